@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+func newBackupCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Create, list, delete and prune backups",
+		Long: `Manage the backups of the databases. Every backup is a new archive of the backup directory named after the time it was taken at, such as backup-20240501T1200.zip, and after its name if it was given one, such as backup-20240501T1200-nightly.zip. "dbproto restore" restores the newest backup unless given the file name or name of another.
+
+Prune removes the backups beyond the newest --keep and older than --keep-days days; a backup kept by either is kept, and named backups and the newest backup are never pruned. "dbproto serve --backup-keep --backup-keep-days" prunes after every backup.
+
+With --destination, or DBPROTO_BACKUP_DESTINATION, backups are also copied to a directory or an S3-compatible bucket, pruned there by the same rules, listed with "list --remote" and downloaded back with "fetch".`,
+	}
+	cmd.PersistentFlags().String("destination", envOrDefault("DBPROTO_BACKUP_DESTINATION", ""), "Directory or s3://bucket/prefix backups are copied to, see dbproto serve --backup-destination (DBPROTO_BACKUP_DESTINATION)")
+	cmd.AddCommand(&cobra.Command{
+		Use:   "create [name]",
+		Short: "Back up the databases",
+		Run:   backupCreateFunc,
+	})
+	var remote bool
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List the backups, newest first",
+		Run:   backupListFunc,
+	}
+	list.Flags().BoolVar(&remote, "remote", false, "List the copies at the backup destination instead")
+	cmd.AddCommand(list)
+	cmd.AddCommand(&cobra.Command{
+		Use:   "fetch [backup]",
+		Short: "Download a backup from the backup destination, by file name or name",
+		Run:   backupFetchFunc,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "delete [backup]",
+		Short: "Delete a backup by file name or name",
+		Run:   backupDeleteFunc,
+	})
+	var keep, keepDays int
+	prune := &cobra.Command{
+		Use:   "prune",
+		Short: "Delete the backups the retention does not keep",
+		Run:   backupPruneFunc,
+	}
+	prune.Flags().IntVar(&keep, "keep", 0, "Number of the newest unnamed backups kept")
+	prune.Flags().IntVar(&keepDays, "keep-days", 0, "Number of days unnamed backups are kept")
+	cmd.AddCommand(prune)
+	return cmd
+}
+
+// openBackupServer opens the server like openServer, copying its backups to the destination of the --destination flag.
+func openBackupServer(cmd *cobra.Command) (*data.Server, error) {
+	server, err := openServer()
+	if err != nil {
+		return nil, err
+	}
+	if location, _ := cmd.Flags().GetString("destination"); location != "" {
+		destination, err := data.ParseBackupDestination(location)
+		if err != nil {
+			return nil, err
+		}
+		server.SetBackupDestination(destination)
+	}
+	return server, nil
+}
+
+func backupCreateFunc(cmd *cobra.Command, args []string) {
+	if len(args) > 1 {
+		fmt.Println("Usage: backup create [name]")
+		return
+	}
+	options := data.BackupOptions{}
+	if len(args) == 1 {
+		options.Name = args[0]
+	}
+	server, err := openBackupServer(cmd)
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	result, err := server.CreateBackup(options)
+	if err != nil {
+		color.Red("Failed to back up databases: %v", err)
+		return
+	}
+	color.Green("Backed up %d files (%d bytes) to %s", result.Files, result.Bytes, result.Path)
+	if result.Copy != "" {
+		color.Green("Copied to %s", result.Copy)
+	}
+}
+
+func backupListFunc(cmd *cobra.Command, args []string) {
+	server, err := openBackupServer(cmd)
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	remote, _ := cmd.Flags().GetBool("remote")
+	list := server.ListBackups
+	if remote {
+		list = server.ListRemoteBackups
+	}
+	backups, err := list()
+	if err != nil {
+		color.Red("Failed to list backups: %v", err)
+		return
+	}
+	if len(backups) == 0 {
+		color.Yellow("No backups")
+		return
+	}
+	for _, backup := range backups {
+		fmt.Printf("%-48s %s %10d bytes", backup.File, backup.Created.Format("2006-01-02 15:04"), backup.Size)
+		if backup.Name != "" {
+			fmt.Printf("  %s", backup.Name)
+		}
+		fmt.Println()
+	}
+}
+
+func backupFetchFunc(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: backup fetch [backup] --destination url")
+		return
+	}
+	server, err := openBackupServer(cmd)
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	backup, err := server.FetchBackup(args[0])
+	if err != nil {
+		color.Red("Failed to fetch backup: %v", err)
+		return
+	}
+	color.Green("Backup downloaded to %s", backup.Path)
+}
+
+func backupDeleteFunc(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: backup delete [backup]")
+		return
+	}
+	server, err := openBackupServer(cmd)
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	backup, err := server.DeleteBackup(args[0])
+	if err != nil {
+		color.Red("Failed to delete backup: %v", err)
+		return
+	}
+	color.Green("Backup %s deleted", backup.File)
+}
+
+func backupPruneFunc(cmd *cobra.Command, args []string) {
+	keep, _ := cmd.Flags().GetInt("keep")
+	keepDays, _ := cmd.Flags().GetInt("keep-days")
+	if keep <= 0 && keepDays <= 0 {
+		fmt.Println("Usage: backup prune --keep N | --keep-days D")
+		return
+	}
+	server, err := openBackupServer(cmd)
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	pruned, err := server.PruneBackups(data.BackupRetention{Keep: keep, KeepDays: keepDays})
+	for _, backup := range pruned {
+		fmt.Printf("Deleted %s\n", backup.Path)
+	}
+	if err != nil {
+		color.Red("Failed to prune backups: %v", err)
+		return
+	}
+	color.Green("Pruned %d backups", len(pruned))
+}
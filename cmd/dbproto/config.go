@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// configFileNames are the names of the configuration files dbproto serve looks for when --config is not given.
+var configFileNames = []string{"dbproto.yaml", "dbproto.yml", "dbproto.toml", "dbproto.json"}
+
+// findConfigFile returns the first of configFileNames in the working directory, or else in /etc/dbproto outside
+// Windows, and an empty string if there is none.
+func findConfigFile() string {
+	dirs := []string{"."}
+	if runtime.GOOS != "windows" {
+		dirs = append(dirs, "/etc/dbproto")
+	}
+	for _, dir := range dirs {
+		for _, name := range configFileNames {
+			path := filepath.Join(dir, name)
+			if info, err := os.Stat(path); err == nil && !info.IsDir() {
+				return path
+			}
+		}
+	}
+	return ""
+}
+
+// parseConfigFile parses the content of a configuration file as YAML, TOML or JSON, by the extension of path.
+func parseConfigFile(path string, content []byte) (map[string]interface{}, error) {
+	var settings map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(content, &settings); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		if err := toml.Unmarshal(content, &settings); err != nil {
+			return nil, err
+		}
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		if err := decoder.Decode(&settings); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown format, expected a .yaml, .yml, .toml or .json file")
+	}
+	return settings, nil
+}
+
+// flattenSettings adds the settings to flat keyed by flag name. The settings of a section are named by the section
+// and their key joined with a dash, so tls: {cert: ...} sets tls-cert, and underscores in keys stand for dashes.
+// Lists set the flag to their items separated by commas.
+func flattenSettings(flat map[string]string, prefix string, settings map[string]interface{}) {
+	for key, value := range settings {
+		name := strings.ReplaceAll(key, "_", "-")
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+		switch value := value.(type) {
+		case map[string]interface{}:
+			flattenSettings(flat, name, value)
+		case []interface{}:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			flat[name] = strings.Join(items, ",")
+		default:
+			flat[name] = fmt.Sprint(value)
+		}
+	}
+}
+
+// applyConfigFile sets the flags named by the settings of the YAML, TOML or JSON file at path to their values, except
+// for flags given on the command line or through their environment variable, DBPROTO_ followed by the flag name in
+// upper case with underscores.
+func applyConfigFile(cmd *cobra.Command, path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read the configuration file: %v", err)
+	}
+	settings, err := parseConfigFile(path, content)
+	if err != nil {
+		return fmt.Errorf("failed to parse the configuration file %s: %v", path, err)
+	}
+	flat := make(map[string]string)
+	flattenSettings(flat, "", settings)
+	for name, value := range flat {
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil || name == "config" {
+			return fmt.Errorf("unknown setting %q in the configuration file %s", name, path)
+		}
+		if flag.Changed || os.Getenv("DBPROTO_"+strings.ToUpper(strings.ReplaceAll(name, "-", "_"))) != "" {
+			continue
+		}
+		if err := flag.Value.Set(value); err != nil {
+			return fmt.Errorf("invalid setting %q in the configuration file %s: %v", name, path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+func newDatabaseCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "database",
+		Short: "Delete or rename databases",
+		Long: `Delete or rename databases with their tables and files. The grants of roles naming a database are not changed when it is renamed. Stop the server first.
+
+The reserved databases cannot be deleted or renamed.`,
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "delete [database]",
+		Short: "Delete a database with its tables and files",
+		Run:   databaseDeleteFunc,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "rename [database] [new name]",
+		Short: "Rename a database",
+		Run:   databaseRenameFunc,
+	})
+	return cmd
+}
+
+func databaseDeleteFunc(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: database delete [database]")
+		return
+	}
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	if err := server.DeleteDatabase(args[0]); err != nil {
+		color.Red("Failed to delete database %s: %v", args[0], err)
+		return
+	}
+	color.Green("Deleted database %s", args[0])
+}
+
+func databaseRenameFunc(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		fmt.Println("Usage: database rename [database] [new name]")
+		return
+	}
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	if err := server.RenameDatabase(args[0], args[1]); err != nil {
+		color.Red("Failed to rename database %s: %v", args[0], err)
+		return
+	}
+	color.Green("Renamed database %s to %s", args[0], args[1])
+}
+
+func newTableCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "table",
+		Short: "Drop, rename or tune tables",
+		Long:  `Drop or rename tables with their files. A table referenced by a foreign key of another table cannot be dropped or renamed until the foreign key is removed. Stop the server first.`,
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "drop [database] [table]",
+		Short: "Drop a table with its files",
+		Run:   tableDropFunc,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "rename [database] [table] [new name]",
+		Short: "Rename a table",
+		Run:   tableRenameFunc,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "concurrency [database] [table] [goroutines]",
+		Short: "Set the number of goroutines that encode and decode the file of a table in chunks",
+		Run:   tableConcurrencyFunc,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "compression [database] [table] [algorithm|none]",
+		Short: "Set the algorithm that compresses the file of a table",
+		Run:   tableCompressionFunc,
+	})
+	return cmd
+}
+
+func tableDropFunc(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		fmt.Println("Usage: table drop [database] [table]")
+		return
+	}
+	db, ok := openDatabase(args[0])
+	if !ok {
+		return
+	}
+	if err := db.DropTable(args[1]); err != nil {
+		color.Red("Failed to drop table %s: %v", args[1], err)
+		return
+	}
+	color.Green("Dropped table %s of database %s", args[1], args[0])
+}
+
+func tableRenameFunc(cmd *cobra.Command, args []string) {
+	if len(args) < 3 {
+		fmt.Println("Usage: table rename [database] [table] [new name]")
+		return
+	}
+	db, ok := openDatabase(args[0])
+	if !ok {
+		return
+	}
+	if err := db.RenameTable(args[1], args[2]); err != nil {
+		color.Red("Failed to rename table %s: %v", args[1], err)
+		return
+	}
+	color.Green("Renamed table %s of database %s to %s", args[1], args[0], args[2])
+}
+
+func tableConcurrencyFunc(cmd *cobra.Command, args []string) {
+	if len(args) < 3 {
+		fmt.Println("Usage: table concurrency [database] [table] [goroutines]")
+		return
+	}
+	concurrency, err := strconv.Atoi(args[2])
+	if err != nil {
+		color.Red("Invalid number of goroutines %q", args[2])
+		return
+	}
+	db, ok := openDatabase(args[0])
+	if !ok {
+		return
+	}
+	table, exists := db.Tables[args[1]]
+	if !exists {
+		color.Red("Table %s not found in database %s", args[1], args[0])
+		return
+	}
+	if err := table.SetConcurrency(concurrency); err != nil {
+		color.Red("Failed to set the concurrency of table %s: %v", args[1], err)
+		return
+	}
+	color.Green("Table %s of database %s is encoded by %d goroutines", args[1], args[0], max(concurrency, 1))
+}
+
+func tableCompressionFunc(cmd *cobra.Command, args []string) {
+	if len(args) < 3 {
+		fmt.Printf("Usage: table compression [database] [table] [%s|none]\n", strings.Join(data.Compressors(), "|"))
+		return
+	}
+	algorithm := args[2]
+	if algorithm == "none" {
+		algorithm = data.CompressionNone
+	}
+	db, ok := openDatabase(args[0])
+	if !ok {
+		return
+	}
+	table, exists := db.Tables[args[1]]
+	if !exists {
+		color.Red("Table %s not found in database %s", args[1], args[0])
+		return
+	}
+	if err := table.SetCompression(algorithm); err != nil {
+		color.Red("Failed to set the compression of table %s: %v", args[1], err)
+		return
+	}
+	color.Green("Table %s of database %s is compressed with %s", args[1], args[0], args[2])
+}
+
+// openDatabase initializes the server and returns the database with the given name, printing why if it cannot.
+func openDatabase(name string) (*data.Database, bool) {
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return nil, false
+	}
+	db, err := server.Database(name)
+	if err != nil {
+		color.Red("Database %s does not exist", name)
+		return nil, false
+	}
+	return db, true
+}
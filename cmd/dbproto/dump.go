@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+func newDumpCmd() *cobra.Command {
+	var keyFile string
+	var unencrypted, compress bool
+	cmd := &cobra.Command{
+		Use:   "dump [file]",
+		Short: "Write every database, its tables and records to a logical dump",
+		Long: `Write every database, with the primary key and options of its tables and their records, to a file, or to the standard output if the file is - or omitted, in a format "dbproto load" reads back on any server, whatever its encryption key. Use it to move data between machines or encryption keys.
+
+The records are decrypted, so the dump is encrypted with the 32 byte AES key of --key-file, or DBPROTO_DUMP_KEY, unless --unencrypted consents to writing them in the clear. --compress compresses it with gzip.`,
+		Run: dumpFunc,
+	}
+	cmd.Flags().StringVar(&keyFile, "key-file", "", "File holding the AES key the dump is encrypted with, DBPROTO_DUMP_KEY if empty")
+	cmd.Flags().BoolVar(&unencrypted, "unencrypted", false, "Write the records unencrypted when no key is given")
+	cmd.Flags().BoolVar(&compress, "compress", false, "Compress the dump with gzip")
+	return cmd
+}
+
+func newLoadCmd() *cobra.Command {
+	var keyFile string
+	cmd := &cobra.Command{
+		Use:   "load [file]",
+		Short: "Create the databases, tables and records of a dump",
+		Long:  `Create the databases and tables of a dump written by "dbproto dump", read from a file, or from the standard input if the file is - or omitted, and write their records with the encryption key of this server. Tables that exist already make the load fail. An encrypted dump needs its key, from --key-file or DBPROTO_DUMP_KEY.`,
+		Run:   loadFunc,
+	}
+	cmd.Flags().StringVar(&keyFile, "key-file", "", "File holding the AES key the dump was encrypted with, DBPROTO_DUMP_KEY if empty")
+	return cmd
+}
+
+// dumpKey returns the key of the --key-file flag, or of DBPROTO_DUMP_KEY, none if neither is set.
+func dumpKey(cmd *cobra.Command) ([]byte, error) {
+	key := os.Getenv("DBPROTO_DUMP_KEY")
+	if keyFile, _ := cmd.Flags().GetString("key-file"); keyFile != "" {
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = strings.TrimRight(string(content), "\r\n")
+	}
+	if key == "" {
+		return nil, nil
+	}
+	return []byte(key), nil
+}
+
+func dumpFunc(cmd *cobra.Command, args []string) {
+	if len(args) > 1 {
+		fmt.Println("Usage: dump [file] --key-file [file] | --unencrypted")
+		return
+	}
+	key, err := dumpKey(cmd)
+	if err != nil {
+		color.Red("Failed to read the dump key: %v", err)
+		return
+	}
+	unencrypted, _ := cmd.Flags().GetBool("unencrypted")
+	compress, _ := cmd.Flags().GetBool("compress")
+	if key == nil && !unencrypted {
+		fmt.Println("Usage: dump [file] --key-file [file] | --unencrypted")
+		return
+	}
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	var w io.Writer = os.Stdout
+	path := "-"
+	if len(args) == 1 {
+		path = args[0]
+	}
+	var file *os.File
+	if path != "-" {
+		if file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+			color.Red("Failed to create dump file: %v", err)
+			return
+		}
+		w = file
+	}
+	stats, err := server.Dump(w, data.DumpOptions{Key: key, Unencrypted: unencrypted, Compress: compress})
+	if file != nil {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		color.Red("Failed to dump databases: %v", err)
+		return
+	}
+	// The dump itself may be on the standard output
+	fmt.Fprintf(os.Stderr, "Dumped %d databases, %d tables and %d records\n", stats.Databases, stats.Tables, stats.Records)
+}
+
+func loadFunc(cmd *cobra.Command, args []string) {
+	if len(args) > 1 {
+		fmt.Println("Usage: load [file] --key-file [file]")
+		return
+	}
+	key, err := dumpKey(cmd)
+	if err != nil {
+		color.Red("Failed to read the dump key: %v", err)
+		return
+	}
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	var r io.Reader = os.Stdin
+	if len(args) == 1 && args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			color.Red("Failed to open dump file: %v", err)
+			return
+		}
+		defer file.Close()
+		r = file
+	}
+	stats, err := server.Load(r, data.LoadOptions{Key: key})
+	if err != nil {
+		color.Red("Failed to load dump: %v", err)
+		return
+	}
+	color.Green("Loaded %d databases, %d tables and %d records", stats.Databases, stats.Tables, stats.Records)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf8"
+
+	"github.com/Malpizarr/dbproto/pkg/imports"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+func newImportCmd() *cobra.Command {
+	var format, delimiter string
+	var fields map[string]string
+	var batchSize, maxErrors int
+	var noInfer bool
+	cmd := &cobra.Command{
+		Use:   "import [database] [table] [filename]",
+		Short: "Insert the records of a file into a table",
+		Long: `Insert a record into a table for every row of a CSV file, every object of a JSON array, or every line of an NDJSON file, read from a file or from the standard input if the filename is -. Files are read as a stream, so they may be larger than memory.
+
+The header row of a CSV file names the fields, or --map renames its columns, such as --map "E-mail=email,Notes=" where an empty field skips the column. CSV values get the types the table schema declares; the others are inferred, numbers and true or false becoming numbers and booleans unless --no-infer keeps them as strings. JSON values keep their types.
+
+Records are inserted in batches of --batch-size. Records the table rejects, such as duplicate keys, are reported with their line, or their position in a JSON array, and the others are inserted; --max-errors stops the import after that many rejected records.`,
+		Run: importFunc,
+	}
+	cmd.Flags().StringVarP(&format, "format", "f", "csv", "Format of the file (csv, json, ndjson)")
+	cmd.Flags().StringVar(&delimiter, "delimiter", ",", "Field delimiter of the csv format")
+	cmd.Flags().StringToStringVar(&fields, "map", nil, "Fields the columns of a CSV header are imported as, such as E-mail=email")
+	cmd.Flags().IntVar(&batchSize, "batch-size", imports.DefaultBatchSize, "Number of records inserted together")
+	cmd.Flags().IntVar(&maxErrors, "max-errors", 0, "Stop after this many rejected records, 0 for no limit")
+	cmd.Flags().BoolVar(&noInfer, "no-infer", false, "Keep the CSV values of the fields the schema does not declare as strings")
+	return cmd
+}
+
+func importFunc(cmd *cobra.Command, args []string) {
+	if len(args) != 3 {
+		fmt.Println("Usage: import [database] [table] [filename] --format=[csv|json|ndjson] --delimiter=[char] --map=[column=field,...] --batch-size=[n] --max-errors=[n] --no-infer")
+		return
+	}
+	databaseName, tableName, filename := args[0], args[1], args[2]
+
+	format, _ := cmd.Flags().GetString("format")
+	delimiter, _ := cmd.Flags().GetString("delimiter")
+	if format != "csv" && format != "json" && format != "ndjson" {
+		color.Red("Unsupported format %s", format)
+		return
+	}
+	comma, size := utf8.DecodeRuneInString(delimiter)
+	if size == 0 || size != len(delimiter) {
+		color.Red("The delimiter must be a single character")
+		return
+	}
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	database, exists := server.Databases[databaseName]
+	if !exists {
+		color.Red("Database %s does not exist", databaseName)
+		return
+	}
+	table, exists := database.Tables[tableName]
+	if !exists {
+		color.Red("Table %s does not exist", tableName)
+		return
+	}
+
+	var in io.Reader = os.Stdin
+	if filename != "-" {
+		file, err := os.Open(filename)
+		if err != nil {
+			color.Red("Error opening import file: %v", err)
+			return
+		}
+		defer file.Close()
+		in = file
+	}
+
+	fields, _ := cmd.Flags().GetStringToString("map")
+	batchSize, _ := cmd.Flags().GetInt("batch-size")
+	maxErrors, _ := cmd.Flags().GetInt("max-errors")
+	noInfer, _ := cmd.Flags().GetBool("no-infer")
+	var result imports.Result
+	switch format {
+	case "csv":
+		options := imports.CSVOptions{Comma: comma, Fields: fields, BatchSize: batchSize, MaxErrors: maxErrors, NoInfer: noInfer}
+		result, err = imports.ImportCSV(table, in, options)
+	case "json":
+		result, err = imports.ImportJSON(table, in, imports.JSONOptions{BatchSize: batchSize, MaxErrors: maxErrors})
+	case "ndjson":
+		result, err = imports.ImportNDJSON(table, in, imports.JSONOptions{BatchSize: batchSize, MaxErrors: maxErrors})
+	}
+	for _, rowErr := range result.Errors {
+		color.Red("Rejected %v", rowErr)
+	}
+	if err != nil && result.Inserted > 0 {
+		color.Red("Error importing records after %d were inserted: %v", result.Inserted, err)
+		return
+	}
+	if err != nil {
+		color.Red("Error importing records: %v", err)
+		return
+	}
+	if result.Stopped {
+		color.Red("Import stopped after %d rejected records, %d records were inserted", len(result.Errors), result.Inserted)
+		return
+	}
+	color.Green("%d records were imported into %s, %d were rejected", result.Inserted, tableName, len(result.Errors))
+}
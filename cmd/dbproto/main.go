@@ -2,33 +2,94 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/Malpizarr/dbproto/pkg/data"
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
 	"github.com/Malpizarr/dbproto/pkg/exports"
 	"github.com/fatih/color"
 	"github.com/spf13/cobra"
-	"google.golang.org/protobuf/types/known/structpb"
+	"github.com/spf13/pflag"
 )
 
+// stdin is shared by the prompt and the commands that read further input, such as sql, so that
+// input buffered by one is not lost to the other.
+var stdin = bufio.NewReader(os.Stdin)
+
+// bytesFormat is how binary values are printed, "hex" or "base64", set with the --bytes flag.
+var bytesFormat string
+
 func main() {
 	rootCmd := &cobra.Command{
 		Use:   "dbproto",
 		Short: "dbproto is a CLI for database interactions",
 		Long:  `dbproto is a CLI that allows interactive database interactions.`,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if bytesFormat != "hex" && bytesFormat != "base64" {
+				return fmt.Errorf("invalid --bytes format %q, expected hex or base64", bytesFormat)
+			}
+			return nil
+		},
+		PersistentPostRun: func(cmd *cobra.Command, args []string) {
+			closeOpenedServers()
+		},
 	}
+	rootCmd.PersistentFlags().StringVar(&bytesFormat, "bytes", "hex", "How binary values are printed (hex, base64)")
+	rootCmd.PersistentFlags().StringVar(&tenantName, "tenant", envOrDefault("DBPROTO_TENANT", ""), "Tenant the command works on, the root server if empty (DBPROTO_TENANT)")
 
 	rootCmd.AddCommand(newListCmd())
 	rootCmd.AddCommand(newExportCmd())
+	rootCmd.AddCommand(newImportCmd())
+	rootCmd.AddCommand(newRecommendCmd())
+	rootCmd.AddCommand(newStatsCmd())
+	rootCmd.AddCommand(newExplainCmd())
+	rootCmd.AddCommand(newDescribeCmd())
+	rootCmd.AddCommand(newDatabaseCmd())
+	rootCmd.AddCommand(newTableCmd())
+	rootCmd.AddCommand(newServeCmd())
+	rootCmd.AddCommand(newOpenAPICmd())
+	rootCmd.AddCommand(newBackupCmd())
+	rootCmd.AddCommand(newRestoreCmd())
+	rootCmd.AddCommand(newDumpCmd())
+	rootCmd.AddCommand(newLoadCmd())
+	rootCmd.AddCommand(newVerifyCmd())
+	rootCmd.AddCommand(newRecoveryCmd())
+	rootCmd.AddCommand(newRetentionCmd())
+	rootCmd.AddCommand(newWriteBehindCmd())
+	rootCmd.AddCommand(newSegmentationCmd())
+	rootCmd.AddCommand(newMigrateCmd())
+	rootCmd.AddCommand(newKeyCmd())
+	rootCmd.AddCommand(newPlaintextCmd())
+	rootCmd.AddCommand(newAPIKeyCmd())
+	rootCmd.AddCommand(newUserCmd())
+	rootCmd.AddCommand(newRoleCmd())
+	rootCmd.AddCommand(newTenantCmd())
+	rootCmd.AddCommand(newSQLCmd())
+
+	// Commands given on the command line run once, which is how service managers start the server.
+	if len(os.Args) > 1 {
+		if err := rootCmd.Execute(); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
 
-	reader := bufio.NewReader(os.Stdin)
 	fmt.Println("Welcome to dbproto CLI. Type 'exit' to quit.")
 	for {
 		fmt.Print("> ")
-		input, _ := reader.ReadString('\n')
+		input, _ := stdin.ReadString('\n')
 		input = strings.TrimSpace(input)
 		if input == "exit" {
 			color.Yellow("Exiting dbproto CLI.")
@@ -36,6 +97,7 @@ func main() {
 		}
 
 		args := strings.Fields(input)
+		resetFlags(rootCmd)
 		rootCmd.SetArgs(args)
 		if err := rootCmd.Execute(); err != nil {
 			color.Red("Error: %v", err)
@@ -43,6 +105,20 @@ func main() {
 	}
 }
 
+// resetFlags restores every flag to its default value, so flags given to one command in the prompt
+// do not leak into the next one.
+func resetFlags(cmd *cobra.Command) {
+	reset := func(flag *pflag.Flag) {
+		flag.Value.Set(flag.DefValue)
+		flag.Changed = false
+	}
+	cmd.Flags().VisitAll(reset)
+	cmd.PersistentFlags().VisitAll(reset)
+	for _, child := range cmd.Commands() {
+		resetFlags(child)
+	}
+}
+
 func newListCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "list [database] [table]",
@@ -55,20 +131,29 @@ func newListCmd() *cobra.Command {
 }
 
 func newExportCmd() *cobra.Command {
-	var format string
+	var format, dialect string
+	var denormalize bool
+	var depth int
 	cmd := &cobra.Command{
 		Use:   "export [database] [table] [filename]",
 		Short: "Export records of a table to a specified format",
-		Long:  `Export all records from a specified table in a database to a specified format (e.g., CSV, XML).`,
+		Long:  `Export all records from a specified table in a database to a specified format (e.g., CSV, XML, JSON, Parquet), in a file, or on the standard output if the filename is -. CSV, XML and JSON exports are streamed record by record. --where, --fields, --sort and --limit export only the records and fields selected, in the order of a query, rather than the whole table; --where takes the conditions of a WHERE clause of "dbproto sql". The sql format writes the CREATE TABLE and INSERT statements of a table in the SQL of --dialect, to migrate it into a relational database. With --denormalize, the records referenced by the foreign keys of the table are embedded in each exported record.`,
 		Run:   exportFunc,
 	}
-	cmd.Flags().StringVarP(&format, "format", "f", "csv", "Format to export (csv, xml)")
+	cmd.Flags().StringVarP(&format, "format", "f", "csv", "Format to export (csv, xml, json, parquet, sql)")
+	cmd.Flags().StringVar(&dialect, "dialect", exports.SQLite, "SQL dialect of the sql format (sqlite, mysql, postgres)")
+	cmd.Flags().String("where", "", "Export only the records matching conditions, such as \"status = 'active' AND age >= 18\"")
+	cmd.Flags().StringSlice("fields", nil, "Export only these top-level fields, such as id,email")
+	cmd.Flags().String("sort", "", "Field to sort the records by")
+	cmd.Flags().Int("limit", 0, "Maximum number of records to export")
+	cmd.Flags().BoolVar(&denormalize, "denormalize", false, "Embed the records referenced by foreign keys, json format only")
+	cmd.Flags().IntVar(&depth, "depth", 1, "Levels of foreign keys followed by --denormalize")
 	return cmd
 }
 
 func exportFunc(cmd *cobra.Command, args []string) {
 	if len(args) != 3 {
-		fmt.Println("Usage: export [database] [table] [filename] --format=[csv|xml]")
+		fmt.Println("Usage: export [database] [table] [filename] --format=[csv|xml|json|parquet|sql] --dialect=[sqlite|mysql|postgres] --where=[conditions] --fields=[field,...] --sort=[field] --limit=[n] --denormalize --depth=[levels]")
 		return
 	}
 	databaseName, tableName, filename := args[0], args[1], args[2]
@@ -78,9 +163,15 @@ func exportFunc(cmd *cobra.Command, args []string) {
 		color.Red("Error retrieving format flag: %v", err)
 		return
 	}
+	denormalize, _ := cmd.Flags().GetBool("denormalize")
+	depth, _ := cmd.Flags().GetInt("depth")
+	if denormalize && format != "json" {
+		color.Red("Denormalized exports are only supported in json format")
+		return
+	}
 
-	server := data.NewServer()
-	if err := server.Initialize(); err != nil {
+	server, err := openServer()
+	if err != nil {
 		color.Red("Failed to initialize server: %v", err)
 		return
 	}
@@ -97,34 +188,131 @@ func exportFunc(cmd *cobra.Command, args []string) {
 		return
 	}
 
-	records, err := table.SelectAll()
+	query, err := exportQuery(cmd, table)
 	if err != nil {
-		color.Red("Error retrieving records from table %s: %v", tableName, err)
+		color.Red("Invalid query: %v", err)
+		return
+	}
+	if denormalize && query != nil {
+		color.Red("Denormalized exports cannot be filtered, projected, sorted or limited")
 		return
 	}
 
-	switch format {
-	case "csv":
-		if err := exports.ExportRecordsToCSV(records, filename); err != nil {
-			color.Red("Error exporting records to CSV: %v", err)
+	// CSV, JSON and XML stream the records of the table; the other formats type their columns with every record first
+	var iter exports.RecordIterator
+	var protoRecords []*dbdata.Record
+	switch {
+	case format != "csv" && format != "xml" && format != "json" && format != "sql" && format != "parquet":
+		color.Red("Unsupported format %s", format)
+		return
+	case denormalize:
+		records, err := database.Denormalize(tableName, depth)
+		if err != nil {
+			color.Red("Error retrieving records from table %s: %v", tableName, err)
 			return
 		}
-	case "xml":
-		if err := exports.ExportRecordsToXML(records, filename); err != nil {
-			color.Red("Error exporting records to XML: %v", err)
+		if protoRecords, err = toProtoRecords(records); err != nil {
+			color.Red("Error converting records from table %s: %v", tableName, err)
 			return
 		}
+		iter = exports.SliceIterator(protoRecords)
 	default:
-		color.Red("Unsupported format %s", format)
+		if query != nil {
+			iter, err = table.IterateQuery(context.Background(), *query)
+		} else {
+			iter, err = table.Iterate(context.Background())
+		}
+		if err == nil && (format == "sql" || format == "parquet") {
+			protoRecords, err = exports.CollectRecords(iter)
+		}
+		if err != nil {
+			color.Red("Error retrieving records from table %s: %v", tableName, err)
+			return
+		}
+	}
+
+	// A projection only keeps the declared types and primary key of the fields it exports
+	schema, primaryKey := table.Options.Schema, table.PrimaryKey
+	if query != nil && len(query.Fields) > 0 {
+		schema, primaryKey = make(map[string]string), ""
+		for _, field := range query.Fields {
+			if fieldType, declared := table.Options.Schema[field]; declared {
+				schema[field] = fieldType
+			}
+			if field == table.PrimaryKey {
+				primaryKey = field
+			}
+		}
+	}
+
+	// The file - is the standard output, for pipes
+	out := os.Stdout
+	if filename != "-" {
+		if out, err = os.Create(filename); err != nil {
+			color.Red("Error creating export file: %v", err)
+			return
+		}
+	}
+	switch format {
+	case "csv":
+		err = exports.ExportCSV(out, iter)
+	case "xml":
+		err = exports.ExportXML(out, iter)
+	case "json":
+		err = exports.ExportJSON(out, iter)
+	case "sql":
+		dialect, _ := cmd.Flags().GetString("dialect")
+		options := exports.SQLOptions{Dialect: dialect, Table: tableName, PrimaryKey: primaryKey, Schema: schema}
+		err = exports.WriteRecordsSQL(out, protoRecords, options)
+	case "parquet":
+		err = exports.WriteRecordsParquet(out, protoRecords, schema)
+	}
+	if filename != "-" {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		color.Red("Error exporting records to %s: %v", strings.ToUpper(format), err)
 		return
 	}
 
-	color.Green("Records were successfully exported to %s in %s format", filename, format)
+	if filename != "-" {
+		color.Green("Records were successfully exported to %s in %s format", filename, format)
+	}
+}
+
+// exportQuery returns the query on the table of the --where, --fields, --sort and --limit flags of export, nil if none
+// is set.
+func exportQuery(cmd *cobra.Command, table *data.Table) (*data.Query, error) {
+	where, _ := cmd.Flags().GetString("where")
+	fields, _ := cmd.Flags().GetStringSlice("fields")
+	sortBy, _ := cmd.Flags().GetString("sort")
+	limit, _ := cmd.Flags().GetInt("limit")
+	if where == "" && len(fields) == 0 && sortBy == "" && limit == 0 {
+		return nil, nil
+	}
+	if limit < 0 {
+		return nil, fmt.Errorf("limit must not be negative")
+	}
+	// Equality conditions become filters, which indexes serve, like in the queries of dbproto sql
+	builder := table.NewQuery().Select(fields...).OrderBy(sortBy).Limit(limit)
+	if where != "" {
+		conditions, err := data.ParseConditions(where)
+		if err != nil {
+			return nil, err
+		}
+		for _, condition := range conditions {
+			builder.Where(condition.Field, condition.Operator, condition.Value)
+		}
+	}
+	query, err := builder.Query()
+	return &query, err
 }
 
 func listFunc(cmd *cobra.Command, args []string) {
-	server := data.NewServer()
-	if err := server.Initialize(); err != nil {
+	server, err := openServer()
+	if err != nil {
 		color.Red("Failed to initialize server: %v", err)
 		return
 	}
@@ -170,8 +358,8 @@ func listFunc(cmd *cobra.Command, args []string) {
 	color.Magenta("Records in %s.%s:", databaseName, tableName)
 	fmt.Fprintf(w, "Key\tValue\t\n")
 	for i, record := range records {
-		for key, val := range record.Fields {
-			fmt.Fprintf(w, "%s\t%v\t\n", color.YellowString(key), formatProtoValue(val))
+		for key, val := range record {
+			fmt.Fprintf(w, "%s\t%v\t\n", color.YellowString(key), formatValue(val))
 		}
 		if i < len(records)-1 {
 			fmt.Fprintln(w, "\t")
@@ -179,18 +367,1009 @@ func listFunc(cmd *cobra.Command, args []string) {
 	}
 }
 
-func formatProtoValue(val *structpb.Value) string {
-	switch x := val.Kind.(type) {
-	case *structpb.Value_StringValue:
-		return fmt.Sprintf("\"%s\"", x.StringValue)
-	case *structpb.Value_NumberValue:
-		if float64(int(x.NumberValue)) == x.NumberValue {
-			return fmt.Sprintf("%d", int(x.NumberValue))
+func newRecommendCmd() *cobra.Command {
+	var serverURL string
+	cmd := &cobra.Command{
+		Use:   "recommend [database] [table]",
+		Short: "Show index recommendations from a running server",
+		Long:  `Show the fields whose queries caused full scans on a running server, and how many queries an index on them would have served.`,
+		Run:   recommendFunc,
+	}
+	cmd.Flags().StringVarP(&serverURL, "server", "s", "http://localhost:8080", "Address of the running dbproto HTTP server")
+	return cmd
+}
+
+func recommendFunc(cmd *cobra.Command, args []string) {
+	serverURL, err := cmd.Flags().GetString("server")
+	if err != nil {
+		color.Red("Error retrieving server flag: %v", err)
+		return
+	}
+
+	resp, err := http.Get(strings.TrimSuffix(serverURL, "/") + "/v1/stats")
+	if err != nil {
+		color.Red("Failed to reach server at %s: %v", serverURL, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		color.Red("Server returned %s", resp.Status)
+		return
+	}
+
+	var stats struct {
+		Recommendations map[string][]data.IndexRecommendation `json:"recommendations"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		color.Red("Failed to decode stats: %v", err)
+		return
+	}
+
+	// The recommendations are matched by their database and table, as the keys join both with an underscore
+	found := false
+	for _, recommendations := range stats.Recommendations {
+		for _, recommendation := range recommendations {
+			if len(args) > 0 && recommendation.Database != args[0] || len(args) > 1 && recommendation.Table != args[1] {
+				continue
+			}
+			found = true
+			color.Cyan("%s.%s: %s", recommendation.Database, recommendation.Table, recommendation.Message)
+		}
+	}
+	if !found {
+		color.Green("No index recommendations")
+	}
+}
+
+func newExplainCmd() *cobra.Command {
+	var sortBy string
+	var limit, offset int
+	cmd := &cobra.Command{
+		Use:   "explain [database] [table] [field=value...]",
+		Short: "Show the execution plan of a query",
+		Long:  `Show which index a query on a table would use, its selectivity, and the estimated number of records it has to examine.`,
+		Run:   explainFunc,
+	}
+	cmd.Flags().StringVar(&sortBy, "sort", "", "Field to sort the records by")
+	cmd.Flags().IntVar(&limit, "limit", 0, "Maximum number of records to return")
+	cmd.Flags().IntVar(&offset, "offset", 0, "Number of records to skip")
+	return cmd
+}
+
+func explainFunc(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		fmt.Println("Usage: explain [database] [table] [field=value...] --sort=[field] --limit=[n] --offset=[n]")
+		return
+	}
+	databaseName, tableName := args[0], args[1]
+
+	query := data.Query{Filters: make(map[string]interface{})}
+	for _, arg := range args[2:] {
+		field, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			color.Red("Invalid filter %s, expected field=value", arg)
+			return
+		}
+		query.Filters[field] = parseValue(value)
+	}
+	query.SortBy, _ = cmd.Flags().GetString("sort")
+	query.Limit, _ = cmd.Flags().GetInt("limit")
+	query.Offset, _ = cmd.Flags().GetInt("offset")
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+
+	database, exists := server.Databases[databaseName]
+	if !exists {
+		color.Red("Database %s does not exist", databaseName)
+		return
+	}
+
+	table, exists := database.Tables[tableName]
+	if !exists {
+		color.Red("Table %s does not exist", tableName)
+		return
+	}
+
+	explanation := table.Explain(query)
+
+	color.Magenta("Execution plan for %s.%s:", databaseName, tableName)
+	if explanation.FullScan {
+		color.Yellow("  Full scan of %d records", explanation.TotalRecords)
+	} else {
+		color.Green("  Index on '%s' (selectivity %.3f)", explanation.Plan.IndexToUse, explanation.Selectivity)
+	}
+	for field, selectivity := range explanation.Candidates {
+		fmt.Printf("  Candidate index '%s': selectivity %.3f\n", field, selectivity)
+	}
+	if explanation.Plan.SortBy != "" {
+		fmt.Printf("  Sort by '%s'\n", explanation.Plan.SortBy)
+	}
+	fmt.Printf("  Records to scan: %d\n", explanation.RecordsToScan)
+	fmt.Printf("  Estimated rows: %d\n", explanation.EstimatedRows)
+	fmt.Printf("  Estimated cost: %.1f\n", explanation.EstimatedCost)
+}
+
+func newDescribeCmd() *cobra.Command {
+	var asJSON bool
+	cmd := &cobra.Command{
+		Use:   "describe [database] [table]",
+		Short: "Show the structure of a table",
+		Long:  `Show the primary key, declared schema, fields, indexes and constraints of a table, with its number of records and file size.`,
+		Run:   describeFunc,
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the description as JSON")
+	return cmd
+}
+
+func describeFunc(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		fmt.Println("Usage: describe [database] [table] --json")
+		return
+	}
+	databaseName, tableName := args[0], args[1]
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+
+	database, err := server.Database(databaseName)
+	if err != nil {
+		color.Red("Database %s does not exist", databaseName)
+		return
+	}
+	description, err := database.DescribeTable(tableName)
+	if errors.Is(err, data.ErrTableNotFound) {
+		color.Red("Table %s does not exist", tableName)
+		return
+	} else if err != nil {
+		color.Red("Failed to describe table: %v", err)
+		return
+	}
+
+	if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(description); err != nil {
+			color.Red("Failed to encode description: %v", err)
+		}
+		return
+	}
+
+	color.Magenta("Table %s.%s:", databaseName, tableName)
+	fmt.Printf("  Primary key: %s\n", description.PrimaryKey)
+	fmt.Printf("  Records: %d\n", description.Records)
+	fmt.Printf("  File size: %d bytes\n", description.FileSize)
+	if description.Segments > 0 {
+		fmt.Printf("  Segments: %d\n", description.Segments)
+	}
+	var options []string
+	if description.AutoID {
+		options = append(options, "autoID")
+	}
+	if description.Timestamps {
+		options = append(options, "timestamps")
+	}
+	if description.ClientEncrypted {
+		options = append(options, "clientEncrypted")
+	}
+	if description.Plaintext {
+		options = append(options, "plaintext")
+	}
+	if description.Compression != "" {
+		options = append(options, fmt.Sprintf("compression(%s)", description.Compression))
+	}
+	if description.Concurrency > 1 {
+		options = append(options, fmt.Sprintf("concurrency(%d)", description.Concurrency))
+	}
+	if description.WriteBehind != nil {
+		options = append(options, fmt.Sprintf("writeBehind(%s)", formatWriteBehind(description.WriteBehind)))
+	}
+	if description.Segmentation != nil {
+		options = append(options, fmt.Sprintf("segmented(%s)", formatSegmentation(description.Segmentation)))
+	}
+	if description.InMemory {
+		options = append(options, "inMemory")
+	}
+	if len(options) > 0 {
+		fmt.Printf("  Options: %s\n", strings.Join(options, ", "))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	color.Cyan("  Fields:")
+	for _, field := range description.Fields {
+		declared := "-"
+		if fieldType, ok := description.Schema[field.Field]; ok {
+			declared = fieldType
+		}
+		fmt.Fprintf(w, "    %s\t%s\t%s\t%d records\n", field.Field, declared, strings.Join(field.Kinds, ","), field.Records)
+	}
+	var undescribed []string
+	for field := range description.Schema {
+		if !describesField(description.Fields, field) {
+			undescribed = append(undescribed, field)
+		}
+	}
+	sort.Strings(undescribed)
+	for _, field := range undescribed {
+		fmt.Fprintf(w, "    %s\t%s\t-\t0 records\n", field, description.Schema[field])
+	}
+	w.Flush()
+	color.Cyan("  Indexes:")
+	for _, index := range description.Indexes {
+		fmt.Fprintf(w, "    %s\t%d entries\n", index.Field, index.Entries)
+	}
+	w.Flush()
+
+	if len(description.ForeignKeys) > 0 || len(description.Rules) > 0 || len(description.ComputedFields) > 0 {
+		color.Cyan("  Constraints:")
+		for _, foreignKey := range description.ForeignKeys {
+			fmt.Printf("    %s references %s\n", foreignKey.Field, foreignKey.Table)
+		}
+		fields := make([]string, 0, len(description.Rules))
+		for field := range description.Rules {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			rule := description.Rules[field]
+			if rule.Pattern != "" {
+				fmt.Printf("    %s matches %s\n", field, rule.Pattern)
+			}
+			if rule.Min != nil {
+				fmt.Printf("    %s >= %v\n", field, *rule.Min)
+			}
+			if rule.Max != nil {
+				fmt.Printf("    %s <= %v\n", field, *rule.Max)
+			}
+			if len(rule.Enum) > 0 {
+				fmt.Printf("    %s in %v\n", field, rule.Enum)
+			}
+		}
+		for _, computed := range description.ComputedFields {
+			when := "on write"
+			if computed.OnRead {
+				when = "on read"
+			}
+			fmt.Printf("    %s = %s (%s)\n", computed.Name, computed.Expression, when)
+		}
+	}
+}
+
+// describesField reports whether the fields include the named one.
+func describesField(fields []data.FieldSummary, name string) bool {
+	for _, field := range fields {
+		if field.Field == name {
+			return true
 		}
-		return fmt.Sprintf("%.3f", x.NumberValue)
-	case *structpb.Value_BoolValue:
-		return fmt.Sprintf("%t", x.BoolValue)
+	}
+	return false
+}
+
+func newRestoreCmd() *cobra.Command {
+	var preview, yes, verify, dryRun bool
+	var at, commitLogDir string
+	cmd := &cobra.Command{
+		Use:   "restore [backup]",
+		Short: "Preview, verify or restore a backup",
+		Long: `Compare a backup, the newest one unless given the path, file name or name of another, see dbproto backup list, with the live databases and restore it. Without --yes, a restore that would overwrite existing data is refused after showing what would change. Every file of the backup is checked against the manifest the backup was written with before anything is written, and --dry-run runs that check and shows what would change without restoring. With --verify, the backup is restored into a temporary directory and checked instead, without touching the live data.
+
+With --at, the databases are restored to their state at that time, such as 2024-05-01T12:30:00Z: the newest backup finished by then is restored and the commit log written by "dbproto serve --commit-log-dir" is replayed up to that time. It always overwrites the live data, so it requires --yes.`,
+		Run: restoreFunc,
+	}
+	cmd.Flags().BoolVar(&preview, "preview", false, "Only show the backup contents and how they differ from the live data")
+	cmd.Flags().BoolVar(&yes, "yes", false, "Confirm overwriting existing data")
+	cmd.Flags().BoolVar(&verify, "verify", false, "Only check that every table of the backup can be restored")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Check the backup against its manifest and show what a restore would change, without restoring it")
+	cmd.Flags().StringVar(&at, "at", "", "Restore the databases to their state at this RFC 3339 time from a backup and the commit log")
+	cmd.Flags().StringVar(&commitLogDir, "commit-log-dir", envOrDefault("DBPROTO_COMMIT_LOG_DIR", ""), "Directory of the commit log replayed by --at (DBPROTO_COMMIT_LOG_DIR)")
+	return cmd
+}
+
+func restoreFunc(cmd *cobra.Command, args []string) {
+	if len(args) > 1 {
+		fmt.Println("Usage: restore [backup] --preview --dry-run --verify --yes")
+		return
+	}
+	backupPath := ""
+	if len(args) == 1 {
+		backupPath = args[0]
+	}
+	previewOnly, _ := cmd.Flags().GetBool("preview")
+	yes, _ := cmd.Flags().GetBool("yes")
+	verifyOnly, _ := cmd.Flags().GetBool("verify")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	if at, _ := cmd.Flags().GetString("at"); at != "" {
+		if backupPath != "" || verifyOnly {
+			fmt.Println("Usage: restore --at time [--commit-log-dir dir] --preview --yes")
+			return
+		}
+		commitLogDir, _ := cmd.Flags().GetString("commit-log-dir")
+		restoreToTime(at, commitLogDir, previewOnly, yes)
+		return
+	}
+
+	// The backups of the root server are verified without loading its databases, those of a tenant once it is found.
+	server := data.NewServer()
+	if !verifyOnly || tenantName != "" {
+		var err error
+		if server, err = openServer(); err != nil {
+			color.Red("Failed to initialize server: %v", err)
+			return
+		}
+	}
+	if verifyOnly {
+		verification, err := server.VerifyBackup(backupPath)
+		if err != nil {
+			color.Red("Failed to verify backup: %v", err)
+			return
+		}
+		printBackupVerification(verification)
+		return
+	}
+
+	if previewOnly {
+		preview, err := server.PreviewRestore(backupPath)
+		if err != nil {
+			color.Red("Failed to preview restore: %v", err)
+			return
+		}
+		printRestorePreview(preview)
+		return
+	}
+
+	preview, err := server.Restore(data.RestoreOptions{Path: backupPath, ConfirmOverwrite: yes, DryRun: dryRun})
+	if dryRun && err == nil {
+		printRestorePreview(preview)
+		if preview.Verified {
+			color.Green("Every file of %s matches its manifest", preview.Archive)
+		} else {
+			color.Yellow("%s has no manifest, only its paths and checksums were checked", preview.Archive)
+		}
+		fmt.Printf("Dry run: %d files would be written, %d of them overwritten. Nothing was changed.\n", len(preview.Files), len(preview.ChangedFiles))
+		return
+	}
+	if errors.Is(err, data.ErrRestoreNotConfirmed) {
+		printRestorePreview(preview)
+		color.Yellow("The restore would overwrite %d files. Run again with --yes to confirm.", len(preview.ChangedFiles))
+		return
+	}
+	if err != nil {
+		color.Red("Failed to restore backup: %v", err)
+		return
+	}
+	color.Green("Restored %d files from %s", len(preview.Files), preview.Archive)
+}
+
+// restoreToTime restores the databases to their state at the RFC 3339 time at, from the newest backup finished by
+// then and the commit log in commitLogDir.
+func restoreToTime(at, commitLogDir string, previewOnly, yes bool) {
+	target, err := time.Parse(time.RFC3339Nano, at)
+	if err != nil {
+		color.Red("Invalid --at %q, expected an RFC 3339 time such as 2024-05-01T12:30:00Z", at)
+		return
+	}
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	if previewOnly || !yes {
+		report, err := server.PreviewRestoreToTime(target, commitLogDir)
+		if err != nil {
+			color.Red("Failed to preview restore: %v", err)
+			return
+		}
+		printRestorePreview(report.Restore)
+		fmt.Printf("Backup %s, finished at %s\n", report.Backup, report.Finished.Format(time.RFC3339))
+		fmt.Printf("%d commit log entries to replay up to %s\n", report.Entries, target.Format(time.RFC3339))
+		if !previewOnly {
+			color.Yellow("The restore overwrites the live data. Run again with --yes to confirm.")
+		}
+		return
+	}
+
+	report, err := server.RestoreToTime(target, commitLogDir)
+	if err != nil {
+		color.Red("Failed to restore to %s: %v", target.Format(time.RFC3339), err)
+		return
+	}
+	for _, table := range report.Skipped {
+		color.Yellow("Skipped the commit log entries of %s, which is not in the restored databases", table)
+	}
+	color.Green("Restored %s and replayed %d commit log entries up to %s", report.Backup, report.Entries, target.Format(time.RFC3339))
+}
+
+func newVerifyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "verify [database] [table]",
+		Short: "Check record checksums",
+		Long:  `Check every record of all tables, a database or a single table against its checksum and list the corrupted records.`,
+		Run:   verifyFunc,
+	}
+}
+
+func verifyFunc(cmd *cobra.Command, args []string) {
+	if len(args) > 2 {
+		fmt.Println("Usage: verify [database] [table]")
+		return
+	}
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+
+	corrupted, err := server.CorruptRecords()
+	if err != nil {
+		color.Red("Failed to verify records: %v", err)
+		return
+	}
+
+	prefix := ""
+	if len(args) > 0 {
+		prefix = args[0] + "_"
+		if len(args) > 1 {
+			prefix += args[1]
+		}
+	}
+
+	found := false
+	for name, keys := range corrupted {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		found = true
+		color.Red("%s: %d corrupted records", name, len(keys))
+		for _, key := range keys {
+			fmt.Printf("  %s\n", key)
+		}
+	}
+	if !found {
+		color.Green("All records match their checksums")
+	}
+}
+
+func newRecoveryCmd() *cobra.Command {
+	var retry, restore, discard bool
+	var backup string
+	cmd := &cobra.Command{
+		Use:   "recovery [database] [table]",
+		Short: "List and recover quarantined tables",
+		Long:  `List the tables quarantined because they failed to load. With --retry a quarantined table is loaded again, with --restore it is replaced by its copy in a backup, and with --discard its files are deleted.`,
+		Run:   recoveryFunc,
+	}
+	cmd.Flags().BoolVar(&retry, "retry", false, "Load the quarantined table again")
+	cmd.Flags().BoolVar(&restore, "restore", false, "Replace the quarantined table with its copy in the backup")
+	cmd.Flags().BoolVar(&discard, "discard", false, "Delete the files of the quarantined table")
+	cmd.Flags().StringVar(&backup, "backup", "", "Backup used by --restore instead of the default one")
+	return cmd
+}
+
+func recoveryFunc(cmd *cobra.Command, args []string) {
+	retry, _ := cmd.Flags().GetBool("retry")
+	restore, _ := cmd.Flags().GetBool("restore")
+	discard, _ := cmd.Flags().GetBool("discard")
+	backup, _ := cmd.Flags().GetString("backup")
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+
+	if !retry && !restore && !discard {
+		report, err := server.RecoveryReport()
+		if err != nil {
+			color.Red("Failed to read the recovery report: %v", err)
+			return
+		}
+		if !report.SafeMode {
+			color.Green("No table is quarantined")
+			return
+		}
+		color.Yellow("%d tables are quarantined:", len(report.Quarantined))
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, table := range report.Quarantined {
+			fmt.Fprintf(w, "  %s.%s\t%s\t%s\n", table.Database, table.Table, table.QuarantinedAt.Format(time.RFC3339), table.Error)
+		}
+		w.Flush()
+		return
+	}
+
+	if len(args) != 2 {
+		fmt.Println("Usage: recovery [database] [table] --retry | --restore [--backup path] | --discard")
+		return
+	}
+	switch {
+	case retry && !restore && !discard:
+		err = server.RetryQuarantinedTable(args[0], args[1])
+	case restore && !retry && !discard:
+		err = server.RestoreQuarantinedTable(args[0], args[1], backup)
+	case discard && !retry && !restore:
+		err = server.DiscardQuarantinedTable(args[0], args[1])
+	default:
+		color.Red("Choose one of --retry, --restore and --discard")
+		return
+	}
+	if err != nil {
+		color.Red("Failed to recover table %s of database %s: %v", args[1], args[0], err)
+		return
+	}
+	if discard {
+		color.Green("Table %s of database %s discarded", args[1], args[0])
+		return
+	}
+	color.Green("Table %s of database %s recovered", args[1], args[0])
+}
+
+func newRetentionCmd() *cobra.Command {
+	var field, archiveTable string
+	var days int
+	var archive, remove, enable, disable, apply bool
+	cmd := &cobra.Command{
+		Use:   "retention [database] [table]",
+		Short: "Manage the retention policy of a table",
+		Long: `Show the retention policy of a table and the records it would delete or archive now. With --field and --days the policy is declared, with --remove it is removed, with --enable and --disable its background application is switched on and off, and with --apply it is applied now.
+
+A running server applies the enabled policies every --retention-every.`,
+		Run: retentionFunc,
+	}
+	cmd.Flags().StringVar(&field, "field", "", "Timestamp field the age of the records is read from")
+	cmd.Flags().IntVar(&days, "days", 0, "Number of days records are kept")
+	cmd.Flags().BoolVar(&archive, "archive", false, "Move expired records to the archive table instead of deleting them")
+	cmd.Flags().StringVar(&archiveTable, "archive-table", "", "Archive table, the table name with an _archive suffix by default")
+	cmd.Flags().BoolVar(&remove, "remove", false, "Remove the retention policy")
+	cmd.Flags().BoolVar(&enable, "enable", false, "Apply the policy in the background")
+	cmd.Flags().BoolVar(&disable, "disable", false, "Keep the policy without applying it in the background")
+	cmd.Flags().BoolVar(&apply, "apply", false, "Delete or archive the expired records now")
+	return cmd
+}
+
+func retentionFunc(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		fmt.Println("Usage: retention [database] [table] [--field name --days n [--archive]] [--remove] [--enable | --disable] [--apply]")
+		return
+	}
+	field, _ := cmd.Flags().GetString("field")
+	days, _ := cmd.Flags().GetInt("days")
+	archive, _ := cmd.Flags().GetBool("archive")
+	archiveTable, _ := cmd.Flags().GetString("archive-table")
+	remove, _ := cmd.Flags().GetBool("remove")
+	enable, _ := cmd.Flags().GetBool("enable")
+	disable, _ := cmd.Flags().GetBool("disable")
+	apply, _ := cmd.Flags().GetBool("apply")
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	db, err := server.Database(args[0])
+	if err != nil {
+		color.Red("Failed to open database %s: %v", args[0], err)
+		return
+	}
+	table, exists := db.Tables[args[1]]
+	if !exists {
+		color.Red("Table %s not found in database %s", args[1], args[0])
+		return
+	}
+
+	switch {
+	case remove:
+		if err := table.SetRetention(nil); err != nil {
+			color.Red("Failed to remove the retention policy: %v", err)
+			return
+		}
+		color.Green("Retention policy of table %s removed", args[1])
+		return
+	case field != "" || days != 0:
+		policy := &data.RetentionPolicy{Field: field, MaxAgeDays: days, ArchiveTable: archiveTable, Disabled: disable}
+		if archive || archiveTable != "" {
+			policy.Action = data.RetentionArchive
+		}
+		if err := table.SetRetention(policy); err != nil {
+			color.Red("Failed to set the retention policy: %v", err)
+			return
+		}
+		color.Green("Retention policy of table %s set", args[1])
+	case enable || disable:
+		if err := table.EnableRetention(enable); err != nil {
+			color.Red("Failed to change the retention policy: %v", err)
+			return
+		}
+		color.Green("Retention policy of table %s updated", args[1])
+	}
+
+	report, err := db.ApplyRetention(args[1], !apply)
+	if errors.Is(err, data.ErrNoRetentionPolicy) {
+		color.Yellow("Table %s has no retention policy", args[1])
+		return
+	} else if err != nil {
+		color.Red("Failed to apply the retention policy: %v", err)
+		return
+	}
+	policy := table.Options.Retention
+	state := "enabled"
+	if policy.Disabled {
+		state = "disabled"
+	}
+	fmt.Printf("Policy: %s records whose %s is older than %d days (%s)\n", report.Action, policy.Field, policy.MaxAgeDays, state)
+	if report.Archive != "" {
+		fmt.Printf("Archive table: %s\n", report.Archive)
+	}
+	if report.DryRun {
+		color.Yellow("%d records older than %s would be %sd", len(report.Keys), report.Cutoff.Format(time.RFC3339), report.Action)
+		return
+	}
+	color.Green("%d records older than %s %sd", report.Purged, report.Cutoff.Format(time.RFC3339), report.Action)
+}
+
+// printRestorePreview prints the contents of a backup and how they differ from the live data.
+func printRestorePreview(preview *data.RestorePreview) {
+	color.Magenta("Backup %s:", preview.Archive)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, file := range preview.Files {
+		fmt.Fprintf(w, "  %s\t%d bytes\n", file.Path, file.Size)
+	}
+	w.Flush()
+
+	for _, name := range preview.AddedDatabases {
+		color.Green("  + database %s", name)
+	}
+	for _, name := range preview.AddedTables {
+		color.Green("  + table %s", name)
+	}
+	for _, name := range preview.RemovedDatabases {
+		color.Cyan("  - database %s (not in backup, kept)", name)
+	}
+	for _, name := range preview.RemovedTables {
+		color.Cyan("  - table %s (not in backup, kept)", name)
+	}
+	for _, change := range preview.ChangedFiles {
+		color.Yellow("  ~ %s: %d bytes live, %d bytes in backup", change.Path, change.LiveSize, change.ArchiveSize)
+	}
+	if !preview.Destructive() {
+		color.Green("  No existing data would be overwritten")
+	}
+}
+
+// printBackupVerification prints the result of every table of a verified backup.
+func printBackupVerification(verification *data.BackupVerification) {
+	color.Magenta("Backup %s:", verification.Archive)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, table := range verification.Tables {
+		status := "ok"
+		if table.Error != "" {
+			status = table.Error
+		}
+		fmt.Fprintf(w, "  %s.%s\t%d records\t%d indexes\t%s\n", table.Database, table.Table, table.Records, table.Indexes, status)
+	}
+	w.Flush()
+	if verification.OK {
+		color.Green("All %d tables verified in %v", len(verification.Tables), verification.Duration.Round(time.Millisecond))
+	} else {
+		color.Red("%d of %d tables failed verification", len(verification.Failed()), len(verification.Tables))
+	}
+}
+
+// parseValue converts a command line value to a bool or number when it looks like one, or keeps it as a string.
+func parseValue(value string) interface{} {
+	if b, err := strconv.ParseBool(value); err == nil {
+		return b
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f
+	}
+	return value
+}
+
+// toProtoRecords converts records returned by the data package into protobuf records for the exporters.
+func toProtoRecords(records []data.Record) ([]*dbdata.Record, error) {
+	protoRecords := make([]*dbdata.Record, 0, len(records))
+	for _, record := range records {
+		protoRecord := &dbdata.Record{Fields: make(map[string]*dbdata.Value)}
+		for key, value := range record {
+			protoValue, err := dbdata.NewValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for field '%s': %v", key, err)
+			}
+			protoRecord.Fields[key] = protoValue
+		}
+		protoRecords = append(protoRecords, protoRecord)
+	}
+	return protoRecords, nil
+}
+
+func formatValue(val interface{}) string {
+	switch x := val.(type) {
+	case string:
+		return fmt.Sprintf("\"%s\"", x)
+	case int64:
+		return fmt.Sprintf("%d", x)
+	case float64:
+		if float64(int(x)) == x {
+			return fmt.Sprintf("%d", int(x))
+		}
+		return fmt.Sprintf("%.3f", x)
+	case bool:
+		return fmt.Sprintf("%t", x)
+	case time.Time:
+		return x.Format(time.RFC3339Nano)
+	case []byte:
+		if bytesFormat == "base64" {
+			return base64.StdEncoding.EncodeToString(x)
+		}
+		return "0x" + hex.EncodeToString(x)
+	case nil:
+		return "NULL"
 	default:
 		return fmt.Sprintf("%v", val)
 	}
 }
+
+func newKeyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "key",
+		Short: "Manage the AES key",
+	}
+	var newKeyFile, database string
+	rotate := &cobra.Command{
+		Use:   "rotate",
+		Short: "Replace the master AES key or the data key of a database",
+		Long: `Replace the master AES key with a new key, read from --new-key-file or the AES_NEW_KEY environment variable. The data key of every database is wrapped with the new key, and tables of databases created before data keys existed are re-encrypted. Files are only replaced once all of them have been written. Stop the server first.
+
+Afterwards set AES_KEY to the new key, and AES_PREVIOUS_KEY to the old one for as long as backups taken before the rotation must stay restorable.
+
+With --database, the data key of that database is replaced with a new random key instead, and only its tables are re-encrypted.`,
+		Run: keyRotateFunc,
+	}
+	rotate.Flags().StringVar(&newKeyFile, "new-key-file", "", "File holding the new AES key, AES_NEW_KEY if empty")
+	rotate.Flags().StringVar(&database, "database", "", "Database whose data key to replace, instead of the master key")
+	cmd.AddCommand(rotate)
+	return cmd
+}
+
+func keyRotateFunc(cmd *cobra.Command, args []string) {
+	database, _ := cmd.Flags().GetString("database")
+	newKey := os.Getenv("AES_NEW_KEY")
+	if newKeyFile, _ := cmd.Flags().GetString("new-key-file"); newKeyFile != "" {
+		content, err := os.ReadFile(newKeyFile)
+		if err != nil {
+			color.Red("Failed to read the new key: %v", err)
+			return
+		}
+		newKey = strings.TrimRight(string(content), "\r\n")
+	}
+	if newKey == "" && database == "" {
+		fmt.Println("Usage: key rotate --new-key-file [file], or set AES_NEW_KEY, or key rotate --database [database]")
+		return
+	}
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	if database != "" {
+		db, err := server.Database(database)
+		if err != nil {
+			color.Red("Database %s does not exist", database)
+			return
+		}
+		rotation, err := db.RotateDataKey()
+		if err != nil {
+			color.Red("Failed to rotate the data key: %v", err)
+			return
+		}
+		color.Green("Replaced the data key of database %s and re-encrypted %d tables", database, len(rotation.Tables))
+		for _, table := range rotation.Tables {
+			fmt.Printf("  %s\n", table)
+		}
+		return
+	}
+
+	rotation, err := server.RotateKey([]byte(newKey))
+	if err != nil {
+		color.Red("Failed to rotate the key: %v", err)
+		return
+	}
+	color.Green("Wrapped the data keys of %d databases with the new key", len(rotation.Databases))
+	if len(rotation.Tables) > 0 {
+		color.Green("Re-encrypted %d tables of databases that had no data key", len(rotation.Tables))
+		for _, table := range rotation.Tables {
+			fmt.Printf("  %s\n", table)
+		}
+	}
+	color.Yellow("Set AES_KEY to the new key, and AES_PREVIOUS_KEY to the old one while older backups must stay readable, before starting the server.")
+}
+
+func newPlaintextCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "plaintext [database] [on|off]",
+		Short: "Turn plaintext mode on or off for a database",
+		Long: `Turn plaintext mode on or off for a database. In plaintext mode the tables are written as raw protobuf, behind a small file header, instead of encrypted, which is meant for development and debugging. Every table file is rewritten in the new mode right away, and files in either format are always read. Stop the server first.
+
+Use "dbproto serve --plaintext" to write every database unencrypted instead.`,
+		Run: plaintextFunc,
+	}
+}
+
+func plaintextFunc(cmd *cobra.Command, args []string) {
+	if len(args) < 2 || (args[1] != "on" && args[1] != "off") {
+		fmt.Println("Usage: plaintext [database] [on|off]")
+		return
+	}
+	databaseName, enabled := args[0], args[1] == "on"
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	db, err := server.Database(databaseName)
+	if err != nil {
+		color.Red("Database %s does not exist", databaseName)
+		return
+	}
+	if err := db.SetPlaintext(enabled); err != nil {
+		color.Red("Failed to change the mode of database %s: %v", databaseName, err)
+		return
+	}
+	if enabled {
+		color.Yellow("The tables of database %s are now written unencrypted", databaseName)
+	} else {
+		color.Green("The tables of database %s are now encrypted", databaseName)
+	}
+}
+
+func newAPIKeyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "apikey",
+		Short: "Manage the API keys of the HTTP server",
+		Long: `Manage the API keys that "dbproto serve --require-api-key" checks. Clients send a key in the Authorization header as "Bearer <key>", or in the X-Api-Key header. Keys with the read scope may only read data, keys with the read-write scope may also change it and manage API keys through /v1/apiKeys.
+
+Only the SHA-256 of each key is stored, in a system table. Stop the server first, or manage the keys through /v1/apiKeys while it runs.`,
+	}
+	var scope string
+	create := &cobra.Command{
+		Use:   "create [name]",
+		Short: "Create an API key",
+		Run:   apiKeyCreateFunc,
+	}
+	create.Flags().StringVar(&scope, "scope", string(data.ScopeReadWrite), "Scope of the key, read or read-write")
+	cmd.AddCommand(create)
+	cmd.AddCommand(&cobra.Command{
+		Use:   "revoke [id]",
+		Short: "Revoke an API key",
+		Run:   apiKeyRevokeFunc,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the API keys",
+		Run:   apiKeyListFunc,
+	})
+	return cmd
+}
+
+func apiKeyCreateFunc(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: apikey create [name] --scope [read|read-write]")
+		return
+	}
+	scope, _ := cmd.Flags().GetString("scope")
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	key, token, err := server.CreateAPIKey(args[0], data.APIKeyScope(scope))
+	if err != nil {
+		color.Red("Failed to create the API key: %v", err)
+		return
+	}
+	color.Green("Created API key %s (%s) for %s", key.ID, key.Scope, key.Name)
+	fmt.Println(token)
+	color.Yellow("Store the key now, it cannot be shown again.")
+}
+
+func apiKeyRevokeFunc(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: apikey revoke [id]")
+		return
+	}
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	if err := server.RevokeAPIKey(args[0]); err != nil {
+		color.Red("Failed to revoke the API key: %v", err)
+		return
+	}
+	color.Green("Revoked API key %s", args[0])
+}
+
+func apiKeyListFunc(cmd *cobra.Command, args []string) {
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	keys, err := server.ListAPIKeys()
+	if err != nil {
+		color.Red("Failed to list the API keys: %v", err)
+		return
+	}
+	if len(keys) == 0 {
+		color.Yellow("No API keys")
+		return
+	}
+	for _, key := range keys {
+		status := "active"
+		if key.RevokedAt != nil {
+			status = "revoked " + key.RevokedAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%s  %-10s  %s  %s  %s\n", key.ID, key.Scope, key.CreatedAt.Format(time.RFC3339), status, key.Name)
+	}
+}
+
+func newMigrateCmd() *cobra.Command {
+	var dir string
+	var dryRun bool
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Apply the pending migrations",
+		Long: `Apply the migration files that have not been applied to their database yet, in version order. Each file, such as 0001_add_order_status.json, alters one table:
+
+  {"database": "shop", "table": "orders", "operations": [{"op": "add_field", "field": "status", "default": "new"}]}
+
+The server applies them on startup too.`,
+		Run: migrateFunc,
+	}
+	cmd.Flags().StringVar(&dir, "dir", "", "Directory of the migration files, the migrations directory next to the databases if empty")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only list the pending migrations")
+	return cmd
+}
+
+func migrateFunc(cmd *cobra.Command, args []string) {
+	dir, _ := cmd.Flags().GetString("dir")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	report, err := server.RunMigrations(dir, dryRun)
+	if report != nil {
+		for _, migration := range report.Applied {
+			color.Green("Applied %s, %d records changed", migration.Name, migration.Records)
+		}
+	}
+	if err != nil {
+		color.Red("Failed to apply migrations: %v", err)
+		return
+	}
+	if dryRun {
+		if len(report.Pending) == 0 {
+			color.Green("No pending migrations")
+		}
+		for _, name := range report.Pending {
+			color.Yellow("Pending %s", name)
+		}
+		return
+	}
+	if len(report.Applied) == 0 {
+		color.Green("No pending migrations")
+	}
+}
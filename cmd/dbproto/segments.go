@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+func newSegmentationCmd() *cobra.Command {
+	var maxSegments int
+	var off, compact bool
+	cmd := &cobra.Command{
+		Use:   "segmentation [database] [table]",
+		Short: "Manage the segmented mode of a table",
+		Long: `Show the segmented mode of a table and its number of segments. With --max-segments the table is switched to segmented mode, with --off back to rewriting its file on every write, and with --compact its segments are folded into its file now.
+
+In segmented mode a write only writes the records it changed, and a tombstone for each record it deleted, to a new segment file next to the table file. Once the table has --max-segments segments, a background compaction merges them, or rewrites the table file and drops them if they are large. Stop the server first, or use /segmentation while it runs.`,
+		Run: segmentationFunc,
+	}
+	cmd.Flags().IntVar(&maxSegments, "max-segments", 0, "Number of segments that starts a compaction, 8 by default")
+	cmd.Flags().BoolVar(&off, "off", false, "Fold the segments into the file and rewrite it on every write again")
+	cmd.Flags().BoolVar(&compact, "compact", false, "Fold the segments into the file now")
+	return cmd
+}
+
+func segmentationFunc(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		fmt.Println("Usage: segmentation [database] [table] [--max-segments n] [--off] [--compact]")
+		return
+	}
+	maxSegments, _ := cmd.Flags().GetInt("max-segments")
+	off, _ := cmd.Flags().GetBool("off")
+	compact, _ := cmd.Flags().GetBool("compact")
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	db, err := server.Database(args[0])
+	if err != nil {
+		color.Red("Failed to open database %s: %v", args[0], err)
+		return
+	}
+	table, exists := db.Tables[args[1]]
+	if !exists {
+		color.Red("Table %s not found in database %s", args[1], args[0])
+		return
+	}
+
+	switch {
+	case off:
+		if err := table.SetSegmentation(nil); err != nil {
+			color.Red("Failed to switch segmented mode off: %v", err)
+			return
+		}
+		color.Green("Table %s rewrites its file on every write", args[1])
+		return
+	case cmd.Flags().Changed("max-segments"):
+		if err := table.SetSegmentation(&data.Segmentation{MaxSegments: maxSegments}); err != nil {
+			color.Red("Failed to set the segmented mode: %v", err)
+			return
+		}
+		color.Green("Table %s is in segmented mode", args[1])
+	}
+	if compact {
+		if err := table.Compact(); err != nil {
+			color.Red("Failed to compact table %s: %v", args[1], err)
+			return
+		}
+		color.Green("Compacted the segments of table %s", args[1])
+	}
+
+	if table.Options.Segmentation == nil {
+		color.Yellow("Table %s rewrites its file on every write", args[1])
+	} else {
+		fmt.Printf("Segmented: %s\n", formatSegmentation(table.Options.Segmentation))
+	}
+	fmt.Printf("Segments: %d\n", table.Segments())
+}
+
+// formatSegmentation describes when the segments of a table in segmented mode are compacted.
+func formatSegmentation(policy *data.Segmentation) string {
+	maxSegments := data.DefaultMaxSegments
+	if policy.MaxSegments > 0 {
+		maxSegments = policy.MaxSegments
+	}
+	return fmt.Sprintf("compacted at %d segments", maxSegments)
+}
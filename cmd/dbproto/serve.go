@@ -0,0 +1,748 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/api"
+	"github.com/Malpizarr/dbproto/pkg/data"
+	"github.com/Malpizarr/dbproto/pkg/rpc"
+	"github.com/Malpizarr/dbproto/pkg/service"
+	"github.com/Malpizarr/dbproto/pkg/utils"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	shutdownTimeout   = 10 * time.Second // shutdownTimeout bounds how long the server waits for in-flight requests when it is stopped.
+	keyPollInterval   = time.Second      // keyPollInterval is how often the server checks whether the AES key became available.
+	commitLogFileSize = 64 << 20         // commitLogFileSize is the size after which the commit log file is rotated.
+)
+
+func newServeCmd() *cobra.Command {
+	var addr, name, logFormat, maxRows, maxQueryTime, roleLimits, writeDelayAfter, writeRejectAfter, writeMaxDelay, idGenerator, nodeID, telemetryEndpoint, telemetryRate, traceEndpoint, traceRate, cachePolicy, verifyBackupEvery, retentionEvery, migrationsDir, jwtSecretFile, jwtTTL, configFile, tlsCert, tlsKey, tlsClientCA, tlsMinVersion, readHeaderTimeout, readTimeout, writeTimeout, idleTimeout, commitLogDir, commitLogSyslog, commitLogDestination, commitLogBatch, grpcAddr, dataDir, backupDir, backupEvery, backupKeep, backupKeepDays, backupDestination, logLevel, cacheSize, hotCacheSize, cacheColdAfter, indexMemoryLimit, indexSpillDir string
+	var plaintext, readOnly, requireAPIKey, accessLog, rejectLegacyCiphertext bool
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Run the HTTP server",
+		Long: `Run the dbproto HTTP server, and the gRPC server if --grpc-addr is set, until it is interrupted. Under systemd (Type=notify) or the Windows Service Control Manager it reports readiness and stops cleanly on request.
+
+Every flag can also be set through the environment variable in its description, so the server can be configured entirely from the environment in containers, or in the YAML, TOML or JSON file given by --config, whose keys are the flag names. Sections name the flags starting with their name, so this file sets --addr, --tls-cert and --tls-key:
+
+  addr: ":8443"
+  tls:
+    cert: /etc/dbproto/tls.crt
+    key: /etc/dbproto/tls.key
+
+Without --config, the first of dbproto.yaml, dbproto.yml, dbproto.toml and dbproto.json found in the working directory, or else in /etc/dbproto, is read. Flags take precedence over environment variables, which take precedence over the file.`,
+		SilenceUsage: true,
+		RunE:         serveFunc,
+	}
+	cmd.Flags().StringVar(&configFile, "config", envOrDefault("DBPROTO_CONFIG", ""), "YAML, TOML or JSON file setting flags by name, for those not given on the command line or in the environment; dbproto.yaml, .yml, .toml or .json in the working directory or /etc/dbproto if empty (DBPROTO_CONFIG)")
+	cmd.Flags().StringVar(&dataDir, "data-dir", envOrDefault("DBPROTO_DATA_DIR", ""), "Directory holding the databases and the backups; /data if it exists, else a directory of the user if empty (DBPROTO_DATA_DIR)")
+	cmd.Flags().StringVar(&backupDir, "backup-dir", envOrDefault("DBPROTO_BACKUP_DIR", ""), "Directory the backups are written to, the data directory if empty (DBPROTO_BACKUP_DIR)")
+	cmd.Flags().StringVar(&addr, "addr", envOrDefault("DBPROTO_ADDR", ":8080"), "Address to listen on (DBPROTO_ADDR)")
+	cmd.Flags().StringVar(&grpcAddr, "grpc-addr", envOrDefault("DBPROTO_GRPC_ADDR", ""), "Address the gRPC service is served on, alongside the HTTP server and with the same TLS and authentication; no gRPC server if empty (DBPROTO_GRPC_ADDR)")
+	cmd.Flags().StringVar(&tlsCert, "tls-cert", envOrDefault("DBPROTO_TLS_CERT", ""), "PEM certificate served over HTTPS, reloaded when the file changes; plain HTTP if empty (DBPROTO_TLS_CERT)")
+	cmd.Flags().StringVar(&tlsKey, "tls-key", envOrDefault("DBPROTO_TLS_KEY", ""), "PEM private key of the certificate (DBPROTO_TLS_KEY)")
+	cmd.Flags().StringVar(&tlsClientCA, "tls-client-ca", envOrDefault("DBPROTO_TLS_CLIENT_CA", ""), "PEM certificates of the CAs client certificates must be signed by, for mutual TLS; client certificates are not requested if empty (DBPROTO_TLS_CLIENT_CA)")
+	cmd.Flags().StringVar(&tlsMinVersion, "tls-min-version", envOrDefault("DBPROTO_TLS_MIN_VERSION", "1.2"), "Oldest TLS version accepted, 1.2 or 1.3 (DBPROTO_TLS_MIN_VERSION)")
+	cmd.Flags().StringVar(&readHeaderTimeout, "read-header-timeout", envOrDefault("DBPROTO_READ_HEADER_TIMEOUT", "10s"), "Time allowed to read the headers of a request, 0 for no limit (DBPROTO_READ_HEADER_TIMEOUT)")
+	cmd.Flags().StringVar(&readTimeout, "read-timeout", envOrDefault("DBPROTO_READ_TIMEOUT", "5m"), "Time allowed to read a whole request, including its body, 0 for no limit (DBPROTO_READ_TIMEOUT)")
+	cmd.Flags().StringVar(&writeTimeout, "write-timeout", envOrDefault("DBPROTO_WRITE_TIMEOUT", "0"), "Time allowed from the end of reading a request to the end of writing its response, 0 for no limit (DBPROTO_WRITE_TIMEOUT)")
+	cmd.Flags().StringVar(&idleTimeout, "idle-timeout", envOrDefault("DBPROTO_IDLE_TIMEOUT", "2m"), "Time an idle keep-alive connection is kept open, 0 for no limit (DBPROTO_IDLE_TIMEOUT)")
+	cmd.Flags().StringVar(&name, "service-name", envOrDefault("DBPROTO_SERVICE_NAME", "dbproto"), "Service name registered with the Windows Service Control Manager (DBPROTO_SERVICE_NAME)")
+	cmd.Flags().StringVar(&logFormat, "log-format", envOrDefault("DBPROTO_LOG_FORMAT", "text"), "Log format written to stdout, text or json (DBPROTO_LOG_FORMAT)")
+	cmd.Flags().StringVar(&logLevel, "log-level", envOrDefault("DBPROTO_LOG_LEVEL", "info"), "Lowest level of the structured log records written, such as the access log: debug, info, warn or error (DBPROTO_LOG_LEVEL)")
+	cmd.Flags().StringVar(&maxRows, "max-rows", envOrDefault("DBPROTO_MAX_ROWS", "0"), "Maximum number of rows a query, select or join may return, 0 for no limit (DBPROTO_MAX_ROWS)")
+	cmd.Flags().StringVar(&maxQueryTime, "max-query-time", envOrDefault("DBPROTO_MAX_QUERY_TIME", "0"), "Maximum time a query, select or join may run, such as 5s, 0 for no limit (DBPROTO_MAX_QUERY_TIME)")
+	cmd.Flags().StringVar(&roleLimits, "role-limits", envOrDefault("DBPROTO_ROLE_LIMITS", ""), "Limits of the roles named by the "+api.RoleHeader+" header, as role=rows/time pairs separated by commas, such as reporting=100000/1m (DBPROTO_ROLE_LIMITS)")
+	cmd.Flags().StringVar(&writeDelayAfter, "write-delay-after", envOrDefault("DBPROTO_WRITE_DELAY_AFTER", "0"), "Number of writes pending on a table after which new writes are delayed, 0 for no delay (DBPROTO_WRITE_DELAY_AFTER)")
+	cmd.Flags().StringVar(&writeRejectAfter, "write-reject-after", envOrDefault("DBPROTO_WRITE_REJECT_AFTER", "0"), "Number of writes pending on a table after which new writes are rejected with 429, 0 for no limit (DBPROTO_WRITE_REJECT_AFTER)")
+	cmd.Flags().StringVar(&writeMaxDelay, "write-max-delay", envOrDefault("DBPROTO_WRITE_MAX_DELAY", "100ms"), "Delay of a write admitted just below the rejection threshold, and the Retry-After of rejected writes (DBPROTO_WRITE_MAX_DELAY)")
+	cmd.Flags().StringVar(&idGenerator, "id-generator", envOrDefault("DBPROTO_ID_GENERATOR", "random"), "Generator of the primary keys of AutoID tables: random, uuidv7 or snowflake (DBPROTO_ID_GENERATOR)")
+	cmd.Flags().StringVar(&nodeID, "node-id", envOrDefault("DBPROTO_NODE_ID", "0"), "Node ID of the snowflake generator, unique within the cluster, between 0 and 1023 (DBPROTO_NODE_ID)")
+	cmd.Flags().StringVar(&telemetryEndpoint, "telemetry-endpoint", envOrDefault("DBPROTO_TELEMETRY_ENDPOINT", ""), "OTLP/HTTP collector that sampled operation shapes are exported to, such as http://localhost:4318, empty to disable telemetry (DBPROTO_TELEMETRY_ENDPOINT)")
+	cmd.Flags().StringVar(&telemetryRate, "telemetry-sample-rate", envOrDefault("DBPROTO_TELEMETRY_SAMPLE_RATE", "0.01"), "Fraction of operations sampled for telemetry, between 0 and 1 (DBPROTO_TELEMETRY_SAMPLE_RATE)")
+	cmd.Flags().StringVar(&traceEndpoint, "trace-endpoint", envOrDefault("DBPROTO_TRACE_ENDPOINT", ""), "OTLP/HTTP collector that the spans of traced requests are exported to, such as http://localhost:4318, empty to disable tracing (DBPROTO_TRACE_ENDPOINT)")
+	cmd.Flags().StringVar(&traceRate, "trace-sample-rate", envOrDefault("DBPROTO_TRACE_SAMPLE_RATE", "0.1"), "Fraction of requests traced, between 0 and 1, unless the caller decided with a traceparent header (DBPROTO_TRACE_SAMPLE_RATE)")
+	cmd.Flags().StringVar(&cachePolicy, "cache-policy", envOrDefault("DBPROTO_CACHE_POLICY", "off"), "Caching of tables, off to keep every table in memory or adaptive to size caches by access frequency and evict idle tables (DBPROTO_CACHE_POLICY)")
+	cmd.Flags().StringVar(&cacheSize, "cache-size", envOrDefault("DBPROTO_CACHE_SIZE", "1000"), "Number of records the lookup cache of a warm table holds under the adaptive cache policy (DBPROTO_CACHE_SIZE)")
+	cmd.Flags().StringVar(&hotCacheSize, "hot-cache-size", envOrDefault("DBPROTO_HOT_CACHE_SIZE", "10000"), "Number of records the lookup cache of a hot table holds under the adaptive cache policy (DBPROTO_HOT_CACHE_SIZE)")
+	cmd.Flags().StringVar(&indexMemoryLimit, "index-memory-limit", envOrDefault("DBPROTO_INDEX_MEMORY_LIMIT", "0"), "Estimated memory the indexes of every table take before the least recently used ones are spilled to disk, in bytes or with a KB, MB, GB, KiB, MiB or GiB suffix; 0 for no limit (DBPROTO_INDEX_MEMORY_LIMIT)")
+	cmd.Flags().StringVar(&indexSpillDir, "index-spill-dir", envOrDefault("DBPROTO_INDEX_SPILL_DIR", ""), "Directory spilled indexes are written to under --index-memory-limit, the temporary directory if empty (DBPROTO_INDEX_SPILL_DIR)")
+	cmd.Flags().StringVar(&cacheColdAfter, "cache-cold-after", envOrDefault("DBPROTO_CACHE_COLD_AFTER", "30m"), "How long a table goes without accesses before the adaptive cache policy evicts it from memory (DBPROTO_CACHE_COLD_AFTER)")
+	cmd.Flags().StringVar(&backupEvery, "backup-every", envOrDefault("DBPROTO_BACKUP_EVERY", "0"), "How often the databases are backed up to a new timestamped backup, such as 24h, 0 to never back them up in the background (DBPROTO_BACKUP_EVERY)")
+	cmd.Flags().StringVar(&backupDestination, "backup-destination", envOrDefault("DBPROTO_BACKUP_DESTINATION", ""), "Where every backup is copied to once written: a directory, or an S3-compatible bucket as s3://bucket/prefix with the credentials in AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY; none if empty (DBPROTO_BACKUP_DESTINATION)")
+	cmd.Flags().StringVar(&backupKeep, "backup-keep", envOrDefault("DBPROTO_BACKUP_KEEP", "0"), "Number of the newest unnamed backups kept after every backup, 0 to keep them all unless --backup-keep-days prunes them (DBPROTO_BACKUP_KEEP)")
+	cmd.Flags().StringVar(&backupKeepDays, "backup-keep-days", envOrDefault("DBPROTO_BACKUP_KEEP_DAYS", "0"), "Number of days unnamed backups are kept, 0 to keep them all unless --backup-keep prunes them; a backup kept by either flag is kept (DBPROTO_BACKUP_KEEP_DAYS)")
+	cmd.Flags().StringVar(&verifyBackupEvery, "verify-backup-every", envOrDefault("DBPROTO_VERIFY_BACKUP_EVERY", "0"), "How often the newest backup is restored into a temporary directory and verified, such as 24h, 0 to never verify it (DBPROTO_VERIFY_BACKUP_EVERY)")
+	cmd.Flags().StringVar(&retentionEvery, "retention-every", envOrDefault("DBPROTO_RETENTION_EVERY", "1h"), "How often the retention policies of the tables are applied, such as 1h, 0 to never apply them in the background (DBPROTO_RETENTION_EVERY)")
+	cmd.Flags().BoolVar(&plaintext, "plaintext", envOrDefault("DBPROTO_PLAINTEXT", "false") == "true", "Write the tables of every database unencrypted, for development and debugging; no AES key is needed unless a table is still encrypted (DBPROTO_PLAINTEXT)")
+	cmd.Flags().BoolVar(&rejectLegacyCiphertext, "reject-legacy-ciphertext", envOrDefault(utils.RejectLegacyCiphertextVariable, "false") == "true", "Fail to read data still encrypted in the legacy CTR format, which has no integrity check, instead of decrypting it; the tables read in that format are logged and counted by dbproto_table_legacy_ciphertext_reads_total ("+utils.RejectLegacyCiphertextVariable+")")
+	cmd.Flags().BoolVar(&readOnly, "read-only", envOrDefault("DBPROTO_READ_ONLY", "false") == "true", "Serve the databases read-only, for replicas or forensic inspection: every write is answered with 403, files are never opened for writing, migrations and retention are not applied and tables that fail to load are skipped instead of quarantined (DBPROTO_READ_ONLY)")
+	cmd.Flags().BoolVar(&requireAPIKey, "require-api-key", envOrDefault("DBPROTO_REQUIRE_API_KEY", "false") == "true", "Reject API requests without a valid API key, see dbproto apikey create; /healthz and /readyz stay open (DBPROTO_REQUIRE_API_KEY)")
+	cmd.Flags().StringVar(&jwtSecretFile, "jwt-secret-file", envOrDefault("DBPROTO_JWT_SECRET_FILE", ""), "File holding the secret, at least 32 bytes, that signs the tokens issued by /v1/login; if set, or if DBPROTO_JWT_SECRET is, API requests need a token or an API key (DBPROTO_JWT_SECRET_FILE)")
+	cmd.Flags().StringVar(&jwtTTL, "jwt-ttl", envOrDefault("DBPROTO_JWT_TTL", "1h"), "How long the tokens issued by /v1/login are valid (DBPROTO_JWT_TTL)")
+	cmd.Flags().BoolVar(&accessLog, "access-log", envOrDefault("DBPROTO_ACCESS_LOG", "true") == "true", "Log every API request with its method, path, status, latency, caller and request ID, in the format of --log-format (DBPROTO_ACCESS_LOG)")
+	cmd.Flags().StringVar(&commitLogDir, "commit-log-dir", envOrDefault("DBPROTO_COMMIT_LOG_DIR", ""), "Directory the commit log of every write is appended to as JSON lines, with the ID of the request that made it, in files of up to 64 MiB; no commit log if empty (DBPROTO_COMMIT_LOG_DIR)")
+	cmd.Flags().StringVar(&commitLogSyslog, "commit-log-syslog", envOrDefault("DBPROTO_COMMIT_LOG_SYSLOG", ""), "Syslog daemon the commit log of every write is sent to as JSON messages, local for the daemon of the host or udp://host:514 or tcp://host:514 for a remote one; none if empty (DBPROTO_COMMIT_LOG_SYSLOG)")
+	cmd.Flags().StringVar(&commitLogDestination, "commit-log-destination", envOrDefault("DBPROTO_COMMIT_LOG_DESTINATION", ""), "Where the commit log of every write is uploaded to in objects of --commit-log-batch entries, never overwritten: a directory, or an S3-compatible bucket as s3://bucket/prefix like --backup-destination; none if empty (DBPROTO_COMMIT_LOG_DESTINATION)")
+	cmd.Flags().StringVar(&commitLogBatch, "commit-log-batch", envOrDefault("DBPROTO_COMMIT_LOG_BATCH", "100"), "Number of commit log entries uploaded together to --commit-log-destination; entries of an incomplete batch are uploaded when the server stops (DBPROTO_COMMIT_LOG_BATCH)")
+	cmd.Flags().StringVar(&migrationsDir, "migrations-dir", envOrDefault("DBPROTO_MIGRATIONS_DIR", ""), "Directory of the migration files applied on startup, the migrations directory next to the databases if empty (DBPROTO_MIGRATIONS_DIR)")
+	return cmd
+}
+
+// envOrDefault returns the value of the environment variable key, or fallback if it is unset or empty.
+func envOrDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func serveFunc(cmd *cobra.Command, args []string) error {
+	configFile, _ := cmd.Flags().GetString("config")
+	if configFile == "" {
+		configFile = findConfigFile()
+	}
+	if configFile != "" {
+		if err := applyConfigFile(cmd, configFile); err != nil {
+			return err
+		}
+	}
+	addr, _ := cmd.Flags().GetString("addr")
+	grpcAddr, _ := cmd.Flags().GetString("grpc-addr")
+	name, _ := cmd.Flags().GetString("service-name")
+	logFormat, _ := cmd.Flags().GetString("log-format")
+	logLevel, _ := cmd.Flags().GetString("log-level")
+	dataDir, _ := cmd.Flags().GetString("data-dir")
+	backupDir, _ := cmd.Flags().GetString("backup-dir")
+	backupEvery, _ := cmd.Flags().GetString("backup-every")
+	backupKeep, _ := cmd.Flags().GetString("backup-keep")
+	backupKeepDays, _ := cmd.Flags().GetString("backup-keep-days")
+	backupDestination, _ := cmd.Flags().GetString("backup-destination")
+	cacheSize, _ := cmd.Flags().GetString("cache-size")
+	hotCacheSize, _ := cmd.Flags().GetString("hot-cache-size")
+	cacheColdAfter, _ := cmd.Flags().GetString("cache-cold-after")
+	indexMemoryLimit, _ := cmd.Flags().GetString("index-memory-limit")
+	indexSpillDir, _ := cmd.Flags().GetString("index-spill-dir")
+	maxRows, _ := cmd.Flags().GetString("max-rows")
+	maxQueryTime, _ := cmd.Flags().GetString("max-query-time")
+	roleLimitsFlag, _ := cmd.Flags().GetString("role-limits")
+	writeDelayAfter, _ := cmd.Flags().GetString("write-delay-after")
+	writeRejectAfter, _ := cmd.Flags().GetString("write-reject-after")
+	writeMaxDelay, _ := cmd.Flags().GetString("write-max-delay")
+	idGenerator, _ := cmd.Flags().GetString("id-generator")
+	nodeID, _ := cmd.Flags().GetString("node-id")
+	telemetryEndpoint, _ := cmd.Flags().GetString("telemetry-endpoint")
+	telemetryRate, _ := cmd.Flags().GetString("telemetry-sample-rate")
+	traceEndpoint, _ := cmd.Flags().GetString("trace-endpoint")
+	traceRate, _ := cmd.Flags().GetString("trace-sample-rate")
+	cachePolicy, _ := cmd.Flags().GetString("cache-policy")
+	verifyBackupEvery, _ := cmd.Flags().GetString("verify-backup-every")
+	retentionEvery, _ := cmd.Flags().GetString("retention-every")
+	migrationsDir, _ := cmd.Flags().GetString("migrations-dir")
+	plaintext, _ := cmd.Flags().GetBool("plaintext")
+	readOnly, _ := cmd.Flags().GetBool("read-only")
+	rejectLegacyCiphertext, _ := cmd.Flags().GetBool("reject-legacy-ciphertext")
+	requireAPIKey, _ := cmd.Flags().GetBool("require-api-key")
+	accessLog, _ := cmd.Flags().GetBool("access-log")
+	commitLogDir, _ := cmd.Flags().GetString("commit-log-dir")
+	commitLogSyslog, _ := cmd.Flags().GetString("commit-log-syslog")
+	commitLogDestination, _ := cmd.Flags().GetString("commit-log-destination")
+	commitLogBatch, _ := cmd.Flags().GetString("commit-log-batch")
+	jwtSecretFile, _ := cmd.Flags().GetString("jwt-secret-file")
+	jwtTTL, _ := cmd.Flags().GetString("jwt-ttl")
+	tlsCert, _ := cmd.Flags().GetString("tls-cert")
+	tlsKey, _ := cmd.Flags().GetString("tls-key")
+	tlsClientCA, _ := cmd.Flags().GetString("tls-client-ca")
+	tlsMinVersion, _ := cmd.Flags().GetString("tls-min-version")
+
+	limits, err := parseLimits(maxRows, maxQueryTime)
+	if err != nil {
+		return err
+	}
+	roleLimits, err := parseRoleLimits(roleLimitsFlag)
+	if err != nil {
+		return err
+	}
+	throttle, err := parseWriteThrottle(writeDelayAfter, writeRejectAfter, writeMaxDelay)
+	if err != nil {
+		return err
+	}
+	generators, err := parseGenerators(idGenerator, nodeID)
+	if err != nil {
+		return err
+	}
+	sampleRate, err := strconv.ParseFloat(telemetryRate, 64)
+	if err != nil || sampleRate < 0 || sampleRate > 1 {
+		return fmt.Errorf("invalid telemetry sample rate %q, expected a number between 0 and 1", telemetryRate)
+	}
+	traceSampleRate, err := strconv.ParseFloat(traceRate, 64)
+	if err != nil || traceSampleRate < 0 || traceSampleRate > 1 {
+		return fmt.Errorf("invalid trace sample rate %q, expected a number between 0 and 1", traceRate)
+	}
+	if cachePolicy != "off" && cachePolicy != "adaptive" {
+		return fmt.Errorf("unknown cache policy %q, expected off or adaptive", cachePolicy)
+	}
+	adaptiveCache, err := parseCachePolicy(cacheSize, hotCacheSize, cacheColdAfter)
+	if err != nil {
+		return err
+	}
+	indexLimit, err := parseByteSize(indexMemoryLimit)
+	if err != nil {
+		return fmt.Errorf("invalid index memory limit %q, expected a size such as 256MiB", indexMemoryLimit)
+	}
+	backupInterval, err := time.ParseDuration(backupEvery)
+	if err != nil || backupInterval < 0 {
+		return fmt.Errorf("invalid backup interval %q, expected a duration such as 24h", backupEvery)
+	}
+	var backupRetention data.BackupRetention
+	if backupRetention.Keep, err = strconv.Atoi(backupKeep); err != nil || backupRetention.Keep < 0 {
+		return fmt.Errorf("invalid number of backups kept %q, expected a number such as 7", backupKeep)
+	}
+	if backupRetention.KeepDays, err = strconv.Atoi(backupKeepDays); err != nil || backupRetention.KeepDays < 0 {
+		return fmt.Errorf("invalid number of days backups are kept %q, expected a number such as 30", backupKeepDays)
+	}
+	var destination data.BackupDestination
+	if backupDestination != "" {
+		if destination, err = data.ParseBackupDestination(backupDestination); err != nil {
+			return err
+		}
+	}
+	syslogNetwork, syslogAddress, err := parseSyslogAddress(commitLogSyslog)
+	if err != nil {
+		return err
+	}
+	var commitLogUploader data.Uploader
+	if commitLogDestination != "" {
+		if commitLogUploader, err = data.ParseBackupDestination(commitLogDestination); err != nil {
+			return err
+		}
+	}
+	batchSize, err := strconv.Atoi(commitLogBatch)
+	if err != nil || batchSize <= 0 {
+		return fmt.Errorf("invalid commit log batch %q, expected a number of entries such as 100", commitLogBatch)
+	}
+	verifyInterval, err := time.ParseDuration(verifyBackupEvery)
+	if err != nil || verifyInterval < 0 {
+		return fmt.Errorf("invalid backup verification interval %q, expected a duration such as 24h", verifyBackupEvery)
+	}
+	retentionInterval, err := time.ParseDuration(retentionEvery)
+	if err != nil || retentionInterval < 0 {
+		return fmt.Errorf("invalid retention interval %q, expected a duration such as 1h", retentionEvery)
+	}
+
+	timeouts := make(map[string]time.Duration)
+	for _, flag := range []string{"read-header-timeout", "read-timeout", "write-timeout", "idle-timeout"} {
+		value, _ := cmd.Flags().GetString(flag)
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			return fmt.Errorf("invalid %s %q, expected a duration such as 30s", flag, value)
+		}
+		timeouts[flag] = timeout
+	}
+	var tlsConfig *tls.Config
+	if tlsCert != "" || tlsKey != "" || tlsClientCA != "" {
+		if tlsConfig, err = serverTLSConfig(tlsCert, tlsKey, tlsClientCA, tlsMinVersion); err != nil {
+			return err
+		}
+	}
+
+	var tokens *api.Tokens
+	jwtSecret := os.Getenv("DBPROTO_JWT_SECRET")
+	if jwtSecretFile != "" {
+		content, err := os.ReadFile(jwtSecretFile)
+		if err != nil {
+			return fmt.Errorf("failed to read the token secret: %v", err)
+		}
+		jwtSecret = strings.TrimRight(string(content), "\r\n")
+	}
+	if jwtSecret != "" {
+		ttl, err := time.ParseDuration(jwtTTL)
+		if err != nil {
+			return fmt.Errorf("invalid token lifetime %q, expected a duration such as 1h", jwtTTL)
+		}
+		if tokens, err = api.NewTokens([]byte(jwtSecret), ttl); err != nil {
+			return err
+		}
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		return fmt.Errorf("unknown log level %q, expected debug, info, warn or error", logLevel)
+	}
+	switch logFormat {
+	case "text":
+		log.SetOutput(os.Stdout)
+		slog.SetLogLoggerLevel(level)
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
+	default:
+		return fmt.Errorf("unknown log format %q, expected text or json", logFormat)
+	}
+	data.SetDataDir(dataDir)
+	data.SetBackupDir(backupDir)
+	if rejectLegacyCiphertext {
+		log.Printf("Data encrypted in the legacy CTR format is rejected")
+		utils.SetRejectLegacyCiphertext(true)
+	}
+
+	return service.Run(name, func(ctx context.Context, ready func()) error {
+		server := data.NewServer()
+		server.SetLimits(limits)
+		for role, roleLimit := range roleLimits {
+			server.SetRoleLimits(role, roleLimit)
+		}
+		server.SetWriteThrottle(throttle)
+		server.SetGenerators(generators)
+		if err := server.SetBackupRetention(backupRetention); err != nil {
+			return err
+		}
+		if destination != nil {
+			log.Printf("Backups are copied to %s", destination)
+			server.SetBackupDestination(destination)
+		}
+		var sinks []data.LogSink
+		if commitLogDir != "" {
+			sink, err := data.NewRotatingFileSink(commitLogDir, commitLogFileSize)
+			if err != nil {
+				return err
+			}
+			sinks = append(sinks, sink)
+		}
+		if commitLogSyslog != "" {
+			sink, err := data.NewSyslogSink(syslogNetwork, syslogAddress, name)
+			if err != nil {
+				return err
+			}
+			sinks = append(sinks, sink)
+		}
+		if commitLogUploader != nil {
+			log.Printf("The commit log is uploaded to %s", commitLogUploader)
+			sinks = append(sinks, data.NewObjectSink(commitLogUploader, "", batchSize))
+		}
+		if len(sinks) > 0 {
+			commitLog, err := data.NewCommitLog(sinks...)
+			if err != nil {
+				return err
+			}
+			defer commitLog.Close()
+			server.SetCommitLog(commitLog)
+		}
+		if plaintext {
+			log.Printf("Plaintext mode: tables are written unencrypted")
+			if err := server.SetPlaintext(true); err != nil {
+				return err
+			}
+		}
+		if readOnly {
+			log.Printf("Read-only mode: writes are rejected and the data directory is left unchanged")
+			if err := server.SetReadOnly(true); err != nil {
+				return err
+			}
+		}
+		if telemetryEndpoint != "" {
+			telemetry := data.NewTelemetry(&data.OTLPExporter{Endpoint: telemetryEndpoint, ServiceName: name}, sampleRate)
+			defer telemetry.Close()
+			server.SetTelemetry(telemetry)
+		}
+		var tracer *data.Tracer
+		if traceEndpoint != "" {
+			tracer = data.NewTracer(&data.OTLPExporter{Endpoint: traceEndpoint, ServiceName: name}, traceSampleRate)
+			defer tracer.Close()
+		}
+		// Background jobs, and the jobs started over the API, write to the tables, so they are stopped and waited for
+		// before the tables are flushed, and before the commit log, telemetry and tracing close. The startup is one too,
+		// as it starts the others.
+		jobCtx, stopJobs := context.WithCancel(ctx)
+		var jobs sync.WaitGroup
+		runJob := func(job func()) {
+			jobs.Add(1)
+			go func() {
+				defer jobs.Done()
+				job()
+			}()
+		}
+		defer func() {
+			stopJobs()
+			jobs.Wait()
+			if err := server.Close(); err != nil {
+				log.Printf("Failed to close tables: %v", err)
+			}
+		}()
+		if cachePolicy == "adaptive" {
+			runJob(func() { server.RunCachePolicy(jobCtx, adaptiveCache) })
+		}
+		if indexLimit > 0 {
+			runJob(func() {
+				if err := server.RunIndexBudget(jobCtx, data.IndexBudget{MaxBytes: indexLimit, Dir: indexSpillDir}); err != nil && jobCtx.Err() == nil {
+					log.Printf("Index memory budget stopped: %v", err)
+				}
+			})
+		}
+		readiness := &api.Readiness{}
+
+		apiMux := http.NewServeMux()
+		api.RegisterRoutes(apiMux, server)
+		var apiHandler http.Handler = apiMux
+		if tokens != nil {
+			api.RegisterLogin(apiMux, server, tokens)
+			apiHandler = api.RequireJWT(server, tokens, apiMux)
+		} else if requireAPIKey {
+			apiHandler = api.RequireAPIKey(server, apiMux)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz", api.HealthHandler())
+		mux.HandleFunc("/readyz", api.ReadyHandler(readiness))
+		api.RegisterDocs(mux)
+		apiHandler = readiness.Gate(apiHandler)
+		if accessLog {
+			apiHandler = api.AccessLog(slog.Default(), apiHandler)
+		}
+		apiHandler = api.Trace(tracer, apiHandler)
+		mux.Handle("/", apiHandler)
+		httpServer := &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			TLSConfig:         tlsConfig,
+			ReadHeaderTimeout: timeouts["read-header-timeout"],
+			ReadTimeout:       timeouts["read-timeout"],
+			WriteTimeout:      timeouts["write-timeout"],
+			IdleTimeout:       timeouts["idle-timeout"],
+		}
+		// Shutdown does not cancel requests in flight, so end the change subscriptions, which never finish on their own
+		shutdown := make(chan struct{})
+		httpServer.BaseContext = func(net.Listener) context.Context { return api.WithShutdown(context.Background(), shutdown) }
+		httpServer.RegisterOnShutdown(func() { close(shutdown) })
+
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %v", addr, err)
+		}
+		serveErr := make(chan error, 1)
+		if tlsConfig != nil {
+			log.Printf("dbproto listening on %s with TLS", listener.Addr())
+			go func() {
+				serveErr <- httpServer.ServeTLS(listener, "", "")
+			}()
+		} else {
+			log.Printf("dbproto listening on %s", listener.Addr())
+			go func() {
+				serveErr <- httpServer.Serve(listener)
+			}()
+		}
+
+		var grpcServer *grpc.Server
+		if grpcAddr != "" {
+			grpcListener, err := net.Listen("tcp", grpcAddr)
+			if err != nil {
+				httpServer.Close()
+				return fmt.Errorf("failed to listen on %s: %v", grpcAddr, err)
+			}
+			var opts []grpc.ServerOption
+			if tlsConfig != nil {
+				opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+			}
+			grpcServer = rpc.NewServer(server, rpc.Config{Tokens: tokens, RequireAPIKey: requireAPIKey, Readiness: readiness}, opts...)
+			log.Printf("dbproto serving gRPC on %s", grpcListener.Addr())
+			go func() {
+				if err := grpcServer.Serve(grpcListener); err != nil {
+					serveErr <- fmt.Errorf("gRPC server failed: %v", err)
+				}
+			}()
+		}
+
+		startErr := make(chan error, 1)
+		runJob(func() {
+			if !plaintext {
+				if err := waitForKey(jobCtx); err != nil {
+					startErr <- err
+					return
+				}
+			}
+			if err := server.Initialize(); err != nil {
+				startErr <- fmt.Errorf("failed to initialize server: %v", err)
+				return
+			}
+			migrations, err := server.RunMigrations(migrationsDir, readOnly)
+			if err != nil {
+				startErr <- fmt.Errorf("failed to apply migrations: %v", err)
+				return
+			}
+			for _, migration := range migrations.Applied {
+				log.Printf("Applied migration %s, %d records changed", migration.Name, migration.Records)
+			}
+			if readOnly && len(migrations.Pending) > 0 {
+				log.Printf("Read-only mode: %d migrations are pending and not applied", len(migrations.Pending))
+			}
+			if backupInterval > 0 {
+				runJob(func() { server.RunBackups(jobCtx, backupInterval) })
+			}
+			if verifyInterval > 0 {
+				runJob(func() { server.RunBackupVerification(jobCtx, verifyInterval, "") })
+			}
+			if retentionInterval > 0 && !readOnly {
+				runJob(func() { server.RunRetention(jobCtx, retentionInterval) })
+			}
+			if tokens != nil {
+				if users, err := server.ListUsers(); err == nil && len(users) == 0 {
+					log.Printf("No user exists, only API keys are accepted: stop the server and run dbproto user create")
+				}
+			} else if requireAPIKey {
+				if exists, err := server.HasAPIKeys(); err == nil && !exists {
+					log.Printf("No API key exists, every API request is rejected: stop the server and run dbproto apikey create")
+				}
+			}
+			if report, err := server.RecoveryReport(); err == nil && report.SafeMode {
+				log.Printf("dbproto starting in safe mode: %d tables are quarantined, see /v1/recovery", len(report.Quarantined))
+			}
+			readiness.SetReady()
+			ready()
+			log.Printf("dbproto ready, serving %d databases", len(server.ListDatabases()))
+		})
+
+		select {
+		case err := <-serveErr:
+			if grpcServer != nil {
+				grpcServer.Stop()
+			}
+			httpServer.Close()
+			return err
+		case err := <-startErr:
+			if grpcServer != nil {
+				grpcServer.Stop()
+			}
+			httpServer.Close()
+			return err
+		case <-ctx.Done():
+		}
+
+		log.Printf("dbproto shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if grpcServer != nil {
+			stopGRPC(shutdownCtx, grpcServer)
+		}
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			return fmt.Errorf("failed to shut down server: %v", err)
+		}
+		if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	})
+}
+
+// stopGRPC stops the gRPC server once its calls in flight have finished, or cancels them when ctx is done, which it is
+// first for the Watch streams that only end when their client cancels them.
+func stopGRPC(ctx context.Context, grpcServer *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		grpcServer.Stop()
+	}
+}
+
+// parseLimits parses a row count and a duration into read limits. Zero, or an empty string, means no limit.
+func parseLimits(rows, duration string) (data.Limits, error) {
+	var limits data.Limits
+	var err error
+	if rows != "" {
+		if limits.MaxRows, err = strconv.Atoi(rows); err != nil || limits.MaxRows < 0 {
+			return data.Limits{}, fmt.Errorf("invalid row limit %q, expected a non-negative integer", rows)
+		}
+	}
+	if duration != "" && duration != "0" {
+		if limits.MaxDuration, err = time.ParseDuration(duration); err != nil || limits.MaxDuration < 0 {
+			return data.Limits{}, fmt.Errorf("invalid time limit %q, expected a duration such as 5s", duration)
+		}
+	}
+	return limits, nil
+}
+
+// parseRoleLimits parses role limits given as role=rows/time pairs separated by commas, where either limit may be
+// empty or 0 for no limit.
+func parseRoleLimits(value string) (map[string]data.Limits, error) {
+	roleLimits := make(map[string]data.Limits)
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		role, spec, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		rows, duration, _ := strings.Cut(spec, "/")
+		if !ok || role == "" {
+			return nil, fmt.Errorf("invalid role limits %q, expected role=rows/time", pair)
+		}
+		limits, err := parseLimits(rows, duration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid limits of role %s: %v", role, err)
+		}
+		roleLimits[role] = limits
+	}
+	return roleLimits, nil
+}
+
+// parseWriteThrottle parses the write throttle thresholds, each a non-negative number of pending writes, and the
+// maximum delay.
+func parseWriteThrottle(delayAfter, rejectAfter, maxDelay string) (data.WriteThrottle, error) {
+	var throttle data.WriteThrottle
+	var err error
+	if throttle.DelayAfter, err = strconv.Atoi(delayAfter); err != nil || throttle.DelayAfter < 0 {
+		return data.WriteThrottle{}, fmt.Errorf("invalid write delay threshold %q, expected a non-negative integer", delayAfter)
+	}
+	if throttle.RejectAfter, err = strconv.Atoi(rejectAfter); err != nil || throttle.RejectAfter < 0 {
+		return data.WriteThrottle{}, fmt.Errorf("invalid write rejection threshold %q, expected a non-negative integer", rejectAfter)
+	}
+	if throttle.MaxDelay, err = time.ParseDuration(maxDelay); err != nil || throttle.MaxDelay < 0 {
+		return data.WriteThrottle{}, fmt.Errorf("invalid maximum write delay %q, expected a duration such as 100ms", maxDelay)
+	}
+	return throttle, nil
+}
+
+// parseCachePolicy returns data.DefaultCachePolicy with the cache sizes and the time after which idle tables are
+// evicted.
+func parseCachePolicy(cacheSize, hotCacheSize, coldAfter string) (data.CachePolicy, error) {
+	policy := data.DefaultCachePolicy
+	var err error
+	if policy.CacheSize, err = strconv.Atoi(cacheSize); err != nil || policy.CacheSize < 0 {
+		return data.CachePolicy{}, fmt.Errorf("invalid cache size %q, expected a non-negative integer", cacheSize)
+	}
+	if policy.HotCacheSize, err = strconv.Atoi(hotCacheSize); err != nil || policy.HotCacheSize < 0 {
+		return data.CachePolicy{}, fmt.Errorf("invalid hot cache size %q, expected a non-negative integer", hotCacheSize)
+	}
+	if policy.ColdAfter, err = time.ParseDuration(coldAfter); err != nil || policy.ColdAfter <= 0 {
+		return data.CachePolicy{}, fmt.Errorf("invalid cache eviction delay %q, expected a duration such as 30m", coldAfter)
+	}
+	return policy, nil
+}
+
+// byteUnits are the suffixes of the sizes parsed by parseByteSize, longest first.
+var byteUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9},
+	{"B", 1},
+}
+
+// parseByteSize returns the number of bytes of a size given in bytes or with one of the byteUnits suffixes.
+func parseByteSize(size string) (int64, error) {
+	size = strings.TrimSpace(size)
+	unit := int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(size, u.suffix) {
+			size, unit = strings.TrimSpace(strings.TrimSuffix(size, u.suffix)), u.bytes
+			break
+		}
+	}
+	value, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || value < 0 || value > math.MaxInt64/unit {
+		return 0, errors.New("invalid size")
+	}
+	return value * unit, nil
+}
+
+// parseGenerators returns the generators of the named primary key generator, with the node ID used by the
+// snowflake generator.
+func parseGenerators(idGenerator, nodeID string) (data.Generators, error) {
+	switch idGenerator {
+	case "random":
+		return data.Generators{}, nil
+	case "uuidv7":
+		return data.Generators{IDs: &data.UUIDv7Generator{}}, nil
+	case "snowflake":
+		node, err := strconv.Atoi(nodeID)
+		if err != nil {
+			return data.Generators{}, fmt.Errorf("invalid node ID %q, expected an integer", nodeID)
+		}
+		generator, err := data.NewSnowflakeGenerator(node)
+		if err != nil {
+			return data.Generators{}, err
+		}
+		return data.Generators{IDs: generator}, nil
+	default:
+		return data.Generators{}, fmt.Errorf("unknown ID generator %q, expected random, uuidv7 or snowflake", idGenerator)
+	}
+}
+
+// parseSyslogAddress returns the network and address of the syslog daemon named by --commit-log-syslog: empty ones
+// for local, the daemon of the host, or those of a udp://host:port or tcp://host:port URL.
+func parseSyslogAddress(value string) (network, address string, err error) {
+	if value == "" || value == "local" {
+		return "", "", nil
+	}
+	network, address, found := strings.Cut(value, "://")
+	if !found || (network != "udp" && network != "tcp") || address == "" {
+		return "", "", fmt.Errorf("invalid commit log syslog %q, expected local, udp://host:514 or tcp://host:514", value)
+	}
+	return network, address, nil
+}
+
+// waitForKey blocks until a valid AES key is available from AES_KEY, AES_KEY_FILE or the configured key
+// provider, so a server whose secret is mounted late, or whose key service is unreachable, stays unready
+// instead of failing. It returns ctx.Err() if ctx is cancelled first.
+func waitForKey(ctx context.Context) error {
+	ticker := time.NewTicker(keyPollInterval)
+	defer ticker.Stop()
+
+	logged := false
+	for {
+		_, err := utils.NewUtils()
+		if err == nil {
+			return nil
+		}
+		if !logged {
+			log.Printf("waiting for AES key: %v", err)
+			logged = true
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func newOpenAPICmd() *cobra.Command {
+	var output string
+	cmd := &cobra.Command{
+		Use:   "openapi",
+		Short: "Print the OpenAPI document of the HTTP API",
+		Long:  `Print the OpenAPI 3 document of the HTTP API, which dbproto serve also serves at /openapi.json with a Swagger UI at /docs, to generate clients in other languages.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if output == "" {
+				fmt.Println(string(api.OpenAPIDocument()))
+				return
+			}
+			if err := os.WriteFile(output, api.OpenAPIDocument(), 0644); err != nil {
+				color.Red("Failed to write the OpenAPI document: %v", err)
+				return
+			}
+			color.Green("OpenAPI document written to %s", output)
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "", "File to write the document to instead of the standard output")
+	return cmd
+}
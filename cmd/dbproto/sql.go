@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+const sqlHelp = `Statements end with ; and may span several lines:
+  SELECT * | field, ... FROM table [WHERE cond [AND cond]...] [ORDER BY field] [LIMIT n] [OFFSET n];
+  INSERT INTO table (field, ...) VALUES (value, ...);
+  UPDATE table SET field = value, ... [WHERE ...];
+  DELETE FROM table [WHERE ...];
+Meta commands:
+  \dt          list the tables of the database
+  \d table     describe a table
+  \c database  connect to another database
+  \r           clear the statement being typed
+  \?           show this help
+  \q           quit`
+
+func newSQLCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sql [database]",
+		Short: "Run query language statements interactively",
+		Long: `Open a prompt that runs query language statements against a database. Statements end with a semicolon and may span several lines; the time each one takes is printed after its result.
+
+Type \? at the prompt for the supported statements and meta commands.`,
+		Run: sqlFunc,
+	}
+	return cmd
+}
+
+func sqlFunc(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: sql [database]")
+		return
+	}
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	databaseName := args[0]
+	database, err := server.Database(databaseName)
+	if err != nil {
+		color.Red("Failed to open database %s: %v", databaseName, err)
+		return
+	}
+
+	fmt.Println(`Type \? for help and \q to quit.`)
+	var buffer strings.Builder
+	for {
+		if buffer.Len() == 0 {
+			fmt.Printf("%s=> ", databaseName)
+		} else {
+			fmt.Printf("%s-> ", databaseName)
+		}
+		line, err := stdin.ReadString('\n')
+		if err != nil && (!errors.Is(err, io.EOF) || line == "") {
+			fmt.Println()
+			return
+		}
+
+		// The catalog is a snapshot, so it is rebuilt before every command to show current metadata
+		if databaseName == data.CatalogDatabase {
+			if database, err = server.Catalog(); err != nil {
+				color.Red("Failed to build the catalog: %v", err)
+				return
+			}
+		}
+
+		// Meta commands are only recognized at the start of a statement and end with the line
+		trimmed := strings.TrimSpace(line)
+		if trimmed == `\r` {
+			buffer.Reset()
+			continue
+		}
+		if buffer.Len() == 0 && strings.HasPrefix(trimmed, `\`) {
+			fields := strings.Fields(trimmed)
+			switch fields[0] {
+			case `\q`:
+				return
+			case `\?`:
+				fmt.Println(sqlHelp)
+			case `\dt`:
+				tables, err := database.ListTables()
+				if err != nil {
+					color.Red("Error listing tables in database %s: %v", databaseName, err)
+					continue
+				}
+				sort.Strings(tables)
+				for _, table := range tables {
+					fmt.Println(table)
+				}
+			case `\d`:
+				if len(fields) != 2 {
+					color.Red(`Usage: \d table`)
+					continue
+				}
+				describeTable(database, fields[1])
+			case `\c`:
+				if len(fields) != 2 {
+					color.Red(`Usage: \c database`)
+					continue
+				}
+				if next, err := server.Database(fields[1]); err == nil {
+					databaseName, database = fields[1], next
+					color.Green("Connected to database %s", databaseName)
+				} else {
+					color.Red("Failed to open database %s: %v", fields[1], err)
+				}
+			default:
+				color.Red(`Unknown command %s, type \? for help`, fields[0])
+			}
+			continue
+		}
+
+		buffer.WriteString(line)
+		statements, rest := splitStatements(buffer.String())
+		buffer.Reset()
+		buffer.WriteString(rest)
+		for _, statement := range statements {
+			runStatement(database, statement)
+		}
+	}
+}
+
+// splitStatements returns the complete statements of input, each ending with a semicolon outside quotes, and the
+// text after the last one.
+func splitStatements(input string) ([]string, string) {
+	var statements []string
+	var quote rune
+	start := 0
+	for i, c := range input {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0 // A doubled quote closes and reopens the quote, which leaves it open
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ';':
+			if statement := strings.TrimSpace(input[start:i]); statement != "" {
+				statements = append(statements, statement)
+			}
+			start = i + 1
+		}
+	}
+	rest := input[start:]
+	if strings.TrimSpace(rest) == "" {
+		rest = ""
+	}
+	return statements, rest
+}
+
+// runStatement runs a statement and prints its result and how long it took.
+func runStatement(database *data.Database, statement string) {
+	start := time.Now()
+	result, err := database.Exec(statement)
+	elapsed := time.Since(start)
+	if err != nil {
+		color.Red("Error: %v", err)
+		return
+	}
+
+	fields := strings.Fields(statement)
+	switch kind := strings.ToUpper(fields[0]); kind {
+	case data.StatementSelect:
+		printResult(result)
+		if len(result.Records) == 1 {
+			fmt.Println("(1 row)")
+		} else {
+			fmt.Printf("(%d rows)\n", len(result.Records))
+		}
+	default:
+		color.Green("%s %d", kind, result.Affected)
+	}
+	fmt.Printf("Time: %.3f ms\n", float64(elapsed.Microseconds())/1000)
+}
+
+// printResult prints the selected records as a table. Fields a record does not have are left blank, while NULL
+// values are printed as NULL.
+func printResult(result *data.Result) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, strings.Join(result.Columns, "\t"))
+	separators := make([]string, len(result.Columns))
+	for i, column := range result.Columns {
+		separators[i] = strings.Repeat("-", len(column))
+	}
+	fmt.Fprintln(w, strings.Join(separators, "\t"))
+	for _, record := range result.Records {
+		values := make([]string, len(result.Columns))
+		for i, column := range result.Columns {
+			if value, exists := record[column]; exists {
+				values[i] = formatValue(value)
+			}
+		}
+		fmt.Fprintln(w, strings.Join(values, "\t"))
+	}
+}
+
+// describeTable prints the primary key and options of a table and the fields its records have, with the kinds of
+// values stored in each field. Tables have no fixed schema, so the fields are gathered from the records.
+func describeTable(database *data.Database, tableName string) {
+	table, exists := database.Tables[tableName]
+	if !exists {
+		color.Red("Table %s does not exist in database %s", tableName, database.Name)
+		return
+	}
+	records, err := table.SelectAll()
+	if err != nil {
+		color.Red("Error retrieving records from table %s: %v", tableName, err)
+		return
+	}
+
+	kinds := make(map[string]map[string]bool)
+	counts := make(map[string]int)
+	for _, record := range records {
+		for field, value := range record {
+			if kinds[field] == nil {
+				kinds[field] = make(map[string]bool)
+			}
+			kinds[field][valueKind(value)] = true
+			counts[field]++
+		}
+	}
+	fields := make([]string, 0, len(kinds))
+	for field := range kinds {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	color.Magenta("Table %s.%s (%d records)", database.Name, tableName, len(records))
+	fmt.Printf("Primary key: %s\n", table.PrimaryKey)
+	var options []string
+	if table.Options.AutoID {
+		options = append(options, "auto id")
+	}
+	if table.Options.Timestamps {
+		options = append(options, "timestamps")
+	}
+	if table.Options.ClientEncrypted {
+		options = append(options, "client encrypted")
+	}
+	if table.Options.VerifyChecksums {
+		options = append(options, "verify checksums")
+	}
+	if len(options) > 0 {
+		fmt.Printf("Options: %s\n", strings.Join(options, ", "))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "Field\tKinds\tRecords")
+	fmt.Fprintln(w, "-----\t-----\t-------")
+	for _, field := range fields {
+		names := make([]string, 0, len(kinds[field]))
+		for kind := range kinds[field] {
+			names = append(names, kind)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(w, "%s\t%s\t%d\n", field, strings.Join(names, ", "), counts[field])
+	}
+}
+
+// valueKind names the kind of a record value for describeTable.
+func valueKind(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case int64, float64:
+		return "number"
+	case bool:
+		return "bool"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Malpizarr/dbproto/pkg/api"
+	"github.com/Malpizarr/dbproto/pkg/data"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+func newStatsCmd() *cobra.Command {
+	var serverURL, apiKey string
+	var asJSON bool
+	cmd := &cobra.Command{
+		Use:   "stats [database]",
+		Short: "Show the metrics of the databases and tables",
+		Long: `Show the records, file sizes, operation counts and cache hit ratios of every table, added up per database and for the whole server.
+
+With --server, the metrics are read from a running server at /v1/admin/metrics, and count the operations since it opened each table. Without it, the databases are opened from the data directory, and only the records and file sizes are meaningful.`,
+		Run: statsFunc,
+	}
+	cmd.Flags().StringVarP(&serverURL, "server", "s", "", "Address of a running dbproto HTTP server, such as http://localhost:8080; the data directory if empty")
+	cmd.Flags().StringVar(&apiKey, "api-key", envOrDefault("DBPROTO_API_KEY", ""), "API key sent to the server, if it requires one (DBPROTO_API_KEY)")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the metrics as JSON")
+	return cmd
+}
+
+func statsFunc(cmd *cobra.Command, args []string) {
+	serverURL, _ := cmd.Flags().GetString("server")
+	asJSON, _ := cmd.Flags().GetBool("json")
+
+	var metrics data.ServerMetrics
+	if serverURL != "" {
+		apiKey, _ := cmd.Flags().GetString("api-key")
+		var err error
+		if metrics, err = fetchMetrics(serverURL, apiKey); err != nil {
+			color.Red("%v", err)
+			return
+		}
+	} else {
+		server, err := openServer()
+		if err != nil {
+			color.Red("Failed to initialize server: %v", err)
+			return
+		}
+		metrics = server.Metrics()
+	}
+
+	if len(args) > 0 {
+		db, exists := metrics.Databases[args[0]]
+		if !exists {
+			color.Red("Database %s does not exist", args[0])
+			return
+		}
+		metrics.Databases = map[string]data.DatabaseMetrics{args[0]: db}
+		metrics.MetricsSummary = db.MetricsSummary
+	}
+
+	if asJSON {
+		out, _ := json.MarshalIndent(metrics, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+	printServerMetrics(metrics)
+}
+
+// fetchMetrics reads the metrics of a running server from its /v1/admin/metrics route, for the tenant given with
+// --tenant.
+func fetchMetrics(serverURL, apiKey string) (data.ServerMetrics, error) {
+	var metrics data.ServerMetrics
+	req, err := http.NewRequest("GET", strings.TrimSuffix(serverURL, "/")+"/v1/admin/metrics", nil)
+	if err != nil {
+		return metrics, fmt.Errorf("invalid server address %s: %v", serverURL, err)
+	}
+	if apiKey != "" {
+		req.Header.Set(api.APIKeyHeader, apiKey)
+	}
+	if tenantName != "" {
+		req.Header.Set(api.TenantHeader, tenantName)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return metrics, fmt.Errorf("failed to reach server at %s: %v", serverURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return metrics, fmt.Errorf("server returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&metrics); err != nil {
+		return metrics, fmt.Errorf("failed to decode metrics: %v", err)
+	}
+	return metrics, nil
+}
+
+// printServerMetrics prints a row per table, followed by the totals of its database, and the totals of the server.
+func printServerMetrics(metrics data.ServerMetrics) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DATABASE\tTABLE\tRECORDS\tFILE SIZE\tINSERTS\tUPDATES\tDELETES\tQUERIES\tFULL SCANS\tCACHE HITS")
+	row := func(database, table string, summary data.MetricsSummary) {
+		hits := "-"
+		if summary.CacheHits+summary.CacheMisses > 0 {
+			hits = fmt.Sprintf("%.1f%%", summary.CacheHitRatio*100)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n", database, table, summary.Records, summary.FileSize,
+			summary.Inserts, summary.Updates, summary.Deletes, summary.Queries, summary.FullScans, hits)
+	}
+
+	databases := make([]string, 0, len(metrics.Databases))
+	for name := range metrics.Databases {
+		databases = append(databases, name)
+	}
+	sort.Strings(databases)
+	for _, name := range databases {
+		db := metrics.Databases[name]
+		tables := make([]string, 0, len(db.TableMetrics))
+		for table := range db.TableMetrics {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+		for _, table := range tables {
+			row(name, table, db.TableMetrics[table])
+		}
+		row(name, "(total)", db.MetricsSummary)
+	}
+	if len(databases) != 1 {
+		row("(total)", "", metrics.MetricsSummary)
+	}
+	w.Flush()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+// tenantName is the tenant the commands work on, set with the --tenant flag; the root server if empty.
+var tenantName string
+
+// openedServers are the servers opened by openServer for the running command, which flushes them once it is done.
+var openedServers []*data.Server
+
+// openServer initializes the server and returns the server of the tenant given with --tenant, or the root server.
+func openServer() (*data.Server, error) {
+	server := data.NewServer()
+	if err := server.Initialize(); err != nil {
+		return nil, err
+	}
+	openedServers = append(openedServers, server)
+	return server.Tenant(tenantName)
+}
+
+// closeOpenedServers closes the servers opened by the command, which writes the changes left pending by the tables
+// in write-behind mode, since the process may exit before they are flushed in the background.
+func closeOpenedServers() {
+	for _, server := range openedServers {
+		if err := server.Close(); err != nil {
+			color.Red("Failed to close tables: %v", err)
+		}
+	}
+	openedServers = nil
+}
+
+func newTenantCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tenant",
+		Short: "Manage the tenants of the server",
+		Long: `Manage the tenants of the server. Each tenant has its own databases, users, roles and backups, in a directory of its own, and only API keys and tokens of the tenant reach them. Other commands work on a tenant when given --tenant or DBPROTO_TENANT, such as "dbproto --tenant acme user create alice".
+
+Stop the server first, or create tenants through /v1/tenants while it runs.`,
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "create [name]",
+		Short: "Create a tenant",
+		Run:   tenantCreateFunc,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the tenants",
+		Run:   tenantListFunc,
+	})
+	return cmd
+}
+
+func tenantCreateFunc(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: tenant create [name]")
+		return
+	}
+	server := data.NewServer()
+	if err := server.Initialize(); err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	if err := server.CreateTenant(args[0]); err != nil {
+		color.Red("Failed to create the tenant: %v", err)
+		return
+	}
+	color.Green("Tenant %s created", args[0])
+}
+
+func tenantListFunc(cmd *cobra.Command, args []string) {
+	server := data.NewServer()
+	if err := server.Initialize(); err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	tenants := server.ListTenants()
+	if len(tenants) == 0 {
+		color.Yellow("No tenants")
+		return
+	}
+	for _, tenant := range tenants {
+		fmt.Println(tenant)
+	}
+}
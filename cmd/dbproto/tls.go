@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// certificateLoader serves the TLS certificate of a pair of files, reloading them when the certificate file changes, so
+// renewed certificates are picked up without restarting the server.
+type certificateLoader struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	modTime time.Time
+	cert    *tls.Certificate
+}
+
+// newCertificateLoader loads the certificate and key files, failing if they cannot be loaded.
+func newCertificateLoader(certFile, keyFile string) (*certificateLoader, error) {
+	loader := &certificateLoader{certFile: certFile, keyFile: keyFile}
+	if _, err := loader.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return loader, nil
+}
+
+// GetCertificate returns the certificate, reloading it first if its file changed. If a changed file cannot be loaded,
+// such as while it is only half written, the previous certificate is served.
+func (l *certificateLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	info, err := os.Stat(l.certFile)
+	if err != nil {
+		if l.cert != nil {
+			return l.cert, nil
+		}
+		return nil, fmt.Errorf("failed to read the TLS certificate: %v", err)
+	}
+	if l.cert != nil && info.ModTime().Equal(l.modTime) {
+		return l.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		if l.cert != nil {
+			return l.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load the TLS certificate: %v", err)
+	}
+	l.cert, l.modTime = &cert, info.ModTime()
+	return l.cert, nil
+}
+
+// serverTLSConfig returns the TLS configuration of the server serving the certificate in certFile with the key in
+// keyFile. If clientCAFile is set, clients must present a certificate signed by one of the certificates it holds.
+// minVersion is 1.2 or 1.3.
+func serverTLSConfig(certFile, keyFile, clientCAFile, minVersion string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS requires both a certificate and a key")
+	}
+	loader, err := newCertificateLoader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{GetCertificate: loader.GetCertificate}
+	switch minVersion {
+	case "1.2":
+		config.MinVersion = tls.VersionTLS12
+	case "1.3":
+		config.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported TLS version %q, expected 1.2 or 1.3", minVersion)
+	}
+
+	if clientCAFile != "" {
+		content, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificate found in the client CA file %s", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+func newUserCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "user",
+		Short: "Manage the users of the HTTP server",
+		Long: `Manage the users that log in to the HTTP server at /v1/login when it runs with DBPROTO_JWT_SECRET or --jwt-secret-file. A user gets a token for a password, and sends it as "Authorization: Bearer <token>"; what the token allows is given by the roles of the user, see dbproto role.
+
+The password is read from the file given with --password-file, or else from the first line of the standard input. Only a salted hash of it is stored, in a system table. Stop the server first.`,
+	}
+	var roles, passwordFile string
+	create := &cobra.Command{
+		Use:   "create [username]",
+		Short: "Create a user",
+		Run:   userCreateFunc,
+	}
+	create.Flags().StringVar(&roles, "roles", "", "Roles of the user, separated by commas, such as admin or reporting,app")
+	create.Flags().StringVar(&passwordFile, "password-file", "", "File holding the password, the standard input if empty")
+	passwd := &cobra.Command{
+		Use:   "passwd [username]",
+		Short: "Change the password of a user",
+		Run:   userPasswdFunc,
+	}
+	passwd.Flags().StringVar(&passwordFile, "password-file", "", "File holding the password, the standard input if empty")
+	grant := &cobra.Command{
+		Use:   "roles [username] [role,...]",
+		Short: "Replace the roles of a user",
+		Run:   userRolesFunc,
+	}
+	cmd.AddCommand(create, passwd, grant)
+	cmd.AddCommand(&cobra.Command{
+		Use:   "delete [username]",
+		Short: "Delete a user",
+		Run:   userDeleteFunc,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the users",
+		Run:   userListFunc,
+	})
+	return cmd
+}
+
+// readPassword returns the password in the file given with --password-file, or else the first line of the standard
+// input.
+func readPassword(cmd *cobra.Command) (string, error) {
+	if passwordFile, _ := cmd.Flags().GetString("password-file"); passwordFile != "" {
+		content, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read the password: %v", err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+	fmt.Print("Password: ")
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read the password: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// splitRoles returns the roles separated by commas.
+func splitRoles(value string) []string {
+	roles := []string{}
+	for _, role := range strings.Split(value, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+func userCreateFunc(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: user create [username] --roles [role,...] --password-file [file]")
+		return
+	}
+	roles, _ := cmd.Flags().GetString("roles")
+	password, err := readPassword(cmd)
+	if err != nil {
+		color.Red("%v", err)
+		return
+	}
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	if err := server.CreateUser(args[0], password, splitRoles(roles)); err != nil {
+		color.Red("Failed to create the user: %v", err)
+		return
+	}
+	color.Green("Created user %s", args[0])
+}
+
+func userPasswdFunc(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: user passwd [username] --password-file [file]")
+		return
+	}
+	password, err := readPassword(cmd)
+	if err != nil {
+		color.Red("%v", err)
+		return
+	}
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	if err := server.SetUserPassword(args[0], password); err != nil {
+		color.Red("Failed to change the password: %v", err)
+		return
+	}
+	color.Green("Changed the password of user %s", args[0])
+}
+
+func userRolesFunc(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: user roles [username] [role,...]")
+		return
+	}
+	roles := []string{}
+	if len(args) > 1 {
+		roles = splitRoles(args[1])
+	}
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	if err := server.SetUserRoles(args[0], roles); err != nil {
+		color.Red("Failed to change the roles: %v", err)
+		return
+	}
+	color.Green("User %s now has the roles %v", args[0], roles)
+}
+
+func userDeleteFunc(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: user delete [username]")
+		return
+	}
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	if err := server.DeleteUser(args[0]); err != nil {
+		color.Red("Failed to delete the user: %v", err)
+		return
+	}
+	color.Green("Deleted user %s", args[0])
+}
+
+func userListFunc(cmd *cobra.Command, args []string) {
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	users, err := server.ListUsers()
+	if err != nil {
+		color.Red("Failed to list the users: %v", err)
+		return
+	}
+	if len(users) == 0 {
+		color.Yellow("No users")
+		return
+	}
+	for _, user := range users {
+		fmt.Printf("%-20s  %s  %s\n", user.Username, user.CreatedAt.Format(time.RFC3339), strings.Join(user.Roles, ","))
+	}
+}
+
+func newRoleCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "role",
+		Short: "Manage the roles of the users of the HTTP server",
+		Long: `Manage the roles given to users, see dbproto user. A role is a set of grants, each written database[.table]:permission with * for every database, such as shop:read, shop.orders:write or *:admin. The read permission allows reading and joining tables, write also allows changing records, and admin also allows creating tables and managing their retention. Creating, deleting and renaming databases, restoring backups, recovery and API keys need admin on every database, and dropping and renaming tables admin on their database.
+
+The built-in admin role grants *:admin. Changes apply to the next request of the users of the role. Stop the server first.`,
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "set [name] [grant...]",
+		Short: "Create a role, or replace its grants",
+		Run:   roleSetFunc,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "delete [name]",
+		Short: "Delete a role",
+		Run:   roleDeleteFunc,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the roles",
+		Run:   roleListFunc,
+	})
+	return cmd
+}
+
+func roleSetFunc(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: role set [name] [database[.table]:permission...]")
+		return
+	}
+	role := data.Role{Name: args[0]}
+	for _, arg := range args[1:] {
+		grant, err := data.ParseGrant(arg)
+		if err != nil {
+			color.Red("%v", err)
+			return
+		}
+		role.Grants = append(role.Grants, grant)
+	}
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	if err := server.SetRole(role); err != nil {
+		color.Red("Failed to set the role: %v", err)
+		return
+	}
+	color.Green("Role %s now grants %d permissions", role.Name, len(role.Grants))
+}
+
+func roleDeleteFunc(cmd *cobra.Command, args []string) {
+	if len(args) < 1 {
+		fmt.Println("Usage: role delete [name]")
+		return
+	}
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	if err := server.DeleteRole(args[0]); err != nil {
+		color.Red("Failed to delete the role: %v", err)
+		return
+	}
+	color.Green("Deleted role %s", args[0])
+}
+
+func roleListFunc(cmd *cobra.Command, args []string) {
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	roles, err := server.ListRoles()
+	if err != nil {
+		color.Red("Failed to list the roles: %v", err)
+		return
+	}
+	for _, role := range roles {
+		grants := make([]string, len(role.Grants))
+		for i, grant := range role.Grants {
+			grants[i] = grant.String()
+		}
+		fmt.Printf("%-20s  %s\n", role.Name, strings.Join(grants, " "))
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+func newWriteBehindCmd() *cobra.Command {
+	var interval, commits int
+	var off bool
+	cmd := &cobra.Command{
+		Use:   "write-behind [database] [table]",
+		Short: "Manage the write-behind mode of a table",
+		Long: `Show the write-behind mode of a table. With --interval or --commits the table is switched to write-behind mode, and with --off back to writing its file on every write.
+
+In write-behind mode writes return once they are appended to the write-behind log of the table, applied in memory and shipped to the commit log, and the file is written for all of them at once: --interval milliseconds after the first one, or as soon as --commits of them are pending. Writes not yet flushed are kept in the write-behind log of the table, which is replayed when the table is opened again if the server dies. Stop the server first, or use /writeBehind while it runs.`,
+		Run: writeBehindFunc,
+	}
+	cmd.Flags().IntVar(&interval, "interval", 0, "Milliseconds writes stay unflushed at most, 1000 by default")
+	cmd.Flags().IntVar(&commits, "commits", 0, "Number of pending writes that are flushed at once, no limit by default")
+	cmd.Flags().BoolVar(&off, "off", false, "Write the file on every write again")
+	return cmd
+}
+
+func writeBehindFunc(cmd *cobra.Command, args []string) {
+	if len(args) != 2 {
+		fmt.Println("Usage: write-behind [database] [table] [--interval ms] [--commits n] [--off]")
+		return
+	}
+	interval, _ := cmd.Flags().GetInt("interval")
+	commits, _ := cmd.Flags().GetInt("commits")
+	off, _ := cmd.Flags().GetBool("off")
+
+	server, err := openServer()
+	if err != nil {
+		color.Red("Failed to initialize server: %v", err)
+		return
+	}
+	db, err := server.Database(args[0])
+	if err != nil {
+		color.Red("Failed to open database %s: %v", args[0], err)
+		return
+	}
+	table, exists := db.Tables[args[1]]
+	if !exists {
+		color.Red("Table %s not found in database %s", args[1], args[0])
+		return
+	}
+
+	switch {
+	case off:
+		if err := table.SetWriteBehind(nil); err != nil {
+			color.Red("Failed to switch write-behind off: %v", err)
+			return
+		}
+		color.Green("Table %s writes its file on every write", args[1])
+		return
+	case interval != 0 || commits != 0:
+		if err := table.SetWriteBehind(&data.WriteBehind{IntervalMs: interval, Commits: commits}); err != nil {
+			color.Red("Failed to set the write-behind mode: %v", err)
+			return
+		}
+		color.Green("Table %s is in write-behind mode", args[1])
+	}
+
+	if table.Options.WriteBehind == nil {
+		color.Yellow("Table %s writes its file on every write", args[1])
+		return
+	}
+	fmt.Printf("Write-behind: %s\n", formatWriteBehind(table.Options.WriteBehind))
+}
+
+// formatWriteBehind describes when a table in write-behind mode flushes its file.
+func formatWriteBehind(policy *data.WriteBehind) string {
+	interval := data.DefaultWriteBehindInterval.Milliseconds()
+	if policy.IntervalMs > 0 {
+		interval = int64(policy.IntervalMs)
+	}
+	if policy.Commits > 0 {
+		return fmt.Sprintf("every %d ms or %d writes", interval, policy.Commits)
+	}
+	return fmt.Sprintf("every %d ms", interval)
+}
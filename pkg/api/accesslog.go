@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+)
+
+// RequestIDHeader is the header carrying the ID of a request. The server keeps the ID a client sends, generates one
+// for requests without it, and answers with it in the same header.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength is the length above which a request ID sent by a client is replaced with a generated one.
+const maxRequestIDLength = 128
+
+// accessLogKey is the context key of the accessEntry of a request.
+type accessLogKey struct{}
+
+// accessEntry collects what the handlers of a request learn about it for its access log line.
+type accessEntry struct {
+	caller string // caller identifies who sent the request, such as user:ana or apikey:45b0ac26204b9ad5.
+}
+
+// setCaller records who sent the request of the context in its access log line, if it is logged.
+func setCaller(ctx context.Context, caller string) {
+	if entry, ok := ctx.Value(accessLogKey{}).(*accessEntry); ok {
+		entry.caller = caller
+	}
+}
+
+// statusRecorder remembers the status and the size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Unwrap returns the wrapped ResponseWriter, so http.ResponseController reaches it.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// AccessLog logs every request to logger once it is answered, with its method, path, status, response size, latency,
+// remote address, caller and request ID. The request ID is taken from RequestIDHeader, or generated, sent back in the
+// same header and put in the context of the request with data.WithRequestID, so the commit log entries, change events
+// and table logs of the writes it makes carry it. The caller is set by RequireAPIKey and RequireJWT, or else taken
+// from the client certificate of mutual TLS, and is empty for anonymous requests. Requests traced by Trace, which must
+// wrap AccessLog for it, are logged with their trace ID too.
+func AccessLog(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength || !printable(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		entry := &accessEntry{}
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			entry.caller = "cert:" + r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+		ctx := context.WithValue(data.WithRequestID(r.Context(), id), accessLogKey{}, entry)
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if recorder.status >= 500 {
+			level = slog.LevelError
+		}
+		attributes := []slog.Attr{
+			slog.String("request_id", id),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Int("bytes", recorder.bytes),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("remote", r.RemoteAddr),
+			slog.String("caller", entry.caller),
+		}
+		if span := data.SpanFromContext(ctx); span != nil {
+			attributes = append(attributes, slog.String("trace_id", span.TraceIDString()))
+		}
+		logger.LogAttrs(ctx, level, "request", attributes...)
+	})
+}
+
+// newRequestID returns a random request ID of 16 hex characters.
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// printable reports whether the string only holds printable ASCII characters, so it can be logged and sent back as is.
+func printable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x21 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
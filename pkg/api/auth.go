@@ -0,0 +1,162 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+)
+
+// APIKeyHeader is the request header carrying the API key, for clients that cannot send it as a bearer token in the
+// Authorization header.
+const APIKeyHeader = "X-Api-Key"
+
+// apiKeyContextKey is the context key of the API key authenticating a request.
+type apiKeyContextKey struct{}
+
+// APIKeyFromContext returns the API key that authenticated the request of the context, or nil if the request went
+// through no RequireAPIKey middleware.
+func APIKeyFromContext(ctx context.Context) *data.APIKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*data.APIKey)
+	return key
+}
+
+// readRoutes lists the routes whose POST requests only read data, besides the query routes of the tables, see
+// isQueryRoute. Every other route only reads on GET and HEAD. /tableAction is checked again by TableActionHandler once
+// its action is known, and /joinTables by JoinTablesHandler when it writes the join into a table.
+var readRoutes = map[string]bool{
+	"/joinTables":  true,
+	"/tableAction": true,
+}
+
+// RequireAPIKey rejects requests without a valid API key with 401 Unauthorized and passes the others to next, with the
+// key and the tenant it is bound to, see TenantFromContext, in their context. The key is read from the Authorization header as "Bearer <key>", or from APIKeyHeader. Keys
+// with the read scope are rejected with 403 Forbidden on requests that change data and on the /apiKeys route.
+func RequireAPIKey(server *data.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := requestToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dbproto"`)
+			writeError(w, "API key required", http.StatusUnauthorized)
+			return
+		}
+		key, err := server.AuthenticateAPIKey(token)
+		if errors.Is(err, data.ErrInvalidAPIKey) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dbproto", error="invalid_token"`)
+			writeError(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		setCaller(r.Context(), "apikey:"+key.ID)
+
+		route := routePath(r.URL.Path)
+		reads := r.Method == "GET" || r.Method == "HEAD" || (r.Method == "POST" && (readRoutes[route] || isQueryRoute(routePath(r.URL.EscapedPath()))))
+		if !key.CanWrite() && (!reads || route == "/apiKeys") {
+			writeError(w, "The API key is read-only", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withTenant(context.WithValue(r.Context(), apiKeyContextKey{}, key), key.Tenant)))
+	})
+}
+
+// requestToken returns the bearer token of the Authorization header of the request, or else its APIKeyHeader.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		scheme, credentials, _ := strings.Cut(auth, " ")
+		if strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(credentials)
+		}
+	}
+	return r.Header.Get(APIKeyHeader)
+}
+
+// routePath returns the path of the request without its /v{version} prefix, if any.
+func routePath(path string) string {
+	for _, version := range APIVersions {
+		prefix := "/v" + version.Name
+		if strings.HasPrefix(path, prefix+"/") {
+			return strings.TrimPrefix(path, prefix)
+		}
+	}
+	return path
+}
+
+// writeAllowed reports whether the API key of the request, if any, may change data, and rejects the request with
+// 403 Forbidden if it may not.
+func writeAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if key := APIKeyFromContext(r.Context()); key != nil && !key.CanWrite() {
+		writeError(w, "The API key is read-only", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// APIKeysHandler manages the API keys. GET lists them, without their secrets. POST takes {"action": "create", "name":
+// ..., "scope": "read" or "read-write"} and answers 201 Created with the key, shown only once, or {"action": "revoke",
+// "id": ...} and answers 404 Not Found for an unknown key.
+func APIKeysHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			keys, err := server.ListAPIKeys()
+			if err != nil {
+				writeErrorFrom(w, err, http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(keys); err != nil {
+				writeError(w, "Failed to serialize response", http.StatusInternalServerError)
+			}
+			return
+		case "POST":
+		default:
+			writeError(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var payload struct {
+			Action string           `json:"action"`
+			Name   string           `json:"name,omitempty"`
+			Scope  data.APIKeyScope `json:"scope,omitempty"`
+			ID     string           `json:"id,omitempty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		switch payload.Action {
+		case "create":
+			key, token, err := server.CreateAPIKey(payload.Name, payload.Scope)
+			if err != nil {
+				writeErrorFrom(w, err, http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(struct {
+				*data.APIKey
+				Key string `json:"key"`
+			}{key, token})
+		case "revoke":
+			err := server.RevokeAPIKey(payload.ID)
+			if errors.Is(err, data.ErrAPIKeyNotFound) {
+				writeErrorFrom(w, err, http.StatusNotFound)
+				return
+			} else if err != nil {
+				writeErrorFrom(w, err, http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, "API key '%s' revoked.", payload.ID)
+		default:
+			writeError(w, "Invalid action, expected create or revoke", http.StatusBadRequest)
+		}
+	}
+}
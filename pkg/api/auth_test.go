@@ -0,0 +1,69 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Malpizarr/dbproto/pkg/api"
+	"github.com/Malpizarr/dbproto/pkg/data"
+)
+
+// TestReadOnlyKeyCannotMaterializeJoin checks that an API key with the read scope may join tables but not write the
+// join into a new table, which /joinTables does when the request names an intoTable.
+func TestReadOnlyKeyCannotMaterializeJoin(t *testing.T) {
+	if os.Getenv("AES_KEY") == "" && os.Getenv("AES_KEY_FILE") == "" {
+		t.Setenv("AES_KEY", "0123456789abcdef0123456789abcdef")
+	}
+	data.SetDataDir(t.TempDir())
+	defer data.SetDataDir("")
+
+	server := data.NewServer()
+	defer server.Close()
+	if err := server.Initialize(); err != nil {
+		t.Fatalf("Failed to initialize server: %v", err)
+	}
+	if err := server.CreateDatabase("shop"); err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	db := server.Databases["shop"]
+	for _, name := range []string{"users", "orders"} {
+		if err := db.CreateTable(name, "id"); err != nil {
+			t.Fatalf("Failed to create table %s: %v", name, err)
+		}
+	}
+	if err := db.Tables["users"].Insert(data.Record{"id": "u1", "name": "Ada"}); err != nil {
+		t.Fatalf("Failed to insert user: %v", err)
+	}
+	if err := db.Tables["orders"].Insert(data.Record{"id": "o1", "user": "u1"}); err != nil {
+		t.Fatalf("Failed to insert order: %v", err)
+	}
+	_, token, err := server.CreateAPIKey("reporting", data.ScopeRead)
+	if err != nil {
+		t.Fatalf("Failed to create API key: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	api.RegisterRoutes(mux, server)
+	handler := api.RequireAPIKey(server, mux)
+
+	join := func(body string) int {
+		req := httptest.NewRequest("POST", "/joinTables?dbName=shop", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := join(`{"table1": "users", "table2": "orders", "key1": "id", "key2": "user"}`); code != http.StatusOK {
+		t.Errorf("Join with a read-only key answered %d, expected %d", code, http.StatusOK)
+	}
+	if code := join(`{"table1": "users", "table2": "orders", "key1": "id", "key2": "user", "intoTable": "report", "primaryKey": "id"}`); code != http.StatusForbidden {
+		t.Errorf("Join into a table with a read-only key answered %d, expected %d", code, http.StatusForbidden)
+	}
+	if _, exists := db.Tables["report"]; exists {
+		t.Error("Join with a read-only key created the table report")
+	}
+}
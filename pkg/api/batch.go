@@ -0,0 +1,138 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+)
+
+// maxBatchItems is the largest number of items a batch request may hold.
+const maxBatchItems = 1000
+
+// batchItemResult is the outcome of one item of a batch request.
+type batchItemResult struct {
+	Index      int                   `json:"index"`
+	Status     int                   `json:"status"`
+	Key        string                `json:"key,omitempty"`
+	Record     data.Record           `json:"record,omitempty"`
+	Code       string                `json:"code,omitempty"`
+	Error      string                `json:"error,omitempty"`
+	Violations []data.FieldViolation `json:"violations,omitempty"`
+}
+
+// BatchHandler serves POST /databases/{db}/tables/{table}/batch, which inserts, updates or deletes many records of
+// the table under a single lock and a single write of its file. The body is one of:
+//   - {"operation": "insert", "records": [{...}, ...]}
+//   - {"operation": "update", "updates": [{"key": ..., "updates": {...}}, ...]}
+//   - {"operation": "delete", "keys": [..., ...]}
+//
+// Items fail independently: the request answers 207 Multi-Status with {"results": [...], "succeeded": n, "failed":
+// m}, where every item has its index, its own status code (201 for inserts, 200 for updates, 204 for deletes, or the
+// status a single write of it would have failed with, such as 404 or 409), its key, the stored record and the error
+// of a failed item. A request whose batch fails as a whole answers with a single status, like a single write.
+func BatchHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		parts := pathSegments(r.URL.EscapedPath())
+		table, ok := tableFromPath(server, w, parts[0], parts[2])
+		if !ok {
+			return
+		}
+		if parts[0] == data.CatalogDatabase {
+			writeErrorFrom(w, data.ErrCatalogReadOnly, http.StatusForbidden)
+			return
+		}
+		if !writeAllowed(w, r) {
+			return
+		}
+
+		var payload struct {
+			Operation string        `json:"operation"`
+			Records   []data.Record `json:"records,omitempty"`
+			Updates   []struct {
+				Key     interface{} `json:"key"`
+				Updates data.Record `json:"updates"`
+			} `json:"updates,omitempty"`
+			Keys []interface{} `json:"keys,omitempty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if items := len(payload.Records) + len(payload.Updates) + len(payload.Keys); items > maxBatchItems {
+			writeError(w, fmt.Sprintf("A batch holds at most %d items, got %d", maxBatchItems, items), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		var results []data.BatchResult
+		var err error
+		success := http.StatusOK
+		switch payload.Operation {
+		case "insert":
+			for i, record := range payload.Records {
+				if record == nil {
+					writeError(w, fmt.Sprintf("Record %d is not a JSON object", i), http.StatusBadRequest)
+					return
+				}
+				if err := data.DecodeBinaryFields(record); err != nil {
+					writeErrorFrom(w, err, http.StatusBadRequest)
+					return
+				}
+			}
+			success = http.StatusCreated
+			results, err = table.InsertBatchCtx(r.Context(), payload.Records)
+		case "update":
+			updates := make([]data.BatchUpdate, len(payload.Updates))
+			for i, update := range payload.Updates {
+				if err := data.DecodeBinaryFields(update.Updates); err != nil {
+					writeErrorFrom(w, err, http.StatusBadRequest)
+					return
+				}
+				updates[i] = data.BatchUpdate{Key: update.Key, Updates: update.Updates}
+			}
+			results, err = table.UpdateBatchCtx(r.Context(), updates)
+		case "delete":
+			success = http.StatusNoContent
+			results, err = table.DeleteBatchCtx(r.Context(), payload.Keys)
+		default:
+			writeError(w, "Invalid operation, expected insert, update or delete", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			writeErrorFrom(w, err, writeErrorStatus(w, err, http.StatusInternalServerError))
+			return
+		}
+
+		response := struct {
+			Results   []batchItemResult `json:"results"`
+			Succeeded int               `json:"succeeded"`
+			Failed    int               `json:"failed"`
+		}{Results: make([]batchItemResult, len(results))}
+		for i, result := range results {
+			item := batchItemResult{Index: i, Status: success, Key: result.Key}
+			if result.Err != nil {
+				item.Status = recordErrorStatus(result.Err, http.StatusBadRequest)
+				item.Code, _ = errorDetails(result.Err, item.Status)
+				item.Error = result.Err.Error()
+				var validationErr *data.ValidationError
+				if errors.As(result.Err, &validationErr) {
+					item.Violations = validationErr.Violations
+				}
+				response.Failed++
+			} else {
+				item.Record = data.EncodeBinaryFields(result.Record)
+				response.Succeeded++
+			}
+			response.Results[i] = item
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMultiStatus)
+		json.NewEncoder(w).Encode(response)
+	}
+}
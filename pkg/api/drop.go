@@ -0,0 +1,139 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+)
+
+// DatabaseHandler serves /databases/{db}:
+//   - DELETE deletes the database with its tables and files, and answers 204 No Content.
+//   - PATCH renames it to the name in the body, {"name": "..."}, and answers 204 No Content.
+//
+// Unknown databases answer 404 Not Found, and names taken by another database 409 Conflict.
+func DatabaseHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !dropMethodAllowed(w, r, []string{"DELETE", "PATCH"}) {
+			return
+		}
+		parts := pathSegments(r.URL.EscapedPath())
+		if len(parts) != 1 || parts[0] == "" {
+			writeError(w, "Expected /databases/{db}", http.StatusNotFound)
+			return
+		}
+		if !writeAllowed(w, r) {
+			return
+		}
+
+		var err error
+		if r.Method == "DELETE" {
+			err = server.DeleteDatabase(parts[0])
+		} else {
+			newName, ok := readNewName(w, r)
+			if !ok {
+				return
+			}
+			err = server.RenameDatabase(parts[0], newName)
+		}
+		if err != nil {
+			writeDropError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// TableHandler serves the writes of /databases/{db}/tables/{table}, whose GET requests DescribeTableHandler serves:
+//   - DELETE drops the table with its files, and answers 204 No Content.
+//   - PATCH renames it to the name in the body, {"name": "..."}, and answers 204 No Content.
+//
+// Unknown databases and tables answer 404 Not Found, tables referenced by a foreign key of another table and names
+// taken by another table 409 Conflict.
+func TableHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !dropMethodAllowed(w, r, []string{"GET", "DELETE", "PATCH"}) {
+			return
+		}
+		parts := pathSegments(r.URL.EscapedPath())
+		if len(parts) != 3 || parts[1] != "tables" {
+			writeError(w, "Expected /databases/{db}/tables/{table}", http.StatusNotFound)
+			return
+		}
+		if parts[0] == data.CatalogDatabase {
+			writeErrorFrom(w, data.ErrCatalogReadOnly, http.StatusForbidden)
+			return
+		}
+		db, err := server.Database(parts[0])
+		if errors.Is(err, data.ErrDatabaseNotFound) {
+			writeErrorFrom(w, data.ErrDatabaseNotFound, http.StatusNotFound)
+			return
+		} else if err != nil {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !writeAllowed(w, r) {
+			return
+		}
+
+		if r.Method == "DELETE" {
+			err = db.DropTable(parts[2])
+		} else {
+			newName, ok := readNewName(w, r)
+			if !ok {
+				return
+			}
+			err = db.RenameTable(parts[2], newName)
+		}
+		if err != nil {
+			writeDropError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// dropMethodAllowed answers 405 Method Not Allowed with an Allow header unless the request uses one of the methods.
+func dropMethodAllowed(w http.ResponseWriter, r *http.Request, allowed []string) bool {
+	if slices.Contains(allowed, r.Method) {
+		return true
+	}
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, "Only "+strings.Join(allowed, ", ")+" methods are allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// readNewName reads the {"name": "..."} body of a rename, answering 400 Bad Request if it has no name.
+func readNewName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var payload struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Name == "" {
+		writeError(w, `Invalid request body, expected {"name": "..."}`, http.StatusBadRequest)
+		return "", false
+	}
+	return payload.Name, true
+}
+
+// writeDropError answers a failed drop or rename: 404 Not Found for unknown databases and tables, 403 Forbidden for
+// the catalog, 409 Conflict for referenced tables and taken names, 400 Bad Request for reserved and invalid names,
+// and 500 Internal Server Error otherwise.
+func writeDropError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, data.ErrDatabaseNotFound):
+		writeErrorFrom(w, data.ErrDatabaseNotFound, http.StatusNotFound)
+	case errors.Is(err, data.ErrTableNotFound):
+		writeErrorFrom(w, data.ErrTableNotFound, http.StatusNotFound)
+	case errors.Is(err, data.ErrCatalogReadOnly):
+		writeErrorFrom(w, err, http.StatusForbidden)
+	case errors.Is(err, data.ErrTableReferenced), errors.Is(err, data.ErrNameTaken):
+		writeErrorFrom(w, err, http.StatusConflict)
+	case errors.Is(err, data.ErrInvalidName):
+		writeErrorFrom(w, err, http.StatusBadRequest)
+	default:
+		writeErrorFrom(w, err, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+)
+
+// ErrorResponse is the body of every error response of the API. Code is a stable, machine-readable name of the
+// error, such as "record_not_found", that clients can branch on instead of parsing Message, which is meant for
+// people and may change. Details, if set, holds what the error is about, such as the rules a record broke.
+type ErrorResponse struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// errorCodes are the codes of the errors of pkg/data and of this package, checked in order with errors.Is.
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{data.ErrDatabaseNotFound, "database_not_found"},
+	{data.ErrTableNotFound, "table_not_found"},
+	{data.ErrTableDropped, "table_not_found"},
+	{data.ErrRecordNotFound, "record_not_found"},
+	{data.ErrDuplicateKey, "duplicate_key"},
+	{data.ErrInvalidKey, "invalid_key"},
+	{data.ErrSchemaViolation, "schema_violation"},
+	{data.ErrValidationFailed, "validation_failed"},
+	{data.ErrCatalogReadOnly, "read_only"},
+	{data.ErrReadOnly, "server_read_only"},
+	{data.ErrClosed, "closed"},
+	{data.ErrNameTaken, "name_taken"},
+	{data.ErrInvalidName, "invalid_name"},
+	{data.ErrTableReferenced, "table_referenced"},
+	{data.ErrNoRetentionPolicy, "no_retention_policy"},
+	{data.ErrTableNotQuarantined, "table_not_quarantined"},
+	{data.ErrRestoreNotConfirmed, "restore_not_confirmed"},
+	{data.ErrBackupNotFound, "backup_not_found"},
+	{data.ErrNoBackupDestination, "no_backup_destination"},
+	{data.ErrBackupCorrupt, "backup_corrupt"},
+	{data.ErrCoercionFailed, "coercion_failed"},
+	{data.ErrTxDone, "transaction_done"},
+	{data.ErrUserNotFound, "user_not_found"},
+	{data.ErrRoleNotFound, "role_not_found"},
+	{data.ErrInvalidCredentials, "invalid_credentials"},
+	{data.ErrInvalidAPIKey, "invalid_api_key"},
+	{data.ErrAPIKeyNotFound, "api_key_not_found"},
+	{data.ErrJobNotFound, "job_not_found"},
+	{data.ErrTenantNotFound, "tenant_not_found"},
+	{ErrTenantMismatch, "tenant_mismatch"},
+	{ErrInvalidToken, "invalid_token"},
+	{ErrTransactionNotFound, "transaction_not_found"},
+}
+
+// statusCode returns the code of the errors that have no code of their own, named after the status, such as
+// "not_found" for 404 Not Found.
+func statusCode(status int) string {
+	switch status {
+	case http.StatusInternalServerError:
+		return "internal"
+	case http.StatusRequestEntityTooLarge:
+		return "too_large"
+	}
+	if text := http.StatusText(status); text != "" {
+		return strings.ReplaceAll(strings.ToLower(text), " ", "_")
+	}
+	return "error"
+}
+
+// errorDetails returns the code and the details of err, or the code of the status if err has no code of its own.
+func errorDetails(err error, status int) (string, interface{}) {
+	var validationErr *data.ValidationError
+	var limitErr *data.LimitExceededError
+	var backpressureErr *data.BackpressureError
+	var corruptErr *data.CorruptRecordsError
+	switch {
+	case errors.As(err, &validationErr):
+		return "validation_failed", map[string]interface{}{"violations": validationErr.Violations}
+	case errors.As(err, &limitErr):
+		details := make(map[string]interface{})
+		if limitErr.MaxRows > 0 {
+			details["maxRows"] = limitErr.MaxRows
+		}
+		if limitErr.MaxDuration > 0 {
+			details["maxDuration"] = limitErr.MaxDuration.String()
+		}
+		return "limit_exceeded", details
+	case errors.As(err, &backpressureErr):
+		return "too_many_pending_writes", map[string]interface{}{
+			"pending": backpressureErr.Pending, "limit": backpressureErr.Limit, "retryAfter": backpressureErr.RetryAfter.String(),
+		}
+	case errors.As(err, &corruptErr):
+		return "corrupt_records", map[string]interface{}{"keys": corruptErr.Keys}
+	}
+	for _, known := range errorCodes {
+		if errors.Is(err, known.err) {
+			return known.code, nil
+		}
+	}
+	return statusCode(status), nil
+}
+
+// writeError answers with the status and an ErrorResponse holding the message, with the code of the status. It takes
+// the place of http.Error, so every error of the API is JSON.
+func writeError(w http.ResponseWriter, message string, status int) {
+	writeErrorResponse(w, ErrorResponse{Code: statusCode(status), Message: message}, status)
+}
+
+// writeErrorFrom answers with the status and an ErrorResponse holding err, with the code and details of the typed
+// errors of pkg/data, see errorDetails. Writes refused by a read-only server are answered with 403 Forbidden whatever
+// the status, as every route that writes can be refused.
+func writeErrorFrom(w http.ResponseWriter, err error, status int) {
+	if errors.Is(err, data.ErrReadOnly) {
+		status = http.StatusForbidden
+	}
+	code, details := errorDetails(err, status)
+	writeErrorResponse(w, ErrorResponse{Code: code, Message: err.Error(), Details: details}, status)
+}
+
+// writeErrorResponse answers with the status and the error as JSON.
+func writeErrorResponse(w http.ResponseWriter, response ErrorResponse, status int) {
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// notFoundHandler answers the paths no route serves with 404 Not Found.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, "No route serves "+r.URL.Path, http.StatusNotFound)
+}
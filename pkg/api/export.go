@@ -0,0 +1,109 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+	"github.com/Malpizarr/dbproto/pkg/exports"
+)
+
+// exportFormats maps the formats of the export route to their media type and the function streaming them.
+var exportFormats = map[string]struct {
+	mediaType string
+	write     func(w io.Writer, iter exports.RecordIterator) error
+}{
+	"csv":  {"text/csv; charset=utf-8", exports.ExportCSV},
+	"json": {mediaTypeJSON, exports.ExportJSON},
+	"xml":  {"application/xml", exports.ExportXML},
+}
+
+// ExportHandler serves GET /databases/{db}/tables/{table}/export?format=csv|json|xml, which streams the records of
+// the table as a file download, csv if the format is empty, like dbproto export. The where, fields, sortBy and limit
+// parameters export only the records and fields they select, see exportQuery. The records are read from the
+// version of the table current when the request started and written one by one, so the export is never held in
+// memory and writes do not wait for it. An error once the response has started aborts it, so clients never take a
+// truncated export for a complete one.
+//
+// Unknown formats and invalid queries answer 400 Bad Request, and unknown databases and tables 404 Not Found.
+func ExportHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeError(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := r.URL.Query().Get("format")
+		if name == "" {
+			name = "csv"
+		}
+		format, ok := exportFormats[name]
+		if !ok {
+			writeError(w, "Unsupported format "+name+", expected csv, json or xml", http.StatusBadRequest)
+			return
+		}
+		parts := pathSegments(r.URL.EscapedPath())
+		table, ok := tableFromPath(server, w, parts[0], parts[2])
+		if !ok {
+			return
+		}
+		builder, err := exportQuery(table, r.URL.Query())
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		iter, err := builder.WithContext(r.Context()).Iterate()
+		if err != nil {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
+			return
+		}
+		// Exports of large tables last longer than the write timeout of the server
+		stream := http.NewResponseController(w)
+		if err := stream.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", format.mediaType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", parts[2]+"."+name))
+		if err := format.write(w, iter); err != nil {
+			log.Printf("Failed to export the records of table %s: %v", parts[2], err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// exportQuery returns the query of the parameters of an export: where, the conditions of a WHERE clause, see
+// data.ParseConditions, fields, a comma-separated list of the top-level fields exported, sortBy and limit.
+func exportQuery(table *data.Table, params url.Values) (*data.QueryBuilder, error) {
+	builder := table.NewQuery().OrderBy(params.Get("sortBy"))
+	if fields := params.Get("fields"); fields != "" {
+		builder.Select(strings.Split(fields, ",")...)
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid limit %q", limit)
+		}
+		builder.Limit(n)
+	}
+	if where := params.Get("where"); where != "" {
+		conditions, err := data.ParseConditions(where)
+		if err != nil {
+			return nil, err
+		}
+		for _, condition := range conditions {
+			builder.Where(condition.Field, condition.Operator, condition.Value)
+		}
+	}
+	if _, err := builder.Query(); err != nil {
+		return nil, err
+	}
+	return builder, nil
+}
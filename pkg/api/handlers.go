@@ -1,17 +1,101 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/Malpizarr/dbproto/pkg/data"
 )
 
+// RoleHeader is the request header naming the role whose limits apply to reads, see Server.SetRoleLimits.
+// The server does not authenticate it: deployments that give roles higher limits must set it in an
+// authenticating proxy and drop it from client requests.
+const RoleHeader = "X-Dbproto-Role"
+
+// ConsistencyHeader is the request header choosing which writes the reads of a request observe: read-your-writes,
+// the default, serves them from memory, with every write that returned, and durable only serves the writes already
+// in the files of tables in write-behind mode, see data.WithConsistency.
+const ConsistencyHeader = "X-Dbproto-Consistency"
+
+// consistent serves the requests with the consistency named by their ConsistencyHeader in their context, rejecting
+// those naming none of them with 400 Bad Request.
+func consistent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.Header.Get(ConsistencyHeader)
+		if name == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		consistency, err := data.ParseConsistency(name)
+		if err != nil {
+			writeError(w, fmt.Sprintf("Invalid %s: %v", ConsistencyHeader, err), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(data.WithConsistency(r.Context(), consistency)))
+	})
+}
+
+// limitedContext returns the context of the request carrying the read limits of its role.
+func limitedContext(server *data.Server, r *http.Request) (context.Context, context.CancelFunc) {
+	return data.WithLimits(r.Context(), server.LimitsFor(r.Header.Get(RoleHeader)))
+}
+
+// readErrorStatus returns the status code of a failed read: 422 Unprocessable Entity if it exceeded a limit,
+// so clients know to refine the request, and fallback otherwise.
+func readErrorStatus(err error, fallback int) int {
+	var limitErr *data.LimitExceededError
+	if errors.As(err, &limitErr) {
+		return http.StatusUnprocessableEntity
+	}
+	return fallback
+}
+
+// writeErrorStatus returns the status code of a failed write: 429 Too Many Requests if the table had too many
+// pending writes, after setting Retry-After so clients know when to retry, and otherwise the status of
+// recordErrorStatus.
+func writeErrorStatus(w http.ResponseWriter, err error, fallback int) int {
+	var backpressureErr *data.BackpressureError
+	if errors.As(err, &backpressureErr) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(backpressureErr.RetryAfter.Seconds()))))
+		return http.StatusTooManyRequests
+	}
+	return recordErrorStatus(err, fallback)
+}
+
+// recordErrorStatus returns the status code of a write of a record that failed because of the record itself: 422 Unprocessable Entity if it broke the validation rules of the table, 400 Bad Request if it did
+// not match the table schema or had an invalid key, 404 Not Found if its key had no record, 409 Conflict if it had one
+// already, and fallback otherwise.
+func recordErrorStatus(err error, fallback int) int {
+	var validationErr *data.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, data.ErrSchemaViolation), errors.Is(err, data.ErrInvalidKey):
+		return http.StatusBadRequest
+	case errors.Is(err, data.ErrRecordNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, data.ErrDuplicateKey):
+		return http.StatusConflict
+	}
+	return fallback
+}
+
+// writeWriteError answers a failed write with the status of writeErrorStatus. If the record broke the validation
+// rules of the table, the details of the error list the violations, so clients can point at every failing field.
+func writeWriteError(w http.ResponseWriter, err error, fallback int) {
+	writeErrorFrom(w, err, writeErrorStatus(w, err, fallback))
+}
+
 func CreateDatabaseHandler(server *data.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
-			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			writeError(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
@@ -19,11 +103,11 @@ func CreateDatabaseHandler(server *data.Server) http.HandlerFunc {
 			Name string `json:"name"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			writeError(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 		if err := server.CreateDatabase(payload.Name); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeErrorFrom(w, err, http.StatusInternalServerError)
 			return
 		}
 		fmt.Fprintf(w, "Database '%s' created successfully.", payload.Name)
@@ -33,33 +117,65 @@ func CreateDatabaseHandler(server *data.Server) http.HandlerFunc {
 func CreateTableHandler(server *data.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
-			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			writeError(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
 		dbName := r.URL.Query().Get("dbName")
 		if dbName == "" {
-			http.Error(w, "Database name is required", http.StatusBadRequest)
+			writeError(w, "Database name is required", http.StatusBadRequest)
 			return
 		}
 
 		var payload struct {
-			TableName  string `json:"tableName"`
-			PrimaryKey string `json:"primaryKey"`
+			TableName        string                    `json:"tableName"`
+			PrimaryKey       string                    `json:"primaryKey"`
+			ClientEncrypted  bool                      `json:"clientEncrypted,omitempty"`
+			Pipeline         []string                  `json:"pipeline,omitempty"`
+			AutoID           bool                      `json:"autoID,omitempty"`
+			Timestamps       bool                      `json:"timestamps,omitempty"`
+			ForeignKeys      []data.ForeignKey         `json:"foreignKeys,omitempty"`
+			Schema           map[string]string         `json:"schema,omitempty"`
+			KeyNormalization *data.KeyNormalization    `json:"keyNormalization,omitempty"`
+			ComputedFields   []data.ComputedField      `json:"computedFields,omitempty"`
+			Rules            map[string]data.FieldRule `json:"rules,omitempty"`
+			CacheSize        int                       `json:"cacheSize,omitempty"`
+			WriteBehind      *data.WriteBehind         `json:"writeBehind,omitempty"`
+			Concurrency      int                       `json:"concurrency,omitempty"`
+			Compression      string                    `json:"compression,omitempty"`
+			Segmentation     *data.Segmentation        `json:"segmentation,omitempty"`
+			InMemory         bool                      `json:"inMemory,omitempty"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			writeError(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
-		db, exists := server.Databases[dbName]
-		if !exists {
-			http.Error(w, "Database not found", http.StatusNotFound)
+		db, err := server.Database(dbName)
+		if err != nil {
+			writeErrorFrom(w, data.ErrDatabaseNotFound, http.StatusNotFound)
 			return
 		}
 
-		if err := db.CreateTable(payload.TableName, payload.PrimaryKey); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		options := data.TableOptions{
+			ClientEncrypted:  payload.ClientEncrypted,
+			Pipeline:         payload.Pipeline,
+			AutoID:           payload.AutoID,
+			Timestamps:       payload.Timestamps,
+			ForeignKeys:      payload.ForeignKeys,
+			Schema:           payload.Schema,
+			KeyNormalization: payload.KeyNormalization,
+			ComputedFields:   payload.ComputedFields,
+			Rules:            payload.Rules,
+			CacheSize:        payload.CacheSize,
+			WriteBehind:      payload.WriteBehind,
+			Concurrency:      payload.Concurrency,
+			Compression:      payload.Compression,
+			Segmentation:     payload.Segmentation,
+			InMemory:         payload.InMemory,
+		}
+		if err := db.CreateTableWithOptions(payload.TableName, payload.PrimaryKey, options); err != nil {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
 			return
 		}
 		fmt.Fprintf(w, "Table '%s' created successfully in database '%s'.", payload.TableName, dbName)
@@ -69,85 +185,214 @@ func CreateTableHandler(server *data.Server) http.HandlerFunc {
 func ListDatabasesHandler(server *data.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
-			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			writeError(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
 			return
 		}
 		databases := server.ListDatabases()
 		err := json.NewEncoder(w).Encode(databases)
 		if err != nil {
-			http.Error(w, "Failed to serialize response", http.StatusInternalServerError)
+			writeError(w, "Failed to serialize response", http.StatusInternalServerError)
 			return
 		}
 	}
 }
 
-func TableActionHandler(server *data.Server) http.HandlerFunc {
+// TableActionHandler performs an action on a table. Requests naming an open transaction as "transaction"
+// add their insert, update or delete to it instead of performing it, see BeginTransactionHandler.
+func TableActionHandler(server *data.Server, transactions *Transactions) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
-			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			writeError(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
 		dbName := r.URL.Query().Get("dbName")
 		if dbName == "" {
-			http.Error(w, "Database name is required", http.StatusBadRequest)
+			writeError(w, "Database name is required", http.StatusBadRequest)
 			return
 		}
 
-		db, exists := server.Databases[dbName]
-		if !exists {
-			http.Error(w, "Database not found", http.StatusNotFound)
+		db, err := server.Database(dbName)
+		if errors.Is(err, data.ErrDatabaseNotFound) {
+			writeErrorFrom(w, data.ErrDatabaseNotFound, http.StatusNotFound)
+			return
+		} else if err != nil {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
 			return
 		}
 
 		var payload struct {
-			Action    string      `json:"action"`
-			TableName string      `json:"tableName"`
-			Record    data.Record `json:"record,omitempty"`
-			Key       string      `json:"key,omitempty"`
-			Updates   data.Record `json:"updates,omitempty"`
+			Action      string                 `json:"action"`
+			TableName   string                 `json:"tableName"`
+			Transaction string                 `json:"transaction,omitempty"`
+			Record      data.Record            `json:"record,omitempty"`
+			Key         string                 `json:"key,omitempty"`
+			Updates     data.Record            `json:"updates,omitempty"`
+			Filters     map[string]interface{} `json:"filters,omitempty"`
+			Return      bool                   `json:"returnRecord,omitempty"`
+			Query       struct {
+				Filters map[string]interface{} `json:"filters,omitempty"`
+				SortBy  string                 `json:"sortBy,omitempty"`
+				Limit   int                    `json:"limit,omitempty"`
+				Offset  int                    `json:"offset,omitempty"`
+				Cursor  string                 `json:"cursor,omitempty"`
+			} `json:"query,omitempty"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			writeError(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
+		for _, fields := range []map[string]interface{}{payload.Record, payload.Updates, payload.Filters, payload.Query.Filters} {
+			if err := data.DecodeBinaryFields(fields); err != nil {
+				writeErrorFrom(w, err, http.StatusBadRequest)
+				return
+			}
+		}
 
 		table, exists := db.Tables[payload.TableName]
 		if !exists {
-			http.Error(w, "Table not found", http.StatusNotFound)
+			writeErrorFrom(w, data.ErrTableNotFound, http.StatusNotFound)
+			return
+		}
+
+		if dbName == data.CatalogDatabase && payload.Action != "selectAll" && payload.Action != "query" {
+			writeErrorFrom(w, data.ErrCatalogReadOnly, http.StatusForbidden)
+			return
+		}
+		if payload.Action != "selectAll" && payload.Action != "query" && !writeAllowed(w, r) {
+			return
+		}
+
+		if payload.Transaction != "" {
+			tx, exists := transactions.Get(payload.Transaction)
+			if !exists {
+				writeErrorFrom(w, ErrTransactionNotFound, http.StatusNotFound)
+				return
+			}
+			name := dbName + "." + payload.TableName
+			var err error
+			switch payload.Action {
+			case "insert":
+				err = tx.Insert(name, payload.Record)
+			case "update":
+				err = tx.Update(name, payload.Key, payload.Updates)
+			case "delete":
+				err = tx.Delete(name, payload.Key)
+			default:
+				writeError(w, fmt.Sprintf("Action '%s' cannot be part of a transaction", payload.Action), http.StatusBadRequest)
+				return
+			}
+			if errors.Is(err, data.ErrTxDone) {
+				writeErrorFrom(w, ErrTransactionNotFound, http.StatusNotFound)
+				return
+			} else if err != nil {
+				writeErrorFrom(w, err, http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, "Action '%s' on table '%s' added to transaction '%s'.", payload.Action, payload.TableName, payload.Transaction)
 			return
 		}
 
 		switch payload.Action {
-		case "insert":
-			if err := table.Insert(payload.Record); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+		case "insert", "update":
+			var stored data.Record
+			var err error
+			if payload.Action == "insert" {
+				stored, err = table.InsertReturningCtx(r.Context(), payload.Record)
+			} else {
+				stored, err = table.UpdateReturningCtx(r.Context(), payload.Key, payload.Updates)
+			}
+			if err != nil {
+				writeWriteError(w, err, http.StatusInternalServerError)
 				return
 			}
-		case "update":
-			if err := table.Update(payload.Key, payload.Updates); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			if payload.Return {
+				w.Header().Set("Content-Type", "application/json")
+				if err := json.NewEncoder(w).Encode(map[string]data.Record{"record": data.EncodeBinaryFields(stored)}); err != nil {
+					writeError(w, "Failed to serialize response", http.StatusInternalServerError)
+				}
 				return
 			}
 		case "delete":
-			if err := table.Delete(payload.Key); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			if err := table.DeleteCtx(r.Context(), payload.Key); err != nil {
+				writeWriteError(w, err, http.StatusInternalServerError)
 				return
 			}
+		case "updateWhere", "deleteWhere":
+			// Empty filters match every record, which a client forgetting them surely does not mean to change
+			if len(payload.Filters) == 0 {
+				writeError(w, fmt.Sprintf("Action '%s' requires filters", payload.Action), http.StatusBadRequest)
+				return
+			}
+			var affected int
+			var err error
+			if payload.Action == "updateWhere" {
+				affected, err = table.UpdateWhereCtx(r.Context(), payload.Filters, payload.Updates)
+			} else {
+				affected, err = table.DeleteWhereCtx(r.Context(), payload.Filters)
+			}
+			if err != nil {
+				writeWriteError(w, err, http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(map[string]int{"affected": affected}); err != nil {
+				writeError(w, "Failed to serialize response", http.StatusInternalServerError)
+			}
+			return
 		case "selectAll":
-			records, err := table.SelectAll()
+			mediaType, ok := negotiateRecords(w, r)
+			if !ok {
+				return
+			}
+			ctx, cancel := limitedContext(server, r)
+			defer cancel()
+			records, err := table.Iterate(ctx)
+			if err == nil {
+				err = records.CheckLimits()
+			}
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeErrorFrom(w, err, readErrorStatus(err, http.StatusInternalServerError))
+				return
+			}
+			writeRecords(w, mediaType, recordsResponse{records: records, table: table})
+			return
+		case "query":
+			mediaType, ok := negotiateRecords(w, r)
+			if !ok {
 				return
 			}
-			err = json.NewEncoder(w).Encode(records)
+			ctx, cancel := limitedContext(server, r)
+			defer cancel()
+			records, err := table.IterateQuery(ctx, data.Query{
+				Filters: payload.Query.Filters,
+				SortBy:  payload.Query.SortBy,
+				Limit:   payload.Query.Limit,
+				Offset:  payload.Query.Offset,
+				Cursor:  payload.Query.Cursor,
+			})
+			if err == nil {
+				err = records.CheckLimits()
+			}
 			if err != nil {
-				http.Error(w, "Failed to serialize response", http.StatusInternalServerError)
+				writeErrorFrom(w, err, readErrorStatus(err, http.StatusBadRequest))
 				return
 			}
+			nextCursor := records.NextCursor()
+			if nextCursor != "" {
+				w.Header().Set(NextCursorHeader, nextCursor)
+			}
+			writeRecords(w, mediaType, recordsResponse{
+				records: records,
+				table:   table,
+				page: struct {
+					NextCursor string `json:"next_cursor,omitempty"`
+				}{nextCursor},
+			})
 			return
 		default:
-			http.Error(w, "Invalid action", http.StatusBadRequest)
+			writeError(w, "Invalid action", http.StatusBadRequest)
 		}
 
 		fmt.Fprintf(w, "Action '%s' performed successfully on table '%s'.", payload.Action, payload.TableName)
@@ -157,13 +402,13 @@ func TableActionHandler(server *data.Server) http.HandlerFunc {
 func JoinTablesHandler(server *data.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
-			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			writeError(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
 		dbName := r.URL.Query().Get("dbName")
 		if dbName == "" {
-			http.Error(w, "Database name is required", http.StatusBadRequest)
+			writeError(w, "Database name is required", http.StatusBadRequest)
 			return
 		}
 
@@ -173,41 +418,566 @@ func JoinTablesHandler(server *data.Server) http.HandlerFunc {
 			Key1     string        `json:"key1"`
 			Key2     string        `json:"key2"`
 			JoinType data.JoinType `json:"joinType"`
+			// IntoTable, if set, names a new table the joined records are written to instead of being returned,
+			// with PrimaryKey as its primary key.
+			IntoTable  string `json:"intoTable"`
+			PrimaryKey string `json:"primaryKey"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&joinRequest); err != nil {
 			fmt.Printf("Error decoding JSON: %v\n", err)
-			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			writeError(w, "Invalid JSON body", http.StatusBadRequest)
 			return
 		}
 
-		db, exists := server.Databases[dbName]
-		if !exists {
-			http.Error(w, "Database not found", http.StatusNotFound)
+		db, err := server.Database(dbName)
+		if errors.Is(err, data.ErrDatabaseNotFound) {
+			writeErrorFrom(w, data.ErrDatabaseNotFound, http.StatusNotFound)
+			return
+		} else if err != nil {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
 			return
 		}
 
 		t1, exists1 := db.Tables[joinRequest.Table1]
 		t2, exists2 := db.Tables[joinRequest.Table2]
 		if !exists1 || !exists2 {
-			http.Error(w, "One or both tables not found", http.StatusNotFound)
+			writeErrorFrom(w, fmt.Errorf("%w: one or both tables do not exist", data.ErrTableNotFound), http.StatusNotFound)
 			return
 		}
 
-		results, err := data.JoinTables(t1, t2, joinRequest.Key1, joinRequest.Key2, joinRequest.JoinType)
+		if joinRequest.IntoTable != "" {
+			// Joins are read routes, see readRoutes, but materializing one creates a table
+			if !writeAllowed(w, r) {
+				return
+			}
+			count, err := db.JoinIntoTableCtx(r.Context(), t1, t2, joinRequest.Key1, joinRequest.Key2, joinRequest.JoinType, joinRequest.IntoTable, joinRequest.PrimaryKey)
+			if err != nil {
+				fmt.Printf("Error materializing join: %v\n", err)
+				writeError(w, "Join operation failed: "+err.Error(), writeErrorStatus(w, err, http.StatusInternalServerError))
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, "Table '%s' created with %d joined records in database '%s'.", joinRequest.IntoTable, count, dbName)
+			return
+		}
+
+		mediaType, ok := negotiateRecords(w, r)
+		if !ok {
+			return
+		}
+		ctx, cancel := limitedContext(server, r)
+		defer cancel()
+		results, err := data.JoinTablesCtx(ctx, t1, t2, joinRequest.Key1, joinRequest.Key2, joinRequest.JoinType)
 		if err != nil {
 			fmt.Printf("Error joining tables: %v\n", err)
-			http.Error(w, "Join operation failed: "+err.Error(), http.StatusInternalServerError)
+			writeError(w, "Join operation failed: "+err.Error(), readErrorStatus(err, http.StatusInternalServerError))
+			return
+		}
+
+		records := make([]data.Record, len(results))
+		for i, result := range results {
+			records[i] = result
+		}
+		writeRecords(w, mediaType, recordsResponse{records: &protoIterator{records: records}})
+	}
+}
+
+// StatsHandler serves the metrics, index recommendations and cache states of every table.
+// GET returns them, with the counts since the tables were opened or their metrics reset, or with mode=delta, the
+// counts since the previous delta request. DELETE resets the metrics of every table.
+func StatsHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+		case "DELETE":
+			server.ResetMetrics()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		default:
+			writeError(w, "Only GET and DELETE methods are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		mode := r.URL.Query().Get("mode")
+		if mode != "" && mode != "total" && mode != "delta" {
+			writeError(w, "Invalid mode, expected total or delta", http.StatusBadRequest)
+			return
+		}
+
+		stats := struct {
+			Mode            string                                `json:"mode"`
+			Metrics         map[string]data.MetricsSnapshot       `json:"metrics"`
+			Recommendations map[string][]data.IndexRecommendation `json:"recommendations"`
+			Caching         map[string]data.CacheState            `json:"caching"`
+		}{
+			Mode:            "total",
+			Metrics:         server.MetricsSnapshots(mode == "delta"),
+			Recommendations: server.IndexRecommendations(),
+			Caching:         server.CacheStates(),
+		}
+		if mode == "delta" {
+			stats.Mode = mode
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			writeError(w, "Failed to serialize response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// BackupsHandler manages the backups of the server. GET lists them, newest first, as data.Backup, or with remote=true
+// the copies at the backup destination. POST takes {"action": ...} with action "create" to back up the databases now,
+// with an optional "name", and answer 201 Created with the data.BackupResult, "delete" to delete the backup whose file
+// name or name is "backup" and answer with it, "fetch" to download it from the backup destination and answer with it,
+// or "prune" to delete the backups the retention given as "retention", or else the one of the server, does not keep,
+// and answer with them. Invalid names answer 400 Bad Request and unknown backups 404 Not Found.
+func BackupsHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Action    string                `json:"action"`
+			Name      string                `json:"name,omitempty"`
+			Backup    string                `json:"backup,omitempty"`
+			Retention *data.BackupRetention `json:"retention,omitempty"`
+		}
+		switch r.Method {
+		case "GET":
+			payload.Action = "list"
+		case "POST":
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				writeError(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		default:
+			writeError(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var response interface{}
+		var err error
+		status := http.StatusOK
+		switch payload.Action {
+		case "list":
+			list := server.ListBackups
+			if r.URL.Query().Get("remote") == "true" {
+				list = server.ListRemoteBackups
+			}
+			var backups []data.Backup
+			backups, err = list()
+			if backups == nil {
+				backups = []data.Backup{}
+			}
+			response = backups
+		case "create":
+			response, err = server.CreateBackup(data.BackupOptions{Name: payload.Name})
+			status = http.StatusCreated
+		case "delete":
+			response, err = server.DeleteBackup(payload.Backup)
+		case "fetch":
+			response, err = server.FetchBackup(payload.Backup)
+		case "prune":
+			retention := server.BackupRetention()
+			if payload.Retention != nil {
+				retention = *payload.Retention
+			}
+			if retention.Keep < 0 || retention.KeepDays < 0 {
+				writeError(w, "Invalid retention, keep and keepDays must not be negative", http.StatusBadRequest)
+				return
+			}
+			var pruned []data.Backup
+			pruned, err = server.PruneBackups(retention)
+			if pruned == nil {
+				pruned = []data.Backup{}
+			}
+			response = pruned
+		default:
+			writeError(w, "Invalid action, expected create, delete, fetch or prune", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, data.ErrBackupNotFound) {
+			writeErrorFrom(w, err, http.StatusNotFound)
+			return
+		} else if errors.Is(err, data.ErrInvalidName) {
+			writeErrorFrom(w, err, http.StatusBadRequest)
+			return
+		} else if errors.Is(err, data.ErrNoBackupDestination) {
+			writeErrorFrom(w, err, http.StatusConflict)
+			return
+		} else if err != nil {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			writeError(w, "Failed to serialize response", http.StatusInternalServerError)
+		}
+	}
+}
+
+// RestoreHandler previews and performs restores of the newest backup, or of the backup named by the "backup" query
+// parameter or field, a file name or name listed by /backups.
+// GET returns the RestorePreview. POST restores the backup; if that would overwrite live data,
+// the request must set "confirm" to true, otherwise it fails with 409 Conflict and the preview as body. With "dryRun"
+// set, the backup is checked like a restore and the preview returned, without restoring it. A corrupt backup fails
+// with 422 Unprocessable Entity before anything is written.
+func RestoreHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			preview, err := server.PreviewRestore(r.URL.Query().Get("backup"))
+			if err != nil {
+				writeErrorFrom(w, err, http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(preview); err != nil {
+				writeError(w, "Failed to serialize response", http.StatusInternalServerError)
+			}
+		case "POST":
+			var payload struct {
+				Backup  string `json:"backup,omitempty"`
+				Confirm bool   `json:"confirm"`
+				DryRun  bool   `json:"dryRun"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				writeError(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			preview, err := server.Restore(data.RestoreOptions{Path: payload.Backup, ConfirmOverwrite: payload.Confirm, DryRun: payload.DryRun})
+			if errors.Is(err, data.ErrRestoreNotConfirmed) {
+				writeErrorResponse(w, ErrorResponse{Code: "restore_not_confirmed", Message: err.Error(), Details: preview}, http.StatusConflict)
+				return
+			}
+			if errors.Is(err, data.ErrBackupCorrupt) {
+				writeErrorFrom(w, err, http.StatusUnprocessableEntity)
+				return
+			}
+			if err != nil {
+				writeErrorFrom(w, err, http.StatusInternalServerError)
+				return
+			}
+			if payload.DryRun {
+				w.Header().Set("Content-Type", "application/json")
+				if err := json.NewEncoder(w).Encode(preview); err != nil {
+					writeError(w, "Failed to serialize response", http.StatusInternalServerError)
+				}
+				return
+			}
+			fmt.Fprintf(w, "Backup restored: %d files, %d overwritten.", len(preview.Files), len(preview.ChangedFiles))
+		default:
+			writeError(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// VerifyBackupHandler verifies the newest backup by restoring it into a temporary directory, without touching the
+// live data. POST runs a verification and returns the BackupVerification. GET returns the result of the last
+// verification, including scheduled ones, or 404 Not Found if no backup has been verified yet.
+func VerifyBackupHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var verification *data.BackupVerification
+		switch r.Method {
+		case "GET":
+			verification = server.LastBackupVerification()
+			if verification == nil {
+				writeError(w, "No backup has been verified yet", http.StatusNotFound)
+				return
+			}
+		case "POST":
+			var err error
+			verification, err = server.VerifyBackup()
+			if err != nil {
+				writeErrorFrom(w, err, http.StatusInternalServerError)
+				return
+			}
+		default:
+			writeError(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(verification); err != nil {
+			writeError(w, "Failed to serialize response", http.StatusInternalServerError)
+		}
+	}
+}
+
+// RecoveryHandler reports and recovers the tables quarantined because they failed to load. GET returns the
+// RecoveryReport. POST takes {"database": ..., "table": ..., "action": ...} with action "retry" to load the table
+// again, "restore" to replace it with its copy in the default backup, or "discard" to delete it; it answers 404 Not
+// Found for a table that is not quarantined and 409 Conflict if the table fails to load again.
+func RecoveryHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			report, err := server.RecoveryReport()
+			if err != nil {
+				writeErrorFrom(w, err, http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(report); err != nil {
+				writeError(w, "Failed to serialize response", http.StatusInternalServerError)
+			}
+		case "POST":
+			var payload struct {
+				Database string `json:"database"`
+				Table    string `json:"table"`
+				Action   string `json:"action"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				writeError(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			var err error
+			switch payload.Action {
+			case "retry":
+				err = server.RetryQuarantinedTable(payload.Database, payload.Table)
+			case "restore":
+				err = server.RestoreQuarantinedTable(payload.Database, payload.Table, "")
+			case "discard":
+				err = server.DiscardQuarantinedTable(payload.Database, payload.Table)
+			default:
+				writeError(w, "Invalid action, expected retry, restore or discard", http.StatusBadRequest)
+				return
+			}
+			if errors.Is(err, data.ErrTableNotQuarantined) || errors.Is(err, data.ErrDatabaseNotFound) {
+				writeErrorFrom(w, err, http.StatusNotFound)
+				return
+			} else if err != nil {
+				writeErrorFrom(w, err, http.StatusConflict)
+				return
+			}
+			fmt.Fprintf(w, "Action '%s' performed on quarantined table '%s' of database '%s'.", payload.Action, payload.Table, payload.Database)
+		default:
+			writeError(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// RetentionHandler manages the retention policies of tables. GET with dbName and tableName returns a dry run of the
+// policy of the table as a RetentionReport. POST takes {"database": ..., "table": ..., "action": ...} with action
+// "set" to declare the policy given as "policy", or remove it if there is none, "enable" or "disable" to switch the
+// background application of the policy, or "apply" to apply it now and return the RetentionReport. It answers
+// 404 Not Found for a missing table and 409 Conflict for a table without a policy.
+func RetentionHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Database string                `json:"database"`
+			Table    string                `json:"table"`
+			Action   string                `json:"action"`
+			Policy   *data.RetentionPolicy `json:"policy,omitempty"`
+		}
+		switch r.Method {
+		case "GET":
+			payload.Database = r.URL.Query().Get("dbName")
+			payload.Table = r.URL.Query().Get("tableName")
+			payload.Action = "preview"
+		case "POST":
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				writeError(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+		default:
+			writeError(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		response, err := json.Marshal(results)
+		db, err := server.Database(payload.Database)
+		if errors.Is(err, data.ErrDatabaseNotFound) {
+			writeErrorFrom(w, data.ErrDatabaseNotFound, http.StatusNotFound)
+			return
+		} else if err != nil {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
+			return
+		}
+		db.RLock()
+		table, exists := db.Tables[payload.Table]
+		db.RUnlock()
+		if !exists {
+			writeErrorFrom(w, data.ErrTableNotFound, http.StatusNotFound)
+			return
+		}
+
+		var report *data.RetentionReport
+		switch payload.Action {
+		case "preview":
+			report, err = db.ApplyRetention(payload.Table, true)
+		case "apply":
+			report, err = db.ApplyRetention(payload.Table, false)
+		case "set":
+			err = table.SetRetention(payload.Policy)
+		case "enable", "disable":
+			err = table.EnableRetention(payload.Action == "enable")
+		default:
+			writeError(w, "Invalid action, expected set, enable, disable or apply", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, data.ErrNoRetentionPolicy) {
+			writeErrorFrom(w, err, http.StatusConflict)
+			return
+		} else if err != nil {
+			writeErrorFrom(w, err, http.StatusBadRequest)
+			return
+		}
+		if report == nil {
+			fmt.Fprintf(w, "Action '%s' performed on the retention policy of table '%s' of database '%s'.", payload.Action, payload.Table, payload.Database)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			writeError(w, "Failed to serialize response", http.StatusInternalServerError)
+		}
+	}
+}
+
+// WriteBehindHandler manages the write-behind mode of tables. POST takes {"database": ..., "table": ..., "action": ...}
+// with action "set" to switch the table to write-behind mode with the policy given as "policy", or back to writing its
+// file on every write if there is none, or "flush" to write its pending writes to the file now. It answers 404 Not
+// Found for a missing table.
+func WriteBehindHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var payload struct {
+			Database string            `json:"database"`
+			Table    string            `json:"table"`
+			Action   string            `json:"action"`
+			Policy   *data.WriteBehind `json:"policy,omitempty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		db, err := server.Database(payload.Database)
+		if errors.Is(err, data.ErrDatabaseNotFound) {
+			writeErrorFrom(w, data.ErrDatabaseNotFound, http.StatusNotFound)
+			return
+		} else if err != nil {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
+			return
+		}
+		db.RLock()
+		table, exists := db.Tables[payload.Table]
+		db.RUnlock()
+		if !exists {
+			writeErrorFrom(w, data.ErrTableNotFound, http.StatusNotFound)
+			return
+		}
+
+		status := http.StatusBadRequest
+		switch payload.Action {
+		case "set":
+			err = table.SetWriteBehind(payload.Policy)
+		case "flush":
+			err = table.Flush()
+			status = http.StatusInternalServerError
+		default:
+			writeError(w, "Invalid action, expected set or flush", http.StatusBadRequest)
+			return
+		}
 		if err != nil {
-			fmt.Printf("Error marshaling response: %v\n", err)
-			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			writeErrorFrom(w, err, status)
 			return
 		}
+		fmt.Fprintf(w, "Action '%s' performed on the write-behind mode of table '%s' of database '%s'.", payload.Action, payload.Table, payload.Database)
+	}
+}
 
+// SegmentationHandler manages the segmented mode of tables. POST takes {"database": ..., "table": ..., "action": ...}
+// with action "set" to switch the table to segmented mode with the policy given as "policy", or back to rewriting
+// its file on every write if there is none, or "compact" to fold its segments into its file now. It answers 404 Not
+// Found for a missing table.
+func SegmentationHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var payload struct {
+			Database string             `json:"database"`
+			Table    string             `json:"table"`
+			Action   string             `json:"action"`
+			Policy   *data.Segmentation `json:"policy,omitempty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		db, err := server.Database(payload.Database)
+		if errors.Is(err, data.ErrDatabaseNotFound) {
+			writeErrorFrom(w, data.ErrDatabaseNotFound, http.StatusNotFound)
+			return
+		} else if err != nil {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
+			return
+		}
+		db.RLock()
+		table, exists := db.Tables[payload.Table]
+		db.RUnlock()
+		if !exists {
+			writeErrorFrom(w, data.ErrTableNotFound, http.StatusNotFound)
+			return
+		}
+
+		status := http.StatusBadRequest
+		switch payload.Action {
+		case "set":
+			err = table.SetSegmentation(payload.Policy)
+		case "compact":
+			err = table.Compact()
+			status = http.StatusInternalServerError
+		default:
+			writeError(w, "Invalid action, expected set or compact", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			writeErrorFrom(w, err, status)
+			return
+		}
+		fmt.Fprintf(w, "Action '%s' performed on the segmented mode of table '%s' of database '%s'.", payload.Action, payload.Table, payload.Database)
+	}
+}
+
+// DescribeTableHandler serves GET /databases/{db}/tables/{table}, which returns the data.TableDescription of the
+// table: its primary key, declared schema, indexes and constraints, number of records and file size.
+func DescribeTableHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeError(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/databases/"), "/")
+		if len(parts) != 3 || parts[0] == "" || parts[1] != "tables" || parts[2] == "" {
+			writeError(w, "Expected /databases/{db}/tables/{table}", http.StatusNotFound)
+			return
+		}
+		db, err := server.Database(parts[0])
+		if errors.Is(err, data.ErrDatabaseNotFound) {
+			writeErrorFrom(w, data.ErrDatabaseNotFound, http.StatusNotFound)
+			return
+		} else if err != nil {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		description, err := db.DescribeTable(parts[2])
+		if errors.Is(err, data.ErrTableNotFound) {
+			writeErrorFrom(w, data.ErrTableNotFound, http.StatusNotFound)
+			return
+		} else if err != nil {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		w.Write(response)
+		if err := json.NewEncoder(w).Encode(description); err != nil {
+			writeError(w, "Failed to serialize response", http.StatusInternalServerError)
+		}
 	}
 }
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Readiness tracks whether the server has finished starting and can serve API requests.
+// The zero value is not ready.
+type Readiness struct {
+	ready atomic.Bool
+}
+
+// SetReady marks the server as ready.
+func (r *Readiness) SetReady() {
+	r.ready.Store(true)
+}
+
+// Ready reports whether the server is ready.
+func (r *Readiness) Ready() bool {
+	return r.ready.Load()
+}
+
+// Gate rejects requests with 503 Service Unavailable until the server is ready and passes them to next afterwards.
+func (r *Readiness) Gate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !r.Ready() {
+			writeError(w, "Server is not ready", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// HealthHandler answers liveness probes. It succeeds as long as the process serves HTTP.
+func HealthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	}
+}
+
+// ReadyHandler answers readiness probes with 200 once the server is ready and 503 before.
+func ReadyHandler(readiness *Readiness) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !readiness.Ready() {
+			writeError(w, "Not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "Ready")
+	}
+}
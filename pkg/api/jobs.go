@@ -0,0 +1,120 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+)
+
+// JobsHandler runs long operations in the background as jobs, so requests do not wait for them. POST takes
+// {"kind": ...} with kind "backup" with an optional "name" like /backups, "restore" with "backup" and "confirm" like
+// /restore, "export" with "database", "table" and
+// "format" (csv, json, xml or parquet, csv if empty), or "reindex" with "database" and an optional "table", and answers 202
+// Accepted with the data.Job and its Location, /jobs/{id}. GET lists the running jobs and those that finished within
+// the last hour, newest first.
+//
+// Unknown kinds and formats answer 400 Bad Request, unknown databases and tables 404 Not Found, and restores that
+// would overwrite live data without confirmation 409 Conflict with the preview of the restore as details.
+func JobsHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			writeJob(w, server.Jobs(), http.StatusOK)
+			return
+		case "POST":
+		default:
+			writeError(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var payload struct {
+			Kind     string `json:"kind"`
+			Name     string `json:"name,omitempty"`
+			Backup   string `json:"backup,omitempty"`
+			Database string `json:"database,omitempty"`
+			Table    string `json:"table,omitempty"`
+			Format   string `json:"format,omitempty"`
+			Confirm  bool   `json:"confirm,omitempty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var job data.Job
+		var err error
+		switch payload.Kind {
+		case "backup":
+			job, err = server.StartBackup(data.BackupOptions{Name: payload.Name})
+		case "restore":
+			var preview *data.RestorePreview
+			job, preview, err = server.StartRestore(data.RestoreOptions{Path: payload.Backup, ConfirmOverwrite: payload.Confirm})
+			if errors.Is(err, data.ErrRestoreNotConfirmed) {
+				writeErrorResponse(w, ErrorResponse{Code: "restore_not_confirmed", Message: err.Error(), Details: preview}, http.StatusConflict)
+				return
+			}
+		case "export":
+			if payload.Format == "" {
+				payload.Format = "csv"
+			}
+			if payload.Format != "csv" && payload.Format != "json" && payload.Format != "xml" && payload.Format != "parquet" {
+				writeError(w, "Unsupported format "+payload.Format+", expected csv, json, xml or parquet", http.StatusBadRequest)
+				return
+			}
+			job, err = server.StartExport(payload.Database, payload.Table, payload.Format)
+		case "reindex":
+			job, err = server.StartReindex(payload.Database, payload.Table)
+		default:
+			writeError(w, "Unknown job kind "+payload.Kind+", expected backup, restore, export or reindex", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, data.ErrDatabaseNotFound) || errors.Is(err, data.ErrTableNotFound) {
+			writeErrorFrom(w, err, http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, data.ErrInvalidName) {
+			writeErrorFrom(w, err, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Location", strings.TrimSuffix(requestPath(r), "/")+"/"+url.PathEscape(job.ID))
+		writeJob(w, job, http.StatusAccepted)
+	}
+}
+
+// JobHandler serves GET /jobs/{id}, which reports the status and progress of a job started with JobsHandler, and its
+// result once it succeeded, such as the path of the backup file. Unknown jobs, and jobs that finished longer than an
+// hour ago, answer 404 Not Found.
+func JobHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeError(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+		if id == "" || strings.Contains(id, "/") {
+			writeError(w, "Expected /jobs/{id}", http.StatusNotFound)
+			return
+		}
+		job, err := server.Job(id)
+		if err != nil {
+			writeErrorFrom(w, err, http.StatusNotFound)
+			return
+		}
+		writeJob(w, job, http.StatusOK)
+	}
+}
+
+// writeJob answers with the status and the job, or jobs, as JSON.
+func writeJob(w http.ResponseWriter, job interface{}, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(job)
+}
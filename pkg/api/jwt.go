@@ -0,0 +1,392 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+)
+
+// tokenIssuer is the iss claim of the tokens issued by the server.
+const tokenIssuer = "dbproto"
+
+// ErrInvalidToken is returned by Tokens.Verify for a token that is malformed, has a wrong signature or has expired.
+var ErrInvalidToken = errors.New("invalid token")
+
+// Tokens issues and verifies the JSON Web Tokens users authenticate with, signed with HMAC-SHA256 (HS256).
+type Tokens struct {
+	Secret []byte        // Secret signs the tokens, at least 32 bytes.
+	TTL    time.Duration // TTL is how long a token is valid after it is issued.
+}
+
+// NewTokens returns Tokens signing with the secret, which must be at least 32 bytes long.
+func NewTokens(secret []byte, ttl time.Duration) (*Tokens, error) {
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("the token secret must be at least 32 bytes long, got %d", len(secret))
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("the token lifetime must be positive")
+	}
+	return &Tokens{Secret: secret, TTL: ttl}, nil
+}
+
+// tokenClaims are the claims of the tokens issued by the server.
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	Issuer    string `json:"iss"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	Tenant    string `json:"tenant,omitempty"`
+}
+
+// Issue returns a token for the user of the root server, and when it expires.
+func (t *Tokens) Issue(username string) (string, time.Time, error) {
+	return t.IssueTenant("", username)
+}
+
+// IssueTenant returns a token for the user of the tenant, bound to the tenant, and when it expires. An empty tenant
+// issues a token for a user of the root server.
+func (t *Tokens) IssueTenant(tenant, username string) (string, time.Time, error) {
+	now := time.Now()
+	expires := now.Add(t.TTL)
+	header, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	claims, err := json.Marshal(tokenClaims{Subject: username, Issuer: tokenIssuer, IssuedAt: now.Unix(), ExpiresAt: expires.Unix(), Tenant: tenant})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(t.sign(signed)), expires, nil
+}
+
+// Verify checks the signature and the expiry of a token of a user of the root server and returns the user it was
+// issued to. Tokens bound to a tenant are rejected, so a user of a tenant is never taken for a user of the root server
+// with the same name; VerifyTenant accepts them.
+func (t *Tokens) Verify(token string) (string, error) {
+	tenant, username, err := t.VerifyTenant(token)
+	if err == nil && tenant != "" {
+		return "", ErrInvalidToken
+	}
+	return username, err
+}
+
+// VerifyTenant checks the signature and the expiry of a token and returns the tenant it is bound to, empty for the
+// root server, and the user it was issued to.
+func (t *Tokens) VerifyTenant(token string) (string, string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", "", ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, t.sign(parts[0]+"."+parts[1])) {
+		return "", "", ErrInvalidToken
+	}
+
+	// The algorithm is checked even though the signature matched, so tokens are never accepted unsigned
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	var claims tokenClaims
+	if content, err := base64.RawURLEncoding.DecodeString(parts[0]); err != nil || json.Unmarshal(content, &header) != nil || header.Algorithm != "HS256" {
+		return "", "", ErrInvalidToken
+	}
+	if content, err := base64.RawURLEncoding.DecodeString(parts[1]); err != nil || json.Unmarshal(content, &claims) != nil {
+		return "", "", ErrInvalidToken
+	}
+	if claims.Issuer != tokenIssuer || claims.Subject == "" || time.Now().Unix() >= claims.ExpiresAt {
+		return "", "", ErrInvalidToken
+	}
+	return claims.Tenant, claims.Subject, nil
+}
+
+// sign returns the HMAC-SHA256 of the signed part of a token.
+func (t *Tokens) sign(signed string) []byte {
+	mac := hmac.New(sha256.New, t.Secret)
+	mac.Write([]byte(signed))
+	return mac.Sum(nil)
+}
+
+// userContextKey is the context key of the user authenticating a request.
+type userContextKey struct{}
+
+// UserFromContext returns the user that authenticated the request of the context with a token, or nil if the request
+// went through no RequireJWT middleware or was authenticated with an API key.
+func UserFromContext(ctx context.Context) *data.User {
+	user, _ := ctx.Value(userContextKey{}).(*data.User)
+	return user
+}
+
+// LoginHandler issues tokens. POST takes {"username": ..., "password": ...} and answers {"token": ..., "tokenType":
+// "Bearer", "expiresAt": ...}, or 401 Unauthorized for an unknown user or a wrong password. Users of a tenant name it
+// in "tenant" or in TenantHeader, and get a token bound to it; unknown tenants answer 401 Unauthorized like unknown
+// users.
+func LoginHandler(server *data.Server, tokens *Tokens) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var payload struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Tenant   string `json:"tenant,omitempty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if payload.Tenant == "" {
+			payload.Tenant = r.Header.Get(TenantHeader)
+		}
+		tenant, err := server.Tenant(payload.Tenant)
+		if errors.Is(err, data.ErrTenantNotFound) {
+			writeErrorFrom(w, data.ErrInvalidCredentials, http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
+			return
+		}
+		user, err := tenant.AuthenticateUser(payload.Username, payload.Password)
+		if errors.Is(err, data.ErrInvalidCredentials) {
+			writeErrorFrom(w, err, http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
+			return
+		}
+		token, expires, err := tokens.IssueTenant(payload.Tenant, user.Username)
+		if err != nil {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{"token": token, "tokenType": "Bearer", "expiresAt": expires.UTC()})
+	}
+}
+
+// accessCheck is a permission a request needs on a database, or on a table of it.
+type accessCheck struct {
+	database   string
+	table      string
+	permission data.Permission
+}
+
+// RequireJWT rejects requests without a valid token with 401 Unauthorized, and requests needing a permission the roles
+// of the user do not grant with 403 Forbidden, before they reach next with the user, and the tenant the token is bound
+// to, in their context. The users and roles of a tenant are those of its server. Users of the root server may only
+// make requests to a tenant, by naming it in TenantHeader, if they have the admin permission on every database of the
+// root server. /login is open, so users can get a token. Requests sending an API key instead of a token are checked
+// like RequireAPIKey does.
+func RequireJWT(server *data.Server, tokens *Tokens, next http.Handler) http.Handler {
+	apiKeys := RequireAPIKey(server, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routePath(r.URL.Path)
+		if route == "/login" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := requestToken(r)
+		if data.IsAPIKey(token) {
+			apiKeys.ServeHTTP(w, r)
+			return
+		}
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dbproto"`)
+			writeError(w, "Token required, see /v1/login", http.StatusUnauthorized)
+			return
+		}
+		tenantName, username, err := tokens.VerifyTenant(token)
+		var tenant *data.Server
+		if err == nil {
+			if tenant, err = server.Tenant(tenantName); errors.Is(err, data.ErrTenantNotFound) {
+				err = ErrInvalidToken
+			}
+		}
+		if err == nil {
+			var user *data.User
+			if user, err = tenant.User(username); errors.Is(err, data.ErrUserNotFound) {
+				err = ErrInvalidToken
+			} else if err == nil {
+				if tenantName != "" {
+					setCaller(r.Context(), "user:"+tenantName+"/"+user.Username)
+				} else {
+					setCaller(r.Context(), "user:"+user.Username)
+				}
+				r = r.WithContext(withTenant(context.WithValue(r.Context(), userContextKey{}, user), tenantName))
+			}
+		}
+		if errors.Is(err, ErrInvalidToken) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dbproto", error="invalid_token"`)
+			writeError(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		user := UserFromContext(r.Context())
+		checks, ok := requiredAccess(r, route)
+		if !ok {
+			writeError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if tenantName == "" && r.Header.Get(TenantHeader) != "" {
+			// The request is served by the tenant it names, whose databases the roles of the root server do not
+			// describe, so only users who may manage tenants, with the admin permission on every database, may name one
+			checks = []accessCheck{{"*", "", data.PermissionAdmin}}
+		}
+		for _, check := range checks {
+			allowed, err := tenant.Authorize(user, check.database, check.table, check.permission)
+			if err != nil {
+				writeErrorFrom(w, err, http.StatusInternalServerError)
+				return
+			}
+			if !allowed {
+				target := check.database
+				if check.table != "" {
+					target += "." + check.table
+				}
+				writeError(w, fmt.Sprintf("User %s lacks %s permission on %s", user.Username, check.permission, target), http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requiredAccess returns the permissions the request to the route, without its version prefix, needs, and false if
+// its body cannot be parsed. The databases and tables are read from the query or the body of the request, whose body
+// is left for the handler to read again. Routes not listed, as well as unknown actions of /tableAction and unknown
+// paths under /databases/, need the admin permission on every database.
+func requiredAccess(r *http.Request, route string) ([]accessCheck, bool) {
+	query := r.URL.Query()
+	switch {
+	case route == "/listDatabases", route == "/transactions", strings.HasPrefix(route, "/transactions/"):
+		// Transactions only stage actions sent to /tableAction, which are checked there
+		return nil, true
+	case route == "/createTable":
+		return []accessCheck{{query.Get("dbName"), "", data.PermissionAdmin}}, true
+	case strings.HasPrefix(route, "/databases/"):
+		// Split the escaped path like the handlers do, so both name the same table
+		return databasesAccess(r, pathSegments(routePath(r.URL.EscapedPath()))), true
+	case route == "/tableAction":
+		var payload struct {
+			Action    string `json:"action"`
+			TableName string `json:"tableName"`
+		}
+		if !peekBody(r, &payload) {
+			return nil, false
+		}
+		permission, known := tableActionPermissions[payload.Action]
+		if !known {
+			return []accessCheck{{"*", "", data.PermissionAdmin}}, true
+		}
+		return []accessCheck{{query.Get("dbName"), payload.TableName, permission}}, true
+	case route == "/joinTables":
+		var payload struct {
+			Table1    string `json:"table1"`
+			Table2    string `json:"table2"`
+			IntoTable string `json:"intoTable"`
+		}
+		if !peekBody(r, &payload) {
+			return nil, false
+		}
+		checks := []accessCheck{{query.Get("dbName"), payload.Table1, data.PermissionRead}, {query.Get("dbName"), payload.Table2, data.PermissionRead}}
+		if payload.IntoTable != "" {
+			checks = append(checks, accessCheck{query.Get("dbName"), "", data.PermissionAdmin})
+		}
+		return checks, true
+	case route == "/retention" || route == "/writeBehind" || route == "/segmentation":
+		if r.Method == "GET" {
+			return []accessCheck{{query.Get("dbName"), query.Get("tableName"), data.PermissionAdmin}}, true
+		}
+		var payload struct {
+			Database string `json:"database"`
+			Table    string `json:"table"`
+		}
+		if !peekBody(r, &payload) {
+			return nil, false
+		}
+		return []accessCheck{{payload.Database, payload.Table, data.PermissionAdmin}}, true
+	case route == "/stats" && r.Method == "GET":
+		return []accessCheck{{"*", "", data.PermissionRead}}, true
+	}
+	return []accessCheck{{"*", "", data.PermissionAdmin}}, true
+}
+
+// tableActionPermissions maps the actions of /tableAction to the permission they need on their table: the actions
+// that only read need read, and those that change records need write. Other actions need the admin permission on
+// every database.
+var tableActionPermissions = map[string]data.Permission{
+	"selectAll":   data.PermissionRead,
+	"query":       data.PermissionRead,
+	"insert":      data.PermissionWrite,
+	"update":      data.PermissionWrite,
+	"delete":      data.PermissionWrite,
+	"updateWhere": data.PermissionWrite,
+	"deleteWhere": data.PermissionWrite,
+}
+
+// tableResourceReads maps the resources under /databases/{db}/tables/{table}/ to the methods that only read them,
+// which need read on the table. The other methods of records and batch change records and need write.
+var tableResourceReads = map[string]map[string]bool{
+	"records":   {"GET": true, "HEAD": true},
+	"query":     {"POST": true},
+	"export":    {"GET": true, "HEAD": true},
+	"subscribe": {"GET": true},
+	"batch":     {},
+}
+
+// databasesAccess returns the permissions the request to the resource under /databases/ with the given path segments
+// needs. Paths and methods no handler serves need the admin permission on every database, like the routes
+// requiredAccess does not list, so a path it does not know is never let through unchecked.
+func databasesAccess(r *http.Request, parts []string) []accessCheck {
+	deny := []accessCheck{{"*", "", data.PermissionAdmin}}
+	switch {
+	case len(parts) == 1 && (r.Method == "DELETE" || r.Method == "PATCH"):
+		// Deleting and renaming databases need the admin permission on every database, like creating them
+		return deny
+	case len(parts) < 3 || parts[1] != "tables":
+		return deny
+	case len(parts) == 3 && (r.Method == "DELETE" || r.Method == "PATCH"):
+		return []accessCheck{{parts[0], "", data.PermissionAdmin}}
+	case len(parts) == 3 && (r.Method == "GET" || r.Method == "HEAD"):
+		return []accessCheck{{parts[0], parts[2], data.PermissionRead}}
+	case len(parts) == 3:
+		return deny
+	}
+	methods, known := tableResourceReads[parts[3]]
+	if !known || len(parts) > 5 || len(parts) == 5 && parts[3] != "records" {
+		return deny
+	}
+	if methods[r.Method] {
+		return []accessCheck{{parts[0], parts[2], data.PermissionRead}}
+	}
+	if parts[3] == "records" || parts[3] == "batch" {
+		return []accessCheck{{parts[0], parts[2], data.PermissionWrite}}
+	}
+	return deny
+}
+
+// peekBody decodes the JSON body of the request into v the way the handlers do, and puts the body back for the
+// handler. It reports whether the body could be decoded.
+func peekBody(r *http.Request, v interface{}) bool {
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return err == nil && json.NewDecoder(bytes.NewReader(body)).Decode(v) == nil
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+)
+
+// tableMetric is a metric reported for every table by MetricsHandler.
+type tableMetric struct {
+	name  string
+	kind  string // counter or gauge
+	help  string
+	value func(metrics data.TableMetrics) int
+}
+
+// tableMetrics are the metrics MetricsHandler reports for every table, labeled with its database and name.
+var tableMetrics = []tableMetric{
+	{"dbproto_table_inserts_total", "counter", "Records inserted.", func(m data.TableMetrics) int { return m.Metrics.InsertCount }},
+	{"dbproto_table_updates_total", "counter", "Records updated.", func(m data.TableMetrics) int { return m.Metrics.UpdateCount }},
+	{"dbproto_table_deletes_total", "counter", "Records deleted.", func(m data.TableMetrics) int { return m.Metrics.DeleteCount }},
+	{"dbproto_table_queries_total", "counter", "Queries run.", func(m data.TableMetrics) int { return m.Metrics.QueryCount }},
+	{"dbproto_table_cache_hits_total", "counter", "Lookups answered from the record cache.", func(m data.TableMetrics) int { return m.Metrics.CacheHits }},
+	{"dbproto_table_cache_misses_total", "counter", "Lookups that missed the record cache.", func(m data.TableMetrics) int { return m.Metrics.CacheMisses }},
+	{"dbproto_table_cache_evictions_total", "counter", "Records evicted from the full record cache.", func(m data.TableMetrics) int { return m.Metrics.CacheEvictions }},
+	{"dbproto_table_delayed_writes_total", "counter", "Writes delayed by the write throttle.", func(m data.TableMetrics) int { return m.Metrics.DelayedWrites }},
+	{"dbproto_table_rejected_writes_total", "counter", "Writes rejected by the write throttle.", func(m data.TableMetrics) int { return m.Metrics.RejectedWrites }},
+	{"dbproto_table_purged_records_total", "counter", "Records deleted or archived by the retention policy.", func(m data.TableMetrics) int { return m.Metrics.PurgedRecords }},
+	{"dbproto_table_records", "gauge", "Records stored in the table.", func(m data.TableMetrics) int { return m.Records }},
+	{"dbproto_table_cached_records", "gauge", "Records in the lookup cache.", func(m data.TableMetrics) int { return m.CachedRecords }},
+	{"dbproto_table_file_bytes", "gauge", "Size in bytes of the data file.", func(m data.TableMetrics) int { return int(m.FileSize) }},
+	{"dbproto_table_unflushed_writes", "gauge", "Writes applied in memory but not yet in the data file, in write-behind mode.", func(m data.TableMetrics) int { return m.Unflushed }},
+	{"dbproto_table_legacy_ciphertext_reads_total", "counter", "Reads of data encrypted in the legacy CTR format, which has no integrity check.", func(m data.TableMetrics) int { return m.LegacyReads }},
+	{"dbproto_table_segments", "gauge", "Segment files next to the data file, in segmented mode.", func(m data.TableMetrics) int { return m.Segments }},
+	{"dbproto_table_indexes", "gauge", "Indexed fields and nested paths.", func(m data.TableMetrics) int { return m.Indexes.Indexes }},
+	{"dbproto_table_index_bytes", "gauge", "Estimated memory in bytes of the indexes held in memory.", func(m data.TableMetrics) int { return int(m.Indexes.Bytes) }},
+	{"dbproto_table_spilled_indexes", "gauge", "Indexes spilled to disk by the index memory budget.", func(m data.TableMetrics) int { return m.Indexes.Spilled }},
+	{"dbproto_table_index_page_ins_total", "counter", "Spilled indexes paged back into memory.", func(m data.TableMetrics) int { return int(m.Indexes.PageIns) }},
+	{"dbproto_table_pending_writes", "gauge", "Writes waiting for the table or being written.", func(m data.TableMetrics) int { return m.Metrics.PendingWrites }},
+	{"dbproto_table_resident", "gauge", "Whether the records are in memory (1) or evicted by the cache policy (0).", func(m data.TableMetrics) int {
+		if m.Resident {
+			return 1
+		}
+		return 0
+	}},
+}
+
+// MetricsHandler serves GET /metrics, the metrics of every table and of the server in the Prometheus text exposition
+// format. The counters of a table are totals since it was opened or its metrics were reset with DELETE /stats, which
+// Prometheus reads as a counter reset; scraping never starts a new delta interval of /stats?mode=delta.
+func MetricsHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			writeError(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		tables := server.TableMetrics()
+		var out bytes.Buffer
+		for _, metric := range tableMetrics {
+			writeMetricHeader(&out, metric.name, metric.kind, metric.help)
+			for _, table := range tables {
+				fmt.Fprintf(&out, "%s{database=%s,table=%s} %d\n", metric.name, metricLabel(table.Database), metricLabel(table.Table), metric.value(table))
+			}
+		}
+		writeMetricHeader(&out, "dbproto_table_full_scans_total", "counter", "Queries that scanned every record, by filtered field.")
+		for _, table := range tables {
+			fields := make([]string, 0, len(table.Metrics.FullScans))
+			for field := range table.Metrics.FullScans {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			for _, field := range fields {
+				fmt.Fprintf(&out, "dbproto_table_full_scans_total{database=%s,table=%s,field=%s} %d\n", metricLabel(table.Database), metricLabel(table.Table), metricLabel(field), table.Metrics.FullScans[field])
+			}
+		}
+
+		records := 0
+		resident := 0
+		var indexBytes int64
+		for _, table := range tables {
+			records += table.Records
+			if table.Resident {
+				resident++
+			}
+			indexBytes += table.Indexes.Bytes
+		}
+		var memory runtime.MemStats
+		runtime.ReadMemStats(&memory)
+		for _, gauge := range []struct {
+			name  string
+			help  string
+			value uint64
+		}{
+			{"dbproto_databases", "Databases of the server.", uint64(len(server.ListDatabases()))},
+			{"dbproto_tables", "Open tables of every database.", uint64(len(tables))},
+			{"dbproto_tables_resident", "Tables whose records are in memory.", uint64(resident)},
+			{"dbproto_records", "Records of every table.", uint64(records)},
+			{"dbproto_index_bytes", "Estimated memory in bytes of the indexes held in memory by every table.", uint64(indexBytes)},
+			{"dbproto_index_memory_limit_bytes", "Estimated memory the indexes may take before they are spilled to disk, 0 for no limit.", uint64(server.IndexMemoryLimit())},
+			{"go_goroutines", "Goroutines of the process.", uint64(runtime.NumGoroutine())},
+			{"go_memstats_heap_alloc_bytes", "Bytes of allocated heap objects.", memory.HeapAlloc},
+		} {
+			writeMetricHeader(&out, gauge.name, "gauge", gauge.help)
+			fmt.Fprintf(&out, "%s %d\n", gauge.name, gauge.value)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(out.Bytes())
+	}
+}
+
+// AdminMetricsHandler serves GET /admin/metrics, the data.ServerMetrics of the server as JSON: the metrics of every
+// table added up per database and for the whole server, see Server.Metrics.
+func AdminMetricsHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeError(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(server.Metrics()); err != nil {
+			writeError(w, "Failed to serialize response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// writeMetricHeader writes the HELP and TYPE lines of a metric.
+func writeMetricHeader(out *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// metricLabel quotes a label value, escaping backslashes, double quotes and line feeds as the exposition format
+// requires.
+func metricLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
@@ -0,0 +1,251 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+	"github.com/Malpizarr/dbproto/pkg/exports"
+	"google.golang.org/protobuf/proto"
+)
+
+// Media types of the responses holding records. Clients choose one with the Accept header, see negotiateRecords.
+const (
+	mediaTypeJSON     = "application/json"
+	mediaTypeProtobuf = "application/x-protobuf"
+	mediaTypeCSV      = "text/csv"
+)
+
+// recordsMediaTypes are the media types responses holding records are written in, in order of preference when the
+// client accepts several equally.
+var recordsMediaTypes = []string{mediaTypeJSON, mediaTypeProtobuf, mediaTypeCSV}
+
+// Headers carrying the paging of query results in protobuf and CSV responses, which have no room for it.
+const (
+	NextCursorHeader = "X-Next-Cursor"
+	TotalCountHeader = "X-Total-Count"
+)
+
+// negotiateRecords returns the media type of recordsMediaTypes the Accept header of the request prefers, JSON if it
+// has none. The q parameters of the header are honored, and a media type is matched by its most specific range, so
+// "text/csv;q=0, */*" excludes CSV. It answers 406 Not Acceptable if the header accepts none of them.
+func negotiateRecords(w http.ResponseWriter, r *http.Request) (string, bool) {
+	w.Header().Add("Vary", "Accept")
+	accept := strings.Join(r.Header.Values("Accept"), ",")
+	if strings.TrimSpace(accept) == "" {
+		return mediaTypeJSON, true
+	}
+
+	best, bestQuality := "", 0.0
+	for _, mediaType := range recordsMediaTypes {
+		quality, specificity := 0.0, -1
+		for _, part := range strings.Split(accept, ",") {
+			mediaRange, params, _ := strings.Cut(part, ";")
+			rangeSpecificity := mediaRangeSpecificity(strings.ToLower(strings.TrimSpace(mediaRange)), mediaType)
+			if rangeSpecificity <= specificity {
+				continue
+			}
+			specificity, quality = rangeSpecificity, 1.0
+			for _, param := range strings.Split(params, ";") {
+				name, value, _ := strings.Cut(param, "=")
+				if strings.TrimSpace(name) == "q" {
+					if quality, _ = strconv.ParseFloat(strings.TrimSpace(value), 64); quality < 0 {
+						quality = 0
+					}
+				}
+			}
+		}
+		if quality > bestQuality {
+			best, bestQuality = mediaType, quality
+		}
+	}
+	if best == "" {
+		writeError(w, "Not acceptable, records are served as "+strings.Join(recordsMediaTypes, ", "), http.StatusNotAcceptable)
+		return "", false
+	}
+	return best, true
+}
+
+// mediaRangeSpecificity returns 2 if the media range of an Accept header is the media type, 1 if it is its type with
+// a wildcard subtype, such as text/*, 0 if it is */*, and -1 if it does not match it.
+func mediaRangeSpecificity(mediaRange, mediaType string) int {
+	switch {
+	case mediaRange == mediaType:
+		return 2
+	case mediaRange == "*/*":
+		return 0
+	case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+		return 1
+	}
+	return -1
+}
+
+// recordsResponse is a response holding records, written by writeRecords in the negotiated media type.
+type recordsResponse struct {
+	// records yields the records of the response as they are written, so they are never held in memory whole. CSV
+	// responses read it twice if it is an exports.ResettableIterator, see exports.ExportCSV.
+	records exports.RecordIterator
+	// table, if set, is the table of the records, whose primary keys key them in protobuf responses. Records without
+	// a primary key, such as joined records, are keyed by their position.
+	table *data.Table
+	// page, if set, makes JSON responses an object holding the records under "records" and the fields of page, rather
+	// than an array of records.
+	page interface{}
+}
+
+// writeRecords answers with the records in the media type: JSON, as an array of records or a page, protobuf, as the
+// dbdata.Records of the records, or CSV, with a column per field like dbproto export. Records are read from the
+// iterator, encoded and written one by one, so the response is never held in memory whole. An error before anything
+// was written, such as a limit the first records exceed, is answered like any other error, with 500 Internal Server
+// Error unless it has a status of its own; an error once the response has started aborts it, so clients never take a
+// truncated response for a complete one.
+func writeRecords(w http.ResponseWriter, mediaType string, response recordsResponse) {
+	out := &responseOutput{w: w}
+	var err error
+	switch mediaType {
+	case mediaTypeProtobuf:
+		w.Header().Set("Content-Type", mediaTypeProtobuf)
+		err = writeRecordsProtobuf(out, response)
+	case mediaTypeCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		err = exports.ExportCSV(out, response.records)
+	default:
+		w.Header().Set("Content-Type", mediaTypeJSON)
+		err = writeRecordsJSON(out, response)
+	}
+	if err == nil {
+		return
+	}
+	log.Printf("Failed to write the records of the response: %v", err)
+	if !out.started {
+		writeErrorFrom(w, err, readErrorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	panic(http.ErrAbortHandler)
+}
+
+// responseOutput is the body of a response holding records, which remembers whether anything was written to it:
+// until then, the response can still answer with an error instead.
+type responseOutput struct {
+	w       io.Writer
+	started bool
+}
+
+func (o *responseOutput) Write(p []byte) (int, error) {
+	o.started = true
+	return o.w.Write(p)
+}
+
+// writeRecordsJSON writes the records as JSON, the way encoding them in one value with json.Encoder would.
+func writeRecordsJSON(w io.Writer, response recordsResponse) error {
+	out := bufio.NewWriter(w)
+	if response.page != nil {
+		out.WriteString(`{"records":`)
+	}
+	out.WriteByte('[')
+	for i := 0; ; i++ {
+		protoRecord, err := response.records.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		record, err := data.RecordFromProto(protoRecord)
+		if err != nil {
+			return err
+		}
+		encoded, err := json.Marshal(data.EncodeBinaryFields(record))
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		if _, err := out.Write(encoded); err != nil {
+			return err
+		}
+	}
+	out.WriteByte(']')
+	if response.page != nil {
+		fields, err := json.Marshal(response.page)
+		if err != nil {
+			return err
+		}
+		if len(fields) > 2 {
+			out.WriteByte(',')
+		}
+		out.Write(fields[1:])
+	}
+	out.WriteByte('\n')
+	return out.Flush()
+}
+
+// writeRecordsProtobuf writes the records as a dbdata.Records message. Map entries of a message may be sent one by
+// one, so each record is written as a message of its own, which decoders merge into one.
+func writeRecordsProtobuf(w io.Writer, response recordsResponse) error {
+	out := bufio.NewWriter(w)
+	marshal := proto.MarshalOptions{Deterministic: true}
+	header, err := marshal.Marshal(&dbdata.Records{FormatVersion: data.RecordsFormatVersion})
+	if err != nil {
+		return err
+	}
+	out.Write(header)
+	for i := 0; ; i++ {
+		protoRecord, err := response.records.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if len(protoRecord.Checksum) > 0 {
+			// Stored records are sent without the checksum the table keeps of them
+			protoRecord = &dbdata.Record{Fields: protoRecord.Fields}
+		}
+		key := strconv.Itoa(i)
+		if response.table != nil {
+			if value, exists := protoRecord.Fields[response.table.PrimaryKey]; exists {
+				keyValue, err := data.ValueFromProto(value)
+				if err != nil {
+					return err
+				}
+				if key, err = response.table.EncodeKey(keyValue); err != nil {
+					return err
+				}
+			}
+		}
+		entry, err := marshal.Marshal(&dbdata.Records{Records: map[string]*dbdata.Record{key: protoRecord}})
+		if err != nil {
+			return err
+		}
+		if _, err := out.Write(entry); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// protoIterator converts records to protobuf records one at a time, as the streaming exports read them, for
+// responses holding records that are not stored in a table, such as joined records.
+type protoIterator struct {
+	records []data.Record
+	next    int
+}
+
+func (it *protoIterator) Next() (*dbdata.Record, error) {
+	if it.next >= len(it.records) {
+		return nil, io.EOF
+	}
+	it.next++
+	return data.RecordToProto(it.records[it.next-1])
+}
+
+func (it *protoIterator) Reset() error {
+	it.next = 0
+	return nil
+}
@@ -0,0 +1,796 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// schema is a JSON Schema object of the OpenAPI document.
+type schema map[string]interface{}
+
+// openAPIOperation is an operation of the OpenAPI document, one method of a path.
+type openAPIOperation struct {
+	Summary     string                     `json:"summary"`
+	Description string                     `json:"description,omitempty"`
+	OperationID string                     `json:"operationId"`
+	Tags        []string                   `json:"tags,omitempty"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+// openAPIParameter is a path or query parameter of an operation.
+type openAPIParameter struct {
+	Name        string `json:"name"`
+	In          string `json:"in"`
+	Description string `json:"description,omitempty"`
+	Required    bool   `json:"required"`
+	Schema      schema `json:"schema"`
+}
+
+// openAPIRequestBody is the JSON body of an operation.
+type openAPIRequestBody struct {
+	Required bool                      `json:"required"`
+	Content  map[string]openAPIContent `json:"content"`
+}
+
+// openAPIResponse is a response of an operation, for one status code.
+type openAPIResponse struct {
+	Description string                    `json:"description"`
+	Content     map[string]openAPIContent `json:"content,omitempty"`
+}
+
+// openAPIContent is the schema of a body of a media type.
+type openAPIContent struct {
+	Schema schema `json:"schema"`
+}
+
+// routeDoc documents the paths served by a route registered by RegisterRoutes or RegisterLogin, keyed by path and
+// then by lowercase method. RegisterRoutes refuses routes without one, so the document cannot miss a route.
+type routeDoc map[string]map[string]*openAPIOperation
+
+// Schema helpers, to keep routeDocs readable.
+var (
+	str     = schema{"type": "string"}
+	integer = schema{"type": "integer"}
+	boolean = schema{"type": "boolean"}
+	anyJSON = schema{}
+)
+
+func ref(name string) schema { return schema{"$ref": "#/components/schemas/" + name} }
+
+func arrayOf(items schema) schema { return schema{"type": "array", "items": items} }
+
+func mapOf(values schema) schema { return schema{"type": "object", "additionalProperties": values} }
+
+func object(properties map[string]schema, required ...string) schema {
+	s := schema{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func enum(values ...string) schema { return schema{"type": "string", "enum": values} }
+
+func jsonBody(s schema) *openAPIRequestBody {
+	return &openAPIRequestBody{Required: true, Content: map[string]openAPIContent{"application/json": {Schema: s}}}
+}
+
+func jsonResponse(description string, s schema) openAPIResponse {
+	return openAPIResponse{Description: description, Content: map[string]openAPIContent{"application/json": {Schema: s}}}
+}
+
+// negotiatedResponse documents a response holding records, which clients may also get as protobuf or CSV, see
+// negotiateRecords.
+func negotiatedResponse(description string, s schema) openAPIResponse {
+	response := jsonResponse(description+" As protobuf, a dbdata.Records message; as CSV, a column per field.", s)
+	response.Content[mediaTypeProtobuf] = openAPIContent{Schema: schema{"type": "string", "format": "binary"}}
+	response.Content[mediaTypeCSV] = openAPIContent{Schema: str}
+	return response
+}
+
+func textResponse(description string) openAPIResponse {
+	return openAPIResponse{Description: description, Content: map[string]openAPIContent{"text/plain": {Schema: str}}}
+}
+
+// errorResponse documents an error response, whose body is an ErrorResponse.
+func errorResponse(description string) openAPIResponse {
+	return jsonResponse(description, ref("Error"))
+}
+
+func emptyResponse(description string) openAPIResponse {
+	return openAPIResponse{Description: description}
+}
+
+func pathParam(name, description string) openAPIParameter {
+	return openAPIParameter{Name: name, In: "path", Description: description, Required: true, Schema: str}
+}
+
+func queryParam(name, description string, required bool, s schema) openAPIParameter {
+	return openAPIParameter{Name: name, In: "query", Description: description, Required: required, Schema: s}
+}
+
+// Parameters and responses shared by many operations.
+var (
+	dbNameParam    = queryParam("dbName", "The name of the database.", true, str)
+	dbPathParam    = pathParam("db", "The name of the database.")
+	tablePathParam = pathParam("table", "The name of the table.")
+	keyPathParam   = pathParam("key", "The primary key of the record, with slashes escaped as %2F.")
+
+	badRequest = errorResponse("The request is invalid.")
+	notFound   = errorResponse("The database, table or record does not exist.")
+	forbidden  = errorResponse("The API key or the roles of the user do not allow the request, or the table is read-only.")
+	tooMany    = errorResponse("The table has too many pending writes; retry after the Retry-After header.")
+	invalid    = errorResponse("The record breaks the validation rules of the table; the details list the violations.")
+
+	notAcceptable = errorResponse("The Accept header accepts none of application/json, application/x-protobuf and text/csv.")
+)
+
+// openAPISchemas are the components/schemas of the OpenAPI document.
+var openAPISchemas = map[string]schema{
+	"Record": {
+		"type":                 "object",
+		"description":          "A record, whose fields are free-form JSON values. Binary values are objects {\"$bytes\": base64}.",
+		"additionalProperties": true,
+	},
+	"Error": object(map[string]schema{
+		"code":    {"type": "string", "description": "Stable name of the error, such as record_not_found or validation_failed."},
+		"message": str,
+		"details": {"type": "object", "description": "What the error is about, such as the violations of validation_failed.", "additionalProperties": true},
+	}, "code", "message"),
+	"Condition": object(map[string]schema{
+		"field":    str,
+		"operator": enum("=", "!=", ">", ">=", "<", "<=", "IS NULL", "IS NOT NULL", "IS MISSING"),
+		"value":    anyJSON,
+	}, "field", "operator"),
+	"Query": object(map[string]schema{
+		"filters":    mapOf(anyJSON),
+		"conditions": arrayOf(ref("Condition")),
+		"sortBy":     str,
+		"limit":      integer,
+		"offset":     integer,
+		"cursor":     str,
+		"fields":     arrayOf(str),
+	}),
+	"QueryResult": object(map[string]schema{
+		"records":     arrayOf(ref("Record")),
+		"next_cursor": str,
+		"total":       integer,
+	}, "records", "total"),
+	"ChangeEvent": object(map[string]schema{
+		"operation":  enum("insert", "update", "delete"),
+		"key":        str,
+		"before":     ref("Record"),
+		"after":      ref("Record"),
+		"time":       {"type": "string", "format": "date-time"},
+		"request_id": str,
+	}, "operation", "key", "time"),
+	"BatchResult": object(map[string]schema{
+		"index":      integer,
+		"status":     integer,
+		"key":        str,
+		"record":     ref("Record"),
+		"code":       str,
+		"error":      str,
+		"violations": arrayOf(anyJSON),
+	}, "index", "status"),
+	"TableDescription": schema{"type": "object", "description": "The structure of a table, see dbproto describe.", "additionalProperties": true},
+	"Backup": object(map[string]schema{
+		"file":    str,
+		"name":    str,
+		"path":    str,
+		"created": {"type": "string", "format": "date-time"},
+		"size":    integer,
+		"remote":  boolean,
+	}, "file", "path", "created", "size"),
+	"Job": object(map[string]schema{
+		"id":     str,
+		"kind":   enum("backup", "restore", "export", "reindex"),
+		"status": enum("running", "succeeded", "failed"),
+		"progress": object(map[string]schema{
+			"done":  integer,
+			"total": {"type": "integer", "description": "0 until the job knows how much work it has."},
+			"unit":  enum("files", "records", "tables"),
+		}, "done", "total", "unit"),
+		"result":   {"type": "object", "description": "What the job produced once it succeeded, such as the path of the backup or export file.", "additionalProperties": true},
+		"error":    str,
+		"created":  {"type": "string", "format": "date-time"},
+		"finished": {"type": "string", "format": "date-time"},
+	}, "id", "kind", "status", "progress", "created"),
+}
+
+// routeDocs documents every route of the HTTP API, keyed by the pattern it is registered with.
+var routeDocs = map[string]routeDoc{
+	"/createDatabase": {"/createDatabase": {"post": {
+		Summary:     "Create a database",
+		OperationID: "createDatabase",
+		Tags:        []string{"databases"},
+		RequestBody: jsonBody(object(map[string]schema{"name": str}, "name")),
+		Responses:   map[string]openAPIResponse{"200": textResponse("The database was created."), "400": badRequest, "500": errorResponse("The database exists already or could not be created.")},
+	}}},
+	"/createTable": {"/createTable": {"post": {
+		Summary:     "Create a table",
+		OperationID: "createTable",
+		Tags:        []string{"tables"},
+		Parameters:  []openAPIParameter{dbNameParam},
+		RequestBody: jsonBody(object(map[string]schema{
+			"tableName":        str,
+			"primaryKey":       str,
+			"clientEncrypted":  boolean,
+			"pipeline":         arrayOf(str),
+			"autoID":           boolean,
+			"timestamps":       boolean,
+			"foreignKeys":      arrayOf(object(map[string]schema{"Field": str, "Table": str, "As": str}, "Field", "Table")),
+			"schema":           mapOf(str),
+			"keyNormalization": mapOf(anyJSON),
+			"computedFields":   arrayOf(mapOf(anyJSON)),
+			"rules":            mapOf(mapOf(anyJSON)),
+			"cacheSize":        integer,
+			"writeBehind":      object(map[string]schema{"IntervalMs": integer, "Commits": integer}),
+			"concurrency":      integer,
+			"compression":      str,
+			"segmentation":     object(map[string]schema{"MaxSegments": integer}),
+			"inMemory":         boolean,
+		}, "tableName", "primaryKey")),
+		Responses: map[string]openAPIResponse{"200": textResponse("The table was created."), "400": badRequest, "404": errorResponse("The database does not exist."), "500": errorResponse("The table could not be created.")},
+	}}},
+	"/listDatabases": {"/listDatabases": {"get": {
+		Summary:     "List the databases",
+		OperationID: "listDatabases",
+		Tags:        []string{"databases"},
+		Responses:   map[string]openAPIResponse{"200": jsonResponse("The names of the databases.", arrayOf(str))},
+	}}},
+	"/databases/": {
+		"/databases/{db}": {
+			"delete": {
+				Summary:     "Delete a database",
+				Description: "Deletes the database with its tables and files.",
+				OperationID: "deleteDatabase",
+				Tags:        []string{"databases"},
+				Parameters:  []openAPIParameter{dbPathParam},
+				Responses:   map[string]openAPIResponse{"204": emptyResponse("The database was deleted."), "400": badRequest, "404": notFound},
+			},
+			"patch": {
+				Summary:     "Rename a database",
+				OperationID: "renameDatabase",
+				Tags:        []string{"databases"},
+				Parameters:  []openAPIParameter{dbPathParam},
+				RequestBody: jsonBody(object(map[string]schema{"name": str}, "name")),
+				Responses:   map[string]openAPIResponse{"204": emptyResponse("The database was renamed."), "400": badRequest, "404": notFound, "409": errorResponse("The name is taken.")},
+			},
+		},
+		"/databases/{db}/tables/{table}": {
+			"get": {
+				Summary:     "Describe a table",
+				OperationID: "describeTable",
+				Tags:        []string{"tables"},
+				Parameters:  []openAPIParameter{dbPathParam, tablePathParam},
+				Responses:   map[string]openAPIResponse{"200": jsonResponse("The description of the table.", ref("TableDescription")), "404": errorResponse("The database or table does not exist.")},
+			},
+			"delete": {
+				Summary:     "Drop a table",
+				OperationID: "dropTable",
+				Tags:        []string{"tables"},
+				Parameters:  []openAPIParameter{dbPathParam, tablePathParam},
+				Responses:   map[string]openAPIResponse{"204": emptyResponse("The table was dropped."), "403": forbidden, "404": notFound, "409": errorResponse("A foreign key of another table references the table.")},
+			},
+			"patch": {
+				Summary:     "Rename a table",
+				OperationID: "renameTable",
+				Tags:        []string{"tables"},
+				Parameters:  []openAPIParameter{dbPathParam, tablePathParam},
+				RequestBody: jsonBody(object(map[string]schema{"name": str}, "name")),
+				Responses:   map[string]openAPIResponse{"204": emptyResponse("The table was renamed."), "400": badRequest, "403": forbidden, "404": notFound, "409": errorResponse("The name is taken, or a foreign key references the table.")},
+			},
+		},
+		"/databases/{db}/tables/{table}/records": {
+			"get": {
+				Summary:     "List records",
+				Description: "Every query parameter other than limit, offset, sortBy and cursor filters on the equality of a field, its value read as JSON when it is valid JSON.",
+				OperationID: "listRecords",
+				Tags:        []string{"records"},
+				Parameters: []openAPIParameter{dbPathParam, tablePathParam,
+					queryParam("limit", "The largest number of records to return.", false, integer),
+					queryParam("offset", "The number of records to skip.", false, integer),
+					queryParam("sortBy", "The field to sort by.", false, str),
+					queryParam("cursor", "The next_cursor of the previous page.", false, str),
+				},
+				Responses: map[string]openAPIResponse{"200": negotiatedResponse("A page of records.", ref("QueryResult")), "406": notAcceptable, "400": badRequest, "404": notFound},
+			},
+			"post": {
+				Summary:     "Insert a record",
+				OperationID: "insertRecord",
+				Tags:        []string{"records"},
+				Parameters:  []openAPIParameter{dbPathParam, tablePathParam},
+				RequestBody: jsonBody(ref("Record")),
+				Responses: map[string]openAPIResponse{"201": jsonResponse("The stored record, with its Location.", ref("Record")), "400": badRequest, "403": forbidden, "404": notFound,
+					"409": errorResponse("The key already has a record."), "422": invalid, "429": tooMany},
+			},
+		},
+		"/databases/{db}/tables/{table}/records/{key}": {
+			"get": {
+				Summary:     "Read a record",
+				OperationID: "selectRecord",
+				Tags:        []string{"records"},
+				Parameters:  []openAPIParameter{dbPathParam, tablePathParam, keyPathParam},
+				Responses:   map[string]openAPIResponse{"200": jsonResponse("The record.", ref("Record")), "404": notFound},
+			},
+			"put": {
+				Summary:     "Replace a record",
+				Description: "Replaces every field of the record but its key and creation timestamp, creating it if the key has none.",
+				OperationID: "replaceRecord",
+				Tags:        []string{"records"},
+				Parameters:  []openAPIParameter{dbPathParam, tablePathParam, keyPathParam},
+				RequestBody: jsonBody(ref("Record")),
+				Responses: map[string]openAPIResponse{"200": jsonResponse("The replaced record.", ref("Record")), "201": jsonResponse("The created record.", ref("Record")),
+					"400": badRequest, "403": forbidden, "404": notFound, "422": invalid, "429": tooMany},
+			},
+			"patch": {
+				Summary:     "Update a record",
+				Description: "Changes the fields in the body, leaving the others as they are.",
+				OperationID: "updateRecord",
+				Tags:        []string{"records"},
+				Parameters:  []openAPIParameter{dbPathParam, tablePathParam, keyPathParam},
+				RequestBody: jsonBody(ref("Record")),
+				Responses:   map[string]openAPIResponse{"200": jsonResponse("The updated record.", ref("Record")), "400": badRequest, "403": forbidden, "404": notFound, "422": invalid, "429": tooMany},
+			},
+			"delete": {
+				Summary:     "Delete a record",
+				OperationID: "deleteRecord",
+				Tags:        []string{"records"},
+				Parameters:  []openAPIParameter{dbPathParam, tablePathParam, keyPathParam},
+				Responses:   map[string]openAPIResponse{"204": emptyResponse("The record was deleted."), "403": forbidden, "404": notFound, "429": tooMany},
+			},
+		},
+		"/databases/{db}/tables/{table}/query": {"post": {
+			Summary:     "Query records",
+			Description: "Read-only API keys and the read permission may send queries.",
+			OperationID: "queryRecords",
+			Tags:        []string{"records"},
+			Parameters:  []openAPIParameter{dbPathParam, tablePathParam},
+			RequestBody: jsonBody(ref("Query")),
+			Responses:   map[string]openAPIResponse{"200": negotiatedResponse("A page of records and the number of records matching the query.", ref("QueryResult")), "406": notAcceptable, "400": badRequest, "404": notFound},
+		}},
+		"/databases/{db}/tables/{table}/batch": {"post": {
+			Summary:     "Write records in a batch",
+			Description: "Inserts, updates or deletes up to 1000 records under one lock and one write of the table file. Items fail independently.",
+			OperationID: "batchRecords",
+			Tags:        []string{"records"},
+			Parameters:  []openAPIParameter{dbPathParam, tablePathParam},
+			RequestBody: jsonBody(object(map[string]schema{
+				"operation": enum("insert", "update", "delete"),
+				"records":   arrayOf(ref("Record")),
+				"updates":   arrayOf(object(map[string]schema{"key": anyJSON, "updates": ref("Record")})),
+				"keys":      arrayOf(anyJSON),
+			}, "operation")),
+			Responses: map[string]openAPIResponse{
+				"207": jsonResponse("The outcome of every item.", object(map[string]schema{"results": arrayOf(ref("BatchResult")), "succeeded": integer, "failed": integer})),
+				"400": badRequest, "403": forbidden, "404": notFound, "413": errorResponse("The batch holds more than 1000 items."), "429": tooMany,
+			},
+		}},
+		"/databases/{db}/tables/{table}/export": {"get": {
+			Summary:     "Export a table",
+			Description: "Streams the records of the table, or those selected by a query, as a CSV, JSON or XML file download, like dbproto export, from the version of the table current when the request started. An error once the response has started aborts it.",
+			OperationID: "exportTable",
+			Tags:        []string{"records"},
+			Parameters: []openAPIParameter{dbPathParam, tablePathParam,
+				queryParam("format", "The format of the file, csv if empty.", false, enum("csv", "json", "xml")),
+				queryParam("where", "Conditions of a WHERE clause the exported records match, such as status = 'active' AND age >= 18.", false, str),
+				queryParam("fields", "Comma-separated top-level fields exported, all of them if empty.", false, str),
+				queryParam("sortBy", "The field to sort by.", false, str),
+				queryParam("limit", "The largest number of records to export.", false, integer),
+			},
+			Responses: map[string]openAPIResponse{
+				"200": {Description: "The records of the table.", Content: map[string]openAPIContent{"text/csv": {Schema: str}, mediaTypeJSON: {Schema: arrayOf(ref("Record"))}, "application/xml": {Schema: str}}},
+				"400": badRequest, "404": notFound,
+			},
+		}},
+		"/databases/{db}/tables/{table}/subscribe": {"get": {
+			Summary:     "Subscribe to changes",
+			Description: "Streams the committed changes of the table as Server-Sent Events named insert, update or delete, whose data is the change as JSON, until the client disconnects. A subscriber that falls too far behind gets an overflow event and the stream ends.",
+			OperationID: "subscribeChanges",
+			Tags:        []string{"records"},
+			Parameters:  []openAPIParameter{dbPathParam, tablePathParam},
+			Responses: map[string]openAPIResponse{
+				"200": {Description: "The stream of change events.", Content: map[string]openAPIContent{"text/event-stream": {Schema: ref("ChangeEvent")}}},
+				"404": notFound,
+			},
+		}},
+	},
+	"/tableAction": {"/tableAction": {"post": {
+		Summary:     "Run an action on a table",
+		Description: "Actions insert, update, delete, updateWhere, deleteWhere, selectAll and query. updateWhere and deleteWhere answer 400 Bad Request without filters, which would match every record. Writes naming a transaction are staged and answer 202 Accepted.",
+		OperationID: "tableAction",
+		Tags:        []string{"records"},
+		Parameters:  []openAPIParameter{dbNameParam},
+		RequestBody: jsonBody(object(map[string]schema{
+			"action":       enum("insert", "update", "delete", "updateWhere", "deleteWhere", "selectAll", "query"),
+			"tableName":    str,
+			"transaction":  str,
+			"record":       ref("Record"),
+			"key":          str,
+			"updates":      ref("Record"),
+			"filters":      mapOf(anyJSON),
+			"returnRecord": boolean,
+			"query":        object(map[string]schema{"filters": mapOf(anyJSON), "sortBy": str, "limit": integer, "offset": integer, "cursor": str}),
+		}, "action", "tableName")),
+		Responses: map[string]openAPIResponse{"200": negotiatedResponse("The result of the action, text for writes without returnRecord. The records of selectAll and query may be negotiated.", anyJSON), "202": textResponse("The write was added to the transaction."),
+			"400": badRequest, "403": forbidden, "404": errorResponse("The database, table, record or transaction does not exist."), "406": notAcceptable, "409": errorResponse("The key already has a record."), "422": invalid, "429": tooMany},
+	}}},
+	"/transactions": {"/transactions": {"post": {
+		Summary:     "Begin a transaction",
+		OperationID: "beginTransaction",
+		Tags:        []string{"transactions"},
+		RequestBody: &openAPIRequestBody{Content: map[string]openAPIContent{"application/json": {Schema: object(map[string]schema{"timeout": str})}}},
+		Responses:   map[string]openAPIResponse{"201": jsonResponse("The token of the transaction and its idle timeout.", object(map[string]schema{"id": str, "timeout": str})), "400": badRequest},
+	}}},
+	"/transactions/": {
+		"/transactions/{id}/commit": {"post": {
+			Summary:     "Commit a transaction",
+			OperationID: "commitTransaction",
+			Tags:        []string{"transactions"},
+			Parameters:  []openAPIParameter{pathParam("id", "The token of the transaction.")},
+			Responses:   map[string]openAPIResponse{"200": textResponse("The writes were applied."), "404": errorResponse("The transaction does not exist or timed out."), "409": errorResponse("The commit failed and every table is unchanged.")},
+		}},
+		"/transactions/{id}/rollback": {"post": {
+			Summary:     "Roll back a transaction",
+			OperationID: "rollbackTransaction",
+			Tags:        []string{"transactions"},
+			Parameters:  []openAPIParameter{pathParam("id", "The token of the transaction.")},
+			Responses:   map[string]openAPIResponse{"200": textResponse("The writes were discarded."), "404": errorResponse("The transaction does not exist or timed out.")},
+		}},
+	},
+	"/joinTables": {"/joinTables": {"post": {
+		Summary:     "Join two tables",
+		Description: "Returns the joined records, or materializes them into intoTable and answers 201 Created.",
+		OperationID: "joinTables",
+		Tags:        []string{"tables"},
+		Parameters:  []openAPIParameter{dbNameParam},
+		RequestBody: jsonBody(object(map[string]schema{
+			"table1": str, "table2": str, "key1": str, "key2": str,
+			"joinType":   schema{"type": "integer", "enum": []int{0, 1, 2, 3}, "description": "0 for an inner join, 1 left, 2 right, 3 full outer."},
+			"intoTable":  str,
+			"primaryKey": str,
+		}, "table1", "table2", "key1", "key2")),
+		Responses: map[string]openAPIResponse{"200": negotiatedResponse("The joined records.", arrayOf(ref("Record"))), "406": notAcceptable, "201": textResponse("The joined records were written into intoTable."), "400": badRequest, "404": errorResponse("A table does not exist.")},
+	}}},
+	"/stats": {"/stats": {
+		"get": {
+			Summary:     "Read the metrics of every table",
+			OperationID: "getStats",
+			Tags:        []string{"operations"},
+			Parameters:  []openAPIParameter{queryParam("mode", "total for the counts since the tables were opened, delta for those since the previous delta request.", false, enum("total", "delta"))},
+			Responses:   map[string]openAPIResponse{"200": jsonResponse("The metrics, index recommendations and cache states.", mapOf(anyJSON)), "400": badRequest},
+		},
+		"delete": {
+			Summary:     "Reset the metrics of every table",
+			OperationID: "resetStats",
+			Tags:        []string{"operations"},
+			Responses:   map[string]openAPIResponse{"204": emptyResponse("The metrics were reset.")},
+		},
+	}},
+	"/metrics": {"/metrics": {"get": {
+		Summary:     "Read the metrics in the Prometheus format",
+		OperationID: "getMetrics",
+		Tags:        []string{"operations"},
+		Responses:   map[string]openAPIResponse{"200": textResponse("The metrics in the Prometheus text exposition format.")},
+	}}},
+	"/admin/metrics": {"/admin/metrics": {"get": {
+		Summary:     "Read the metrics rolled up per database",
+		Description: "Returns the records, file sizes, operation counts and cache hit ratios of every table, added up per database and for the whole server.",
+		OperationID: "getAdminMetrics",
+		Tags:        []string{"operations"},
+		Responses:   map[string]openAPIResponse{"200": jsonResponse("The metrics of the server, of each database under databases and of each table under tableMetrics.", mapOf(anyJSON))},
+	}}},
+	"/backups": {"/backups": {
+		"get": {
+			Summary:     "List the backups",
+			Description: "Lists the backups of the backup directory, newest first, or their copies at the backup destination.",
+			OperationID: "listBackups",
+			Tags:        []string{"backups"},
+			Parameters:  []openAPIParameter{queryParam("remote", "true to list the copies at the backup destination.", false, boolean)},
+			Responses:   map[string]openAPIResponse{"200": jsonResponse("The backups.", arrayOf(ref("Backup")))},
+		},
+		"post": {
+			Summary:     "Create, delete, fetch or prune backups",
+			Description: "create backs up the databases now, with an optional name, and copies the backup to the backup destination; delete deletes the backup whose file name or name is backup; fetch downloads it from the backup destination; prune deletes the backups the retention, or else the retention of the server, does not keep.",
+			OperationID: "manageBackups",
+			Tags:        []string{"backups"},
+			RequestBody: jsonBody(object(map[string]schema{
+				"action":    enum("create", "delete", "fetch", "prune"),
+				"name":      str,
+				"backup":    str,
+				"retention": object(map[string]schema{"keep": integer, "keepDays": integer}),
+			}, "action")),
+			Responses: map[string]openAPIResponse{"200": jsonResponse("The deleted or fetched backup, or the pruned backups.", anyJSON), "201": jsonResponse("The result of the backup.", mapOf(anyJSON)),
+				"400": badRequest, "404": errorResponse("The backup does not exist."), "409": errorResponse("The server has no backup destination to fetch from.")},
+		},
+	}},
+	"/restore": {"/restore": {
+		"get": {
+			Summary:     "Preview a restore of a backup",
+			OperationID: "previewRestore",
+			Tags:        []string{"backups"},
+			Parameters:  []openAPIParameter{queryParam("backup", "The file name or name of the backup, the newest backup if omitted.", false, str)},
+			Responses:   map[string]openAPIResponse{"200": jsonResponse("The files the restore would write.", mapOf(anyJSON))},
+		},
+		"post": {
+			Summary:     "Restore a backup",
+			OperationID: "restore",
+			Tags:        []string{"backups"},
+			RequestBody: jsonBody(object(map[string]schema{"backup": str, "confirm": boolean, "dryRun": boolean})),
+			Responses: map[string]openAPIResponse{"200": textResponse("The backup was restored, or for a dry run, the preview of the restore as JSON."), "400": badRequest,
+				"409": errorResponse("The restore would overwrite live data and was not confirmed; the details are the preview of the restore."),
+				"422": errorResponse("The backup is corrupt: a file is damaged, missing or does not match its manifest.")},
+		},
+	}},
+	"/jobs": {"/jobs": {
+		"get": {
+			Summary:     "List the jobs",
+			Description: "Lists the running jobs and those that finished within the last hour, newest first.",
+			OperationID: "listJobs",
+			Tags:        []string{"jobs"},
+			Responses:   map[string]openAPIResponse{"200": jsonResponse("The jobs.", arrayOf(ref("Job")))},
+		},
+		"post": {
+			Summary:     "Start a job",
+			Description: "Starts a backup, a restore of a backup, an export of a table to a file next to the backups, or a rebuild of the indexes of a table or of every table of a database, and answers before it finishes.",
+			OperationID: "startJob",
+			Tags:        []string{"jobs"},
+			RequestBody: jsonBody(object(map[string]schema{
+				"kind":     enum("backup", "restore", "export", "reindex"),
+				"name":     str,
+				"backup":   str,
+				"database": str,
+				"table":    str,
+				"format":   enum("csv", "json", "xml", "parquet"),
+				"confirm":  boolean,
+			}, "kind")),
+			Responses: map[string]openAPIResponse{"202": jsonResponse("The job, whose status is at its Location.", ref("Job")), "400": badRequest, "404": errorResponse("The database or table does not exist."),
+				"409": errorResponse("The restore would overwrite live data and was not confirmed; the details are the preview of the restore.")},
+		},
+	}},
+	"/jobs/": {"/jobs/{id}": {"get": {
+		Summary:     "Read a job",
+		Description: "Reports the status and progress of a job, and its result once it succeeded.",
+		OperationID: "getJob",
+		Tags:        []string{"jobs"},
+		Parameters:  []openAPIParameter{pathParam("id", "The ID of the job.")},
+		Responses:   map[string]openAPIResponse{"200": jsonResponse("The job.", ref("Job")), "404": errorResponse("The job does not exist or finished more than an hour ago.")},
+	}}},
+	"/verifyBackup": {"/verifyBackup": {
+		"get": {
+			Summary:     "Read the last backup verification",
+			OperationID: "getBackupVerification",
+			Tags:        []string{"backups"},
+			Responses:   map[string]openAPIResponse{"200": jsonResponse("The last verification.", mapOf(anyJSON)), "404": errorResponse("No backup has been verified yet.")},
+		},
+		"post": {
+			Summary:     "Verify the newest backup",
+			OperationID: "verifyBackup",
+			Tags:        []string{"backups"},
+			Responses:   map[string]openAPIResponse{"200": jsonResponse("The verification.", mapOf(anyJSON))},
+		},
+	}},
+	"/recovery": {"/recovery": {
+		"get": {
+			Summary:     "List the quarantined tables",
+			OperationID: "getRecovery",
+			Tags:        []string{"backups"},
+			Responses:   map[string]openAPIResponse{"200": jsonResponse("The recovery report.", mapOf(anyJSON))},
+		},
+		"post": {
+			Summary:     "Recover a quarantined table",
+			OperationID: "recoverTable",
+			Tags:        []string{"backups"},
+			RequestBody: jsonBody(object(map[string]schema{"database": str, "table": str, "action": enum("retry", "restore", "discard")}, "database", "table", "action")),
+			Responses:   map[string]openAPIResponse{"200": textResponse("The table was recovered."), "400": badRequest, "404": errorResponse("The table is not quarantined."), "409": errorResponse("The table failed to load again.")},
+		},
+	}},
+	"/retention": {"/retention": {
+		"get": {
+			Summary:     "Preview the retention policy of a table",
+			OperationID: "previewRetention",
+			Tags:        []string{"tables"},
+			Parameters:  []openAPIParameter{dbNameParam, queryParam("tableName", "The name of the table.", true, str)},
+			Responses:   map[string]openAPIResponse{"200": jsonResponse("A dry run of the policy.", mapOf(anyJSON)), "404": errorResponse("The database or table does not exist."), "409": errorResponse("The table has no retention policy.")},
+		},
+		"post": {
+			Summary:     "Manage the retention policy of a table",
+			OperationID: "manageRetention",
+			Tags:        []string{"tables"},
+			RequestBody: jsonBody(object(map[string]schema{"database": str, "table": str, "action": enum("set", "enable", "disable", "preview", "apply"), "policy": mapOf(anyJSON)}, "database", "table", "action")),
+			Responses: map[string]openAPIResponse{"200": jsonResponse("The retention report of preview and apply, text otherwise.", mapOf(anyJSON)), "400": badRequest,
+				"404": errorResponse("The database or table does not exist."), "409": errorResponse("The table has no retention policy.")},
+		},
+	}},
+	"/writeBehind": {"/writeBehind": {"post": {
+		Summary:     "Manage the write-behind mode of a table",
+		Description: "Switches the table to write-behind mode with the given policy, or back to writing its file on every write without one, or flushes its pending writes to the file.",
+		OperationID: "manageWriteBehind",
+		Tags:        []string{"tables"},
+		RequestBody: jsonBody(object(map[string]schema{"database": str, "table": str, "action": enum("set", "flush"), "policy": object(map[string]schema{"IntervalMs": integer, "Commits": integer})}, "database", "table", "action")),
+		Responses:   map[string]openAPIResponse{"200": textResponse("The action was performed."), "400": badRequest, "404": errorResponse("The database or table does not exist."), "500": errorResponse("The pending writes could not be flushed.")},
+	}}},
+	"/segmentation": {"/segmentation": {"post": {
+		Summary:     "Manage the segmented mode of a table",
+		Description: "Switches the table to segmented mode with the given policy, or back to rewriting its file on every write without one, or folds its segments into its file.",
+		OperationID: "manageSegmentation",
+		Tags:        []string{"tables"},
+		RequestBody: jsonBody(object(map[string]schema{"database": str, "table": str, "action": enum("set", "compact"), "policy": object(map[string]schema{"MaxSegments": integer})}, "database", "table", "action")),
+		Responses:   map[string]openAPIResponse{"200": textResponse("The action was performed."), "400": badRequest, "404": errorResponse("The database or table does not exist."), "500": errorResponse("The segments could not be compacted.")},
+	}}},
+	"/apiKeys": {"/apiKeys": {
+		"get": {
+			Summary:     "List the API keys",
+			OperationID: "listAPIKeys",
+			Tags:        []string{"access"},
+			Responses:   map[string]openAPIResponse{"200": jsonResponse("The API keys, without their secrets.", arrayOf(mapOf(anyJSON)))},
+		},
+		"post": {
+			Summary:     "Create or revoke an API key",
+			OperationID: "manageAPIKeys",
+			Tags:        []string{"access"},
+			RequestBody: jsonBody(object(map[string]schema{"action": enum("create", "revoke"), "name": str, "scope": enum("read", "read-write"), "id": str}, "action")),
+			Responses:   map[string]openAPIResponse{"200": textResponse("The key was revoked."), "201": jsonResponse("The created key, shown only once.", mapOf(anyJSON)), "400": badRequest, "404": errorResponse("The key does not exist.")},
+		},
+	}},
+	"/tenants": {"/tenants": {
+		"get": {
+			Summary:     "List the tenants",
+			OperationID: "listTenants",
+			Tags:        []string{"tenants"},
+			Responses:   map[string]openAPIResponse{"200": jsonResponse("The names of the tenants.", arrayOf(str)), "403": errorResponse("The request is made to a tenant.")},
+		},
+		"post": {
+			Summary:     "Create a tenant",
+			Description: "Creates a tenant, whose databases are reached by requests naming it in the X-Dbproto-Tenant header or made with credentials bound to it.",
+			OperationID: "createTenant",
+			Tags:        []string{"tenants"},
+			RequestBody: jsonBody(object(map[string]schema{"name": str}, "name")),
+			Responses: map[string]openAPIResponse{"201": textResponse("The tenant was created."), "400": badRequest, "403": errorResponse("The request is made to a tenant."),
+				"409": errorResponse("The tenant exists.")},
+		},
+	}},
+	"/login": {"/login": {"post": {
+		Summary:     "Get a token",
+		Description: "Served when the server has a token secret, see dbproto serve --jwt-secret-file. Users of a tenant name it in tenant, or in the X-Dbproto-Tenant header, and get a token bound to it.",
+		OperationID: "login",
+		Tags:        []string{"access"},
+		RequestBody: jsonBody(object(map[string]schema{"username": str, "password": str, "tenant": str}, "username", "password")),
+		Responses:   map[string]openAPIResponse{"200": jsonResponse("The token.", object(map[string]schema{"token": str, "tokenType": str, "expiresAt": str})), "401": errorResponse("The user or the tenant is unknown or the password is wrong.")},
+	}}},
+}
+
+// handleDocumented registers the handler on the mux, and panics if routeDocs does not document the pattern, so the
+// OpenAPI document keeps up with the routes.
+func handleDocumented(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	if _, ok := routeDocs[pattern]; !ok {
+		panic(fmt.Sprintf("route %s is not documented in routeDocs", pattern))
+	}
+	mux.HandleFunc(pattern, handler)
+}
+
+var (
+	openAPIOnce     sync.Once
+	openAPIDocument []byte
+)
+
+// OpenAPIDocument returns the OpenAPI 3 document of the HTTP API as JSON, with a server for every version in
+// APIVersions. Clients in other languages can be generated from it.
+func OpenAPIDocument() []byte {
+	openAPIOnce.Do(func() {
+		paths := make(map[string]map[string]*openAPIOperation)
+		for _, doc := range routeDocs {
+			for path, item := range doc {
+				paths[path] = item
+			}
+		}
+		var servers []map[string]string
+		for i := len(APIVersions) - 1; i >= 0; i-- {
+			version := APIVersions[i]
+			description := "Version " + version.Name
+			if version.Deprecated {
+				description += ", deprecated"
+			}
+			servers = append(servers, map[string]string{"url": "/v" + version.Name, "description": description})
+		}
+		document := map[string]interface{}{
+			"openapi": "3.0.3",
+			"info": map[string]string{
+				"title":       "dbproto",
+				"description": "The HTTP API of a dbproto server. Requests authenticate with a token from /login or an API key when the server requires one. Requests are made to the tenant their credentials are bound to, or else to the tenant named in the X-Dbproto-Tenant header, or else to the root server.",
+				"version":     CurrentAPIVersion,
+			},
+			"servers": servers,
+			"tags":    openAPITags(),
+			"paths":   paths,
+			"components": map[string]interface{}{
+				"schemas": openAPISchemas,
+				"securitySchemes": map[string]interface{}{
+					"bearer": map[string]string{"type": "http", "scheme": "bearer", "description": "A token from /login, or an API key."},
+					"apiKey": map[string]string{"type": "apiKey", "in": "header", "name": APIKeyHeader},
+				},
+			},
+			"security": []map[string][]string{{}, {"bearer": {}}, {"apiKey": {}}},
+		}
+		var err error
+		if openAPIDocument, err = json.MarshalIndent(document, "", "  "); err != nil {
+			panic(fmt.Sprintf("failed to encode the OpenAPI document: %v", err))
+		}
+	})
+	return openAPIDocument
+}
+
+// openAPITags returns the tags of the operations, sorted.
+func openAPITags() []map[string]string {
+	seen := make(map[string]bool)
+	for _, doc := range routeDocs {
+		for _, item := range doc {
+			for _, operation := range item {
+				for _, tag := range operation.Tags {
+					seen[tag] = true
+				}
+			}
+		}
+	}
+	tags := make([]map[string]string, 0, len(seen))
+	for tag := range seen {
+		tags = append(tags, map[string]string{"name": tag})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i]["name"] < tags[j]["name"] })
+	return tags
+}
+
+// OpenAPIHandler serves GET /openapi.json, the OpenAPI document of the HTTP API.
+func OpenAPIHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			writeError(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(OpenAPIDocument())
+	}
+}
+
+// docsPage is the Swagger UI page of /docs. Swagger UI is loaded from a CDN, so the server bundles no assets.
+const docsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>dbproto API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>SwaggerUIBundle({url: "{{SPEC}}", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+// DocsHandler serves GET /docs, a Swagger UI page browsing the OpenAPI document served at specPath.
+func DocsHandler(specPath string) http.HandlerFunc {
+	page := strings.Replace(docsPage, "{{SPEC}}", specPath, 1)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			writeError(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(page))
+	}
+}
+
+// RegisterDocs registers /openapi.json and the /docs page browsing it on the mux. They describe the API without
+// exposing any data, so servers usually register them outside the authentication middleware, like /healthz.
+func RegisterDocs(mux *http.ServeMux) {
+	mux.HandleFunc("/openapi.json", OpenAPIHandler())
+	mux.HandleFunc("/docs", DocsHandler("/openapi.json"))
+}
@@ -0,0 +1,400 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+)
+
+// recordsQueryParams are the query parameters of GET .../records that are not filters.
+var recordsQueryParams = map[string]bool{"limit": true, "offset": true, "sortBy": true, "cursor": true}
+
+// DatabasesHandler serves the resources under /databases/: the deletion and renaming of a database at /databases/{db},
+// see DatabaseHandler, the description of a table at /databases/{db}/tables/{table}, see DescribeTableHandler, which
+// is dropped and renamed there too, see TableHandler, its records at
+// /databases/{db}/tables/{table}/records and /databases/{db}/tables/{table}/records/{key}, see RecordsHandler, its
+// queries at /databases/{db}/tables/{table}/query, see QueryHandler, its batch writes at
+// /databases/{db}/tables/{table}/batch, see BatchHandler, and its changes at /databases/{db}/tables/{table}/subscribe,
+// see SubscribeHandler.
+func DatabasesHandler(server *data.Server) http.HandlerFunc {
+	describe := DescribeTableHandler(server)
+	records := RecordsHandler(server)
+	query := QueryHandler(server)
+	batch := BatchHandler(server)
+	subscribe := SubscribeHandler(server)
+	export := ExportHandler(server)
+	database := DatabaseHandler(server)
+	table := TableHandler(server)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isQueryRoute(r.URL.EscapedPath()) {
+			query(w, r)
+			return
+		}
+		parts := pathSegments(r.URL.EscapedPath())
+		if len(parts) == 4 && parts[1] == "tables" && parts[3] == "batch" {
+			batch(w, r)
+			return
+		}
+		if len(parts) == 4 && parts[1] == "tables" && parts[3] == "subscribe" {
+			subscribe(w, r)
+			return
+		}
+		if len(parts) == 4 && parts[1] == "tables" && parts[3] == "export" {
+			export(w, r)
+			return
+		}
+		if len(parts) == 1 {
+			database(w, r)
+			return
+		}
+		if len(parts) == 3 && r.Method != "GET" {
+			table(w, r)
+			return
+		}
+		if len(strings.Split(strings.TrimPrefix(r.URL.Path, "/databases/"), "/")) > 3 {
+			records(w, r)
+			return
+		}
+		describe(w, r)
+	}
+}
+
+// isQueryRoute reports whether the escaped route, without its version prefix, is the query route of a table, whose
+// POST requests only read data.
+func isQueryRoute(route string) bool {
+	parts := pathSegments(route)
+	return strings.HasPrefix(route, "/databases/") && len(parts) == 4 && parts[1] == "tables" && parts[3] == "query"
+}
+
+// tableFromPath returns the table named by the database and table segments of the path, answering 404 Not Found if
+// either does not exist.
+func tableFromPath(server *data.Server, w http.ResponseWriter, dbName, tableName string) (*data.Table, bool) {
+	db, err := server.Database(dbName)
+	if errors.Is(err, data.ErrDatabaseNotFound) {
+		writeErrorFrom(w, data.ErrDatabaseNotFound, http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		writeErrorFrom(w, err, http.StatusInternalServerError)
+		return nil, false
+	}
+	db.RLock()
+	table, exists := db.Tables[tableName]
+	db.RUnlock()
+	if !exists {
+		writeErrorFrom(w, data.ErrTableNotFound, http.StatusNotFound)
+		return nil, false
+	}
+	return table, true
+}
+
+// pathSegments returns the segments of the escaped path after /databases/, each unescaped, so names and keys may hold
+// slashes. It returns nil if a segment is empty or badly escaped.
+func pathSegments(escapedPath string) []string {
+	parts := strings.Split(strings.TrimPrefix(escapedPath, "/databases/"), "/")
+	for i, part := range parts {
+		unescaped, err := url.PathUnescape(part)
+		if err != nil || unescaped == "" {
+			return nil
+		}
+		parts[i] = unescaped
+	}
+	return parts
+}
+
+// recordsPath returns the database, the table and the key, if any, of a path to the records of a table. It reports
+// false if the path is not one.
+func recordsPath(r *http.Request) (dbName, tableName, key string, hasKey, ok bool) {
+	parts := pathSegments(r.URL.EscapedPath())
+	if len(parts) < 4 || len(parts) > 5 || parts[1] != "tables" || parts[3] != "records" {
+		return "", "", "", false, false
+	}
+	if len(parts) == 5 {
+		return parts[0], parts[2], parts[4], true, true
+	}
+	return parts[0], parts[2], "", false, true
+}
+
+// RecordsHandler serves the records of a table as REST resources:
+//   - GET /databases/{db}/tables/{table}/records lists the records as a data.QueryResult, {"records": [...],
+//     "next_cursor": ..., "total": ...}. The
+//     limit, offset, sortBy and cursor query parameters page through them like the query action of
+//     TableActionHandler, and every other parameter filters on the equality of a field, its value read as JSON if it
+//     is valid JSON, such as ?age=30 or ?active=true, and as a string otherwise.
+//   - POST /databases/{db}/tables/{table}/records inserts the record in the body and answers 201 Created with the
+//     stored record and its Location, or 409 Conflict if its key already has a record.
+//   - GET /databases/{db}/tables/{table}/records/{key} returns the record of the key, or 404 Not Found with the code
+//     record_not_found if it has none.
+//   - PUT replaces the record of the key with the one in the body, creating it with 201 Created if the key has none.
+//   - PATCH changes the fields in the body, leaving the others as they are.
+//   - DELETE deletes the record of the key and answers 204 No Content.
+//
+// Unknown databases, tables and keys answer 404 Not Found.
+func RecordsHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dbName, tableName, key, hasKey, ok := recordsPath(r)
+		if !ok {
+			writeError(w, "Expected /databases/{db}/tables/{table}/records or /databases/{db}/tables/{table}/records/{key}", http.StatusNotFound)
+			return
+		}
+		allowed := []string{"GET", "POST"}
+		if hasKey {
+			allowed = []string{"GET", "PUT", "PATCH", "DELETE"}
+		}
+		if !slices.Contains(allowed, r.Method) {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeError(w, fmt.Sprintf("Only %s methods are allowed", strings.Join(allowed, ", ")), http.StatusMethodNotAllowed)
+			return
+		}
+
+		table, ok := tableFromPath(server, w, dbName, tableName)
+		if !ok {
+			return
+		}
+		if r.Method != "GET" {
+			if dbName == data.CatalogDatabase {
+				writeErrorFrom(w, data.ErrCatalogReadOnly, http.StatusForbidden)
+				return
+			}
+			if !writeAllowed(w, r) {
+				return
+			}
+		}
+
+		switch {
+		case !hasKey && r.Method == "GET":
+			listRecords(server, table, w, r)
+		case !hasKey:
+			record, ok := readRecordBody(w, r)
+			if !ok {
+				return
+			}
+			stored, err := table.InsertReturningCtx(r.Context(), record)
+			if err != nil {
+				writeWriteError(w, err, http.StatusInternalServerError)
+				return
+			}
+			storedKey, err := table.EncodeKey(stored[table.PrimaryKey])
+			if err != nil {
+				writeErrorFrom(w, err, http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Location", strings.TrimSuffix(requestPath(r), "/")+"/"+url.PathEscape(storedKey))
+			writeRecord(w, http.StatusCreated, stored)
+		case r.Method == "GET":
+			record, err := table.SelectCtx(r.Context(), key)
+			if errors.Is(err, data.ErrRecordNotFound) {
+				writeErrorFrom(w, err, http.StatusNotFound)
+				return
+			} else if err != nil {
+				writeErrorFrom(w, err, writeErrorStatus(w, err, http.StatusInternalServerError))
+				return
+			}
+			writeRecord(w, http.StatusOK, record)
+		case r.Method == "PUT", r.Method == "PATCH":
+			record, ok := readRecordBody(w, r)
+			if !ok {
+				return
+			}
+			if value, exists := record[table.PrimaryKey]; exists {
+				if encoded, err := table.EncodeKey(value); err != nil || encoded != key {
+					writeError(w, fmt.Sprintf("Primary key field %s does not match the key %s of the path", table.PrimaryKey, key), http.StatusBadRequest)
+					return
+				}
+			}
+			var stored data.Record
+			var err error
+			created := false
+			if r.Method == "PUT" {
+				stored, created, err = table.ReplaceCtx(r.Context(), key, record)
+			} else {
+				stored, err = table.UpdateReturningCtx(r.Context(), key, record)
+			}
+			if err != nil {
+				writeWriteError(w, err, http.StatusInternalServerError)
+				return
+			}
+			if created {
+				w.Header().Set("Location", requestPath(r))
+				writeRecord(w, http.StatusCreated, stored)
+				return
+			}
+			writeRecord(w, http.StatusOK, stored)
+		case r.Method == "DELETE":
+			if err := table.DeleteCtx(r.Context(), key); err != nil {
+				writeWriteError(w, err, http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// requestPath returns the path the client requested, with the version prefix the routes do not see.
+func requestPath(r *http.Request) string {
+	path, _, _ := strings.Cut(r.RequestURI, "?")
+	return path
+}
+
+// listRecords answers GET .../records with the records of the table matching the query parameters.
+func listRecords(server *data.Server, table *data.Table, w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query := data.Query{SortBy: params.Get("sortBy"), Cursor: params.Get("cursor")}
+	for name, target := range map[string]*int{"limit": &query.Limit, "offset": &query.Offset} {
+		if value := params.Get(name); value != "" {
+			number, err := strconv.Atoi(value)
+			if err != nil || number < 0 {
+				writeError(w, fmt.Sprintf("Invalid %s %q", name, value), http.StatusBadRequest)
+				return
+			}
+			*target = number
+		}
+	}
+	for field, values := range params {
+		if recordsQueryParams[field] {
+			continue
+		}
+		if query.Filters == nil {
+			query.Filters = make(map[string]interface{})
+		}
+		var value interface{}
+		if err := json.Unmarshal([]byte(values[0]), &value); err != nil {
+			value = values[0]
+		}
+		query.Filters[field] = value
+	}
+	if err := data.DecodeBinaryFields(query.Filters); err != nil {
+		writeErrorFrom(w, err, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := limitedContext(server, r)
+	defer cancel()
+	writeQueryResult(ctx, w, r, table, query)
+}
+
+// QueryHandler serves POST /databases/{db}/tables/{table}/query, which runs the query in the body and answers with a
+// data.QueryResult, {"records": [...], "next_cursor": ..., "total": ...}. The body takes:
+//   - filters: fields the records must equal, such as {"status": "paid"};
+//   - conditions: comparisons, such as [{"field": "total", "operator": ">=", "value": 100}];
+//   - sortBy, limit, offset and cursor, paging like the query action of TableActionHandler;
+//   - fields: the fields kept in the returned records, every field if empty.
+//
+// Unknown databases and tables answer 404 Not Found, and invalid queries 400 Bad Request.
+func QueryHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		parts := pathSegments(r.URL.EscapedPath())
+		table, ok := tableFromPath(server, w, parts[0], parts[2])
+		if !ok {
+			return
+		}
+
+		var payload struct {
+			Filters    map[string]interface{} `json:"filters,omitempty"`
+			Conditions []struct {
+				Field    string      `json:"field"`
+				Operator string      `json:"operator"`
+				Value    interface{} `json:"value"`
+			} `json:"conditions,omitempty"`
+			SortBy string   `json:"sortBy,omitempty"`
+			Limit  int      `json:"limit,omitempty"`
+			Offset int      `json:"offset,omitempty"`
+			Cursor string   `json:"cursor,omitempty"`
+			Fields []string `json:"fields,omitempty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if payload.Limit < 0 || payload.Offset < 0 {
+			writeError(w, "limit and offset must not be negative", http.StatusBadRequest)
+			return
+		}
+		query := data.Query{
+			Filters: payload.Filters,
+			SortBy:  payload.SortBy,
+			Limit:   payload.Limit,
+			Offset:  payload.Offset,
+			Cursor:  payload.Cursor,
+			Fields:  payload.Fields,
+		}
+		if err := data.DecodeBinaryFields(query.Filters); err != nil {
+			writeErrorFrom(w, err, http.StatusBadRequest)
+			return
+		}
+		for _, condition := range payload.Conditions {
+			value := map[string]interface{}{"value": condition.Value}
+			if err := data.DecodeBinaryFields(value); err != nil {
+				writeErrorFrom(w, err, http.StatusBadRequest)
+				return
+			}
+			query.Conditions = append(query.Conditions, data.Condition{Field: condition.Field, Operator: condition.Operator, Value: value["value"]})
+		}
+
+		ctx, cancel := limitedContext(server, r)
+		defer cancel()
+		writeQueryResult(ctx, w, r, table, query)
+	}
+}
+
+// writeQueryResult answers with the page of the query as a data.QueryResult, or in the media type the client accepts,
+// see negotiateRecords, with the cursor of the next page and the number of matching records in NextCursorHeader and
+// TotalCountHeader. The records of the page are read from an iterator as they are written.
+func writeQueryResult(ctx context.Context, w http.ResponseWriter, r *http.Request, table *data.Table, query data.Query) {
+	mediaType, ok := negotiateRecords(w, r)
+	if !ok {
+		return
+	}
+	records, err := table.IterateQuery(ctx, query)
+	if err == nil {
+		err = records.CheckLimits()
+	}
+	if err != nil {
+		writeErrorFrom(w, err, readErrorStatus(err, http.StatusBadRequest))
+		return
+	}
+	if records.NextCursor() != "" {
+		w.Header().Set(NextCursorHeader, records.NextCursor())
+	}
+	w.Header().Set(TotalCountHeader, strconv.Itoa(records.Total()))
+	writeRecords(w, mediaType, recordsResponse{
+		records: records,
+		table:   table,
+		page: struct {
+			NextCursor string `json:"next_cursor,omitempty"`
+			Total      int    `json:"total"`
+		}{records.NextCursor(), records.Total()},
+	})
+}
+
+// readRecordBody decodes the record in the body of the request, answering 400 Bad Request if it cannot.
+func readRecordBody(w http.ResponseWriter, r *http.Request) (data.Record, bool) {
+	var record data.Record
+	if err := json.NewDecoder(r.Body).Decode(&record); err != nil || record == nil {
+		writeError(w, "Invalid request body, expected a JSON object", http.StatusBadRequest)
+		return nil, false
+	}
+	if err := data.DecodeBinaryFields(record); err != nil {
+		writeErrorFrom(w, err, http.StatusBadRequest)
+		return nil, false
+	}
+	return record, true
+}
+
+// writeRecord answers with the record as JSON and the status.
+func writeRecord(w http.ResponseWriter, status int, record data.Record) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data.EncodeBinaryFields(record))
+}
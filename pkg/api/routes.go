@@ -7,9 +7,59 @@ import (
 )
 
 func SetupRoutes(server *data.Server) {
-	http.HandleFunc("/createDatabase", CreateDatabaseHandler(server))
-	http.HandleFunc("/createTable", CreateTableHandler(server))
-	http.HandleFunc("/listDatabases", ListDatabasesHandler(server))
-	http.HandleFunc("/tableAction", TableActionHandler(server))
-	http.HandleFunc("/joinTables", JoinTablesHandler(server))
+	RegisterRoutes(http.DefaultServeMux, server)
+}
+
+// RegisterRoutes registers the HTTP API of the server on the given mux. Every route is served under the prefix of
+// each version in APIVersions, such as /v1/createTable, and without a prefix for clients written before versions
+// existed, see unversioned. Every route must be documented in routeDocs, which OpenAPIDocument is built from.
+// Requests are served by the routes of the tenant they are made to, see TenantServer, and their reads observe the
+// writes their ConsistencyHeader chooses.
+func RegisterRoutes(mux *http.ServeMux, server *data.Server) {
+	routes := consistent(&tenantRoutes{server: server, routes: make(map[*data.Server]http.Handler)})
+	for _, version := range APIVersions {
+		mux.Handle("/v"+version.Name+"/", versioned(version, routes))
+	}
+	mux.Handle("/", unversioned(routes))
+}
+
+// newRoutes returns the routes of the HTTP API on the databases of the server, without version prefix.
+func newRoutes(server *data.Server) *http.ServeMux {
+	routes := http.NewServeMux()
+	handleDocumented(routes, "/createDatabase", CreateDatabaseHandler(server))
+	handleDocumented(routes, "/createTable", CreateTableHandler(server))
+	handleDocumented(routes, "/listDatabases", ListDatabasesHandler(server))
+	handleDocumented(routes, "/databases/", DatabasesHandler(server))
+	transactions := NewTransactions(server)
+	handleDocumented(routes, "/tableAction", TableActionHandler(server, transactions))
+	handleDocumented(routes, "/transactions", BeginTransactionHandler(transactions))
+	handleDocumented(routes, "/transactions/", EndTransactionHandler(transactions))
+	handleDocumented(routes, "/joinTables", JoinTablesHandler(server))
+	handleDocumented(routes, "/stats", StatsHandler(server))
+	handleDocumented(routes, "/metrics", MetricsHandler(server))
+	handleDocumented(routes, "/admin/metrics", AdminMetricsHandler(server))
+	handleDocumented(routes, "/backups", BackupsHandler(server))
+	handleDocumented(routes, "/restore", RestoreHandler(server))
+	handleDocumented(routes, "/jobs", JobsHandler(server))
+	handleDocumented(routes, "/jobs/", JobHandler(server))
+	handleDocumented(routes, "/verifyBackup", VerifyBackupHandler(server))
+	handleDocumented(routes, "/recovery", RecoveryHandler(server))
+	handleDocumented(routes, "/retention", RetentionHandler(server))
+	handleDocumented(routes, "/writeBehind", WriteBehindHandler(server))
+	handleDocumented(routes, "/segmentation", SegmentationHandler(server))
+	handleDocumented(routes, "/apiKeys", APIKeysHandler(server))
+	handleDocumented(routes, "/tenants", TenantsHandler(server))
+	routes.HandleFunc("/", notFoundHandler)
+	return routes
+}
+
+// RegisterLogin registers the /login route issuing the tokens RequireJWT checks, under the prefix of each version in
+// APIVersions and without a prefix, like RegisterRoutes.
+func RegisterLogin(mux *http.ServeMux, server *data.Server, tokens *Tokens) {
+	login := http.NewServeMux()
+	handleDocumented(login, "/login", LoginHandler(server, tokens))
+	for _, version := range APIVersions {
+		mux.Handle("/v"+version.Name+"/login", versioned(version, login))
+	}
+	mux.Handle("/login", unversioned(login))
 }
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+)
+
+// subscribeHeartbeat is how often SubscribeHandler sends a comment to idle subscribers, so proxies do not close the
+// connection and clients notice when it is gone.
+const subscribeHeartbeat = 15 * time.Second
+
+// shutdownKey is the context key of the channel closed when the server shuts down, see WithShutdown.
+type shutdownKey struct{}
+
+// WithShutdown returns a copy of ctx carrying a channel closed when the server shuts down, which ends the streams of
+// SubscribeHandler. http.Server.Shutdown does not cancel the requests in flight, so servers serving subscriptions
+// should set it in the BaseContext of their http.Server and close the channel with RegisterOnShutdown, or Shutdown
+// waits for the subscribers to leave.
+func WithShutdown(ctx context.Context, shutdown <-chan struct{}) context.Context {
+	return context.WithValue(ctx, shutdownKey{}, shutdown)
+}
+
+// subscriptionEvent is a change event as sent to subscribers, with byte values encoded like in the other responses.
+type subscriptionEvent struct {
+	Operation string      `json:"operation"`
+	Key       string      `json:"key"`
+	Before    data.Record `json:"before,omitempty"`
+	After     data.Record `json:"after,omitempty"`
+	Time      time.Time   `json:"time"`
+	RequestID string      `json:"request_id,omitempty"`
+}
+
+// SubscribeHandler serves GET /databases/{db}/tables/{table}/subscribe, which streams the committed changes of the table
+// as Server-Sent Events until the client disconnects. Each event is named after its operation, insert, update or
+// delete, and its data is the change as JSON, with the record before and after it. A subscriber that falls too far
+// behind gets an overflow event and the stream ends, after which it should read the table again and subscribe anew,
+// see Table.Watch.
+//
+// Unknown databases and tables answer 404 Not Found.
+func SubscribeHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writeError(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		parts := pathSegments(r.URL.EscapedPath())
+		table, ok := tableFromPath(server, w, parts[0], parts[2])
+		if !ok {
+			return
+		}
+		stream := http.NewResponseController(w)
+		// Subscriptions last longer than any write timeout of the server
+		if err := stream.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		events := table.Watch(ctx)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, ": subscribed\n\n")
+		if err := stream.Flush(); err != nil {
+			return
+		}
+
+		shutdown, _ := r.Context().Value(shutdownKey{}).(<-chan struct{})
+		heartbeat := time.NewTicker(subscribeHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case event, open := <-events:
+				if !open {
+					if ctx.Err() == nil {
+						writeServerSentEvent(w, "overflow", ErrorResponse{Code: "subscriber_overflow", Message: "subscriber fell too far behind and missed changes, read the table and subscribe again"})
+						stream.Flush()
+					}
+					return
+				}
+				writeServerSentEvent(w, event.Operation, subscriptionEvent{
+					Operation: event.Operation,
+					Key:       event.Key,
+					Before:    data.EncodeBinaryFields(event.Before),
+					After:     data.EncodeBinaryFields(event.After),
+					Time:      event.Time,
+					RequestID: event.RequestID,
+				})
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+			case <-shutdown:
+				return
+			case <-ctx.Done():
+				return
+			}
+			if err := stream.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeServerSentEvent writes an event with the name and the value as JSON data. JSON holds no line breaks, so the
+// data fits on one data line.
+func writeServerSentEvent(w http.ResponseWriter, name string, value interface{}) {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		payload, _ = json.Marshal(ErrorResponse{Code: "internal", Message: err.Error()})
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", strings.TrimSpace(name), payload)
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+)
+
+// TenantHeader is the request header naming the tenant a request is made to, for callers whose credentials are not
+// bound to a tenant, such as the API keys of the root server. Requests without it are made to the root server.
+const TenantHeader = "X-Dbproto-Tenant"
+
+// ErrTenantMismatch is returned by TenantServer for a request naming another tenant than the one its credentials are
+// bound to.
+var ErrTenantMismatch = errors.New("the credentials are bound to another tenant")
+
+// tenantContextKey is the context key of the tenant the credentials of a request are bound to.
+type tenantContextKey struct{}
+
+// TenantFromContext returns the tenant the credentials of the request of the context are bound to, or an empty
+// string if they are bound to none or the request went through no authentication middleware.
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantContextKey{}).(string)
+	return tenant
+}
+
+// withTenant returns a copy of ctx carrying the tenant the credentials of its request are bound to.
+func withTenant(ctx context.Context, tenant string) context.Context {
+	if tenant == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// TenantServer returns the server of the tenant a request is made to: the tenant its credentials are bound to, or
+// else the tenant it names, or else the root server.
+//
+// Parameters:
+// - server: The root server.
+// - bound: The tenant the credentials of the request are bound to, empty for none.
+// - named: The tenant the request names, such as in TenantHeader, empty for none.
+//
+// Returns:
+// - A pointer to the Server of the tenant.
+// - ErrTenantMismatch if the request names another tenant than the one of its credentials, or an error wrapping
+// data.ErrTenantNotFound if the tenant does not exist.
+func TenantServer(server *data.Server, bound, named string) (*data.Server, error) {
+	if bound != "" && named != "" && named != bound {
+		return nil, fmt.Errorf("%w: %s cannot access tenant %s", ErrTenantMismatch, bound, named)
+	}
+	if bound != "" {
+		named = bound
+	}
+	return server.Tenant(named)
+}
+
+// tenantRoutes serves every request with the routes of the server of the tenant it is made to, see TenantServer,
+// answering 403 Forbidden for requests naming another tenant than the one of their credentials and 404 Not Found
+// for unknown tenants. The routes of a tenant are built on its first request and kept, with its transactions.
+type tenantRoutes struct {
+	server *data.Server
+	lock   sync.Mutex
+	routes map[*data.Server]http.Handler
+}
+
+func (t *tenantRoutes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server, err := TenantServer(t.server, TenantFromContext(r.Context()), r.Header.Get(TenantHeader))
+	if errors.Is(err, ErrTenantMismatch) {
+		writeErrorFrom(w, err, http.StatusForbidden)
+		return
+	} else if err != nil {
+		writeErrorFrom(w, err, http.StatusNotFound)
+		return
+	}
+
+	t.lock.Lock()
+	routes, exists := t.routes[server]
+	if !exists {
+		routes = newRoutes(server)
+		t.routes[server] = routes
+	}
+	t.lock.Unlock()
+	routes.ServeHTTP(w, r)
+}
+
+// TenantsHandler manages the tenants of the root server. GET lists their names. POST takes {"name": ...} and answers
+// 201 Created, 409 Conflict for a tenant that exists or 400 Bad Request for an invalid name. Requests made to a tenant
+// answer 403 Forbidden.
+func TenantsHandler(server *data.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if server.TenantName() != "" {
+			writeError(w, "Tenants are managed on the root server", http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(server.ListTenants())
+			return
+		case "POST":
+		default:
+			writeError(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var payload struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		err := server.CreateTenant(payload.Name)
+		if errors.Is(err, data.ErrNameTaken) {
+			writeErrorFrom(w, err, http.StatusConflict)
+			return
+		} else if errors.Is(err, data.ErrInvalidName) {
+			writeErrorFrom(w, err, http.StatusBadRequest)
+			return
+		} else if err != nil {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "Tenant '%s' created.", payload.Name)
+	}
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+)
+
+// routeParameters name the path segments following the segments of the routes that take a parameter, see traceRoute.
+var routeParameters = map[string]string{
+	"databases":    "{db}",
+	"tables":       "{table}",
+	"records":      "{key}",
+	"transactions": "{id}",
+}
+
+// Trace traces the requests the tracer samples, in a server span named after the method and route of the request
+// that the operations of pkg/data it runs, such as reading table files and planning queries, are traced as part of.
+// Requests carrying a W3C traceparent header continue the trace of their caller. Spans hold the route with its
+// parameters left out, such as /v1/databases/{db}/tables/{table}/records/{key}, so no keys are exported. Responses
+// with a 5xx status mark the span as failed. A nil tracer traces nothing.
+func Trace(tracer *data.Tracer, next http.Handler) http.Handler {
+	if tracer == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := traceRoute(r.URL.Path)
+		ctx, span := tracer.StartTrace(r.Context(), r.Method+" "+route, r.Header.Get("traceparent"))
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer span.End()
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("http.route", route)
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		span.SetAttribute("http.response.status_code", strconv.Itoa(recorder.status))
+		if recorder.status >= 500 {
+			span.SetError(fmt.Errorf("answered %d %s", recorder.status, http.StatusText(recorder.status)))
+		}
+	})
+}
+
+// traceRoute returns the path with the parameters of the route left out, such as /databases/{db}/tables/{table} for
+// /databases/shop/tables/users.
+func traceRoute(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 1; i < len(segments); i++ {
+		if parameter, ok := routeParameters[segments[i-1]]; ok && segments[i] != "" {
+			segments[i] = parameter
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+)
+
+const (
+	DefaultTransactionTimeout = time.Minute      // DefaultTransactionTimeout is how long a transaction may stay idle unless its client asks otherwise.
+	MaxTransactionTimeout     = 10 * time.Minute // MaxTransactionTimeout is the longest idle timeout a client may ask for.
+)
+
+// ErrTransactionNotFound is answered to requests naming a transaction that does not exist, has ended, or was
+// rolled back after it stayed idle for too long.
+var ErrTransactionNotFound = errors.New("transaction not found or timed out")
+
+// Transactions holds the transactions opened over the HTTP API, each identified by a random token.
+// A transaction that stays idle for longer than its timeout is abandoned: it is rolled back and its token forgotten.
+type Transactions struct {
+	sync.Mutex
+	server *data.Server
+	open   map[string]*txSession
+}
+
+// txSession is a transaction opened over the HTTP API.
+type txSession struct {
+	tx      *data.MultiTx // Transaction spanning the tables of the server
+	timeout time.Duration // Idle time after which the transaction is rolled back
+	timer   *time.Timer   // Timer rolling the transaction back once it fires
+}
+
+// NewTransactions creates an empty set of HTTP transactions on the server.
+func NewTransactions(server *data.Server) *Transactions {
+	return &Transactions{server: server, open: make(map[string]*txSession)}
+}
+
+// Begin starts a transaction spanning the tables of the server and returns its token. The transaction is rolled
+// back if no request uses it for the given timeout.
+func (t *Transactions) Begin(timeout time.Duration) (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", fmt.Errorf("failed to generate transaction token: %v", err)
+	}
+	id := hex.EncodeToString(token)
+
+	t.Lock()
+	defer t.Unlock()
+	session := &txSession{tx: t.server.BeginTx(), timeout: timeout}
+	session.timer = time.AfterFunc(timeout, func() {
+		t.Lock()
+		if t.open[id] != session {
+			t.Unlock()
+			return
+		}
+		delete(t.open, id)
+		t.Unlock()
+		session.tx.Rollback()
+		log.Printf("Rolled back transaction %s after %v without activity", id, timeout)
+	})
+	t.open[id] = session
+	return id, nil
+}
+
+// Get returns the open transaction with the given token and restarts its idle timeout.
+// It returns false if there is no such transaction or it has timed out.
+func (t *Transactions) Get(id string) (*data.MultiTx, bool) {
+	t.Lock()
+	defer t.Unlock()
+	session, exists := t.open[id]
+	if !exists || !session.timer.Stop() {
+		return nil, false // A timer that already fired is rolling the transaction back
+	}
+	session.timer.Reset(session.timeout)
+	return session.tx, true
+}
+
+// End forgets the open transaction with the given token and returns it, so that it can be committed or rolled
+// back. It returns false if there is no such transaction or it has timed out.
+func (t *Transactions) End(id string) (*data.MultiTx, bool) {
+	t.Lock()
+	defer t.Unlock()
+	session, exists := t.open[id]
+	if !exists || !session.timer.Stop() {
+		return nil, false
+	}
+	delete(t.open, id)
+	return session.tx, true
+}
+
+// BeginTransactionHandler starts a transaction. The optional body {"timeout": "30s"} sets how long the
+// transaction may stay idle before it is rolled back, up to MaxTransactionTimeout. The response holds the
+// token that tableAction requests pass as "transaction" and that names the transaction in
+// /transactions/{id}/commit and /transactions/{id}/rollback.
+func BeginTransactionHandler(transactions *Transactions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var payload struct {
+			Timeout string `json:"timeout,omitempty"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		timeout := DefaultTransactionTimeout
+		if payload.Timeout != "" {
+			var err error
+			if timeout, err = time.ParseDuration(payload.Timeout); err != nil || timeout <= 0 || timeout > MaxTransactionTimeout {
+				writeError(w, fmt.Sprintf("Invalid timeout, expected a duration of at most %v", MaxTransactionTimeout), http.StatusBadRequest)
+				return
+			}
+		}
+
+		id, err := transactions.Begin(timeout)
+		if err != nil {
+			writeErrorFrom(w, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(map[string]string{"id": id, "timeout": timeout.String()}); err != nil {
+			writeError(w, "Failed to serialize response", http.StatusInternalServerError)
+		}
+	}
+}
+
+// EndTransactionHandler serves POST /transactions/{id}/commit, which applies the writes of the transaction
+// atomically, and POST /transactions/{id}/rollback, which discards them. Either way the transaction ends.
+// A commit that fails leaves every table unchanged and answers 409 Conflict.
+func EndTransactionHandler(transactions *Transactions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeError(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		id, action, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/transactions/"), "/")
+		if !ok || (action != "commit" && action != "rollback") {
+			writeError(w, "Expected /transactions/{id}/commit or /transactions/{id}/rollback", http.StatusNotFound)
+			return
+		}
+		tx, exists := transactions.End(id)
+		if !exists {
+			writeErrorFrom(w, ErrTransactionNotFound, http.StatusNotFound)
+			return
+		}
+
+		if action == "rollback" {
+			if err := tx.Rollback(); err != nil {
+				writeErrorFrom(w, err, http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, "Transaction '%s' rolled back.", id)
+			return
+		}
+		if err := tx.CommitCtx(r.Context()); err != nil {
+			writeWriteError(w, err, http.StatusConflict)
+			return
+		}
+		fmt.Fprintf(w, "Transaction '%s' committed.", id)
+	}
+}
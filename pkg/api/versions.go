@@ -0,0 +1,103 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// APIVersionHeader is the header clients send to choose the version of the API they expect and the server answers
+// with the version that served the request.
+const APIVersionHeader = "X-Dbproto-Api-Version"
+
+// CurrentAPIVersion is the latest version of the HTTP API.
+const CurrentAPIVersion = "1"
+
+// APIVersion describes a version of the HTTP API.
+type APIVersion struct {
+	Name       string // Name is the version, served under the /v{Name} prefix, e.g. "1".
+	Deprecated bool   // Deprecated marks versions that still work but will be removed; their responses carry a Deprecation header.
+	Sunset     string // Sunset is the HTTP date after which a deprecated version may be removed, empty if none is planned.
+}
+
+// APIVersions lists the versions of the HTTP API the server serves, oldest first.
+var APIVersions = []APIVersion{
+	{Name: "1"},
+}
+
+// apiVersion returns the version with the given name.
+func apiVersion(name string) (APIVersion, bool) {
+	for _, version := range APIVersions {
+		if version.Name == name {
+			return version, true
+		}
+	}
+	return APIVersion{}, false
+}
+
+// supportedVersions returns the names of the served versions, comma separated.
+func supportedVersions() string {
+	names := make([]string, 0, len(APIVersions))
+	for _, version := range APIVersions {
+		names = append(names, version.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// versioned serves the routes of a version under its /v{version} prefix. The prefix is stripped before the request
+// reaches next. A request whose APIVersionHeader names another version is rejected with 400 Bad Request.
+func versioned(version APIVersion, next http.Handler) http.Handler {
+	prefix := "/v" + version.Name
+	stripped := http.StripPrefix(prefix, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requested := r.Header.Get(APIVersionHeader); requested != "" && requested != version.Name {
+			writeError(w, fmt.Sprintf("%s %s does not match the version %s of the path", APIVersionHeader, requested, version.Name), http.StatusBadRequest)
+			return
+		}
+		writeVersionHeaders(w, version, r.URL.Path)
+		stripped.ServeHTTP(w, r)
+	})
+}
+
+// unversioned serves the routes without a version prefix. Requests naming a version in APIVersionHeader are served
+// by that version. Requests without the header are served by version 1, which the unprefixed routes have always
+// been, with Deprecation and Link headers pointing clients to the prefixed route.
+func unversioned(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.Header.Get(APIVersionHeader)
+		if name == "" {
+			version, _ := apiVersion("1")
+			writeVersionHeaders(w, version, "/v1"+r.URL.Path)
+			if !version.Deprecated {
+				w.Header().Set("Deprecation", "true")
+				w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, "/v1"+r.URL.Path))
+				w.Header().Add("Warning", fmt.Sprintf(`299 - "Unversioned routes are deprecated, use /v1%s or send %s"`, r.URL.Path, APIVersionHeader))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		version, ok := apiVersion(name)
+		if !ok {
+			writeError(w, fmt.Sprintf("Unsupported API version %s, supported versions are %s", name, supportedVersions()), http.StatusBadRequest)
+			return
+		}
+		writeVersionHeaders(w, version, "/v"+version.Name+r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeVersionHeaders reports the version serving a request at path and, if it is deprecated, when it goes away and
+// where its successor is.
+func writeVersionHeaders(w http.ResponseWriter, version APIVersion, path string) {
+	w.Header().Set(APIVersionHeader, version.Name)
+	if !version.Deprecated {
+		return
+	}
+	w.Header().Set("Deprecation", "true")
+	if version.Sunset != "" {
+		w.Header().Set("Sunset", version.Sunset)
+	}
+	successor := "/v" + CurrentAPIVersion + strings.TrimPrefix(path, "/v"+version.Name)
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, successor))
+	w.Header().Add("Warning", fmt.Sprintf(`299 - "API version %s is deprecated, use version %s"`, version.Name, CurrentAPIVersion))
+}
@@ -0,0 +1,331 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+	"github.com/Malpizarr/dbproto/pkg/utils"
+)
+
+// apiVersion is the version of the HTTP API the client speaks.
+const apiVersion = "1"
+
+// Client is a Go client for the dbproto HTTP API.
+// In encrypted mode it encrypts field values with its own key before they are sent, and decrypts them
+// when records are read back, so the server only ever stores opaque ciphertext.
+type Client struct {
+	BaseURL    string       // BaseURL is the address of the server, e.g. http://localhost:8080.
+	HTTPClient *http.Client // HTTPClient is the client used for requests.
+	APIKey     string       // APIKey, or a token issued by /v1/login, is sent as a bearer token for servers that require one; empty sends none.
+
+	crypter   *utils.Utils    // crypter encrypts field values in encrypted mode.
+	plaintext map[string]bool // plaintext holds the fields sent unencrypted, such as primary keys.
+}
+
+// New creates a client that sends records as they are.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// NewEncrypted creates a client that encrypts every field value with the given 32 byte key,
+// except for the plaintext fields, which must include the primary keys of the tables used.
+// The key never leaves the client.
+func NewEncrypted(baseURL string, key []byte, plaintextFields ...string) (*Client, error) {
+	crypter, err := utils.NewUtilsWithKey(key)
+	if err != nil {
+		return nil, err
+	}
+	c := New(baseURL)
+	c.crypter = crypter
+	c.plaintext = make(map[string]bool, len(plaintextFields))
+	for _, field := range plaintextFields {
+		c.plaintext[field] = true
+	}
+	return c, nil
+}
+
+// CreateDatabase creates a database on the server.
+func (c *Client) CreateDatabase(name string) error {
+	return c.post("/createDatabase", nil, map[string]string{"name": name}, nil)
+}
+
+// CreateTable creates a table on the server. In encrypted mode the table is created as client encrypted,
+// so the server rejects any plaintext value outside the primary key.
+func (c *Client) CreateTable(dbName, tableName, primaryKey string) error {
+	payload := map[string]interface{}{
+		"tableName":       tableName,
+		"primaryKey":      primaryKey,
+		"clientEncrypted": c.crypter != nil,
+	}
+	return c.post("/createTable", url.Values{"dbName": {dbName}}, payload, nil)
+}
+
+// Insert inserts a record into a table.
+func (c *Client) Insert(dbName, tableName string, record data.Record) error {
+	encrypted, err := c.encrypt(record)
+	if err != nil {
+		return err
+	}
+	return c.tableAction(dbName, map[string]interface{}{"action": "insert", "tableName": tableName, "record": encrypted}, nil)
+}
+
+// Update updates the fields of the record with the given key.
+func (c *Client) Update(dbName, tableName, key string, updates data.Record) error {
+	encrypted, err := c.encrypt(updates)
+	if err != nil {
+		return err
+	}
+	return c.tableAction(dbName, map[string]interface{}{"action": "update", "tableName": tableName, "key": key, "updates": encrypted}, nil)
+}
+
+// InsertReturning inserts a record and returns it as stored by the server, decrypted in encrypted mode.
+func (c *Client) InsertReturning(dbName, tableName string, record data.Record) (data.Record, error) {
+	encrypted, err := c.encrypt(record)
+	if err != nil {
+		return nil, err
+	}
+	return c.returningAction(dbName, map[string]interface{}{"action": "insert", "tableName": tableName, "record": encrypted, "returnRecord": true})
+}
+
+// UpdateReturning updates the record with the given key and returns it as stored by the server, decrypted in encrypted mode.
+func (c *Client) UpdateReturning(dbName, tableName, key string, updates data.Record) (data.Record, error) {
+	encrypted, err := c.encrypt(updates)
+	if err != nil {
+		return nil, err
+	}
+	return c.returningAction(dbName, map[string]interface{}{"action": "update", "tableName": tableName, "key": key, "updates": encrypted, "returnRecord": true})
+}
+
+// returningAction performs an insert or update that asks the server for the stored record.
+func (c *Client) returningAction(dbName string, payload map[string]interface{}) (data.Record, error) {
+	var response struct {
+		Record data.Record `json:"record"`
+	}
+	if err := c.tableAction(dbName, payload, &response); err != nil {
+		return nil, err
+	}
+	return c.decrypt(response.Record)
+}
+
+// Delete deletes the record with the given key.
+func (c *Client) Delete(dbName, tableName, key string) error {
+	return c.tableAction(dbName, map[string]interface{}{"action": "delete", "tableName": tableName, "key": key}, nil)
+}
+
+// SelectAll returns every record of a table, decrypted in encrypted mode.
+func (c *Client) SelectAll(dbName, tableName string) ([]data.Record, error) {
+	var records []data.Record
+	if err := c.tableAction(dbName, map[string]interface{}{"action": "selectAll", "tableName": tableName}, &records); err != nil {
+		return nil, err
+	}
+	for i, record := range records {
+		decrypted, err := c.decrypt(record)
+		if err != nil {
+			return nil, err
+		}
+		records[i] = decrypted
+	}
+	return records, nil
+}
+
+// Select returns the record with the given key, decrypted in encrypted mode. It fails with a 404 Not Found error if
+// the key has no record.
+func (c *Client) Select(dbName, tableName, key string) (data.Record, error) {
+	var record data.Record
+	path := "/databases/" + url.PathEscape(dbName) + "/tables/" + url.PathEscape(tableName) + "/records/" + url.PathEscape(key)
+	if err := c.do("GET", path, nil, nil, &record); err != nil {
+		return nil, err
+	}
+	return c.decrypt(record)
+}
+
+// Query returns the page of the records of a table matching the query, with its records decrypted in encrypted mode.
+// Filter values are sent as they are, so in encrypted mode only plaintext fields can be filtered and sorted on.
+func (c *Client) Query(dbName, tableName string, query data.Query) (data.QueryResult, error) {
+	conditions := make([]map[string]interface{}, len(query.Conditions))
+	for i, condition := range query.Conditions {
+		conditions[i] = map[string]interface{}{"field": condition.Field, "operator": condition.Operator, "value": condition.Value}
+	}
+	payload := map[string]interface{}{
+		"filters":    data.EncodeBinaryFields(query.Filters),
+		"conditions": conditions,
+		"sortBy":     query.SortBy,
+		"limit":      query.Limit,
+		"offset":     query.Offset,
+		"cursor":     query.Cursor,
+		"fields":     query.Fields,
+	}
+	var result data.QueryResult
+	path := "/databases/" + url.PathEscape(dbName) + "/tables/" + url.PathEscape(tableName) + "/query"
+	if err := c.do("POST", path, nil, payload, &result); err != nil {
+		return data.QueryResult{}, err
+	}
+	for i, record := range result.Records {
+		decrypted, err := c.decrypt(record)
+		if err != nil {
+			return data.QueryResult{}, err
+		}
+		result.Records[i] = decrypted
+	}
+	return result, nil
+}
+
+// encrypt returns the record with its byte slices in their JSON representation, see data.EncodeBinaryFields, and in
+// encrypted mode with every non-plaintext value encrypted.
+func (c *Client) encrypt(record data.Record) (data.Record, error) {
+	record = data.EncodeBinaryFields(record)
+	if c.crypter == nil {
+		return record, nil
+	}
+	encrypted := make(data.Record, len(record))
+	for field, value := range record {
+		if c.plaintext[field] {
+			encrypted[field] = value
+			continue
+		}
+		cipherText, err := c.crypter.EncryptValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt field '%s': %v", field, err)
+		}
+		encrypted[field] = cipherText
+	}
+	return encrypted, nil
+}
+
+// decrypt reverses encrypt: it returns a copy of the record with every encrypted value decrypted and its byte slices
+// decoded.
+func (c *Client) decrypt(record data.Record) (data.Record, error) {
+	if c.crypter == nil {
+		if err := data.DecodeBinaryFields(record); err != nil {
+			return nil, err
+		}
+		return record, nil
+	}
+	decrypted := make(data.Record, len(record))
+	for field, value := range record {
+		plainValue, err := c.crypter.DecryptValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt field '%s': %v", field, err)
+		}
+		decrypted[field] = plainValue
+	}
+	if err := data.DecodeBinaryFields(decrypted); err != nil {
+		return nil, err
+	}
+	return decrypted, nil
+}
+
+func (c *Client) tableAction(dbName string, payload interface{}, out interface{}) error {
+	return c.post("/tableAction", url.Values{"dbName": {dbName}}, payload, out)
+}
+
+// post sends payload as JSON and decodes the JSON response into out, if out is not nil.
+func (c *Client) post(path string, query url.Values, payload interface{}, out interface{}) error {
+	return c.do("POST", path, query, payload, out)
+}
+
+// do sends a request with the method, and payload as JSON unless it is nil, and decodes the JSON response into out,
+// if out is not nil.
+func (c *Client) do(method, path string, query url.Values, payload interface{}, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		content, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to serialize request: %v", err)
+		}
+		body = bytes.NewReader(content)
+	}
+	target := c.BaseURL + "/v" + apiVersion + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return responseError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
+
+// Error is an error answered by the server. Code is the stable name of the error, such as "record_not_found", and
+// Details what it is about, as the JSON of the details of the error body. Errors with the code of an error of
+// pkg/data unwrap to it, so errors.Is(err, data.ErrRecordNotFound) works on the errors of the client as on those
+// of the server.
+type Error struct {
+	StatusCode int             // StatusCode is the HTTP status of the response.
+	Status     string          // Status is the HTTP status line of the response, such as "404 Not Found".
+	Code       string          // Code is the code of the error body, empty if the response had none.
+	Message    string          // Message is the message of the error body, or the body if it was not JSON.
+	Details    json.RawMessage // Details holds the details of the error body, nil if it had none.
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Status, e.Message)
+}
+
+// Unwrap returns the error of pkg/data with the code of e, or nil.
+func (e *Error) Unwrap() error {
+	return dataErrors[e.Code]
+}
+
+// dataErrors are the errors of pkg/data by the code the server answers them with.
+var dataErrors = map[string]error{
+	"database_not_found": data.ErrDatabaseNotFound,
+	"table_not_found":    data.ErrTableNotFound,
+	"record_not_found":   data.ErrRecordNotFound,
+	"duplicate_key":      data.ErrDuplicateKey,
+	"invalid_key":        data.ErrInvalidKey,
+	"schema_violation":   data.ErrSchemaViolation,
+	"validation_failed":  data.ErrValidationFailed,
+	"read_only":          data.ErrCatalogReadOnly,
+	"server_read_only":   data.ErrReadOnly,
+	"name_taken":         data.ErrNameTaken,
+	"invalid_name":       data.ErrInvalidName,
+	"table_referenced":   data.ErrTableReferenced,
+}
+
+// responseError returns the Error of a response with an error status, read from its JSON error body.
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(resp.Body)
+	apiErr := &Error{StatusCode: resp.StatusCode, Status: resp.Status}
+	var envelope struct {
+		Code    string          `json:"code"`
+		Message string          `json:"message"`
+		Details json.RawMessage `json:"details"`
+	}
+	if err := json.Unmarshal(body, &envelope); err == nil && envelope.Code != "" {
+		apiErr.Code, apiErr.Message, apiErr.Details = envelope.Code, envelope.Message, envelope.Details
+	} else {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+	return apiErr
+}
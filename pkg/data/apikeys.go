@@ -0,0 +1,324 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SystemDatabase is the name of the database holding the tables the server keeps about itself, such as the API keys.
+// It is stored, backed up and encrypted like any database, but is reserved: it cannot be created, listed or opened
+// by name, so the HTTP API cannot read or change it.
+const SystemDatabase = "_system"
+
+// apiKeysTable is the table of SystemDatabase holding the API keys, keyed by their ID.
+const apiKeysTable = "api_keys"
+
+// apiKeyPrefix starts every API key, followed by its ID and its secret separated by underscores.
+const apiKeyPrefix = "dbp_"
+
+// ErrInvalidAPIKey is returned by AuthenticateAPIKey for a key that is malformed, unknown or revoked.
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// ErrAPIKeyNotFound is returned for an API key ID that does not exist.
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// APIKeyScope is what the requests authenticated with an API key may do.
+type APIKeyScope string
+
+const (
+	ScopeRead      APIKeyScope = "read"       // ScopeRead allows requests that only read data.
+	ScopeReadWrite APIKeyScope = "read-write" // ScopeReadWrite allows every request, including managing API keys.
+)
+
+// APIKey describes an API key. The key itself is only returned by CreateAPIKey; the server stores its SHA-256.
+type APIKey struct {
+	ID        string      `json:"id"`                  // ID identifies the key, and is part of it.
+	Name      string      `json:"name"`                // Name describes who or what uses the key.
+	Tenant    string      `json:"tenant,omitempty"`    // Tenant is the tenant the key is bound to, empty for keys of the root server.
+	Scope     APIKeyScope `json:"scope"`               // Scope is what the requests authenticated with the key may do.
+	CreatedAt time.Time   `json:"createdAt"`           // CreatedAt is when the key was created.
+	RevokedAt *time.Time  `json:"revokedAt,omitempty"` // RevokedAt is when the key was revoked, nil while it is valid.
+}
+
+// CanWrite reports whether the key allows requests that change data.
+func (k *APIKey) CanWrite() bool {
+	return k.Scope == ScopeReadWrite
+}
+
+// systemTable returns the table of SystemDatabase with the given name, creating the database and the table, with the
+// given primary key, if create is set. It returns nil if they do not exist and create is not set.
+func (s *Server) systemTable(name, primaryKey string, create bool) (*Table, error) {
+	s.RLock()
+	db, exists := s.Databases[SystemDatabase]
+	s.RUnlock()
+	if exists {
+		if table, err := db.lookupTable(name); err == nil {
+			return table, nil
+		}
+	}
+	if !create {
+		return nil, nil
+	}
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	db, exists = s.Databases[SystemDatabase]
+	if !exists {
+		db = s.newDatabase(SystemDatabase)
+		s.Databases[SystemDatabase] = db
+	}
+	if table, err := db.lookupTable(name); err == nil {
+		return table, nil
+	}
+	if err := db.CreateTable(name, primaryKey); err != nil {
+		return nil, fmt.Errorf("failed to create the system table %s: %v", name, err)
+	}
+	return db.lookupTable(name)
+}
+
+// apiKeys returns the table of the API keys, see systemTable.
+func (s *Server) apiKeys(create bool) (*Table, error) {
+	return s.systemTable(apiKeysTable, "id", create)
+}
+
+// hashAPIKeySecret returns the hex encoded SHA-256 of the secret of an API key. The secrets are random, so a plain
+// hash is enough to keep a stolen table from revealing them.
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeyFromRecord returns the API key of a record of the API key table.
+func apiKeyFromRecord(record Record) *APIKey {
+	key := &APIKey{}
+	key.ID, _ = record["id"].(string)
+	key.Name, _ = record["name"].(string)
+	key.Tenant, _ = record["tenant"].(string)
+	scope, _ := record["scope"].(string)
+	key.Scope = APIKeyScope(scope)
+	key.CreatedAt, _ = record["createdAt"].(time.Time)
+	if revokedAt, ok := record["revokedAt"].(time.Time); ok {
+		key.RevokedAt = &revokedAt
+	}
+	return key
+}
+
+// CreateAPIKey is a method of the Server struct that creates an API key for the HTTP API. Only the SHA-256 of its
+// secret is stored, in the api_keys table of SystemDatabase, so the key cannot be shown again. The keys created on the
+// server of a tenant are bound to the tenant, and stored by the root server, which finds the tenant of a key from it.
+//
+// Parameters:
+// - name: A description of who or what uses the key.
+// - scope: What the requests authenticated with the key may do, ScopeRead or ScopeReadWrite.
+//
+// Returns:
+// - A pointer to the APIKey describing the key.
+// - The key, to be sent by clients in the Authorization header as "Bearer <key>".
+// - An error, if the scope is unknown or the key cannot be stored. If the operation is successful, the error is nil.
+func (s *Server) CreateAPIKey(name string, scope APIKeyScope) (*APIKey, string, error) {
+	if scope != ScopeRead && scope != ScopeReadWrite {
+		return nil, "", fmt.Errorf("unknown API key scope %q, expected %s or %s", scope, ScopeRead, ScopeReadWrite)
+	}
+	table, err := s.credentialServer().apiKeys(true)
+	if err != nil {
+		return nil, "", err
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, "", fmt.Errorf("failed to generate the API key: %v", err)
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", fmt.Errorf("failed to generate the API key: %v", err)
+	}
+	key := &APIKey{
+		ID:        hex.EncodeToString(id),
+		Name:      name,
+		Tenant:    s.tenant,
+		Scope:     scope,
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+	}
+	encodedSecret := base64.RawURLEncoding.EncodeToString(secret)
+	record := Record{
+		"id":        key.ID,
+		"name":      key.Name,
+		"scope":     string(key.Scope),
+		"hash":      hashAPIKeySecret(encodedSecret),
+		"createdAt": key.CreatedAt,
+	}
+	if key.Tenant != "" {
+		record["tenant"] = key.Tenant
+	}
+	if err := table.Insert(record); err != nil {
+		return nil, "", fmt.Errorf("failed to store the API key: %v", err)
+	}
+	return key, apiKeyPrefix + key.ID + "_" + encodedSecret, nil
+}
+
+// RevokeAPIKey is a method of the Server struct that revokes an API key, which is rejected from then on. The key
+// stays listed by ListAPIKeys with the time it was revoked.
+//
+// Parameters:
+// - id: The ID of the key.
+//
+// Returns:
+// - ErrAPIKeyNotFound if there is no key with the ID, or the server is the server of a tenant the key is not bound
+// to, or an error if it cannot be revoked. If the operation is successful, or the key was already revoked, the error
+// is nil.
+func (s *Server) RevokeAPIKey(id string) error {
+	table, err := s.credentialServer().apiKeys(false)
+	if err != nil {
+		return err
+	}
+	if table == nil {
+		return fmt.Errorf("%w: %s", ErrAPIKeyNotFound, id)
+	}
+	record, err := apiKeyRecord(table, id)
+	if err != nil {
+		return err
+	}
+	key := apiKeyFromRecord(record)
+	if s.root != nil && key.Tenant != s.tenant {
+		return fmt.Errorf("%w: %s", ErrAPIKeyNotFound, id)
+	}
+	if key.RevokedAt != nil {
+		return nil
+	}
+	if err := table.Update(id, Record{"revokedAt": time.Now().UTC().Truncate(time.Microsecond)}); err != nil {
+		return fmt.Errorf("failed to revoke the API key: %v", err)
+	}
+	return nil
+}
+
+// ListAPIKeys is a method of the Server struct that lists the API keys, including revoked ones, oldest first. The
+// root server lists the keys of every tenant, the server of a tenant only the keys bound to it.
+//
+// Returns:
+// - The API keys, without their secrets.
+// - An error, if the API key table cannot be read. If the operation is successful, the error is nil.
+func (s *Server) ListAPIKeys() ([]APIKey, error) {
+	table, err := s.credentialServer().apiKeys(false)
+	if err != nil {
+		return nil, err
+	}
+	keys := []APIKey{}
+	if table == nil {
+		return keys, nil
+	}
+	records, err := table.SelectAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the API keys: %v", err)
+	}
+	for _, record := range records {
+		if key := apiKeyFromRecord(record); s.root == nil || key.Tenant == s.tenant {
+			keys = append(keys, *key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
+
+// HasAPIKeys reports whether any API key that is not revoked exists.
+func (s *Server) HasAPIKeys() (bool, error) {
+	keys, err := s.ListAPIKeys()
+	if err != nil {
+		return false, err
+	}
+	for _, key := range keys {
+		if key.RevokedAt == nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// IsAPIKey reports whether the token has the form of an API key, as opposed to other bearer tokens.
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+// AuthenticateAPIKey is a method of the Server struct that checks an API key sent by a client.
+//
+// Parameters:
+// - token: The key, as returned by CreateAPIKey.
+//
+// Returns:
+// - A pointer to the APIKey describing the key, whose Scope says what the request may do and whose Tenant is the
+// tenant it is bound to.
+// - ErrInvalidAPIKey if the key is malformed, unknown, revoked, has the wrong secret or, on the server of a tenant, is
+// not bound to the tenant, or an error if the API key table cannot be read. If the key is valid, the error is nil.
+func (s *Server) AuthenticateAPIKey(token string) (*APIKey, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(token, apiKeyPrefix), "_")
+	if !ok || !strings.HasPrefix(token, apiKeyPrefix) || id == "" || secret == "" {
+		return nil, ErrInvalidAPIKey
+	}
+	table, err := s.credentialServer().apiKeys(false)
+	if err != nil {
+		return nil, err
+	}
+	if table == nil {
+		return nil, ErrInvalidAPIKey
+	}
+
+	record, err := apiKeyRecord(table, id)
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return nil, ErrInvalidAPIKey
+	} else if err != nil {
+		return nil, err
+	}
+	hash, _ := record["hash"].(string)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(hashAPIKeySecret(secret))) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+	key := apiKeyFromRecord(record)
+	if key.RevokedAt != nil || (s.root != nil && key.Tenant != s.tenant) {
+		return nil, ErrInvalidAPIKey
+	}
+	return key, nil
+}
+
+// apiKeyRecord returns the record of the API key with the given ID from the API key table.
+func apiKeyRecord(table *Table, id string) (Record, error) {
+	record, err := systemRecord(table, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the API keys: %v", err)
+	}
+	if record == nil {
+		return nil, fmt.Errorf("%w: %s", ErrAPIKeyNotFound, id)
+	}
+	return record, nil
+}
+
+// systemRecord returns the record of a system table with the given primary key, or nil if there is none.
+func systemRecord(table *Table, key string) (Record, error) {
+	snap, err := table.resident()
+	if err != nil {
+		return nil, err
+	}
+	keyStr, err := table.EncodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	stored, exists := snap.records[keyStr]
+	if !exists {
+		return nil, nil
+	}
+	return fromProtoRecord(stored)
+}
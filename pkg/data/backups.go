@@ -0,0 +1,353 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrBackupNotFound is returned when a backup that does not exist is deleted.
+var ErrBackupNotFound = errors.New("backup not found")
+
+// backupTimeLayout is the layout of the time a backup was created at in its file name, in UTC.
+const backupTimeLayout = "20060102T1504"
+
+// legacyBackupFile is the file every backup was written to before backups were timestamped, still listed and
+// restored, but never pruned.
+const legacyBackupFile = "backup.zip"
+
+// Backup describes a backup archive of the backup directory of a server.
+type Backup struct {
+	File    string    `json:"file"`             // File is the name of the archive, such as backup-20240501T1200-nightly.zip.
+	Name    string    `json:"name,omitempty"`   // Name is the name the backup was given, empty if it has none.
+	Path    string    `json:"path"`             // Path is the path of the archive, or its location at the backup destination.
+	Created time.Time `json:"created"`          // Created is when the backup was taken, to the minute.
+	Size    int64     `json:"size"`             // Size is the size of the archive in bytes.
+	Remote  bool      `json:"remote,omitempty"` // Remote reports a copy at the backup destination, see ListRemoteBackups.
+
+	seq      int       // Counter telling apart the backups taken in the same minute, 1 for the first
+	modified time.Time // Time the archive was last written
+}
+
+// BackupOptions configures a backup taken with CreateBackup.
+type BackupOptions struct {
+	Name string // Name is appended to the file name of the backup; it may only hold letters, digits, hyphens and underscores.
+}
+
+// BackupRetention declares which backups PruneBackups keeps. A backup is kept if either rule keeps it, named backups
+// and the newest backup are always kept, and the zero BackupRetention keeps every backup.
+type BackupRetention struct {
+	Keep     int `json:"keep,omitempty"`     // Keep is how many of the newest backups are kept, 0 for no limit.
+	KeepDays int `json:"keepDays,omitempty"` // KeepDays is how many days backups are kept, 0 for no limit.
+}
+
+// enabled reports whether the retention prunes any backup.
+func (r BackupRetention) enabled() bool {
+	return r.Keep > 0 || r.KeepDays > 0
+}
+
+// validate checks that the counts of the retention are not negative.
+func (r BackupRetention) validate() error {
+	if r.Keep < 0 || r.KeepDays < 0 {
+		return fmt.Errorf("invalid backup retention of %d backups and %d days, expected positive numbers or 0", r.Keep, r.KeepDays)
+	}
+	return nil
+}
+
+// backupsDir returns the directory the backups of the server are written to.
+func (s *Server) backupsDir() string {
+	return filepath.Join(s.backupBaseDir(), "backups")
+}
+
+// CreateBackup backs up every database of the server, like BackupDatabases, to a new archive of the backup
+// directory named after the time it is taken at, such as backup-20240501T1200.zip, and after options.Name if given,
+// such as backup-20240501T1200-nightly.zip. Backups taken in the same minute are told apart by a counter, such as
+// backup-20240501T1200_2.zip. The backup is then copied to the backup destination set with SetBackupDestination,
+// if any, and the backups are pruned by the retention set with SetBackupRetention.
+//
+// Parameters:
+// - options: The name of the backup, if any.
+//
+// Returns:
+// - The BackupResult of the backup, holding its path and the backups pruned after it.
+// - An error, if the name is invalid, the backup cannot be written or it cannot be copied to the backup destination,
+// in which case the backup is kept in the backup directory. If the operation is successful, the error is nil.
+func (s *Server) CreateBackup(options BackupOptions) (*BackupResult, error) {
+	return s.createBackup(context.Background(), options, nil)
+}
+
+// createBackup does the work of CreateBackup, reporting the files written to the backup to progress. The copy to the
+// backup destination stops once ctx is done.
+func (s *Server) createBackup(ctx context.Context, options BackupOptions, progress ProgressFunc) (*BackupResult, error) {
+	if options.Name != "" && !ValidFilename(options.Name) {
+		return nil, fmt.Errorf("%w: backup name %q may only contain letters, digits, hyphens and underscores", ErrInvalidName, options.Name)
+	}
+	result, err := s.backupDatabases(ctx, options.Name, progress)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.uploadBackup(ctx, result); err != nil {
+		return nil, err
+	}
+
+	s.RLock()
+	retention := s.backupRetention
+	s.RUnlock()
+	if retention.enabled() {
+		pruned, err := s.PruneBackups(retention)
+		if err != nil {
+			log.Printf("Failed to prune backups%s: %v", s.tenantSuffix(), err)
+		}
+		for _, backup := range pruned {
+			if backup.Remote {
+				result.Pruned = append(result.Pruned, backup.Path)
+			} else {
+				result.Pruned = append(result.Pruned, backup.File)
+			}
+		}
+	}
+	return result, nil
+}
+
+// backupFileName returns the file name of a backup taken at created, with the given name, if any, and told apart
+// from the backups taken in the same minute by the counter n if it is above 1.
+func backupFileName(created time.Time, name string, n int) string {
+	file := "backup-" + created.UTC().Format(backupTimeLayout)
+	if n > 1 {
+		file += "_" + strconv.Itoa(n)
+	}
+	if name != "" {
+		file += "-" + name
+	}
+	return file + ".zip"
+}
+
+// parseBackupFileName returns the backup whose archive is named file, and false if file is not named like a backup.
+func parseBackupFileName(file string) (Backup, bool) {
+	if file == legacyBackupFile {
+		return Backup{File: file}, true
+	}
+	stem, ok := strings.CutSuffix(file, ".zip")
+	if !ok {
+		return Backup{}, false
+	}
+	if stem, ok = strings.CutPrefix(stem, "backup-"); !ok {
+		return Backup{}, false
+	}
+	stamp, name, _ := strings.Cut(stem, "-")
+	stamp, counter, hasCounter := strings.Cut(stamp, "_")
+	seq := 1
+	if hasCounter {
+		var err error
+		if seq, err = strconv.Atoi(counter); err != nil || seq < 2 {
+			return Backup{}, false
+		}
+	}
+	created, err := time.Parse(backupTimeLayout, stamp)
+	if err != nil {
+		return Backup{}, false
+	}
+	return Backup{File: file, Name: name, Created: created, seq: seq}, true
+}
+
+// ListBackups returns the backups of the backup directory of the server, newest first. The backup.zip written before
+// backups were timestamped is listed by the time it was last written.
+//
+// Returns:
+// - The backups, empty if there are none.
+// - An error, if the backup directory cannot be read. If the operation is successful, the error is nil.
+func (s *Server) ListBackups() ([]Backup, error) {
+	dir := s.backupsDir()
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read backup directory: %v", err)
+	}
+
+	var backups []Backup
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		backup, ok := parseBackupFileName(entry.Name())
+		if !ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// The backup was removed while it was listed
+			continue
+		}
+		backup.Path = filepath.Join(dir, backup.File)
+		backup.Size = info.Size()
+		backup.modified = info.ModTime()
+		if backup.File == legacyBackupFile {
+			backup.Created = info.ModTime().UTC()
+		}
+		backups = append(backups, backup)
+	}
+	sortBackups(backups)
+	return backups, nil
+}
+
+// sortBackups sorts the backups newest first, those taken in the same minute by their counter, then by when they were
+// written.
+func sortBackups(backups []Backup) {
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].Created.Equal(backups[j].Created) {
+			return backups[i].Created.After(backups[j].Created)
+		}
+		if backups[i].seq != backups[j].seq {
+			return backups[i].seq > backups[j].seq
+		}
+		return backups[i].modified.After(backups[j].modified)
+	})
+}
+
+// findBackup returns the newest backup whose file name, file name without extension or name is ref, and false if
+// there is none.
+func (s *Server) findBackup(ref string) (Backup, bool) {
+	backups, err := s.ListBackups()
+	if err != nil {
+		return Backup{}, false
+	}
+	return matchBackup(backups, ref)
+}
+
+// matchBackup returns the first of the backups whose file name, file name without extension or name is ref.
+func matchBackup(backups []Backup, ref string) (Backup, bool) {
+	for _, backup := range backups {
+		if backup.File == ref || strings.TrimSuffix(backup.File, ".zip") == ref || (backup.Name != "" && backup.Name == ref) {
+			return backup, true
+		}
+	}
+	return Backup{}, false
+}
+
+// DeleteBackup deletes a backup of the backup directory of the server.
+//
+// Parameters:
+// - ref: The file name of the backup, with or without its .zip extension, or its name, in which case the newest
+// backup with that name is deleted.
+//
+// Returns:
+// - The deleted backup.
+// - ErrBackupNotFound if there is no such backup, or an error if it cannot be deleted. If the operation is
+// successful, the error is nil.
+func (s *Server) DeleteBackup(ref string) (Backup, error) {
+	backup, ok := s.findBackup(ref)
+	if !ok {
+		return Backup{}, fmt.Errorf("%w: %s", ErrBackupNotFound, ref)
+	}
+	if err := os.Remove(backup.Path); err != nil {
+		return Backup{}, fmt.Errorf("failed to delete backup %s: %v", backup.File, err)
+	}
+	return backup, nil
+}
+
+// PruneBackups deletes the backups of the backup directory of the server that the retention does not keep: those
+// beyond the newest retention.Keep unnamed backups and older than retention.KeepDays days. Named backups, the
+// backup.zip written before backups were timestamped and the newest backup are never deleted. The copies at the
+// backup destination of the server, if it has one, are pruned by the same rules, see SetBackupDestination.
+//
+// Parameters:
+// - retention: Which backups are kept.
+//
+// Returns:
+// - The deleted backups, newest first, followed by the deleted copies at the backup destination.
+// - An error, if the retention is invalid or a backup cannot be deleted, in which case the remaining backups are
+// still pruned. If the operation is successful, the error is nil.
+func (s *Server) PruneBackups(retention BackupRetention) ([]Backup, error) {
+	if err := retention.validate(); err != nil {
+		return nil, err
+	}
+	if !retention.enabled() {
+		return nil, nil
+	}
+	backups, err := s.ListBackups()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	var pruned []Backup
+	var errs []error
+	for _, backup := range expiredBackups(backups, retention, now) {
+		if err := os.Remove(backup.Path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("failed to delete backup %s: %v", backup.File, err))
+			continue
+		}
+		pruned = append(pruned, backup)
+	}
+
+	destination := s.BackupDestination()
+	if destination == nil {
+		return pruned, errors.Join(errs...)
+	}
+	remote, err := s.ListRemoteBackups()
+	if err != nil {
+		return pruned, errors.Join(append(errs, err)...)
+	}
+	for _, backup := range expiredBackups(remote, retention, now) {
+		if err := destination.Delete(context.Background(), s.destinationPrefix()+backup.File); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		pruned = append(pruned, backup)
+	}
+	return pruned, errors.Join(errs...)
+}
+
+// expiredBackups returns the backups, sorted newest first, that the retention does not keep at now, see PruneBackups.
+func expiredBackups(backups []Backup, retention BackupRetention, now time.Time) []Backup {
+	cutoff := now.AddDate(0, 0, -retention.KeepDays)
+	var expired []Backup
+	unnamed := 0
+	for i, backup := range backups {
+		if backup.Name != "" || backup.File == legacyBackupFile {
+			continue
+		}
+		unnamed++
+		if i == 0 {
+			continue
+		}
+		keptByCount := retention.Keep > 0 && unnamed <= retention.Keep
+		keptByAge := retention.KeepDays > 0 && backup.Created.After(cutoff)
+		if !keptByCount && !keptByAge {
+			expired = append(expired, backup)
+		}
+	}
+	return expired
+}
+
+// SetBackupRetention sets which backups of the server, and of its tenants, are kept after every backup, see
+// PruneBackups. The zero BackupRetention, the default, keeps every backup.
+//
+// Returns:
+// - An error, if the retention is invalid. If the operation is successful, the error is nil.
+func (s *Server) SetBackupRetention(retention BackupRetention) error {
+	if err := retention.validate(); err != nil {
+		return err
+	}
+	defer s.forEachTenant(func(tenant *Server) { tenant.SetBackupRetention(retention) })
+	s.Lock()
+	defer s.Unlock()
+
+	s.backupRetention = retention
+	return nil
+}
+
+// BackupRetention returns the retention set with SetBackupRetention.
+func (s *Server) BackupRetention() BackupRetention {
+	s.RLock()
+	defer s.RUnlock()
+	return s.backupRetention
+}
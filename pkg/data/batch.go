@@ -0,0 +1,140 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// BatchResult is the outcome of one item of a batch write, at the same position as the item.
+type BatchResult struct {
+	Key    string // Key is the encoded primary key of the item, empty if it could not be determined.
+	Record Record // Record is the record as stored by an insert or update, nil for deletes and failed items.
+	Err    error  // Err is why the item was not written, nil if it was.
+}
+
+// BatchUpdate is an item of UpdateBatchCtx: the fields to change in the record with the key.
+type BatchUpdate struct {
+	Key     interface{}
+	Updates Record
+}
+
+// InsertBatchCtx inserts the records under a single lock and a single write of the table file, like InsertMany, but
+// reports the outcome of every record instead of stopping at the first failure: records that fail, such as those with
+// a duplicate key, are skipped and the others are inserted.
+//
+// Parameters:
+// - ctx: The context of the write. The table is left unchanged if it is done before the records are written.
+// - records: The records to insert.
+//
+// Returns:
+// - The result of every record, at its position in records.
+// - An error if the batch as a whole failed, in which case no record was inserted.
+func (t *Table) InsertBatchCtx(ctx context.Context, records []Record) ([]BatchResult, error) {
+	defer t.sample("insert_many", "", time.Now())
+	return t.batch(ctx, "insert", len(records), func(allRecords *dbdata.Records, i int) (string, *dbdata.Record, error) {
+		return t.applyInsert(allRecords, records[i])
+	})
+}
+
+// UpdateBatchCtx updates records under a single lock and a single write of the table file, like UpdateMany, reporting
+// the outcome of every update at its position. Updates that fail, such as those of missing keys, are skipped and the
+// others are applied.
+//
+// Parameters:
+// - ctx: The context of the write. The table is left unchanged if it is done before the records are written.
+// - updates: The keys of the records to update with the fields to change in each.
+//
+// Returns:
+// - The result of every update, at its position in updates.
+// - An error if the batch as a whole failed, in which case no record was updated.
+func (t *Table) UpdateBatchCtx(ctx context.Context, updates []BatchUpdate) ([]BatchResult, error) {
+	defer t.sample("update_many", "", time.Now())
+	return t.batch(ctx, "update", len(updates), func(allRecords *dbdata.Records, i int) (string, *dbdata.Record, error) {
+		// applyUpdate only replaces the record if the update succeeds, so a failed update leaves it as it was
+		keyStr, err := t.EncodeKey(updates[i].Key)
+		if err != nil {
+			return "", nil, err
+		}
+		_, updated, err := t.applyUpdate(allRecords, updates[i].Key, updates[i].Updates)
+		return keyStr, updated, err
+	})
+}
+
+// DeleteBatchCtx deletes records under a single lock and a single write of the table file, like DeleteMany, reporting
+// the outcome of every key at its position. Keys that have no record are reported and skipped.
+//
+// Parameters:
+// - ctx: The context of the write. The table is left unchanged if it is done before the remaining records are written.
+// - keys: The primary keys of the records to delete.
+//
+// Returns:
+// - The result of every key, at its position in keys.
+// - An error if the batch as a whole failed, in which case no record was deleted.
+func (t *Table) DeleteBatchCtx(ctx context.Context, keys []interface{}) ([]BatchResult, error) {
+	defer t.sample("delete_many", "", time.Now())
+	return t.batch(ctx, "delete", len(keys), func(allRecords *dbdata.Records, i int) (string, *dbdata.Record, error) {
+		keyStr, err := t.applyDelete(allRecords, keys[i])
+		return keyStr, nil, err
+	})
+}
+
+// batch applies n items of a batch write with apply under the table write lock, writes the table file once if any
+// item succeeded, and logs the commits of the items that did.
+func (t *Table) batch(ctx context.Context, operation string, n int, apply func(allRecords *dbdata.Records, i int) (string, *dbdata.Record, error)) ([]BatchResult, error) {
+	unlock, err := t.lockWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	allRecords, err := t.recordsForWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	results := make([]BatchResult, n)
+	var written []int
+	for i := range results {
+		keyStr, record, err := apply(allRecords, i)
+		if err != nil {
+			results[i] = BatchResult{Key: keyStr, Err: err}
+			continue
+		}
+		results[i].Key = keyStr
+		t.Cache.Remove(keyStr)
+		switch operation {
+		case "insert":
+			t.metrics.IncrementInsertCount()
+		case "update":
+			t.metrics.IncrementUpdateCount()
+		case "delete":
+			t.metrics.IncrementDeleteCount()
+		}
+		if record != nil {
+			if results[i].Record, err = fromProtoRecord(t.withReadFields(record)); err != nil {
+				return nil, err
+			}
+		}
+		written = append(written, i)
+	}
+	if len(written) == 0 {
+		return results, nil
+	}
+
+	if err := t.writeRecordsToFile(allRecords); err != nil {
+		return nil, err
+	}
+	for _, i := range written {
+		if operation == "delete" {
+			t.logCommit(operation, results[i].Key, nil)
+		} else {
+			t.logCommit(operation, results[i].Key, allRecords.Records[results[i].Key])
+		}
+	}
+	return results, nil
+}
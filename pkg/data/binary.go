@@ -0,0 +1,65 @@
+package data
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// BytesJSONKey is the key of the JSON object byte slices are represented as at the JSON API boundary,
+// {"$bytes": "<base64>"}, so that they can be told apart from strings and are stored as bytes again when sent back.
+const BytesJSONKey = "$bytes"
+
+// EncodeBinaryFields returns a copy of the record with every []byte value replaced by its JSON representation,
+// {"$bytes": "<base64>"}. It returns the record itself if it holds no byte slices.
+func EncodeBinaryFields(record Record) Record {
+	var encoded Record
+	for field, value := range record {
+		b, ok := value.([]byte)
+		if !ok {
+			continue
+		}
+		if encoded == nil {
+			encoded = make(Record, len(record))
+			for field, value := range record {
+				encoded[field] = value
+			}
+		}
+		encoded[field] = map[string]interface{}{BytesJSONKey: base64.StdEncoding.EncodeToString(b)}
+	}
+	if encoded == nil {
+		return record
+	}
+	return encoded
+}
+
+// DecodeBinaryFields replaces every {"$bytes": "<base64>"} object among the values of a record decoded from JSON
+// with the bytes it holds. The record is changed in place. Only the values of the record itself are decoded, not
+// those nested in objects or lists.
+//
+// Parameters:
+// - record: The record decoded from JSON, such as the record, updates or filters of a request.
+//
+// Returns:
+// - An error, if a "$bytes" value is not a valid standard base64 string. If the operation is successful, the error is nil.
+func DecodeBinaryFields(record Record) error {
+	for field, value := range record {
+		object, ok := value.(map[string]interface{})
+		if !ok || len(object) != 1 {
+			continue
+		}
+		encoded, ok := object[BytesJSONKey]
+		if !ok {
+			continue
+		}
+		s, ok := encoded.(string)
+		if !ok {
+			return fmt.Errorf("invalid value for field '%s': %s must be a base64 string", field, BytesJSONKey)
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return fmt.Errorf("invalid value for field '%s': %v", field, err)
+		}
+		record[field] = b
+	}
+	return nil
+}
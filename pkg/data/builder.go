@@ -0,0 +1,190 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// QueryBuilder assembles a Query step by step and runs it, so callers do not have to build filter maps by hand:
+//
+//	var users []User
+//	err := db.Table("users").Where("age", ">", 30).OrderBy("name").Limit(10).Find(&users)
+//
+// Errors, such as an unknown table or operator, are remembered and returned by the method that runs the query.
+// A QueryBuilder is not safe for concurrent use.
+type QueryBuilder struct {
+	table *Table
+	query Query
+	ctx   context.Context
+	err   error
+}
+
+// Table returns a QueryBuilder for the table with the given name.
+func (db *Database) Table(name string) *QueryBuilder {
+	db.RLock()
+	table, exists := db.Tables[name]
+	db.RUnlock()
+	if !exists {
+		return &QueryBuilder{err: fmt.Errorf("table %s does not exist in database %s", name, db.Name)}
+	}
+	return table.NewQuery()
+}
+
+// NewQuery returns a QueryBuilder for the table that initially selects every record.
+func (t *Table) NewQuery() *QueryBuilder {
+	return &QueryBuilder{table: t, ctx: context.Background()}
+}
+
+// WithContext makes the query honor ctx: it stops with ctx.Err() once ctx is done.
+func (b *QueryBuilder) WithContext(ctx context.Context) *QueryBuilder {
+	b.ctx = ctx
+	return b
+}
+
+// Where adds a condition comparing the field with the value using one of =, !=, >, >=, <, <=, IS NULL, IS NOT NULL
+// and IS MISSING. Equality conditions can be served by an index, the other operators are evaluated on every candidate record.
+func (b *QueryBuilder) Where(field, operator string, value interface{}) *QueryBuilder {
+	if operator == OpEqual {
+		if b.query.Filters == nil {
+			b.query.Filters = make(map[string]interface{})
+		}
+		if _, exists := b.query.Filters[field]; !exists {
+			b.query.Filters[field] = value
+			return b
+		}
+	}
+	condition := Condition{Field: field, Operator: operator, Value: value}
+	if err := validateConditions([]Condition{condition}); err != nil && b.err == nil {
+		b.err = err
+	}
+	b.query.Conditions = append(b.query.Conditions, condition)
+	return b
+}
+
+// WhereBetween keeps the records whose field is between low and high, both included, such as the records created
+// in a time range: WhereBetween("created_at", from, to).
+func (b *QueryBuilder) WhereBetween(field string, low, high interface{}) *QueryBuilder {
+	return b.Where(field, OpGreaterOrEqual, low).Where(field, OpLessOrEqual, high)
+}
+
+// WhereNull keeps the records whose field is stored as NULL. Records without the field are not kept.
+func (b *QueryBuilder) WhereNull(field string) *QueryBuilder {
+	return b.Where(field, OpIsNull, nil)
+}
+
+// WhereNotNull keeps the records whose field holds a value other than NULL.
+func (b *QueryBuilder) WhereNotNull(field string) *QueryBuilder {
+	return b.Where(field, OpIsNotNull, nil)
+}
+
+// OrderBy sorts the records by the field in ascending order, with ties broken by primary key.
+func (b *QueryBuilder) OrderBy(field string) *QueryBuilder {
+	b.query.SortBy = field
+	return b
+}
+
+// Limit sets the maximum number of records returned.
+func (b *QueryBuilder) Limit(limit int) *QueryBuilder {
+	b.query.Limit = limit
+	return b
+}
+
+// Offset sets the number of records skipped before the first one returned.
+func (b *QueryBuilder) Offset(offset int) *QueryBuilder {
+	b.query.Offset = offset
+	return b
+}
+
+// After resumes the iteration after the position of a cursor returned by Page.
+func (b *QueryBuilder) After(cursor string) *QueryBuilder {
+	b.query.Cursor = cursor
+	return b
+}
+
+// Select keeps only the given top-level fields in the returned records.
+func (b *QueryBuilder) Select(fields ...string) *QueryBuilder {
+	b.query.Fields = fields
+	return b
+}
+
+// Query returns the Query built so far, or the first error recorded while building it.
+func (b *QueryBuilder) Query() (Query, error) {
+	return b.query, b.err
+}
+
+// Records runs the query and returns the matching records.
+func (b *QueryBuilder) Records() ([]Record, error) {
+	records, _, err := b.Page()
+	return records, err
+}
+
+// Page runs the query and returns the matching records along with the cursor of the next page,
+// which is empty when there are no more records.
+func (b *QueryBuilder) Page() ([]Record, string, error) {
+	if b.err != nil {
+		return nil, "", b.err
+	}
+	return b.table.QueryWithCursorCtx(b.ctx, b.query)
+}
+
+// Iterate runs the query and returns an iterator over the matching records, for streaming exports:
+//
+//	iter, err := table.NewQuery().Where("status", "=", "active").Select("id", "email").Iterate()
+//	err = exports.ExportCSV(w, iter)
+func (b *QueryBuilder) Iterate() (*RecordIterator, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return b.table.IterateQuery(b.ctx, b.query)
+}
+
+// Find runs the query and stores the matching records in out, which must be a pointer to a slice.
+// A *[]Record receives the records as they are; any other slice, such as a slice of structs,
+// is filled by converting each record through JSON, so struct fields are matched by their json tags.
+func (b *QueryBuilder) Find(out interface{}) error {
+	records, err := b.Records()
+	if err != nil {
+		return err
+	}
+	if target, ok := out.(*[]Record); ok {
+		*target = records
+		return nil
+	}
+	return decodeRecords(records, out)
+}
+
+// First runs the query with a limit of one and stores the first matching record in out,
+// which must be a pointer to a Record or to a value decodable from JSON.
+// It returns ErrNoRecords if no record matches.
+func (b *QueryBuilder) First(out interface{}) error {
+	b.query.Limit = 1
+	records, err := b.Records()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return ErrNoRecords
+	}
+	if target, ok := out.(*Record); ok {
+		*target = records[0]
+		return nil
+	}
+	return decodeRecords(records[0], out)
+}
+
+// ErrNoRecords is returned by QueryBuilder.First when no record matches the query.
+var ErrNoRecords = errors.New("no records match the query")
+
+// decodeRecords converts records to the type of out through their JSON representation.
+func decodeRecords(records interface{}, out interface{}) error {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return fmt.Errorf("failed to serialize records: %v", err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to decode records into %T: %v", out, err)
+	}
+	return nil
+}
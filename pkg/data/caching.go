@@ -0,0 +1,273 @@
+package data
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// Temperatures of a table, as decided by a CachePolicy from how often the table is accessed.
+const (
+	TableHot  = "hot"  // TableHot tables get the larger cache and are kept in memory.
+	TableWarm = "warm" // TableWarm tables get the regular cache.
+	TableCold = "cold" // TableCold tables have their records evicted from memory until they are accessed again.
+)
+
+// CachePolicy adapts the memory spent on every table to how often it is accessed. On every run it counts the
+// accesses of each table since the previous run: tables accessed at least HotAccesses times are hot, tables not
+// accessed for ColdAfter are cold, and the others are warm. A zero field disables its rule.
+type CachePolicy struct {
+	Interval     time.Duration `json:"interval"`     // Interval is how often the policy runs.
+	HotAccesses  int           `json:"hotAccesses"`  // HotAccesses is the number of accesses within an interval from which a table is hot.
+	ColdAfter    time.Duration `json:"coldAfter"`    // ColdAfter is how long a table goes without accesses before it is cold.
+	CacheSize    int           `json:"cacheSize"`    // CacheSize is the number of records the lookup cache of a warm table holds, DefaultCacheSize if 0.
+	HotCacheSize int           `json:"hotCacheSize"` // HotCacheSize is the number of records the lookup cache of a hot table holds, DefaultCacheSize if 0.
+}
+
+// DefaultCachePolicy is the cache policy that dbproto serve applies when adaptive caching is enabled.
+var DefaultCachePolicy = CachePolicy{
+	Interval:     time.Minute,
+	HotAccesses:  1000,
+	ColdAfter:    30 * time.Minute,
+	CacheSize:    1000,
+	HotCacheSize: 10000,
+}
+
+// CacheState is the state of a table under its cache policy, as reported by the stats API.
+type CacheState struct {
+	Temperature   string    `json:"temperature"`          // Temperature is "hot", "warm" or "cold".
+	Accesses      int64     `json:"accesses"`             // Accesses is the number of accesses counted by the last run of the policy.
+	LastAccess    time.Time `json:"lastAccess,omitempty"` // LastAccess is when the table was last accessed.
+	Resident      bool      `json:"resident"`             // Resident is whether the records of the table are in memory.
+	CachedRecords int       `json:"cachedRecords"`        // CachedRecords is the number of records in the lookup cache.
+	CacheLimit    int       `json:"cacheLimit"`           // CacheLimit is the number of records the lookup cache holds at most.
+}
+
+// tableHeat tracks how often a table is accessed and the decisions of the cache policy about it.
+type tableHeat struct {
+	accesses    atomic.Int64           // Accesses since the cache policy last ran
+	counted     atomic.Int64           // Accesses counted by the last run of the cache policy
+	lastAccess  atomic.Int64           // Unix nanoseconds of the last access
+	temperature atomic.Pointer[string] // Temperature decided by the last run of the cache policy, warm if nil
+	cacheLimit  atomic.Int64           // Size of the lookup cache set by the cache policy, 0 if it sets none
+}
+
+// touch counts an access to the table.
+func (t *Table) touch() {
+	t.heat.accesses.Add(1)
+	t.heat.lastAccess.Store(time.Now().UnixNano())
+}
+
+// resident returns the current version of the table like loadSnapshot, without counting an access.
+func (t *Table) resident() (*snapshot, error) {
+	if snap := t.current.Load(); snap != nil {
+		return snap, nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t.current.Load(), nil
+}
+
+// reload reads the records of a table evicted by the cache policy back from the file and publishes them.
+// It does nothing if the table is in memory, and returns ErrClosed if the table has been closed. The caller must hold
+// the table write lock.
+func (t *Table) reload() error {
+	if t.closed.Load() {
+		return ErrClosed
+	}
+	if t.current.Load() != nil {
+		return nil
+	}
+	records, err := t.readRecordsFromFile()
+	if err != nil {
+		return err
+	}
+	t.publish(records.Records)
+	return nil
+}
+
+// evict drops the records, indexes and cached records of the table from memory. They are read from the file again
+// by the next access. Virtual tables and tables held in memory have no file and are never evicted, nor are tables
+// whose pending write-behind changes cannot be flushed.
+func (t *Table) evict() {
+	if t.virtual || t.temporary {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if err := t.flushPending(); err != nil {
+		log.Printf("Kept table %s in memory, as its pending writes could not be flushed: %v", t.FilePath, err)
+		return
+	}
+	t.current.Store(nil)
+	t.previous = nil
+	t.Records = nil
+	t.Indexes = nil
+	t.removeSpillFiles()
+	t.Cache.Clear()
+}
+
+// cacheRecord adds a record read by a lookup to the lookup cache, evicting the least recently used record if the
+// cache is full. Writes remove the records they change from the cache instead, see RecordCache.
+func (t *Table) cacheRecord(key string, record *dbdata.Record) {
+	if evicted := t.Cache.Put(key, record); evicted > 0 {
+		t.metrics.addCacheEvictions(evicted)
+	}
+}
+
+// setCacheLimit sets the size of the lookup cache chosen by the cache policy, which applies unless the table has a
+// CacheSize option.
+func (t *Table) setCacheLimit(limit int) {
+	t.heat.cacheLimit.Store(int64(limit))
+	t.RLock()
+	size := t.cacheSize()
+	t.RUnlock()
+	if evicted := t.Cache.SetLimit(size); evicted > 0 {
+		t.metrics.addCacheEvictions(evicted)
+	}
+}
+
+// cacheSize returns the number of records the lookup cache of the table holds: its CacheSize option, or else the size
+// set by the cache policy, or else DefaultCacheSize. The caller must hold the table lock.
+func (t *Table) cacheSize() int {
+	switch {
+	case t.Options.CacheSize < 0:
+		return 0
+	case t.Options.CacheSize > 0:
+		return t.Options.CacheSize
+	case t.heat.cacheLimit.Load() > 0:
+		return int(t.heat.cacheLimit.Load())
+	}
+	return DefaultCacheSize
+}
+
+// SetCacheSize is a method of the Table struct that sets the number of records the lookup cache of the table holds,
+// which is stored in its metadata. The least recently used records over the new size are evicted right away.
+//
+// Parameters:
+// - size: The number of records, 0 for the size set by the cache policy or DefaultCacheSize, or a negative number to
+// cache no records.
+//
+// Returns:
+// - An error, if the metadata cannot be written. If the operation is successful, the error is nil.
+func (t *Table) SetCacheSize(size int) error {
+	unlock, err := t.lockWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := t.saveOptions(func(options *TableOptions) {
+		options.CacheSize = size
+	}); err != nil {
+		return err
+	}
+	if evicted := t.Cache.SetLimit(t.cacheSize()); evicted > 0 {
+		t.metrics.addCacheEvictions(evicted)
+	}
+	return nil
+}
+
+// applyCachePolicy decides the temperature of the table from the accesses counted since the previous run and
+// adapts its memory: hot tables are loaded and get the larger cache, cold tables are evicted, and warm tables get
+// the regular cache.
+func (t *Table) applyCachePolicy(policy CachePolicy, now time.Time) error {
+	if t.virtual {
+		return nil
+	}
+	accesses := t.heat.accesses.Swap(0)
+	t.heat.counted.Store(accesses)
+	idle := now.Sub(time.Unix(0, t.heat.lastAccess.Load()))
+
+	temperature := TableWarm
+	switch {
+	case policy.HotAccesses > 0 && accesses >= int64(policy.HotAccesses):
+		temperature = TableHot
+		t.setCacheLimit(policy.HotCacheSize)
+		if _, err := t.resident(); err != nil {
+			return err
+		}
+	case policy.ColdAfter > 0 && accesses == 0 && idle >= policy.ColdAfter:
+		temperature = TableCold
+		t.evict()
+	default:
+		t.setCacheLimit(policy.CacheSize)
+	}
+	t.heat.temperature.Store(&temperature)
+	return nil
+}
+
+// CacheState returns the state of the table under its cache policy.
+func (t *Table) CacheState() CacheState {
+	state := CacheState{
+		Temperature: TableWarm,
+		Accesses:    t.heat.counted.Load(),
+		Resident:    t.current.Load() != nil,
+	}
+	if temperature := t.heat.temperature.Load(); temperature != nil {
+		state.Temperature = *temperature
+	}
+	if lastAccess := t.heat.lastAccess.Load(); lastAccess > 0 {
+		state.LastAccess = time.Unix(0, lastAccess).UTC()
+	}
+	state.CachedRecords = t.Cache.Len()
+	state.CacheLimit = t.Cache.Limit()
+	return state
+}
+
+// RunCachePolicy applies the cache policy to every table of the server and of its tenants every policy.Interval,
+// until ctx is done. Tables that fail to load are left as they are and retried on the next run. It returns ctx.Err(),
+// or ErrClosed once the server is closed.
+func (s *Server) RunCachePolicy(ctx context.Context, policy CachePolicy) error {
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.stopped:
+			return ErrClosed
+		case now := <-ticker.C:
+			s.applyCachePolicy(policy, now)
+		}
+	}
+}
+
+// applyCachePolicy applies the cache policy to every table of the server once.
+func (s *Server) applyCachePolicy(policy CachePolicy, now time.Time) {
+	for _, tenant := range s.tenantServers() {
+		tenant.applyCachePolicy(policy, now)
+	}
+	s.RLock()
+	defer s.RUnlock()
+	for dbName, db := range s.Databases {
+		db.RLock()
+		for tableName, table := range db.Tables {
+			if err := table.applyCachePolicy(policy, now); err != nil {
+				log.Printf("Failed to apply the cache policy to table %s.%s: %v", dbName, tableName, err)
+			}
+		}
+		db.RUnlock()
+	}
+}
+
+// CacheStates returns the cache state of every table, keyed like GetMetrics.
+func (s *Server) CacheStates() map[string]CacheState {
+	s.RLock()
+	defer s.RUnlock()
+
+	states := make(map[string]CacheState)
+	for dbName, db := range s.Databases {
+		db.RLock()
+		for tableName, table := range db.Tables {
+			states[dbName+"_"+tableName] = table.CacheState()
+		}
+		db.RUnlock()
+	}
+	return states
+}
@@ -0,0 +1,239 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// CatalogDatabase is the name of the virtual database whose tables describe the server.
+const CatalogDatabase = "_catalog"
+
+// ErrCatalogReadOnly is returned by attempts to write to a catalog table.
+var ErrCatalogReadOnly = errors.New("the tables of " + CatalogDatabase + " are read-only")
+
+// ErrDatabaseNotFound is returned by Server.Database for an unknown database.
+var ErrDatabaseNotFound = errors.New("database not found")
+
+// Database returns the database with the given name, or a fresh system catalog for CatalogDatabase.
+// It returns ErrDatabaseNotFound if there is no such database, and for SystemDatabase, which is internal, and
+// ErrClosed once the server is closed.
+func (s *Server) Database(name string) (*Database, error) {
+	if name == CatalogDatabase {
+		return s.Catalog()
+	}
+	if name == SystemDatabase {
+		return nil, ErrDatabaseNotFound
+	}
+	if s.closed.Load() {
+		return nil, ErrClosed
+	}
+	s.RLock()
+	defer s.RUnlock()
+	db, exists := s.Databases[name]
+	if !exists {
+		return nil, ErrDatabaseNotFound
+	}
+	return db, nil
+}
+
+// Catalog is a method of the Server struct that returns the system catalog: a virtual, read-only database named
+// CatalogDatabase whose tables describe the server as of the call.
+// The catalog is not stored anywhere and does not change afterwards; call Catalog again for fresh metadata.
+// Its tables are read like any other table, for example with Query, SelectAll or Database.Exec, and every write
+// fails with ErrCatalogReadOnly. The tables are:
+//
+//   - databases: one record per database, with its name and number of tables.
+//   - tables: one record per table, keyed "database.table", with its primary key, number of records and options.
+//   - fields: one record per field of a table, keyed "database.table.field", with the kinds of values stored in the
+//     field and the number of records that have it. Tables have no fixed schema, so fields are gathered from the records.
+//   - indexes: one record per indexed field, keyed "database.table.field", with the number of indexed records.
+//   - stats: one record per table, keyed "database.table", with its operation counters, write backlog and
+//     temperature under the cache policy.
+//
+// Tables evicted by the cache policy are read back into memory, without counting as an access to them.
+//
+// Returns:
+// - A pointer to the catalog Database.
+// - If a catalog table cannot be built, it returns the error.
+func (s *Server) Catalog() (*Database, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var databases, tables, fields, indexes, stats []Record
+	dbNames := make([]string, 0, len(s.Databases))
+	for name := range s.Databases {
+		if name != SystemDatabase {
+			dbNames = append(dbNames, name)
+		}
+	}
+	sort.Strings(dbNames)
+
+	for _, dbName := range dbNames {
+		db := s.Databases[dbName]
+		db.RLock()
+		databases = append(databases, Record{"name": dbName, "tables": len(db.Tables)})
+		for tableName, table := range db.Tables {
+			id := dbName + "." + tableName
+			snap, err := table.resident()
+			if err != nil {
+				db.RUnlock()
+				return nil, fmt.Errorf("failed to load table %s: %v", id, err)
+			}
+			tables = append(tables, Record{
+				"id":              id,
+				"database":        dbName,
+				"table":           tableName,
+				"primaryKey":      table.PrimaryKey,
+				"records":         len(snap.records),
+				"autoID":          table.Options.AutoID,
+				"timestamps":      table.Options.Timestamps,
+				"clientEncrypted": table.Options.ClientEncrypted,
+				"verifyChecksums": table.Options.VerifyChecksums,
+				"pipeline":        strings.Join(table.Options.Pipeline, ","),
+			})
+			for field, described := range describeFields(snap.records) {
+				fields = append(fields, Record{
+					"id":       id + "." + field,
+					"database": dbName,
+					"table":    tableName,
+					"field":    field,
+					"kinds":    described.kinds,
+					"records":  described.records,
+					"primary":  field == table.PrimaryKey,
+				})
+			}
+			for field, partition := range snap.indexes {
+				indexes = append(indexes, Record{
+					"id":       id + "." + field,
+					"database": dbName,
+					"table":    tableName,
+					"field":    field,
+					"entries":  partition.count,
+				})
+			}
+
+			caching := table.CacheState()
+			table.metrics.RLock()
+			stats = append(stats, Record{
+				"id":                id,
+				"database":          dbName,
+				"table":             tableName,
+				"inserts":           table.metrics.InsertCount,
+				"updates":           table.metrics.UpdateCount,
+				"deletes":           table.metrics.DeleteCount,
+				"queries":           table.metrics.QueryCount,
+				"cacheHits":         table.metrics.CacheHits,
+				"cacheMisses":       table.metrics.CacheMisses,
+				"pendingWrites":     table.metrics.PendingWrites,
+				"peakPendingWrites": table.metrics.PeakPendingWrites,
+				"delayedWrites":     table.metrics.DelayedWrites,
+				"rejectedWrites":    table.metrics.RejectedWrites,
+				"temperature":       caching.Temperature,
+				"cachedRecords":     caching.CachedRecords,
+			})
+			table.metrics.RUnlock()
+		}
+		db.RUnlock()
+	}
+
+	catalog := NewDatabase(CatalogDatabase)
+	for _, definition := range []struct {
+		name       string
+		primaryKey string
+		records    []Record
+	}{
+		{"databases", "name", databases},
+		{"tables", "id", tables},
+		{"fields", "id", fields},
+		{"indexes", "id", indexes},
+		{"stats", "id", stats},
+	} {
+		table, err := newVirtualTable(definition.primaryKey, definition.records)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build catalog table %s: %v", definition.name, err)
+		}
+		catalog.Tables[definition.name] = table
+	}
+	return catalog, nil
+}
+
+// fieldDescription summarizes the values a field holds across the records of a table.
+type fieldDescription struct {
+	kinds   string // Sorted, comma separated kinds of the values: bool, bytes, null, number, string, timestamp or other
+	records int    // Number of records that have the field
+}
+
+// describeFields summarizes every field of the records.
+func describeFields(records map[string]*dbdata.Record) map[string]fieldDescription {
+	kinds := make(map[string]map[string]bool)
+	counts := make(map[string]int)
+	for _, record := range records {
+		for field, protoValue := range record.Fields {
+			value, err := fromProtoValue(protoValue)
+			if err != nil {
+				value = protoValue.AsInterface()
+			}
+			if kinds[field] == nil {
+				kinds[field] = make(map[string]bool)
+			}
+			kinds[field][kindOf(value)] = true
+			counts[field]++
+		}
+	}
+
+	described := make(map[string]fieldDescription, len(kinds))
+	for field, fieldKinds := range kinds {
+		names := make([]string, 0, len(fieldKinds))
+		for kind := range fieldKinds {
+			names = append(names, kind)
+		}
+		sort.Strings(names)
+		described[field] = fieldDescription{kinds: strings.Join(names, ","), records: counts[field]}
+	}
+	return described
+}
+
+// kindOf names the kind of a record value.
+func kindOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case int, int32, int64, float32, float64:
+		return "number"
+	case string:
+		return "string"
+	case []byte:
+		return "bytes"
+	case time.Time:
+		return "timestamp"
+	default:
+		return "other"
+	}
+}
+
+// newVirtualTable returns a read-only table holding the records in memory only, for the catalog.
+func newVirtualTable(primaryKey string, records []Record) (*Table, error) {
+	table := &Table{
+		PrimaryKey: primaryKey,
+		Records:    make(map[string]*dbdata.Record),
+		Indexes:    make(map[string][]*dbdata.Record),
+		Cache:      NewRecordCache(0),
+		metrics:    NewMetrics(),
+		virtual:    true,
+	}
+	stored := &dbdata.Records{Records: table.Records}
+	for _, record := range records {
+		if _, _, err := table.applyInsert(stored, record); err != nil {
+			return nil, err
+		}
+	}
+	table.publish(table.Records)
+	return table, nil
+}
@@ -0,0 +1,67 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+	"google.golang.org/protobuf/proto"
+)
+
+// CorruptRecordsError reports the records of a table file whose content no longer matches their checksum,
+// for example after a partial write or bit rot.
+type CorruptRecordsError struct {
+	FilePath string   // FilePath is the table file holding the records.
+	Keys     []string // Keys are the primary keys of the corrupted records, sorted.
+}
+
+func (e *CorruptRecordsError) Error() string {
+	return fmt.Sprintf("%d corrupted records in %s: %s", len(e.Keys), e.FilePath, strings.Join(e.Keys, ", "))
+}
+
+// recordChecksum returns the SHA-256 hash of the deterministic protobuf encoding of the record fields.
+func recordChecksum(record *dbdata.Record) []byte {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(&dbdata.Record{Fields: record.Fields})
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// sealRecord stores the checksum of the record's current fields in the record. It must be called
+// whenever the fields of a record are changed.
+func sealRecord(record *dbdata.Record) {
+	record.Checksum = recordChecksum(record)
+}
+
+// corruptedKeys returns the sorted keys of the records that do not match their checksum.
+// Records without a checksum, written before checksums existed, are not checked.
+func corruptedKeys(records map[string]*dbdata.Record) []string {
+	var corrupted []string
+	for key, record := range records {
+		if len(record.Checksum) > 0 && !bytes.Equal(record.Checksum, recordChecksum(record)) {
+			corrupted = append(corrupted, key)
+		}
+	}
+	sort.Strings(corrupted)
+	return corrupted
+}
+
+// CorruptRecords reads the table file and returns the primary keys of the records whose content does not
+// match the checksum stored with them. An empty result means every checksummed record is intact.
+// It returns an error if the file itself cannot be read or decoded.
+func (t *Table) CorruptRecords() ([]string, error) {
+	t.RLock()
+	defer t.RUnlock()
+
+	records, err := t.decodeRecordsFile(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return corruptedKeys(records.Records), nil
+}
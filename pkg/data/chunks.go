@@ -0,0 +1,315 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+	"google.golang.org/protobuf/proto"
+)
+
+// chunkedMagic starts the files of tables written in chunks, see TableOptions.Concurrency. It is followed by
+// chunkedVersion, the number of chunks and each chunk behind its length, all as uvarints. Every chunk holds some of
+// the records, marshaled and encoded on its own like a whole file is, so chunks are encoded and decoded in parallel.
+const chunkedMagic = "dbpC"
+
+// chunkedVersion is the version of the chunked file format written after chunkedMagic.
+const chunkedVersion byte = 1
+
+// MinChunkRecords is the number of records a chunk holds at least, so tables with fewer records than twice as many
+// are written as a single blob whatever their concurrency.
+const MinChunkRecords = 1000
+
+// isChunked reports whether the stored data starts with the chunked file header.
+func isChunked(stored []byte) bool {
+	return bytes.HasPrefix(stored, []byte(chunkedMagic))
+}
+
+// joinChunks returns the encoded chunks behind the chunked file header.
+func joinChunks(chunks [][]byte) []byte {
+	size := len(chunkedMagic) + 1 + binary.MaxVarintLen64
+	for _, chunk := range chunks {
+		size += binary.MaxVarintLen64 + len(chunk)
+	}
+	joined := make([]byte, 0, size)
+	joined = append(joined, chunkedMagic...)
+	joined = append(joined, chunkedVersion)
+	joined = binary.AppendUvarint(joined, uint64(len(chunks)))
+	for _, chunk := range chunks {
+		joined = binary.AppendUvarint(joined, uint64(len(chunk)))
+		joined = append(joined, chunk...)
+	}
+	return joined
+}
+
+// splitChunks returns the encoded chunks of data written by joinChunks.
+func splitChunks(stored []byte) ([][]byte, error) {
+	if len(stored) <= len(chunkedMagic) || stored[len(chunkedMagic)] != chunkedVersion {
+		return nil, fmt.Errorf("unsupported chunked file version")
+	}
+	rest := stored[len(chunkedMagic)+1:]
+	total, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return nil, errors.New("truncated chunked file header")
+	}
+	rest = rest[n:]
+	var chunks [][]byte
+	for uint64(len(chunks)) < total {
+		length, n := binary.Uvarint(rest)
+		if n <= 0 || uint64(len(rest)-n) < length {
+			return nil, fmt.Errorf("truncated chunk %d of %d", len(chunks)+1, total)
+		}
+		chunks = append(chunks, rest[n:n+int(length)])
+		rest = rest[n+int(length):]
+	}
+	return chunks, nil
+}
+
+// storedPlaintext reports whether the stored data was written in plaintext mode, looking at its first chunk if it
+// was written in chunks.
+func storedPlaintext(stored []byte) bool {
+	if !isChunked(stored) {
+		return isPlaintext(stored)
+	}
+	// The header of the first chunk is enough, so a truncated chunk is fine here
+	rest := stored[min(len(stored), len(chunkedMagic)+1):]
+	if _, n := binary.Uvarint(rest); n > 0 {
+		if _, m := binary.Uvarint(rest[n:]); m > 0 {
+			return isPlaintext(rest[n+m:])
+		}
+	}
+	return false
+}
+
+// transformStored applies transform to the stored data of a table file, or to each of its chunks if it was written in
+// chunks, and returns the data to store instead. It is used to change how a file is encoded without decoding its records.
+func transformStored(stored []byte, transform func(data []byte) ([]byte, error)) ([]byte, error) {
+	if !isChunked(stored) {
+		return transform(stored)
+	}
+	chunks, err := splitChunks(stored)
+	if err != nil {
+		return nil, err
+	}
+	transformed := make([][]byte, len(chunks))
+	for i, chunk := range chunks {
+		if transformed[i], err = transform(chunk); err != nil {
+			return nil, fmt.Errorf("chunk %d: %w", i+1, err)
+		}
+	}
+	return joinChunks(transformed), nil
+}
+
+// validateConcurrency checks the concurrency of a table.
+func validateConcurrency(concurrency int) error {
+	if concurrency < 0 {
+		return fmt.Errorf("invalid concurrency %d, expected a positive number", concurrency)
+	}
+	return nil
+}
+
+// concurrency returns the number of goroutines that encode and decode the file of the table, at least 1.
+func (t *Table) concurrency() int {
+	return max(t.Options.Concurrency, 1)
+}
+
+// SetConcurrency is a method of the Table struct that sets the number of goroutines that marshal and encode the file
+// of the table in chunks, and decode it, which is stored in its metadata. The file is rewritten in the new layout
+// right away, which also flushes the writes write-behind left pending; files in either layout are read whatever the
+// concurrency.
+//
+// Parameters:
+// - concurrency: The number of goroutines, or 0 or 1 to write the file as a single blob.
+//
+// Returns:
+// - An error, if the concurrency is negative, or the metadata or the file cannot be written. If the operation is
+// successful, the error is nil.
+func (t *Table) SetConcurrency(concurrency int) error {
+	if err := validateConcurrency(concurrency); err != nil {
+		return err
+	}
+	unlock, err := t.lockWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := t.saveOptions(func(options *TableOptions) {
+		options.Concurrency = concurrency
+	}); err != nil {
+		return err
+	}
+	if t.virtual || t.temporary {
+		return nil
+	}
+	return t.rewriteFile()
+}
+
+// encodeRecords marshals the records and encodes them with the pipeline of the table into the content of its file.
+// Tables with a concurrency above 1 and enough records are split into that many chunks, marshaled and encoded by as
+// many goroutines.
+func (t *Table) encodeRecords(ctx context.Context, records *dbdata.Records) ([]byte, error) {
+	count := min(t.concurrency(), len(records.Records)/MinChunkRecords)
+	if count <= 1 {
+		return t.encodeChunk(ctx, records)
+	}
+
+	parts := make([]*dbdata.Records, count)
+	for i := range parts {
+		parts[i] = &dbdata.Records{Records: make(map[string]*dbdata.Record, len(records.Records)/count+1), FormatVersion: records.FormatVersion}
+	}
+	i := 0
+	for key, record := range records.Records {
+		parts[i%count].Records[key] = record
+		i++
+	}
+	chunks := make([][]byte, count)
+	err := runParallel(ctx, count, count, func(i int) error {
+		var err error
+		chunks[i], err = t.encodeChunk(ctx, parts[i])
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return joinChunks(chunks), nil
+}
+
+// encodeChunk marshals the records, compresses them and encodes them with the pipeline of the table, tracing each step.
+func (t *Table) encodeChunk(ctx context.Context, records *dbdata.Records) ([]byte, error) {
+	_, marshalSpan := StartSpan(ctx, "proto.marshal")
+	marshalSpan.SetAttribute("dbproto.records", strconv.Itoa(len(records.Records)))
+	data, err := proto.Marshal(records)
+	marshalSpan.SetError(err)
+	marshalSpan.End()
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling records: %v", err)
+	}
+	if data, err = t.compress(ctx, data); err != nil {
+		return nil, err
+	}
+	encoded, err := t.encodeStorageCtx(ctx, data)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding data: %v", err)
+	}
+	return encoded, nil
+}
+
+// decodeRecords decodes the content of the file of the table and unmarshals its records. The chunks of a file
+// written in chunks are decoded by as many goroutines as the concurrency of the table. It returns ctx.Err() if ctx
+// is done before the records are decoded.
+func (t *Table) decodeRecords(ctx context.Context, stored []byte) (*dbdata.Records, error) {
+	if !isChunked(stored) {
+		return t.decodeChunk(ctx, stored)
+	}
+	chunks, err := splitChunks(stored)
+	if err != nil {
+		return nil, fmt.Errorf("decoding failed: %v", err)
+	}
+	parts := make([]*dbdata.Records, len(chunks))
+	err = runParallel(ctx, len(chunks), t.concurrency(), func(i int) error {
+		var err error
+		if parts[i], err = t.decodeChunk(ctx, chunks[i]); err != nil {
+			return fmt.Errorf("chunk %d: %w", i+1, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	size := 0
+	for _, part := range parts {
+		size += len(part.Records)
+	}
+	records := &dbdata.Records{Records: make(map[string]*dbdata.Record, size), FormatVersion: RecordsFormatVersion}
+	for _, part := range parts {
+		records.FormatVersion = min(records.FormatVersion, part.FormatVersion)
+		for key, record := range part.Records {
+			records.Records[key] = record
+		}
+	}
+	return records, nil
+}
+
+// decodeChunk decodes data with the pipeline of the table, decompresses it and unmarshals the records it holds,
+// tracing each step.
+func (t *Table) decodeChunk(ctx context.Context, data []byte) (*dbdata.Records, error) {
+	decoded, err := t.decodeStorageCtx(ctx, data)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("decoding failed: %v", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if decoded, err = decompress(ctx, decoded); err != nil {
+		return nil, fmt.Errorf("decoding failed: %v", err)
+	}
+
+	var records dbdata.Records
+	_, unmarshalSpan := StartSpan(ctx, "proto.unmarshal")
+	err = proto.Unmarshal(decoded, &records)
+	unmarshalSpan.SetError(err)
+	unmarshalSpan.End()
+	if err != nil {
+		return nil, fmt.Errorf("proto unmarshal failed: %v", err)
+	}
+	return &records, nil
+}
+
+// runParallel calls work for every index below count from at most workers goroutines, and returns the first error.
+// No more work is started once one fails or ctx is done.
+func runParallel(ctx context.Context, count, workers int, work func(i int) error) error {
+	if workers <= 1 {
+		for i := 0; i < count; i++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := work(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var firstErr error
+	failed := func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return firstErr != nil
+	}
+	next := make(chan int)
+	for w := 0; w < min(workers, count); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if err := work(i); err != nil {
+					lock.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for i := 0; i < count && ctx.Err() == nil && !failed(); i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,249 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// LogEntry is a single committed mutation in the commit log.
+// Entries are hash chained: Hash covers the entry contents and PrevHash, so removing, reordering
+// or editing an entry in the shipped log breaks the chain and is detected by VerifyCommitLog.
+type LogEntry struct {
+	Sequence  uint64    `json:"seq"`                  // Sequence is the position of the entry in the log.
+	Time      time.Time `json:"time"`                 // Time is when the mutation was committed.
+	Tenant    string    `json:"tenant,omitempty"`     // Tenant is the tenant of the database, empty for the root server.
+	Database  string    `json:"database"`             // Database is the name of the database of the table.
+	Table     string    `json:"table"`                // Table is the name of the mutated table.
+	Operation string    `json:"op"`                   // Operation is "insert", "update" or "delete".
+	Key       string    `json:"key"`                  // Key is the primary key of the mutated record.
+	Record    Record    `json:"record,omitempty"`     // Record is the record after the mutation, empty for deletes.
+	RequestID string    `json:"request_id,omitempty"` // RequestID is the ID of the HTTP request that made the mutation, if any.
+	PrevHash  string    `json:"prev_hash"`            // PrevHash is the hash of the previous entry.
+	Hash      string    `json:"hash"`                 // Hash is the hash of this entry.
+}
+
+// LogSink is an append-only destination the commit log is shipped to.
+type LogSink interface {
+	Write(entry *LogEntry) error // Write appends an entry to the destination.
+	Close() error                // Close flushes and releases the destination.
+}
+
+// CommitLog assigns sequence numbers and hashes to committed mutations and ships them to every sink.
+type CommitLog struct {
+	sync.Mutex
+	sinks    []LogSink
+	sequence uint64
+	lastHash string
+}
+
+// LogTail is implemented by the sinks that can read back the last entry written to them, such as RotatingFileSink,
+// so that a commit log created on them after a restart continues their chain, see NewCommitLog.
+type LogTail interface {
+	LastEntry() (*LogEntry, error) // LastEntry returns the last entry written to the sink, or nil if it has none.
+}
+
+// NewCommitLog creates a commit log that ships entries to the given sinks. It continues the chain of the newest entry
+// the sinks that are a LogTail hold, numbering the next entry after it and chaining it to its hash, so the log of a
+// restarted server verifies as one chain. It fails if a sink cannot read its last entry back, or holds an entry that
+// has been modified.
+func NewCommitLog(sinks ...LogSink) (*CommitLog, error) {
+	c := &CommitLog{sinks: sinks}
+	for _, sink := range sinks {
+		tail, ok := sink.(LogTail)
+		if !ok {
+			continue
+		}
+		last, err := tail.LastEntry()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the last commit log entry: %v", err)
+		}
+		if last != nil && last.Sequence > c.sequence {
+			c.sequence, c.lastHash = last.Sequence, last.Hash
+		}
+	}
+	return c, nil
+}
+
+// Append adds an entry for a committed mutation and writes it to all sinks.
+// Every sink is attempted even if one fails; the first error is returned.
+func (c *CommitLog) Append(database, table, operation, key string, record Record) error {
+	return c.AppendRequest(database, table, operation, key, record, "")
+}
+
+// AppendRequest adds an entry like Append, for a mutation made by the request with the given ID.
+func (c *CommitLog) AppendRequest(database, table, operation, key string, record Record, requestID string) error {
+	return c.append(&LogEntry{Database: database, Table: table, Operation: operation, Key: key, Record: record, RequestID: requestID})
+}
+
+// append numbers, timestamps and chains the entry, and writes it to all sinks, see Append.
+func (c *CommitLog) append(entry *LogEntry) error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.sequence++
+	entry.Sequence = c.sequence
+	entry.Time = time.Now().UTC()
+	entry.PrevHash = c.lastHash
+	hash, err := hashLogEntry(entry)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+	c.lastHash = hash
+
+	var firstErr error
+	for _, sink := range c.sinks {
+		if err := sink.Write(entry); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close closes all sinks of the commit log.
+func (c *CommitLog) Close() error {
+	c.Lock()
+	defer c.Unlock()
+
+	var firstErr error
+	for _, sink := range c.sinks {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// hashLogEntry returns the hex encoded SHA-256 of the entry with its Hash field cleared.
+func hashLogEntry(entry *LogEntry) (string, error) {
+	unhashed := *entry
+	unhashed.Hash = ""
+	data, err := json.Marshal(unhashed)
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize log entry: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// VerifyCommitLog reads JSON lines commit log entries from r and checks that the hash chain is intact and that the
+// sequence numbers follow each other. The first entry must follow the entry whose hash is anchor, such as the last
+// entry of the previous file of the log; an empty anchor checks a log from the start of the chain, whose first entry
+// follows none, so a log missing its first entries is detected.
+// It returns the number of verified entries, or an error describing the first broken entry.
+func VerifyCommitLog(r io.Reader, anchor string) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	count := 0
+	prevHash := anchor
+	var prevSequence uint64
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var entry LogEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return count, fmt.Errorf("failed to parse log entry %d: %v", count+1, err)
+		}
+		if entry.PrevHash != prevHash || (count > 0 && entry.Sequence != prevSequence+1) {
+			if count == 0 {
+				return count, fmt.Errorf("log entry %d does not follow the anchor", entry.Sequence)
+			}
+			return count, fmt.Errorf("log entry %d does not follow the previous entry", entry.Sequence)
+		}
+		hash, err := hashLogEntry(&entry)
+		if err != nil {
+			return count, err
+		}
+		if hash != entry.Hash {
+			return count, fmt.Errorf("log entry %d has been modified", entry.Sequence)
+		}
+		prevHash = entry.Hash
+		prevSequence = entry.Sequence
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return count, fmt.Errorf("failed to read commit log: %v", err)
+	}
+	return count, nil
+}
+
+// lastLogEntry returns the last entry of the JSON lines commit log content, checked against its hash, or nil if it
+// has none. A last line without its newline is the rest of a write interrupted by a crash, and is ignored.
+func lastLogEntry(content []byte) (*LogEntry, error) {
+	end := bytes.LastIndexByte(content, '\n')
+	for end >= 0 {
+		start := bytes.LastIndexByte(content[:end], '\n') + 1
+		if line := strings.TrimSpace(string(content[start:end])); line != "" {
+			return parseLogEntry(line)
+		}
+		end = start - 1
+	}
+	return nil, nil
+}
+
+// SetCommitLog makes the table append every committed mutation to the given commit log.
+// Passing nil disables logging.
+func (t *Table) SetCommitLog(commitLog *CommitLog) {
+	t.Lock()
+	defer t.Unlock()
+	t.commitLog = commitLog
+}
+
+// logCommit reports a committed mutation of the table whose before-image is in the version replaced by the last
+// write, as for writes that change each key at most once.
+func (t *Table) logCommit(operation, key string, record *dbdata.Record) {
+	var before *dbdata.Record
+	if t.previous != nil {
+		before = t.previous.records[key]
+	}
+	t.logChange(operation, key, before, record)
+}
+
+// logChange appends a committed mutation of the table to its commit log, if any, sends it to the watchers of the
+// table and runs its After hooks. The mutation is already stored at this point, in the file of the table or in its
+// write-behind log unless the table is held in memory, so failures to ship it are logged rather than returned.
+// The caller must hold the table write lock.
+func (t *Table) logChange(operation, key string, before, record *dbdata.Record) {
+	t.notifyWatchers(operation, key, before, record)
+	t.runAfterHooks(operation, key, before, record)
+	t.reportMutation(operation, key, before, record)
+	if t.commitLog == nil {
+		return
+	}
+	var after Record
+	if record != nil {
+		var err error
+		if after, err = fromProtoRecord(record); err != nil {
+			log.Printf("Failed to convert record %s for the commit log%s: %v", key, t.requestSuffix(), err)
+			return
+		}
+	}
+	dbName, tableName := t.tableNames()
+	entry := &LogEntry{Tenant: t.tenant, Database: dbName, Table: tableName, Operation: operation, Key: key, Record: after, RequestID: t.requestID}
+	if err := t.commitLog.append(entry); err != nil {
+		log.Printf("Failed to ship commit log entry for %s.%s%s: %v", dbName, tableName, t.requestSuffix(), err)
+	}
+}
+
+// requestSuffix returns " (request <id>)" for a write made by a request with an ID, to be appended to its log
+// messages, and an empty string otherwise. The caller must hold the table write lock.
+func (t *Table) requestSuffix() string {
+	if t.requestID == "" {
+		return ""
+	}
+	return " (request " + t.requestID + ")"
+}
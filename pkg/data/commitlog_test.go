@@ -0,0 +1,57 @@
+package data_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+)
+
+// TestCommitLogChainSurvivesRestart checks that a commit log created on the files of a previous one continues its
+// chain, so the files verify as one log, and that the verifier rejects a log missing its first entry.
+func TestCommitLogChainSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	for run := 0; run < 2; run++ {
+		sink, err := data.NewRotatingFileSink(dir, 0)
+		if err != nil {
+			t.Fatalf("Failed to create sink: %v", err)
+		}
+		commitLog, err := data.NewCommitLog(sink)
+		if err != nil {
+			t.Fatalf("Failed to create commit log: %v", err)
+		}
+		for i := 0; i < 3; i++ {
+			if err := commitLog.Append("shop", "users", "insert", "u1", data.Record{"run": run}); err != nil {
+				t.Fatalf("Failed to append entry: %v", err)
+			}
+		}
+		if err := commitLog.Close(); err != nil {
+			t.Fatalf("Failed to close commit log: %v", err)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "commitlog-*.log"))
+	if err != nil || len(files) != 2 {
+		t.Fatalf("Expected 2 commit log files, found %v (%v)", files, err)
+	}
+	sort.Strings(files)
+	var log bytes.Buffer
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Failed to read commit log file: %v", err)
+		}
+		log.Write(content)
+	}
+	if count, err := data.VerifyCommitLog(bytes.NewReader(log.Bytes()), ""); err != nil || count != 6 {
+		t.Errorf("VerifyCommitLog returned %d, %v, expected 6 verified entries", count, err)
+	}
+
+	lines := bytes.SplitAfterN(log.Bytes(), []byte("\n"), 2)
+	if _, err := data.VerifyCommitLog(bytes.NewReader(lines[1]), ""); err == nil {
+		t.Error("VerifyCommitLog accepted a log missing its first entry")
+	}
+}
@@ -0,0 +1,243 @@
+package data
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// Comparison operators accepted in query conditions.
+const (
+	OpEqual          = "="
+	OpNotEqual       = "!="
+	OpGreater        = ">"
+	OpGreaterOrEqual = ">="
+	OpLess           = "<"
+	OpLessOrEqual    = "<="
+	OpIsNull         = "IS NULL"
+	OpIsNotNull      = "IS NOT NULL"
+	OpIsMissing      = "IS MISSING"
+)
+
+// Condition compares a field of every record with a value. Records without the field only match IS MISSING.
+// A NULL field only matches IS NULL, = nil and != with a non-nil value; it has no order, so <, <=, > and >= never
+// match it. IS NULL, IS NOT NULL and IS MISSING ignore Value.
+type Condition struct {
+	Field    string      // Field is the name of the compared field.
+	Operator string      // Operator is one of =, !=, >, >=, <, <=, IS NULL, IS NOT NULL and IS MISSING.
+	Value    interface{} // Value is the value the field is compared with.
+}
+
+// validateConditions checks that every condition uses a known operator and a value that can be stored in a record.
+func validateConditions(conditions []Condition) error {
+	for _, condition := range conditions {
+		switch condition.Operator {
+		case OpEqual, OpNotEqual, OpGreater, OpGreaterOrEqual, OpLess, OpLessOrEqual, OpIsNull, OpIsNotNull, OpIsMissing:
+		default:
+			return fmt.Errorf("unknown operator '%s' for field %s", condition.Operator, condition.Field)
+		}
+		if _, err := toProtoValue(condition.Value); err != nil {
+			return fmt.Errorf("error converting condition value for field %s: %v", condition.Field, err)
+		}
+	}
+	return nil
+}
+
+// matchConditions reports whether the record satisfies every condition.
+func matchConditions(record *dbdata.Record, conditions []Condition) bool {
+	for _, condition := range conditions {
+		protoValue, exists := fieldValue(record, condition.Field)
+		if condition.Operator == OpIsMissing {
+			if exists {
+				return false
+			}
+			continue
+		}
+		if !exists {
+			return false
+		}
+
+		isNull := isNullValue(protoValue)
+		switch condition.Operator {
+		case OpIsNull:
+			if !isNull {
+				return false
+			}
+			continue
+		case OpIsNotNull:
+			if isNull {
+				return false
+			}
+			continue
+		}
+
+		conditionValue := normalizeValue(condition.Value)
+		if isNull || conditionValue == nil {
+			// NULL is only equal to NULL and has no order
+			bothNull := isNull && conditionValue == nil
+			if (condition.Operator != OpEqual || !bothNull) && (condition.Operator != OpNotEqual || bothNull) {
+				return false
+			}
+			continue
+		}
+
+		value, err := fromProtoValue(protoValue)
+		if err != nil {
+			return false
+		}
+		cmp, comparable := compareValues(value, conditionValue)
+		switch condition.Operator {
+		case OpEqual:
+			if !comparable || cmp != 0 {
+				return false
+			}
+		case OpNotEqual:
+			if comparable && cmp == 0 {
+				return false
+			}
+		case OpGreater:
+			if !comparable || cmp <= 0 {
+				return false
+			}
+		case OpGreaterOrEqual:
+			if !comparable || cmp < 0 {
+				return false
+			}
+		case OpLess:
+			if !comparable || cmp >= 0 {
+				return false
+			}
+		case OpLessOrEqual:
+			if !comparable || cmp > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// normalizeValue converts a Go value to the form fromProtoValue returns for it once stored,
+// so that int 30 and a stored 30 compare equal.
+func normalizeValue(value interface{}) interface{} {
+	protoValue, err := toProtoValue(value)
+	if err != nil {
+		return value
+	}
+	normalized, err := fromProtoValue(protoValue)
+	if err != nil {
+		return value
+	}
+	return normalized
+}
+
+// compareProtoValues orders two stored field values, see compareValues. A nil value is a missing field.
+func compareProtoValues(a, b *dbdata.Value) (int, bool) {
+	var goA, goB interface{}
+	if a != nil {
+		goA, _ = fromProtoValue(a)
+	}
+	if b != nil {
+		goB, _ = fromProtoValue(b)
+	}
+	return compareValues(goA, goB)
+}
+
+// compareValues returns -1, 0 or 1 as a is less than, equal to or greater than b.
+// Numbers compare numerically whether they are ints or floats, timestamps chronologically whatever their UTC offset,
+// strings lexically and false sorts before true. A string compared with a timestamp is read as an RFC 3339 timestamp
+// if it is one. Values of different kinds are not comparable: comparable is false and the result orders them by kind
+// (missing or NULL, bool, number, timestamp, string, anything else) so that sorting stays deterministic.
+func compareValues(a, b interface{}) (result int, comparable bool) {
+	a, b = timeOperands(a, b)
+	rankA, rankB := valueRank(a), valueRank(b)
+	if rankA != rankB {
+		if rankA < rankB {
+			return -1, false
+		}
+		return 1, false
+	}
+
+	switch x := a.(type) {
+	case bool:
+		y := b.(bool)
+		switch {
+		case x == y:
+			return 0, true
+		case !x:
+			return -1, true
+		default:
+			return 1, true
+		}
+	case string:
+		return strings.Compare(x, b.(string)), true
+	case int64:
+		if y, ok := b.(int64); ok {
+			return compareOrdered(x, y), true
+		}
+		return compareOrdered(float64(x), b.(float64)), true
+	case float64:
+		if y, ok := b.(int64); ok {
+			return compareOrdered(x, float64(y)), true
+		}
+		return compareOrdered(x, b.(float64)), true
+	case time.Time:
+		return x.Compare(b.(time.Time)), true
+	case nil:
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// timeOperands returns a and b with a string compared with a time.Time parsed as an RFC 3339 timestamp, so that
+// timestamps given as strings, such as SQL literals or values stored before the timestamp type existed, compare as
+// times. Strings that are not timestamps are returned as they are.
+func timeOperands(a, b interface{}) (interface{}, interface{}) {
+	parse := func(value interface{}) interface{} {
+		if s, ok := value.(string); ok {
+			if parsed, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				return parsed
+			}
+		}
+		return value
+	}
+	if _, ok := a.(time.Time); ok {
+		return a, parse(b)
+	}
+	if _, ok := b.(time.Time); ok {
+		return parse(a), b
+	}
+	return a, b
+}
+
+// valueRank returns the position of the kind of a value in the ordering used by compareValues.
+func valueRank(value interface{}) int {
+	switch value.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case int64, float64:
+		return 2
+	case time.Time:
+		return 3
+	case string:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// compareOrdered returns -1, 0 or 1 as a is less than, equal to or greater than b.
+func compareOrdered[T int64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,181 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// The compression algorithms of table files.
+const (
+	CompressionNone = ""     // CompressionNone stores the marshaled records as they are.
+	CompressionGzip = "gzip" // CompressionGzip compresses the marshaled records with gzip.
+	CompressionZstd = "zstd" // CompressionZstd compresses the marshaled records with zstd, once a Compressor is registered for it.
+)
+
+// compressedMagic starts the marshaled records of tables with compression, before they go through the storage
+// pipeline. It is followed by compressedVersion, the length and name of the Compressor and the compressed data, so a
+// file is decompressed the right way whatever the compression of its table is now.
+const compressedMagic = "dbpZ"
+
+// compressedVersion is the version of the compressed data format written after compressedMagic.
+const compressedVersion byte = 1
+
+// Compressor compresses the marshaled records of a table before they are encoded with its storage pipeline.
+type Compressor interface {
+	Compress(data []byte) ([]byte, error)   // Compress compresses the marshaled records.
+	Decompress(data []byte) ([]byte, error) // Decompress reverses Compress.
+}
+
+var (
+	compressorsLock sync.RWMutex
+	compressors     = map[string]Compressor{
+		CompressionGzip: gzipCompressor{},
+	}
+)
+
+// RegisterCompressor makes a compression algorithm available to tables under the given name, replacing any
+// algorithm with the same name. dbproto has no zstd implementation of its own, so tables use CompressionZstd once
+// one is registered under that name, for example a wrapper of github.com/klauspost/compress/zstd.
+func RegisterCompressor(name string, compressor Compressor) {
+	compressorsLock.Lock()
+	defer compressorsLock.Unlock()
+	compressors[name] = compressor
+}
+
+// Compressors returns the sorted names of the compression algorithms tables can use.
+func Compressors() []string {
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+	names := make([]string, 0, len(compressors))
+	for name := range compressors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compressor returns the compression algorithm registered under name.
+func compressor(name string) (Compressor, error) {
+	compressorsLock.RLock()
+	defer compressorsLock.RUnlock()
+	compressor, exists := compressors[name]
+	if !exists {
+		if name == CompressionZstd {
+			return nil, fmt.Errorf("zstd compression is not available, register a zstd Compressor with data.RegisterCompressor first")
+		}
+		return nil, fmt.Errorf("unknown compression %q", name)
+	}
+	return compressor, nil
+}
+
+// validateCompression checks that the compression of a table is available.
+func validateCompression(name string) error {
+	if name == CompressionNone {
+		return nil
+	}
+	if len(name) > 255 {
+		return fmt.Errorf("invalid compression name of %d bytes", len(name))
+	}
+	_, err := compressor(name)
+	return err
+}
+
+// compress compresses the marshaled records with the compression of the table, behind the compressed data header,
+// or returns them as they are for tables without compression.
+func (t *Table) compress(ctx context.Context, data []byte) ([]byte, error) {
+	name := t.Options.Compression
+	if name == CompressionNone {
+		return data, nil
+	}
+	compressor, err := compressor(name)
+	if err != nil {
+		return nil, err
+	}
+	_, span := StartSpan(ctx, "storage.compress")
+	span.SetAttribute("dbproto.compression", name)
+	compressed, err := compressor.Compress(data)
+	span.SetAttribute("dbproto.compressed.bytes", strconv.Itoa(len(compressed)))
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		return nil, fmt.Errorf("%s compression failed: %v", name, err)
+	}
+
+	header := make([]byte, 0, len(compressedMagic)+2+len(name)+len(compressed))
+	header = append(header, compressedMagic...)
+	header = append(header, compressedVersion, byte(len(name)))
+	header = append(header, name...)
+	return append(header, compressed...), nil
+}
+
+// decompress returns the marshaled records of data written by compress, with the compression named in its header.
+// Data without the header was written without compression and is returned as it is; marshaled records cannot start
+// with it.
+func decompress(ctx context.Context, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(compressedMagic)) {
+		return data, nil
+	}
+	rest := data[len(compressedMagic):]
+	if len(rest) < 2 || rest[0] != compressedVersion {
+		return nil, errors.New("unsupported compressed data version")
+	}
+	length := int(rest[1])
+	if len(rest) < 2+length {
+		return nil, errors.New("truncated compressed data header")
+	}
+	name := string(rest[2 : 2+length])
+	compressor, err := compressor(name)
+	if err != nil {
+		return nil, err
+	}
+	_, span := StartSpan(ctx, "storage.decompress")
+	span.SetAttribute("dbproto.compression", name)
+	decompressed, err := compressor.Decompress(rest[2+length:])
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		return nil, fmt.Errorf("%s decompression failed: %v", name, err)
+	}
+	return decompressed, nil
+}
+
+// SetCompression is a method of the Table struct that sets the compression of the file of the table, which is stored
+// in its metadata. The file is rewritten with the new compression right away, which also flushes the writes
+// write-behind left pending; files are decompressed with the compression recorded in them, whatever the setting.
+//
+// Parameters:
+// - name: CompressionGzip, CompressionZstd, the name of a registered Compressor, or CompressionNone.
+//
+// Returns:
+// - An error, if the compression is not available, or the metadata or the file cannot be written. If the operation
+// is successful, the error is nil.
+func (t *Table) SetCompression(name string) error {
+	if err := validateCompression(name); err != nil {
+		return err
+	}
+	unlock, err := t.lockWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := t.saveOptions(func(options *TableOptions) {
+		options.Compression = name
+	}); err != nil {
+		return err
+	}
+	if t.virtual || t.temporary {
+		return nil
+	}
+	return t.rewriteFile()
+}
+
+// gzipCompressor compresses with gzip at the default level, like the gzip storage stage.
+type gzipCompressor struct{}
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error)   { return gzipStage{}.Encode(data) }
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) { return gzipStage{}.Decode(data) }
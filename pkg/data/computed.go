@@ -0,0 +1,476 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+	"google.golang.org/protobuf/proto"
+)
+
+// ComputedField declares a field whose value is computed from the other fields of its record by an expression.
+//
+// Expressions combine fields, named like in the query language, including nested paths such as address.city, with
+// literals, such as 'text', 42, TRUE or NULL, and the operators + - * / % and parentheses. + concatenates when either
+// side is a string and adds numbers otherwise; the other operators take numbers. A field the record does not have is
+// NULL, and so is any operation on NULL:
+//
+//	{Name: "full_name", Expression: "first + ' ' + last"}
+//	{Name: "total", Expression: "price * quantity", OnRead: true}
+type ComputedField struct {
+	Name       string `json:"Name"`             // Name is the field the value is computed into.
+	Expression string `json:"Expression"`       // Expression computes the value from the fields of the record.
+	OnRead     bool   `json:"OnRead,omitempty"` // OnRead computes the value whenever the record is read instead of storing it on every write.
+}
+
+// computedField is a computed field ready to be evaluated, declared with an expression or registered with a callback.
+type computedField struct {
+	name    string
+	onRead  bool
+	compute func(record Record) (interface{}, error)
+}
+
+// validateComputedFields checks the computed fields in the options of a table with the given primary key.
+func validateComputedFields(primaryKey string, options TableOptions) error {
+	if len(options.ComputedFields) > 0 && options.ClientEncrypted {
+		return fmt.Errorf("client encrypted tables cannot have computed fields")
+	}
+	names := make(map[string]bool, len(options.ComputedFields))
+	for _, field := range options.ComputedFields {
+		if field.Name == "" || field.Name == primaryKey {
+			return fmt.Errorf("invalid computed field name '%s'", field.Name)
+		}
+		if names[field.Name] {
+			return fmt.Errorf("field '%s' is computed twice", field.Name)
+		}
+		names[field.Name] = true
+		if _, err := compileExpression(field.Expression); err != nil {
+			return fmt.Errorf("computed field '%s': %v", field.Name, err)
+		}
+	}
+	return nil
+}
+
+// compileComputedFields prepares the computed fields declared in the options of the table and the callbacks
+// registered with ComputeField, in that order, for the reads and writes of the table.
+func (t *Table) compileComputedFields(callbacks []*computedField) error {
+	fields := make([]*computedField, 0, len(t.Options.ComputedFields)+len(callbacks))
+	for _, field := range t.Options.ComputedFields {
+		compute, err := compileExpression(field.Expression)
+		if err != nil {
+			return fmt.Errorf("computed field '%s': %v", field.Name, err)
+		}
+		fields = append(fields, &computedField{name: field.Name, onRead: field.OnRead, compute: compute})
+	}
+	for _, callback := range callbacks {
+		for _, field := range fields {
+			if field.name == callback.name {
+				return fmt.Errorf("field '%s' is already computed", callback.name)
+			}
+		}
+		fields = append(fields, callback)
+	}
+	t.computed.Store(&fields)
+	return nil
+}
+
+// callbacks returns the computed fields of the table registered with ComputeField.
+func (t *Table) callbacks() []*computedField {
+	fields := t.computed.Load()
+	if fields == nil {
+		return nil
+	}
+	return (*fields)[len(t.Options.ComputedFields):]
+}
+
+// ComputeField is a method of the Table struct that registers a field computed by a Go callback, for values an
+// expression cannot compute. Unlike the ComputedFields of the table options, callbacks are not saved with the table,
+// so they must be registered again whenever the table is opened.
+//
+// A field computed on write is stored with every record inserted or updated afterwards; records written before keep
+// their stored value until their next write. A field computed on read is computed from the stored record every
+// time it is returned. The callback gets a copy of the record, with the fields computed before it, and must not use
+// the table.
+//
+// Parameters:
+// - name: The name of the field, which must not be the primary key or another computed field.
+// - onRead: Whether the value is computed on every read instead of stored on every write.
+// - compute: The callback computing the value of the field from the record.
+//
+// Returns:
+// - An error, if the name is invalid or already computed. If the operation is successful, the error is nil.
+func (t *Table) ComputeField(name string, onRead bool, compute func(record Record) (interface{}, error)) error {
+	if name == "" || name == t.PrimaryKey || compute == nil {
+		return fmt.Errorf("invalid computed field name '%s'", name)
+	}
+	unlock, err := t.lockWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if t.Options.ClientEncrypted {
+		return fmt.Errorf("client encrypted tables cannot have computed fields")
+	}
+	callbacks := append(append([]*computedField(nil), t.callbacks()...), &computedField{name: name, onRead: onRead, compute: compute})
+	return t.compileComputedFields(callbacks)
+}
+
+// SetComputedFields is a method of the Table struct that replaces the computed fields declared in the options of the
+// table and saves them in its metadata. The fields computed on write are computed again for every record, in a
+// single write under the table write lock like RenameField; fields no longer computed keep their stored values.
+//
+// Parameters:
+// - fields: The computed fields, evaluated in order, so an expression may use the fields computed before it.
+//
+// Returns:
+// - An error, if a field is invalid, a value cannot be computed or the table cannot be written. The table is left
+// unchanged on error. If the operation is successful, the error is nil.
+func (t *Table) SetComputedFields(fields []ComputedField) error {
+	defer t.sample("set_computed_fields", "", time.Now())
+	unlock, err := t.lockWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	options := t.Options
+	options.ComputedFields = fields
+	if err := validateComputedFields(t.PrimaryKey, options); err != nil {
+		return err
+	}
+	allRecords, err := t.recordsForWrite(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to load records: %w", err)
+	}
+
+	previous := t.Options.ComputedFields
+	callbacks := t.callbacks()
+	t.Options.ComputedFields = fields
+	if err := t.compileComputedFields(callbacks); err != nil {
+		t.Options.ComputedFields = previous
+		t.compileComputedFields(callbacks)
+		return err
+	}
+	changed := make(map[string]*dbdata.Record)
+	for key, record := range allRecords.Records {
+		computed := proto.Clone(record).(*dbdata.Record)
+		if err = t.applyComputedFields(computed); err != nil {
+			err = fmt.Errorf("record %s: %v", key, err)
+			break
+		}
+		computed.Checksum = record.Checksum
+		if !proto.Equal(computed, record) {
+			changed[key] = computed
+		}
+	}
+	if err == nil {
+		err = t.rewriteRecords(allRecords, changed, func(options *TableOptions) {
+			options.ComputedFields = fields
+		})
+	}
+	if err != nil {
+		t.Options.ComputedFields = previous
+		t.compileComputedFields(callbacks)
+		return err
+	}
+	return nil
+}
+
+// applyComputedFields stores the values of the fields computed on write in a record being written, replacing the
+// values the writer gave, and removes the fields computed on read, which are never stored. Values of fields declared
+// by the schema are converted to their type. The caller must hold the table write lock.
+func (t *Table) applyComputedFields(record *dbdata.Record) error {
+	fields := t.computed.Load()
+	if fields == nil || len(*fields) == 0 {
+		return nil
+	}
+	values, err := fromProtoRecord(record)
+	if err != nil {
+		return err
+	}
+	for _, field := range *fields {
+		delete(record.Fields, field.name)
+		delete(values, field.name)
+		if field.onRead {
+			continue
+		}
+		value, err := field.compute(copyRecord(values))
+		if err != nil {
+			return fmt.Errorf("failed to compute field '%s': %v", field.name, err)
+		}
+		if fieldType, declared := t.Options.Schema[field.name]; declared {
+			if value, err = toFieldType(fieldType, value); err != nil {
+				return fmt.Errorf("%w: computed field '%s' %v", ErrSchemaViolation, field.name, err)
+			}
+		}
+		stored, err := toProtoValue(value)
+		if err != nil {
+			return fmt.Errorf("invalid value of computed field '%s': %v", field.name, err)
+		}
+		record.Fields[field.name] = stored
+		if values[field.name], err = fromProtoValue(stored); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withReadFields returns the record with the values of the fields computed on read, or the record itself if the
+// table has none. A value that cannot be computed is NULL. The given record is not modified.
+func (t *Table) withReadFields(record *dbdata.Record) *dbdata.Record {
+	fields := t.computed.Load()
+	if fields == nil {
+		return record
+	}
+	var values Record
+	var computed *dbdata.Record
+	for _, field := range *fields {
+		if !field.onRead {
+			continue
+		}
+		if computed == nil {
+			var err error
+			if values, err = fromProtoRecord(record); err != nil {
+				return record
+			}
+			computed = &dbdata.Record{Fields: make(map[string]*dbdata.Value, len(record.Fields)+1), Checksum: record.Checksum}
+			for name, value := range record.Fields {
+				computed.Fields[name] = value
+			}
+		}
+		stored := dbdata.NewNullValue()
+		value, err := field.compute(copyRecord(values))
+		if err == nil {
+			stored, err = toProtoValue(value)
+		}
+		if err != nil {
+			log.Printf("Failed to compute field '%s': %v", field.name, err)
+			stored = dbdata.NewNullValue()
+		}
+		computed.Fields[field.name] = stored
+		values[field.name], _ = fromProtoValue(stored)
+	}
+	if computed == nil {
+		return record
+	}
+	return computed
+}
+
+// compileExpression parses the expression of a computed field into a function evaluating it on a record.
+func compileExpression(expression string) (func(record Record) (interface{}, error), error) {
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	compute, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEnd {
+		return nil, p.errorf("unexpected %s", p.describe())
+	}
+	return compute, nil
+}
+
+// parseSum parses terms joined by + and -.
+func (p *parser) parseSum() (func(record Record) (interface{}, error), error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op string
+		switch tok := p.peek(); {
+		case p.symbol("+"):
+			op = "+"
+		case p.symbol("-"):
+			op = "-"
+		case tok.kind == tokenNumber && strings.HasPrefix(tok.text, "-"):
+			// "a -1" is tokenized as a negative number, which here is a subtraction
+			p.tokens[p.pos].text = tok.text[1:]
+			op = "-"
+		default:
+			return left, nil
+		}
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpression(op, left, right)
+	}
+}
+
+// parseProduct parses factors joined by *, / and %.
+func (p *parser) parseProduct() (func(record Record) (interface{}, error), error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op string
+		switch {
+		case p.symbol("*"):
+			op = "*"
+		case p.symbol("/"):
+			op = "/"
+		case p.symbol("%"):
+			op = "%"
+		default:
+			return left, nil
+		}
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpression(op, left, right)
+	}
+}
+
+// parseFactor parses a literal, a field, a negation or an expression in parentheses.
+func (p *parser) parseFactor() (func(record Record) (interface{}, error), error) {
+	if p.symbol("(") {
+		inner, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	}
+	if p.symbol("-") {
+		operand, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return binaryExpression("-", func(Record) (interface{}, error) { return int64(0), nil }, operand), nil
+	}
+	tok := p.peek()
+	if tok.kind == tokenIdent {
+		switch strings.ToUpper(tok.text) {
+		case "TRUE", "FALSE", "NULL", "TIMESTAMP":
+		default:
+			p.pos++
+			return func(record Record) (interface{}, error) {
+				value, _ := recordPath(record, tok.text)
+				return value, nil
+			}, nil
+		}
+	}
+	value, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	return func(Record) (interface{}, error) { return value, nil }, nil
+}
+
+// binaryExpression returns a function applying an operator to the values of two expressions.
+func binaryExpression(op string, left, right func(record Record) (interface{}, error)) func(record Record) (interface{}, error) {
+	return func(record Record) (interface{}, error) {
+		a, err := left(record)
+		if err != nil {
+			return nil, err
+		}
+		b, err := right(record)
+		if err != nil {
+			return nil, err
+		}
+		return applyOperator(op, a, b)
+	}
+}
+
+// applyOperator applies an arithmetic operator, or + on strings, to two values. Integers stay integers unless a
+// division has a remainder.
+func applyOperator(op string, a, b interface{}) (interface{}, error) {
+	if a == nil || b == nil {
+		return nil, nil
+	}
+	_, aString := a.(string)
+	_, bString := b.(string)
+	if op == "+" && (aString || bString) {
+		aText, aOK := textOf(a)
+		bText, bOK := textOf(b)
+		if aOK && bOK {
+			return aText + bText, nil
+		}
+	}
+
+	aInt, aFloat, aIsInt, aOK := numberOf(a)
+	bInt, bFloat, bIsInt, bOK := numberOf(b)
+	if !aOK || !bOK {
+		return nil, fmt.Errorf("cannot apply '%s' to a %s and a %s", op, kindOf(a), kindOf(b))
+	}
+	if (op == "/" || op == "%") && bFloat == 0 {
+		return nil, fmt.Errorf("division by zero")
+	}
+	if aIsInt && bIsInt {
+		switch op {
+		case "+":
+			return aInt + bInt, nil
+		case "-":
+			return aInt - bInt, nil
+		case "*":
+			return aInt * bInt, nil
+		case "%":
+			return aInt % bInt, nil
+		case "/":
+			if aInt%bInt == 0 {
+				return aInt / bInt, nil
+			}
+		}
+	}
+	switch op {
+	case "+":
+		return aFloat + bFloat, nil
+	case "-":
+		return aFloat - bFloat, nil
+	case "*":
+		return aFloat * bFloat, nil
+	case "/":
+		return aFloat / bFloat, nil
+	default:
+		return math.Mod(aFloat, bFloat), nil
+	}
+}
+
+// numberOf returns a number as an integer, if it is one, and as a float, and false for values that are not numbers.
+func numberOf(value interface{}) (int64, float64, bool, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), float64(v), true, true
+	case int32:
+		return int64(v), float64(v), true, true
+	case int64:
+		return v, float64(v), true, true
+	case float32:
+		return 0, float64(v), false, true
+	case float64:
+		return 0, v, false, true
+	}
+	return 0, 0, false, false
+}
+
+// textOf returns the text a value is concatenated as, and false for values that cannot be concatenated.
+func textOf(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case time.Time:
+		return v.Format(time.RFC3339Nano), true
+	}
+	if i, f, isInt, ok := numberOf(value); ok {
+		if isInt {
+			return strconv.FormatInt(i, 10), true
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64), true
+	}
+	return "", false
+}
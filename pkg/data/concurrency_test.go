@@ -0,0 +1,166 @@
+package data_test
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+)
+
+// TestConcurrentReadersAndWriters runs many goroutines doing mixed inserts, updates, deletes, selects, queries, joins
+// and transactions against two tables, then checks that no update was lost and that the tables satisfy
+// Table.CheckInvariants. Run it under the race detector:
+//
+//	go test -race -run TestConcurrentReadersAndWriters ./pkg/data
+func TestConcurrentReadersAndWriters(t *testing.T) {
+	if os.Getenv("AES_KEY") == "" && os.Getenv("AES_KEY_FILE") == "" {
+		t.Setenv("AES_KEY", "0123456789abcdef0123456789abcdef")
+	}
+	workers, ops := 8, 100
+	if testing.Short() {
+		workers, ops = 4, 25
+	}
+
+	dir := t.TempDir()
+	users := data.NewTable("id", filepath.Join(dir, "stress", "users.dat"))
+	orders := data.NewTable("id", filepath.Join(dir, "stress", "orders.dat"))
+	if err := users.Insert(data.Record{"id": "counters"}); err != nil {
+		t.Fatalf("Failed to insert counters record: %v", err)
+	}
+
+	expected := make([]map[string]data.Record, workers)
+	counts := make([]int, workers)
+	errs := make(chan error, workers)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(w) + 1))
+			own := make(map[string]data.Record)
+			counter := fmt.Sprintf("worker_%d", w)
+
+			for i := 0; i < ops; i++ {
+				key := fmt.Sprintf("user-%d-%d", w, rng.Intn(ops/4+1))
+				_, exists := own[key]
+
+				switch op := rng.Intn(10); {
+				case op == 0:
+					// Every worker increments its own field of a shared record; a lost update shows up as a wrong count.
+					counts[w]++
+					if err := users.Update("counters", data.Record{counter: float64(counts[w])}); err != nil {
+						errs <- fmt.Errorf("worker %d: update counters: %v", w, err)
+						return
+					}
+				case op <= 2 && !exists:
+					record := data.Record{"id": key, "name": "name-" + key, "worker": counter}
+					if err := users.InsertWithTransaction(record); err != nil {
+						errs <- fmt.Errorf("worker %d: insert %s: %v", w, key, err)
+						return
+					}
+					own[key] = record
+					if err := orders.Insert(data.Record{"id": "order-" + key, "user": key}); err != nil {
+						errs <- fmt.Errorf("worker %d: insert order %s: %v", w, key, err)
+						return
+					}
+				case op <= 2:
+					// Inserting an existing key fails and rolls back; it must not undo other workers' writes.
+					if err := users.InsertWithTransaction(data.Record{"id": key}); err == nil {
+						errs <- fmt.Errorf("worker %d: duplicate insert of %s succeeded", w, key)
+						return
+					}
+				case op == 3 && exists:
+					name := fmt.Sprintf("renamed-%d", i)
+					if i%2 == 0 {
+						if err := users.UpdateWithTransaction(key, data.Record{"name": name}); err != nil {
+							errs <- fmt.Errorf("worker %d: update %s: %v", w, key, err)
+							return
+						}
+					} else {
+						// The rename and the counter increment are committed together or not at all.
+						tx := users.Begin()
+						tx.Update(key, data.Record{"name": name})
+						tx.Update("counters", data.Record{counter: float64(counts[w] + 1)})
+						if err := tx.Commit(); err != nil {
+							errs <- fmt.Errorf("worker %d: commit update %s: %v", w, key, err)
+							return
+						}
+						counts[w]++
+					}
+					own[key]["name"] = name
+				case op == 4 && exists:
+					if err := users.Delete(key); err != nil {
+						errs <- fmt.Errorf("worker %d: delete %s: %v", w, key, err)
+						return
+					}
+					if err := orders.Delete("order-" + key); err != nil {
+						errs <- fmt.Errorf("worker %d: delete order %s: %v", w, key, err)
+						return
+					}
+					delete(own, key)
+				case op == 5:
+					if _, err := users.Query(data.Query{Filters: map[string]interface{}{"worker": counter}, SortBy: "id", Limit: 5}); err != nil {
+						errs <- fmt.Errorf("worker %d: query: %v", w, err)
+						return
+					}
+				case op == 6:
+					if _, err := data.JoinTables(users, orders, "id", "user", data.LeftJoin); err != nil {
+						errs <- fmt.Errorf("worker %d: join: %v", w, err)
+						return
+					}
+				case op == 7 && exists:
+					if _, err := users.Select(key); err != nil {
+						errs <- fmt.Errorf("worker %d: select %s: %v", w, key, err)
+						return
+					}
+				default:
+					if _, err := users.SelectAll(); err != nil {
+						errs <- fmt.Errorf("worker %d: select all: %v", w, err)
+						return
+					}
+				}
+			}
+			expected[w] = own
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	counters, err := users.Select("counters")
+	if err != nil {
+		t.Fatalf("Failed to select counters record: %v", err)
+	}
+	for w := range counts {
+		got, _ := counters[fmt.Sprintf("worker_%d", w)].(float64)
+		if counts[w] > 0 && int(got) != counts[w] {
+			t.Errorf("Lost update: worker %d incremented its counter %d times but it holds %v", w, counts[w], got)
+		}
+	}
+
+	for w, own := range expected {
+		for key, want := range own {
+			got, err := users.Select(key)
+			if err != nil {
+				t.Errorf("Worker %d: record %s is missing: %v", w, key, err)
+				continue
+			}
+			if got["name"] != want["name"] {
+				t.Errorf("Worker %d: record %s has name %v, want %v", w, key, got["name"], want["name"])
+			}
+		}
+	}
+
+	for name, table := range map[string]*data.Table{"users": users, "orders": orders} {
+		if err := table.CheckInvariants(); err != nil {
+			t.Errorf("Invariant violated on %s: %v", name, err)
+		}
+	}
+}
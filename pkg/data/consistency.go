@@ -0,0 +1,73 @@
+package data
+
+import (
+	"context"
+	"fmt"
+)
+
+// Consistency chooses which writes the reads made with a context observe, see WithConsistency.
+type Consistency int
+
+const (
+	// ConsistencyReadYourWrites serves reads from the records in memory, which hold every write that returned, so a
+	// client reads its own writes even before write-behind flushes them to the file. It is the default.
+	ConsistencyReadYourWrites Consistency = iota
+	// ConsistencyDurable serves reads of a table in write-behind mode from the version of its records last written
+	// to the file, so they never return a write that only its write-behind log holds yet. Tables that write their
+	// file on every write serve the same records with both consistencies.
+	ConsistencyDurable
+)
+
+// consistencyNames are the names of the consistencies, as ParseConsistency reads them.
+var consistencyNames = map[Consistency]string{
+	ConsistencyReadYourWrites: "read-your-writes",
+	ConsistencyDurable:        "durable",
+}
+
+// String returns the name of the consistency, such as "read-your-writes".
+func (c Consistency) String() string {
+	if name, ok := consistencyNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Consistency(%d)", int(c))
+}
+
+// ParseConsistency returns the consistency with the given name, "read-your-writes" or "durable".
+func ParseConsistency(name string) (Consistency, error) {
+	for consistency, consistencyName := range consistencyNames {
+		if name == consistencyName {
+			return consistency, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid consistency %q, expected read-your-writes or durable", name)
+}
+
+// consistencyKey is the context key of the consistency of reads.
+type consistencyKey struct{}
+
+// WithConsistency returns a copy of ctx whose reads observe the writes the consistency chooses: Iterate,
+// IterateQuery, SelectCtx, SelectAllCtx, SelectWithFilterCtx, QueryCtx, QueryWithCursorCtx and JoinTablesCtx. Reads
+// made without it, and the methods without a context, use ConsistencyReadYourWrites.
+func WithConsistency(ctx context.Context, consistency Consistency) context.Context {
+	return context.WithValue(ctx, consistencyKey{}, consistency)
+}
+
+// ConsistencyOf returns the consistency of the reads made with ctx, ConsistencyReadYourWrites if it carries none.
+func ConsistencyOf(ctx context.Context) Consistency {
+	consistency, _ := ctx.Value(consistencyKey{}).(Consistency)
+	return consistency
+}
+
+// readSnapshot returns the version of the table the reads made with ctx are served from, like loadSnapshot: the
+// current version, or for durable reads while write-behind has writes pending, the version last written to the file.
+// The caller must not hold the table lock.
+func (t *Table) readSnapshot(ctx context.Context) (*snapshot, error) {
+	snap, err := t.loadSnapshot()
+	if err != nil || ConsistencyOf(ctx) != ConsistencyDurable {
+		return snap, err
+	}
+	if flushed := t.writeBehind.flushed.Load(); flushed != nil {
+		return flushed, nil
+	}
+	return snap, nil
+}
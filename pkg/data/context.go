@@ -0,0 +1,31 @@
+package data
+
+import "context"
+
+// scanCheckInterval is the number of records scanned between two checks of the context, so that long scans
+// can be cancelled without paying for a check on every record.
+const scanCheckInterval = 1024
+
+// checkScan counts one more scanned record and returns ctx.Err() on every scanCheckInterval-th call once ctx is done.
+func checkScan(ctx context.Context, scanned *int) error {
+	*scanned++
+	if *scanned%scanCheckInterval != 0 {
+		return nil
+	}
+	return ctx.Err()
+}
+
+// requestIDKey is the context key of the request ID.
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the ID of the request it serves. The writes made with the context record
+// the ID in the commit log entries of their changes, and in the logs of their failures to ship them.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, or an empty string if it carries none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
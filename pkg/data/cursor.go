@@ -0,0 +1,66 @@
+package data
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+	"google.golang.org/protobuf/proto"
+)
+
+// cursorPosition is the decoded form of a pagination cursor.
+// It holds the sort value and primary key of the last record returned, so the next page starts right after it
+// no matter how many records were inserted or deleted in between.
+type cursorPosition struct {
+	SortBy       string        `json:"s,omitempty"` // SortBy is the field the cursor was created for.
+	SortValue    *dbdata.Value `json:"-"`           // SortValue is the sort field value of the last record, nil if it has none.
+	EncodedValue []byte        `json:"v,omitempty"` // EncodedValue is the protobuf encoding of SortValue.
+	PrimaryKey   string        `json:"k"`           // PrimaryKey is the primary key value of the last record.
+}
+
+// encodeCursor returns the opaque token for the position of the given record.
+func (t *Table) encodeCursor(record *dbdata.Record, sortBy string) string {
+	position := cursorPosition{
+		SortBy:     sortBy,
+		PrimaryKey: t.recordKey(record),
+	}
+	if value := pathValue(record, sortBy); sortBy != "" && value != nil {
+		position.EncodedValue, _ = proto.Marshal(value)
+	}
+	data, _ := json.Marshal(position)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses a token produced by encodeCursor and checks that it belongs to a query with the same sort field.
+func decodeCursor(cursor, sortBy string) (*cursorPosition, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %v", err)
+	}
+	var position cursorPosition
+	if err := json.Unmarshal(data, &position); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %v", err)
+	}
+	if position.SortBy != sortBy {
+		return nil, fmt.Errorf("cursor was created for a query sorted by '%s', not '%s'", position.SortBy, sortBy)
+	}
+	if len(position.EncodedValue) > 0 {
+		position.SortValue = &dbdata.Value{}
+		if err := proto.Unmarshal(position.EncodedValue, position.SortValue); err != nil {
+			return nil, fmt.Errorf("invalid cursor: %v", err)
+		}
+	}
+	return &position, nil
+}
+
+// after reports whether the record comes strictly after the cursor position in the query ordering.
+func (p *cursorPosition) after(t *Table, record *dbdata.Record) bool {
+	key := t.recordKey(record)
+	if p.SortBy != "" {
+		if cmp, _ := compareProtoValues(pathValue(record, p.SortBy), p.SortValue); cmp != 0 {
+			return cmp > 0
+		}
+	}
+	return key > p.PrimaryKey
+}
@@ -1,14 +1,15 @@
 package data
 
 import (
-	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type DatabaseReader interface {
@@ -17,9 +18,21 @@ type DatabaseReader interface {
 }
 
 type Database struct {
-	sync.RWMutex                   // Mutex to ensure the database is thread safe
-	Name         string            // Name of the database
-	Tables       map[string]*Table // Map of Tables in the database
+	sync.RWMutex                      // Mutex to ensure the database is thread safe
+	Name            string            // Name of the database
+	Tables          map[string]*Table // Map of Tables in the database
+	commitLog       *CommitLog        // Commit log shared by the tables of the database
+	throttle        WriteThrottle     // Write throttle of the tables of the database
+	generators      Generators        // Sources of generated fields of the tables of the database
+	telemetry       *Telemetry        // Telemetry of the tables of the database
+	plugins         []*Plugin         // Plugins registered on the tables of the database
+	keys            *dataKeys         // Data key the tables of the database are encrypted with, nil for the master key
+	plaintext       bool              // Whether the tables are written unencrypted, set with SetPlaintext
+	serverPlaintext bool              // Whether the server writes the tables of every database unencrypted
+	tenant          string            // Tenant of the server of the database, empty for the root server
+	dir             string            // Directory of the database, set by the server it belongs to
+	readOnly        atomic.Bool       // Whether the database and its tables are read-only, set with SetReadOnly
+	closed          atomic.Bool       // Whether the database has been closed, after which its tables cannot be looked up
 }
 
 func NewDatabase(name string) *Database {
@@ -29,6 +42,24 @@ func NewDatabase(name string) *Database {
 	}
 }
 
+// directory returns the directory of the database, in the databases directory of its server, or of the root server
+// for databases created on their own.
+func (db *Database) directory() string {
+	if db.dir != "" {
+		return db.dir
+	}
+	return filepath.Join(getDefaultServerDir(), db.Name)
+}
+
+// qualifiedName returns the name of the database prefixed with its tenant, such as acme/shop, to tell the databases
+// of the tenants apart in the messages and reports covering several tenants.
+func (db *Database) qualifiedName() string {
+	if db.tenant == "" {
+		return db.Name
+	}
+	return db.tenant + "/" + db.Name
+}
+
 func ValidFilename(name string) bool {
 	validName := regexp.MustCompile(`^[a-zA-Z0-9-_]+$`).MatchString
 	return validName(name)
@@ -54,48 +85,115 @@ func ValidFilename(name string) bool {
 // If there is an error creating the initial file, the error is returned.
 // If the table is successfully created, the method returns nil.
 func (db *Database) CreateTable(tableName, primaryKey string) error {
+	return db.CreateTableWithOptions(tableName, primaryKey, TableOptions{})
+}
+
+// CreateTableWithOptions creates a new table like CreateTable, applying the given options
+// and saving them in the table's metadata file. It returns an error wrapping ErrNameTaken if the database has a
+// table with the name already.
+func (db *Database) CreateTableWithOptions(tableName, primaryKey string, options TableOptions) error {
 	if !ValidFilename(tableName) {
 		return fmt.Errorf("invalid table name: %s", tableName)
 	}
 	if !ValidFilename(primaryKey) {
 		return fmt.Errorf("invalid primary key: %s", primaryKey)
 	}
+	for _, foreignKey := range options.ForeignKeys {
+		if foreignKey.Field == "" || !ValidFilename(foreignKey.Table) {
+			return fmt.Errorf("invalid foreign key %s referencing table %s", foreignKey.Field, foreignKey.Table)
+		}
+	}
+	if err := validateSchema(options); err != nil {
+		return err
+	}
+	if err := validateRetention(options.Retention); err != nil {
+		return err
+	}
+	if err := validateComputedFields(primaryKey, options); err != nil {
+		return err
+	}
+	if err := validateRules(options); err != nil {
+		return err
+	}
+	if err := validateWriteBehind(options.WriteBehind); err != nil {
+		return err
+	}
+	if err := validateConcurrency(options.Concurrency); err != nil {
+		return err
+	}
+	if err := validateCompression(options.Compression); err != nil {
+		return err
+	}
+	if err := validateSegmentation(options.Segmentation); err != nil {
+		return err
+	}
+	if err := db.writable(); err != nil {
+		return err
+	}
 	db.Lock()
 	defer db.Unlock()
 	if _, exists := db.Tables[tableName]; exists {
-		return fmt.Errorf("table %s already exists", tableName)
+		return fmt.Errorf("%w: table %s already exists", ErrNameTaken, tableName)
 	}
 
-	serverDir := getDefaultServerDir()
-	dbDir := filepath.Join(serverDir, db.Name)
+	dbDir := db.directory()
 	filePath := filepath.Join(dbDir, tableName+".dat")
 	metaFilePath := filepath.Join(dbDir, tableName+".meta")
 
 	if err := os.MkdirAll(dbDir, 0755); err != nil {
 		return fmt.Errorf("failed to create database directory: %v", err)
 	}
+	// Segments and write-behind logs left behind by a dropped table of the same name would be applied to the new one
+	if err := os.RemoveAll(segmentDir(filePath)); err != nil {
+		return fmt.Errorf("failed to remove old segments of table '%s': %v", tableName, err)
+	}
+	if err := os.Remove(pendingLogPath(filePath)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove old write-behind log of table '%s': %v", tableName, err)
+	}
 
-	table := NewTable(primaryKey, filePath)
+	var table *Table
+	var err error
+	if options.InMemory {
+		// The records of a table held in memory are never written, so it needs neither a data key nor a file
+		if table, err = newMemoryTable(primaryKey, filePath, options); err != nil {
+			return fmt.Errorf("failed to open table '%s': %v", tableName, err)
+		}
+	} else {
+		if !db.writesPlaintext() {
+			if err := db.ensureDataKey(dbDir); err != nil {
+				return err
+			}
+		}
+		keys, err := db.tableKeys()
+		if err != nil {
+			return err
+		}
+		if table, err = openTableWith(primaryKey, filePath, options, keys, db.writesPlaintext()); err != nil {
+			return fmt.Errorf("failed to open table '%s': %v", tableName, err)
+		}
+	}
+	db.configureTable(table)
 	db.Tables[tableName] = table
 
-	// Save the primary key in a metadata file
-	metaData := map[string]string{"PrimaryKey": primaryKey}
-	metaDataBytes, err := json.Marshal(metaData)
-	if err != nil {
-		return fmt.Errorf("failed to serialize metadata: %v", err)
-	}
-	if err := os.WriteFile(metaFilePath, metaDataBytes, 0644); err != nil {
-		return fmt.Errorf("failed to write metadata file: %v", err)
+	// Save the primary key and options in a metadata file
+	if err := writeTableMeta(metaFilePath, tableMeta{PrimaryKey: primaryKey, TableOptions: options}); err != nil {
+		return err
 	}
 
-	if _, err := os.Create(filePath); err != nil {
-		return fmt.Errorf("failed to create initial file for table '%s': %v", tableName, err)
+	if !options.InMemory {
+		if _, err := os.Create(filePath); err != nil {
+			return fmt.Errorf("failed to create initial file for table '%s': %v", tableName, err)
+		}
 	}
 
+	db.tableOpened(tableName, table)
 	return nil
 }
 
-// LoadTables loads the tables from the database directory.
+// LoadTables loads the tables from the database directory. Tables that cannot be loaded, because their metadata is
+// missing or their file fails to decrypt or decode, are moved to the quarantine directory and listed by
+// Server.RecoveryReport rather than failing the whole database, or skipped if the database is read-only. Tables held
+// in memory are opened empty from their metadata file.
 func (db *Database) LoadTables(dbDir string) error {
 	files, err := os.ReadDir(dbDir)
 	if err != nil {
@@ -103,35 +201,81 @@ func (db *Database) LoadTables(dbDir string) error {
 	}
 
 	for _, fileInfo := range files {
-		if !fileInfo.IsDir() && strings.HasSuffix(fileInfo.Name(), ".dat") {
-			tableName := strings.TrimSuffix(fileInfo.Name(), ".dat")
-			tablePath := filepath.Join(dbDir, fileInfo.Name())
-
-			// Load the primary key from the metadata file
-			metaFilePath := filepath.Join(dbDir, tableName+".meta")
-			metaDataBytes, err := os.ReadFile(metaFilePath)
-			if err != nil {
-				return fmt.Errorf("failed to read metadata file for table %s: %v", tableName, err)
-			}
-			var metaData map[string]string
-			if err := json.Unmarshal(metaDataBytes, &metaData); err != nil {
-				return fmt.Errorf("failed to deserialize metadata for table %s: %v", tableName, err)
-			}
-			primaryKey := metaData["PrimaryKey"]
-
-			table := NewTable(primaryKey, tablePath)
-			records, err := table.readRecordsFromFile()
-			if err != nil {
-				return fmt.Errorf("failed to load table %s: %v", tableName, err)
+		if !fileInfo.IsDir() && (strings.HasSuffix(fileInfo.Name(), ".dat") || db.inMemoryTable(dbDir, fileInfo.Name())) {
+			tableName := strings.TrimSuffix(strings.TrimSuffix(fileInfo.Name(), ".dat"), ".meta")
+			table, err := db.openTable(dbDir, tableName)
+			if err != nil && db.readOnly.Load() {
+				// A read-only database leaves the files where they are, quarantining would move them
+				log.Printf("Skipping table %s of database %s, which failed to load: %v", tableName, db.Name, err)
+				continue
+			} else if err != nil {
+				// One unreadable table must not keep the others from loading
+				log.Printf("Quarantining table %s of database %s, which failed to load: %v", tableName, db.Name, err)
+				if _, quarantineErr := quarantineTable(db.Name, tableName, dbDir, err); quarantineErr != nil {
+					return fmt.Errorf("failed to load table %s: %v, and quarantining it failed: %v", tableName, err, quarantineErr)
+				}
+				continue
 			}
-
-			table.Records = records.Records
 			db.Tables[tableName] = table
+			db.tableOpened(tableName, table)
 		}
 	}
 	return nil
 }
 
+// inMemoryTable reports whether the file of the database directory with the given name is the metadata file of a
+// table held in memory, which has no data file. Such tables are opened empty.
+func (db *Database) inMemoryTable(dbDir, name string) bool {
+	tableName, isMeta := strings.CutSuffix(name, ".meta")
+	if !isMeta {
+		return false
+	}
+	if _, err := os.Stat(filepath.Join(dbDir, tableName+".dat")); err == nil {
+		return false
+	}
+	meta, err := readTableMeta(filepath.Join(dbDir, name))
+	return err == nil && meta.InMemory
+}
+
+// openTable opens the table with the given name from the database directory, with the primary key and options of
+// its metadata file and the settings the database applies to its tables. A table held in memory is opened empty.
+func (db *Database) openTable(dbDir, tableName string) (*Table, error) {
+	meta, err := readTableMeta(filepath.Join(dbDir, tableName+".meta"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load table %s: %v", tableName, err)
+	}
+	filePath := filepath.Join(dbDir, tableName+".dat")
+	meta.ReadOnly = db.readOnly.Load()
+	if meta.InMemory {
+		table, err := newMemoryTable(meta.PrimaryKey, filePath, meta.TableOptions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load table %s: %v", tableName, err)
+		}
+		db.configureTable(table)
+		return table, nil
+	}
+	keys, err := db.tableKeys()
+	if err != nil && !isPlaintextFile(filePath) {
+		return nil, err
+	}
+	// A table whose file is in plaintext is read without a key, and fails to write if it needs one
+	table, err := openTableWith(meta.PrimaryKey, filePath, meta.TableOptions, keys, db.writesPlaintext())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load table %s: %v", tableName, err)
+	}
+	db.configureTable(table)
+	return table, nil
+}
+
+// configureTable applies the settings the database applies to its tables to a table it opened.
+func (db *Database) configureTable(table *Table) {
+	table.commitLog = db.commitLog
+	table.tenant = db.tenant
+	table.SetWriteThrottle(db.throttle)
+	table.generators = db.generators
+	table.SetTelemetry(db.telemetry)
+}
+
 // ListTables returns a list of tables in the database
 func (db *Database) ListTables() ([]string, error) {
 	db.RLock()
@@ -144,3 +288,49 @@ func (db *Database) ListTables() ([]string, error) {
 
 	return tables, nil
 }
+
+// SetCommitLog makes every table of the database, including tables created later, ship committed mutations to the given commit log.
+func (db *Database) SetCommitLog(commitLog *CommitLog) {
+	db.Lock()
+	defer db.Unlock()
+
+	db.commitLog = commitLog
+	for _, table := range db.Tables {
+		table.SetCommitLog(commitLog)
+	}
+}
+
+// SetWriteThrottle applies the write throttle to every table of the database, including tables created later.
+func (db *Database) SetWriteThrottle(throttle WriteThrottle) {
+	db.Lock()
+	defer db.Unlock()
+
+	db.throttle = throttle
+	for _, table := range db.Tables {
+		table.SetWriteThrottle(throttle)
+	}
+}
+
+// SetGenerators sets the sources of the generated primary keys and timestamps of every table of the database,
+// including tables created later.
+func (db *Database) SetGenerators(generators Generators) {
+	db.Lock()
+	defer db.Unlock()
+
+	db.generators = generators
+	for _, table := range db.Tables {
+		table.SetGenerators(generators)
+	}
+}
+
+// SetTelemetry makes every table of the database, including tables created later, sample the shapes of its
+// operations to the given telemetry. Passing nil disables it.
+func (db *Database) SetTelemetry(telemetry *Telemetry) {
+	db.Lock()
+	defer db.Unlock()
+
+	db.telemetry = telemetry
+	for _, table := range db.Tables {
+		table.SetTelemetry(telemetry)
+	}
+}
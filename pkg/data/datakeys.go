@@ -0,0 +1,162 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/utils"
+)
+
+// dataKeyFile is the file, in the directory of each database, holding the data key of the database wrapped with the
+// master key. It is part of the backups of the database, which the master key alone then decrypts.
+const dataKeyFile = "datakey.json"
+
+// dataKeyMeta is the content of the data key file of a database.
+type dataKeyMeta struct {
+	WrappedKey string    `json:"WrappedKey"`         // WrappedKey is the data key, encrypted with the master key.
+	Previous   []string  `json:"Previous,omitempty"` // Previous are the replaced data keys, wrapped, while a rotation has tables left to re-encrypt.
+	CreatedAt  time.Time `json:"CreatedAt"`          // CreatedAt is when the data key was generated.
+}
+
+// dataKeys holds the data key of a database, which its tables are encrypted with instead of the master key.
+type dataKeys struct {
+	current   []byte    // Key the tables are encrypted with
+	previous  [][]byte  // Replaced keys that tables not yet re-encrypted by a rotation are still encrypted with
+	createdAt time.Time // When the current key was generated
+}
+
+// masterUtils returns the encryption utilities of the master key: the key set by the last RotateKey or, before
+// any rotation, the AES key of the environment. Data keys are wrapped with it, and tables of databases without a
+// data key are encrypted with it.
+func masterUtils() (*utils.Utils, error) {
+	if rotated := rotatedKeys.Load(); rotated != nil {
+		return rotated, nil
+	}
+	return utils.NewUtils()
+}
+
+// keyUtils returns the encryption utilities the tables of the database are opened with: its data key, which also
+// decrypts data encrypted with the master key, or the master key for databases created before data keys existed.
+// The caller must hold the database lock.
+func (db *Database) keyUtils() (*utils.Utils, error) {
+	master, err := masterUtils()
+	if err != nil {
+		return nil, err
+	}
+	return db.keys.utils(master)
+}
+
+// utils returns the encryption utilities of the data keys, or master itself if keys is nil.
+func (keys *dataKeys) utils(master *utils.Utils) (*utils.Utils, error) {
+	if keys == nil {
+		return master, nil
+	}
+	return master.WithKeys(keys.current, keys.previous...)
+}
+
+// loadDataKey reads the data key of the database from its directory and unwraps it with the master key. Databases
+// without a data key file keep encrypting their tables with the master key.
+func (db *Database) loadDataKey(dbDir string) error {
+	content, err := os.ReadFile(filepath.Join(dbDir, dataKeyFile))
+	if os.IsNotExist(err) {
+		db.keys = nil
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read the data key of database %s: %v", db.Name, err)
+	}
+	var meta dataKeyMeta
+	if err := json.Unmarshal(content, &meta); err != nil {
+		return fmt.Errorf("failed to parse the data key of database %s: %v", db.Name, err)
+	}
+	master, err := masterUtils()
+	if err != nil {
+		return err
+	}
+	keys := &dataKeys{createdAt: meta.CreatedAt}
+	if keys.current, err = master.UnwrapKey(meta.WrappedKey); err != nil {
+		return fmt.Errorf("failed to unwrap the data key of database %s with the master key: %v", db.Name, err)
+	}
+	for _, wrapped := range meta.Previous {
+		previous, err := master.UnwrapKey(wrapped)
+		if err != nil {
+			return fmt.Errorf("failed to unwrap a previous data key of database %s with the master key: %v", db.Name, err)
+		}
+		keys.previous = append(keys.previous, previous)
+	}
+	db.keys = keys
+	return nil
+}
+
+// ensureDataKey generates the data key of a database that has none and no table files yet, so that its tables are
+// never encrypted with the master key. Databases with table files encrypted with the master key get a data key when
+// the master key is rotated. The caller must hold the database write lock.
+func (db *Database) ensureDataKey(dbDir string) error {
+	if db.keys != nil {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(dbDir, dataKeyFile)); err == nil {
+		// The data key was not loaded while the database was in plaintext mode, and must not be replaced
+		return db.loadDataKey(dbDir)
+	}
+	files, err := os.ReadDir(dbDir)
+	if err != nil {
+		return fmt.Errorf("failed to read database directory: %v", err)
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".dat") {
+			return nil
+		}
+	}
+	return db.generateDataKey(dbDir)
+}
+
+// generateDataKey generates a new data key for the database and writes it to its directory. The caller must hold the
+// database write lock, and open no table with other keys afterwards.
+func (db *Database) generateDataKey(dbDir string) error {
+	key, err := utils.GenerateKey()
+	if err != nil {
+		return fmt.Errorf("failed to generate the data key of database %s: %v", db.Name, err)
+	}
+	master, err := masterUtils()
+	if err != nil {
+		return err
+	}
+	keys := &dataKeys{current: key, createdAt: time.Now().UTC()}
+	path := filepath.Join(dbDir, dataKeyFile)
+	if err := writeDataKey(path+rotationSuffix, master, keys); err != nil {
+		return err
+	}
+	if err := os.Rename(path+rotationSuffix, path); err != nil {
+		return fmt.Errorf("failed to write the data key of database %s: %v", db.Name, err)
+	}
+	db.keys = keys
+	return nil
+}
+
+// writeDataKey wraps the data keys with the master key and writes them to the file at path.
+func writeDataKey(path string, master *utils.Utils, keys *dataKeys) error {
+	meta := dataKeyMeta{CreatedAt: keys.createdAt}
+	var err error
+	if meta.WrappedKey, err = master.WrapKey(keys.current); err != nil {
+		return fmt.Errorf("failed to wrap the data key: %v", err)
+	}
+	for _, previous := range keys.previous {
+		wrapped, err := master.WrapKey(previous)
+		if err != nil {
+			return fmt.Errorf("failed to wrap the data key: %v", err)
+		}
+		meta.Previous = append(meta.Previous, wrapped)
+	}
+	content, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		return fmt.Errorf("failed to write the data key: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package data
+
+import (
+	"fmt"
+)
+
+// Denormalize returns every record of a table with the records referenced by its foreign keys embedded, for
+// example each order with its user object inlined, which suits exports to search indexes. The referenced records
+// have their own foreign keys followed in turn, up to depth levels. References to records that do not exist are
+// left as they are.
+//
+// Each table is read from its own snapshot, so records written to the referenced tables while Denormalize runs
+// may or may not be embedded.
+//
+// Parameters:
+// - tableName: The table whose records are returned.
+// - depth: How many levels of foreign keys are followed. 1 embeds the records referenced by the table itself.
+//
+// Returns:
+// - The denormalized records. Embedded records are values of type map[string]interface{}.
+// - An error, if a table does not exist or cannot be read. If the operation is successful, the error is nil.
+func (db *Database) Denormalize(tableName string, depth int) ([]Record, error) {
+	db.RLock()
+	table, exists := db.Tables[tableName]
+	db.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("table %s not found", tableName)
+	}
+
+	records, err := table.SelectAll()
+	if err != nil {
+		return nil, err
+	}
+	d := &denormalizer{db: db, lookup: make(map[string]map[string]Record)}
+	denormalized := make([]Record, 0, len(records))
+	for _, record := range records {
+		embedded, err := d.embed(table, record, depth)
+		if err != nil {
+			return nil, err
+		}
+		denormalized = append(denormalized, embedded)
+	}
+	return denormalized, nil
+}
+
+// denormalizer embeds referenced records, reading every referenced table once.
+type denormalizer struct {
+	db     *Database
+	lookup map[string]map[string]Record // Records of the referenced tables by table name and primary key
+}
+
+// embed returns a copy of the record of table with its foreign keys replaced by the referenced records, up to
+// depth levels.
+func (d *denormalizer) embed(table *Table, record Record, depth int) (Record, error) {
+	table.RLock()
+	foreignKeys := table.Options.ForeignKeys // RenameField replaces the foreign keys under the write lock
+	table.RUnlock()
+	if depth <= 0 || len(foreignKeys) == 0 {
+		return record, nil
+	}
+	embedded := copyRecord(record)
+	for _, foreignKey := range foreignKeys {
+		value, exists := record[foreignKey.Field]
+		if !exists || value == nil {
+			continue
+		}
+		referencedTable, records, err := d.records(foreignKey)
+		if err != nil {
+			return nil, err
+		}
+		key, err := referencedTable.EncodeKey(value)
+		if err != nil {
+			continue
+		}
+		referenced, exists := records[key]
+		if !exists {
+			continue
+		}
+		if referenced, err = d.embed(referencedTable, referenced, depth-1); err != nil {
+			return nil, err
+		}
+		field := foreignKey.As
+		if field == "" {
+			field = foreignKey.Field
+		}
+		embedded[field] = map[string]interface{}(referenced)
+	}
+	return embedded, nil
+}
+
+// records returns the table referenced by the foreign key and its records by primary key.
+func (d *denormalizer) records(foreignKey ForeignKey) (*Table, map[string]Record, error) {
+	d.db.RLock()
+	table, exists := d.db.Tables[foreignKey.Table]
+	d.db.RUnlock()
+	if !exists {
+		return nil, nil, fmt.Errorf("foreign key %s references table %s, which does not exist", foreignKey.Field, foreignKey.Table)
+	}
+	if records, loaded := d.lookup[foreignKey.Table]; loaded {
+		return table, records, nil
+	}
+
+	all, err := table.SelectAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read table %s: %v", foreignKey.Table, err)
+	}
+	records := make(map[string]Record, len(all))
+	for _, record := range all {
+		if key, err := table.EncodeKey(record[table.PrimaryKey]); err == nil {
+			records[key] = record
+		}
+	}
+	d.lookup[foreignKey.Table] = records
+	return table, records, nil
+}
@@ -0,0 +1,121 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrTableNotFound is returned by Database.DescribeTable for an unknown table.
+var ErrTableNotFound = errors.New("table not found")
+
+// TableDescription describes the structure of a table, as returned by Database.DescribeTable.
+type TableDescription struct {
+	Database        string               `json:"database"`                  // Database is the name of the database of the table.
+	Table           string               `json:"table"`                     // Table is the name of the table.
+	PrimaryKey      string               `json:"primaryKey"`                // PrimaryKey is the field name used as the primary key.
+	Records         int                  `json:"records"`                   // Records is the number of records of the table.
+	FileSize        int64                `json:"fileSize"`                  // FileSize is the size in bytes of the data file and its segments, 0 for tables only held in memory.
+	Schema          map[string]string    `json:"schema,omitempty"`          // Schema is the declared type of every field, nil for tables that accept any field.
+	Fields          []FieldSummary       `json:"fields"`                    // Fields summarizes the fields the records hold, sorted by name.
+	Indexes         []IndexSummary       `json:"indexes"`                   // Indexes lists the indexed fields and nested paths, sorted by name.
+	ForeignKeys     []ForeignKey         `json:"foreignKeys,omitempty"`     // ForeignKeys are the declared references to other tables.
+	Rules           map[string]FieldRule `json:"rules,omitempty"`           // Rules are the validation rules of the fields.
+	ComputedFields  []ComputedField      `json:"computedFields,omitempty"`  // ComputedFields are the declared computed fields.
+	AutoID          bool                 `json:"autoID,omitempty"`          // AutoID is whether missing primary keys are generated.
+	Timestamps      bool                 `json:"timestamps,omitempty"`      // Timestamps is whether created_at and updated_at are maintained.
+	ClientEncrypted bool                 `json:"clientEncrypted,omitempty"` // ClientEncrypted is whether the client encrypts every field except the primary key.
+	Plaintext       bool                 `json:"plaintext,omitempty"`       // Plaintext is whether the table is written unencrypted, in plaintext mode.
+	WriteBehind     *WriteBehind         `json:"writeBehind,omitempty"`     // WriteBehind is when the file is flushed in write-behind mode, nil if every write writes it.
+	Concurrency     int                  `json:"concurrency,omitempty"`     // Concurrency is the number of goroutines that encode and decode the file in chunks.
+	Compression     string               `json:"compression,omitempty"`     // Compression is the algorithm that compresses the file, empty for none.
+	Segmentation    *Segmentation        `json:"segmentation,omitempty"`    // Segmentation is when the segments are compacted in segmented mode, nil if every write rewrites the file.
+	Segments        int                  `json:"segments,omitempty"`        // Segments is the number of segment files next to the data file.
+	InMemory        bool                 `json:"inMemory,omitempty"`        // InMemory is whether the records are only held in memory, with no data file.
+}
+
+// FieldSummary summarizes the values a field holds across the records of a table.
+type FieldSummary struct {
+	Field   string   `json:"field"`   // Field is the name of the field.
+	Kinds   []string `json:"kinds"`   // Kinds are the sorted kinds of the values: bool, bytes, null, number, string, timestamp or other.
+	Records int      `json:"records"` // Records is the number of records that have the field.
+}
+
+// IndexSummary describes an index of a table.
+type IndexSummary struct {
+	Field   string `json:"field"`             // Field is the indexed field or nested path.
+	Entries int    `json:"entries"`           // Entries is the number of indexed records.
+	Spilled bool   `json:"spilled,omitempty"` // Spilled is whether the index budget spilled the index to disk.
+}
+
+// DescribeTable is a method of the Database struct that describes the structure of a table: its primary key, its
+// declared schema and constraints, the fields and indexes of its records, and the size of its data. Tables evicted by
+// the cache policy are read back into memory, without counting as an access to them.
+//
+// Parameters:
+// - tableName: The name of the table.
+//
+// Returns:
+// - A pointer to the TableDescription of the table.
+// - An error wrapping ErrTableNotFound if the table does not exist, or an error if its records or file cannot be
+// read. If the operation is successful, the error is nil.
+func (db *Database) DescribeTable(tableName string) (*TableDescription, error) {
+	db.RLock()
+	table, exists := db.Tables[tableName]
+	db.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("%w: %s in database %s", ErrTableNotFound, tableName, db.Name)
+	}
+
+	snap, err := table.resident()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load table %s: %v", tableName, err)
+	}
+	var size int64
+	if !table.virtual && !table.temporary {
+		if size, err = filesSize(table.FilePath); err != nil {
+			return nil, fmt.Errorf("failed to read the file of table %s: %v", tableName, err)
+		}
+	}
+
+	table.RLock()
+	options := table.Options
+	table.RUnlock()
+	description := &TableDescription{
+		Database:        db.Name,
+		Table:           tableName,
+		PrimaryKey:      table.PrimaryKey,
+		Records:         len(snap.records),
+		FileSize:        size,
+		Schema:          options.Schema,
+		Fields:          []FieldSummary{},
+		Indexes:         []IndexSummary{},
+		ForeignKeys:     options.ForeignKeys,
+		Rules:           options.Rules,
+		ComputedFields:  options.ComputedFields,
+		AutoID:          options.AutoID,
+		Timestamps:      options.Timestamps,
+		WriteBehind:     options.WriteBehind,
+		Concurrency:     options.Concurrency,
+		Compression:     options.Compression,
+		Segmentation:    options.Segmentation,
+		Segments:        table.Segments(),
+		InMemory:        options.InMemory,
+		ClientEncrypted: options.ClientEncrypted,
+		Plaintext:       table.plaintext.Load(),
+	}
+	for field, described := range describeFields(snap.records) {
+		description.Fields = append(description.Fields, FieldSummary{
+			Field:   field,
+			Kinds:   strings.Split(described.kinds, ","),
+			Records: described.records,
+		})
+	}
+	sort.Slice(description.Fields, func(i, j int) bool { return description.Fields[i].Field < description.Fields[j].Field })
+	for field, partition := range snap.indexes {
+		description.Indexes = append(description.Indexes, IndexSummary{Field: field, Entries: partition.count, Spilled: partition.spilled()})
+	}
+	sort.Slice(description.Indexes, func(i, j int) bool { return description.Indexes[i].Field < description.Indexes[j].Field })
+	return description, nil
+}
@@ -0,0 +1,326 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNoBackupDestination is returned when a backup is fetched from a server without a backup destination.
+var ErrNoBackupDestination = errors.New("no backup destination")
+
+// BackupDestination is where backups are copied to once they are written, such as a directory on another disk or a
+// bucket of an object store, so they survive the loss of the machine, see SetBackupDestination. Objects are named
+// with slash-separated names, such as backup-20240501T1200.zip or tenants/acme/backup-20240501T1200.zip.
+type BackupDestination interface {
+	Upload(ctx context.Context, name string, content io.Reader, size int64) error // Upload stores content, of size bytes, under name, replacing any object with that name.
+	Download(ctx context.Context, name string, w io.Writer) error                 // Download writes the object to w, or returns an error wrapping ErrBackupNotFound if there is none.
+	List(ctx context.Context, prefix string) ([]DestinationObject, error)         // List returns the objects whose name starts with prefix.
+	Delete(ctx context.Context, name string) error                                // Delete removes the object, doing nothing if there is none.
+	String() string                                                               // String describes the destination in logs and in the path of remote backups, such as s3://bucket/prefix.
+}
+
+// DestinationObject is an object stored at a BackupDestination.
+type DestinationObject struct {
+	Name     string    // Name is the name of the object.
+	Size     int64     // Size is the size of the object in bytes.
+	Modified time.Time // Modified is when the object was last written.
+}
+
+// ParseBackupDestination returns the destination a URL describes: a directory as file:///path, or a plain path, and
+// an S3-compatible bucket as s3://bucket/prefix, see S3Destination, with the optional query parameters endpoint, such
+// as https://storage.googleapis.com or http://localhost:9000, region and path-style (true or false). The credentials
+// of a bucket are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, and its region from
+// AWS_REGION if the URL has none.
+//
+// Parameters:
+// - rawURL: The URL of the destination.
+//
+// Returns:
+// - The destination.
+// - An error, if the URL has an unknown scheme or misses the bucket. If the operation is successful, the error is nil.
+func ParseBackupDestination(rawURL string) (BackupDestination, error) {
+	if !strings.Contains(rawURL, "://") {
+		return &LocalDestination{Dir: rawURL}, nil
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup destination %q: %v", rawURL, err)
+	}
+	switch parsed.Scheme {
+	case "file":
+		return &LocalDestination{Dir: filepath.FromSlash(parsed.Host + parsed.Path)}, nil
+	case "s3":
+		if parsed.Host == "" {
+			return nil, fmt.Errorf("invalid backup destination %q, expected s3://bucket/prefix", rawURL)
+		}
+		query := parsed.Query()
+		destination := &S3Destination{
+			Bucket:       parsed.Host,
+			Prefix:       strings.Trim(parsed.Path, "/"),
+			Endpoint:     query.Get("endpoint"),
+			Region:       query.Get("region"),
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		if destination.Region == "" {
+			destination.Region = os.Getenv("AWS_REGION")
+		}
+		// Object stores other than AWS are usually only reachable by path
+		destination.PathStyle = destination.Endpoint != ""
+		if value := query.Get("path-style"); value != "" {
+			if destination.PathStyle, err = strconv.ParseBool(value); err != nil {
+				return nil, fmt.Errorf("invalid path-style %q of backup destination, expected true or false", value)
+			}
+		}
+		return destination, nil
+	default:
+		return nil, fmt.Errorf("unknown backup destination scheme %q, expected file or s3", parsed.Scheme)
+	}
+}
+
+// SetBackupDestination makes every backup of the server, and of its tenants under tenants/<name>/, be copied to the
+// destination once it is written, see CreateBackup, and the retention set with SetBackupRetention prune the copies
+// too. Passing nil stops copying backups.
+func (s *Server) SetBackupDestination(destination BackupDestination) {
+	defer s.forEachTenant(func(tenant *Server) { tenant.SetBackupDestination(destination) })
+	s.Lock()
+	defer s.Unlock()
+
+	s.destination = destination
+}
+
+// BackupDestination returns the destination set with SetBackupDestination, or nil.
+func (s *Server) BackupDestination() BackupDestination {
+	s.RLock()
+	defer s.RUnlock()
+	return s.destination
+}
+
+// destinationPrefix returns the prefix of the names of the backups of the server at the backup destination.
+func (s *Server) destinationPrefix() string {
+	if s.tenant == "" {
+		return ""
+	}
+	return tenantsDir + "/" + s.tenant + "/"
+}
+
+// uploadBackup copies the backup of the result to the backup destination, if there is one, and records where.
+func (s *Server) uploadBackup(ctx context.Context, result *BackupResult) error {
+	destination := s.BackupDestination()
+	if destination == nil {
+		return nil
+	}
+	file, err := os.Open(result.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %v", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %v", err)
+	}
+	name := s.destinationPrefix() + filepath.Base(result.Path)
+	if err := destination.Upload(ctx, name, file, info.Size()); err != nil {
+		return fmt.Errorf("backup written to %s but not copied: %w", result.Path, err)
+	}
+	result.Copy = strings.TrimSuffix(destination.String(), "/") + "/" + name
+	return nil
+}
+
+// ListRemoteBackups returns the copies of the backups of the server at its backup destination, newest first, see
+// SetBackupDestination.
+//
+// Returns:
+// - The copies, with their location as Path, empty if there are none or the server has no backup destination.
+// - An error, if the destination cannot be listed. If the operation is successful, the error is nil.
+func (s *Server) ListRemoteBackups() ([]Backup, error) {
+	destination := s.BackupDestination()
+	if destination == nil {
+		return nil, nil
+	}
+	prefix := s.destinationPrefix()
+	objects, err := destination.List(context.Background(), prefix)
+	if err != nil {
+		return nil, err
+	}
+	var backups []Backup
+	for _, object := range objects {
+		file := strings.TrimPrefix(object.Name, prefix)
+		if strings.Contains(file, "/") {
+			continue
+		}
+		backup, ok := parseBackupFileName(file)
+		if !ok {
+			continue
+		}
+		backup.Path = strings.TrimSuffix(destination.String(), "/") + "/" + object.Name
+		backup.Size = object.Size
+		backup.Remote = true
+		backup.modified = object.Modified
+		if backup.File == legacyBackupFile {
+			backup.Created = object.Modified.UTC()
+		}
+		backups = append(backups, backup)
+	}
+	sortBackups(backups)
+	return backups, nil
+}
+
+// FetchBackup downloads the copy of a backup from the backup destination of the server into its backup directory, so
+// it can be restored, see ListRemoteBackups. A backup that is already in the backup directory is replaced.
+//
+// Parameters:
+// - ref: The file name of the backup, with or without its .zip extension, or its name, in which case the newest
+// backup with that name is downloaded.
+//
+// Returns:
+// - The downloaded backup.
+// - ErrNoBackupDestination if the server has no backup destination, ErrBackupNotFound if the destination has no such
+// backup, or an error if the backup cannot be downloaded. If the operation is successful, the error is nil.
+func (s *Server) FetchBackup(ref string) (Backup, error) {
+	destination := s.BackupDestination()
+	if destination == nil {
+		return Backup{}, ErrNoBackupDestination
+	}
+	remote, err := s.ListRemoteBackups()
+	if err != nil {
+		return Backup{}, err
+	}
+	backup, ok := matchBackup(remote, ref)
+	if !ok {
+		return Backup{}, fmt.Errorf("%w: %s at %s", ErrBackupNotFound, ref, destination)
+	}
+
+	dir := s.backupsDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return Backup{}, fmt.Errorf("failed to create backup directory: %v", err)
+	}
+	file, err := os.CreateTemp(dir, backup.File+".*.tmp")
+	if err != nil {
+		return Backup{}, fmt.Errorf("failed to create backup file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if err := destination.Download(context.Background(), s.destinationPrefix()+backup.File, file); err != nil {
+		return Backup{}, err
+	}
+	if err := file.Close(); err != nil {
+		return Backup{}, fmt.Errorf("failed to write backup file: %v", err)
+	}
+	backup.Path = filepath.Join(dir, backup.File)
+	backup.Remote = false
+	if err := os.Rename(file.Name(), backup.Path); err != nil {
+		return Backup{}, fmt.Errorf("failed to write backup file: %v", err)
+	}
+	return backup, nil
+}
+
+// LocalDestination copies backups to a directory, such as a mounted network share or another disk.
+type LocalDestination struct {
+	Dir string // Dir is the directory the backups are copied to, created when the first one is.
+}
+
+// Upload writes content to a temporary file of the directory and renames it to name once complete.
+func (d *LocalDestination) Upload(ctx context.Context, name string, content io.Reader, size int64) error {
+	target := filepath.Join(d.Dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create backup destination directory: %v", err)
+	}
+	file, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create backup copy: %v", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := io.Copy(file, contextReader{ctx, content}); err != nil {
+		return fmt.Errorf("failed to copy backup: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to copy backup: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to copy backup: %v", err)
+	}
+	return os.Rename(file.Name(), target)
+}
+
+// Download copies the file name of the directory to w.
+func (d *LocalDestination) Download(ctx context.Context, name string, w io.Writer) error {
+	file, err := os.Open(filepath.Join(d.Dir, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", ErrBackupNotFound, d.location(name))
+	} else if err != nil {
+		return fmt.Errorf("failed to open backup copy: %v", err)
+	}
+	defer file.Close()
+	if _, err := io.Copy(w, contextReader{ctx, file}); err != nil {
+		return fmt.Errorf("failed to copy backup: %v", err)
+	}
+	return nil
+}
+
+// List returns the files of the directory, or of its subdirectory named by prefix, whose name starts with prefix.
+func (d *LocalDestination) List(ctx context.Context, prefix string) ([]DestinationObject, error) {
+	dir := path.Dir(prefix + "x")
+	entries, err := os.ReadDir(filepath.Join(d.Dir, filepath.FromSlash(dir)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list backup destination: %v", err)
+	}
+	var objects []DestinationObject
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+		if !entry.Type().IsRegular() || !strings.HasPrefix(name, prefix) || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		objects = append(objects, DestinationObject{Name: name, Size: info.Size(), Modified: info.ModTime()})
+	}
+	return objects, nil
+}
+
+// Delete removes the file name of the directory.
+func (d *LocalDestination) Delete(ctx context.Context, name string) error {
+	if err := os.Remove(filepath.Join(d.Dir, filepath.FromSlash(name))); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete backup copy: %v", err)
+	}
+	return nil
+}
+
+// String returns the directory as a file URL.
+func (d *LocalDestination) String() string {
+	return "file://" + filepath.ToSlash(d.Dir)
+}
+
+// location returns where the object name is stored.
+func (d *LocalDestination) location(name string) string {
+	return strings.TrimSuffix(d.String(), "/") + "/" + name
+}
+
+// contextReader is a reader that fails once its context is done, so that copies stop when their job is canceled.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
@@ -0,0 +1,211 @@
+package data
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/utils"
+)
+
+// S3Destination copies backups to a bucket of an object store speaking the S3 API, such as Amazon S3, MinIO,
+// Ceph, Cloudflare R2 or Google Cloud Storage through its interoperability endpoint with HMAC keys. Requests are
+// signed with AWS Signature Version 4.
+type S3Destination struct {
+	Bucket       string       // Bucket is the name of the bucket.
+	Prefix       string       // Prefix is prepended, with a slash, to the name of every object, none if empty.
+	Endpoint     string       // Endpoint is the base URL of the object store, https://s3.<region>.amazonaws.com if empty.
+	Region       string       // Region is the region requests are signed for, us-east-1 if empty.
+	PathStyle    bool         // PathStyle addresses the bucket in the path of the URL instead of in its host name.
+	AccessKey    string       // AccessKey is the access key ID of the credentials.
+	SecretKey    string       // SecretKey is the secret access key of the credentials.
+	SessionToken string       // SessionToken is the token of temporary credentials, none if empty.
+	Client       *http.Client // Client sends the requests, http.DefaultClient if nil.
+}
+
+// emptyPayloadHash is the SHA-256 hash of an empty request body.
+var emptyPayloadHash = utils.AWSPayloadHash(nil)
+
+// Upload puts the object. The body is streamed without being hashed, as UNSIGNED-PAYLOAD.
+func (d *S3Destination) Upload(ctx context.Context, name string, content io.Reader, size int64) error {
+	req, err := d.newRequest(ctx, "PUT", d.key(name), nil, content)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := d.do(req, utils.UnsignedPayload)
+	if err != nil {
+		return fmt.Errorf("failed to upload backup to %s: %v", d, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Download gets the object.
+func (d *S3Destination) Download(ctx context.Context, name string, w io.Writer) error {
+	req, err := d.newRequest(ctx, "GET", d.key(name), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.do(req, emptyPayloadHash)
+	if err != nil {
+		if statusErr, ok := err.(*s3Error); ok && statusErr.status == http.StatusNotFound {
+			return fmt.Errorf("%w: %s/%s", ErrBackupNotFound, d, name)
+		}
+		return fmt.Errorf("failed to download backup from %s: %v", d, err)
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("failed to download backup from %s: %v", d, err)
+	}
+	return nil
+}
+
+// List lists the objects of the bucket under the prefix, a page of up to 1000 at a time.
+func (d *S3Destination) List(ctx context.Context, prefix string) ([]DestinationObject, error) {
+	var objects []DestinationObject
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {d.key(prefix)}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := d.newRequest(ctx, "GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := d.do(req, emptyPayloadHash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list backups of %s: %v", d, err)
+		}
+		var page struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list backups of %s: %v", d, err)
+		}
+		for _, object := range page.Contents {
+			name := object.Key
+			if d.Prefix != "" {
+				name = strings.TrimPrefix(name, d.Prefix+"/")
+			}
+			objects = append(objects, DestinationObject{Name: name, Size: object.Size, Modified: object.LastModified})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// Delete deletes the object; the object store answers deletes of missing objects with success.
+func (d *S3Destination) Delete(ctx context.Context, name string) error {
+	req, err := d.newRequest(ctx, "DELETE", d.key(name), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.do(req, emptyPayloadHash)
+	if err != nil {
+		return fmt.Errorf("failed to delete backup from %s: %v", d, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// String returns the bucket and prefix as an s3 URL.
+func (d *S3Destination) String() string {
+	if d.Prefix == "" {
+		return "s3://" + d.Bucket
+	}
+	return "s3://" + d.Bucket + "/" + d.Prefix
+}
+
+// key returns the key of the object name in the bucket.
+func (d *S3Destination) key(name string) string {
+	if d.Prefix == "" {
+		return name
+	}
+	return d.Prefix + "/" + name
+}
+
+// region returns the region requests are signed for.
+func (d *S3Destination) region() string {
+	if d.Region == "" {
+		return "us-east-1"
+	}
+	return d.Region
+}
+
+// newRequest returns an unsigned request for the object key, or for the bucket if key is empty.
+func (d *S3Destination) newRequest(ctx context.Context, method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	endpoint := d.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + d.region() + ".amazonaws.com"
+	}
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %q of backup destination: %v", d.Endpoint, err)
+	}
+	target := *base
+	objectPath := "/" + key
+	if d.PathStyle {
+		objectPath = "/" + d.Bucket + objectPath
+	} else {
+		target.Host = d.Bucket + "." + base.Host
+	}
+	target.Path = strings.TrimSuffix(base.Path, "/") + objectPath
+	target.RawPath = utils.AWSURIEncode(strings.TrimSuffix(base.Path, "/")+objectPath, false)
+	target.RawQuery = utils.AWSCanonicalQuery(query)
+	return http.NewRequestWithContext(ctx, method, target.String(), body)
+}
+
+// do signs the request with the hash of its body, or utils.UnsignedPayload, sends it and returns the response, or an
+// *s3Error if the object store answered with an error status.
+func (d *S3Destination) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	utils.SignAWSRequest(req, payloadHash, "s3", d.region(), d.AccessKey, d.SecretKey, d.SessionToken, time.Now())
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		var body struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if xml.Unmarshal(message, &body) == nil && body.Code != "" {
+			return nil, &s3Error{status: resp.StatusCode, message: resp.Status + ": " + body.Code + ": " + body.Message}
+		}
+		return nil, &s3Error{status: resp.StatusCode, message: resp.Status}
+	}
+	return resp, nil
+}
+
+// s3Error is an error status answered by the object store.
+type s3Error struct {
+	status  int
+	message string
+}
+
+func (e *s3Error) Error() string {
+	return e.message
+}
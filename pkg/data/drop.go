@@ -0,0 +1,330 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// ErrTableDropped is returned by writes to a table that has been dropped or renamed, through a reference taken before.
+var ErrTableDropped = errors.New("table has been dropped or renamed")
+
+// ErrNameTaken is returned when creating a database or table with the name of another one, or renaming one to it.
+var ErrNameTaken = errors.New("name already taken")
+
+// ErrInvalidName is returned when renaming a database or table to a name that is not a valid file name or is
+// reserved, or when creating, deleting or renaming a reserved database.
+var ErrInvalidName = errors.New("invalid name")
+
+// ErrTableReferenced is returned when dropping or renaming a table referenced by a foreign key of another table.
+var ErrTableReferenced = errors.New("table is referenced by a foreign key")
+
+// deletedDirPrefix starts the names of the directories of deleted databases while their files are removed. Database
+// names cannot start with a dot, so LoadDatabases skips them.
+const deletedDirPrefix = ".deleted-"
+
+// DropTable deletes the table with the given name and its files. Writes in progress finish first; writes through
+// references to the table taken before fail afterwards with ErrTableDropped. A table referenced by a foreign key of
+// another table of the database cannot be dropped until the foreign key is removed.
+//
+// Parameters:
+// - tableName: The name of the table to drop.
+//
+// Returns:
+// - ErrTableNotFound if the database has no such table.
+// - ErrTableReferenced if a foreign key of another table references it.
+// - An error if the table is read-only or its files cannot be removed, in which case it is kept.
+func (db *Database) DropTable(tableName string) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	db.Lock()
+	defer db.Unlock()
+	table, err := db.detachableTable(tableName)
+	if err != nil {
+		return err
+	}
+
+	table.Lock()
+	defer table.Unlock()
+	dbDir := filepath.Dir(table.FilePath)
+	if err := os.Remove(table.FilePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove the file of table %s: %v", tableName, err)
+	}
+	table.retire()
+	delete(db.Tables, tableName)
+	if err := os.Remove(filepath.Join(dbDir, tableName+".meta")); err != nil && !os.IsNotExist(err) {
+		log.Printf("Dropped table %s of database %s, but failed to remove its metadata file: %v", tableName, db.Name, err)
+	}
+	if err := os.RemoveAll(segmentDir(table.FilePath)); err != nil {
+		log.Printf("Dropped table %s of database %s, but failed to remove its segments: %v", tableName, db.Name, err)
+	}
+	return nil
+}
+
+// RenameTable renames a table and its files. Writes in progress finish first; writes through references to the
+// table taken before fail afterwards with ErrTableDropped, and the hooks and watchers registered on it are not moved
+// to the renamed table. A table referenced by a foreign key of another table of the database cannot be renamed.
+//
+// Parameters:
+// - oldName: The current name of the table.
+// - newName: The new name of the table, which must be a valid file name not used by another table.
+//
+// Returns:
+// - ErrTableNotFound if the database has no table named oldName.
+// - ErrNameTaken if the database has a table named newName, ErrTableReferenced if a foreign key references the table.
+// - ErrInvalidName if the new name is invalid, or an error if the files cannot be renamed, in which case the table is
+// kept as it was.
+func (db *Database) RenameTable(oldName, newName string) error {
+	if !ValidFilename(newName) {
+		return fmt.Errorf("%w: invalid table name: %s", ErrInvalidName, newName)
+	}
+	if err := db.writable(); err != nil {
+		return err
+	}
+	db.Lock()
+	defer db.Unlock()
+	table, err := db.detachableTable(oldName)
+	if err != nil {
+		return err
+	}
+	if _, exists := db.Tables[newName]; exists {
+		return fmt.Errorf("%w: table %s already exists", ErrNameTaken, newName)
+	}
+
+	table.Lock()
+	defer table.Unlock()
+	if err := table.flushPending(); err != nil {
+		return fmt.Errorf("failed to flush table %s: %v", oldName, err)
+	}
+	dbDir := filepath.Dir(table.FilePath)
+	renames := [][2]string{
+		{table.FilePath, filepath.Join(dbDir, newName+".dat")},
+		{filepath.Join(dbDir, oldName+".meta"), filepath.Join(dbDir, newName+".meta")},
+		{segmentDir(table.FilePath), filepath.Join(dbDir, newName+segmentsSuffix)},
+	}
+	if err := renameFiles(renames); err != nil {
+		return fmt.Errorf("failed to rename table %s: %v", oldName, err)
+	}
+	renamed, err := db.openTable(dbDir, newName)
+	if err != nil {
+		if undoErr := renameFiles(reversed(renames)); undoErr != nil {
+			return fmt.Errorf("failed to open renamed table %s: %v, and renaming it back failed: %v", newName, err, undoErr)
+		}
+		return fmt.Errorf("failed to open renamed table %s: %v", newName, err)
+	}
+	if table.temporary {
+		// A table held in memory has no file to open its records from, so they move to the renamed table as they are
+		renamed.publish(table.Records)
+	}
+	table.retire()
+	delete(db.Tables, oldName)
+	db.Tables[newName] = renamed
+	db.tableOpened(newName, renamed)
+	return nil
+}
+
+// detachableTable returns the table with the given name if it may be dropped or renamed. The caller must hold the
+// database lock.
+func (db *Database) detachableTable(tableName string) (*Table, error) {
+	table, exists := db.Tables[tableName]
+	if !exists {
+		return nil, ErrTableNotFound
+	}
+	if table.virtual {
+		return nil, ErrCatalogReadOnly
+	}
+	for name, other := range db.Tables {
+		for _, foreignKey := range other.Options.ForeignKeys {
+			if name != tableName && foreignKey.Table == tableName {
+				return nil, fmt.Errorf("%w: table %s is referenced by the foreign key %s of table %s", ErrTableReferenced, tableName, foreignKey.Field, name)
+			}
+		}
+	}
+	return table, nil
+}
+
+// retire makes later writes to the table fail with ErrTableDropped, and releases its records. The caller must hold
+// the table write lock.
+func (t *Table) retire() {
+	t.dropped = true
+	t.release()
+}
+
+// release discards the pending changes of the table and releases its records, indexes and cache. The caller must
+// hold the table write lock.
+func (t *Table) release() {
+	t.settlePending()
+	t.current.Store(nil)
+	t.recordCount.Store(0)
+	t.previous = nil
+	t.Records = nil
+	t.Indexes = nil
+	t.removeSpillFiles()
+	t.Cache.Clear()
+}
+
+// DeleteDatabase deletes the database with the given name, its tables and its directory. Writes in progress finish
+// first; writes through references to its tables taken before fail afterwards with ErrTableDropped.
+//
+// Parameters:
+// - name: The name of the database to delete.
+//
+// Returns:
+// - ErrDatabaseNotFound if the server has no such database.
+// - ErrInvalidName if the database is reserved, or an error if its directory cannot be moved aside, in which case it
+// is kept.
+func (s *Server) DeleteDatabase(name string) error {
+	if name == CatalogDatabase || name == SystemDatabase {
+		return fmt.Errorf("%w: database %s is reserved and cannot be deleted", ErrInvalidName, name)
+	}
+	if err := s.writable(); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	db, exists := s.Databases[name]
+	if !exists {
+		return ErrDatabaseNotFound
+	}
+	db.Lock()
+	defer db.Unlock()
+	unlock := lockTables(db)
+	defer unlock()
+
+	// The directory is moved aside first, so a failure halfway through removing it never leaves half a database
+	dbDir := db.directory()
+	deletedDir := filepath.Join(s.databasesDir(), deletedDirPrefix+name+"-"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err := os.Rename(dbDir, deletedDir); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete database %s: %v", name, err)
+	}
+	for _, table := range db.Tables {
+		table.retire()
+	}
+	delete(s.Databases, name)
+	if err := os.RemoveAll(deletedDir); err != nil {
+		log.Printf("Deleted database %s, but failed to remove its files from %s: %v", name, deletedDir, err)
+	}
+	return nil
+}
+
+// RenameDatabase renames a database and its directory. Writes in progress finish first; writes through references
+// to the database or its tables taken before fail afterwards with ErrTableDropped, and the hooks and watchers
+// registered on its tables are not moved to the renamed ones. Grants of roles naming the database are not changed.
+//
+// Parameters:
+// - oldName: The current name of the database.
+// - newName: The new name of the database, which must be a valid file name not used by another database.
+//
+// Returns:
+// - ErrDatabaseNotFound if the server has no database named oldName, ErrNameTaken if it has one named newName.
+// - ErrInvalidName if a name is reserved or the new name is invalid, or an error if the directory cannot be renamed,
+// in which case the database is kept as it was.
+func (s *Server) RenameDatabase(oldName, newName string) error {
+	for _, name := range []string{oldName, newName} {
+		if name == CatalogDatabase || name == SystemDatabase {
+			return fmt.Errorf("%w: database %s is reserved and cannot be renamed", ErrInvalidName, name)
+		}
+	}
+	if !ValidFilename(newName) {
+		return fmt.Errorf("%w: invalid database name: %s", ErrInvalidName, newName)
+	}
+	if err := s.writable(); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	db, exists := s.Databases[oldName]
+	if !exists {
+		return ErrDatabaseNotFound
+	}
+	if _, exists := s.Databases[newName]; exists {
+		return fmt.Errorf("%w: database %s already exists", ErrNameTaken, newName)
+	}
+	db.Lock()
+	defer db.Unlock()
+	unlock := lockTables(db)
+	defer unlock()
+
+	newDir := filepath.Join(s.databasesDir(), newName)
+	if _, err := os.Stat(newDir); err == nil {
+		return fmt.Errorf("%w: directory of database %s already exists", ErrNameTaken, newName)
+	}
+	oldDir := db.directory()
+	moved := true
+	if err := os.Rename(oldDir, newDir); os.IsNotExist(err) {
+		// A database without tables has no directory yet
+		moved = false
+	} else if err != nil {
+		return fmt.Errorf("failed to rename database %s: %v", oldName, err)
+	}
+
+	renamed := NewDatabase(newName)
+	renamed.commitLog = db.commitLog
+	renamed.throttle = db.throttle
+	renamed.generators = db.generators
+	renamed.telemetry = db.telemetry
+	renamed.plugins = db.plugins
+	renamed.keys = db.keys
+	renamed.plaintext = db.plaintext
+	renamed.serverPlaintext = db.serverPlaintext
+	renamed.tenant = db.tenant
+	renamed.dir = newDir
+	if moved {
+		if err := renamed.LoadTables(newDir); err != nil {
+			if undoErr := os.Rename(newDir, oldDir); undoErr != nil {
+				return fmt.Errorf("failed to open renamed database %s: %v, and renaming it back failed: %v", newName, err, undoErr)
+			}
+			return fmt.Errorf("failed to open renamed database %s: %v", newName, err)
+		}
+	}
+	for _, table := range db.Tables {
+		table.retire()
+	}
+	delete(s.Databases, oldName)
+	s.Databases[newName] = renamed
+	return nil
+}
+
+// lockTables takes the write locks of every table of the database, in the order of writeLockTables, and returns the
+// function releasing them. The caller must hold the database lock.
+func lockTables(db *Database) func() {
+	tables := make([]*Table, 0, len(db.Tables))
+	for _, table := range db.Tables {
+		tables = append(tables, table)
+	}
+	tables = lockOrder(tables)
+	for _, table := range tables {
+		table.Lock()
+	}
+	return func() {
+		for i := len(tables) - 1; i >= 0; i-- {
+			tables[i].Unlock()
+		}
+	}
+}
+
+// renameFiles renames every pair of files in order, renaming the renamed ones back if one fails. Missing files are
+// skipped.
+func renameFiles(renames [][2]string) error {
+	for i, rename := range renames {
+		if err := os.Rename(rename[0], rename[1]); err != nil && !os.IsNotExist(err) {
+			renameFiles(reversed(renames[:i]))
+			return err
+		}
+	}
+	return nil
+}
+
+// reversed returns the renames undoing the given ones, in reverse order.
+func reversed(renames [][2]string) [][2]string {
+	undo := make([][2]string, len(renames))
+	for i, rename := range renames {
+		undo[len(renames)-1-i] = [2]string{rename[1], rename[0]}
+	}
+	return undo
+}
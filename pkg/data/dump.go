@@ -0,0 +1,407 @@
+package data
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+	"github.com/Malpizarr/dbproto/pkg/utils"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// ErrDumpNotEncrypted is returned by Dump when it is given neither a key to encrypt the dump with nor the consent to
+// write the records in the clear.
+var ErrDumpNotEncrypted = errors.New("dump would hold unencrypted records, a key or consent to write them unencrypted is required")
+
+// DumpFormat names the format of the dumps written by Dump, in their header.
+const DumpFormat = "dbproto-dump"
+
+// DumpVersion is the version of the dump format written by this version. Load reads dumps up to this version.
+const DumpVersion = 1
+
+// DumpOptions controls Dump.
+type DumpOptions struct {
+	Key         []byte // Key is the 32 byte AES key every line of the dump after its header is encrypted with, Load needs it too.
+	Unencrypted bool   // Unencrypted consents to writing the records in the clear when Key is empty.
+	Compress    bool   // Compress compresses the dump with gzip; Load recognizes compressed dumps by themselves.
+}
+
+// LoadOptions controls Load.
+type LoadOptions struct {
+	Key []byte // Key is the AES key the dump was encrypted with, none for unencrypted dumps.
+}
+
+// DumpStats counts what a dump holds.
+type DumpStats struct {
+	Databases int `json:"databases"` // Databases is the number of databases.
+	Tables    int `json:"tables"`    // Tables is the number of tables.
+	Records   int `json:"records"`   // Records is the number of records.
+}
+
+// dumpLine is a line of a dump: the header, a database, a table with its primary key and options, a record of the
+// last table, or the end, which holds the counts so a truncated dump is detected.
+type dumpLine struct {
+	Type       string          `json:"type"`
+	Format     string          `json:"format,omitempty"`
+	Version    int             `json:"version,omitempty"`
+	Created    *time.Time      `json:"created,omitempty"`
+	Encrypted  bool            `json:"encrypted,omitempty"`
+	Database   string          `json:"database,omitempty"`
+	Table      string          `json:"table,omitempty"`
+	PrimaryKey string          `json:"primaryKey,omitempty"`
+	Options    *TableOptions   `json:"options,omitempty"`
+	Key        string          `json:"key,omitempty"`
+	Record     json.RawMessage `json:"record,omitempty"`
+	*DumpStats
+}
+
+// Dump writes every database of the server, with the primary key and options of every table and its records, to w
+// as a logical dump that Load reads back on any server, whatever its encryption key or storage options: lines of
+// JSON, after a header naming the format and its version, with the records in the protobuf JSON form that keeps the
+// type of every value. Every table is dumped as of a single write, like a backup, while writes go on. The records are
+// decrypted, so unless options.Key encrypts the lines of the dump, options.Unencrypted must consent to writing them in
+// the clear.
+//
+// Parameters:
+// - w: The writer the dump is written to.
+// - options: The key the dump is encrypted with, or the consent to write it unencrypted, and whether it is compressed.
+//
+// Returns:
+// - The number of databases, tables and records dumped.
+// - An error wrapping ErrDumpNotEncrypted without key nor consent, or an error if a table cannot be read or w cannot be written. If the operation is successful, the error is nil.
+func (s *Server) Dump(w io.Writer, options DumpOptions) (*DumpStats, error) {
+	var sealer *utils.Utils
+	if len(options.Key) > 0 {
+		var err error
+		if sealer, err = utils.NewUtilsWithKey(options.Key); err != nil {
+			return nil, fmt.Errorf("invalid dump key: %v", err)
+		}
+	} else if !options.Unencrypted {
+		return nil, ErrDumpNotEncrypted
+	}
+
+	out := bufio.NewWriter(w)
+	var compressor *gzip.Writer
+	dest := io.Writer(out)
+	if options.Compress {
+		compressor = gzip.NewWriter(out)
+		dest = compressor
+	}
+	writer := &dumpWriter{w: dest, sealer: sealer}
+	created := time.Now().UTC()
+	if err := writer.writeHeader(dumpLine{Type: "header", Format: DumpFormat, Version: DumpVersion, Created: &created, Encrypted: sealer != nil}); err != nil {
+		return nil, err
+	}
+
+	stats := &DumpStats{}
+	databases := s.ListDatabases()
+	sort.Strings(databases)
+	for _, dbName := range databases {
+		db, err := s.Database(dbName)
+		if errors.Is(err, ErrDatabaseNotFound) {
+			// Dropped since it was listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if err := writer.write(dumpLine{Type: "database", Database: dbName}); err != nil {
+			return nil, err
+		}
+		stats.Databases++
+		if err := dumpDatabase(db, dbName, writer, stats); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.write(dumpLine{Type: "end", DumpStats: stats}); err != nil {
+		return nil, err
+	}
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			return nil, fmt.Errorf("failed to write dump: %v", err)
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to write dump: %v", err)
+	}
+	return stats, nil
+}
+
+// dumpDatabase writes the tables of the database and their records to the dump, in the order of their names.
+func dumpDatabase(db *Database, dbName string, writer *dumpWriter, stats *DumpStats) error {
+	db.RLock()
+	tables := make(map[string]*Table, len(db.Tables))
+	var names []string
+	for name, table := range db.Tables {
+		if table.virtual {
+			continue
+		}
+		tables[name] = table
+		names = append(names, name)
+	}
+	db.RUnlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		table := tables[name]
+		snap, err := table.loadSnapshot()
+		if err != nil {
+			return fmt.Errorf("failed to read table %s.%s: %v", dbName, name, err)
+		}
+		table.RLock()
+		primaryKey, options := table.PrimaryKey, table.Options
+		table.RUnlock()
+		if err := writer.write(dumpLine{Type: "table", Database: dbName, Table: name, PrimaryKey: primaryKey, Options: &options}); err != nil {
+			return err
+		}
+		stats.Tables++
+
+		keys := make([]string, 0, len(snap.records))
+		for key := range snap.records {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			// The checksum is left out, Load seals the records again
+			record, err := protojson.Marshal(&dbdata.Record{Fields: snap.records[key].Fields})
+			if err != nil {
+				return fmt.Errorf("failed to serialize record %s of table %s.%s: %v", key, dbName, name, err)
+			}
+			if err := writer.write(dumpLine{Type: "record", Key: key, Record: record}); err != nil {
+				return err
+			}
+			stats.Records++
+		}
+	}
+	return nil
+}
+
+// dumpWriter writes the lines of a dump, encrypting every line after the header if it has a sealer.
+type dumpWriter struct {
+	w      io.Writer
+	sealer *utils.Utils
+}
+
+// writeHeader writes the header line, which is never encrypted, so Load knows how to read the others.
+func (d *dumpWriter) writeHeader(line dumpLine) error {
+	content, err := json.Marshal(line)
+	if err != nil {
+		return fmt.Errorf("failed to serialize dump: %v", err)
+	}
+	if _, err := d.w.Write(append(content, '\n')); err != nil {
+		return fmt.Errorf("failed to write dump: %v", err)
+	}
+	return nil
+}
+
+// write writes a line of the dump.
+func (d *dumpWriter) write(line dumpLine) error {
+	content, err := json.Marshal(line)
+	if err != nil {
+		return fmt.Errorf("failed to serialize dump: %v", err)
+	}
+	if d.sealer != nil {
+		sealed, err := d.sealer.Encrypt(content)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt dump: %v", err)
+		}
+		content = []byte(sealed)
+	}
+	if _, err := d.w.Write(append(content, '\n')); err != nil {
+		return fmt.Errorf("failed to write dump: %v", err)
+	}
+	return nil
+}
+
+// Load creates the databases and tables of a dump written by Dump, with their primary keys and options, and writes
+// their records as they were dumped, without running hooks, rules or generated fields, or logging them to the commit
+// log. Databases that exist already get the tables of the dump added, and a table that exists already fails the load
+// with an error wrapping ErrNameTaken. The records are encrypted with the keys of this server, so a dump migrates
+// data between servers with different encryption keys. Tables created before a failure are left in place.
+//
+// Parameters:
+// - r: The reader the dump is read from, compressed or not.
+// - options: The key the dump was encrypted with, if any.
+//
+// Returns:
+// - The number of databases, tables and records loaded.
+// - An error, if the dump is invalid, truncated, of a newer version, encrypted with another key, or a table cannot be created or written. If the operation is successful, the error is nil.
+func (s *Server) Load(r io.Reader, options LoadOptions) (*DumpStats, error) {
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	in := bufio.NewReader(r)
+	if magic, err := in.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		decompressor, err := gzip.NewReader(in)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read compressed dump: %v", err)
+		}
+		defer decompressor.Close()
+		in = bufio.NewReader(decompressor)
+	}
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 256*1024*1024)
+
+	var header dumpLine
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("failed to read dump: %w", scannerErr(scanner))
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Type != "header" || header.Format != DumpFormat {
+		return nil, errors.New("not a dbproto dump")
+	}
+	if header.Version > DumpVersion {
+		return nil, fmt.Errorf("dump version %d is newer than this version supports", header.Version)
+	}
+	var opener *utils.Utils
+	if header.Encrypted {
+		if len(options.Key) == 0 {
+			return nil, errors.New("the dump is encrypted, its key is required")
+		}
+		var err error
+		if opener, err = utils.NewUtilsWithKey(options.Key); err != nil {
+			return nil, fmt.Errorf("invalid dump key: %v", err)
+		}
+	}
+
+	loader := &dumpLoader{server: s, stats: &DumpStats{}}
+	for lineNumber := 2; scanner.Scan(); lineNumber++ {
+		content := scanner.Bytes()
+		if opener != nil {
+			opened, err := opener.Decrypt(string(content))
+			if err != nil {
+				return nil, fmt.Errorf("line %d of dump: %v", lineNumber, err)
+			}
+			content = opened
+		}
+		var line dumpLine
+		if err := json.Unmarshal(content, &line); err != nil {
+			return nil, fmt.Errorf("line %d of dump: %v", lineNumber, err)
+		}
+		done, err := loader.apply(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d of dump: %w", lineNumber, err)
+		}
+		if done {
+			return loader.stats, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read dump: %v", err)
+	}
+	return nil, errors.New("the dump is truncated, it has no end")
+}
+
+// scannerErr returns the error of the scanner, or io.ErrUnexpectedEOF if it reached the end of its input.
+func scannerErr(scanner *bufio.Scanner) error {
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// dumpLoader applies the lines of a dump to a server. The records of a table are gathered and written once its
+// last record has been read.
+type dumpLoader struct {
+	server   *Server
+	stats    *DumpStats
+	database *Database
+	table    *Table
+	records  map[string]*dbdata.Record
+}
+
+// apply applies a line of the dump, and reports whether it was the end.
+func (l *dumpLoader) apply(line dumpLine) (bool, error) {
+	if line.Type != "record" {
+		if err := l.flush(); err != nil {
+			return false, err
+		}
+	}
+	switch line.Type {
+	case "database":
+		db, err := l.server.Database(line.Database)
+		if errors.Is(err, ErrDatabaseNotFound) {
+			if err := l.server.CreateDatabase(line.Database); err != nil {
+				return false, err
+			}
+			db, err = l.server.Database(line.Database)
+		}
+		if err != nil {
+			return false, err
+		}
+		l.database = db
+		l.stats.Databases++
+	case "table":
+		if l.database == nil || line.Database != l.database.Name || line.Options == nil {
+			return false, errors.New("table outside of its database")
+		}
+		if err := l.database.CreateTableWithOptions(line.Table, line.PrimaryKey, *line.Options); err != nil {
+			return false, err
+		}
+		table, err := l.database.lookupTable(line.Table)
+		if err != nil {
+			return false, err
+		}
+		l.table = table
+		l.records = make(map[string]*dbdata.Record)
+		l.stats.Tables++
+	case "record":
+		if l.table == nil {
+			return false, errors.New("record outside of a table")
+		}
+		record := &dbdata.Record{}
+		if err := protojson.Unmarshal(line.Record, record); err != nil {
+			return false, fmt.Errorf("invalid record %s: %v", line.Key, err)
+		}
+		sealRecord(record)
+		l.records[line.Key] = record
+		l.stats.Records++
+	case "end":
+		if line.DumpStats == nil || *line.DumpStats != *l.stats {
+			return false, errors.New("the dump does not hold what its end counts, it is incomplete")
+		}
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown line type %q", line.Type)
+	}
+	return false, nil
+}
+
+// flush writes the records gathered for the current table.
+func (l *dumpLoader) flush() error {
+	if l.table == nil {
+		return nil
+	}
+	table, records := l.table, l.records
+	l.table, l.records = nil, nil
+	if len(records) == 0 {
+		return nil
+	}
+	return table.load(records)
+}
+
+// load replaces the records of the table with the given sealed records and writes them, without hooks, rules,
+// generated fields or logging, as the records were already written once.
+func (t *Table) load(records map[string]*dbdata.Record) error {
+	unlock, err := t.lockWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	allRecords, err := t.recordsForWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	for key, record := range records {
+		allRecords.Records[key] = record
+	}
+	t.Cache.Clear()
+	return t.writeRecordsToFile(allRecords)
+}
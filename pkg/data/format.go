@@ -0,0 +1,86 @@
+package data
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// RecordsFormatVersion is the format version of the records files written by this version, and of the records the
+// HTTP API answers with in protobuf, see dbdata.Records.
+// Files of version 0 stored integers as "num:" strings and strings that look like integers, as well as the primary
+// keys of records holding them, with a "str:" prefix.
+const RecordsFormatVersion = 1
+
+// legacyIntPrefix and legacyStringPrefix are the prefixes of the strings version 0 files stored integers and strings
+// that look like integers as.
+const (
+	legacyIntPrefix    = "num:"
+	legacyStringPrefix = "str:"
+)
+
+// upgradeRecords converts records read from a file of an older format version to the current one, so that the rest
+// of the table only deals with native values. The file itself is upgraded by the next write.
+//
+// Records that do not match their checksum are left as they are, so that they are still reported as corrupted, and
+// records whose upgraded primary key is already taken keep their old key.
+func upgradeRecords(records *dbdata.Records) {
+	renamed := make(map[string]string)
+	for key, record := range records.Records {
+		if len(record.Checksum) > 0 && !bytes.Equal(record.Checksum, recordChecksum(record)) {
+			continue
+		}
+		changed := false
+		for field, value := range record.Fields {
+			if upgraded, ok := upgradeValue(value); ok {
+				record.Fields[field] = upgraded
+				changed = true
+			}
+		}
+		if changed && len(record.Checksum) > 0 {
+			sealRecord(record)
+		}
+		if upgraded, ok := upgradeString(key); ok {
+			renamed[key] = keyString(upgraded)
+		}
+	}
+	for oldKey, newKey := range renamed {
+		if _, taken := records.Records[newKey]; taken {
+			continue
+		}
+		records.Records[newKey] = records.Records[oldKey]
+		delete(records.Records, oldKey)
+	}
+	records.FormatVersion = RecordsFormatVersion
+}
+
+// upgradeValue returns the native form of a value stored with a legacy prefix, and false if it has none.
+func upgradeValue(value *dbdata.Value) (*dbdata.Value, bool) {
+	s, ok := value.GetKind().(*dbdata.Value_StringValue)
+	if !ok {
+		return nil, false
+	}
+	return upgradeString(s.StringValue)
+}
+
+// upgradeString returns the native value of a string stored with a legacy prefix, and false if it has none. Like
+// version 0 files were read, only prefixes followed by at least one character are recognized, and "num:" strings
+// that are not integers are kept.
+func upgradeString(s string) (*dbdata.Value, bool) {
+	if len(s) <= len(legacyIntPrefix) {
+		return nil, false
+	}
+	if rest, found := strings.CutPrefix(s, legacyIntPrefix); found {
+		i, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		return dbdata.NewIntValue(i), true
+	}
+	if rest, found := strings.CutPrefix(s, legacyStringPrefix); found {
+		return dbdata.NewStringValue(rest), true
+	}
+	return nil, false
+}
@@ -0,0 +1,199 @@
+package data
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Names of the fields maintained by tables with the Timestamps option.
+const (
+	CreatedAtField = "created_at" // CreatedAtField holds the time a record was inserted.
+	UpdatedAtField = "updated_at" // UpdatedAtField holds the time a record was last inserted or updated.
+)
+
+// IDGenerator generates the primary keys of records inserted without one into tables with the AutoID option.
+// NewID must be safe for concurrent use and never return the same key twice.
+type IDGenerator interface {
+	NewID() string
+}
+
+// Clock tells the time for the timestamps maintained by tables with the Timestamps option.
+type Clock interface {
+	Now() time.Time
+}
+
+// IDGeneratorFunc adapts a function to an IDGenerator, for example to inject a deterministic sequence in tests.
+type IDGeneratorFunc func() string
+
+// NewID returns f().
+func (f IDGeneratorFunc) NewID() string {
+	return f()
+}
+
+// ClockFunc adapts a function to a Clock, for example to freeze or step the time in tests.
+type ClockFunc func() time.Time
+
+// Now returns f().
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// Generators holds the sources of the server-generated fields of a table. A nil field uses the default:
+// random 128-bit keys and the system clock.
+type Generators struct {
+	IDs   IDGenerator // IDs generates the primary keys of AutoID tables.
+	Clock Clock       // Clock tells the time of the timestamps of Timestamps tables.
+}
+
+// SetGenerators sets the sources of the generated primary keys and timestamps of the table.
+func (t *Table) SetGenerators(generators Generators) {
+	t.Lock()
+	defer t.Unlock()
+	t.generators = generators
+}
+
+// withGeneratedFields returns the record with the server-generated fields enabled by the table options filled in:
+// a primary key from the ID generator when AutoID is set and the record has none, and timestamps in UTC from the
+// clock when Timestamps is set. The given record is not modified. The caller must hold the table write lock.
+func (t *Table) withGeneratedFields(record Record, inserting bool) Record {
+	if !t.Options.AutoID && !t.Options.Timestamps {
+		return record
+	}
+
+	generated := make(Record, len(record)+2)
+	for field, value := range record {
+		generated[field] = value
+	}
+	if inserting && t.Options.AutoID {
+		if value, exists := generated[t.PrimaryKey]; !exists || value == nil || value == "" {
+			if t.generators.IDs != nil {
+				generated[t.PrimaryKey] = t.generators.IDs.NewID()
+			} else {
+				generated[t.PrimaryKey] = newRecordID()
+			}
+		}
+	}
+	if t.Options.Timestamps {
+		stamp := now(t.generators.Clock).UTC()
+		if inserting {
+			generated[CreatedAtField] = stamp
+		}
+		generated[UpdatedAtField] = stamp
+	}
+	return generated
+}
+
+// newRecordID returns a random 128-bit identifier encoded as 32 hexadecimal characters.
+func newRecordID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+	return hex.EncodeToString(id)
+}
+
+// now returns the time of clock, or the system time if clock is nil.
+func now(clock Clock) time.Time {
+	if clock == nil {
+		return time.Now()
+	}
+	return clock.Now()
+}
+
+// UUIDv7Generator generates version 7 UUIDs (RFC 9562): a millisecond timestamp followed by random bits, so keys
+// sort in the order they were generated and servers generating keys independently do not collide.
+// Keys generated within the same millisecond use a counter in place of the first random bits to stay ordered.
+type UUIDv7Generator struct {
+	Clock Clock // Clock tells the time of the keys, the system clock if nil.
+
+	mu       sync.Mutex
+	lastMS   int64
+	sequence uint16
+}
+
+// NewID returns a new UUID in its canonical 36 character form.
+func (g *UUIDv7Generator) NewID() string {
+	var uuid [16]byte
+	if _, err := rand.Read(uuid[:]); err != nil {
+		panic(err) // crypto/rand never fails on supported platforms
+	}
+
+	g.mu.Lock()
+	ms := now(g.Clock).UnixMilli()
+	if ms <= g.lastMS {
+		// Same millisecond, or the clock went back: keep the last timestamp and count up
+		ms = g.lastMS
+		g.sequence = (g.sequence + 1) & 0x0fff
+		if g.sequence == 0 {
+			ms++ // The counter wrapped, borrow the next millisecond
+		}
+	} else {
+		g.sequence = binary.BigEndian.Uint16(uuid[6:8]) & 0x07ff // Start low so the counter rarely wraps
+	}
+	g.lastMS = ms
+	sequence := g.sequence
+	g.mu.Unlock()
+
+	uuid[0] = byte(ms >> 40)
+	uuid[1] = byte(ms >> 32)
+	uuid[2] = byte(ms >> 24)
+	uuid[3] = byte(ms >> 16)
+	uuid[4] = byte(ms >> 8)
+	uuid[5] = byte(ms)
+	uuid[6] = 0x70 | byte(sequence>>8) // Version 7
+	uuid[7] = byte(sequence)
+	uuid[8] = 0x80 | uuid[8]&0x3f // RFC 9562 variant
+
+	encoded := hex.EncodeToString(uuid[:])
+	return encoded[0:8] + "-" + encoded[8:12] + "-" + encoded[12:16] + "-" + encoded[16:20] + "-" + encoded[20:32]
+}
+
+// SnowflakeEpoch is the time from which SnowflakeGenerator counts milliseconds.
+var SnowflakeEpoch = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// MaxSnowflakeNode is the highest node ID of a SnowflakeGenerator.
+const MaxSnowflakeNode = 1<<10 - 1
+
+// SnowflakeGenerator generates Snowflake-style keys: 41 bits of milliseconds since SnowflakeEpoch, a 10-bit node ID
+// and a 12-bit sequence within the millisecond. Servers of a cluster given distinct node IDs never generate the same
+// key. Keys are written as 16 hexadecimal characters, so they sort as strings in the order they were generated.
+type SnowflakeGenerator struct {
+	Clock Clock // Clock tells the time of the keys, the system clock if nil.
+
+	node     int64
+	mu       sync.Mutex
+	lastMS   int64
+	sequence int64
+}
+
+// NewSnowflakeGenerator returns a SnowflakeGenerator for the given node ID, between 0 and MaxSnowflakeNode.
+func NewSnowflakeGenerator(node int) (*SnowflakeGenerator, error) {
+	if node < 0 || node > MaxSnowflakeNode {
+		return nil, fmt.Errorf("snowflake node ID %d is out of range 0-%d", node, MaxSnowflakeNode)
+	}
+	return &SnowflakeGenerator{node: int64(node)}, nil
+}
+
+// NewID returns a new key. If the 4096 keys of a millisecond are used up, the next keys borrow the following
+// milliseconds, so the generator never blocks.
+func (g *SnowflakeGenerator) NewID() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := now(g.Clock).Sub(SnowflakeEpoch).Milliseconds()
+	if ms <= g.lastMS {
+		ms = g.lastMS
+		g.sequence = (g.sequence + 1) & 0x0fff
+		if g.sequence == 0 {
+			ms++
+		}
+	} else {
+		g.sequence = 0
+	}
+	g.lastMS = ms
+	return fmt.Sprintf("%016x", ms<<22|g.node<<12|g.sequence)
+}
@@ -0,0 +1,159 @@
+package data
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// tableHooks holds the trigger hooks registered on a table. They are registered and run while holding the table
+// write lock.
+type tableHooks struct {
+	beforeInsert []func(record Record) error
+	beforeUpdate []func(key string, current, updates Record) error
+	beforeDelete []func(key string, record Record) error
+	after        map[string][]func(event ChangeEvent) // After hooks keyed by operation
+}
+
+// BeforeInsert registers a hook that runs before every insert into the table, including inserts of transactions,
+// before the server-generated fields are filled in. The hook gets a copy of the record, which it may change to
+// set derived fields, and rejects the insert by returning an error.
+//
+// Hooks run in the order they were registered while the table is write locked, so they must not use the table.
+func (t *Table) BeforeInsert(hook func(record Record) error) {
+	t.Lock()
+	defer t.Unlock()
+	t.hooks.beforeInsert = append(t.hooks.beforeInsert, hook)
+}
+
+// BeforeUpdate registers a hook that runs before every update of a record of the table, like BeforeInsert. The hook
+// gets the primary key and the stored record, which it must not change, and a copy of the updates, which it may
+// change. Updates of several records, such as UpdateWhere, run the hook once per record and are rejected as a
+// whole if it rejects any of them.
+func (t *Table) BeforeUpdate(hook func(key string, current, updates Record) error) {
+	t.Lock()
+	defer t.Unlock()
+	t.hooks.beforeUpdate = append(t.hooks.beforeUpdate, hook)
+}
+
+// BeforeDelete registers a hook that runs before every delete of a record of the table, like BeforeInsert. The hook
+// gets the primary key and the stored record, and rejects the delete by returning an error.
+func (t *Table) BeforeDelete(hook func(key string, record Record) error) {
+	t.Lock()
+	defer t.Unlock()
+	t.hooks.beforeDelete = append(t.hooks.beforeDelete, hook)
+}
+
+// AfterInsert registers a hook that runs after every insert into the table is written, with the inserted record in
+// event.After. Like the events of Watch, it also runs for the records restored by a transaction rollback.
+// The hook runs while the table is write locked, so it must not use the table.
+func (t *Table) AfterInsert(hook func(event ChangeEvent)) {
+	t.addAfterHook("insert", hook)
+}
+
+// AfterUpdate registers a hook that runs after every update of a record of the table is written, like AfterInsert,
+// with the record before and after the update in event.Before and event.After.
+func (t *Table) AfterUpdate(hook func(event ChangeEvent)) {
+	t.addAfterHook("update", hook)
+}
+
+// AfterDelete registers a hook that runs after every delete of a record of the table is written, like AfterInsert,
+// with the deleted record in event.Before.
+func (t *Table) AfterDelete(hook func(event ChangeEvent)) {
+	t.addAfterHook("delete", hook)
+}
+
+// addAfterHook registers a hook that runs after every written change of the given operation.
+func (t *Table) addAfterHook(operation string, hook func(event ChangeEvent)) {
+	t.Lock()
+	defer t.Unlock()
+	if t.hooks.after == nil {
+		t.hooks.after = make(map[string][]func(event ChangeEvent))
+	}
+	t.hooks.after[operation] = append(t.hooks.after[operation], hook)
+}
+
+// beforeInsert runs the BeforeInsert hooks on a copy of the record and returns the copy, or the record itself if
+// there are no hooks. The caller must hold the table write lock.
+func (t *Table) beforeInsert(record Record) (Record, error) {
+	if len(t.hooks.beforeInsert) == 0 {
+		return record, nil
+	}
+	record = copyRecord(record)
+	if record == nil {
+		record = make(Record)
+	}
+	for _, hook := range t.hooks.beforeInsert {
+		if err := hook(record); err != nil {
+			return nil, fmt.Errorf("insert rejected: %w", err)
+		}
+	}
+	return record, nil
+}
+
+// beforeUpdate runs the BeforeUpdate hooks on a copy of the updates of the stored record with the given key and
+// returns the copy, or the updates themselves if there are no hooks. The caller must hold the table write lock.
+func (t *Table) beforeUpdate(key string, current *dbdata.Record, updates Record) (Record, error) {
+	if len(t.hooks.beforeUpdate) == 0 {
+		return updates, nil
+	}
+	stored, err := fromProtoRecord(current)
+	if err != nil {
+		return nil, err
+	}
+	updates = copyRecord(updates)
+	if updates == nil {
+		updates = make(Record)
+	}
+	for _, hook := range t.hooks.beforeUpdate {
+		if err := hook(key, stored, updates); err != nil {
+			return nil, fmt.Errorf("update of record %s rejected: %w", key, err)
+		}
+	}
+	return updates, nil
+}
+
+// beforeDelete runs the BeforeDelete hooks on the stored record with the given key.
+// The caller must hold the table write lock.
+func (t *Table) beforeDelete(key string, current *dbdata.Record) error {
+	if len(t.hooks.beforeDelete) == 0 {
+		return nil
+	}
+	stored, err := fromProtoRecord(current)
+	if err != nil {
+		return err
+	}
+	for _, hook := range t.hooks.beforeDelete {
+		if err := hook(key, stored); err != nil {
+			return fmt.Errorf("delete of record %s rejected: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// runAfterHooks runs the After hooks of a written change. The caller must hold the table write lock.
+func (t *Table) runAfterHooks(operation, key string, before, after *dbdata.Record) {
+	hooks := t.hooks.after[operation]
+	if len(hooks) == 0 {
+		return
+	}
+	event := ChangeEvent{Operation: operation, Key: key, Time: time.Now().UTC(), RequestID: t.requestID}
+	var err error
+	if before != nil {
+		if event.Before, err = fromProtoRecord(before); err != nil {
+			log.Printf("Failed to convert record %s for the %s hooks%s: %v", key, operation, t.requestSuffix(), err)
+			return
+		}
+	}
+	if after != nil {
+		if event.After, err = fromProtoRecord(after); err != nil {
+			log.Printf("Failed to convert record %s for the %s hooks%s: %v", key, operation, t.requestSuffix(), err)
+			return
+		}
+	}
+	for _, hook := range hooks {
+		hook(event)
+	}
+}
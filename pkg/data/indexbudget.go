@@ -0,0 +1,477 @@
+package data
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// DefaultIndexBudgetInterval is how often an IndexBudget without an interval is enforced.
+const DefaultIndexBudgetInterval = 10 * time.Second
+
+// The estimated memory of an index, which the index budget adds up: a pointer for every indexed record, plus the
+// index itself and its name.
+const (
+	indexEntryBytes    = 8
+	indexOverheadBytes = 64
+)
+
+// IndexBudget caps the memory the indexes of every table of a server take. Whenever the indexes held in memory take
+// more than MaxBytes, the least recently used ones are spilled to disk: the keys of their records are written to a
+// file and their records dropped from the index, until the rest fits. A query that needs a spilled index pages it
+// back in from that file, and writes carry spilled indexes over by the keys they change without paging them in.
+type IndexBudget struct {
+	MaxBytes int64         `json:"maxBytes"`      // MaxBytes is the estimated memory in bytes the indexes in memory take at most.
+	Interval time.Duration `json:"interval"`      // Interval is how often the budget is enforced, DefaultIndexBudgetInterval if 0.
+	Dir      string        `json:"dir,omitempty"` // Dir is where spilled indexes are written, the temporary directory if empty.
+}
+
+// IndexUsage is the memory taken by the indexes of a table, as reported by the metrics API.
+type IndexUsage struct {
+	Indexes int   `json:"indexes"` // Indexes is the number of indexed fields and nested paths.
+	Spilled int   `json:"spilled"` // Spilled is the number of indexes spilled to disk by the index budget.
+	Bytes   int64 `json:"bytes"`   // Bytes is the estimated memory in bytes of the indexes held in memory.
+	PageIns int64 `json:"pageIns"` // PageIns is the number of times a spilled index was paged back in.
+}
+
+// indexState tracks the indexes of a table spilled to disk by the index budget.
+type indexState struct {
+	pageIns atomic.Int64      // Spilled indexes paged back in since the table was opened
+	files   map[string]string // Latest spill file of every field, guarded by the table write lock
+}
+
+// indexSpill is the copy of an index spilled to disk: the file holding the keys of its records when it was spilled,
+// and the keys of the records written since then, with whether they are in the index now. It is never changed once
+// the partitions of a snapshot share it.
+type indexSpill struct {
+	path    string
+	changes map[string]bool
+}
+
+// indexPartition is the index of a field in a snapshot. Its records are held in memory, or spilled to disk by the
+// index budget and paged back in by the first read that needs them; either way, it indexes the same records.
+type indexPartition struct {
+	field   string
+	count   int                              // Number of records that have the field
+	entries atomic.Pointer[[]*dbdata.Record] // Records that have the field, nil while the index is spilled
+	spill   atomic.Pointer[indexSpill]       // Copy on disk, nil if the index was never spilled
+	lastUse atomic.Int64                     // Unix nanoseconds of the last read of the index
+	lock    sync.Mutex                       // Serializes paging the index in and spilling it
+	state   *indexState                      // Spill state of the table, which counts the page-ins
+}
+
+// newIndexPartition returns the index of the field holding the given records in memory.
+func newIndexPartition(field string, entries []*dbdata.Record, state *indexState) *indexPartition {
+	partition := &indexPartition{field: field, count: len(entries), state: state}
+	partition.entries.Store(&entries)
+	partition.lastUse.Store(time.Now().UnixNano())
+	return partition
+}
+
+// bytes returns the estimated memory of the index when it is held in memory.
+func (p *indexPartition) bytes() int64 {
+	return int64(indexOverheadBytes + len(p.field) + p.count*indexEntryBytes)
+}
+
+// spilled reports whether the records of the index are only on disk.
+func (p *indexPartition) spilled() bool {
+	return p.entries.Load() == nil
+}
+
+// load returns the records of the index, paging them in first if the index is spilled. records are the records of
+// the snapshot of the index, which the keys in the spill file are resolved against. An index whose spill file
+// cannot be read is rebuilt from the records instead.
+func (p *indexPartition) load(records map[string]*dbdata.Record) []*dbdata.Record {
+	p.lastUse.Store(time.Now().UnixNano())
+	if entries := p.entries.Load(); entries != nil {
+		return *entries
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if entries := p.entries.Load(); entries != nil {
+		return *entries
+	}
+	entries, err := p.readSpill(records)
+	if err != nil {
+		log.Printf("Rebuilding index '%s' from the records, as its spilled copy cannot be read: %v", p.field, err)
+		entries = scanIndex(records, p.field)
+	}
+	p.entries.Store(&entries)
+	p.state.pageIns.Add(1)
+	return entries
+}
+
+// scanIndex returns the records that have the field, for an index whose spill file is gone.
+func scanIndex(records map[string]*dbdata.Record, field string) []*dbdata.Record {
+	var entries []*dbdata.Record
+	for _, record := range records {
+		if isIndexed(record, field) {
+			entries = append(entries, record)
+		}
+	}
+	return entries
+}
+
+// readSpill reads the keys of the spilled index back from its file, applies the changes made since it was written
+// and returns their records.
+func (p *indexPartition) readSpill(records map[string]*dbdata.Record) ([]*dbdata.Record, error) {
+	spill := p.spill.Load()
+	if spill == nil {
+		return nil, fmt.Errorf("the index was never spilled")
+	}
+	stored, err := os.ReadFile(spill.path)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*dbdata.Record, 0, p.count)
+	add := func(key string) error {
+		record, exists := records[key]
+		if !exists {
+			return fmt.Errorf("record %s is not in the table", key)
+		}
+		entries = append(entries, record)
+		return nil
+	}
+	for len(stored) > 0 {
+		length, n := binary.Uvarint(stored)
+		if n <= 0 || uint64(len(stored)-n) < length {
+			return nil, fmt.Errorf("truncated spill file %s", spill.path)
+		}
+		key := string(stored[n : n+int(length)])
+		stored = stored[n+int(length):]
+		if _, changed := spill.changes[key]; changed {
+			continue
+		}
+		if err := add(key); err != nil {
+			return nil, err
+		}
+	}
+	for key, indexed := range spill.changes {
+		if !indexed {
+			continue
+		}
+		if err := add(key); err != nil {
+			return nil, err
+		}
+	}
+	if len(entries) != p.count {
+		return nil, fmt.Errorf("spill file %s holds %d records instead of %d", spill.path, len(entries), p.count)
+	}
+	return entries, nil
+}
+
+// spillTo writes the keys of the records of the index to a new file in dir, unless the file it was paged in from
+// still holds them, and drops the records from memory. keys maps the records of the snapshot of the index to their
+// primary key. It returns the path of the file written, or "" if none was.
+func (p *indexPartition) spillTo(dir string, keys map[*dbdata.Record]string) (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	entries := p.entries.Load()
+	if entries == nil {
+		return "", nil
+	}
+	if spill := p.spill.Load(); spill != nil && len(spill.changes) == 0 {
+		if _, err := os.Stat(spill.path); err == nil {
+			p.entries.Store(nil)
+			return "", nil
+		}
+	}
+
+	file, err := os.CreateTemp(dir, "index-*.keys")
+	if err != nil {
+		return "", err
+	}
+	writer := bufio.NewWriter(file)
+	var buf []byte
+	for _, record := range *entries {
+		key := keys[record]
+		buf = binary.AppendUvarint(buf[:0], uint64(len(key)))
+		buf = append(buf, key...)
+		if _, err = writer.Write(buf); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	p.spill.Store(&indexSpill{path: file.Name()})
+	p.entries.Store(nil)
+	return file.Name(), nil
+}
+
+// carrySpilledIndexes returns the indexes of the previous snapshot that are spilled to disk, carried over to the
+// records about to be published with the keys of the records that changed in between, see carrySpilledIndex. The
+// caller must hold the table write lock.
+func (t *Table) carrySpilledIndexes(previous *snapshot, records map[string]*dbdata.Record) map[string]*indexPartition {
+	if previous == nil {
+		return nil
+	}
+	var carried map[string]*indexPartition
+	var changed map[string]struct{}
+	for field, partition := range previous.indexes {
+		if partition.spill.Load() == nil || !partition.spilled() {
+			continue
+		}
+		if changed == nil {
+			changed = changedKeys(previous.records, records)
+		}
+		next := t.carrySpilledIndex(partition, previous.records, records, changed)
+		if next == nil {
+			continue
+		}
+		if carried == nil {
+			carried = make(map[string]*indexPartition)
+		}
+		carried[field] = next
+	}
+	return carried
+}
+
+// carrySpilledIndex returns the spilled index of the previous records carried over to the records about to be
+// published: it keeps its spill file, with the given keys of the records that changed in between added to its
+// changes. It returns nil for an index the records emptied or changed too much, by more than a quarter of its
+// records, which is rebuilt in memory instead, and spilled again by the next run of the index budget if it still
+// does not fit. The caller must hold the table write lock.
+func (t *Table) carrySpilledIndex(partition *indexPartition, previous, records map[string]*dbdata.Record, changed map[string]struct{}) *indexPartition {
+	spill := partition.spill.Load()
+	count := partition.count
+	changes := maps.Clone(spill.changes)
+	for key := range changed {
+		was := indexedIn(previous, key, partition.field)
+		now := indexedIn(records, key, partition.field)
+		if !was && !now {
+			continue
+		}
+		if changes == nil {
+			changes = make(map[string]bool)
+		}
+		changes[key] = now
+		if was && !now {
+			count--
+		} else if now && !was {
+			count++
+		}
+	}
+	if count == 0 || len(changes) > count/4 {
+		return nil
+	}
+	next := &indexPartition{field: partition.field, count: count, state: &t.indexes}
+	next.spill.Store(&indexSpill{path: spill.path, changes: changes})
+	next.lastUse.Store(partition.lastUse.Load())
+	return next
+}
+
+// indexedIn reports whether the record stored under key has the indexed field.
+func indexedIn(records map[string]*dbdata.Record, key, field string) bool {
+	record, exists := records[key]
+	return exists && record != nil && isIndexed(record, field)
+}
+
+// forgetSpillFiles removes the spill files that none of the indexes about to be published uses. Older snapshots may
+// still point at them, in which case they rebuild the index from their records if they need it. The caller must hold
+// the table write lock.
+func (t *Table) forgetSpillFiles(partitions map[string]*indexPartition) {
+	for field, path := range t.indexes.files {
+		if partition := partitions[field]; partition != nil {
+			if spill := partition.spill.Load(); spill != nil && spill.path == path {
+				continue
+			}
+		}
+		os.Remove(path)
+		delete(t.indexes.files, field)
+	}
+}
+
+// removeSpillFiles removes every spill file of the table, once its records are dropped from memory. The caller must
+// hold the table write lock.
+func (t *Table) removeSpillFiles() {
+	t.forgetSpillFiles(nil)
+}
+
+// spillIndexes spills the given indexes of the current snapshot to files in dir, and returns the estimated memory
+// freed. The indexes are looked up in the snapshot current by then, and those already spilled are left as they are.
+func (t *Table) spillIndexes(fields []string, dir string) (int64, error) {
+	t.Lock()
+	defer t.Unlock()
+	snap := t.current.Load()
+	if snap == nil || t.dropped || t.virtual || t.temporary {
+		return 0, nil
+	}
+	keys := make(map[*dbdata.Record]string, len(snap.records))
+	for key, record := range snap.records {
+		keys[record] = key
+	}
+
+	var freed int64
+	for _, field := range fields {
+		partition := snap.indexes[field]
+		if partition == nil || partition.spilled() {
+			continue
+		}
+		path, err := partition.spillTo(dir, keys)
+		if err != nil {
+			return freed, fmt.Errorf("failed to spill index '%s': %w", field, err)
+		}
+		if path != "" {
+			if previous, exists := t.indexes.files[field]; exists && previous != path {
+				os.Remove(previous)
+			}
+			if t.indexes.files == nil {
+				t.indexes.files = make(map[string]string)
+			}
+			t.indexes.files[field] = path
+		}
+		delete(t.Indexes, field)
+		freed += partition.bytes()
+	}
+	return freed, nil
+}
+
+// IndexUsage returns the number of indexes of the table, how many of them are spilled to disk and the estimated
+// memory of the others, without reading evicted tables back into memory.
+func (t *Table) IndexUsage() IndexUsage {
+	usage := IndexUsage{PageIns: t.indexes.pageIns.Load()}
+	snap := t.current.Load()
+	if snap == nil {
+		return usage
+	}
+	usage.Indexes = len(snap.indexes)
+	for _, partition := range snap.indexes {
+		if partition.spilled() {
+			usage.Spilled++
+		} else {
+			usage.Bytes += partition.bytes()
+		}
+	}
+	return usage
+}
+
+// IndexMemoryLimit returns the MaxBytes of the index budget the server enforces, or 0 if it enforces none.
+func (s *Server) IndexMemoryLimit() int64 {
+	return s.indexLimit.Load()
+}
+
+// RunIndexBudget enforces the index budget on the tables of every database of the server, and of its tenants, every
+// interval of the budget until ctx is done. Spilled indexes are written to a directory it creates in the Dir of the
+// budget, which it removes when it returns; the indexes still spilled then are rebuilt from their records by the
+// first read that needs them.
+//
+// Parameters:
+// - ctx: The context that stops enforcing the budget when done.
+// - budget: The estimated memory the indexes take at most, and how often it is enforced.
+//
+// Returns:
+// - An error if the budget is invalid or the spill directory cannot be created, or else ctx.Err() once ctx is done, or
+// ErrClosed once the server is closed.
+func (s *Server) RunIndexBudget(ctx context.Context, budget IndexBudget) error {
+	if budget.MaxBytes <= 0 {
+		return fmt.Errorf("invalid index memory limit of %d bytes, expected a positive number", budget.MaxBytes)
+	}
+	dir, err := os.MkdirTemp(budget.Dir, "dbproto-indexes-")
+	if err != nil {
+		return fmt.Errorf("failed to create the index spill directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	s.indexLimit.Store(budget.MaxBytes)
+	defer s.indexLimit.Store(0)
+
+	interval := budget.Interval
+	if interval <= 0 {
+		interval = DefaultIndexBudgetInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.stopped:
+			return ErrClosed
+		case <-ticker.C:
+			s.applyIndexBudget(budget.MaxBytes, dir)
+		}
+	}
+}
+
+// spillCandidate is an index held in memory that the index budget may spill.
+type spillCandidate struct {
+	table     *Table
+	partition *indexPartition
+}
+
+// applyIndexBudget spills the least recently used indexes held in memory to dir until the others take at most limit
+// bytes.
+func (s *Server) applyIndexBudget(limit int64, dir string) {
+	candidates := s.residentIndexes(nil)
+	var total int64
+	for _, candidate := range candidates {
+		total += candidate.partition.bytes()
+	}
+	if total <= limit {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].partition.lastUse.Load() < candidates[j].partition.lastUse.Load()
+	})
+	var tables []*Table
+	fields := make(map[*Table][]string)
+	for _, candidate := range candidates {
+		if total <= limit {
+			break
+		}
+		if _, exists := fields[candidate.table]; !exists {
+			tables = append(tables, candidate.table)
+		}
+		fields[candidate.table] = append(fields[candidate.table], candidate.partition.field)
+		total -= candidate.partition.bytes()
+	}
+	for _, table := range tables {
+		if _, err := table.spillIndexes(fields[table], dir); err != nil {
+			log.Printf("Failed to spill the indexes of table %s: %v", table.FilePath, err)
+		}
+	}
+}
+
+// residentIndexes appends the indexes held in memory by the tables of every database of the server and of its
+// tenants to candidates.
+func (s *Server) residentIndexes(candidates []spillCandidate) []spillCandidate {
+	for _, tenant := range s.tenantServers() {
+		candidates = tenant.residentIndexes(candidates)
+	}
+	s.RLock()
+	defer s.RUnlock()
+	for _, db := range s.Databases {
+		db.RLock()
+		for _, table := range db.Tables {
+			snap := table.current.Load()
+			if snap == nil || table.virtual || table.temporary {
+				continue
+			}
+			for _, partition := range snap.indexes {
+				if !partition.spilled() {
+					candidates = append(candidates, spillCandidate{table: table, partition: partition})
+				}
+			}
+		}
+		db.RUnlock()
+	}
+	return candidates
+}
@@ -0,0 +1,177 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+	"google.golang.org/protobuf/proto"
+)
+
+// Concurrency guarantees
+//
+// Every Table method is safe for concurrent use. The guarantees the package promises are:
+//
+//   - Each Insert, InsertMany, Update, UpdateMany, Delete and DeleteMany call is atomic: it holds the table
+//     write lock while it copies the map of records, replaces the records it changes with changed copies and
+//     writes the file back, so concurrent writers never lose each other's updates and readers never observe a half
+//     applied call. Records are never changed once published.
+//   - SelectAll, SelectWithFilter, Query, Explain and JoinTables read the current snapshot of the table without locking
+//     it. Every write publishes a new immutable snapshot once its file is written, or at once in write-behind mode,
+//     so these reads observe the state after some complete sequence of writes and neither wait for writers nor
+//     delay them.
+//   - Select holds the table read lock and also observes the state after some complete sequence of writes.
+//   - Reads observe the caller's own writes: they are served from the published snapshot, which a write replaces
+//     before it returns, so any read that starts afterwards, by the same caller or another, sees it. A write
+//     returns only once it is stored: after its file is written, or in write-behind mode after it is appended to
+//     the write-behind log and before its file is written, which happens up to IntervalMs later, or once Commits
+//     writes are pending. Reads made with ConsistencyDurable, see WithConsistency, are served from the last
+//     snapshot written to the file while writes are pending, so they only observe writes already in the file.
+//   - InsertWithTransaction, UpdateWithTransaction and DeleteWithTransaction hold the table write lock for
+//     the whole transaction, so rolling back only undoes the transaction's own changes.
+//   - Tx.Commit holds the table write lock while it applies every buffered write and writes the file once,
+//     so either all the writes of the transaction are stored or none is. MultiTx.Commit write locks every
+//     table it writes in file path order, so commits never deadlock with each other, and restores the tables
+//     already written if writing a later one fails.
+//   - Records, Indexes, the current snapshot and Cache always describe the same records once a call returns, those
+//     stored in the file unless write-behind has writes pending, or the cache policy evicted the table: then they
+//     are all empty until the next access reads the file again.
+//
+// A read followed by a write (for example Select then Update with a value derived from the result)
+// is not atomic; concurrent writers can interleave between the two calls.
+//
+// CheckInvariants verifies the last guarantee and is used by TestConcurrentReadersAndWriters, which runs
+// mixed CRUD operations, joins and transactions from many goroutines under go test -race.
+
+// CheckInvariants verifies that the in-memory state of the table is consistent with its file:
+// every stored record matches its checksum, Records holds exactly the records in the file, the current snapshot
+// holds the records of Records and their indexes, including those spilled to disk, every index entry is a record of Records that has the
+// indexed field, every indexable field of every record is indexed exactly once, the cache holds no more records than its limit, and
+// every cached record matches the stored one. While write-behind has writes pending, the file is behind the records
+// held in memory, and only its checksums are verified. It returns an error describing the first violation found.
+func (t *Table) CheckInvariants() error {
+	if _, err := t.loadSnapshot(); err != nil {
+		return fmt.Errorf("failed to load table: %v", err)
+	}
+	t.RLock()
+	defer t.RUnlock()
+
+	stored, err := t.readRecordsFromFile()
+	if err != nil {
+		return fmt.Errorf("failed to read records from file: %v", err)
+	}
+
+	if corrupted := corruptedKeys(stored.Records); len(corrupted) > 0 {
+		return fmt.Errorf("record %s does not match its checksum", corrupted[0])
+	}
+	if t.writeBehind.pending.Load() > 0 {
+		stored.Records = t.Records
+	}
+	if len(stored.Records) != len(t.Records) {
+		return fmt.Errorf("file holds %d records but memory holds %d", len(stored.Records), len(t.Records))
+	}
+	for key, record := range stored.Records {
+		inMemory, exists := t.Records[key]
+		if !exists {
+			return fmt.Errorf("record %s is in the file but not in memory", key)
+		}
+		if !proto.Equal(record, inMemory) {
+			return fmt.Errorf("record %s differs between file and memory", key)
+		}
+	}
+
+	byPointer := make(map[interface{}]string, len(t.Records))
+	for key, record := range t.Records {
+		byPointer[record] = key
+	}
+	snap := t.current.Load()
+	if snap == nil {
+		return fmt.Errorf("the table was evicted while Records was being checked")
+	}
+	if len(snap.records) != len(t.Records) {
+		return fmt.Errorf("the current snapshot differs from Records")
+	}
+	for key, record := range t.Records {
+		if snap.records[key] != record {
+			return fmt.Errorf("record %s of the current snapshot differs from Records", key)
+		}
+	}
+	for field, index := range t.Indexes {
+		if size, exists := snap.indexSize(field); !exists || size != len(index) {
+			return fmt.Errorf("index '%s' of the current snapshot differs from Indexes", field)
+		}
+	}
+	// Spilled indexes are read from their spill file without paging them in, so the check leaves them spilled. Reads
+	// rebuild an index whose spill file is gone from the records, as the check does.
+	indexes := make(map[string][]*dbdata.Record, len(snap.indexes))
+	for field, partition := range snap.indexes {
+		index := partition.entries.Load()
+		if index == nil {
+			entries, err := partition.readSpill(snap.records)
+			if errors.Is(err, fs.ErrNotExist) {
+				entries, err = scanIndex(snap.records, field), nil
+			}
+			if err != nil {
+				return fmt.Errorf("spilled index '%s' cannot be read: %v", field, err)
+			}
+			index = &entries
+		}
+		if len(*index) != partition.count {
+			return fmt.Errorf("index '%s' holds %d records instead of %d", field, len(*index), partition.count)
+		}
+		indexes[field] = *index
+	}
+	for field, index := range indexes {
+		seen := make(map[string]bool, len(index))
+		for _, record := range index {
+			key, exists := byPointer[record]
+			if !exists {
+				return fmt.Errorf("index '%s' holds a record that is not in the table", field)
+			}
+			if seen[key] {
+				return fmt.Errorf("index '%s' holds record %s more than once", field, key)
+			}
+			seen[key] = true
+			if !isIndexed(record, field) {
+				return fmt.Errorf("index '%s' holds record %s, which does not have the field", field, key)
+			}
+		}
+	}
+	for key, record := range t.Records {
+		var missing string
+		indexedPaths(record, func(field string) {
+			if missing != "" {
+				return
+			}
+			found := false
+			for _, indexed := range indexes[field] {
+				if indexed == record {
+					found = true
+					break
+				}
+			}
+			if !found {
+				missing = field
+			}
+		})
+		if missing != "" {
+			return fmt.Errorf("record %s is missing from index '%s'", key, missing)
+		}
+	}
+
+	if limit := t.Cache.Limit(); t.Cache.Len() > limit {
+		return fmt.Errorf("the cache holds %d records, over its limit of %d", t.Cache.Len(), limit)
+	}
+	var stale error
+	t.Cache.Range(func(key string, cached *dbdata.Record) bool {
+		record, exists := t.Records[key]
+		if !exists {
+			stale = fmt.Errorf("cached record %s is not in the table", key)
+		} else if !proto.Equal(cached, record) {
+			stale = fmt.Errorf("cached record %s is stale", key)
+		}
+		return stale == nil
+	})
+	return stale
+}
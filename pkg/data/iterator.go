@@ -0,0 +1,162 @@
+package data
+
+import (
+	"context"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// RecordIterator yields records of a table one at a time, from the version of the table current when it was
+// created: writes made since are not seen. It implements exports.ResettableIterator, so exports stream the records
+// of a table without copying or converting them all first.
+type RecordIterator struct {
+	ctx      context.Context
+	table    *Table
+	records  []*dbdata.Record // records are the stored records of the iteration, in order
+	computed bool             // computed is true once the computed fields of records are set
+	fields   []string         // fields, if set, are the only top-level fields kept in the returned records
+	next     int
+	scanned  int
+	cursor   string // cursor is the cursor of the page after the records of IterateQuery, empty for the last page
+	total    int    // total is the number of records matching the query of IterateQuery, before paging
+}
+
+// Iterate returns an iterator over the records of the table, in the order of their primary keys, which stops with
+// ctx.Err() once ctx is done. The iterator holds the current version of the table, never a copy of its records, so
+// later writes do not wait for it.
+//
+// Parameters:
+// - ctx: The context of the reads; the iterator stops once it is done.
+//
+// Returns:
+// - The iterator, positioned before the first record.
+// - An error if ctx is done or the records of an evicted table cannot be reloaded.
+func (t *Table) Iterate(ctx context.Context) (*RecordIterator, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	snap, err := t.readSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(snap.records))
+	for key := range snap.records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	records := make([]*dbdata.Record, len(keys))
+	for i, key := range keys {
+		records[i] = snap.records[key]
+	}
+	t.metrics.IncrementQueryCount()
+	return &RecordIterator{ctx: ctx, table: t, records: records}, nil
+}
+
+// IterateQuery returns an iterator over the records matching the query, like Query returns them: filtered by its
+// filters and conditions, sorted, paged by its offset, limit and cursor, and with only its fields if it has any. It
+// runs the query like QueryCtx, but without the limits of WithLimits on the number of records, since the iterator
+// never converts them all at once, so filtered exports of large tables stream like those of whole tables.
+//
+// Parameters:
+// - ctx: The context of the query and of the reads; the iterator stops once it is done.
+// - query: The query selecting the records.
+//
+// Returns:
+// - The iterator, positioned before the first record.
+// - An error if the query is invalid, ctx is done or the records of an evicted table cannot be reloaded.
+func (t *Table) IterateQuery(ctx context.Context, query Query) (*RecordIterator, error) {
+	start := time.Now()
+	if err := validateConditions(query.Conditions); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ctx, span := t.traceOperation(ctx, "query")
+	defer span.End()
+	snap, err := t.readSnapshot(ctx)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	plan := generateExecutionPlan(snap, query)
+	if plan.IndexToUse == "" && len(plan.Filters) > 0 {
+		fields := make([]string, 0, len(plan.Filters))
+		for field := range plan.Filters {
+			fields = append(fields, field)
+		}
+		t.metrics.IncrementFullScans(fields)
+	}
+	t.metrics.IncrementQueryCount()
+	defer t.sample("query", planKind(plan), start)
+
+	records, cursor, total, err := t.matchPlan(ctx, snap, plan)
+	span.SetAttribute("dbproto.plan", planKind(plan))
+	span.SetAttribute("dbproto.records", strconv.Itoa(len(records)))
+	span.SetError(err)
+	if err != nil {
+		return nil, err
+	}
+	return &RecordIterator{ctx: ctx, table: t, records: records, computed: true, fields: query.Fields, cursor: cursor, total: total}, nil
+}
+
+// Next returns the next record, with its computed fields, or io.EOF after the last one. The record must not be
+// modified.
+func (it *RecordIterator) Next() (*dbdata.Record, error) {
+	if err := checkScan(it.ctx, &it.scanned); err != nil {
+		return nil, limitResult(it.ctx, 0, err)
+	}
+	if it.next >= len(it.records) {
+		return nil, io.EOF
+	}
+	it.next++
+	record := it.records[it.next-1]
+	if !it.computed {
+		record = it.table.withReadFields(record)
+	}
+	if len(it.fields) > 0 {
+		projected := &dbdata.Record{Fields: make(map[string]*dbdata.Value, len(it.fields))}
+		for _, field := range it.fields {
+			if value, exists := record.Fields[field]; exists {
+				projected.Fields[field] = value
+			}
+		}
+		record = projected
+	}
+	return record, nil
+}
+
+// Reset starts the iteration over from its first record.
+func (it *RecordIterator) Reset() error {
+	it.next = 0
+	return nil
+}
+
+// Len returns the number of records of the iteration.
+func (it *RecordIterator) Len() int {
+	return len(it.records)
+}
+
+// NextCursor returns the cursor of the page after the records of an iteration of IterateQuery, like
+// QueryWithCursor, or an empty string if they are the last ones.
+func (it *RecordIterator) NextCursor() string {
+	return it.cursor
+}
+
+// Total returns the number of records matching the query of an iteration of IterateQuery before it is paged, like
+// QueryPageCtx.
+func (it *RecordIterator) Total() int {
+	return it.total
+}
+
+// CheckLimits returns a LimitExceededError if the iteration holds more records than the limits set with WithLimits on
+// its context allow, which SelectAllCtx and QueryPageCtx enforce but iterators do not, so that callers serving
+// clients the limits apply to can enforce them before reading any record. Scan limits are enforced by Next.
+func (it *RecordIterator) CheckLimits() error {
+	return limitResult(it.ctx, len(it.records), nil)
+}
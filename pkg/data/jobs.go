@@ -0,0 +1,378 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+	"github.com/Malpizarr/dbproto/pkg/exports"
+)
+
+// jobRetention is how long finished jobs are kept for their status to be read.
+const jobRetention = time.Hour
+
+// ErrJobNotFound is returned for a job that does not exist, or that finished longer than an hour ago.
+var ErrJobNotFound = errors.New("job not found")
+
+// JobStatus is the state of a job.
+type JobStatus string
+
+const (
+	JobRunning   JobStatus = "running"   // JobRunning jobs have started and not finished yet.
+	JobSucceeded JobStatus = "succeeded" // JobSucceeded jobs finished, and their Result is set.
+	JobFailed    JobStatus = "failed"    // JobFailed jobs finished with the error in their Error.
+)
+
+// JobProgress is how much of its work a job has done, counted in Unit, such as "files" or "records". Total is 0
+// until the job knows how much work it has.
+type JobProgress struct {
+	Done  int64  `json:"done"`
+	Total int64  `json:"total"`
+	Unit  string `json:"unit"`
+}
+
+// Job is a long-running operation running in the background, such as a backup, as of the moment it was read.
+type Job struct {
+	ID       string      `json:"id"`                 // ID identifies the job.
+	Kind     string      `json:"kind"`               // Kind is the operation, such as "backup" or "export".
+	Status   JobStatus   `json:"status"`             // Status is whether the job is running, succeeded or failed.
+	Progress JobProgress `json:"progress"`           // Progress is how much of its work the job has done.
+	Result   interface{} `json:"result,omitempty"`   // Result is what the job produced, such as a BackupResult, once it succeeded.
+	Error    string      `json:"error,omitempty"`    // Error is the error the job failed with.
+	Created  time.Time   `json:"created"`            // Created is when the job started.
+	Finished *time.Time  `json:"finished,omitempty"` // Finished is when the job finished, nil while it runs.
+}
+
+// ProgressFunc reports that a job has done done of total units of work.
+type ProgressFunc func(done, total int64)
+
+// report calls the function, unless it is nil.
+func (p ProgressFunc) report(done, total int64) {
+	if p != nil {
+		p(done, total)
+	}
+}
+
+// JobFunc is the work of a job. It reports its progress to progress, should stop with ctx.Err() once ctx is done,
+// and returns the result of the job.
+type JobFunc func(ctx context.Context, progress ProgressFunc) (interface{}, error)
+
+// jobRegistry holds the jobs of a server. The zero value is ready to use.
+type jobRegistry struct {
+	lock    sync.Mutex
+	jobs    map[string]*Job
+	running sync.WaitGroup
+	ctx     context.Context // Context of the jobs, canceled by StopJobs
+	cancel  context.CancelFunc
+}
+
+// BackupResult is the result of a backup job.
+type BackupResult struct {
+	Path   string   `json:"path"`             // Path is the backup file.
+	Name   string   `json:"name,omitempty"`   // Name is the name the backup was given, if any.
+	Files  int      `json:"files"`            // Files is the number of files in the backup.
+	Bytes  int64    `json:"bytes"`            // Bytes is the size of the files before compression.
+	Copy   string   `json:"copy,omitempty"`   // Copy is the location of the copy of the backup at the backup destination, if any.
+	Pruned []string `json:"pruned,omitempty"` // Pruned are the files of the older backups, and the locations of their copies, deleted by the backup retention.
+}
+
+// ExportResult is the result of an export job.
+type ExportResult struct {
+	Path    string `json:"path"`    // Path is the file the records were exported to.
+	Format  string `json:"format"`  // Format is the format of the file: csv, json or xml.
+	Records int    `json:"records"` // Records is the number of records exported.
+}
+
+// ReindexResult is the result of an index rebuild job.
+type ReindexResult struct {
+	Tables  []string `json:"tables"`  // Tables are the tables whose indexes were rebuilt.
+	Records int      `json:"records"` // Records is the number of records of the tables.
+}
+
+// StartJob runs the work in the background as a job of the given kind, whose progress is counted in unit, and
+// returns the job as it started. The job is kept after it finishes for an hour, so its result can be read with Job.
+// Jobs running when StopJobs is called have their context canceled.
+//
+// Parameters:
+// - kind: The name of the operation, such as "backup".
+// - unit: What the progress of the job counts, such as "files".
+// - run: The work of the job.
+//
+// Returns:
+// - The job, with its ID.
+func (s *Server) StartJob(kind, unit string, run JobFunc) Job {
+	return s.startJob(newJobID(), kind, unit, run)
+}
+
+// startJob starts a job with the given ID, see StartJob.
+func (s *Server) startJob(id, kind, unit string, run JobFunc) Job {
+	registry := &s.jobs
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if registry.jobs == nil {
+		registry.jobs = make(map[string]*Job)
+		registry.ctx, registry.cancel = context.WithCancel(context.Background())
+	}
+	now := time.Now().UTC()
+	for jobID, job := range registry.jobs {
+		if job.Finished != nil && now.Sub(*job.Finished) > jobRetention {
+			delete(registry.jobs, jobID)
+		}
+	}
+	job := &Job{ID: id, Kind: kind, Status: JobRunning, Progress: JobProgress{Unit: unit}, Created: now}
+	registry.jobs[id] = job
+
+	registry.running.Add(1)
+	go func(ctx context.Context) {
+		defer registry.running.Done()
+		result, err := run(ctx, func(done, total int64) {
+			registry.lock.Lock()
+			job.Progress.Done, job.Progress.Total = done, total
+			registry.lock.Unlock()
+		})
+		registry.lock.Lock()
+		defer registry.lock.Unlock()
+		finished := time.Now().UTC()
+		job.Finished = &finished
+		if err != nil {
+			job.Status, job.Error = JobFailed, err.Error()
+			log.Printf("Job %s (%s) failed: %v", job.ID, job.Kind, err)
+			return
+		}
+		job.Status, job.Result = JobSucceeded, result
+	}(registry.ctx)
+	return *job
+}
+
+// Job returns the job with the given ID as of now.
+//
+// Parameters:
+// - id: The ID of the job, as returned by StartJob.
+//
+// Returns:
+// - The job.
+// - ErrJobNotFound if there is no such job, or it finished longer than an hour ago.
+func (s *Server) Job(id string) (Job, error) {
+	s.jobs.lock.Lock()
+	defer s.jobs.lock.Unlock()
+	job, exists := s.jobs.jobs[id]
+	if !exists {
+		return Job{}, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	return *job, nil
+}
+
+// Jobs returns the running jobs and the jobs that finished within the last hour, newest first.
+func (s *Server) Jobs() []Job {
+	s.jobs.lock.Lock()
+	defer s.jobs.lock.Unlock()
+	jobs := make([]Job, 0, len(s.jobs.jobs))
+	for _, job := range s.jobs.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].Created.Equal(jobs[j].Created) {
+			return jobs[i].Created.After(jobs[j].Created)
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs
+}
+
+// StopJobs cancels the context of the running jobs, and of the jobs of the tenants, and waits for them to finish.
+// Servers should call it before they stop, so no job is cut short while it writes files.
+func (s *Server) StopJobs() {
+	for _, tenant := range s.tenantServers() {
+		tenant.StopJobs()
+	}
+	s.jobs.lock.Lock()
+	if s.jobs.cancel != nil {
+		s.jobs.cancel()
+	}
+	s.jobs.lock.Unlock()
+	s.jobs.running.Wait()
+}
+
+// StartBackup backs up the databases like CreateBackup in a "backup" job, whose progress counts the files written
+// to the backup and whose result is a BackupResult.
+//
+// Returns:
+// - The job, unless the name of the backup is invalid, in which case the error wraps ErrInvalidName.
+func (s *Server) StartBackup(options BackupOptions) (Job, error) {
+	if options.Name != "" && !ValidFilename(options.Name) {
+		return Job{}, fmt.Errorf("%w: backup name %q may only contain letters, digits, hyphens and underscores", ErrInvalidName, options.Name)
+	}
+	return s.StartJob("backup", "files", func(ctx context.Context, progress ProgressFunc) (interface{}, error) {
+		return s.createBackup(ctx, options, progress)
+	}), nil
+}
+
+// StartRestore restores the databases like Restore in a "restore" job, whose progress counts the files extracted
+// from the backup and whose result is the RestorePreview of the backup. The backup is compared with the live data
+// before the job starts, so a restore that needs a confirmation it was not given fails right away.
+//
+// Parameters:
+// - options: The backup to restore and whether destructive overwrites are confirmed.
+//
+// Returns:
+// - The job, unless the restore cannot start.
+// - The RestorePreview of the backup.
+// - ErrRestoreNotConfirmed if the restore would overwrite live data without confirmation, or an error if the backup
+// cannot be read.
+func (s *Server) StartRestore(options RestoreOptions) (Job, *RestorePreview, error) {
+	if err := s.writable(); err != nil {
+		return Job{}, nil, err
+	}
+	preview, err := s.PreviewRestore(options.Path)
+	if err != nil {
+		return Job{}, nil, err
+	}
+	if preview.Destructive() && !options.ConfirmOverwrite {
+		return Job{}, preview, ErrRestoreNotConfirmed
+	}
+	job := s.StartJob("restore", "files", func(ctx context.Context, progress ProgressFunc) (interface{}, error) {
+		return s.restore(options, progress)
+	})
+	return job, preview, nil
+}
+
+// StartExport exports the records of a table to a file of the export directory, next to the backups, in an
+// "export" job whose progress counts the records converted and whose result is an ExportResult. The file is named
+// after the table and the job, such as shop_users_3f2a9c1e0b4d5a67.csv.
+//
+// Parameters:
+// - dbName: The database of the table.
+// - tableName: The table to export.
+// - format: The format of the file: csv, json, xml or parquet, whose columns have the types of the table schema.
+//
+// Returns:
+// - The job, unless the export cannot start.
+// - ErrDatabaseNotFound or ErrTableNotFound if the table does not exist, or an error if the format is unknown.
+func (s *Server) StartExport(dbName, tableName, format string) (Job, error) {
+	tables, err := s.jobTables(dbName, tableName)
+	if err != nil {
+		return Job{}, err
+	}
+	table := tables[0]
+	var write func(records []*dbdata.Record, filename string) error
+	switch format {
+	case "csv":
+		write = exports.ExportRecordsToCSV
+	case "json":
+		write = exports.ExportRecordsToJSON
+	case "xml":
+		write = exports.ExportRecordsToXML
+	case "parquet":
+		write = func(records []*dbdata.Record, filename string) error {
+			return exports.ExportRecordsToParquet(records, filename, table.Options.Schema)
+		}
+	default:
+		return Job{}, fmt.Errorf("unsupported export format %q, expected csv, json, xml or parquet", format)
+	}
+
+	id := newJobID()
+	path := filepath.Join(s.backupBaseDir(), "exports", fmt.Sprintf("%s_%s_%s.%s", dbName, tableName, id, format))
+	return s.startJob(id, "export", "records", func(ctx context.Context, progress ProgressFunc) (interface{}, error) {
+		records, err := table.SelectAllCtx(ctx)
+		if err != nil {
+			return nil, err
+		}
+		protoRecords := make([]*dbdata.Record, len(records))
+		for i, record := range records {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if protoRecords[i], err = RecordToProto(record); err != nil {
+				return nil, err
+			}
+			progress.report(int64(i+1), int64(len(records)))
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create export directory: %v", err)
+		}
+		if err := write(protoRecords, path); err != nil {
+			os.Remove(path)
+			return nil, fmt.Errorf("failed to write export file: %v", err)
+		}
+		return &ExportResult{Path: path, Format: format, Records: len(records)}, nil
+	}), nil
+}
+
+// StartReindex rebuilds the indexes of a table, or of every table of a database if tableName is empty, from their
+// files in a "reindex" job whose progress counts the tables rebuilt and whose result is a ReindexResult.
+//
+// Parameters:
+// - dbName: The database of the tables.
+// - tableName: The table to rebuild, or empty for every table of the database.
+//
+// Returns:
+// - The job, unless the rebuild cannot start.
+// - ErrDatabaseNotFound or ErrTableNotFound if the database or table does not exist.
+func (s *Server) StartReindex(dbName, tableName string) (Job, error) {
+	tables, err := s.jobTables(dbName, tableName)
+	if err != nil {
+		return Job{}, err
+	}
+	return s.StartJob("reindex", "tables", func(ctx context.Context, progress ProgressFunc) (interface{}, error) {
+		result := &ReindexResult{Tables: make([]string, 0, len(tables))}
+		progress.report(0, int64(len(tables)))
+		for i, table := range tables {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			_, name := table.tableNames()
+			if err := table.ResetAndLoadIndexes(); err != nil {
+				return nil, fmt.Errorf("table %s: %v", name, err)
+			}
+			result.Tables = append(result.Tables, name)
+			if snap := table.current.Load(); snap != nil {
+				result.Records += len(snap.records)
+			}
+			progress.report(int64(i+1), int64(len(tables)))
+		}
+		return result, nil
+	}), nil
+}
+
+// jobTables returns the named table of the database, or every table of it sorted by name if tableName is empty.
+func (s *Server) jobTables(dbName, tableName string) ([]*Table, error) {
+	db, err := s.Database(dbName)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, dbName)
+	}
+	db.RLock()
+	defer db.RUnlock()
+	if tableName != "" {
+		table, exists := db.Tables[tableName]
+		if !exists {
+			return nil, fmt.Errorf("%w: %s in database %s", ErrTableNotFound, tableName, dbName)
+		}
+		return []*Table{table}, nil
+	}
+	names := make([]string, 0, len(db.Tables))
+	for name := range db.Tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tables := make([]*Table, len(names))
+	for i, name := range names {
+		tables[i] = db.Tables[name]
+	}
+	return tables, nil
+}
+
+// newJobID returns a random job ID of 16 hex characters.
+func newJobID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -1,11 +1,11 @@
 package data
 
 import (
+	"context"
 	"fmt"
-	"strconv"
+	"sort"
 
 	"github.com/Malpizarr/dbproto/pkg/dbdata"
-	"google.golang.org/protobuf/types/known/structpb"
 )
 
 type JoinType int
@@ -37,25 +37,46 @@ const (
 // - A slice of maps, where each map represents a joined record. The keys in the map are field names and the values are the corresponding field values.
 // - An error, if any error occurs during the join operation. If the operation is successful, the error is nil.
 func JoinTables(t1, t2 *Table, key1, key2 string, joinType JoinType) ([]map[string]interface{}, error) {
+	return JoinTablesCtx(context.Background(), t1, t2, key1, key2, joinType)
+}
+
+// JoinTablesCtx joins two tables like JoinTables. It stops with ctx.Err() if ctx is done while the records are compared,
+// and enforces the limits set with WithLimits.
+func JoinTablesCtx(ctx context.Context, t1, t2 *Table, key1, key2 string, joinType JoinType) ([]map[string]interface{}, error) {
+	results, err := joinTables(ctx, t1, t2, key1, key2, joinType)
+	if err := limitResult(ctx, len(results), err); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// joinTables joins two tables, honoring ctx like JoinTablesCtx but without enforcing limits.
+func joinTables(ctx context.Context, t1, t2 *Table, key1, key2 string, joinType JoinType) ([]map[string]interface{}, error) {
 	results := make([]map[string]interface{}, 0)
+	scanned := 0
 
-	if err := t1.ResetAndLoadIndexes(); err != nil {
-		return nil, fmt.Errorf("failed to load indexes for table 1: %v", err)
+	snap1, err := t1.readSnapshot(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load table 1: %v", err)
 	}
-	if err := t2.ResetAndLoadIndexes(); err != nil {
-		return nil, fmt.Errorf("failed to load indexes for table 2: %v", err)
+	snap2, err := t2.readSnapshot(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load table 2: %v", err)
 	}
 
 	// Process records from t1
-	for _, rec1 := range t1.Indexes[key1] {
+	for _, rec1 := range snap1.index(key1) {
 		if rec1 == nil {
 			continue
 		}
 
 		// Attempt to find matching records in t2
 		matched := false
-		for _, rec2 := range t2.Indexes[key2] {
-			if rec2 != nil && Equal(rec1.Fields[key1], rec2.Fields[key2]) {
+		for _, rec2 := range snap2.index(key2) {
+			if err := checkScan(ctx, &scanned); err != nil {
+				return nil, err
+			}
+			if rec2 != nil && joinMatch(t1, t2, rec1, rec2, key1, key2) {
 				results = append(results, mergeRecords(rec1, rec2))
 				matched = true
 			}
@@ -69,15 +90,18 @@ func JoinTables(t1, t2 *Table, key1, key2 string, joinType JoinType) ([]map[stri
 
 	// Process records from t2 if it's a right join or full outer join
 	if joinType == RightJoin || joinType == FullOuterJoin {
-		for _, rec2 := range t2.Indexes[key2] {
+		for _, rec2 := range snap2.index(key2) {
 			if rec2 == nil {
 				continue
 			}
 
 			// Check if rec2 was matched
 			matched := false
-			for _, rec1 := range t1.Indexes[key1] {
-				if rec1 != nil && Equal(rec1.Fields[key1], rec2.Fields[key2]) {
+			for _, rec1 := range snap1.index(key1) {
+				if err := checkScan(ctx, &scanned); err != nil {
+					return nil, err
+				}
+				if rec1 != nil && joinMatch(t1, t2, rec1, rec2, key1, key2) {
 					matched = true
 					break
 				}
@@ -94,48 +118,74 @@ func JoinTables(t1, t2 *Table, key1, key2 string, joinType JoinType) ([]map[stri
 }
 
 // mergeRecords merges two dbdata.Record objects and returns a map of field names to their corresponding values.
-// The function extracts the values from the input records and prefixes the field names with "t1." or "t2."
+// The function converts the values of the input records to Go values and prefixes the field names with "t1." or "t2."
 // depending on the record they belong to.
 func mergeRecords(rec1, rec2 *dbdata.Record) map[string]interface{} {
 	result := make(map[string]interface{})
-	// this will extract the value from the records and put it in the result map
-	extractValue := func(v *structpb.Value) interface{} {
-		switch x := v.Kind.(type) {
-		case *structpb.Value_StringValue:
-			// Check for the special prefix
-			if len(x.StringValue) > 4 && x.StringValue[:4] == "num:" {
-				intValue, err := strconv.ParseInt(x.StringValue[4:], 10, 64)
-				if err != nil {
-					return x.StringValue // fallback to the original string if parsing fails
-				}
-				return intValue
-			}
-			if len(x.StringValue) > 4 && x.StringValue[:4] == "str:" {
-				return x.StringValue[4:]
-			}
-			return x.StringValue
-		case *structpb.Value_NumberValue:
-			return x.NumberValue
-		case *structpb.Value_BoolValue:
-			return x.BoolValue
-		default:
-			return nil
-		}
-	}
-
 	if rec1 != nil {
 		for k, v := range rec1.Fields {
 			if v != nil {
-				result["t1."+k] = extractValue(v)
+				result["t1."+k], _ = fromProtoValue(v)
 			}
 		}
 	}
 	if rec2 != nil {
 		for k, v := range rec2.Fields {
 			if v != nil {
-				result["t2."+k] = extractValue(v)
+				result["t2."+k], _ = fromProtoValue(v)
 			}
 		}
 	}
 	return result
 }
+
+// writeLockTables admits a write to every distinct table under its write throttle and then takes their write
+// locks in file path order, so that operations locking the same tables in a different argument order cannot
+// deadlock. Tables evicted by the cache policy are reloaded. If a table rejects the write or cannot be reloaded, it
+// ends the writes admitted so far and returns the error. Otherwise it returns the function that releases the locks
+// and ends the writes.
+func writeLockTables(ctx context.Context, tables ...*Table) (func(), error) {
+	distinct := lockOrder(tables)
+	for i, table := range distinct {
+		if err := table.admitWrite(ctx); err != nil {
+			for _, admitted := range distinct[:i] {
+				admitted.metrics.finishWrite()
+			}
+			return nil, err
+		}
+	}
+	for i, table := range distinct {
+		table.Lock()
+		if err := table.reload(); err != nil {
+			for _, locked := range distinct[:i+1] {
+				locked.Unlock()
+			}
+			for _, admitted := range distinct {
+				admitted.metrics.finishWrite()
+			}
+			return nil, err
+		}
+	}
+	return func() {
+		for i := len(distinct) - 1; i >= 0; i-- {
+			distinct[i].Unlock()
+			distinct[i].metrics.finishWrite()
+		}
+	}, nil
+}
+
+// lockOrder returns the distinct tables sorted by file path, the order in which every operation locks several tables.
+func lockOrder(tables []*Table) []*Table {
+	distinct := make([]*Table, 0, len(tables))
+	seen := make(map[*Table]bool)
+	for _, table := range tables {
+		if !seen[table] {
+			seen[table] = true
+			distinct = append(distinct, table)
+		}
+	}
+	sort.Slice(distinct, func(i, j int) bool {
+		return distinct[i].FilePath < distinct[j].FilePath
+	})
+	return distinct
+}
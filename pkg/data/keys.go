@@ -0,0 +1,162 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// ErrInvalidKey is returned for primary key values that records cannot be stored under.
+var ErrInvalidKey = errors.New("primary key must be a non-empty string or an integer")
+
+// ErrRecordNotFound is wrapped by the errors of reads and writes of a primary key that has no record.
+var ErrRecordNotFound = errors.New("record not found")
+
+// ErrDuplicateKey is wrapped by the errors of inserts of a primary key that already has a record.
+var ErrDuplicateKey = errors.New("duplicate primary key")
+
+// keyError is an error about a record of a primary key, wrapping ErrRecordNotFound or ErrDuplicateKey.
+type keyError struct {
+	kind    error
+	message string
+}
+
+func (e *keyError) Error() string { return e.message }
+func (e *keyError) Unwrap() error { return e.kind }
+
+// recordNotFound returns the error of a read or write of a key that has no record.
+func recordNotFound(key string) error {
+	return &keyError{kind: ErrRecordNotFound, message: fmt.Sprintf("record with key %s not found", key)}
+}
+
+// duplicateKey returns the error of an insert of a key that already has a record.
+func duplicateKey(key string) error {
+	return &keyError{kind: ErrDuplicateKey, message: fmt.Sprintf("record with primary key '%s' already exists", key)}
+}
+
+// KeyNormalization selects the rules applied to string primary keys before records are stored under them or looked
+// up by them. Every rule is off by default, so keys are stored as they are given.
+//
+// The rules are applied in order: Trim, then FoldCase, then NumericStrings. They are fixed when the table is created,
+// as changing them would leave existing records under keys that lookups no longer produce.
+type KeyNormalization struct {
+	Trim           bool `json:"Trim,omitempty"`           // Trim removes the leading and trailing white space of string keys.
+	FoldCase       bool `json:"FoldCase,omitempty"`       // FoldCase stores string keys in lower case, so lookups ignore case.
+	NumericStrings bool `json:"NumericStrings,omitempty"` // NumericStrings stores strings holding an integral number under the key of that number, so "007" and "7.0" find 7.
+}
+
+// keyString returns the key a primary key value is stored under by the key codec without normalization rules, or
+// an empty string for values that cannot be primary keys. See KeyNormalization.encode.
+func keyString(value *dbdata.Value) string {
+	key, _ := (*KeyNormalization)(nil).encode(value)
+	return key
+}
+
+// encode is the key codec: it returns the key records with the given primary key value are stored under. A string
+// is stored as itself, after the normalization rules, and an integer as its decimal form. A floating point number
+// with an integral value is stored like the integer, so 1, 1.0 and "1" are the same key. n may be nil, for no rules.
+//
+// Returns:
+// - The key, never empty.
+// - ErrInvalidKey for nulls, empty strings, fractional numbers and values of other kinds.
+func (n *KeyNormalization) encode(value *dbdata.Value) (string, error) {
+	switch v := value.GetKind().(type) {
+	case *dbdata.Value_StringValue:
+		key := n.normalize(v.StringValue)
+		if key == "" {
+			return "", ErrInvalidKey
+		}
+		return key, nil
+	case *dbdata.Value_IntValue:
+		return strconv.FormatInt(v.IntValue, 10), nil
+	case *dbdata.Value_NumberValue:
+		if key, ok := integralKey(v.NumberValue); ok {
+			return key, nil
+		}
+	}
+	return "", ErrInvalidKey
+}
+
+// normalize applies the normalization rules to a string key.
+func (n *KeyNormalization) normalize(key string) string {
+	if n == nil {
+		return key
+	}
+	if n.Trim {
+		key = strings.TrimSpace(key)
+	}
+	if n.FoldCase {
+		key = strings.ToLower(key)
+	}
+	if n.NumericStrings {
+		if f, err := strconv.ParseFloat(key, 64); err == nil {
+			if canonical, ok := integralKey(f); ok {
+				key = canonical
+			}
+		}
+	}
+	return key
+}
+
+// integralKey returns the decimal form of a number with an integral value in the range of int64, and false for
+// other numbers.
+func integralKey(f float64) (string, bool) {
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return "", false
+	}
+	return strconv.FormatInt(int64(f), 10), true
+}
+
+// EncodeKey is a method of the Table struct that returns the key the records with the given primary key value are
+// stored under, applying the key normalization rules of the table. Inserts, lookups, updates, deletes, transactions
+// and joins all go through it, so that a value finds the record inserted with any value of the same key.
+//
+// Parameters:
+// - key: The primary key value, a string or a number.
+//
+// Returns:
+// - The key the record is stored under.
+// - An error wrapping ErrInvalidKey, if the value cannot be a primary key. If the operation is successful, the error is nil.
+func (t *Table) EncodeKey(key interface{}) (string, error) {
+	value, err := toProtoValue(key)
+	if err != nil {
+		return "", fmt.Errorf("invalid key %v: %w", key, ErrInvalidKey)
+	}
+	keyStr, err := t.Options.KeyNormalization.encode(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid key %v: %w", key, err)
+	}
+	return keyStr, nil
+}
+
+// recordKey returns the key a stored record is stored under, computed from its primary key field.
+func (t *Table) recordKey(record *dbdata.Record) string {
+	key, _ := t.Options.KeyNormalization.encode(record.Fields[t.PrimaryKey])
+	return key
+}
+
+// joinMatch reports whether two records match on the joined fields. When either field is the primary key of its
+// table, both values are compared by the keys they encode to with the codec of that table, so that a join matches the
+// records a lookup of the value finds. Other fields are compared with Equal.
+func joinMatch(t1, t2 *Table, rec1, rec2 *dbdata.Record, key1, key2 string) bool {
+	value1, value2 := pathValue(rec1, key1), pathValue(rec2, key2)
+	var codec *KeyNormalization
+	switch {
+	case key1 == t1.PrimaryKey:
+		codec = t1.Options.KeyNormalization
+	case key2 == t2.PrimaryKey:
+		codec = t2.Options.KeyNormalization
+	default:
+		return Equal(value1, value2)
+	}
+	encoded1, err1 := codec.encode(value1)
+	encoded2, err2 := codec.encode(value2)
+	if err1 != nil || err2 != nil {
+		return Equal(value1, value2)
+	}
+	return encoded1 == encoded2
+}
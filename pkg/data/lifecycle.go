@@ -0,0 +1,133 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrClosed is returned by operations on a table, database or server that has been closed.
+var ErrClosed = errors.New("closed")
+
+// Close is a method of the Table struct that flushes the table and releases it: the changes write-behind left
+// pending are written and the file is flushed to stable storage, as by Flush, the scheduled flush and compaction are
+// stopped, the watchers are closed and the records, indexes and spill files are released. Reads and writes through
+// the table fail with ErrClosed afterwards. Closing a closed table does nothing.
+//
+// Returns:
+// - An error, if the pending changes cannot be written or the file cannot be flushed, in which case the table stays
+// open and Close can be retried. If the operation is successful, the error is nil.
+func (t *Table) Close() error {
+	t.Lock()
+	defer t.Unlock()
+	if t.closed.Load() {
+		return nil
+	}
+	if !t.virtual && !t.temporary && !t.readOnly.Load() && !t.dropped {
+		if err := t.syncFiles(); err != nil {
+			return err
+		}
+	}
+	t.closed.Store(true)
+	t.release()
+	t.closeWatchers()
+	return nil
+}
+
+// Closed reports whether the table has been closed, see Close.
+func (t *Table) Closed() bool {
+	return t.closed.Load()
+}
+
+// Flush waits for the writes in progress on every table of the database, writes the changes left pending by
+// write-behind and flushes the table files to stable storage, like Table.Flush. Every table is flushed even if some
+// fail.
+//
+// Returns:
+// - ErrClosed if the database has been closed, or an error joining the errors of the tables that failed to flush. If
+// every table was flushed, the error is nil.
+func (db *Database) Flush() error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	db.RLock()
+	defer db.RUnlock()
+	return db.syncTables()
+}
+
+// syncTables flushes every table of the database, see Flush. The caller must hold the database lock.
+func (db *Database) syncTables() error {
+	var errs []error
+	for tableName, table := range db.Tables {
+		if err := table.sync(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to flush table %s.%s: %w", db.Name, tableName, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every table of the database, see Table.Close, after which looking up its tables, creating, dropping
+// and renaming them fail with ErrClosed, as do reads and writes through references to its tables taken before.
+// Closing a closed database does nothing.
+//
+// Returns:
+// - An error joining the errors of the tables that failed to close, in which case they and the database stay open and
+// Close can be retried. If the operation is successful, the error is nil.
+func (db *Database) Close() error {
+	db.Lock()
+	defer db.Unlock()
+	if db.closed.Load() {
+		return nil
+	}
+	var errs []error
+	for tableName, table := range db.Tables {
+		if err := table.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close table %s.%s: %w", db.Name, tableName, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	db.closed.Store(true)
+	return nil
+}
+
+// Close shuts the server down: it stops the jobs, as StopJobs does, and the background loops started with
+// RunCachePolicy, RunIndexBudget, RunBackups, RunBackupVerification and RunRetention, which return ErrClosed, and closes
+// every database of the server and of its tenants, see Database.Close. Every operation on the server fails with
+// ErrClosed afterwards. The commit log, telemetry and tracer the server was given belong to the caller, which closes
+// them once Close returns. Closing a closed server does nothing.
+//
+// Returns:
+// - An error joining the errors of the databases that failed to close, in which case they and the server stay open
+// and Close can be retried. If the operation is successful, the error is nil.
+func (s *Server) Close() error {
+	if s.closed.Load() {
+		return nil
+	}
+	s.stopOnce.Do(func() { close(s.stopped) })
+	s.StopJobs()
+
+	var errs []error
+	for _, tenant := range s.tenantServers() {
+		if err := tenant.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %s: %w", tenant.tenant, err))
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, db := range s.Databases {
+		if err := db.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	s.closed.Store(true)
+	return nil
+}
+
+// Closed reports whether the server has been closed, see Close.
+func (s *Server) Closed() bool {
+	return s.closed.Load()
+}
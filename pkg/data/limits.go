@@ -0,0 +1,89 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Limits caps the work a single query, select or join may do, to protect servers shared by several clients.
+// A zero field means no limit.
+type Limits struct {
+	MaxRows     int           `json:"maxRows,omitempty"`     // MaxRows is the maximum number of rows a read may return.
+	MaxDuration time.Duration `json:"maxDuration,omitempty"` // MaxDuration is the maximum time a read may run.
+}
+
+// LimitExceededError is returned by a read that exceeds the Limits of its context.
+type LimitExceededError struct {
+	MaxRows     int           // MaxRows is the row limit that was exceeded, or 0.
+	MaxDuration time.Duration // MaxDuration is the time limit that was exceeded, or 0.
+}
+
+func (e *LimitExceededError) Error() string {
+	if e.MaxRows > 0 {
+		return fmt.Sprintf("limit exceeded: the result has more than %d rows — refine your query or paginate", e.MaxRows)
+	}
+	return fmt.Sprintf("limit exceeded: the query ran longer than %v — refine your query or paginate", e.MaxDuration)
+}
+
+// limitsKey is the context key under which WithLimits stores the limits.
+type limitsKey struct{}
+
+// WithLimits returns a context that enforces the limits on the reads it is passed to: SelectAllCtx,
+// SelectWithFilterCtx, QueryCtx, QueryWithCursorCtx and JoinTablesCtx fail with a LimitExceededError once they
+// run longer than MaxDuration or would return more than MaxRows rows. The returned cancel function must be called
+// to release the timer, as with context.WithTimeout.
+func WithLimits(ctx context.Context, limits Limits) (context.Context, context.CancelFunc) {
+	ctx = context.WithValue(ctx, limitsKey{}, limits)
+	if limits.MaxDuration > 0 {
+		return context.WithTimeoutCause(ctx, limits.MaxDuration, &LimitExceededError{MaxDuration: limits.MaxDuration})
+	}
+	return context.WithCancel(ctx)
+}
+
+// limitResult returns the error of a read of rows rows done with ctx: a LimitExceededError if the read ran past
+// the time limit of ctx or returned more rows than its row limit, and err otherwise.
+func limitResult(ctx context.Context, rows int, err error) error {
+	if err != nil {
+		var limitErr *LimitExceededError
+		if errors.Is(err, context.DeadlineExceeded) && errors.As(context.Cause(ctx), &limitErr) {
+			return limitErr
+		}
+		return err
+	}
+	if limits, ok := ctx.Value(limitsKey{}).(Limits); ok && limits.MaxRows > 0 && rows > limits.MaxRows {
+		return &LimitExceededError{MaxRows: limits.MaxRows}
+	}
+	return nil
+}
+
+// SetLimits sets the limits applied to the reads of callers whose role has no limits of its own.
+func (s *Server) SetLimits(limits Limits) {
+	defer s.forEachTenant(func(tenant *Server) { tenant.SetLimits(limits) })
+	s.Lock()
+	defer s.Unlock()
+	s.limits = limits
+}
+
+// SetRoleLimits sets the limits applied to the reads of callers with the given role, replacing the server limits
+// for them.
+func (s *Server) SetRoleLimits(role string, limits Limits) {
+	defer s.forEachTenant(func(tenant *Server) { tenant.SetRoleLimits(role, limits) })
+	s.Lock()
+	defer s.Unlock()
+	if s.roleLimits == nil {
+		s.roleLimits = make(map[string]Limits)
+	}
+	s.roleLimits[role] = limits
+}
+
+// LimitsFor returns the limits of the given role, or the server limits if the role has none.
+func (s *Server) LimitsFor(role string) Limits {
+	s.RLock()
+	defer s.RUnlock()
+	if limits, ok := s.roleLimits[role]; ok {
+		return limits
+	}
+	return s.limits
+}
@@ -0,0 +1,233 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotatingFileSink writes commit log entries as JSON lines to append-only files in a directory,
+// starting a new file once the current one reaches MaxBytes.
+// OnRotate, if set, is called with the path of every closed file so it can be shipped elsewhere.
+type RotatingFileSink struct {
+	sync.Mutex
+	Dir      string            // Dir is the directory the log files are written to.
+	MaxBytes int64             // MaxBytes is the size after which the current file is rotated.
+	OnRotate func(path string) // OnRotate is called with the path of each rotated file.
+
+	file *os.File
+	size int64
+}
+
+// NewRotatingFileSink creates a RotatingFileSink writing to dir, creating the directory if needed.
+func NewRotatingFileSink(dir string, maxBytes int64) (*RotatingFileSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create commit log directory: %v", err)
+	}
+	return &RotatingFileSink{Dir: dir, MaxBytes: maxBytes}, nil
+}
+
+// Write appends the entry to the current file, rotating it first if it is full.
+func (s *RotatingFileSink) Write(entry *LogEntry) error {
+	s.Lock()
+	defer s.Unlock()
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to serialize log entry: %v", err)
+	}
+	line = append(line, '\n')
+
+	if s.file != nil && s.MaxBytes > 0 && s.size+int64(len(line)) > s.MaxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if s.file == nil {
+		name := fmt.Sprintf("commitlog-%s-%020d.log", time.Now().UTC().Format("20060102T150405"), entry.Sequence)
+		file, err := os.OpenFile(filepath.Join(s.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open commit log file: %v", err)
+		}
+		s.file = file
+		s.size = 0
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write commit log file: %v", err)
+	}
+	return s.file.Sync()
+}
+
+// LastEntry returns the last entry of the newest file of the directory, or nil if it has none, see LogTail.
+func (s *RotatingFileSink) LastEntry() (*LogEntry, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(s.Dir, "commitlog-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	// The names start with the time the file was started at, then the sequence of its first entry
+	sort.Strings(files)
+	for i := len(files) - 1; i >= 0; i-- {
+		content, err := os.ReadFile(files[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read commit log file: %v", err)
+		}
+		entry, err := lastLogEntry(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Base(files[i]), err)
+		}
+		if entry != nil {
+			return entry, nil
+		}
+	}
+	return nil, nil
+}
+
+// rotate closes the current file and hands it to OnRotate.
+func (s *RotatingFileSink) rotate() error {
+	path := s.file.Name()
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("failed to close commit log file: %v", err)
+	}
+	s.file = nil
+	if s.OnRotate != nil {
+		s.OnRotate(path)
+	}
+	return nil
+}
+
+// Close closes the current file, handing it to OnRotate like a rotation.
+func (s *RotatingFileSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	return s.rotate()
+}
+
+// Uploader stores named objects in external append-only storage, such as an S3 bucket with object lock. Every
+// BackupDestination is one, so S3Destination and LocalDestination, and ParseBackupDestination, serve ObjectSink too.
+type Uploader interface {
+	Upload(ctx context.Context, name string, content io.Reader, size int64) error // Upload stores content, of size bytes, under name.
+}
+
+// objectReader is implemented by the uploaders that can list and download the objects they uploaded, as every
+// BackupDestination can.
+type objectReader interface {
+	List(ctx context.Context, prefix string) ([]DestinationObject, error)
+	Download(ctx context.Context, name string, w io.Writer) error
+}
+
+// ObjectSink batches commit log entries and uploads each batch as a new object, never overwriting previous ones.
+// Entries of a batch not yet uploaded are only held in memory until Close uploads them.
+type ObjectSink struct {
+	sync.Mutex
+	Uploader  Uploader // Uploader is the object storage client.
+	Prefix    string   // Prefix is prepended to every object name.
+	BatchSize int      // BatchSize is the number of entries per object.
+
+	buffer bytes.Buffer
+	count  int
+	first  uint64
+}
+
+// NewObjectSink creates an ObjectSink uploading batches of batchSize entries through uploader.
+func NewObjectSink(uploader Uploader, prefix string, batchSize int) *ObjectSink {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	return &ObjectSink{Uploader: uploader, Prefix: prefix, BatchSize: batchSize}
+}
+
+// Write buffers the entry and uploads the batch once it is full.
+func (s *ObjectSink) Write(entry *LogEntry) error {
+	s.Lock()
+	defer s.Unlock()
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to serialize log entry: %v", err)
+	}
+	if s.count == 0 {
+		s.first = entry.Sequence
+	}
+	s.buffer.Write(line)
+	s.buffer.WriteByte('\n')
+	s.count++
+
+	if s.count >= s.BatchSize {
+		return s.flush()
+	}
+	return nil
+}
+
+// flush uploads the buffered entries as one object named after the first sequence number it holds.
+func (s *ObjectSink) flush() error {
+	if s.count == 0 {
+		return nil
+	}
+	name := fmt.Sprintf("%scommitlog-%020d.log", s.Prefix, s.first)
+	if err := s.Uploader.Upload(context.Background(), name, bytes.NewReader(s.buffer.Bytes()), int64(s.buffer.Len())); err != nil {
+		return fmt.Errorf("failed to upload commit log object %s: %v", name, err)
+	}
+	s.buffer.Reset()
+	s.count = 0
+	return nil
+}
+
+// LastEntry returns the last entry of the newest object uploaded under Prefix, or nil if there is none or if the
+// Uploader cannot list and download its objects, see LogTail.
+func (s *ObjectSink) LastEntry() (*LogEntry, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	reader, ok := s.Uploader.(objectReader)
+	if !ok {
+		return nil, nil
+	}
+	ctx := context.Background()
+	objects, err := reader.List(ctx, s.Prefix+"commitlog-")
+	if err != nil {
+		return nil, err
+	}
+	// The names end with the sequence of the first entry of the object, zero padded so they sort by it
+	newest := ""
+	for _, object := range objects {
+		if strings.HasSuffix(object.Name, ".log") && object.Name > newest {
+			newest = object.Name
+		}
+	}
+	if newest == "" {
+		return nil, nil
+	}
+	var content bytes.Buffer
+	if err := reader.Download(ctx, newest, &content); err != nil {
+		return nil, err
+	}
+	entry, err := lastLogEntry(content.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", newest, err)
+	}
+	return entry, nil
+}
+
+// Close uploads any buffered entries.
+func (s *ObjectSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.flush()
+}
@@ -0,0 +1,23 @@
+//go:build windows || plan9
+
+package data
+
+import "errors"
+
+// SyslogSink writes commit log entries to syslog, which this platform does not have.
+type SyslogSink struct{}
+
+// NewSyslogSink fails: syslog is not available on this platform.
+func NewSyslogSink(network, address, tag string) (*SyslogSink, error) {
+	return nil, errors.New("syslog is not available on this platform")
+}
+
+// Write fails: syslog is not available on this platform.
+func (s *SyslogSink) Write(entry *LogEntry) error {
+	return errors.New("syslog is not available on this platform")
+}
+
+// Close does nothing.
+func (s *SyslogSink) Close() error {
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build !windows && !plan9
+
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+)
+
+// SyslogSink writes commit log entries as JSON messages to a local or remote syslog daemon.
+type SyslogSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogSink connects to syslog. An empty network and address use the local daemon.
+func NewSyslogSink(network, address, tag string) (*SyslogSink, error) {
+	writer, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %v", err)
+	}
+	return &SyslogSink{writer: writer}, nil
+}
+
+// Write sends the entry to syslog.
+func (s *SyslogSink) Write(entry *LogEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to serialize log entry: %v", err)
+	}
+	return s.writer.Info(string(line))
+}
+
+// Close closes the syslog connection.
+func (s *SyslogSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,154 @@
+package data
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrBackupCorrupt is returned by restores and verifications of a backup whose files do not match its manifest, or
+// whose archive is damaged.
+var ErrBackupCorrupt = errors.New("backup is corrupt")
+
+// manifestFileName is the archive entry listing the other files of a backup. It cannot be the name of a database, so
+// it never collides with one, and it is never extracted.
+const manifestFileName = ".manifest.json"
+
+// backupManifestVersion is the version of the manifest written by this version.
+const backupManifestVersion = 1
+
+// backupManifest lists the files of a backup archive with their size and SHA-256, so a restore can tell that none
+// was removed, added or altered since the backup was written.
+type backupManifest struct {
+	Version int            `json:"version"`
+	Files   []manifestFile `json:"files"`
+}
+
+// manifestFile is a file listed in the manifest of a backup.
+type manifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// add writes the content as the archive entry name and lists it in the manifest, and returns its size.
+func (m *backupManifest) add(zipWriter *zip.Writer, name string, content io.Reader) (int64, error) {
+	zipFile, err := zipWriter.Create(name)
+	if err != nil {
+		return 0, err
+	}
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(zipFile, hash), content)
+	if err != nil {
+		return written, err
+	}
+	m.Files = append(m.Files, manifestFile{Path: name, Size: written, SHA256: hex.EncodeToString(hash.Sum(nil))})
+	return written, nil
+}
+
+// write adds the manifest itself to the archive, after every file it lists.
+func (m *backupManifest) write(zipWriter *zip.Writer) error {
+	m.Version = backupManifestVersion
+	content, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	zipFile, err := zipWriter.Create(manifestFileName)
+	if err != nil {
+		return err
+	}
+	_, err = zipFile.Write(content)
+	return err
+}
+
+// checkArchive checks that every entry of the backup archive is extracted inside dir, see restorePath, and reads
+// every file, which checks their CRC-32, comparing them with the manifest. It reports whether the archive has a
+// manifest: backups written before manifests existed are only checked for their names and CRC-32. Nothing is
+// written. It returns an error wrapping ErrBackupCorrupt if a file is damaged, missing from the archive or from the
+// manifest, or differs from it.
+func checkArchive(zipReader *zip.Reader, dir string) (bool, error) {
+	var manifest *backupManifest
+	for _, file := range zipReader.File {
+		if _, err := restorePath(dir, file.Name); err != nil {
+			return false, err
+		}
+		if isManifest(file.Name) {
+			manifest = &backupManifest{}
+			if err := readManifest(file, manifest); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	listed := make(map[string]manifestFile)
+	if manifest != nil {
+		if manifest.Version > backupManifestVersion {
+			return false, fmt.Errorf("backup manifest version %d is newer than this version supports", manifest.Version)
+		}
+		for _, file := range manifest.Files {
+			listed[file.Path] = file
+		}
+	}
+	for _, file := range zipReader.File {
+		if file.FileInfo().IsDir() || isManifest(file.Name) {
+			continue
+		}
+		size, sum, err := hashArchiveFile(file)
+		if err != nil {
+			return false, err
+		}
+		if manifest == nil {
+			continue
+		}
+		expected, ok := listed[file.Name]
+		if !ok {
+			return false, fmt.Errorf("%w: %s is not in the manifest", ErrBackupCorrupt, file.Name)
+		}
+		if size != expected.Size || sum != expected.SHA256 {
+			return false, fmt.Errorf("%w: %s does not match the manifest", ErrBackupCorrupt, file.Name)
+		}
+		delete(listed, file.Name)
+	}
+	for name := range listed {
+		return false, fmt.Errorf("%w: %s is missing", ErrBackupCorrupt, name)
+	}
+	return manifest != nil, nil
+}
+
+// readManifest decodes the manifest entry of a backup archive.
+func readManifest(file *zip.File, manifest *backupManifest) error {
+	rc, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("%w: failed to open manifest: %v", ErrBackupCorrupt, err)
+	}
+	defer rc.Close()
+	if err := json.NewDecoder(rc).Decode(manifest); err != nil {
+		return fmt.Errorf("%w: failed to read manifest: %v", ErrBackupCorrupt, err)
+	}
+	return nil
+}
+
+// hashArchiveFile reads a file of a backup archive and returns its size and SHA-256.
+func hashArchiveFile(file *zip.File) (int64, string, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: failed to open %s: %v", ErrBackupCorrupt, file.Name, err)
+	}
+	defer rc.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, rc)
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: failed to read %s: %v", ErrBackupCorrupt, file.Name, err)
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// isManifest reports whether the archive entry name is the manifest of the backup.
+func isManifest(name string) bool {
+	return strings.ReplaceAll(name, `\`, "/") == manifestFileName
+}
@@ -0,0 +1,80 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// JoinIntoTable joins two tables like JoinTables and writes the joined records into a new table of the database, so
+// that an expensive join can be computed once and then queried like any other table. The fields of the joined
+// records are named like those returned by JoinTables with the dot replaced by an underscore, "t1_id" rather than
+// "t1.id", so that they can be used in filters and statements.
+//
+// The new table is created with the AutoID option: joined records without a primaryKey field, such as the unmatched
+// records of an outer join or every record when primaryKey is not a field of the joined records, get a generated key.
+// It is a snapshot of the join and is not updated when the joined tables change.
+//
+// Parameters:
+// - t1, t2: Pointers to the first and second Table objects to be joined.
+// - key1, key2: The key fields for the first and second tables, respectively.
+// - joinType: The type of join to be performed, represented as a JoinType value.
+// - destTable: The name of the table to create. It must not exist.
+// - primaryKey: The primary key of the new table, for example "t2_id".
+//
+// Returns:
+// - The number of records written to the new table.
+// - An error, if the join fails, the table cannot be created or two joined records have the same primary key. The new
+// table is removed on error. If the operation is successful, the error is nil.
+func (db *Database) JoinIntoTable(t1, t2 *Table, key1, key2 string, joinType JoinType, destTable, primaryKey string) (int, error) {
+	return db.JoinIntoTableCtx(context.Background(), t1, t2, key1, key2, joinType, destTable, primaryKey)
+}
+
+// JoinIntoTableCtx materializes a join like JoinIntoTable. It stops with ctx.Err() if ctx is done while the records
+// are compared. The limits set with WithLimits do not apply, as the joined records are not returned.
+func (db *Database) JoinIntoTableCtx(ctx context.Context, t1, t2 *Table, key1, key2 string, joinType JoinType, destTable, primaryKey string) (int, error) {
+	results, err := joinTables(ctx, t1, t2, key1, key2, joinType)
+	if err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	records := make([]Record, 0, len(results))
+	for _, result := range results {
+		record := make(Record, len(result))
+		for field, value := range result {
+			record[strings.Replace(field, ".", "_", 1)] = value
+		}
+		records = append(records, record)
+	}
+
+	if err := db.CreateTableWithOptions(destTable, primaryKey, TableOptions{AutoID: true}); err != nil {
+		return 0, err
+	}
+	db.RLock()
+	table := db.Tables[destTable]
+	db.RUnlock()
+	if err := table.InsertMany(records); err != nil {
+		db.removeTable(destTable, table)
+		return 0, fmt.Errorf("failed to write joined records to table %s: %w", destTable, err)
+	}
+	return len(records), nil
+}
+
+// removeTable removes a table created by the database and its files, unless it has been replaced meanwhile.
+func (db *Database) removeTable(tableName string, table *Table) {
+	db.Lock()
+	defer db.Unlock()
+	if db.Tables[tableName] != table {
+		return
+	}
+	delete(db.Tables, tableName)
+	os.Remove(table.FilePath)
+	os.Remove(filepath.Join(filepath.Dir(table.FilePath), tableName+".meta"))
+	os.RemoveAll(segmentDir(table.FilePath))
+	os.Remove(pendingLogPath(table.FilePath))
+}
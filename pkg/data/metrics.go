@@ -19,11 +19,153 @@ type Metrics struct {
 	LastUpdate  time.Time // The timestamp of the last update operation.
 	LastDelete  time.Time // The timestamp of the last delete operation.
 	LastQuery   time.Time // The timestamp of the last query operation.
+
+	CacheEvictions int // The number of records evicted from the full cache to make room for others.
+
+	FullScans map[string]int // The number of full-scan queries that filtered on each field.
+
+	PendingWrites     int // The number of writes waiting for the table or being written.
+	PeakPendingWrites int // The highest number of pending writes seen.
+	DelayedWrites     int // The number of writes delayed by the write throttle.
+	RejectedWrites    int // The number of writes rejected by the write throttle.
+
+	PurgedRecords int // The number of records deleted or archived by the retention policy.
+
+	resetAt    time.Time       // When the metrics were created or last reset.
+	lastScrape MetricsSnapshot // The snapshot taken by the last Delta, which the next one is relative to.
+	scrapePeak int             // The highest number of pending writes seen since the last Delta.
+}
+
+// MetricsSnapshot is a copy of the counters of a Metrics structure, taken at once so that they are consistent with
+// each other. The counters cover the period starting at Since.
+type MetricsSnapshot struct {
+	InsertCount int       // The number of insert operations performed.
+	UpdateCount int       // The number of update operations performed.
+	DeleteCount int       // The number of delete operations performed.
+	QueryCount  int       // The number of query operations performed.
+	CacheHits   int       // The number of successful cache retrievals.
+	CacheMisses int       // The number of unsuccessful cache retrievals.
+	LastInsert  time.Time // The timestamp of the last insert operation.
+	LastUpdate  time.Time // The timestamp of the last update operation.
+	LastDelete  time.Time // The timestamp of the last delete operation.
+	LastQuery   time.Time // The timestamp of the last query operation.
+
+	CacheEvictions int // The number of records evicted from the full cache to make room for others.
+
+	FullScans map[string]int // The number of full-scan queries that filtered on each field.
+
+	PendingWrites     int // The number of writes waiting for the table or being written when the snapshot was taken.
+	PeakPendingWrites int // The highest number of pending writes seen during the period.
+	DelayedWrites     int // The number of writes delayed by the write throttle.
+	RejectedWrites    int // The number of writes rejected by the write throttle.
+
+	PurgedRecords int // The number of records deleted or archived by the retention policy.
+
+	Since time.Time // The start of the period the counters cover.
+	Taken time.Time // When the snapshot was taken, the end of the period.
 }
 
 // NewMetrics creates and returns a new Metrics structure.
 func NewMetrics() *Metrics {
-	return &Metrics{}
+	return &Metrics{resetAt: time.Now()}
+}
+
+// Snapshot returns the counters accumulated since the metrics were created or last reset.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.RLock()
+	defer m.RUnlock()
+	return m.snapshot()
+}
+
+// snapshot copies the counters. The caller must hold the lock.
+func (m *Metrics) snapshot() MetricsSnapshot {
+	snapshot := MetricsSnapshot{
+		InsertCount:       m.InsertCount,
+		UpdateCount:       m.UpdateCount,
+		DeleteCount:       m.DeleteCount,
+		QueryCount:        m.QueryCount,
+		CacheHits:         m.CacheHits,
+		CacheMisses:       m.CacheMisses,
+		LastInsert:        m.LastInsert,
+		LastUpdate:        m.LastUpdate,
+		LastDelete:        m.LastDelete,
+		LastQuery:         m.LastQuery,
+		CacheEvictions:    m.CacheEvictions,
+		PendingWrites:     m.PendingWrites,
+		PeakPendingWrites: m.PeakPendingWrites,
+		DelayedWrites:     m.DelayedWrites,
+		RejectedWrites:    m.RejectedWrites,
+		PurgedRecords:     m.PurgedRecords,
+		Since:             m.resetAt,
+		Taken:             time.Now(),
+	}
+	if len(m.FullScans) > 0 {
+		snapshot.FullScans = make(map[string]int, len(m.FullScans))
+		for field, count := range m.FullScans {
+			snapshot.FullScans[field] = count
+		}
+	}
+	return snapshot
+}
+
+// Delta returns the counters accumulated since the previous call to Delta, or since the metrics were created or last
+// reset for the first one, so that a poller gets per-interval numbers it can turn into rates. Each call starts a new
+// interval, so a table's deltas are meant for a single poller. PendingWrites is the current value and
+// PeakPendingWrites the highest value seen during the interval; the timestamps of the last operations are kept.
+func (m *Metrics) Delta() MetricsSnapshot {
+	m.Lock()
+	defer m.Unlock()
+	current := m.snapshot()
+	previous := m.lastScrape
+	if previous.Taken.IsZero() {
+		previous = MetricsSnapshot{Taken: m.resetAt}
+	}
+	m.lastScrape = current
+
+	delta := current
+	delta.InsertCount -= previous.InsertCount
+	delta.UpdateCount -= previous.UpdateCount
+	delta.DeleteCount -= previous.DeleteCount
+	delta.QueryCount -= previous.QueryCount
+	delta.CacheHits -= previous.CacheHits
+	delta.CacheMisses -= previous.CacheMisses
+	delta.CacheEvictions -= previous.CacheEvictions
+	delta.DelayedWrites -= previous.DelayedWrites
+	delta.RejectedWrites -= previous.RejectedWrites
+	delta.PurgedRecords -= previous.PurgedRecords
+	delta.FullScans = nil
+	for field, count := range current.FullScans {
+		if count -= previous.FullScans[field]; count > 0 {
+			if delta.FullScans == nil {
+				delta.FullScans = make(map[string]int)
+			}
+			delta.FullScans[field] = count
+		}
+	}
+	delta.PeakPendingWrites = m.scrapePeak
+	if delta.PeakPendingWrites < m.PendingWrites {
+		delta.PeakPendingWrites = m.PendingWrites
+	}
+	m.scrapePeak = m.PendingWrites
+	delta.Since = previous.Taken
+	return delta
+}
+
+// Reset sets every counter back to zero, for example between the runs of a load test, and starts a new delta
+// interval. Writes pending at the time are still counted by PendingWrites. The full scans behind the index
+// recommendations are cleared too.
+func (m *Metrics) Reset() {
+	m.Lock()
+	defer m.Unlock()
+	m.InsertCount, m.UpdateCount, m.DeleteCount, m.QueryCount = 0, 0, 0, 0
+	m.CacheHits, m.CacheMisses, m.CacheEvictions = 0, 0, 0
+	m.LastInsert, m.LastUpdate, m.LastDelete, m.LastQuery = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+	m.FullScans = nil
+	m.PeakPendingWrites, m.DelayedWrites, m.RejectedWrites = m.PendingWrites, 0, 0
+	m.PurgedRecords = 0
+	m.resetAt = time.Now()
+	m.lastScrape = MetricsSnapshot{}
+	m.scrapePeak = m.PendingWrites
 }
 
 // IncrementInsertCount increases the count of insert operations and updates the timestamp of the last insert operation.
@@ -72,6 +214,66 @@ func (m *Metrics) IncrementCacheMisses() {
 	m.Unlock()
 }
 
+// addCacheEvictions adds the records evicted from the full cache.
+func (m *Metrics) addCacheEvictions(count int) {
+	m.Lock()
+	m.CacheEvictions += count
+	m.Unlock()
+}
+
+// IncrementFullScans records a query that had to scan every record, counting it once for each filtered field.
+func (m *Metrics) IncrementFullScans(fields []string) {
+	m.Lock()
+	if m.FullScans == nil {
+		m.FullScans = make(map[string]int)
+	}
+	for _, field := range fields {
+		m.FullScans[field]++
+	}
+	m.Unlock()
+}
+
+// IncrementDelayedWrites increases the count of writes delayed by the write throttle.
+func (m *Metrics) IncrementDelayedWrites() {
+	m.Lock()
+	m.DelayedWrites++
+	m.Unlock()
+}
+
+// addPurgedRecords adds the records deleted or archived by an application of the retention policy.
+func (m *Metrics) addPurgedRecords(count int) {
+	m.Lock()
+	m.PurgedRecords += count
+	m.Unlock()
+}
+
+// startWrite counts a new pending write unless the pending writes already reach rejectAfter, in which case it
+// counts a rejected write instead. It returns the number of pending writes including the new one and whether it
+// was admitted. A rejectAfter of 0 admits every write.
+func (m *Metrics) startWrite(rejectAfter int) (int, bool) {
+	m.Lock()
+	defer m.Unlock()
+	if rejectAfter > 0 && m.PendingWrites >= rejectAfter {
+		m.RejectedWrites++
+		return m.PendingWrites, false
+	}
+	m.PendingWrites++
+	if m.PendingWrites > m.PeakPendingWrites {
+		m.PeakPendingWrites = m.PendingWrites
+	}
+	if m.PendingWrites > m.scrapePeak {
+		m.scrapePeak = m.PendingWrites
+	}
+	return m.PendingWrites, true
+}
+
+// finishWrite ends a write admitted by startWrite.
+func (m *Metrics) finishWrite() {
+	m.Lock()
+	m.PendingWrites--
+	m.Unlock()
+}
+
 // String returns a string representation of the Metrics structure in JSON format.
 func (m *Metrics) String() string {
 	m.RLock()
@@ -79,3 +281,91 @@ func (m *Metrics) String() string {
 	metrics, _ := json.MarshalIndent(m, "", "  ")
 	return string(metrics)
 }
+
+// Metrics returns the metrics of the operations on the table.
+func (t *Table) Metrics() *Metrics {
+	return t.metrics
+}
+
+// MetricsSummary adds up the metrics of one or more tables, as reported by Server.Metrics.
+type MetricsSummary struct {
+	Tables         int     `json:"tables"`         // Tables is the number of tables added up.
+	Records        int     `json:"records"`        // Records is the number of records stored.
+	CachedRecords  int     `json:"cachedRecords"`  // CachedRecords is the number of records in the lookup caches.
+	FileSize       int64   `json:"fileSize"`       // FileSize is the size in bytes of the data files.
+	Inserts        int     `json:"inserts"`        // Inserts is the number of insert operations performed.
+	Updates        int     `json:"updates"`        // Updates is the number of update operations performed.
+	Deletes        int     `json:"deletes"`        // Deletes is the number of delete operations performed.
+	Queries        int     `json:"queries"`        // Queries is the number of query operations performed.
+	FullScans      int     `json:"fullScans"`      // FullScans is the number of queries that scanned every record.
+	CacheHits      int     `json:"cacheHits"`      // CacheHits is the number of lookups answered from the caches.
+	CacheMisses    int     `json:"cacheMisses"`    // CacheMisses is the number of lookups that missed the caches.
+	CacheHitRatio  float64 `json:"cacheHitRatio"`  // CacheHitRatio is CacheHits over all lookups, 0 without lookups.
+	CacheEvictions int     `json:"cacheEvictions"` // CacheEvictions is the number of records evicted from full caches.
+	PendingWrites  int     `json:"pendingWrites"`  // PendingWrites is the number of writes waiting or being written.
+	RejectedWrites int     `json:"rejectedWrites"` // RejectedWrites is the number of writes rejected by the write throttle.
+}
+
+// add adds the metrics of a table to the summary.
+func (m *MetricsSummary) add(table TableMetrics) {
+	m.Tables++
+	m.Records += table.Records
+	m.CachedRecords += table.CachedRecords
+	m.FileSize += table.FileSize
+	m.Inserts += table.Metrics.InsertCount
+	m.Updates += table.Metrics.UpdateCount
+	m.Deletes += table.Metrics.DeleteCount
+	m.Queries += table.Metrics.QueryCount
+	for _, count := range table.Metrics.FullScans {
+		m.FullScans += count
+	}
+	m.CacheHits += table.Metrics.CacheHits
+	m.CacheMisses += table.Metrics.CacheMisses
+	m.CacheEvictions += table.Metrics.CacheEvictions
+	if lookups := m.CacheHits + m.CacheMisses; lookups > 0 {
+		m.CacheHitRatio = float64(m.CacheHits) / float64(lookups)
+	}
+	m.PendingWrites += table.Metrics.PendingWrites
+	m.RejectedWrites += table.Metrics.RejectedWrites
+}
+
+// DatabaseMetrics are the metrics of a database, as reported by Server.Metrics.
+type DatabaseMetrics struct {
+	MetricsSummary                           // The metrics of the tables of the database, added up.
+	TableMetrics   map[string]MetricsSummary `json:"tableMetrics"` // TableMetrics are the metrics of each table, by name.
+}
+
+// ServerMetrics are the metrics of a server rolled up from those of its tables, as returned by Server.Metrics.
+type ServerMetrics struct {
+	MetricsSummary                            // The metrics of every table of the server, added up.
+	Databases      map[string]DatabaseMetrics `json:"databases"` // Databases are the metrics of each database, by name.
+	Taken          time.Time                  `json:"taken"`     // Taken is when the metrics were read.
+}
+
+// Metrics is a method of the Server struct that rolls the metrics of every table up into totals per database and for
+// the whole server: operation counts, cache hit ratios, record counts and file sizes. Like TableMetrics it leaves out
+// the reserved system database, does not read evicted tables back into memory and does not start a new delta
+// interval. The counts are those since each table was opened or its metrics reset.
+//
+// Returns:
+// - A ServerMetrics holding the totals of the server and of each of its databases, and the metrics of each table.
+func (s *Server) Metrics() ServerMetrics {
+	metrics := ServerMetrics{Databases: make(map[string]DatabaseMetrics), Taken: time.Now().UTC()}
+	for _, name := range s.ListDatabases() {
+		metrics.Databases[name] = DatabaseMetrics{TableMetrics: make(map[string]MetricsSummary)}
+	}
+	for _, table := range s.TableMetrics() {
+		db, exists := metrics.Databases[table.Database]
+		if !exists {
+			// The database was created after it was listed.
+			db.TableMetrics = make(map[string]MetricsSummary)
+		}
+		var summary MetricsSummary
+		summary.add(table)
+		db.TableMetrics[table.Table] = summary
+		db.add(table)
+		metrics.Databases[table.Database] = db
+		metrics.add(table)
+	}
+	return metrics
+}
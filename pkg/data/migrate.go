@@ -0,0 +1,544 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+	"google.golang.org/protobuf/proto"
+)
+
+// What ConvertFieldType does with values that cannot be coerced to the target type.
+const (
+	CoerceFail = ""     // CoerceFail leaves the table unchanged and returns ErrCoercionFailed.
+	CoerceNull = "null" // CoerceNull stores NULL instead of the value.
+	CoerceDrop = "drop" // CoerceDrop removes the field from the record.
+)
+
+// ErrCoercionFailed is returned by ConvertFieldType when some values cannot be coerced to the target type and the
+// coercion rules do not say what to do with them. The table is left unchanged.
+var ErrCoercionFailed = errors.New("some values cannot be coerced to the target type")
+
+// CoercionRules controls how ConvertFieldType converts values.
+//
+// By default strings are parsed with strconv.ParseFloat and strconv.ParseBool after trimming spaces, numbers become
+// true when they are 1 and false when they are 0, booleans become 1 and 0, and numbers and booleans become their
+// decimal and "true" or "false" strings. NULL values are kept as they are. Other values, such as nested objects,
+// cannot be coerced.
+type CoercionRules struct {
+	TrueStrings  []string // TrueStrings are further strings, compared case-insensitively, that become true.
+	FalseStrings []string // FalseStrings are further strings, compared case-insensitively, that become false.
+	OnFailure    string   // OnFailure is what to do with values that cannot be coerced: CoerceFail, CoerceNull or CoerceDrop.
+	DryRun       bool     // DryRun only reports what the conversion would do, without changing the table.
+}
+
+// CoercionFailure describes a value that cannot be coerced to the target type.
+type CoercionFailure struct {
+	Key    string      `json:"key"`    // Key is the primary key of the record.
+	Value  interface{} `json:"value"`  // Value is the stored value.
+	Reason string      `json:"reason"` // Reason explains why the value cannot be coerced.
+}
+
+// ConversionReport describes the records changed by ConvertFieldType.
+type ConversionReport struct {
+	Field     string            `json:"field"`     // Field is the converted field.
+	Type      string            `json:"type"`      // Type is the target type.
+	Converted int               `json:"converted"` // Converted is the number of records whose value was coerced.
+	Failures  []CoercionFailure `json:"failures"`  // Failures lists the values that cannot be coerced.
+	DryRun    bool              `json:"dryRun"`    // DryRun is whether the table was left unchanged on purpose.
+}
+
+// RenameField renames a field in every record of the table and in its schema and foreign keys, rewriting the
+// records, their indexes and the table metadata in a single write under the table write lock. Every changed record
+// is reported to the watchers, After hooks and commit log as an update; Before hooks are not run.
+//
+// Parameters:
+// - oldName: The field to rename. It must not be the primary key.
+// - newName: The new name of the field. No record may already have a field with this name.
+//
+// Returns:
+// - The number of records that had the field.
+// - An error, if the names are invalid, a record already has newName, or the table cannot be written. The table is
+// left unchanged on error. If the operation is successful, the error is nil.
+func (t *Table) RenameField(oldName, newName string) (int, error) {
+	defer t.sample("rename_field", "", time.Now())
+	if oldName == t.PrimaryKey || newName == t.PrimaryKey {
+		return 0, fmt.Errorf("the primary key '%s' cannot be renamed", t.PrimaryKey)
+	}
+	if oldName == "" || newName == "" || oldName == newName {
+		return 0, fmt.Errorf("invalid field rename from '%s' to '%s'", oldName, newName)
+	}
+	unlock, err := t.lockWrite(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	allRecords, err := t.recordsForWrite(context.Background())
+	if err != nil {
+		return 0, fmt.Errorf("failed to load records: %w", err)
+	}
+	changed := make(map[string]*dbdata.Record)
+	for key, record := range allRecords.Records {
+		value, exists := record.Fields[oldName]
+		if !exists {
+			continue
+		}
+		if _, taken := record.Fields[newName]; taken {
+			return 0, fmt.Errorf("record %s already has a field '%s'", key, newName)
+		}
+		renamed := proto.Clone(record).(*dbdata.Record)
+		delete(renamed.Fields, oldName)
+		renamed.Fields[newName] = value
+		changed[key] = renamed
+	}
+
+	var foreignKeys []ForeignKey // The renamed foreign keys, nil if none references the field
+	for i, foreignKey := range t.Options.ForeignKeys {
+		if foreignKey.Field == oldName {
+			if foreignKeys == nil {
+				foreignKeys = append([]ForeignKey(nil), t.Options.ForeignKeys...)
+			}
+			foreignKeys[i].Field = newName
+		}
+	}
+	var schema map[string]string // The schema with the field renamed, nil if it does not declare the field
+	if fieldType, declared := t.Options.Schema[oldName]; declared {
+		if _, taken := t.Options.Schema[newName]; taken {
+			return 0, fmt.Errorf("the schema already declares a field '%s'", newName)
+		}
+		schema = make(map[string]string, len(t.Options.Schema))
+		for field, declaredType := range t.Options.Schema {
+			schema[field] = declaredType
+		}
+		delete(schema, oldName)
+		schema[newName] = fieldType
+	}
+	if len(changed) == 0 && foreignKeys == nil && schema == nil {
+		return 0, nil
+	}
+
+	var updateOptions func(options *TableOptions)
+	if foreignKeys != nil || schema != nil {
+		updateOptions = func(options *TableOptions) {
+			if foreignKeys != nil {
+				options.ForeignKeys = foreignKeys
+			}
+			if schema != nil {
+				options.Schema = schema
+			}
+		}
+	}
+	if err := t.rewriteRecords(allRecords, changed, updateOptions); err != nil {
+		return 0, err
+	}
+	return len(changed), nil
+}
+
+// ConvertFieldType converts the values of a field of every record of the table to the target type, rewriting the
+// records and their indexes in a single write under the table write lock, like RenameField. If the schema of the table
+// declares the field, it declares it with the target type afterwards, FieldFloat for FieldNumber.
+//
+// Parameters:
+// - field: The field to convert. It must not be the primary key.
+// - targetType: FieldString, FieldNumber or FieldBool.
+// - rules: How values are coerced, what to do with the values that cannot be, and whether this is a dry run.
+//
+// Returns:
+// - A ConversionReport with the number of converted records and the values that cannot be coerced. It is returned
+// along with ErrCoercionFailed too, so callers can show which values need attention.
+// - An error, if the arguments are invalid, values cannot be coerced and rules.OnFailure is CoerceFail outside a dry
+// run, or the table cannot be written. The table is left unchanged on error. If the operation is successful, the error is nil.
+func (t *Table) ConvertFieldType(field, targetType string, rules CoercionRules) (*ConversionReport, error) {
+	defer t.sample("convert_field", "", time.Now())
+	if field == t.PrimaryKey {
+		return nil, fmt.Errorf("the type of the primary key '%s' cannot be converted", t.PrimaryKey)
+	}
+	if targetType != FieldString && targetType != FieldNumber && targetType != FieldBool {
+		return nil, fmt.Errorf("unknown field type %q, expected string, number or bool", targetType)
+	}
+	if rules.OnFailure != CoerceFail && rules.OnFailure != CoerceNull && rules.OnFailure != CoerceDrop {
+		return nil, fmt.Errorf("unknown coercion failure handling %q, expected null or drop", rules.OnFailure)
+	}
+	unlock, err := t.lockWrite(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if t.Options.ClientEncrypted {
+		return nil, fmt.Errorf("the fields of a client encrypted table cannot be converted")
+	}
+
+	schema := t.convertedSchema(field, targetType)
+	allRecords, err := t.recordsForWrite(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load records: %w", err)
+	}
+	report := &ConversionReport{Field: field, Type: targetType, DryRun: rules.DryRun}
+	changed := make(map[string]*dbdata.Record)
+	for key, record := range allRecords.Records {
+		stored, exists := record.Fields[field]
+		if !exists {
+			continue
+		}
+		value, err := fromProtoValue(stored)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read field '%s' of record %s: %v", field, key, err)
+		}
+		if value == nil || kindOf(value) == targetType {
+			continue
+		}
+
+		converted := proto.Clone(record).(*dbdata.Record)
+		coerced, err := coerceValue(value, targetType, rules)
+		if err != nil {
+			report.Failures = append(report.Failures, CoercionFailure{Key: key, Value: value, Reason: err.Error()})
+			switch rules.OnFailure {
+			case CoerceNull:
+				converted.Fields[field] = dbdata.NewNullValue()
+			case CoerceDrop:
+				delete(converted.Fields, field)
+			}
+		} else {
+			if converted.Fields[field], err = toProtoValue(coerced); err != nil {
+				return nil, fmt.Errorf("failed to store field '%s' of record %s: %v", field, key, err)
+			}
+			report.Converted++
+		}
+		changed[key] = converted
+	}
+	sort.Slice(report.Failures, func(i, j int) bool { return report.Failures[i].Key < report.Failures[j].Key })
+
+	if rules.DryRun || len(changed) == 0 && schema == nil {
+		return report, nil
+	}
+	if len(report.Failures) > 0 && rules.OnFailure == CoerceFail {
+		return report, fmt.Errorf("%w: %d values of field '%s'", ErrCoercionFailed, len(report.Failures), field)
+	}
+	var updateOptions func(options *TableOptions)
+	if schema != nil {
+		updateOptions = func(options *TableOptions) {
+			options.Schema = schema
+		}
+	}
+	if err := t.rewriteRecords(allRecords, changed, updateOptions); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// convertedSchema returns the schema of the table with the field declared with the type matching targetType, or nil
+// if the schema does not declare the field or already declares it with a matching type. The caller must hold the
+// table write lock.
+func (t *Table) convertedSchema(field, targetType string) map[string]string {
+	declared, exists := t.Options.Schema[field]
+	if !exists || declared == targetType || targetType == FieldNumber && (declared == FieldInt || declared == FieldFloat) {
+		return nil
+	}
+	schema := make(map[string]string, len(t.Options.Schema))
+	for name, fieldType := range t.Options.Schema {
+		schema[name] = fieldType
+	}
+	schema[field] = targetType
+	if targetType == FieldNumber {
+		schema[field] = FieldFloat
+	}
+	return schema
+}
+
+// rewriteRecords replaces records with the changed ones, writes the file and, unless updateOptions is nil, the
+// metadata with the options it changes, and reports every changed record as an update. If the metadata cannot be
+// written, the previous records are written back. updateOptions must only assign fields, as it is applied to the
+// options of the table too. The caller must hold the table write lock.
+func (t *Table) rewriteRecords(allRecords *dbdata.Records, changed map[string]*dbdata.Record, updateOptions func(options *TableOptions)) error {
+	previous := make(map[string]*dbdata.Record, len(changed))
+	for key, record := range changed {
+		previous[key] = allRecords.Records[key]
+		sealRecord(record)
+		allRecords.Records[key] = record
+		t.Cache.Remove(key)
+	}
+	if err := t.writeRecordsToFile(allRecords); err != nil {
+		return err
+	}
+
+	if updateOptions != nil {
+		if err := t.saveOptions(updateOptions); err != nil {
+			for key, record := range previous {
+				allRecords.Records[key] = record
+			}
+			if restoreErr := t.writeRecordsToFile(allRecords); restoreErr != nil {
+				return fmt.Errorf("%v, and restoring the records failed: %v", err, restoreErr)
+			}
+			return err
+		}
+	}
+
+	for key, record := range changed {
+		t.metrics.IncrementUpdateCount()
+		t.logChange("update", key, previous[key], record)
+	}
+	return nil
+}
+
+// coerceValue converts a value read from a record to the target type.
+func coerceValue(value interface{}, targetType string, rules CoercionRules) (interface{}, error) {
+	switch targetType {
+	case FieldString:
+		switch v := value.(type) {
+		case int64:
+			return strconv.FormatInt(v, 10), nil
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		}
+	case FieldNumber:
+		switch v := value.(type) {
+		case string:
+			number, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a number", v)
+			}
+			return number, nil
+		case bool:
+			if v {
+				return float64(1), nil
+			}
+			return float64(0), nil
+		}
+	case FieldBool:
+		switch v := value.(type) {
+		case string:
+			trimmed := strings.TrimSpace(v)
+			for _, s := range rules.TrueStrings {
+				if strings.EqualFold(trimmed, s) {
+					return true, nil
+				}
+			}
+			for _, s := range rules.FalseStrings {
+				if strings.EqualFold(trimmed, s) {
+					return false, nil
+				}
+			}
+			b, err := strconv.ParseBool(trimmed)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not a boolean", v)
+			}
+			return b, nil
+		case int64:
+			return coerceNumberToBool(float64(v))
+		case float64:
+			return coerceNumberToBool(v)
+		}
+	}
+	return nil, fmt.Errorf("a %s cannot be converted to a %s", kindOf(value), targetType)
+}
+
+// coerceNumberToBool converts 1 to true and 0 to false.
+func coerceNumberToBool(number float64) (interface{}, error) {
+	switch number {
+	case 1:
+		return true, nil
+	case 0:
+		return false, nil
+	}
+	return nil, fmt.Errorf("%v is neither 0 nor 1", number)
+}
+
+// The operations of AlterTable.
+const (
+	AlterAddField    = "add_field"    // AlterAddField adds a field, with its default value, to the records that do not have it.
+	AlterDropField   = "drop_field"   // AlterDropField removes a field from every record.
+	AlterRenameField = "rename_field" // AlterRenameField renames a field in every record.
+)
+
+// AlterOperation is a change of the fields of a table made by AlterTable.
+type AlterOperation struct {
+	Op      string      `json:"op"`                // Op is AlterAddField, AlterDropField or AlterRenameField.
+	Field   string      `json:"field"`             // Field is the field added, dropped or renamed.
+	NewName string      `json:"newName,omitempty"` // NewName is the new name of a renamed field.
+	Default interface{} `json:"default,omitempty"` // Default is the value an added field is given, NULL if nil.
+	Type    string      `json:"type,omitempty"`    // Type is the schema type of an added field, required if the table has a schema.
+}
+
+// AlterTable is a method of the Database struct that changes the fields of every record of a table: it adds fields
+// with a default value, drops fields and renames fields. The operations are applied in order to the records and to
+// the schema and foreign keys of the table, and the result is written in a single write under the table write lock,
+// like RenameField, so readers see the table either before or after all of them. Every changed record is reported to
+// the watchers, After hooks and commit log as an update.
+//
+// Parameters:
+// - tableName: The name of the table to alter.
+// - operations: The operations, applied in order. None may change the primary key.
+//
+// Returns:
+// - The number of records changed.
+// - An error, if the table does not exist, an operation is invalid, such as adding a field a record already has
+// under the new name of a rename, or the table cannot be written. The table is left unchanged on error. If the
+// operation is successful, the error is nil.
+func (db *Database) AlterTable(tableName string, operations ...AlterOperation) (int, error) {
+	table, err := db.lookupTable(tableName)
+	if err != nil {
+		return 0, err
+	}
+	return table.alter(operations)
+}
+
+// alter applies the operations of AlterTable to the table.
+func (t *Table) alter(operations []AlterOperation) (int, error) {
+	defer t.sample("alter_table", "", time.Now())
+	if len(operations) == 0 {
+		return 0, fmt.Errorf("no alter operations given")
+	}
+	unlock, err := t.lockWrite(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	allRecords, err := t.recordsForWrite(context.Background())
+	if err != nil {
+		return 0, fmt.Errorf("failed to load records: %w", err)
+	}
+	changed := make(map[string]*dbdata.Record)
+	current := func(key string) *dbdata.Record {
+		if record, exists := changed[key]; exists {
+			return record
+		}
+		return allRecords.Records[key]
+	}
+	modified := func(key string) *dbdata.Record {
+		if _, exists := changed[key]; !exists {
+			changed[key] = proto.Clone(allRecords.Records[key]).(*dbdata.Record)
+		}
+		return changed[key]
+	}
+
+	options := t.Options
+	options.ForeignKeys = append([]ForeignKey(nil), t.Options.ForeignKeys...)
+	if t.Options.Schema != nil {
+		options.Schema = make(map[string]string, len(t.Options.Schema))
+		for field, fieldType := range t.Options.Schema {
+			options.Schema[field] = fieldType
+		}
+	}
+
+	for i, op := range operations {
+		if op.Field == "" {
+			return 0, fmt.Errorf("operation %d: a field is required", i+1)
+		}
+		if op.Field == t.PrimaryKey || op.Op == AlterRenameField && op.NewName == t.PrimaryKey {
+			return 0, fmt.Errorf("operation %d: the primary key '%s' cannot be altered", i+1, t.PrimaryKey)
+		}
+		switch op.Op {
+		case AlterAddField:
+			value := op.Default
+			if len(options.Schema) > 0 || op.Type != "" {
+				if _, declared := options.Schema[op.Field]; declared {
+					return 0, fmt.Errorf("operation %d: the schema already declares a field '%s'", i+1, op.Field)
+				}
+				if op.Type == "" {
+					return 0, fmt.Errorf("operation %d: the type of field '%s' is required by the schema", i+1, op.Field)
+				}
+				if value, err = toFieldType(op.Type, value); err != nil {
+					return 0, fmt.Errorf("operation %d: default of field '%s' %v", i+1, op.Field, err)
+				}
+				if len(options.Schema) > 0 {
+					options.Schema[op.Field] = op.Type
+				}
+			}
+			if value != nil {
+				if err := t.checkClientEncrypted(Record{op.Field: value}); err != nil {
+					return 0, fmt.Errorf("operation %d: %v", i+1, err)
+				}
+			}
+			stored, err := toProtoValue(value)
+			if err != nil {
+				return 0, fmt.Errorf("operation %d: invalid default of field '%s': %v", i+1, op.Field, err)
+			}
+			for key := range allRecords.Records {
+				if _, exists := current(key).Fields[op.Field]; !exists {
+					modified(key).Fields[op.Field] = proto.Clone(stored).(*dbdata.Value)
+				}
+			}
+		case AlterDropField:
+			for key := range allRecords.Records {
+				if _, exists := current(key).Fields[op.Field]; exists {
+					delete(modified(key).Fields, op.Field)
+				}
+			}
+			delete(options.Schema, op.Field)
+			foreignKeys := options.ForeignKeys[:0]
+			for _, foreignKey := range options.ForeignKeys {
+				if foreignKey.Field != op.Field {
+					foreignKeys = append(foreignKeys, foreignKey)
+				}
+			}
+			options.ForeignKeys = foreignKeys
+		case AlterRenameField:
+			if op.NewName == "" || op.NewName == op.Field {
+				return 0, fmt.Errorf("operation %d: invalid field rename from '%s' to '%s'", i+1, op.Field, op.NewName)
+			}
+			for key := range allRecords.Records {
+				value, exists := current(key).Fields[op.Field]
+				if !exists {
+					continue
+				}
+				if _, taken := current(key).Fields[op.NewName]; taken {
+					return 0, fmt.Errorf("operation %d: record %s already has a field '%s'", i+1, key, op.NewName)
+				}
+				renamed := modified(key)
+				delete(renamed.Fields, op.Field)
+				renamed.Fields[op.NewName] = value
+			}
+			if fieldType, declared := options.Schema[op.Field]; declared {
+				if _, taken := options.Schema[op.NewName]; taken {
+					return 0, fmt.Errorf("operation %d: the schema already declares a field '%s'", i+1, op.NewName)
+				}
+				delete(options.Schema, op.Field)
+				options.Schema[op.NewName] = fieldType
+			}
+			for j, foreignKey := range options.ForeignKeys {
+				if foreignKey.Field == op.Field {
+					options.ForeignKeys[j].Field = op.NewName
+				}
+			}
+		default:
+			return 0, fmt.Errorf("operation %d: unknown operation %q, expected %s, %s or %s", i+1, op.Op, AlterAddField, AlterDropField, AlterRenameField)
+		}
+	}
+	if err := validateSchema(options); err != nil {
+		return 0, err
+	}
+
+	// Operations may undo each other, such as a field added and dropped again
+	for key, record := range changed {
+		if proto.Equal(record, allRecords.Records[key]) {
+			delete(changed, key)
+		}
+	}
+	if len(options.ForeignKeys) == 0 {
+		options.ForeignKeys = nil
+	}
+	var updateOptions func(options *TableOptions)
+	if !reflect.DeepEqual(options.Schema, t.Options.Schema) || !reflect.DeepEqual(options.ForeignKeys, t.Options.ForeignKeys) {
+		updateOptions = func(updated *TableOptions) {
+			updated.Schema = options.Schema
+			updated.ForeignKeys = options.ForeignKeys
+		}
+	}
+	if len(changed) == 0 && updateOptions == nil {
+		return 0, nil
+	}
+	if err := t.rewriteRecords(allRecords, changed, updateOptions); err != nil {
+		return 0, err
+	}
+	return len(changed), nil
+}
@@ -0,0 +1,215 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationStateFile is the file, in the directory of each database, listing the migrations applied to it. It is part
+// of the backups of the database, so a restored database applies the migrations made after the backup again.
+const migrationStateFile = "migrations.json"
+
+// Migration is a versioned change of the fields of a table, read from a migration file. The file is named after its
+// version and a description, such as 0003_add_order_status.json, and holds the database, table and AlterTable
+// operations:
+//
+//	{"database": "shop", "table": "orders", "operations": [{"op": "add_field", "field": "status", "default": "new"}]}
+type Migration struct {
+	Version    int              `json:"-"`          // Version orders the migrations, from the number the file name starts with.
+	Name       string           `json:"-"`          // Name is the file name.
+	Database   string           `json:"database"`   // Database is the database of the altered table.
+	Table      string           `json:"table"`      // Table is the altered table.
+	Operations []AlterOperation `json:"operations"` // Operations are applied by AlterTable.
+}
+
+// AppliedMigration records a migration applied to a database.
+type AppliedMigration struct {
+	Version   int       `json:"version"`   // Version is the version of the migration.
+	Name      string    `json:"name"`      // Name is the file name of the migration.
+	Records   int       `json:"records"`   // Records is the number of records the migration changed.
+	AppliedAt time.Time `json:"appliedAt"` // AppliedAt is when the migration was applied.
+}
+
+// MigrationReport lists the migrations applied by RunMigrations.
+type MigrationReport struct {
+	Applied []AppliedMigration `json:"applied"` // Applied lists the migrations applied by this run, in order.
+	Pending []string           `json:"pending"` // Pending lists the file names of the migrations left to apply, after a failure or in a dry run.
+}
+
+// getDefaultMigrationsDir returns the directory the migration files are read from, next to the databases directory.
+func getDefaultMigrationsDir() string {
+	return filepath.Join(filepath.Dir(getDefaultServerDir()), "migrations")
+}
+
+// migrationsDir returns the directory the migration files of the server are read from, next to its databases
+// directory.
+func (s *Server) migrationsDir() string {
+	return filepath.Join(s.dataDir(), "migrations")
+}
+
+// ReadMigrations reads the migration files of a directory, sorted by version. Files without the .json extension are
+// ignored. A missing directory holds no migrations.
+//
+// Parameters:
+// - dir: The directory of the migration files, or "" for the migrations directory next to the databases.
+//
+// Returns:
+// - The migrations, sorted by version.
+// - An error, if a file name does not start with a positive version, two files have the same version, or a file
+// cannot be read or parsed. If the operation is successful, the error is nil.
+func ReadMigrations(dir string) ([]Migration, error) {
+	if dir == "" {
+		dir = getDefaultMigrationsDir()
+	}
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read migrations directory: %v", err)
+	}
+
+	var migrations []Migration
+	versions := make(map[int]string)
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		prefix, _, _ := strings.Cut(strings.TrimSuffix(file.Name(), ".json"), "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s must be named after its version, such as 0001_%s", file.Name(), file.Name())
+		}
+		if other, exists := versions[version]; exists {
+			return nil, fmt.Errorf("migrations %s and %s have the same version %d", other, file.Name(), version)
+		}
+		versions[version] = file.Name()
+
+		content, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %v", file.Name(), err)
+		}
+		migration := Migration{Version: version, Name: file.Name()}
+		if err := json.Unmarshal(content, &migration); err != nil {
+			return nil, fmt.Errorf("failed to parse migration %s: %v", file.Name(), err)
+		}
+		if migration.Database == "" || migration.Table == "" {
+			return nil, fmt.Errorf("migration %s must name a database and a table", file.Name())
+		}
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// RunMigrations is a method of the Server struct that applies the migrations of a directory that have not been
+// applied to their database yet, in version order, and records each one in the database once it is applied. A
+// migration whose version is lower than one already applied is still applied, so that migrations merged from
+// different branches are not skipped.
+//
+// Parameters:
+// - dir: The directory of the migration files, or "" for the migrations directory next to the databases.
+// - dryRun: Whether to only list the pending migrations, without applying them.
+//
+// Returns:
+// - A pointer to a MigrationReport with the migrations applied and those left pending.
+// - An error, if the migrations cannot be read or one fails, in which case the migrations before it stay applied and
+// the report lists it and the following ones as pending, or ErrReadOnly if migrations are pending on a read-only
+// server. If the operation is successful, the error is nil.
+func (s *Server) RunMigrations(dir string, dryRun bool) (*MigrationReport, error) {
+	if dir == "" {
+		dir = s.migrationsDir()
+	}
+	migrations, err := ReadMigrations(dir)
+	if err != nil {
+		return nil, err
+	}
+	report := &MigrationReport{Applied: []AppliedMigration{}, Pending: []string{}}
+	applied := make(map[string]map[int]bool)
+	var pending []Migration
+	for _, migration := range migrations {
+		if applied[migration.Database] == nil {
+			state, err := s.readMigrationState(migration.Database)
+			if err != nil {
+				return nil, err
+			}
+			applied[migration.Database] = make(map[int]bool, len(state))
+			for _, done := range state {
+				applied[migration.Database][done.Version] = true
+			}
+		}
+		if !applied[migration.Database][migration.Version] {
+			pending = append(pending, migration)
+			report.Pending = append(report.Pending, migration.Name)
+		}
+	}
+	if dryRun {
+		return report, nil
+	}
+	if err := s.writable(); err != nil && len(pending) > 0 {
+		return report, fmt.Errorf("%d migrations are pending: %w", len(pending), err)
+	}
+
+	for _, migration := range pending {
+		db, err := s.Database(migration.Database)
+		if err != nil {
+			return report, fmt.Errorf("migration %s: %w", migration.Name, err)
+		}
+		records, err := db.AlterTable(migration.Table, migration.Operations...)
+		if err != nil {
+			return report, fmt.Errorf("migration %s: %w", migration.Name, err)
+		}
+		done := AppliedMigration{Version: migration.Version, Name: migration.Name, Records: records, AppliedAt: time.Now().UTC()}
+		if err := s.recordMigration(migration.Database, done); err != nil {
+			return report, fmt.Errorf("migration %s was applied but could not be recorded: %v", migration.Name, err)
+		}
+		report.Applied = append(report.Applied, done)
+		report.Pending = report.Pending[1:]
+	}
+	return report, nil
+}
+
+// AppliedMigrations is a method of the Server struct that lists the migrations applied to a database, in the order
+// they were applied.
+func (s *Server) AppliedMigrations(dbName string) ([]AppliedMigration, error) {
+	if _, err := s.Database(dbName); err != nil {
+		return nil, err
+	}
+	return s.readMigrationState(dbName)
+}
+
+// readMigrationState reads the migrations applied to a database, none if it has no migration state file.
+func (s *Server) readMigrationState(dbName string) ([]AppliedMigration, error) {
+	if !ValidFilename(dbName) {
+		return nil, fmt.Errorf("invalid database name: %s", dbName)
+	}
+	content, err := os.ReadFile(filepath.Join(s.databasesDir(), dbName, migrationStateFile))
+	if os.IsNotExist(err) {
+		return []AppliedMigration{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read the migrations of database %s: %v", dbName, err)
+	}
+	var state []AppliedMigration
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse the migrations of database %s: %v", dbName, err)
+	}
+	return state, nil
+}
+
+// recordMigration adds an applied migration to the migration state file of its database.
+func (s *Server) recordMigration(dbName string, migration AppliedMigration) error {
+	state, err := s.readMigrationState(dbName)
+	if err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(append(state, migration), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(s.databasesDir(), dbName, migrationStateFile), content, 0644)
+}
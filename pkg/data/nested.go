@@ -0,0 +1,165 @@
+package data
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// fieldValue returns the value of a field of the record, and false if the record does not have it. A path of dot
+// separated names, such as "address.city", selects a value nested in objects, and a number selects an element of a
+// list, as in "tags.0". A field whose own name contains dots is found by its full name first.
+func fieldValue(record *dbdata.Record, path string) (*dbdata.Value, bool) {
+	if value, exists := record.Fields[path]; exists {
+		return value, true
+	}
+	field, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		return nil, false
+	}
+	var current *structpb.Value
+	switch v := record.Fields[field].GetKind().(type) {
+	case *dbdata.Value_StructValue:
+		current = structpb.NewStructValue(v.StructValue)
+	case *dbdata.Value_ListValue:
+		current = structpb.NewListValue(v.ListValue)
+	default:
+		return nil, false
+	}
+	for _, name := range strings.Split(rest, ".") {
+		switch v := current.GetKind().(type) {
+		case *structpb.Value_StructValue:
+			next, exists := v.StructValue.GetFields()[name]
+			if !exists {
+				return nil, false
+			}
+			current = next
+		case *structpb.Value_ListValue:
+			i, err := strconv.Atoi(name)
+			if err != nil || i < 0 || i >= len(v.ListValue.GetValues()) {
+				return nil, false
+			}
+			current = v.ListValue.Values[i]
+		default:
+			return nil, false
+		}
+	}
+	return dbdata.NewValueFromStructpb(current), true
+}
+
+// recordPath returns the value of a field of a record converted to Go values, looking up nested paths like fieldValue.
+func recordPath(record Record, path string) (interface{}, bool) {
+	if value, exists := record[path]; exists {
+		return value, true
+	}
+	field, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		return nil, false
+	}
+	current, exists := record[field]
+	if !exists {
+		return nil, false
+	}
+	for _, name := range strings.Split(rest, ".") {
+		switch v := current.(type) {
+		case map[string]interface{}:
+			if current, exists = v[name]; !exists {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(name)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			current = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// equalStructs reports whether two objects have the same fields with equal values, compared like Equal does.
+func equalStructs(s1, s2 *structpb.Struct) bool {
+	if len(s1.GetFields()) != len(s2.GetFields()) {
+		return false
+	}
+	for name, value1 := range s1.GetFields() {
+		value2, exists := s2.GetFields()[name]
+		if !exists || !Equal(dbdata.NewValueFromStructpb(value1), dbdata.NewValueFromStructpb(value2)) {
+			return false
+		}
+	}
+	return true
+}
+
+// equalLists reports whether two lists have equal values in the same order, compared like Equal does.
+func equalLists(l1, l2 *structpb.ListValue) bool {
+	if len(l1.GetValues()) != len(l2.GetValues()) {
+		return false
+	}
+	for i, value1 := range l1.GetValues() {
+		if !Equal(dbdata.NewValueFromStructpb(value1), dbdata.NewValueFromStructpb(l2.GetValues()[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+// indexedPaths calls visit with every field of the record that is indexed: the fields holding an indexable value
+// and, for fields holding objects, the paths of the nested non-empty strings and integral numbers, such as
+// "address.city". Values nested in lists, or in fields whose own name contains dots, are not indexed, as fieldValue
+// does not find them. A nested path is skipped when the record has a field with the same name, which fieldValue
+// finds first.
+func indexedPaths(record *dbdata.Record, visit func(path string)) {
+	for field, value := range record.Fields {
+		if indexable(value) {
+			visit(field)
+		}
+		if s, ok := value.GetKind().(*dbdata.Value_StructValue); ok && !strings.Contains(field, ".") {
+			visitNestedPaths(record, field, s.StructValue, visit)
+		}
+	}
+}
+
+// visitNestedPaths calls visit with the paths of the indexable values nested in an object stored at prefix.
+func visitNestedPaths(record *dbdata.Record, prefix string, s *structpb.Struct, visit func(path string)) {
+	for name, value := range s.GetFields() {
+		path := prefix + "." + name
+		if _, shadowed := record.Fields[path]; shadowed || strings.Contains(name, ".") {
+			continue
+		}
+		switch v := value.GetKind().(type) {
+		case *structpb.Value_StringValue:
+			if v.StringValue != "" {
+				visit(path)
+			}
+		case *structpb.Value_NumberValue:
+			if v.NumberValue == math.Trunc(v.NumberValue) && !math.IsInf(v.NumberValue, 0) {
+				visit(path)
+			}
+		case *structpb.Value_StructValue:
+			visitNestedPaths(record, path, v.StructValue, visit)
+		}
+	}
+}
+
+// pathValue returns the value of a field or nested path of the record, see fieldValue, and nil if it has none.
+func pathValue(record *dbdata.Record, path string) *dbdata.Value {
+	value, _ := fieldValue(record, path)
+	return value
+}
+
+// isIndexed reports whether the record belongs in the index of the given field or nested path.
+func isIndexed(record *dbdata.Record, path string) bool {
+	indexed := false
+	indexedPaths(record, func(p string) {
+		if p == path {
+			indexed = true
+		}
+	})
+	return indexed
+}
@@ -0,0 +1,105 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Malpizarr/dbproto/pkg/utils"
+)
+
+// TableOptions holds the optional settings of a table. They are stored in the table's metadata file
+// next to the primary key, so they survive restarts.
+type TableOptions struct {
+	ClientEncrypted  bool                 `json:"ClientEncrypted,omitempty"`  // ClientEncrypted requires every field except the primary key to be encrypted by the client.
+	Pipeline         []string             `json:"Pipeline,omitempty"`         // Pipeline lists the storage stages applied when writing the file, DefaultPipeline if empty.
+	Retry            *RetryPolicy         `json:"Retry,omitempty"`            // Retry controls retries of file operations after transient errors, DefaultRetryPolicy if nil.
+	AutoID           bool                 `json:"AutoID,omitempty"`           // AutoID generates a random primary key for inserted records that have none.
+	Timestamps       bool                 `json:"Timestamps,omitempty"`       // Timestamps maintains the created_at and updated_at fields of every record.
+	VerifyChecksums  bool                 `json:"VerifyChecksums,omitempty"`  // VerifyChecksums makes loading the file fail with a CorruptRecordsError if a record does not match its checksum.
+	ForeignKeys      []ForeignKey         `json:"ForeignKeys,omitempty"`      // ForeignKeys declares the fields that reference records of other tables of the database.
+	Schema           map[string]string    `json:"Schema,omitempty"`           // Schema declares the type of every field, so writes of other fields or types are rejected. Tables without one accept any field.
+	KeyNormalization *KeyNormalization    `json:"KeyNormalization,omitempty"` // KeyNormalization sets the rules applied to string primary keys, none if nil.
+	Retention        *RetentionPolicy     `json:"Retention,omitempty"`        // Retention declares how long records are kept, forever if nil.
+	ComputedFields   []ComputedField      `json:"ComputedFields,omitempty"`   // ComputedFields declares the fields computed from the other fields of each record.
+	Rules            map[string]FieldRule `json:"Rules,omitempty"`            // Rules constrains the values written to each field, such as a pattern or a range.
+	CacheSize        int                  `json:"CacheSize,omitempty"`        // CacheSize is the number of records the lookup cache holds, see Table.SetCacheSize.
+	WriteBehind      *WriteBehind         `json:"WriteBehind,omitempty"`      // WriteBehind defers writing the file to a flush shared by many writes, every write writes it if nil.
+	Concurrency      int                  `json:"Concurrency,omitempty"`      // Concurrency is the number of goroutines that marshal and encode the file in chunks, and decode it; a single blob if 0 or 1.
+	Compression      string               `json:"Compression,omitempty"`      // Compression is the algorithm that compresses the marshaled records before the pipeline, none if empty.
+	Segmentation     *Segmentation        `json:"Segmentation,omitempty"`     // Segmentation writes the changes of each write to a segment file merged by compaction, every write rewrites the file if nil.
+	InMemory         bool                 `json:"InMemory,omitempty"`         // InMemory holds the records only in memory, with no data file, so they are lost when the table is closed.
+	ReadOnly         bool                 `json:"-"`                          // ReadOnly opens the table read-only, see Table.SetReadOnly; it is never stored in the metadata.
+}
+
+// MemoryPath is the file path that opens a table only held in memory with OpenTable, like an empty one.
+const MemoryPath = ":memory:"
+
+// ForeignKey declares that a field holds the primary key of a record of another table of the same database.
+// Foreign keys are not enforced on writes; Database.Denormalize follows them to embed the referenced records.
+type ForeignKey struct {
+	Field string `json:"Field"`        // Field is the field holding the primary key of the referenced record.
+	Table string `json:"Table"`        // Table is the referenced table.
+	As    string `json:"As,omitempty"` // As is the field the referenced record is embedded under, Field itself if empty.
+}
+
+// tableMeta is the content of a table's .meta file.
+type tableMeta struct {
+	PrimaryKey string `json:"PrimaryKey"` // PrimaryKey is the field name used as the primary key.
+	TableOptions
+}
+
+// writeTableMeta saves the primary key and options of a table in its metadata file.
+func writeTableMeta(metaFilePath string, meta tableMeta) error {
+	metaDataBytes, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to serialize metadata: %v", err)
+	}
+	if err := os.WriteFile(metaFilePath, metaDataBytes, 0644); err != nil {
+		return fmt.Errorf("failed to write metadata file: %v", err)
+	}
+	return nil
+}
+
+// readTableMeta loads the primary key and options of a table from its metadata file.
+func readTableMeta(metaFilePath string) (tableMeta, error) {
+	var meta tableMeta
+	metaDataBytes, err := os.ReadFile(metaFilePath)
+	if err != nil {
+		return meta, fmt.Errorf("failed to read metadata file: %v", err)
+	}
+	if err := json.Unmarshal(metaDataBytes, &meta); err != nil {
+		return meta, fmt.Errorf("failed to deserialize metadata: %v", err)
+	}
+	return meta, nil
+}
+
+// saveOptions applies update to the options of the table and saves them in its metadata file, leaving the options
+// unchanged if the file cannot be written. Temporary tables and tables opened at MemoryPath have no metadata file,
+// unlike the tables of a database held in memory. The caller must hold the table write lock.
+func (t *Table) saveOptions(update func(options *TableOptions)) error {
+	options := t.Options
+	update(&options)
+	if !t.temporary || t.Options.InMemory && t.FilePath != MemoryPath {
+		metaFilePath := strings.TrimSuffix(t.FilePath, ".dat") + ".meta"
+		if err := writeTableMeta(metaFilePath, tableMeta{PrimaryKey: t.PrimaryKey, TableOptions: options}); err != nil {
+			return err
+		}
+	}
+	update(&t.Options)
+	return nil
+}
+
+// checkClientEncrypted rejects plaintext values on client encrypted tables, so the server never stores them.
+func (t *Table) checkClientEncrypted(record Record) error {
+	if !t.Options.ClientEncrypted {
+		return nil
+	}
+	for field, value := range record {
+		if field != t.PrimaryKey && !utils.IsCiphertext(value) {
+			return fmt.Errorf("field '%s' must be encrypted by the client", field)
+		}
+	}
+	return nil
+}
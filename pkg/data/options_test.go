@@ -0,0 +1,40 @@
+package data_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+	"github.com/Malpizarr/dbproto/pkg/utils"
+)
+
+// TestClientEncryptedRejectsMarkedPlaintext checks that a client encrypted table stores values encrypted by
+// EncryptValue but rejects plaintext that only starts with the ciphertext prefix.
+func TestClientEncryptedRejectsMarkedPlaintext(t *testing.T) {
+	if os.Getenv("AES_KEY") == "" && os.Getenv("AES_KEY_FILE") == "" {
+		t.Setenv("AES_KEY", "0123456789abcdef0123456789abcdef")
+	}
+	table, err := data.OpenTable("id", filepath.Join(t.TempDir(), "people.dat"), data.TableOptions{ClientEncrypted: true})
+	if err != nil {
+		t.Fatalf("Failed to open table: %v", err)
+	}
+	defer table.Close()
+
+	clientUtils, err := utils.NewUtilsWithKey([]byte("fedcba9876543210fedcba9876543210"))
+	if err != nil {
+		t.Fatalf("Failed to create client utils: %v", err)
+	}
+	ssn, err := clientUtils.EncryptValue("123-45-6789")
+	if err != nil {
+		t.Fatalf("Failed to encrypt value: %v", err)
+	}
+	if err := table.Insert(data.Record{"id": "p1", "ssn": ssn}); err != nil {
+		t.Errorf("Failed to insert an encrypted value: %v", err)
+	}
+	for _, value := range []string{utils.CiphertextPrefix + "123-45-6789", utils.CiphertextPrefix, utils.CiphertextPrefix + "ZGJwRQE="} {
+		if err := table.Insert(data.Record{"id": "p2", "ssn": value}); err == nil {
+			t.Errorf("Inserted the plaintext value %q into a client encrypted table", value)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package data
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OTLPExporter exports operation samples and the spans of traced requests to an OpenTelemetry collector, using OTLP
+// over HTTP with the JSON encoding. Each sample becomes a span named after its operation, lasting its latency, with
+// the size bucket and plan as attributes. It is both a TelemetryExporter and a SpanExporter.
+type OTLPExporter struct {
+	Endpoint    string       // Endpoint is the base URL of the collector, such as http://localhost:4318.
+	ServiceName string       // ServiceName is the service.name resource attribute, "dbproto" if empty.
+	Client      *http.Client // Client sends the requests, a client with a 10 second timeout if nil.
+}
+
+// otlpAttribute is a key-value pair of the OTLP JSON encoding, restricted to string values.
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+// otlpSpan is a span of the OTLP JSON encoding. Times are nanoseconds since the Unix epoch, written as strings.
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+// otlpStatus is the status of a failed span of the OTLP JSON encoding.
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 is STATUS_CODE_ERROR
+	Message string `json:"message"`
+}
+
+// Export sends the samples to the collector in a single request.
+func (e *OTLPExporter) Export(samples []OperationSample) error {
+	spans := make([]otlpSpan, 0, len(samples))
+	for _, sample := range samples {
+		ids := make([]byte, 24)
+		if _, err := rand.Read(ids); err != nil {
+			return fmt.Errorf("failed to generate span IDs: %v", err)
+		}
+		attributes := []otlpAttribute{
+			newOTLPAttribute("db.system", "dbproto"),
+			newOTLPAttribute("db.operation.name", sample.Operation),
+			newOTLPAttribute("dbproto.table.size_bucket", sample.SizeBucket),
+		}
+		if sample.Plan != "" {
+			attributes = append(attributes, newOTLPAttribute("dbproto.plan", sample.Plan))
+		}
+		spans = append(spans, otlpSpan{
+			TraceID:    hex.EncodeToString(ids[:16]),
+			SpanID:     hex.EncodeToString(ids[16:]),
+			Name:       sample.Operation,
+			Kind:       SpanKindInternal,
+			Start:      strconv.FormatInt(sample.Time.UnixNano(), 10),
+			End:        strconv.FormatInt(sample.Time.Add(sample.Latency).UnixNano(), 10),
+			Attributes: attributes,
+		})
+	}
+	return e.send(spans)
+}
+
+// ExportSpans sends the spans of traced requests to the collector in a single request.
+func (e *OTLPExporter) ExportSpans(spans []*Span) error {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		keys := make([]string, 0, len(span.Attributes))
+		for key := range span.Attributes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		attributes := []otlpAttribute{newOTLPAttribute("db.system", "dbproto")}
+		for _, key := range keys {
+			attributes = append(attributes, newOTLPAttribute(key, span.Attributes[key]))
+		}
+		otlp := otlpSpan{
+			TraceID:    hex.EncodeToString(span.TraceID[:]),
+			SpanID:     hex.EncodeToString(span.SpanID[:]),
+			Name:       span.Name,
+			Kind:       span.Kind,
+			Start:      strconv.FormatInt(span.StartTime.UnixNano(), 10),
+			End:        strconv.FormatInt(span.EndTime.UnixNano(), 10),
+			Attributes: attributes,
+		}
+		if span.ParentID != [8]byte{} {
+			otlp.ParentSpanID = hex.EncodeToString(span.ParentID[:])
+		}
+		if span.Error != "" {
+			otlp.Status = &otlpStatus{Code: 2, Message: span.Error}
+		}
+		encoded = append(encoded, otlp)
+	}
+	return e.send(encoded)
+}
+
+// send posts the spans to the traces endpoint of the collector.
+func (e *OTLPExporter) send(spans []otlpSpan) error {
+	serviceName := e.ServiceName
+	if serviceName == "" {
+		serviceName = "dbproto"
+	}
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{newOTLPAttribute("service.name", serviceName)},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/Malpizarr/dbproto"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to serialize spans: %v", err)
+	}
+
+	client := e.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Post(strings.TrimSuffix(e.Endpoint, "/")+"/v1/traces", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to send spans: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("collector answered %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// newOTLPAttribute returns a string attribute.
+func newOTLPAttribute(key, value string) otlpAttribute {
+	var attribute otlpAttribute
+	attribute.Key = key
+	attribute.Value.StringValue = value
+	return attribute
+}
@@ -0,0 +1,105 @@
+package data
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+)
+
+// userBaseDir returns the per-user directory under which dbproto keeps its data.
+// On Windows it prefers APPDATA, then LOCALAPPDATA and USERPROFILE, which may be unset for service accounts.
+// Elsewhere it uses HOME. If none of them is set it falls back to os.UserHomeDir and finally to the working directory.
+// The result is always absolute, so the os package can apply the Windows long path prefix to paths below it.
+func userBaseDir() string {
+	var candidates []string
+	switch runtime.GOOS {
+	case "windows":
+		candidates = []string{os.Getenv("APPDATA"), os.Getenv("LOCALAPPDATA"), os.Getenv("USERPROFILE")}
+	default:
+		candidates = []string{os.Getenv("HOME")}
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		candidates = append(candidates, home)
+	}
+	candidates = append(candidates, ".")
+
+	for _, dir := range candidates {
+		if dir == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(dir); err == nil {
+			return abs
+		}
+	}
+	return "."
+}
+
+// dataDir and backupDir are the directories set with SetDataDir and SetBackupDir, nil until they are set.
+var dataDir, backupDir atomic.Pointer[string]
+
+// SetDataDir sets the directory holding the databases and the backups, in place of DBPROTO_DATA_DIR, which is read
+// when it is not set. An empty dir restores the default. It must be set before the server is initialized, as tables
+// already open keep the paths they were opened with.
+func SetDataDir(dir string) {
+	dataDir.Store(&dir)
+}
+
+// SetBackupDir sets the directory backups are written to and restored from by default, in place of
+// DBPROTO_BACKUP_DIR, which is read when it is not set. An empty dir restores the default.
+func SetBackupDir(dir string) {
+	backupDir.Store(&dir)
+}
+
+// configuredDir returns the directory set in dir, or else the value of the environment variable.
+func configuredDir(dir *atomic.Pointer[string], variable string) string {
+	if set := dir.Load(); set != nil && *set != "" {
+		return *set
+	}
+	return os.Getenv(variable)
+}
+
+// containerDataDir is the volume mount point used as data directory when it exists and DBPROTO_DATA_DIR is unset.
+const containerDataDir = "/data"
+
+// dataRootDir returns the directory holding both the databases and the backups when dbproto runs with a
+// dedicated data directory: the one set with SetDataDir or DBPROTO_DATA_DIR, otherwise /data if it is a directory.
+// It returns "" when neither applies and the per-user layout below userBaseDir is used.
+func dataRootDir() string {
+	if dir := configuredDir(&dataDir, "DBPROTO_DATA_DIR"); dir != "" {
+		if abs, err := filepath.Abs(dir); err == nil {
+			return abs
+		}
+		return dir
+	}
+	if runtime.GOOS != "windows" {
+		if info, err := os.Stat(containerDataDir); err == nil && info.IsDir() {
+			return containerDataDir
+		}
+	}
+	return ""
+}
+
+// archivePath returns the name under which the file at relativePath is stored in a backup archive.
+// Zip entries always use forward slashes, whatever the operating system.
+func archivePath(relativePath string) string {
+	return filepath.ToSlash(relativePath)
+}
+
+// restorePath returns the location inside baseDir of the backup archive entry with the given name.
+// It rejects absolute names, volume names and names that climb out of baseDir, so a crafted archive
+// cannot overwrite files outside the data directory.
+func restorePath(baseDir, name string) (string, error) {
+	localName := filepath.FromSlash(strings.ReplaceAll(name, `\`, "/"))
+	if filepath.IsAbs(localName) || filepath.VolumeName(localName) != "" || strings.HasPrefix(localName, string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid path %q in backup", name)
+	}
+	target := filepath.Join(baseDir, localName)
+	relative, err := filepath.Rel(baseDir, target)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid path %q in backup", name)
+	}
+	return target, nil
+}
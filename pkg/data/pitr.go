@@ -0,0 +1,353 @@
+package data
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// ErrNoBaseBackup is returned by RestoreToTime when no backup was finished by the time to restore to.
+var ErrNoBaseBackup = errors.New("no backup finished before the recovery time")
+
+// ErrNoCommitLog is returned by RestoreToTime when the server writes no commit log to a directory and no directory
+// was given.
+var ErrNoCommitLog = errors.New("no commit log directory")
+
+// PointInTimeReport describes a restore to a point in time, see RestoreToTime.
+type PointInTimeReport struct {
+	Time     time.Time       `json:"time"`              // Time is the point in time the databases are restored to.
+	Backup   string          `json:"backup"`            // Backup is the path of the backup restored before replaying the commit log.
+	Started  time.Time       `json:"started"`           // Started is when the backup was started, the first commit log entry replayed is from then.
+	Finished time.Time       `json:"finished"`          // Finished is when the backup was finished.
+	Entries  int             `json:"entries"`           // Entries is the number of commit log entries replayed, or to replay for a preview.
+	Skipped  []string        `json:"skipped,omitempty"` // Skipped lists the tables, as "db.table", whose entries were skipped because the restored server has no such table.
+	Restore  *RestorePreview `json:"restore"`           // Restore compares the backup with the live data directory before it was restored.
+}
+
+// backupTimes is stored as JSON in the comment of every backup archive, so a restore to a point in time knows which
+// commit log entries the backup may miss.
+type backupTimes struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+// backupComment returns the archive comment of a backup started and finished at the given times.
+func backupComment(started, finished time.Time) string {
+	comment, _ := json.Marshal(backupTimes{Started: started, Finished: finished})
+	return string(comment)
+}
+
+// PreviewRestoreToTime finds the backup and commit log entries RestoreToTime would restore and replay, without
+// changing anything.
+//
+// Parameters:
+// - at: The point in time to restore the databases to.
+// - commitLogDir: Optional directory of the commit log files. If it is omitted, the directory the server writes its commit log to is used.
+//
+// Returns:
+// - A PointInTimeReport with the backup, the number of entries to replay and the comparison of the backup with the live data directory.
+// - An error, if no backup was finished by at, or the backup or the commit log cannot be read. If the operation is successful, the error is nil.
+func (s *Server) PreviewRestoreToTime(at time.Time, commitLogDir ...string) (*PointInTimeReport, error) {
+	report, entries, err := s.planRestoreToTime(at, commitLogDir)
+	if err != nil {
+		return nil, err
+	}
+	s.RLock()
+	defer s.RUnlock()
+	if report.Restore, err = s.previewRestore(report.Backup); err != nil {
+		return nil, err
+	}
+	report.Entries = len(entries)
+	return report, nil
+}
+
+// RestoreToTime restores the databases to their state at a point in time between backups: it restores the newest
+// backup finished by then, like Restore with the overwrite confirmed, and replays the commit log entries of the
+// server committed from the start of the backup up to and including at. Entries the backup already holds are
+// replayed too, which changes nothing since every entry sets a record to the image it had after the write, or deletes
+// it. Replayed changes run no hooks, rules or generated fields and are not logged again, and records are restored
+// with the types JSON gives them back, integers and floating point numbers, unless the table declares a schema.
+// Databases and tables that are not in the backup are left as they are, and entries of tables the restored server
+// does not have are skipped.
+//
+// Parameters:
+// - at: The point in time to restore the databases to.
+// - commitLogDir: Optional directory of the commit log files, see RotatingFileSink. If it is omitted, the directory the server writes its commit log to is used.
+//
+// Returns:
+// - A PointInTimeReport with the backup restored, the number of entries replayed and the tables skipped.
+// - An error wrapping ErrNoBaseBackup if no backup was finished by at, ErrNoCommitLog if there is no commit log
+// directory, or an error if the backup cannot be restored or an entry cannot be replayed. If the operation is successful, the error is nil.
+func (s *Server) RestoreToTime(at time.Time, commitLogDir ...string) (*PointInTimeReport, error) {
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	report, entries, err := s.planRestoreToTime(at, commitLogDir)
+	if err != nil {
+		return nil, err
+	}
+	if report.Restore, err = s.restore(RestoreOptions{Path: report.Backup, ConfirmOverwrite: true}, nil); err != nil {
+		return report, err
+	}
+
+	// The entries of every table are replayed together, in the order they were committed
+	type tableName struct{ database, table string }
+	var order []tableName
+	byTable := make(map[tableName][]*LogEntry)
+	for _, entry := range entries {
+		name := tableName{entry.Database, entry.Table}
+		if _, seen := byTable[name]; !seen {
+			order = append(order, name)
+		}
+		byTable[name] = append(byTable[name], entry)
+	}
+	for _, name := range order {
+		table, err := s.replayTable(name.database, name.table)
+		if err != nil {
+			report.Skipped = append(report.Skipped, name.database+"."+name.table)
+			continue
+		}
+		if err := table.replay(byTable[name]); err != nil {
+			return report, fmt.Errorf("failed to replay the commit log of table %s.%s: %v", name.database, name.table, err)
+		}
+		report.Entries += len(byTable[name])
+	}
+	return report, nil
+}
+
+// replayTable returns the table the commit log entries of database and table are replayed to.
+func (s *Server) replayTable(database, table string) (*Table, error) {
+	db, err := s.Database(database)
+	if err != nil {
+		return nil, err
+	}
+	return db.lookupTable(table)
+}
+
+// planRestoreToTime returns the report of a restore to at, with the backup it restores, and the commit log entries it
+// replays, in the order they were committed.
+func (s *Server) planRestoreToTime(at time.Time, commitLogDir []string) (*PointInTimeReport, []*LogEntry, error) {
+	dir := ""
+	if len(commitLogDir) > 0 {
+		dir = commitLogDir[0]
+	}
+	if dir == "" {
+		dir = s.commitLogDir()
+	}
+	if dir == "" {
+		return nil, nil, ErrNoCommitLog
+	}
+
+	backups, err := s.ListBackups()
+	if err != nil {
+		return nil, nil, err
+	}
+	report := &PointInTimeReport{Time: at}
+	for _, backup := range backups {
+		times, err := readBackupTimes(backup)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !times.Finished.After(at) {
+			report.Backup, report.Started, report.Finished = backup.Path, times.Started, times.Finished
+			break
+		}
+	}
+	if report.Backup == "" {
+		return nil, nil, fmt.Errorf("%w: %s", ErrNoBaseBackup, at.Format(time.RFC3339))
+	}
+
+	entries, err := readCommitLog(dir, func(entry *LogEntry) bool {
+		return entry.Tenant == s.tenant && !entry.Time.Before(report.Started) && !entry.Time.After(at)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return report, entries, nil
+}
+
+// commitLogDir returns the directory the commit log of the server is written to, empty if it has none.
+func (s *Server) commitLogDir() string {
+	s.RLock()
+	commitLog := s.commitLog
+	s.RUnlock()
+	if commitLog == nil {
+		return ""
+	}
+	commitLog.Lock()
+	defer commitLog.Unlock()
+	for _, sink := range commitLog.sinks {
+		if fileSink, ok := sink.(*RotatingFileSink); ok {
+			return fileSink.Dir
+		}
+	}
+	return ""
+}
+
+// readBackupTimes returns when the backup was started and finished, from the comment of its archive. Backups written
+// before the times were recorded are assumed to have been started at the minute in their name, or with the commit
+// log for the legacy backup.zip, and finished when their file was last modified.
+func readBackupTimes(backup Backup) (backupTimes, error) {
+	archive, err := zip.OpenReader(backup.Path)
+	if err != nil {
+		return backupTimes{}, fmt.Errorf("failed to open backup file: %v", err)
+	}
+	defer archive.Close()
+
+	var times backupTimes
+	if err := json.Unmarshal([]byte(archive.Comment), &times); err == nil && !times.Finished.IsZero() {
+		return times, nil
+	}
+	times = backupTimes{Finished: backup.modified}
+	if backup.File != legacyBackupFile {
+		times.Started = backup.Created
+	}
+	return times, nil
+}
+
+// readCommitLog reads the entries kept by keep from the commit log files in dir, in the order they were committed.
+// Every entry is checked against its hash, so edited entries are never replayed.
+func readCommitLog(dir string, keep func(entry *LogEntry) bool) ([]*LogEntry, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "commitlog-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	// The names start with the time the file was started at, then the sequence of its first entry
+	sort.Strings(files)
+
+	var entries []*LogEntry
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open commit log file: %v", err)
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+			entry, err := parseLogEntry(text)
+			if err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%s:%d: %v", filepath.Base(path), line, err)
+			}
+			if keep(entry) {
+				entries = append(entries, entry)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read commit log file %s: %v", filepath.Base(path), err)
+		}
+	}
+	return entries, nil
+}
+
+// parseLogEntry parses a JSON line of the commit log and checks it against its hash. Numbers of the record are
+// decoded as int64 if they are integers and float64 otherwise; they are hashed as written, so large integers match.
+func parseLogEntry(line string) (*LogEntry, error) {
+	var entry LogEntry
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	if err := decoder.Decode(&entry); err != nil {
+		return nil, fmt.Errorf("failed to parse log entry: %v", err)
+	}
+	hash, err := hashLogEntry(&entry)
+	if err != nil {
+		return nil, err
+	}
+	if hash != entry.Hash {
+		return nil, fmt.Errorf("log entry %d has been modified", entry.Sequence)
+	}
+	for field, value := range entry.Record {
+		entry.Record[field] = replayValue(value)
+	}
+	return &entry, nil
+}
+
+// replayValue converts the json.Number values decoded from a commit log record to int64, or float64 if they are not
+// integers.
+func replayValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, nested := range v {
+			v[key] = replayValue(nested)
+		}
+	case []interface{}:
+		for i, nested := range v {
+			v[i] = replayValue(nested)
+		}
+	}
+	return value
+}
+
+// replay applies commit log entries of the table: every record is set to the image it had after the entry, or
+// deleted. Hooks, rules and generated fields do not run and nothing is logged, the entries record writes already made.
+func (t *Table) replay(entries []*LogEntry) error {
+	unlock, err := t.lockWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	allRecords, err := t.recordsForWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		t.Cache.Remove(entry.Key)
+		if entry.Operation == "delete" {
+			delete(allRecords.Records, entry.Key)
+			continue
+		}
+		record, err := t.replayRecord(entry.Record)
+		if err != nil {
+			return fmt.Errorf("log entry %d: %v", entry.Sequence, err)
+		}
+		allRecords.Records[entry.Key] = record
+	}
+	return t.writeRecordsToFile(allRecords)
+}
+
+// replayRecord converts the record of a commit log entry to the types of the schema of the table, and the timestamps
+// it maintains to time.Time, and seals it. The caller must hold the table write lock.
+func (t *Table) replayRecord(record Record) (*dbdata.Record, error) {
+	record, err := t.applySchema(t.Options.Schema, record)
+	if err != nil {
+		return nil, err
+	}
+	if t.Options.Timestamps {
+		for _, field := range []string{CreatedAtField, UpdatedAtField} {
+			if value, ok := record[field]; ok {
+				if record[field], err = toFieldType(FieldTimestamp, value); err != nil {
+					return nil, fmt.Errorf("field '%s' %v", field, err)
+				}
+			}
+		}
+	}
+	protoRecord, err := RecordToProto(record)
+	if err != nil {
+		return nil, err
+	}
+	sealRecord(protoRecord)
+	return protoRecord, nil
+}
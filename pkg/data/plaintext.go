@@ -0,0 +1,294 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Malpizarr/dbproto/pkg/utils"
+)
+
+// plaintextMagic starts the files of tables written in plaintext mode. It is followed by plaintextVersion and the
+// marshaled records as they are, so a file is read the right way whatever mode its table is in now.
+const plaintextMagic = "dbpP"
+
+// plaintextVersion is the version of the plaintext file format written after plaintextMagic.
+const plaintextVersion byte = 1
+
+// databaseMetaFile is the file, in the directory of a database, holding the settings of the database.
+const databaseMetaFile = "database.json"
+
+// databaseMeta is the content of the settings file of a database.
+type databaseMeta struct {
+	Plaintext bool `json:"Plaintext,omitempty"` // Plaintext is whether the tables are written unencrypted.
+}
+
+// errNoStorageKey is returned when reading a file that is not in plaintext, or writing one, with a table opened
+// without the AES key its pipeline needs.
+var errNoStorageKey = errors.New("the table was opened without an AES key, so only files in plaintext can be read or written")
+
+// encodePlaintext returns the marshaled records behind the plaintext file header.
+func encodePlaintext(data []byte) []byte {
+	encoded := make([]byte, 0, len(plaintextMagic)+1+len(data))
+	encoded = append(encoded, plaintextMagic...)
+	encoded = append(encoded, plaintextVersion)
+	return append(encoded, data...)
+}
+
+// isPlaintext reports whether the stored data starts with the plaintext file header.
+func isPlaintext(stored []byte) bool {
+	return bytes.HasPrefix(stored, []byte(plaintextMagic))
+}
+
+// isPlaintextFile reports whether the file at path starts with the plaintext file header, or its first chunk does if
+// it was written in chunks.
+func isPlaintextFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	// Enough for the chunked file header and the length of the first chunk before the plaintext file header
+	header := make([]byte, len(chunkedMagic)+1+2*binary.MaxVarintLen64+len(plaintextMagic))
+	n, err := io.ReadFull(file, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return false
+	}
+	return storedPlaintext(header[:n])
+}
+
+// decodePlaintext returns the marshaled records of data written by encodePlaintext.
+func decodePlaintext(stored []byte) ([]byte, error) {
+	if len(stored) <= len(plaintextMagic) || stored[len(plaintextMagic)] != plaintextVersion {
+		return nil, fmt.Errorf("unsupported plaintext file version")
+	}
+	return stored[len(plaintextMagic)+1:], nil
+}
+
+// readDatabaseMeta loads the settings of the database from its directory. Databases without a settings file have the
+// default settings.
+func readDatabaseMeta(dbDir string) (databaseMeta, error) {
+	var meta databaseMeta
+	content, err := os.ReadFile(filepath.Join(dbDir, databaseMetaFile))
+	if os.IsNotExist(err) {
+		return meta, nil
+	} else if err != nil {
+		return meta, fmt.Errorf("failed to read database settings: %v", err)
+	}
+	if err := json.Unmarshal(content, &meta); err != nil {
+		return meta, fmt.Errorf("failed to parse database settings: %v", err)
+	}
+	return meta, nil
+}
+
+// writesPlaintext reports whether the tables of the database are written unencrypted, because the database or the
+// server is in plaintext mode. The caller must hold the database lock.
+func (db *Database) writesPlaintext() bool {
+	return db.plaintext || db.serverPlaintext
+}
+
+// tableKeys returns the encryption utilities the tables of the database are opened with, like keyUtils. A database in
+// plaintext mode opens its tables without any if no AES key is available, and they then only read plaintext files.
+// The caller must hold the database lock.
+func (db *Database) tableKeys() (*utils.Utils, error) {
+	keys, err := db.keyUtils()
+	if err != nil && db.writesPlaintext() {
+		return nil, nil
+	}
+	return keys, err
+}
+
+// SetPlaintext is a method of the Database struct that turns plaintext mode on or off for the database, which is
+// meant for development and debugging. In plaintext mode the tables are written as raw protobuf behind a small file
+// header instead of through their storage pipeline, and no AES key is needed to open them. The setting is saved in
+// the directory of the database, and every table file is rewritten in the new mode right away, under the write locks
+// of the database and its tables. Files in either format are always read, whatever the mode.
+//
+// Parameters:
+// - enabled: Whether the tables are written unencrypted.
+//
+// Returns:
+// - An error, if the setting cannot be saved, or a table file cannot be read or rewritten, such as when turning plaintext
+// mode off without an AES key. The mode is then unchanged, and tables rewritten before the failing one keep their new
+// format, which is read either way. If the operation is successful, the error is nil.
+func (db *Database) SetPlaintext(enabled bool) error {
+	tables, unlock, err := lockForRotation([]*Database{db})
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// The setting is only saved once every table is rewritten, tables rewritten before a failure are fixed by the next call
+	previous := db.plaintext
+	db.plaintext = enabled
+	if err := db.applyPlaintext(tables[db]); err != nil {
+		db.plaintext = previous
+		return err
+	}
+	dbDir := db.directory()
+	if err := os.MkdirAll(dbDir, 0755); err != nil {
+		return fmt.Errorf("failed to create database directory: %v", err)
+	}
+	content, err := json.MarshalIndent(databaseMeta{Plaintext: enabled}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dbDir, databaseMetaFile), content, 0644); err != nil {
+		return fmt.Errorf("failed to write database settings: %v", err)
+	}
+	return nil
+}
+
+// SetPlaintext is a method of the Server struct that turns plaintext mode on or off for every database of the server
+// and of its tenants, including databases created or loaded later, like Database.SetPlaintext does for one database. The setting is not
+// saved; databases in plaintext mode of their own stay in it when it is turned off.
+//
+// Parameters:
+// - enabled: Whether the tables of every database are written unencrypted.
+//
+// Returns:
+// - An error, if a table file of a loaded database cannot be read or rewritten. If the operation is successful, the error is nil.
+func (s *Server) SetPlaintext(enabled bool) error {
+	if err := s.setPlaintext(enabled); err != nil {
+		return err
+	}
+	var err error
+	s.forEachTenant(func(tenant *Server) {
+		if err == nil {
+			err = tenant.SetPlaintext(enabled)
+		}
+	})
+	return err
+}
+
+// setPlaintext sets the plaintext mode of the databases of the server, without its tenants, see SetPlaintext.
+func (s *Server) setPlaintext(enabled bool) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.plaintext = enabled
+	databases := make([]*Database, 0, len(s.Databases))
+	for _, db := range s.Databases {
+		databases = append(databases, db)
+	}
+	for _, db := range databases {
+		tables, unlock, err := lockForRotation([]*Database{db})
+		if err != nil {
+			return err
+		}
+		previous := db.serverPlaintext
+		db.serverPlaintext = enabled
+		err = db.applyPlaintext(tables[db])
+		if err != nil {
+			db.serverPlaintext = previous
+		}
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyPlaintext switches the tables to the mode of the database and rewrites the files that are in the other format,
+// such as files a table has not written since the mode changed. Tables leaving plaintext mode are encrypted with the
+// data key of the database, which is loaded first if plaintext mode kept it from loading. The caller must hold the
+// write locks of the database and the tables.
+func (db *Database) applyPlaintext(tables map[string]*Table) error {
+	plaintext := db.writesPlaintext()
+	var keys *utils.Utils
+	if !plaintext {
+		dbDir := db.directory()
+		if db.keys == nil {
+			if err := db.loadDataKey(dbDir); err != nil {
+				return fmt.Errorf("encrypting database %s requires the AES key: %v", db.Name, err)
+			}
+		}
+		if db.keys == nil && !encryptedFiles(tables) {
+			// A database created in plaintext mode gets the data key it would have had, as every table is switched to it
+			if err := os.MkdirAll(dbDir, 0755); err != nil {
+				return fmt.Errorf("failed to create database directory: %v", err)
+			}
+			if err := db.generateDataKey(dbDir); err != nil {
+				return fmt.Errorf("encrypting database %s requires the AES key: %v", db.Name, err)
+			}
+		}
+		var err error
+		if keys, err = db.keyUtils(); err != nil {
+			return fmt.Errorf("encrypting database %s requires the AES key: %v", db.Name, err)
+		}
+	}
+	for _, name := range sortedTableNames(tables) {
+		if err := tables[name].convertStorage(plaintext, keys); err != nil {
+			return fmt.Errorf("failed to rewrite table %s.%s: %v", db.Name, name, err)
+		}
+	}
+	return nil
+}
+
+// encryptedFiles reports whether the file of any of the tables holds encrypted data.
+func encryptedFiles(tables map[string]*Table) bool {
+	for _, table := range tables {
+		stored, err := os.ReadFile(table.FilePath)
+		if (err != nil && !os.IsNotExist(err)) || (len(stored) > 0 && !storedPlaintext(stored)) {
+			return true
+		}
+	}
+	return false
+}
+
+// convertStorage switches the table to plaintext mode or out of it, encrypting with the given utilities, and rewrites
+// its file in the new mode unless it already is, after folding its segments into it. The caller must hold the table
+// write lock.
+func (t *Table) convertStorage(plaintext bool, keys *utils.Utils) error {
+	storage := t.storage
+	if !plaintext {
+		var err error
+		if storage, err = newPipeline(t.Options.Pipeline, keys); err != nil {
+			return err
+		}
+	}
+
+	if err := t.compact(); err != nil {
+		return err
+	}
+	stored, err := os.ReadFile(t.FilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(stored) > 0 && storedPlaintext(stored) != plaintext {
+		data, err := transformStored(stored, func(data []byte) ([]byte, error) {
+			data, err := t.decodeStorage(data)
+			if err != nil {
+				return nil, err
+			}
+			if plaintext {
+				return encodePlaintext(data), nil
+			}
+			for _, stage := range storage {
+				if data, err = stage.Encode(data); err != nil {
+					return nil, fmt.Errorf("%s stage failed: %v", stage.Name(), err)
+				}
+			}
+			return data, nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := writeFileBuffered(t.FilePath, data); err != nil {
+			return err
+		}
+	}
+
+	if !plaintext {
+		t.utils = keys
+		t.storage = storage
+	}
+	t.plaintext.Store(plaintext)
+	return nil
+}
@@ -0,0 +1,209 @@
+package data
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// Plugin is a set of callbacks an integration registers on a server to follow the lifecycle of its tables, such as
+// a search indexer that indexes every mutated record or a cache that evicts the entries of changed keys, without
+// changing the data layer. Every callback is optional.
+//
+// Callbacks run synchronously on the goroutine of the operation, OnTableOpened while the database is locked and
+// OnRecordMutated while the table is write locked, so they must not use the server and must return quickly.
+// Integrations doing slow work, such as calling a remote service, should queue the events and process them on their
+// own goroutine. Temporary tables are not reported.
+type Plugin struct {
+	Name            string                    // Name identifies the plugin, which UnregisterPlugin removes by name.
+	OnTableOpened   func(event TableEvent)    // OnTableOpened is called for every table created, loaded or recovered.
+	OnRecordMutated func(event MutationEvent) // OnRecordMutated is called for every insert, update and delete once it is written.
+	OnQueryExecuted func(event QueryEvent)    // OnQueryExecuted is called for every read once it returns.
+}
+
+// TableEvent reports that a table has been opened.
+type TableEvent struct {
+	Tenant     string    // Tenant is the tenant of the database, empty for the root server.
+	Database   string    // Database is the name of the database of the table.
+	Table      string    // Table is the name of the table.
+	PrimaryKey string    // PrimaryKey is the primary key field of the table.
+	Time       time.Time // Time is when the table was opened.
+}
+
+// MutationEvent reports a written change of a record, like the events of Watch, with the table it belongs to. Like
+// those, it is also sent for the writes of transactions and the compensating changes of a rollback.
+type MutationEvent struct {
+	Tenant   string // Tenant is the tenant of the database, empty for the root server.
+	Database string // Database is the name of the database of the table.
+	Table    string // Table is the name of the table.
+	ChangeEvent
+}
+
+// QueryEvent reports a read of a table. It holds neither the keys nor the filters of the read.
+type QueryEvent struct {
+	Tenant    string        // Tenant is the tenant of the database, empty for the root server.
+	Database  string        // Database is the name of the database of the table.
+	Table     string        // Table is the name of the table.
+	Operation string        // Operation is "select", "select_all", "select_filter" or "query".
+	Plan      string        // Plan is how a query found its records, "index" or "full scan", empty for other reads.
+	Duration  time.Duration // Duration is how long the read took, including waiting for the table.
+	Time      time.Time     // Time is when the read started.
+}
+
+// readOperations are the operations reported to OnQueryExecuted.
+var readOperations = map[string]bool{"select": true, "select_all": true, "select_filter": true, "query": true}
+
+// RegisterPlugin is a method of the Server struct that registers a plugin on every table of the server and of its
+// tenants, including tables of databases created or loaded later. OnTableOpened is called right away for the tables
+// already open, so that a plugin registered after Initialize sees every table.
+//
+// Parameters:
+// - plugin: The plugin, with a name no other registered plugin has.
+//
+// Returns:
+// - An error, if the name is empty or already registered. If the operation is successful, the error is nil.
+func (s *Server) RegisterPlugin(plugin Plugin) error {
+	if err := s.registerPlugin(plugin); err != nil {
+		return err
+	}
+	s.forEachTenant(func(tenant *Server) { tenant.registerPlugin(plugin) })
+	return nil
+}
+
+// registerPlugin registers the plugin on the tables of the server, without its tenants, see RegisterPlugin.
+func (s *Server) registerPlugin(plugin Plugin) error {
+	if plugin.Name == "" {
+		return fmt.Errorf("plugin name is required")
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, registered := range s.plugins {
+		if registered.Name == plugin.Name {
+			return fmt.Errorf("plugin %s is already registered", plugin.Name)
+		}
+	}
+
+	s.plugins = append(append([]*Plugin(nil), s.plugins...), &plugin)
+	for _, db := range s.Databases {
+		db.setPlugins(s.plugins)
+		if plugin.OnTableOpened == nil {
+			continue
+		}
+		db.RLock()
+		for tableName, table := range db.Tables {
+			plugin.OnTableOpened(TableEvent{Tenant: db.tenant, Database: db.Name, Table: tableName, PrimaryKey: table.PrimaryKey, Time: time.Now().UTC()})
+		}
+		db.RUnlock()
+	}
+	return nil
+}
+
+// UnregisterPlugin removes the plugin with the given name from every table of the server. It reports whether such a
+// plugin was registered.
+func (s *Server) UnregisterPlugin(name string) bool {
+	defer s.forEachTenant(func(tenant *Server) { tenant.UnregisterPlugin(name) })
+	s.Lock()
+	defer s.Unlock()
+	plugins := make([]*Plugin, 0, len(s.plugins))
+	for _, plugin := range s.plugins {
+		if plugin.Name != name {
+			plugins = append(plugins, plugin)
+		}
+	}
+	if len(plugins) == len(s.plugins) {
+		return false
+	}
+	s.plugins = plugins
+	for _, db := range s.Databases {
+		db.setPlugins(plugins)
+	}
+	return true
+}
+
+// setPlugins sets the plugins of every table of the database, including tables created later.
+func (db *Database) setPlugins(plugins []*Plugin) {
+	db.Lock()
+	defer db.Unlock()
+	db.plugins = plugins
+	for _, table := range db.Tables {
+		table.plugins.Store(&plugins)
+	}
+}
+
+// tableOpened gives the table the plugins of the database and reports it to their OnTableOpened callbacks.
+// The caller must hold the database lock.
+func (db *Database) tableOpened(tableName string, table *Table) {
+	plugins := db.plugins
+	table.plugins.Store(&plugins)
+	for _, plugin := range plugins {
+		if plugin.OnTableOpened != nil {
+			plugin.OnTableOpened(TableEvent{Tenant: db.tenant, Database: db.Name, Table: tableName, PrimaryKey: table.PrimaryKey, Time: time.Now().UTC()})
+		}
+	}
+}
+
+// tableNames returns the names of the database and the table, which the path of its file is made of.
+func (t *Table) tableNames() (string, string) {
+	return filepath.Base(filepath.Dir(t.FilePath)), strings.TrimSuffix(filepath.Base(t.FilePath), filepath.Ext(t.FilePath))
+}
+
+// reportMutation sends a written change to the OnRecordMutated callbacks of the plugins of the table.
+// The caller must hold the table write lock.
+func (t *Table) reportMutation(operation, key string, before, after *dbdata.Record) {
+	plugins := t.plugins.Load()
+	if plugins == nil {
+		return
+	}
+	var event *MutationEvent
+	for _, plugin := range *plugins {
+		if plugin.OnRecordMutated == nil {
+			continue
+		}
+		if event == nil {
+			dbName, tableName := t.tableNames()
+			event = &MutationEvent{Tenant: t.tenant, Database: dbName, Table: tableName}
+			event.ChangeEvent = ChangeEvent{Operation: operation, Key: key, Time: time.Now().UTC(), RequestID: t.requestID}
+			var err error
+			if before != nil {
+				if event.Before, err = fromProtoRecord(before); err != nil {
+					log.Printf("Failed to convert record %s for the plugins%s: %v", key, t.requestSuffix(), err)
+					return
+				}
+			}
+			if after != nil {
+				if event.After, err = fromProtoRecord(after); err != nil {
+					log.Printf("Failed to convert record %s for the plugins%s: %v", key, t.requestSuffix(), err)
+					return
+				}
+			}
+		}
+		plugin.OnRecordMutated(*event)
+	}
+}
+
+// reportQuery sends a read of the table that started at start to the OnQueryExecuted callbacks of its plugins.
+func (t *Table) reportQuery(operation, plan string, start time.Time) {
+	plugins := t.plugins.Load()
+	if plugins == nil || !readOperations[operation] {
+		return
+	}
+	for _, plugin := range *plugins {
+		if plugin.OnQueryExecuted == nil {
+			continue
+		}
+		dbName, tableName := t.tableNames()
+		plugin.OnQueryExecuted(QueryEvent{
+			Tenant:    t.tenant,
+			Database:  dbName,
+			Table:     tableName,
+			Operation: operation,
+			Plan:      plan,
+			Duration:  time.Since(start),
+			Time:      start,
+		})
+	}
+}
@@ -1,40 +1,63 @@
 package data
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"sort"
+	"strconv"
+	"time"
 
 	"github.com/Malpizarr/dbproto/pkg/dbdata"
-	"google.golang.org/protobuf/types/known/structpb"
 )
 
 // The Query functionality allows you to perform complex queries on your database table.
 // A query can include filters, sorting, limits, and offsets, which help in retrieving specific subsets of data efficiently.
 type Query struct {
-	Filters map[string]interface{} // Filters to select specific records
-	SortBy  string                 // SortBy is a Field to sort the records by
-	Limit   int                    // Limit is the Maximum number of records to return
-	Offset  int                    // Offset is the Number of records to skip (for pagination)
+	Filters    map[string]interface{} // Filters to select specific records
+	Conditions []Condition            // Conditions are comparisons every selected record must also satisfy
+	SortBy     string                 // SortBy is a Field to sort the records by
+	Limit      int                    // Limit is the Maximum number of records to return
+	Offset     int                    // Offset is the Number of records to skip (for pagination)
+	Cursor     string                 // Cursor is the token returned with a previous page to resume iteration after it
+	Fields     []string               // Fields, if set, are the only top-level fields kept in the returned records
+}
+
+// QueryResult is a page of the records matching a query.
+type QueryResult struct {
+	Records    []Record `json:"records"`               // Records are the records of the page.
+	NextCursor string   `json:"next_cursor,omitempty"` // NextCursor resumes the iteration after the page, empty on the last page.
+	Total      int      `json:"total"`                 // Total is the number of records matching the query, on every page.
 }
 
 // ExecutionPlan represents the execution plan for a database query.
 type ExecutionPlan struct {
 	IndexToUse string                 // IndexToUse specifies the index to be used for the query.
 	Filters    map[string]interface{} // Filters contains the filters to be applied to the query.
+	Conditions []Condition            // Conditions contains the comparisons to be applied to the query.
 	SortBy     string                 // SortBy specifies the field to sort the query results by.
 	Limit      int                    // Limit specifies the maximum number of results to be returned.
 	Offset     int                    // Offset specifies the number of results to skip before returning.
+	Cursor     string                 // Cursor specifies the position after which results start.
+	Fields     []string               // Fields specifies the fields kept in the results, all of them if empty.
 }
 
-// selectBestIndex selects the best index for a given query.
-func (t *Table) selectBestIndex(query Query) string {
+// selectBestIndex selects the best index of the snapshot for a given query.
+func selectBestIndex(snap *snapshot, query Query) string {
 	bestIndex := ""
 	bestSelectivity := 1.0 // Worst possible selectivity
 
+	if len(snap.records) == 0 {
+		return bestIndex
+	}
+
 	// Iterate over each filter field to find the best index
-	for field := range query.Filters {
-		if index, exists := t.Indexes[field]; exists {
-			selectivity := float64(len(index)) / float64(len(t.Records))
+	for field, value := range query.Filters {
+		if value == nil {
+			continue // NULL values are not indexed
+		}
+		if size, exists := snap.indexSize(field); exists {
+			selectivity := float64(size) / float64(len(snap.records))
 			if selectivity < bestSelectivity {
 				bestSelectivity = selectivity
 				bestIndex = field
@@ -45,84 +68,148 @@ func (t *Table) selectBestIndex(query Query) string {
 	return bestIndex
 }
 
-// generateExecutionPlan generates an execution plan for a given query.
-func (t *Table) generateExecutionPlan(query Query) ExecutionPlan {
-	bestIndex := t.selectBestIndex(query)
+// generateExecutionPlan generates an execution plan for a given query on the snapshot.
+func generateExecutionPlan(snap *snapshot, query Query) ExecutionPlan {
+	bestIndex := selectBestIndex(snap, query)
 	return ExecutionPlan{
 		IndexToUse: bestIndex,
 		Filters:    query.Filters,
+		Conditions: query.Conditions,
 		SortBy:     query.SortBy,
 		Limit:      query.Limit,
 		Offset:     query.Offset,
+		Cursor:     query.Cursor,
+		Fields:     query.Fields,
 	}
 }
 
-// executePlan executes the execution plan and returns the resulting records.
-func (t *Table) executePlan(plan ExecutionPlan) ([]Record, error) {
+// executePlan executes the execution plan and returns the resulting records,
+// along with the cursor of the next page when the limit cut the results short
+// and the number of records matching the plan before the cursor, offset and limit are applied.
+// It returns ctx.Err() if ctx is done during the scan.
+func (t *Table) executePlan(ctx context.Context, snap *snapshot, plan ExecutionPlan) ([]Record, string, int, error) {
+	results, nextCursor, total, err := t.matchPlan(ctx, snap, plan)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	// Convert results to []Record
+	recordResults := make([]Record, len(results))
+	for i, protoRecord := range results {
+		record, err := fromProtoRecord(protoRecord)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		recordResults[i] = project(record, plan.Fields)
+	}
+
+	return recordResults, nextCursor, total, nil
+}
+
+// matchPlan executes the plan like executePlan, but returns the matching records as they are stored, with their
+// computed fields and without projection, along with the cursor of the next page and the number of records matching.
+func (t *Table) matchPlan(ctx context.Context, snap *snapshot, plan ExecutionPlan) ([]*dbdata.Record, string, int, error) {
 	var results []*dbdata.Record
 
+	var position *cursorPosition
+	if plan.Cursor != "" {
+		var err error
+		position, err = decodeCursor(plan.Cursor, plan.SortBy)
+		if err != nil {
+			return nil, "", 0, err
+		}
+	}
+
 	// If an index is used, search within the indexed records
+	scanned := 0
 	if plan.IndexToUse != "" {
-		for _, record := range t.Indexes[plan.IndexToUse] {
-			if match(record, plan.Filters) {
+		for _, record := range snap.index(plan.IndexToUse) {
+			if err := checkScan(ctx, &scanned); err != nil {
+				return nil, "", 0, err
+			}
+			record = t.withReadFields(record)
+			if match(record, plan.Filters) && matchConditions(record, plan.Conditions) {
 				results = append(results, record)
 			}
 		}
 	} else {
 		// Otherwise, search within all records
-		for _, record := range t.Records {
-			if match(record, plan.Filters) {
+		for _, record := range snap.records {
+			if err := checkScan(ctx, &scanned); err != nil {
+				return nil, "", 0, err
+			}
+			record = t.withReadFields(record)
+			if match(record, plan.Filters) && matchConditions(record, plan.Conditions) {
 				results = append(results, record)
 			}
 		}
 	}
 
-	// Sort the results if a sort field is specified
+	// Sort the results if a sort field is specified, breaking ties by primary key so pages are stable
 	if plan.SortBy != "" {
 		sort.Slice(results, func(i, j int) bool {
-			return results[i].Fields[plan.SortBy].GetNumberValue() < results[j].Fields[plan.SortBy].GetNumberValue()
+			if cmp, _ := compareProtoValues(pathValue(results[i], plan.SortBy), pathValue(results[j], plan.SortBy)); cmp != 0 {
+				return cmp < 0
+			}
+			return t.recordKey(results[i]) < t.recordKey(results[j])
 		})
 	} else {
 		sort.Slice(results, func(i, j int) bool {
-			return results[i].Fields[t.PrimaryKey].GetStringValue() < results[j].Fields[t.PrimaryKey].GetStringValue()
+			return t.recordKey(results[i]) < t.recordKey(results[j])
+		})
+	}
+
+	total := len(results)
+
+	// Skip everything up to and including the cursor position
+	if position != nil {
+		start := sort.Search(len(results), func(i int) bool {
+			return position.after(t, results[i])
 		})
+		results = results[start:]
 	}
 
 	// Apply offset to the results
 	if plan.Offset > 0 {
 		if plan.Offset >= len(results) {
-			return []Record{}, nil
+			return nil, "", total, nil
 		}
 		results = results[plan.Offset:]
 	}
 
 	// Apply limit to the results
+	nextCursor := ""
 	if plan.Limit > 0 && plan.Limit < len(results) {
 		results = results[:plan.Limit]
+		nextCursor = t.encodeCursor(results[len(results)-1], plan.SortBy)
 	}
 
-	// Convert results to []Record
-	recordResults := make([]Record, len(results))
-	for i, protoRecord := range results {
-		record, err := fromProtoRecord(protoRecord)
-		if err != nil {
-			return nil, err
+	return results, nextCursor, total, nil
+}
+
+// project returns the record with only the given fields, or the record itself if no fields are given.
+func project(record Record, fields []string) Record {
+	if len(fields) == 0 {
+		return record
+	}
+	projected := make(Record, len(fields))
+	for _, field := range fields {
+		if value, exists := record[field]; exists {
+			projected[field] = value
 		}
-		recordResults[i] = record
 	}
-
-	return recordResults, nil
+	return projected
 }
 
 // match checks if a record matches the given filters.
 func match(record *dbdata.Record, filters map[string]interface{}) bool {
 	for field, value := range filters {
-		protoValue, err := structpb.NewValue(value)
+		protoValue, err := toProtoValue(value)
 		if err != nil {
 			fmt.Printf("Error converting filter value for field %s: %v\n", field, err)
 			return false
 		}
-		recordValue, exists := record.Fields[field]
+		recordValue, exists := fieldValue(record, field)
 		if !exists {
 			fmt.Printf("Field %s does not exist in record\n", field)
 			return false
@@ -135,6 +222,7 @@ func match(record *dbdata.Record, filters map[string]interface{}) bool {
 }
 
 // Query is a method of the Table struct that performs a query on the table and returns the resulting records.
+// It reads the current snapshot of the table without locking it, so a slow query never holds up writers.
 // It first generates an execution plan for the given query.
 // The execution plan includes the best index to use for the query, the filters to apply, the field to sort by, and the limit and offset for the results.
 // It then executes the execution plan, searching for records that match the filters, sorting the results, and applying the limit and offset.
@@ -147,6 +235,170 @@ func match(record *dbdata.Record, filters map[string]interface{}) bool {
 // - A slice of Record objects, representing the records that match the query. If no records match the query, it returns an empty slice.
 // - An error, if any error occurs during the query operation. If the operation is successful, the error is nil.
 func (t *Table) Query(query Query) ([]Record, error) {
-	plan := t.generateExecutionPlan(query)
-	return t.executePlan(plan)
+	return t.QueryCtx(context.Background(), query)
+}
+
+// QueryCtx performs a query like Query. It stops with ctx.Err() if ctx is done while the records are scanned,
+// and enforces the limits set with WithLimits on the returned page.
+func (t *Table) QueryCtx(ctx context.Context, query Query) ([]Record, error) {
+	records, _, err := t.QueryWithCursorCtx(ctx, query)
+	return records, err
+}
+
+// QueryWithCursor performs a query like Query and also returns an opaque cursor for the next page.
+// The cursor is empty when there are no more records. Passing it back in Query.Cursor resumes the iteration
+// right after the last returned record, so pages stay stable even if records are inserted between calls.
+func (t *Table) QueryWithCursor(query Query) ([]Record, string, error) {
+	return t.QueryWithCursorCtx(context.Background(), query)
+}
+
+// QueryWithCursorCtx performs a query like QueryWithCursor, honoring ctx like QueryCtx.
+func (t *Table) QueryWithCursorCtx(ctx context.Context, query Query) ([]Record, string, error) {
+	records, nextCursor, _, err := t.queryWithCursor(ctx, query)
+	if err := limitResult(ctx, len(records), err); err != nil {
+		return nil, "", err
+	}
+	return records, nextCursor, nil
+}
+
+// QueryPageCtx performs a query like QueryWithCursorCtx and returns the page with the number of records matching the
+// query, so clients can show how many pages there are.
+func (t *Table) QueryPageCtx(ctx context.Context, query Query) (QueryResult, error) {
+	records, nextCursor, total, err := t.queryWithCursor(ctx, query)
+	if err := limitResult(ctx, len(records), err); err != nil {
+		return QueryResult{}, err
+	}
+	return QueryResult{Records: records, NextCursor: nextCursor, Total: total}, nil
+}
+
+// queryWithCursor performs a query, honoring ctx like QueryCtx but without enforcing limits.
+func (t *Table) queryWithCursor(ctx context.Context, query Query) ([]Record, string, int, error) {
+	start := time.Now()
+	if err := validateConditions(query.Conditions); err != nil {
+		return nil, "", 0, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, "", 0, err
+	}
+
+	ctx, span := t.traceOperation(ctx, "query")
+	defer span.End()
+	snap, err := t.readSnapshot(ctx)
+	if err != nil {
+		span.SetError(err)
+		return nil, "", 0, err
+	}
+	_, planSpan := StartSpan(ctx, "query.plan")
+	plan := generateExecutionPlan(snap, query)
+	planSpan.SetAttribute("dbproto.plan", planKind(plan))
+	planSpan.End()
+	if plan.IndexToUse == "" && len(plan.Filters) > 0 {
+		fields := make([]string, 0, len(plan.Filters))
+		for field := range plan.Filters {
+			fields = append(fields, field)
+		}
+		t.metrics.IncrementFullScans(fields)
+	}
+	t.metrics.IncrementQueryCount()
+	defer t.sample("query", planKind(plan), start)
+
+	executeCtx, executeSpan := StartSpan(ctx, "query.execute")
+	records, cursor, total, err := t.executePlan(executeCtx, snap, plan)
+	executeSpan.SetAttribute("dbproto.records", strconv.Itoa(len(records)))
+	executeSpan.SetError(err)
+	executeSpan.End()
+	span.SetAttribute("dbproto.plan", planKind(plan))
+	span.SetError(err)
+	return records, cursor, total, err
+}
+
+// IndexRecommendation suggests a field that would benefit from an index.
+type IndexRecommendation struct {
+	Database string `json:"database,omitempty"` // Database is the database of the table, set by Server.IndexRecommendations.
+	Table    string `json:"table,omitempty"`    // Table is the name of the table, set by Server.IndexRecommendations.
+	Field    string `json:"field"`              // Field is the filtered field that caused full scans.
+	Queries  int    `json:"queries"`            // Queries is the number of full-scan queries that filtered on Field.
+	Message  string `json:"message"`            // Message is a human readable description of the recommendation.
+}
+
+// IndexRecommendations returns the fields that caused full scans, ordered by how many queries an index on them would have served.
+func (t *Table) IndexRecommendations() []IndexRecommendation {
+	t.metrics.RLock()
+	defer t.metrics.RUnlock()
+
+	recommendations := make([]IndexRecommendation, 0, len(t.metrics.FullScans))
+	for field, count := range t.metrics.FullScans {
+		recommendations = append(recommendations, IndexRecommendation{
+			Field:   field,
+			Queries: count,
+			Message: fmt.Sprintf("creating an index on '%s' would have served %d queries", field, count),
+		})
+	}
+	sort.Slice(recommendations, func(i, j int) bool {
+		if recommendations[i].Queries != recommendations[j].Queries {
+			return recommendations[i].Queries > recommendations[j].Queries
+		}
+		return recommendations[i].Field < recommendations[j].Field
+	})
+	return recommendations
+}
+
+// Explanation describes how a query would be executed and what it is expected to cost.
+type Explanation struct {
+	Plan          ExecutionPlan      `json:"plan"`          // Plan is the execution plan chosen for the query.
+	FullScan      bool               `json:"fullScan"`      // FullScan is true when no index can serve the query.
+	TotalRecords  int                `json:"totalRecords"`  // TotalRecords is the number of records in the table.
+	Selectivity   float64            `json:"selectivity"`   // Selectivity is the fraction of the table read through the chosen index.
+	RecordsToScan int                `json:"recordsToScan"` // RecordsToScan is the number of records the plan examines.
+	EstimatedRows int                `json:"estimatedRows"` // EstimatedRows is the upper bound of records returned after offset and limit.
+	EstimatedCost float64            `json:"estimatedCost"` // EstimatedCost is the records examined plus the cost of sorting them.
+	Candidates    map[string]float64 `json:"candidates"`    // Candidates holds the selectivity of every filtered field that has an index.
+}
+
+// Explain returns the execution plan that Query would use for the given query, along with the selectivity
+// of the candidate indexes and an estimate of how many records the plan has to examine.
+// It does not execute the query. A table that cannot be loaded is explained as if it were empty.
+func (t *Table) Explain(query Query) Explanation {
+	snap, err := t.loadSnapshot()
+	if err != nil {
+		snap = &snapshot{}
+	}
+	plan := generateExecutionPlan(snap, query)
+	total := len(snap.records)
+
+	explanation := Explanation{
+		Plan:         plan,
+		FullScan:     plan.IndexToUse == "",
+		TotalRecords: total,
+		Selectivity:  1,
+		Candidates:   make(map[string]float64),
+	}
+	for field, value := range query.Filters {
+		if size, exists := snap.indexSize(field); exists && total > 0 && value != nil {
+			explanation.Candidates[field] = float64(size) / float64(total)
+		}
+	}
+
+	explanation.RecordsToScan = total
+	if !explanation.FullScan {
+		explanation.RecordsToScan, _ = snap.indexSize(plan.IndexToUse)
+		explanation.Selectivity = explanation.Candidates[plan.IndexToUse]
+	}
+
+	explanation.EstimatedCost = float64(explanation.RecordsToScan)
+	if explanation.RecordsToScan > 1 {
+		n := float64(explanation.RecordsToScan)
+		explanation.EstimatedCost += n * math.Log2(n)
+	}
+
+	rows := explanation.RecordsToScan - plan.Offset
+	if rows < 0 {
+		rows = 0
+	}
+	if plan.Limit > 0 && plan.Limit < rows {
+		rows = plan.Limit
+	}
+	explanation.EstimatedRows = rows
+	return explanation
 }
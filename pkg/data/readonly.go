@@ -0,0 +1,118 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrReadOnly is returned by writes to a table, database or server opened read-only, such as a replica or a copy of
+// the data directory being inspected.
+var ErrReadOnly = errors.New("opened read-only")
+
+// SetReadOnly is a method of the Table struct that makes the table read-only, or writable again. Writes to a
+// read-only table, and changes to its options, fail with ErrReadOnly before taking its lock, and its file and
+// segments are only ever opened for reading, so Flush does nothing. Changes write-behind left pending are flushed
+// before the table turns read-only.
+//
+// Parameters:
+// - enabled: Whether the table is read-only.
+//
+// Returns:
+// - An error, if the pending changes cannot be flushed, in which case the table stays writable. If the operation is
+// successful, the error is nil.
+func (t *Table) SetReadOnly(enabled bool) error {
+	t.Lock()
+	defer t.Unlock()
+	if enabled && !t.readOnly.Load() {
+		if err := t.flushPending(); err != nil {
+			return err
+		}
+	}
+	t.readOnly.Store(enabled)
+	return nil
+}
+
+// ReadOnly reports whether the table is read-only, see SetReadOnly.
+func (t *Table) ReadOnly() bool {
+	return t.readOnly.Load()
+}
+
+// SetReadOnly makes every table of the database, including tables loaded later, read-only or writable again, see
+// Table.SetReadOnly. Creating, dropping and renaming tables and changing the encryption of a read-only database fail
+// with ErrReadOnly. Every table is switched even if some fail.
+//
+// Returns:
+// - An error joining the errors of the tables whose pending changes could not be flushed, or nil.
+func (db *Database) SetReadOnly(enabled bool) error {
+	db.Lock()
+	defer db.Unlock()
+
+	db.readOnly.Store(enabled)
+	var errs []error
+	for name, table := range db.Tables {
+		if err := table.SetReadOnly(enabled); err != nil {
+			errs = append(errs, fmt.Errorf("failed to flush table %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ReadOnly reports whether the database is read-only, see SetReadOnly.
+func (db *Database) ReadOnly() bool {
+	return db.readOnly.Load()
+}
+
+// writable returns ErrClosed if the database has been closed, and ErrReadOnly if it is read-only.
+func (db *Database) writable() error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	if db.readOnly.Load() {
+		return fmt.Errorf("%w: database %s", ErrReadOnly, db.qualifiedName())
+	}
+	return nil
+}
+
+// SetReadOnly makes every database of the server and of its tenants, including databases loaded later, read-only or
+// writable again, see Database.SetReadOnly. A read-only server never creates, moves or removes a file of its data
+// directory: Initialize expects the directory to exist and skips the tables that fail to load instead of
+// quarantining them, and creating, deleting and renaming databases and tenants, restoring backups, rotating keys,
+// switching the plaintext mode and applying migrations fail with ErrReadOnly. Backups are still written, to the
+// backup directory. Call it before Initialize to open a data directory that must not change.
+//
+// Returns:
+// - An error joining the errors of the tables whose pending changes could not be flushed, or nil.
+func (s *Server) SetReadOnly(enabled bool) error {
+	var errs []error
+	s.forEachTenant(func(tenant *Server) {
+		if err := tenant.SetReadOnly(enabled); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %s: %w", tenant.tenant, err))
+		}
+	})
+	s.Lock()
+	defer s.Unlock()
+
+	s.readOnly.Store(enabled)
+	for dbName, db := range s.Databases {
+		if err := db.SetReadOnly(enabled); err != nil {
+			errs = append(errs, fmt.Errorf("database %s: %w", dbName, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ReadOnly reports whether the server is read-only, see SetReadOnly.
+func (s *Server) ReadOnly() bool {
+	return s.readOnly.Load()
+}
+
+// writable returns ErrClosed if the server has been closed, and ErrReadOnly if it is read-only.
+func (s *Server) writable() error {
+	if s.closed.Load() {
+		return ErrClosed
+	}
+	if s.readOnly.Load() {
+		return ErrReadOnly
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package data
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// DefaultCacheSize is the number of records the lookup cache of a table holds when neither the table, with its
+// CacheSize option, nor the cache policy sets another size.
+const DefaultCacheSize = 1000
+
+// RecordCache is the lookup cache of a table: it holds up to a limit of records by their encoded primary key, and
+// makes room for a new record by evicting the least recently used one. Tables fill it with the records Select reads
+// and remove the records every write changes, so it never holds a record that differs from the stored one. It is safe
+// for concurrent use.
+type RecordCache struct {
+	lock    sync.Mutex
+	limit   int
+	entries map[string]*list.Element // entries holds the element of order of every cached key.
+	order   *list.List               // order holds a *cacheEntry per cached record, the most recently used first.
+}
+
+// cacheEntry is a record of a RecordCache.
+type cacheEntry struct {
+	key    string
+	record *dbdata.Record
+}
+
+// NewRecordCache returns an empty cache holding up to limit records, none if limit is 0 or less.
+func NewRecordCache(limit int) *RecordCache {
+	return &RecordCache{limit: limit, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// Get returns the cached record of the key and marks it as the most recently used, or reports false if the key is
+// not cached.
+func (c *RecordCache) Get(key string) (*dbdata.Record, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, exists := c.entries[key]
+	if !exists {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheEntry).record, true
+}
+
+// Put caches the record of the key as the most recently used, replacing the record cached for it, and returns the
+// number of records evicted to make room for it.
+func (c *RecordCache) Put(key string, record *dbdata.Record) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.limit <= 0 {
+		return 0
+	}
+	if element, exists := c.entries[key]; exists {
+		element.Value.(*cacheEntry).record = record
+		c.order.MoveToFront(element)
+		return 0
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, record: record})
+	return c.trim()
+}
+
+// Remove drops the record of the key from the cache, if it is cached.
+func (c *RecordCache) Remove(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, exists := c.entries[key]; exists {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+// Clear drops every record from the cache.
+func (c *RecordCache) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// Len returns the number of cached records.
+func (c *RecordCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
+
+// Limit returns the number of records the cache holds at most.
+func (c *RecordCache) Limit() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.limit
+}
+
+// SetLimit changes the number of records the cache holds at most, evicting the least recently used records over it,
+// and returns the number of records evicted.
+func (c *RecordCache) SetLimit(limit int) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.limit = limit
+	return c.trim()
+}
+
+// Range calls fn with every cached record, the most recently used first, until fn returns false. The cache must not
+// be used by fn.
+func (c *RecordCache) Range(fn func(key string, record *dbdata.Record) bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*cacheEntry)
+		if !fn(entry.key, entry.record) {
+			return
+		}
+	}
+}
+
+// trim evicts the least recently used records until the cache is within its limit, and returns how many it evicted.
+// The caller must hold the lock.
+func (c *RecordCache) trim() int {
+	evicted := 0
+	for len(c.entries) > 0 && len(c.entries) > c.limit {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		evicted++
+	}
+	return evicted
+}
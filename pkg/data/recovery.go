@@ -0,0 +1,287 @@
+package data
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrTableNotQuarantined is returned by the recovery methods for a table that is not in the quarantine directory.
+var ErrTableNotQuarantined = errors.New("table is not quarantined")
+
+// QuarantinedTable describes a table that failed to load. Its files are kept in the quarantine directory, out of
+// the databases and their backups, until it is recovered or discarded.
+type QuarantinedTable struct {
+	Database      string    `json:"database"`      // Database is the database the table belongs to.
+	Table         string    `json:"table"`         // Table is the name of the table.
+	Error         string    `json:"error"`         // Error is why the table failed to load.
+	Path          string    `json:"path"`          // Path is the quarantined data file.
+	QuarantinedAt time.Time `json:"quarantinedAt"` // QuarantinedAt is when the table was quarantined.
+}
+
+// RecoveryReport lists the quarantined tables. The server runs in safe mode while any table is quarantined: the other
+// tables are served as usual, while the quarantined ones are missing until they are recovered.
+type RecoveryReport struct {
+	SafeMode    bool               `json:"safeMode"`    // SafeMode reports whether any table is quarantined.
+	Quarantined []QuarantinedTable `json:"quarantined"` // Quarantined lists the quarantined tables by database and name.
+}
+
+// quarantineDir returns the directory holding the quarantined tables of the server, next to its databases directory.
+func (s *Server) quarantineDir() string {
+	return filepath.Join(s.dataDir(), "quarantine")
+}
+
+// quarantineTable moves the data and metadata files and the segments of a table that failed to load from dbDir to the
+// quarantine directory next to the databases directory holding dbDir, along with a description of the failure.
+func quarantineTable(dbName, tableName, dbDir string, loadErr error) (QuarantinedTable, error) {
+	dir := filepath.Join(filepath.Dir(filepath.Dir(dbDir)), "quarantine", dbName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return QuarantinedTable{}, fmt.Errorf("failed to create quarantine directory: %v", err)
+	}
+	for _, ext := range []string{".dat", ".meta", segmentsSuffix} {
+		err := os.Rename(filepath.Join(dbDir, tableName+ext), filepath.Join(dir, tableName+ext))
+		if err != nil && !os.IsNotExist(err) {
+			return QuarantinedTable{}, fmt.Errorf("failed to move %s%s to quarantine: %v", tableName, ext, err)
+		}
+	}
+	quarantined := QuarantinedTable{
+		Database:      dbName,
+		Table:         tableName,
+		Error:         loadErr.Error(),
+		Path:          filepath.Join(dir, tableName+".dat"),
+		QuarantinedAt: time.Now().UTC(),
+	}
+	report, err := json.MarshalIndent(quarantined, "", "  ")
+	if err != nil {
+		return QuarantinedTable{}, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, tableName+".json"), report, 0644); err != nil {
+		return QuarantinedTable{}, fmt.Errorf("failed to write quarantine report: %v", err)
+	}
+	return quarantined, nil
+}
+
+// RecoveryReport is a method of the Server struct that lists the tables quarantined because they failed to load,
+// at this or an earlier startup, and have not been recovered or discarded since.
+//
+// Returns:
+// - A pointer to a RecoveryReport, in safe mode if any table is quarantined.
+// - An error, if the quarantine directory cannot be read. If the operation is successful, the error is nil.
+func (s *Server) RecoveryReport() (*RecoveryReport, error) {
+	report := &RecoveryReport{Quarantined: []QuarantinedTable{}}
+	reports, err := filepath.Glob(filepath.Join(s.quarantineDir(), "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range reports {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read quarantine report: %v", err)
+		}
+		var quarantined QuarantinedTable
+		if err := json.Unmarshal(content, &quarantined); err != nil {
+			return nil, fmt.Errorf("failed to parse quarantine report %s: %v", path, err)
+		}
+		report.Quarantined = append(report.Quarantined, quarantined)
+	}
+	sort.Slice(report.Quarantined, func(i, j int) bool {
+		a, b := report.Quarantined[i], report.Quarantined[j]
+		if a.Database != b.Database {
+			return a.Database < b.Database
+		}
+		return a.Table < b.Table
+	})
+	report.SafeMode = len(report.Quarantined) > 0
+	return report, nil
+}
+
+// RetryQuarantinedTable moves a quarantined table back into its database and loads it again, for failures that have
+// been fixed meanwhile, such as a missing encryption key. If it still fails to load, it is quarantined again with
+// the new error.
+//
+// Parameters:
+// - dbName: The database of the quarantined table.
+// - tableName: The name of the quarantined table.
+//
+// Returns:
+// - An error, if the table is not quarantined, a table with its name has been created since, or it fails to load
+// again. If the operation is successful, the error is nil and the table is served again.
+func (s *Server) RetryQuarantinedTable(dbName, tableName string) error {
+	return s.recoverTable(dbName, tableName, func(dbDir string) error {
+		dir := filepath.Join(s.quarantineDir(), dbName)
+		for _, ext := range []string{".dat", ".meta", segmentsSuffix} {
+			err := os.Rename(filepath.Join(dir, tableName+ext), filepath.Join(dbDir, tableName+ext))
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to move %s%s out of quarantine: %v", tableName, ext, err)
+			}
+		}
+		return nil
+	})
+}
+
+// RestoreQuarantinedTable replaces a quarantined table with its copy in a backup, leaving every other table as it is.
+// The quarantined files are deleted once the restored table loads; if it does not, they are kept and the restored
+// files removed.
+//
+// Parameters:
+// - dbName: The database of the quarantined table.
+// - tableName: The name of the quarantined table.
+// - backupPath: The path of the backup file, or file name or name of a backup, or "" for the newest backup.
+//
+// Returns:
+// - An error, if the table is not quarantined, a table with its name has been created since, the backup does not
+// hold the table or the restored table fails to load. If the operation is successful, the error is nil.
+func (s *Server) RestoreQuarantinedTable(dbName, tableName, backupPath string) error {
+	return s.recoverTable(dbName, tableName, func(dbDir string) error {
+		return extractTable(s.resolveBackupPath(backupPath), dbName, tableName, dbDir)
+	})
+}
+
+// DiscardQuarantinedTable deletes the files of a quarantined table for good, for tables that cannot be recovered or
+// are no longer needed. A table with the same name can be created afterwards.
+func (s *Server) DiscardQuarantinedTable(dbName, tableName string) error {
+	if err := s.writable(); err != nil {
+		return err
+	}
+	dir := filepath.Join(s.quarantineDir(), dbName)
+	if !s.isQuarantined(dbName, tableName) {
+		return ErrTableNotQuarantined
+	}
+	for _, ext := range []string{".dat", ".meta", segmentsSuffix, ".json"} {
+		if err := os.RemoveAll(filepath.Join(dir, tableName+ext)); err != nil {
+			return fmt.Errorf("failed to delete quarantined table %s: %v", tableName, err)
+		}
+	}
+	return nil
+}
+
+// isQuarantined reports whether the quarantine directory of the server holds the report of the table.
+func (s *Server) isQuarantined(dbName, tableName string) bool {
+	if !ValidFilename(dbName) || !ValidFilename(tableName) {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(s.quarantineDir(), dbName, tableName+".json"))
+	return err == nil
+}
+
+// recoverTable puts the files of a quarantined table back into its database with place and loads it. If the table
+// loads, its quarantined files are deleted and it is added to the database. Otherwise the files placed are handed to
+// quarantineTable again, with the new error.
+func (s *Server) recoverTable(dbName, tableName string, place func(dbDir string) error) error {
+	if err := s.writable(); err != nil {
+		return err
+	}
+	if !s.isQuarantined(dbName, tableName) {
+		return ErrTableNotQuarantined
+	}
+	db, err := s.Database(dbName)
+	if err != nil {
+		return err
+	}
+	db.Lock()
+	defer db.Unlock()
+	if _, exists := db.Tables[tableName]; exists {
+		return fmt.Errorf("table %s already exists in database %s", tableName, dbName)
+	}
+
+	dbDir := filepath.Join(s.databasesDir(), dbName)
+	if err := place(dbDir); err != nil {
+		return err
+	}
+	table, err := db.openTable(dbDir, tableName)
+	if err != nil {
+		// Keep what the quarantine held, so a failed restore does not lose the original files
+		dir := filepath.Join(s.quarantineDir(), dbName)
+		for _, ext := range []string{".dat", ".meta", segmentsSuffix} {
+			if _, statErr := os.Stat(filepath.Join(dir, tableName+ext)); statErr == nil {
+				os.RemoveAll(filepath.Join(dbDir, tableName+ext))
+			}
+		}
+		if _, quarantineErr := quarantineTable(dbName, tableName, dbDir, err); quarantineErr != nil {
+			return fmt.Errorf("%v, and quarantining it again failed: %v", err, quarantineErr)
+		}
+		return err
+	}
+	db.Tables[tableName] = table
+	db.tableOpened(tableName, table)
+
+	dir := filepath.Join(s.quarantineDir(), dbName)
+	for _, ext := range []string{".dat", ".meta", segmentsSuffix, ".json"} {
+		os.RemoveAll(filepath.Join(dir, tableName+ext))
+	}
+	return nil
+}
+
+// extractTable writes the data and metadata files and the segments of a table from the backup at path into dbDir.
+func extractTable(path, dbName, tableName, dbDir string) error {
+	zipReader, err := zip.OpenReader(path)
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %v", err)
+	}
+	defer zipReader.Close()
+
+	segments := filepath.Join(dbDir, tableName+segmentsSuffix)
+	if err := os.RemoveAll(segments); err != nil {
+		return fmt.Errorf("failed to remove old segments of table %s: %v", tableName, err)
+	}
+	segmentsPrefix := archivePath(filepath.Join(dbName, tableName+segmentsSuffix)) + "/"
+
+	wanted := map[string]string{
+		archivePath(filepath.Join(dbName, tableName+".dat")):  filepath.Join(dbDir, tableName+".dat"),
+		archivePath(filepath.Join(dbName, tableName+".meta")): filepath.Join(dbDir, tableName+".meta"),
+	}
+	found := 0
+	for _, file := range zipReader.File {
+		name := strings.ReplaceAll(file.Name, `\`, "/")
+		if segment, ok := strings.CutPrefix(name, segmentsPrefix); ok && ValidFilename(strings.TrimSuffix(segment, filepath.Ext(segment))) && !file.FileInfo().IsDir() {
+			if err := extractFile(file, filepath.Join(segments, segment)); err != nil {
+				return err
+			}
+			continue
+		}
+		target, ok := wanted[name]
+		if !ok {
+			continue
+		}
+		if err := extractFile(file, target); err != nil {
+			return err
+		}
+		found++
+	}
+	if found < len(wanted) {
+		for _, target := range wanted {
+			os.Remove(target)
+		}
+		os.RemoveAll(segments)
+		return fmt.Errorf("backup %s does not hold table %s of database %s", path, tableName, dbName)
+	}
+	return nil
+}
+
+// extractFile writes a file of a backup archive to target.
+func extractFile(file *zip.File, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	rc, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open zip file for reading: %v", err)
+	}
+	defer rc.Close()
+	outFile, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, file.Mode())
+	if err != nil {
+		return fmt.Errorf("failed to open file for writing: %v", err)
+	}
+	if _, err := io.Copy(outFile, rc); err != nil {
+		outFile.Close()
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+	return outFile.Close()
+}
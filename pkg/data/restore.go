@@ -0,0 +1,290 @@
+package data
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrRestoreNotConfirmed is returned by Restore when restoring would overwrite live data that differs
+// from the backup and the caller did not confirm it.
+var ErrRestoreNotConfirmed = errors.New("restore would overwrite existing data, confirmation required")
+
+// ArchiveFile describes a file stored in a backup archive.
+type ArchiveFile struct {
+	Path     string `json:"path"`     // Path is the location of the file relative to the server directory, with forward slashes.
+	Database string `json:"database"` // Database is the database the file belongs to.
+	Table    string `json:"table"`    // Table is the table the file belongs to.
+	Size     int64  `json:"size"`     // Size is the uncompressed size of the file.
+}
+
+// FileChange describes a file that exists both in the backup and in the live data directory with different content.
+type FileChange struct {
+	Path        string `json:"path"`        // Path is the location of the file relative to the server directory, with forward slashes.
+	LiveSize    int64  `json:"liveSize"`    // LiveSize is the size of the live file.
+	ArchiveSize int64  `json:"archiveSize"` // ArchiveSize is the size of the file in the backup.
+}
+
+// RestorePreview lists the contents of a backup and compares them with the live data directory.
+// Databases and tables are reported as "db" and "db/table". Restoring never deletes live data,
+// so removed databases and tables are kept as they are.
+type RestorePreview struct {
+	Archive          string        `json:"archive"`          // Archive is the path of the backup file.
+	Files            []ArchiveFile `json:"files"`            // Files lists every file in the backup.
+	AddedDatabases   []string      `json:"addedDatabases"`   // AddedDatabases exist in the backup only.
+	RemovedDatabases []string      `json:"removedDatabases"` // RemovedDatabases exist in the live data directory only.
+	AddedTables      []string      `json:"addedTables"`      // AddedTables exist in the backup only.
+	RemovedTables    []string      `json:"removedTables"`    // RemovedTables exist in the live data directory only.
+	ChangedFiles     []FileChange  `json:"changedFiles"`     // ChangedFiles would be overwritten with different content.
+	Verified         bool          `json:"verified"`         // Verified reports whether a dry run or restore checked the files against the manifest of the backup, which backups written before manifests existed lack.
+}
+
+// Destructive reports whether restoring the backup would overwrite live data.
+func (p *RestorePreview) Destructive() bool {
+	return len(p.ChangedFiles) > 0
+}
+
+// RestoreOptions controls Restore.
+type RestoreOptions struct {
+	Path             string // Path is the backup file, or the file name or name of a backup, see ListBackups; the newest backup if empty.
+	ConfirmOverwrite bool   // ConfirmOverwrite allows the restore to overwrite live files that differ from the backup.
+	DryRun           bool   // DryRun checks the backup like a restore and returns the preview without changing anything.
+}
+
+// PreviewRestore lists the contents of a backup and compares them with the live data directory without changing anything.
+//
+// Parameters:
+// - backupPath: Optional path of the backup file, or file name or name of a backup. If it is omitted, the newest backup is used.
+//
+// Returns:
+// - A RestorePreview describing the databases, tables and files the restore would add or overwrite.
+// - An error, if the backup cannot be read or the data directory cannot be inspected. If the operation is successful, the error is nil.
+func (s *Server) PreviewRestore(backupPath ...string) (*RestorePreview, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	path := ""
+	if len(backupPath) > 0 {
+		path = backupPath[0]
+	}
+	return s.previewRestore(s.resolveBackupPath(path))
+}
+
+// Restore restores the databases from a backup like RestoreDatabases, but first compares the backup with the
+// live data directory. If the restore would overwrite files whose content differs and options.ConfirmOverwrite
+// is false, nothing is changed and ErrRestoreNotConfirmed is returned along with the preview. Before anything is
+// written, every file of the backup is read and checked against its manifest, and every path against the data
+// directory, so a damaged or crafted archive fails with ErrBackupCorrupt, or an invalid path error, without changing
+// anything. With options.DryRun, the backup is checked the same way and the preview returned, without restoring it.
+//
+// Parameters:
+// - options: The backup to restore, whether destructive overwrites are confirmed and whether it is a dry run.
+//
+// Returns:
+// - The RestorePreview computed before restoring, so callers can report what changed.
+// - An error, if the restore was not confirmed, the backup is corrupt or the restore failed. If the operation is successful, the error is nil.
+func (s *Server) Restore(options RestoreOptions) (*RestorePreview, error) {
+	return s.restore(options, nil)
+}
+
+// restore does the work of Restore, reporting the files extracted from the backup to progress.
+func (s *Server) restore(options RestoreOptions, progress ProgressFunc) (*RestorePreview, error) {
+	if options.DryRun {
+		return s.dryRunRestore(options.Path)
+	}
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	path := s.resolveBackupPath(options.Path)
+	preview, err := s.previewRestore(path)
+	if err != nil {
+		return nil, err
+	}
+	if preview.Destructive() && !options.ConfirmOverwrite {
+		return preview, ErrRestoreNotConfirmed
+	}
+	preview.Verified, err = s.restoreDatabases(path, progress)
+	return preview, err
+}
+
+// dryRunRestore compares the backup at path with the live server directory and checks it like restoreDatabases,
+// without changing anything.
+func (s *Server) dryRunRestore(path string) (*RestorePreview, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	path = s.resolveBackupPath(path)
+	preview, err := s.previewRestore(path)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup file: %v", err)
+	}
+	defer archive.Close()
+	if preview.Verified, err = checkArchive(&archive.Reader, s.databasesDir()); err != nil {
+		return preview, err
+	}
+	return preview, nil
+}
+
+// resolveBackupPath returns the path of the backup path refers to: the newest backup of the server if path is empty,
+// the backup whose file name or name path is if it is not a path to an existing file, see DeleteBackup, or path
+// itself otherwise.
+func (s *Server) resolveBackupPath(path string) string {
+	if path == "" {
+		backups, err := s.ListBackups()
+		if err != nil || len(backups) == 0 {
+			return filepath.Join(s.backupsDir(), legacyBackupFile)
+		}
+		return backups[0].Path
+	}
+	if _, err := os.Stat(path); err == nil || strings.ContainsAny(path, `/\`) {
+		return path
+	}
+	if backup, ok := s.findBackup(path); ok {
+		return backup.Path
+	}
+	return path
+}
+
+// previewRestore compares the backup at path with the live server directory.
+func (s *Server) previewRestore(path string) (*RestorePreview, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup file: %v", err)
+	}
+	defer archive.Close()
+
+	serverDir := s.databasesDir()
+	preview := &RestorePreview{Archive: path}
+	archiveDatabases := make(map[string]bool)
+	archiveTables := make(map[string]bool)
+
+	for _, file := range archive.File {
+		livePath, err := restorePath(serverDir, file.Name)
+		if err != nil {
+			return nil, err
+		}
+		if file.FileInfo().IsDir() || isManifest(file.Name) {
+			continue
+		}
+		name := filepath.ToSlash(strings.ReplaceAll(file.Name, `\`, "/"))
+		database, table := splitTablePath(name)
+		preview.Files = append(preview.Files, ArchiveFile{Path: name, Database: database, Table: table, Size: int64(file.UncompressedSize64)})
+		if database != "" {
+			archiveDatabases[database] = true
+		}
+		if table != "" {
+			archiveTables[database+"/"+table] = true
+		}
+
+		info, err := os.Stat(livePath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect %s: %v", livePath, err)
+		}
+		same, err := sameContent(livePath, info.Size(), file)
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			preview.ChangedFiles = append(preview.ChangedFiles, FileChange{Path: name, LiveSize: info.Size(), ArchiveSize: int64(file.UncompressedSize64)})
+		}
+	}
+
+	liveDatabases, liveTables, err := liveContents(serverDir)
+	if err != nil {
+		return nil, err
+	}
+	preview.AddedDatabases = difference(archiveDatabases, liveDatabases)
+	preview.RemovedDatabases = difference(liveDatabases, archiveDatabases)
+	preview.AddedTables = difference(archiveTables, liveTables)
+	preview.RemovedTables = difference(liveTables, archiveTables)
+	return preview, nil
+}
+
+// splitTablePath returns the database and table of an archive path like "db/table.dat".
+// The table is empty for files that are not table data or metadata.
+func splitTablePath(name string) (database, table string) {
+	dir, file, found := strings.Cut(name, "/")
+	if !found {
+		return "", ""
+	}
+	if ext := filepath.Ext(file); !strings.Contains(file, "/") && (ext == ".dat" || ext == ".meta") {
+		table = strings.TrimSuffix(file, ext)
+	}
+	return dir, table
+}
+
+// sameContent reports whether the live file has the same size and CRC-32 as the archived file.
+func sameContent(livePath string, liveSize int64, file *zip.File) (bool, error) {
+	if uint64(liveSize) != file.UncompressedSize64 {
+		return false, nil
+	}
+	liveFile, err := os.Open(livePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to open %s: %v", livePath, err)
+	}
+	defer liveFile.Close()
+
+	hash := crc32.NewIEEE()
+	if _, err := io.Copy(hash, liveFile); err != nil {
+		return false, fmt.Errorf("failed to read %s: %v", livePath, err)
+	}
+	return hash.Sum32() == file.CRC32, nil
+}
+
+// liveContents returns the databases and "db/table" names found in the server directory.
+func liveContents(serverDir string) (map[string]bool, map[string]bool, error) {
+	databases := make(map[string]bool)
+	tables := make(map[string]bool)
+
+	entries, err := os.ReadDir(serverDir)
+	if os.IsNotExist(err) {
+		return databases, tables, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read server directory: %v", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		databases[entry.Name()] = true
+		files, err := os.ReadDir(filepath.Join(serverDir, entry.Name()))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read database directory: %v", err)
+		}
+		for _, file := range files {
+			if _, table := splitTablePath(entry.Name() + "/" + file.Name()); table != "" && !file.IsDir() {
+				tables[entry.Name()+"/"+table] = true
+			}
+		}
+	}
+	return databases, tables, nil
+}
+
+// difference returns the sorted keys of a that are not in b.
+func difference(a, b map[string]bool) []string {
+	keys := []string{}
+	for key := range a {
+		if !b[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
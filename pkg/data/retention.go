@@ -0,0 +1,382 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+	"google.golang.org/protobuf/proto"
+)
+
+// The actions a retention policy takes on expired records.
+const (
+	RetentionDelete  = "delete"  // RetentionDelete deletes expired records.
+	RetentionArchive = "archive" // RetentionArchive moves expired records to the archive table.
+)
+
+// ErrNoRetentionPolicy is returned when retention is applied to, enabled or disabled on a table without a policy.
+var ErrNoRetentionPolicy = errors.New("table has no retention policy")
+
+// RetentionPolicy declares how long the records of a table are kept, based on a timestamp field. Records whose field
+// holds a timestamp, or an RFC 3339 string, older than MaxAgeDays are expired; records without the field, or with
+// a value of another kind, are kept.
+type RetentionPolicy struct {
+	Field        string `json:"Field"`                  // Field is the timestamp field, or nested path, the age of a record is read from.
+	MaxAgeDays   int    `json:"MaxAgeDays"`             // MaxAgeDays is how many days records are kept.
+	Action       string `json:"Action,omitempty"`       // Action is RetentionDelete, the default, or RetentionArchive.
+	ArchiveTable string `json:"ArchiveTable,omitempty"` // ArchiveTable receives archived records, the table name with an "_archive" suffix if empty.
+	Disabled     bool   `json:"Disabled,omitempty"`     // Disabled keeps the policy without applying it in the background.
+}
+
+// RetentionReport describes an application of a retention policy.
+type RetentionReport struct {
+	Database string        `json:"database"`          // Database is the database of the table.
+	Table    string        `json:"table"`             // Table is the name of the table.
+	Action   string        `json:"action"`            // Action is what was done with the expired records.
+	Archive  string        `json:"archive,omitempty"` // Archive is the table the records were moved to, for RetentionArchive.
+	DryRun   bool          `json:"dryRun"`            // DryRun reports that nothing was changed.
+	Cutoff   time.Time     `json:"cutoff"`            // Cutoff is the time records older than are expired.
+	Keys     []string      `json:"keys"`              // Keys are the primary keys of the expired records, sorted.
+	Purged   int           `json:"purged"`            // Purged is the number of records deleted or archived, 0 for a dry run.
+	Duration time.Duration `json:"duration"`          // Duration is how long the application took.
+}
+
+// validateRetention checks that a retention policy can be applied.
+func validateRetention(policy *RetentionPolicy) error {
+	if policy == nil {
+		return nil
+	}
+	if policy.Field == "" {
+		return fmt.Errorf("retention policy requires a timestamp field")
+	}
+	if policy.MaxAgeDays <= 0 {
+		return fmt.Errorf("invalid retention period of %d days, expected a positive number", policy.MaxAgeDays)
+	}
+	if policy.Action != "" && policy.Action != RetentionDelete && policy.Action != RetentionArchive {
+		return fmt.Errorf("unknown retention action %q, expected %s or %s", policy.Action, RetentionDelete, RetentionArchive)
+	}
+	if policy.ArchiveTable != "" && !ValidFilename(policy.ArchiveTable) {
+		return fmt.Errorf("invalid archive table name: %s", policy.ArchiveTable)
+	}
+	return nil
+}
+
+// SetRetention is a method of the Table struct that declares the retention policy of the table, which is stored in
+// its metadata and applied by Server.RunRetention and Database.ApplyRetention. Passing nil removes the policy.
+//
+// Parameters:
+// - policy: The retention policy, or nil to keep every record.
+//
+// Returns:
+// - An error, if the policy is invalid or the metadata cannot be written. If the operation is successful, the error is nil.
+func (t *Table) SetRetention(policy *RetentionPolicy) error {
+	if err := validateRetention(policy); err != nil {
+		return err
+	}
+	unlock, err := t.lockWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return t.saveOptions(func(options *TableOptions) {
+		options.Retention = policy
+	})
+}
+
+// EnableRetention enables or disables the retention policy of the table in the background, keeping the policy
+// itself. Disabled policies can still be applied, or previewed, with Database.ApplyRetention.
+func (t *Table) EnableRetention(enabled bool) error {
+	unlock, err := t.lockWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if t.Options.Retention == nil {
+		return ErrNoRetentionPolicy
+	}
+	policy := *t.Options.Retention
+	policy.Disabled = !enabled
+	return t.saveOptions(func(options *TableOptions) {
+		options.Retention = &policy
+	})
+}
+
+// retentionPolicy returns a copy of the retention policy of the table, nil if it has none.
+func (t *Table) retentionPolicy() *RetentionPolicy {
+	t.RLock()
+	defer t.RUnlock()
+	if t.Options.Retention == nil {
+		return nil
+	}
+	policy := *t.Options.Retention
+	return &policy
+}
+
+// expired reports whether the record is older than the cutoff according to the policy.
+func (p *RetentionPolicy) expired(record *dbdata.Record, cutoff *dbdata.Value) bool {
+	value := pathValue(record, p.Field)
+	if value == nil {
+		return false
+	}
+	cmp, comparable := compareProtoValues(value, cutoff)
+	return comparable && cmp < 0
+}
+
+// ApplyRetention is a method of the Database struct that applies the retention policy of a table once, deleting or
+// archiving its expired records, whether the policy is enabled or not. Archived records are moved to the archive
+// table, created with the primary key of the table if it does not exist, in a single write of both tables under
+// their write locks, replacing earlier archived copies with the same key.
+//
+// Parameters:
+// - tableName: The name of the table.
+// - dryRun: Whether to only report the expired records, without changing anything.
+//
+// Returns:
+// - A pointer to a RetentionReport listing the expired records.
+// - An error, if the table does not exist, has no retention policy or cannot be written, or a BeforeDelete hook
+// rejects a record. The table is left unchanged on error. If the operation is successful, the error is nil.
+func (db *Database) ApplyRetention(tableName string, dryRun bool) (*RetentionReport, error) {
+	return db.applyRetention(context.Background(), tableName, dryRun, time.Now())
+}
+
+// applyRetention applies the retention policy of the table with now as the current time.
+func (db *Database) applyRetention(ctx context.Context, tableName string, dryRun bool, now time.Time) (*RetentionReport, error) {
+	table, err := db.lookupTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+	policy := table.retentionPolicy()
+	if policy == nil {
+		return nil, ErrNoRetentionPolicy
+	}
+
+	report := &RetentionReport{
+		Database: db.Name,
+		Table:    tableName,
+		Action:   RetentionDelete,
+		DryRun:   dryRun,
+		Cutoff:   now.Add(-time.Duration(policy.MaxAgeDays) * 24 * time.Hour).UTC(),
+		Keys:     []string{},
+	}
+	if policy.Action == RetentionArchive {
+		report.Action = RetentionArchive
+		report.Archive = policy.ArchiveTable
+		if report.Archive == "" {
+			report.Archive = tableName + "_archive"
+		}
+	}
+	cutoff := dbdata.NewTimestampValue(report.Cutoff)
+	defer func(start time.Time) {
+		report.Duration = time.Since(start)
+	}(time.Now())
+
+	if dryRun {
+		snap, err := table.loadSnapshot()
+		if err != nil {
+			return nil, err
+		}
+		for key, record := range snap.records {
+			if policy.expired(record, cutoff) {
+				report.Keys = append(report.Keys, key)
+			}
+		}
+		sort.Strings(report.Keys)
+		return report, nil
+	}
+
+	if report.Action == RetentionArchive {
+		archive, err := db.archiveTable(table, report.Archive)
+		if err != nil {
+			return nil, err
+		}
+		report.Keys, err = table.archiveExpired(ctx, archive, policy, cutoff)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		unlock, err := table.lockWrite(ctx)
+		if err != nil {
+			return nil, err
+		}
+		_, err = table.deleteMatching(ctx, func(record *dbdata.Record) bool {
+			if policy.expired(record, cutoff) {
+				report.Keys = append(report.Keys, table.recordKey(record))
+				return true
+			}
+			return false
+		})
+		unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(report.Keys)
+	report.Purged = len(report.Keys)
+	table.metrics.addPurgedRecords(report.Purged)
+	return report, nil
+}
+
+// archiveTable returns the archive table of a table, creating it with the same primary key and storage options if
+// it does not exist.
+func (db *Database) archiveTable(table *Table, name string) (*Table, error) {
+	if archive, err := db.lookupTable(name); err == nil {
+		if archive == table {
+			return nil, fmt.Errorf("table %s cannot be its own archive", name)
+		}
+		return archive, nil
+	}
+	table.RLock()
+	options := TableOptions{
+		ClientEncrypted:  table.Options.ClientEncrypted,
+		Pipeline:         table.Options.Pipeline,
+		Schema:           table.Options.Schema,
+		KeyNormalization: table.Options.KeyNormalization,
+	}
+	table.RUnlock()
+	if err := db.CreateTableWithOptions(name, table.PrimaryKey, options); err != nil {
+		return nil, fmt.Errorf("failed to create archive table %s: %v", name, err)
+	}
+	return db.lookupTable(name)
+}
+
+// archiveExpired moves the expired records of the table to the archive, writing both tables under their write locks.
+// If the archive cannot be written the table is left unchanged, and if the table cannot be written the archive is
+// restored. It returns the keys of the moved records.
+func (t *Table) archiveExpired(ctx context.Context, archive *Table, policy *RetentionPolicy, cutoff *dbdata.Value) ([]string, error) {
+	unlock, err := writeLockTables(ctx, t, archive)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	records, err := t.recordsForWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	archived, err := archive.recordsForWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for key, record := range records.Records {
+		if policy.expired(record, cutoff) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return keys, nil
+	}
+	for _, key := range keys {
+		if err := t.beforeDelete(key, records.Records[key]); err != nil {
+			return nil, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	replaced := make(map[string]*dbdata.Record, len(keys))
+	for _, key := range keys {
+		if previous, exists := archived.Records[key]; exists {
+			replaced[key] = previous
+		}
+		archived.Records[key] = proto.Clone(records.Records[key]).(*dbdata.Record)
+	}
+	if err := archive.writeRecordsToFile(archived); err != nil {
+		return nil, fmt.Errorf("failed to write archive table: %w", err)
+	}
+	for _, key := range keys {
+		delete(records.Records, key)
+		t.Cache.Remove(key)
+	}
+	if err := t.writeRecordsToFile(records); err != nil {
+		restored := make(map[string]*dbdata.Record, len(archived.Records))
+		for key, record := range archived.Records {
+			restored[key] = record
+		}
+		for _, key := range keys {
+			delete(restored, key)
+			if previous, exists := replaced[key]; exists {
+				restored[key] = previous
+			}
+		}
+		if restoreErr := archive.writeRecordsToFile(&dbdata.Records{Records: restored}); restoreErr != nil {
+			return nil, fmt.Errorf("%v (restoring the archive failed: %v)", err, restoreErr)
+		}
+		return nil, err
+	}
+
+	for _, key := range keys {
+		record := archived.Records[key]
+		archive.Cache.Remove(key)
+		if _, existed := replaced[key]; existed {
+			archive.metrics.IncrementUpdateCount()
+			archive.logCommit("update", key, record)
+		} else {
+			archive.metrics.IncrementInsertCount()
+			archive.logCommit("insert", key, record)
+		}
+		t.metrics.IncrementDeleteCount()
+		t.logCommit("delete", key, nil)
+	}
+	return keys, nil
+}
+
+// RunRetention applies the enabled retention policies of every table of the server and of its tenants every
+// interval, until ctx is done, logging the records purged from each table. Failures are logged and retried on the
+// next run. It returns ctx.Err(), or ErrClosed once the server is closed.
+func (s *Server) RunRetention(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.stopped:
+			return ErrClosed
+		case now := <-ticker.C:
+			s.applyRetention(ctx, now)
+		}
+	}
+}
+
+// applyRetention applies the enabled retention policies of every table of the server once.
+func (s *Server) applyRetention(ctx context.Context, now time.Time) {
+	for _, tenant := range s.tenantServers() {
+		tenant.applyRetention(ctx, now)
+	}
+	s.RLock()
+	databases := make([]*Database, 0, len(s.Databases))
+	for _, db := range s.Databases {
+		databases = append(databases, db)
+	}
+	s.RUnlock()
+
+	for _, db := range databases {
+		// The tables are listed first, as archiving may create tables in the database
+		db.RLock()
+		var tableNames []string
+		for tableName, table := range db.Tables {
+			if policy := table.retentionPolicy(); policy != nil && !policy.Disabled {
+				tableNames = append(tableNames, tableName)
+			}
+		}
+		db.RUnlock()
+
+		for _, tableName := range tableNames {
+			report, err := db.applyRetention(ctx, tableName, false, now)
+			if err != nil {
+				log.Printf("Failed to apply the retention policy of table %s.%s: %v", db.Name, tableName, err)
+				continue
+			}
+			if report.Purged > 0 {
+				log.Printf("Retention: %s %d records of table %s.%s older than %s", report.Action+"d", report.Purged, db.Name, tableName, report.Cutoff.Format(time.RFC3339))
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy controls how file operations are retried after transient errors, such as an interrupted
+// system call or, on Windows, a file briefly held open by an antivirus scanner or backup agent.
+// Permanent errors (missing files, permission denied, corrupted data) are returned immediately.
+type RetryPolicy struct {
+	Attempts       int           `json:"Attempts"`       // Attempts is the total number of tries, including the first one.
+	InitialBackoff time.Duration `json:"InitialBackoff"` // InitialBackoff is the wait before the first retry.
+	MaxBackoff     time.Duration `json:"MaxBackoff"`     // MaxBackoff caps the wait between retries.
+	Multiplier     float64       `json:"Multiplier"`     // Multiplier grows the wait after every retry.
+}
+
+// DefaultRetryPolicy is used by tables that do not configure a retry policy.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:       5,
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     500 * time.Millisecond,
+	Multiplier:     2,
+}
+
+// Do runs op until it succeeds, fails with a permanent error, or runs out of attempts.
+// It returns the last error.
+func (p RetryPolicy) Do(op func() error) error {
+	return p.DoCtx(context.Background(), op)
+}
+
+// DoCtx runs op like Do, but stops waiting between attempts and returns ctx.Err() once ctx is done.
+func (p RetryPolicy) DoCtx(ctx context.Context, op func() error) error {
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := op()
+		if err == nil || !IsTransientError(err) || attempt >= p.Attempts {
+			return err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff = time.Duration(float64(backoff) * p.Multiplier)
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// IsTransientError reports whether err is a file system error that may succeed if the operation is retried.
+func IsTransientError(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	for _, transient := range transientErrnos {
+		if errno == transient {
+			return true
+		}
+	}
+	return false
+}
+
+// retryPolicy returns the retry policy configured for the table, or DefaultRetryPolicy.
+func (t *Table) retryPolicy() RetryPolicy {
+	if t.Options.Retry != nil {
+		return *t.Options.Retry
+	}
+	return DefaultRetryPolicy
+}
@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+
+package data
+
+import "syscall"
+
+// transientErrnos are the errors worth retrying: interrupted system calls, resources that are
+// temporarily unavailable or busy, and stale or timed out handles on network file systems.
+var transientErrnos = []syscall.Errno{
+	syscall.EINTR,
+	syscall.EAGAIN,
+	syscall.EBUSY,
+	syscall.ETIMEDOUT,
+	syscall.ESTALE,
+}
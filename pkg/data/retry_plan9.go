@@ -0,0 +1,6 @@
+package data
+
+import "syscall"
+
+// transientErrnos is empty on Plan 9, whose system calls report errors as strings rather than numbers.
+var transientErrnos []syscall.Errno
@@ -0,0 +1,13 @@
+package data
+
+import "syscall"
+
+// transientErrnos are the Windows errors worth retrying: files locked by another process
+// (ERROR_SHARING_VIOLATION, ERROR_LOCK_VIOLATION), and network file systems that dropped a request.
+var transientErrnos = []syscall.Errno{
+	32,  // ERROR_SHARING_VIOLATION
+	33,  // ERROR_LOCK_VIOLATION
+	64,  // ERROR_NETNAME_DELETED
+	121, // ERROR_SEM_TIMEOUT
+	syscall.EINTR,
+}
@@ -0,0 +1,367 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/utils"
+)
+
+// rotatedKeys holds the encryption utilities of the master key set by the last RotateKey, which is used instead of
+// the AES key of the environment afterwards. It is nil until the master key is rotated.
+var rotatedKeys atomic.Pointer[utils.Utils]
+
+// rotationSuffix is appended to the path of a file rewritten by a key rotation for the file holding its new content,
+// until it replaces the file.
+const rotationSuffix = ".rotate"
+
+// KeyRotation reports what a key rotation changed.
+type KeyRotation struct {
+	Databases []string `json:"databases"` // Databases is the sorted names of the databases whose data key was wrapped again or replaced, as "tenant/database" for the databases of tenants.
+	Tables    []string `json:"tables"`    // Tables is the sorted names of the re-encrypted tables, as "database.table" or "tenant/database.table".
+}
+
+// rotationStep is a file rewritten by a key rotation, with the change made in memory once the file is replaced.
+type rotationStep struct {
+	path      string // File to replace, none if only the change in memory is made
+	temporary string // File holding the new content, which replaces path
+	switched  func() // Change made once the file is replaced, such as switching a table to the new key
+}
+
+// keyRotation rewrites the files of a key rotation. Every file is written to a temporary file first, and only once
+// all of them are written do they replace the files, in order, so a failure before that changes nothing.
+type keyRotation struct {
+	steps  []rotationStep
+	report KeyRotation
+}
+
+// stage adds a step writing the content to a temporary file next to path.
+func (r *keyRotation) stage(path string, content []byte, switched func()) error {
+	temporary := path + rotationSuffix
+	if err := writeFileBuffered(temporary, content); err != nil {
+		return err
+	}
+	r.steps = append(r.steps, rotationStep{path: path, temporary: temporary, switched: switched})
+	return nil
+}
+
+// stageDataKey adds a step writing the data keys of the database wrapped with the master key.
+func (r *keyRotation) stageDataKey(db *Database, master *utils.Utils, keys *dataKeys) error {
+	path := filepath.Join(db.directory(), dataKeyFile)
+	temporary := path + rotationSuffix
+	if err := writeDataKey(temporary, master, keys); err != nil {
+		return fmt.Errorf("database %s: %v", db.qualifiedName(), err)
+	}
+	r.steps = append(r.steps, rotationStep{path: path, temporary: temporary, switched: func() { db.keys = keys }})
+	r.report.Databases = append(r.report.Databases, db.qualifiedName())
+	return nil
+}
+
+// stageTable adds a step switching the table to the given encryption utilities and, if reencrypt is set, re-encrypting
+// its file with them, or writing it in plaintext for a table in plaintext mode. The file is decrypted with the
+// utilities the table has, which it keeps until the file is replaced. The segments of the table are folded into its
+// file first. The caller must hold the table write lock.
+func (r *keyRotation) stageTable(name string, table *Table, keys *utils.Utils, reencrypt bool) error {
+	if err := table.compact(); err != nil {
+		return fmt.Errorf("failed to flush table %s: %v", name, err)
+	}
+	storage, err := newPipeline(table.Options.Pipeline, keys)
+	if err != nil {
+		return fmt.Errorf("table %s: %v", name, err)
+	}
+	switched := func() {
+		table.utils = keys
+		table.storage = storage
+	}
+	if !reencrypt {
+		r.steps = append(r.steps, rotationStep{switched: switched})
+		return nil
+	}
+
+	stored, err := os.ReadFile(table.FilePath)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && len(stored) == 0) {
+		r.steps = append(r.steps, rotationStep{switched: switched})
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read table %s: %v", name, err)
+	}
+	plaintext := table.plaintext.Load()
+	if plaintext && storedPlaintext(stored) {
+		r.steps = append(r.steps, rotationStep{switched: switched})
+		return nil
+	}
+	// Files written in chunks are re-encrypted chunk by chunk
+	data, err := transformStored(stored, func(data []byte) ([]byte, error) {
+		data, err := table.decodeStorage(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt table %s: %v", name, err)
+		}
+		if plaintext {
+			// A table in plaintext mode whose file is still encrypted is written in plaintext, as its next write would be
+			return encodePlaintext(data), nil
+		}
+		for _, stage := range storage {
+			if data, err = stage.Encode(data); err != nil {
+				return nil, fmt.Errorf("failed to encrypt table %s: %s stage failed: %v", name, stage.Name(), err)
+			}
+		}
+		return data, nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := r.stage(table.FilePath, data, switched); err != nil {
+		return fmt.Errorf("failed to write table %s: %v", name, err)
+	}
+	r.report.Tables = append(r.report.Tables, name)
+	return nil
+}
+
+// discard removes the temporary files of the steps.
+func (r *keyRotation) discard() {
+	for _, step := range r.steps {
+		if step.temporary != "" {
+			os.Remove(step.temporary)
+		}
+	}
+}
+
+// commit replaces the files of the steps in order, making the change in memory of each step once its file is
+// replaced. If a file cannot be replaced, the temporary files of the following steps are removed.
+func (r *keyRotation) commit() (*KeyRotation, error) {
+	for i, step := range r.steps {
+		if step.path != "" {
+			if err := os.Rename(step.temporary, step.path); err != nil {
+				for _, left := range r.steps[i:] {
+					if left.temporary != "" {
+						os.Remove(left.temporary)
+					}
+				}
+				return nil, fmt.Errorf("failed to replace %s, the files before it use the new key: %v", step.path, err)
+			}
+		}
+		step.switched()
+	}
+	sort.Strings(r.report.Databases)
+	sort.Strings(r.report.Tables)
+	if r.report.Databases == nil {
+		r.report.Databases = []string{}
+	}
+	if r.report.Tables == nil {
+		r.report.Tables = []string{}
+	}
+	return &r.report, nil
+}
+
+// lockForRotation locks the databases for writing, in name order, and the tables stored in their files for writing,
+// so that no table is created, written or read from its file during a key rotation. It returns the tables of each
+// database by name and a function releasing the locks, or ErrReadOnly if a database is read-only.
+func lockForRotation(databases []*Database) (map[*Database]map[string]*Table, func(), error) {
+	for _, db := range databases {
+		if err := db.writable(); err != nil {
+			return nil, nil, err
+		}
+	}
+	sort.Slice(databases, func(i, j int) bool { return databases[i].qualifiedName() < databases[j].qualifiedName() })
+	tables := make(map[*Database]map[string]*Table, len(databases))
+	var all []*Table
+	for _, db := range databases {
+		db.Lock()
+		tables[db] = make(map[string]*Table)
+		for name, table := range db.Tables {
+			if !table.virtual && !table.temporary {
+				tables[db][name] = table
+				all = append(all, table)
+			}
+		}
+	}
+	unlockDatabases := func() {
+		for i := len(databases) - 1; i >= 0; i-- {
+			databases[i].Unlock()
+		}
+	}
+	unlockTables, err := writeLockTables(context.Background(), all...)
+	if err != nil {
+		unlockDatabases()
+		return nil, nil, err
+	}
+	return tables, func() {
+		unlockTables()
+		unlockDatabases()
+	}, nil
+}
+
+// sortedTableNames returns the names of the tables, sorted.
+func sortedTableNames(tables map[string]*Table) []string {
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RotateKey is a method of the Server struct that replaces the master AES key. The data key of every database, those
+// of the tenants included, is wrapped with the new key, which does not touch its tables. Databases created before
+// data keys existed, whose tables are encrypted with the master key, get a data key and their tables are re-encrypted
+// with it. Every file is written to a temporary file first, under the write locks of all databases and tables, and
+// the temporary files replace the files only once all are written, so a failure before that leaves everything
+// unchanged. Afterwards tables and data keys opened by the process use the new key, and data encrypted with the old
+// one, such as backups taken before the rotation, can still be decrypted. Only the root server rotates the key.
+//
+// The new key must be set in AES_KEY, and the old one in AES_PREVIOUS_KEY for as long as older data must stay
+// readable, before the server is started again.
+//
+// Parameters:
+// - newKey: The new AES key, exactly 32 bytes (256 bits) long.
+//
+// Returns:
+// - A pointer to a KeyRotation listing the databases whose data key was wrapped or generated and the re-encrypted tables.
+// - An error, if the key is invalid or the same as the current one, or a file cannot be read or written. If the
+// temporary files could not all replace the files, the error says which file failed; the files before it use the
+// new key. If the operation is successful, the error is nil.
+func (s *Server) RotateKey(newKey []byte) (*KeyRotation, error) {
+	if s.root != nil {
+		return nil, fmt.Errorf("the master key is shared by every tenant, rotate it on the root server instead of tenant %s", s.tenant)
+	}
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	current, err := masterUtils()
+	if err != nil {
+		return nil, err
+	}
+	rotated, err := current.Rotate(newKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var databases []*Database
+	for _, server := range append([]*Server{s}, s.tenantServers()...) {
+		server.RLock()
+		for _, db := range server.Databases {
+			databases = append(databases, db)
+		}
+		server.RUnlock()
+	}
+	tables, unlock, err := lockForRotation(databases)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	r := &keyRotation{}
+	for _, db := range databases {
+		keys := db.keys
+		if keys == nil {
+			if _, err := os.Stat(db.directory()); os.IsNotExist(err) {
+				continue // The database gets a data key when its first table is created
+			}
+			key, err := utils.GenerateKey()
+			if err != nil {
+				r.discard()
+				return nil, fmt.Errorf("failed to generate the data key of database %s: %v", db.qualifiedName(), err)
+			}
+			keys = &dataKeys{current: key, createdAt: time.Now().UTC()}
+		}
+		// The data key file is replaced before the tables, so tables are never encrypted with a key that is not stored
+		if err := r.stageDataKey(db, rotated, keys); err != nil {
+			r.discard()
+			return nil, err
+		}
+		tableKeys, err := keys.utils(rotated)
+		if err != nil {
+			r.discard()
+			return nil, err
+		}
+		for _, name := range sortedTableNames(tables[db]) {
+			// Tables encrypted with a data key are not rewritten, they only learn the new master key
+			if err := r.stageTable(db.qualifiedName()+"."+name, tables[db][name], tableKeys, db.keys == nil); err != nil {
+				r.discard()
+				return nil, err
+			}
+		}
+	}
+
+	report, err := r.commit()
+	if err != nil {
+		return nil, err
+	}
+	rotatedKeys.Store(rotated)
+	return report, nil
+}
+
+// RotateDataKey is a method of the Database struct that replaces the data key of the database with a new random key
+// and re-encrypts its tables with it, which leaves the other databases untouched. The data key file, holding the new
+// key and the replaced one, and the tables are written to temporary files first, under the write locks of the
+// database and its tables, and replace the files only once all are written. The replaced key is dropped from the data
+// key file once every table is re-encrypted.
+//
+// Returns:
+// - A pointer to a KeyRotation listing the database and its re-encrypted tables.
+// - An error, if the master key is not available or a file cannot be read or written. If the operation is
+// successful, the error is nil.
+func (db *Database) RotateDataKey() (*KeyRotation, error) {
+	master, err := masterUtils()
+	if err != nil {
+		return nil, err
+	}
+	key, err := utils.GenerateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate the data key of database %s: %v", db.Name, err)
+	}
+
+	tables, unlock, err := lockForRotation([]*Database{db})
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	dbDir := db.directory()
+	if err := os.MkdirAll(dbDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %v", err)
+	}
+
+	// Until every table is re-encrypted, the data key file keeps the replaced key, which decrypts the tables left
+	keys := &dataKeys{current: key, createdAt: time.Now().UTC()}
+	if db.keys != nil {
+		keys.previous = append([][]byte{db.keys.current}, db.keys.previous...)
+	}
+	r := &keyRotation{}
+	if err := r.stageDataKey(db, master, keys); err != nil {
+		r.discard()
+		return nil, err
+	}
+	tableKeys, err := keys.utils(master)
+	if err != nil {
+		r.discard()
+		return nil, err
+	}
+	for _, name := range sortedTableNames(tables[db]) {
+		if err := r.stageTable(db.Name+"."+name, tables[db][name], tableKeys, true); err != nil {
+			r.discard()
+			return nil, err
+		}
+	}
+	report, err := r.commit()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keys.previous) > 0 {
+		final := &keyRotation{}
+		current := &dataKeys{current: keys.current, createdAt: keys.createdAt}
+		if err := final.stageDataKey(db, master, current); err != nil {
+			return nil, fmt.Errorf("tables were re-encrypted but the replaced data key could not be dropped: %v", err)
+		}
+		if _, err := final.commit(); err != nil {
+			return nil, fmt.Errorf("tables were re-encrypted but the replaced data key could not be dropped: %v", err)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,208 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrValidationFailed is wrapped by the ValidationError returned by writes of values that break the validation
+// rules of their fields.
+var ErrValidationFailed = errors.New("record breaks the validation rules of the table")
+
+// FieldRule constrains the values of a field. NULL values and records without the field pass every rule, and
+// writes of values that break any rule are rejected with a ValidationError.
+type FieldRule struct {
+	Pattern string        `json:"Pattern,omitempty"` // Pattern is a regular expression, in RE2 syntax, that string values must match.
+	Min     *float64      `json:"Min,omitempty"`     // Min is the smallest number the field may hold, no lower bound if nil.
+	Max     *float64      `json:"Max,omitempty"`     // Max is the largest number the field may hold, no upper bound if nil.
+	Enum    []interface{} `json:"Enum,omitempty"`    // Enum lists the values the field may hold, any value if empty.
+}
+
+// FieldViolation describes a value that breaks a validation rule of its field.
+type FieldViolation struct {
+	Field   string      `json:"field"`   // Field is the field, or nested path, the rule applies to.
+	Rule    string      `json:"rule"`    // Rule is the broken rule: "pattern", "min", "max" or "enum".
+	Value   interface{} `json:"value"`   // Value is the rejected value.
+	Message string      `json:"message"` // Message explains what the field must hold.
+}
+
+// ValidationError reports every value of a written record that breaks the validation rules of the table. It wraps
+// ErrValidationFailed.
+type ValidationError struct {
+	Violations []FieldViolation // Violations lists the broken rules, sorted by field.
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		messages[i] = fmt.Sprintf("field '%s' %s", violation.Field, violation.Message)
+	}
+	return fmt.Sprintf("%v: %s", ErrValidationFailed, strings.Join(messages, "; "))
+}
+
+// Unwrap returns ErrValidationFailed, so that errors.Is identifies validation errors.
+func (e *ValidationError) Unwrap() error {
+	return ErrValidationFailed
+}
+
+// patterns caches the compiled regular expressions of the rules, which are checked on every write.
+var patterns sync.Map
+
+// compilePattern returns the compiled regular expression of a rule.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if compiled, ok := patterns.Load(pattern); ok {
+		return compiled.(*regexp.Regexp), nil
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patterns.Store(pattern, compiled)
+	return compiled, nil
+}
+
+// validateRules checks the validation rules in the options of a table.
+func validateRules(options TableOptions) error {
+	if len(options.Rules) > 0 && options.ClientEncrypted {
+		return errors.New("client encrypted tables cannot have validation rules")
+	}
+	for field, rule := range options.Rules {
+		if rule.Pattern != "" {
+			if _, err := compilePattern(rule.Pattern); err != nil {
+				return fmt.Errorf("invalid pattern of field '%s': %v", field, err)
+			}
+		}
+		if rule.Min != nil && rule.Max != nil && *rule.Min > *rule.Max {
+			return fmt.Errorf("invalid rule of field '%s': min %v is greater than max %v", field, *rule.Min, *rule.Max)
+		}
+		for _, value := range rule.Enum {
+			if _, err := toProtoValue(value); err != nil {
+				return fmt.Errorf("invalid enum value %v of field '%s': %v", value, field, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkRules checks the fields of a record, or the updates of a record, against the validation rules and returns a
+// ValidationError listing every value that breaks them. Fields the record does not have are not checked.
+func checkRules(rules map[string]FieldRule, record Record) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	var violations []FieldViolation
+	for field, rule := range rules {
+		value, exists := recordPath(record, field)
+		if !exists || value == nil {
+			continue
+		}
+		violations = append(violations, rule.check(field, value)...)
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	sort.Slice(violations, func(i, j int) bool {
+		if violations[i].Field != violations[j].Field {
+			return violations[i].Field < violations[j].Field
+		}
+		return violations[i].Rule < violations[j].Rule
+	})
+	return &ValidationError{Violations: violations}
+}
+
+// check returns the violations of the rule by a value of the field.
+func (r FieldRule) check(field string, value interface{}) []FieldViolation {
+	var violations []FieldViolation
+	violate := func(rule, format string, args ...interface{}) {
+		violations = append(violations, FieldViolation{Field: field, Rule: rule, Value: value, Message: fmt.Sprintf(format, args...)})
+	}
+	if r.Pattern != "" {
+		s, ok := value.(string)
+		if compiled, err := compilePattern(r.Pattern); !ok || err != nil || !compiled.MatchString(s) {
+			violate("pattern", "must be a string matching %s", r.Pattern)
+		}
+	}
+	if r.Min != nil || r.Max != nil {
+		_, number, _, ok := numberOf(value)
+		if r.Min != nil && (!ok || number < *r.Min) {
+			violate("min", "must be a number of at least %v", *r.Min)
+		}
+		if r.Max != nil && (!ok || number > *r.Max) {
+			violate("max", "must be a number of at most %v", *r.Max)
+		}
+	}
+	if len(r.Enum) > 0 && !r.allows(value) {
+		allowed := make([]string, len(r.Enum))
+		for i, option := range r.Enum {
+			allowed[i] = fmt.Sprintf("%v", option)
+		}
+		violate("enum", "must be one of %s", strings.Join(allowed, ", "))
+	}
+	return violations
+}
+
+// allows reports whether the value is one of the values of the enum, compared like Equal does.
+func (r FieldRule) allows(value interface{}) bool {
+	stored, err := toProtoValue(value)
+	if err != nil {
+		return false
+	}
+	for _, option := range r.Enum {
+		if allowed, err := toProtoValue(option); err == nil && Equal(stored, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRules is a method of the Table struct that replaces the validation rules of the table and saves them in its
+// metadata. Like a check constraint, the rules must hold for the records already stored.
+//
+// Parameters:
+// - rules: The rule of every constrained field or nested path, none if empty.
+//
+// Returns:
+// - An error wrapping the ValidationError of the first stored record that breaks the rules, or an error if the
+// rules are invalid or the metadata cannot be written. The rules are left unchanged on error. If the operation is
+// successful, the error is nil.
+func (t *Table) SetRules(rules map[string]FieldRule) error {
+	defer t.sample("set_rules", "", time.Now())
+	unlock, err := t.lockWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	options := t.Options
+	options.Rules = rules
+	if err := validateRules(options); err != nil {
+		return err
+	}
+	allRecords, err := t.recordsForWrite(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to load records: %w", err)
+	}
+	keys := make([]string, 0, len(allRecords.Records))
+	for key := range allRecords.Records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		values, err := fromProtoRecord(allRecords.Records[key])
+		if err != nil {
+			return fmt.Errorf("failed to read record %s: %v", key, err)
+		}
+		if err := checkRules(rules, values); err != nil {
+			return fmt.Errorf("record %s: %w", key, err)
+		}
+	}
+	return t.saveOptions(func(options *TableOptions) {
+		options.Rules = rules
+	})
+}
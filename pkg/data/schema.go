@@ -0,0 +1,221 @@
+package data
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+	"google.golang.org/protobuf/proto"
+)
+
+// Field types. Table schemas declare fields as FieldString, FieldInt, FieldFloat, FieldBool, FieldTimestamp or
+// FieldBytes; ConvertFieldType converts values to FieldString, FieldNumber or FieldBool.
+const (
+	FieldString    = "string"    // FieldString values are strings.
+	FieldNumber    = "number"    // FieldNumber values are numbers, integer or not.
+	FieldInt       = "int"       // FieldInt values are 64-bit integers.
+	FieldFloat     = "float"     // FieldFloat values are floating point numbers.
+	FieldBool      = "bool"      // FieldBool values are booleans.
+	FieldTimestamp = "timestamp" // FieldTimestamp values are times, stored with their UTC offset.
+	FieldBytes     = "bytes"     // FieldBytes values are byte strings, given as []byte or base64 encoded strings.
+)
+
+// ErrSchemaViolation is returned, wrapped with the offending field, by writes of records that do not match the
+// schema of the table.
+var ErrSchemaViolation = errors.New("record does not match the table schema")
+
+// validateSchema checks the schema in the options of a table.
+func validateSchema(options TableOptions) error {
+	if len(options.Schema) == 0 {
+		return nil
+	}
+	if options.ClientEncrypted {
+		return errors.New("client encrypted tables cannot have a schema")
+	}
+	for field, fieldType := range options.Schema {
+		switch fieldType {
+		case FieldString, FieldInt, FieldFloat, FieldBool, FieldTimestamp, FieldBytes:
+		default:
+			return fmt.Errorf("unknown type %q of field '%s', expected string, int, float, bool, timestamp or bytes", fieldType, field)
+		}
+	}
+	if options.Timestamps {
+		for _, field := range []string{CreatedAtField, UpdatedAtField} {
+			if fieldType, declared := options.Schema[field]; declared && fieldType != FieldTimestamp {
+				return fmt.Errorf("field '%s' is maintained by the table and must be a timestamp", field)
+			}
+		}
+	}
+	return nil
+}
+
+// applySchema checks the fields of a record, or the updates of a record, against the schema and returns them
+// converted to the declared types. Fields that are not declared are rejected, except the primary key and the fields
+// maintained by the table, and NULL is accepted for every field. The given record is not modified.
+// The caller must hold the table write lock.
+func (t *Table) applySchema(schema map[string]string, record Record) (Record, error) {
+	if len(schema) == 0 {
+		return record, nil
+	}
+	typed := make(Record, len(record))
+	for field, value := range record {
+		fieldType, declared := schema[field]
+		if !declared {
+			if field == t.PrimaryKey || t.Options.Timestamps && (field == CreatedAtField || field == UpdatedAtField) {
+				typed[field] = value
+				continue
+			}
+			return nil, fmt.Errorf("%w: unknown field '%s'", ErrSchemaViolation, field)
+		}
+		converted, err := toFieldType(fieldType, value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: field '%s' %v", ErrSchemaViolation, field, err)
+		}
+		typed[field] = converted
+	}
+	return typed, nil
+}
+
+// toFieldType converts a value to the form values of the field type are stored in, accepting the other forms the
+// value may be given in, such as integers decoded from JSON as float64 or timestamps given as time.Time.
+func toFieldType(fieldType string, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	switch fieldType {
+	case FieldString:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+	case FieldInt:
+		switch v := value.(type) {
+		case int:
+			return int64(v), nil
+		case int32:
+			return int64(v), nil
+		case int64:
+			return v, nil
+		case float32:
+			return floatToInt(float64(v))
+		case float64:
+			return floatToInt(v)
+		}
+	case FieldFloat:
+		switch v := value.(type) {
+		case int:
+			return float64(v), nil
+		case int32:
+			return float64(v), nil
+		case int64:
+			return float64(v), nil
+		case float32:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		}
+	case FieldBool:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	case FieldTimestamp:
+		switch v := value.(type) {
+		case time.Time:
+			return v, nil
+		case string:
+			parsed, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return nil, fmt.Errorf("must be an RFC 3339 timestamp, got %q", v)
+			}
+			return parsed, nil
+		}
+	case FieldBytes:
+		switch v := value.(type) {
+		case []byte:
+			return v, nil
+		case string:
+			decoded, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return nil, fmt.Errorf("must be base64 encoded bytes, got %q", v)
+			}
+			return decoded, nil
+		}
+	}
+	return nil, fmt.Errorf("must be %s, got %s", fieldType, kindOf(value))
+}
+
+// floatToInt converts a number without a fractional part to an integer.
+func floatToInt(f float64) (interface{}, error) {
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return nil, fmt.Errorf("must be int, got %v", f)
+	}
+	return int64(f), nil
+}
+
+// SetSchema declares the types of the fields of the table, replacing its schema, or removes the schema if it is
+// empty. It is stored in the table metadata. Every record must already match the schema: values given in other forms
+// of the declared type, such as integers stored as floating point numbers, are rewritten in the form of the type,
+// like RenameField rewrites records.
+//
+// Parameters:
+// - schema: The type of every field, FieldString, FieldInt, FieldFloat, FieldBool, FieldTimestamp or FieldBytes.
+//
+// Returns:
+// - An error wrapping ErrSchemaViolation if a record does not match the schema, or an error if the schema is invalid
+// or the table cannot be written. The table is left unchanged on error. If the operation is successful, the error is nil.
+func (t *Table) SetSchema(schema map[string]string) error {
+	unlock, err := t.lockWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	options := t.Options
+	options.Schema = schema
+	if err := validateSchema(options); err != nil {
+		return err
+	}
+	allRecords, err := t.recordsForWrite(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to load records: %w", err)
+	}
+
+	changed := make(map[string]*dbdata.Record)
+	for key, record := range allRecords.Records {
+		values, err := fromProtoRecord(record)
+		if err != nil {
+			return fmt.Errorf("failed to read record %s: %v", key, err)
+		}
+		typed, err := t.applySchema(schema, values)
+		if err != nil {
+			return fmt.Errorf("record %s: %w", key, err)
+		}
+		var converted *dbdata.Record
+		for field := range schema {
+			value, exists := typed[field]
+			if !exists {
+				continue
+			}
+			stored, err := toProtoValue(value)
+			if err != nil {
+				return fmt.Errorf("failed to store field '%s' of record %s: %v", field, key, err)
+			}
+			if proto.Equal(stored, record.Fields[field]) {
+				continue
+			}
+			if converted == nil {
+				converted = proto.Clone(record).(*dbdata.Record)
+			}
+			converted.Fields[field] = stored
+		}
+		if converted != nil {
+			changed[key] = converted
+		}
+	}
+	return t.rewriteRecords(allRecords, changed, func(options *TableOptions) {
+		options.Schema = schema
+	})
+}
@@ -0,0 +1,451 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// DefaultMaxSegments is the number of segment files that starts a compaction of a segmented table whose Segmentation
+// sets none.
+const DefaultMaxSegments = 8
+
+// segmentsSuffix replaces the .dat extension of a table file for the directory holding its segment files.
+const segmentsSuffix = ".segments"
+
+// The extensions of segment files. Delta segments hold the records changed by some writes, and a tombstone for each
+// record they deleted; full segments hold every record and take the place of the table file and the older segments.
+const (
+	deltaSegmentExt = ".seg"
+	fullSegmentExt  = ".full"
+)
+
+// Segmentation configures the segmented mode of a table. By default every write replaces the whole table file; in
+// segmented mode a write only writes the records it changed, and a tombstone for each record it deleted, to a new
+// segment file, so writes to a huge table cost as much as their changes. Once the table has MaxSegments segments, a
+// background compaction merges them into one if together they are small next to the table file, and otherwise
+// rewrites the table file with every record, which drops the segments and their tombstones. Writes that change at
+// least half of the records rewrite the table file right away.
+type Segmentation struct {
+	MaxSegments int `json:"MaxSegments,omitempty"` // MaxSegments is the number of segments that starts a compaction, DefaultMaxSegments if 0.
+}
+
+// maxSegments returns the number of segments that starts a compaction.
+func (s *Segmentation) maxSegments() int {
+	if s.MaxSegments > 0 {
+		return s.MaxSegments
+	}
+	return DefaultMaxSegments
+}
+
+// validateSegmentation checks that a segmented mode can be applied.
+func validateSegmentation(policy *Segmentation) error {
+	if policy != nil && policy.MaxSegments < 0 {
+		return fmt.Errorf("invalid segment count %d, expected a positive number", policy.MaxSegments)
+	}
+	return nil
+}
+
+// segmentState tracks the segment files of a table and their compaction.
+type segmentState struct {
+	count      atomic.Int64        // Number of segment files, as last read or written
+	unwritten  map[string]struct{} // Keys of the records changed in memory but not in a file yet, in write-behind mode
+	compacting bool                // Whether a background compaction is scheduled
+}
+
+// segmentFile is a segment file of a table.
+type segmentFile struct {
+	seq  uint64 // Position of the segment in the order they were written
+	path string // Path of the segment file
+	full bool   // Whether the segment holds every record of the table
+}
+
+// segmentDir returns the directory holding the segment files of the table file at filePath.
+func segmentDir(filePath string) string {
+	return strings.TrimSuffix(filePath, ".dat") + segmentsSuffix
+}
+
+// segmentFiles returns the segment files of the table file at filePath in the order they were written, none if it
+// has no segment directory. Segments still being written are skipped.
+func segmentFiles(filePath string) ([]segmentFile, error) {
+	dir := segmentDir(filePath)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var segments []segmentFile
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		if entry.IsDir() || (ext != deltaSegmentExt && ext != fullSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segmentFile{seq: seq, path: filepath.Join(dir, name), full: ext == fullSegmentExt})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].seq < segments[j].seq })
+	return segments, nil
+}
+
+// lastFullSegment returns the index of the latest full segment, or -1 if there is none.
+func lastFullSegment(segments []segmentFile) int {
+	for i := len(segments) - 1; i >= 0; i-- {
+		if segments[i].full {
+			return i
+		}
+	}
+	return -1
+}
+
+// nextSegmentPath returns the path of a segment with the given extension written after the given segments.
+func (t *Table) nextSegmentPath(segments []segmentFile, ext string) string {
+	seq := uint64(1)
+	if len(segments) > 0 {
+		seq = segments[len(segments)-1].seq + 1
+	}
+	return filepath.Join(segmentDir(t.FilePath), fmt.Sprintf("%010d%s", seq, ext))
+}
+
+// filesSize returns the size in bytes of the table file at filePath and of its segment files.
+func filesSize(filePath string) (int64, error) {
+	var size int64
+	info, err := os.Stat(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	} else if err == nil {
+		size = info.Size()
+	}
+	segments, err := segmentFiles(filePath)
+	if err != nil {
+		return 0, err
+	}
+	for _, segment := range segments {
+		if info, err := os.Stat(segment.path); err == nil {
+			size += info.Size()
+		}
+	}
+	return size, nil
+}
+
+// isTombstone reports whether a record of a delta segment marks the deletion of its key: unlike the records written,
+// which are all sealed, it has neither fields nor a checksum.
+func isTombstone(record *dbdata.Record) bool {
+	return len(record.Fields) == 0 && len(record.Checksum) == 0
+}
+
+// changedKeys returns the keys of the records inserted, changed or deleted between two versions of the records of a
+// table. Records are sealed again whenever they are changed, so their checksums tell the changed ones apart.
+func changedKeys(previous, current map[string]*dbdata.Record) map[string]struct{} {
+	changed := make(map[string]struct{})
+	for key, record := range current {
+		if old, exists := previous[key]; !exists || len(old.Checksum) == 0 || !bytes.Equal(old.Checksum, record.Checksum) {
+			changed[key] = struct{}{}
+		}
+	}
+	for key := range previous {
+		if _, exists := current[key]; !exists {
+			changed[key] = struct{}{}
+		}
+	}
+	return changed
+}
+
+// trackChanges remembers the keys of the records changed by a write that write-behind left pending, for the next
+// flush to write them to a segment. It does nothing for tables that are not segmented, whose writes pass no keys.
+// The caller must hold the table write lock.
+func (t *Table) trackChanges(keys map[string]struct{}) {
+	if keys == nil {
+		return
+	}
+	if t.segments.unwritten == nil {
+		t.segments.unwritten = make(map[string]struct{}, len(keys))
+	}
+	for key := range keys {
+		t.segments.unwritten[key] = struct{}{}
+	}
+}
+
+// storeChanges writes the records of the given keys, and a tombstone for each key that has none, to a new delta
+// segment, and schedules a compaction once the table has enough segments. Changes touching at least half of the
+// records rewrite the table file with every record instead. The caller must hold the table write lock.
+func (t *Table) storeChanges(records map[string]*dbdata.Record, keys map[string]struct{}) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if 2*len(keys) >= len(records) {
+		return t.checkpoint(records)
+	}
+
+	segments, err := segmentFiles(t.FilePath)
+	if err != nil {
+		return fmt.Errorf("failed to list segments: %v", err)
+	}
+	if err := t.writeSegment(t.nextSegmentPath(segments, deltaSegmentExt), changesOf(records, keys)); err != nil {
+		return err
+	}
+	count := len(segments) + 1
+	t.segments.count.Store(int64(count))
+	if policy := t.Options.Segmentation; policy != nil && count >= policy.maxSegments() {
+		t.scheduleCompaction()
+	}
+	return nil
+}
+
+// changesOf returns the records of the given keys, with a tombstone for each key that has none, as delta segments and
+// the write-behind log hold them.
+func changesOf(records map[string]*dbdata.Record, keys map[string]struct{}) *dbdata.Records {
+	changes := &dbdata.Records{Records: make(map[string]*dbdata.Record, len(keys)), FormatVersion: RecordsFormatVersion}
+	for key := range keys {
+		if record, exists := records[key]; exists {
+			changes.Records[key] = record
+		} else {
+			changes.Records[key] = &dbdata.Record{}
+		}
+	}
+	return changes
+}
+
+// applyChanges applies the records and tombstones of a delta segment or of a frame of the write-behind log to records.
+func applyChanges(records, changes *dbdata.Records) {
+	for key, record := range changes.Records {
+		if isTombstone(record) {
+			delete(records.Records, key)
+		} else {
+			records.Records[key] = record
+		}
+	}
+}
+
+// writeSegment writes the records to a new segment file at path. The segment is written to a temporary file first,
+// so a segment is never read half written.
+func (t *Table) writeSegment(path string, records *dbdata.Records) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create segment directory: %v", err)
+	}
+	temporary := path + ".tmp"
+	if err := t.storeRecordsAt(temporary, records); err != nil {
+		os.Remove(temporary)
+		return err
+	}
+	if err := os.Rename(temporary, path); err != nil {
+		os.Remove(temporary)
+		return fmt.Errorf("failed to write segment: %v", err)
+	}
+	return nil
+}
+
+// checkpoint writes every record to the table file and removes the segments of the table, dropping their tombstones.
+// Tables with segments get a full segment first, which loading prefers to the table file and the older segments, and
+// which replaces the table file once the older segments are removed, so older segments are never applied to newer
+// records whichever step fails. Once the full segment is written the records are stored, and failing to clean up
+// after it is only logged; the next checkpoint finishes the job. The caller must hold the table write lock.
+func (t *Table) checkpoint(records map[string]*dbdata.Record) error {
+	whole := &dbdata.Records{Records: records, FormatVersion: RecordsFormatVersion}
+	segments, err := segmentFiles(t.FilePath)
+	if err != nil {
+		return fmt.Errorf("failed to list segments: %v", err)
+	}
+	if len(segments) == 0 {
+		return t.storeRecords(whole)
+	}
+
+	full := t.nextSegmentPath(segments, fullSegmentExt)
+	if err := t.writeSegment(full, whole); err != nil {
+		return err
+	}
+	t.segments.count.Store(int64(len(segments) + 1))
+	for _, segment := range segments {
+		if err := os.Remove(segment.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove segment %s of table %s: %v", filepath.Base(segment.path), t.FilePath, err)
+			return nil
+		}
+	}
+	if err := os.Rename(full, t.FilePath); err != nil {
+		log.Printf("Failed to replace table %s with its full segment: %v", t.FilePath, err)
+		return nil
+	}
+	// Only the temporary files of failed segment writes can be left
+	os.RemoveAll(segmentDir(t.FilePath))
+	t.segments.count.Store(0)
+	return nil
+}
+
+// applySegments applies the changes of the delta segments, in order, to the records read from the table file.
+func (t *Table) applySegments(ctx context.Context, records *dbdata.Records, segments []segmentFile) error {
+	for _, segment := range segments {
+		changes, err := t.decodeStoredFile(ctx, segment.path)
+		if err != nil {
+			return fmt.Errorf("segment %s: %w", filepath.Base(segment.path), err)
+		}
+		applyChanges(records, changes)
+	}
+	return nil
+}
+
+// scheduleCompaction starts a background compaction of the segments of the table, unless one is already scheduled.
+// The caller must hold the table write lock.
+func (t *Table) scheduleCompaction() {
+	if t.segments.compacting {
+		return
+	}
+	t.segments.compacting = true
+	go t.compactBehind()
+}
+
+// compactBehind compacts the segments of the table in the background, once the write that scheduled it released the
+// table.
+func (t *Table) compactBehind() {
+	t.Lock()
+	defer t.Unlock()
+	t.segments.compacting = false
+	if t.dropped || t.closed.Load() || t.Options.Segmentation == nil {
+		return
+	}
+	if err := t.compactSegments(); err != nil {
+		log.Printf("Failed to compact table %s: %v", t.FilePath, err)
+	}
+}
+
+// compactSegments compacts the segments of the table if there are MaxSegments of them: delta segments smaller
+// together than half the table file are merged into one, and otherwise the table file is rewritten with every record.
+// The caller must hold the table write lock.
+func (t *Table) compactSegments() error {
+	segments, err := segmentFiles(t.FilePath)
+	if err != nil {
+		return fmt.Errorf("failed to list segments: %v", err)
+	}
+	if len(segments) < t.Options.Segmentation.maxSegments() {
+		return nil
+	}
+	if lastFullSegment(segments) < 0 {
+		var deltas int64
+		for _, segment := range segments {
+			if info, err := os.Stat(segment.path); err == nil {
+				deltas += info.Size()
+			}
+		}
+		if info, err := os.Stat(t.FilePath); err == nil && 2*deltas < info.Size() {
+			return t.mergeSegments(segments)
+		}
+	}
+	if err := t.reload(); err != nil {
+		return err
+	}
+	return t.rewriteFile()
+}
+
+// mergeSegments replaces the delta segments with a single one holding their latest changes. Tombstones are kept, as
+// the table file may still hold the records they delete. The merged segment is written before the others are
+// removed, and applying it after them changes nothing, so no step leaves the table inconsistent; segments that cannot
+// be removed are left to the next compaction. The caller must hold the table write lock.
+func (t *Table) mergeSegments(segments []segmentFile) error {
+	merged := &dbdata.Records{Records: make(map[string]*dbdata.Record), FormatVersion: RecordsFormatVersion}
+	for _, segment := range segments {
+		changes, err := t.decodeStoredFile(context.Background(), segment.path)
+		if err != nil {
+			return fmt.Errorf("segment %s: %w", filepath.Base(segment.path), err)
+		}
+		for key, record := range changes.Records {
+			merged.Records[key] = record
+		}
+	}
+	if err := t.writeSegment(t.nextSegmentPath(segments, deltaSegmentExt), merged); err != nil {
+		return err
+	}
+	remaining := 1
+	for _, segment := range segments {
+		if err := os.Remove(segment.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove segment %s of table %s: %v", filepath.Base(segment.path), t.FilePath, err)
+			remaining++
+		}
+	}
+	t.segments.count.Store(int64(remaining))
+	return nil
+}
+
+// compact writes the changes write-behind left pending and folds the segments of the table into the table file, so
+// that it holds every record on its own, before the file is read or replaced as a whole. The caller must hold the
+// table write lock.
+func (t *Table) compact() error {
+	segments, err := segmentFiles(t.FilePath)
+	if err != nil {
+		return fmt.Errorf("failed to list segments: %v", err)
+	}
+	if t.dropped || (len(segments) == 0 && t.writeBehind.pending.Load() == 0) {
+		return t.flushPending()
+	}
+	if err := t.reload(); err != nil {
+		return err
+	}
+	return t.rewriteFile()
+}
+
+// SetSegmentation is a method of the Table struct that switches the table to segmented mode, which is stored in its
+// metadata, or back to rewriting the file on every write. Changes write-behind left pending are flushed first, and
+// switching the mode off folds the segments into the file.
+//
+// Parameters:
+// - policy: When the segments are compacted, or nil to rewrite the file on every write.
+//
+// Returns:
+// - An error, if the policy is invalid, the pending changes or the segments cannot be written or the metadata cannot
+// be written. If the operation is successful, the error is nil.
+func (t *Table) SetSegmentation(policy *Segmentation) error {
+	if err := validateSegmentation(policy); err != nil {
+		return err
+	}
+	unlock, err := t.lockWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := t.flushPending(); err != nil {
+		return err
+	}
+	if policy == nil && !t.virtual && !t.temporary {
+		if err := t.compact(); err != nil {
+			return err
+		}
+	}
+	return t.saveOptions(func(options *TableOptions) {
+		options.Segmentation = policy
+	})
+}
+
+// Compact is a method of the Table struct that folds the segments of the table into its file right away, dropping
+// the tombstones they hold, after waiting for the writes in progress. Changes write-behind left pending are written
+// too. Tables without segments are left as they are.
+//
+// Returns:
+// - An error, if the records or the file cannot be written. If the operation is successful, the error is nil.
+func (t *Table) Compact() error {
+	if t.virtual || t.temporary {
+		return nil
+	}
+	unlock, err := t.lockWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return t.compact()
+}
+
+// Segments returns the number of segment files of the table, which is only non-zero in segmented mode or until the
+// segments left by it are compacted.
+func (t *Table) Segments() int {
+	return int(t.segments.count.Load())
+}
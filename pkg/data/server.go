@@ -2,19 +2,48 @@ package data
 
 import (
 	"archive/zip"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Server struct {
 	sync.RWMutex                      // Mutex to ensure the server is thread safe
 	Databases    map[string]*Database // Map of Databases in the server
+	commitLog    *CommitLog           // Commit log shared by every database
+	limits       Limits               // Limits of reads by callers without a role limit
+	roleLimits   map[string]Limits    // Limits of reads by role
+	throttle     WriteThrottle        // Write throttle of the tables of every database
+	generators   Generators           // Sources of generated fields of the tables of every database
+	telemetry    *Telemetry           // Telemetry of the tables of every database
+	plugins      []*Plugin            // Plugins registered on the tables of every database
+	plaintext    bool                 // Whether the tables of every database are written unencrypted, set with SetPlaintext
+	tenant       string               // Tenant whose databases the server holds, empty for the root server
+	root         *Server              // Root server holding the tenants and the API keys, nil for the root server
+	tenantsLock  sync.Mutex           // Mutex guarding tenants
+	tenants      map[string]*Server   // Servers of the tenants, loaded by Initialize on the root server
+
+	readOnly         atomic.Bool                        // Whether the databases of the server are read-only, set with SetReadOnly
+	closed           atomic.Bool                        // Whether the server has been closed, after which every operation fails with ErrClosed
+	stopped          chan struct{}                      // Closed by Close to stop the background loops of the server
+	stopOnce         sync.Once                          // Closes stopped once
+	lastVerification atomic.Pointer[BackupVerification] // Result of the last backup verification
+	backupRetention  BackupRetention                    // Which backups are kept after every backup, set with SetBackupRetention
+	destination      BackupDestination                  // Where backups are copied to, set with SetBackupDestination
+	indexLimit       atomic.Int64                       // MaxBytes of the index budget enforced by RunIndexBudget, 0 if none
+	jobs             jobRegistry                        // Jobs running in the background, see StartJob
 }
 
 // NewServer creates a new Server instance.
@@ -24,28 +53,41 @@ type Server struct {
 func NewServer() *Server {
 	return &Server{
 		Databases: make(map[string]*Database),
+		stopped:   make(chan struct{}),
 	}
 }
 
 // Initialize is a method of the Server struct that initializes the server.
-// It creates the server directory and loads the databases.
-// The server directory is determined by the getDefaultServerDir function.
-// If the server directory does not exist, it is created with read, write, and execute permissions for the user only.
+// It creates the server directory and loads the databases, and on the root server the tenants, see Tenant.
+// The server directory is determined by the databasesDir method.
+// If the server directory does not exist, it is created with read, write, and execute permissions for the user only,
+// unless the server is read-only, see SetReadOnly.
 // If there is an error creating the server directory, the error is returned.
 // After the server directory is successfully created or if it already exists, the databases are loaded using the LoadDatabases method.
 // If there is an error loading the databases, the error is returned.
 // If the server directory is successfully created and the databases are successfully loaded, the method returns nil.
 func (s *Server) Initialize() error {
-	serverDir := getDefaultServerDir()
-	if err := os.MkdirAll(serverDir, 0755); err != nil {
+	serverDir := s.databasesDir()
+	if s.readOnly.Load() {
+		// A read-only server creates nothing, the directory must exist
+		if _, err := os.Stat(serverDir); err != nil {
+			return fmt.Errorf("failed to access server directory: %v", err)
+		}
+	} else if err := os.MkdirAll(serverDir, 0755); err != nil {
 		return fmt.Errorf("failed to create or access server directory: %v", err)
 	}
 
-	return s.LoadDatabases()
+	if err := s.LoadDatabases(); err != nil {
+		return err
+	}
+	if s.root == nil {
+		return s.loadTenants()
+	}
+	return nil
 }
 
 // LoadDatabases is a method of the Server struct that loads the databases from the server directory.
-// It reads the server directory using the os.ReadDir function and the getDefaultServerDir function.
+// It reads the server directory using the os.ReadDir function and the databasesDir method.
 // If there is an error reading the server directory, the error is returned.
 // For each directory in the server directory, it creates a new Database instance with the directory name as the database name.
 // It then loads the tables from the database directory using the LoadTables method of the Database struct.
@@ -53,15 +95,27 @@ func (s *Server) Initialize() error {
 // If the tables are successfully loaded, the database is added to the Databases field of the Server struct.
 // If all databases are successfully loaded, the method returns nil.
 func (s *Server) LoadDatabases() error {
-	dbs, err := os.ReadDir(getDefaultServerDir())
+	dbs, err := os.ReadDir(s.databasesDir())
 	if err != nil {
 		return fmt.Errorf("failed to read server directory: %v", err)
 	}
 
 	for _, dbInfo := range dbs {
-		if dbInfo.IsDir() {
-			dbDir := filepath.Join(getDefaultServerDir(), dbInfo.Name())
-			db := NewDatabase(dbInfo.Name())
+		// Directories of deleted databases still being removed start with a dot, which database names cannot
+		if dbInfo.IsDir() && !strings.HasPrefix(dbInfo.Name(), ".") {
+			dbDir := filepath.Join(s.databasesDir(), dbInfo.Name())
+			db := s.newDatabase(dbInfo.Name())
+			meta, err := readDatabaseMeta(dbDir)
+			if err != nil {
+				return fmt.Errorf("database %s: %v", dbInfo.Name(), err)
+			}
+			db.plaintext = meta.Plaintext
+			if err := db.loadDataKey(dbDir); err != nil {
+				if !db.writesPlaintext() {
+					return err
+				}
+				log.Printf("Database %s is in plaintext mode, its tables are opened without its data key: %v", db.Name, err)
+			}
 			if err := db.LoadTables(dbDir); err != nil {
 				return err
 			}
@@ -71,60 +125,126 @@ func (s *Server) LoadDatabases() error {
 	return nil
 }
 
-// getDefaultServerDir returns the default server directory based on the operating system.
+// getDefaultServerDir returns the default server directory: "databases" inside the data directory
+// when one is configured, otherwise a per-user directory based on the operating system.
 func getDefaultServerDir() string {
-	var baseDir string
-	switch Os := runtime.GOOS; Os {
-	case "windows":
-		baseDir = os.Getenv("APPDATA")
-		if baseDir == "" {
-			baseDir = os.Getenv("USERPROFILE")
-		}
-	case "linux", "darwin":
-		baseDir = os.Getenv("HOME")
-	default:
-		baseDir = "."
+	if root := dataRootDir(); root != "" {
+		return filepath.Join(root, "databases")
 	}
-
-	return filepath.Join(baseDir, "DBPROTO", "databases")
+	return filepath.Join(userBaseDir(), "DBPROTO", "databases")
 }
 
-// getDefaultServerDir returns the default server directory based on the operating system.
+// getDefaultBackUpDir returns the default backup directory: the one set with SetBackupDir or DBPROTO_BACKUP_DIR,
+// the data directory when one is configured, otherwise a per-user directory based on the operating system.
 func getDefaultBackUpDir() string {
-	var baseDir string
-	switch Os := runtime.GOOS; Os {
-	case "windows":
-		baseDir = os.Getenv("APPDATA")
-		if baseDir == "" {
-			baseDir = os.Getenv("USERPROFILE")
-		}
-	case "linux", "darwin":
-		baseDir = os.Getenv("HOME")
-	default:
-		baseDir = "."
+	if dir := configuredDir(&backupDir, "DBPROTO_BACKUP_DIR"); dir != "" {
+		return dir
 	}
-
-	return filepath.Join(baseDir, "DBPROTO_backups")
+	if root := dataRootDir(); root != "" {
+		return root
+	}
+	return filepath.Join(userBaseDir(), "DBPROTO_backups")
 }
 
-// CreateDatabase creates a new database in the server.
+// CreateDatabase creates a new database in the server. It returns an error wrapping ErrInvalidName for the reserved
+// names, and ErrNameTaken if the server has a database with the name already.
 func (s *Server) CreateDatabase(name string) error {
+	if name == CatalogDatabase {
+		return fmt.Errorf("%w: Database name %s is reserved for the system catalog", ErrInvalidName, name)
+	}
+	if name == SystemDatabase {
+		return fmt.Errorf("%w: Database name %s is reserved for the system tables", ErrInvalidName, name)
+	}
+	if err := s.writable(); err != nil {
+		return err
+	}
 	s.Lock()
 	defer s.Unlock()
 	if _, exists := s.Databases[name]; exists {
-		return fmt.Errorf("Database %s already exists", name)
+		return fmt.Errorf("%w: Database %s already exists", ErrNameTaken, name)
 	}
-	s.Databases[name] = NewDatabase(name)
+	s.Databases[name] = s.newDatabase(name)
 	return nil
 }
 
+// newDatabase returns a new database with the settings the server applies to every database. The caller must hold
+// the server lock.
+func (s *Server) newDatabase(name string) *Database {
+	db := NewDatabase(name)
+	db.commitLog = s.commitLog
+	db.throttle = s.throttle
+	db.generators = s.generators
+	db.telemetry = s.telemetry
+	db.plugins = s.plugins
+	db.serverPlaintext = s.plaintext
+	db.tenant = s.tenant
+	db.dir = filepath.Join(s.databasesDir(), name)
+	db.readOnly.Store(s.readOnly.Load())
+	return db
+}
+
+// SetCommitLog makes every database of the server, including databases created or loaded later,
+// ship committed mutations to the given commit log.
+func (s *Server) SetCommitLog(commitLog *CommitLog) {
+	defer s.forEachTenant(func(tenant *Server) { tenant.SetCommitLog(commitLog) })
+	s.Lock()
+	defer s.Unlock()
+
+	s.commitLog = commitLog
+	for _, db := range s.Databases {
+		db.SetCommitLog(commitLog)
+	}
+}
+
+// SetWriteThrottle applies the write throttle to every table of the server, including tables of databases
+// created or loaded later.
+func (s *Server) SetWriteThrottle(throttle WriteThrottle) {
+	defer s.forEachTenant(func(tenant *Server) { tenant.SetWriteThrottle(throttle) })
+	s.Lock()
+	defer s.Unlock()
+
+	s.throttle = throttle
+	for _, db := range s.Databases {
+		db.SetWriteThrottle(throttle)
+	}
+}
+
+// SetGenerators sets the sources of the generated primary keys and timestamps of every table of the server,
+// including tables of databases created or loaded later. Servers of a cluster can use a SnowflakeGenerator with
+// distinct node IDs, or a UUIDv7Generator, so that the keys they generate never collide.
+func (s *Server) SetGenerators(generators Generators) {
+	defer s.forEachTenant(func(tenant *Server) { tenant.SetGenerators(generators) })
+	s.Lock()
+	defer s.Unlock()
+
+	s.generators = generators
+	for _, db := range s.Databases {
+		db.SetGenerators(generators)
+	}
+}
+
+// SetTelemetry makes every table of the server, including tables of databases created or loaded later, sample the
+// shapes of its operations to the given telemetry. Passing nil disables it.
+func (s *Server) SetTelemetry(telemetry *Telemetry) {
+	defer s.forEachTenant(func(tenant *Server) { tenant.SetTelemetry(telemetry) })
+	s.Lock()
+	defer s.Unlock()
+
+	s.telemetry = telemetry
+	for _, db := range s.Databases {
+		db.SetTelemetry(telemetry)
+	}
+}
+
 // ListDatabases returns a list of databases in the server.
 func (s *Server) ListDatabases() []string {
 	s.RLock()
 	defer s.RUnlock()
 	var databases []string
 	for name := range s.Databases {
-		databases = append(databases, name)
+		if name != SystemDatabase {
+			databases = append(databases, name)
+		}
 	}
 	return databases
 }
@@ -133,102 +253,273 @@ func (s *Server) ListDatabases() []string {
 // It returns the path to the backup file and an error if there is one.
 //
 // The method works as follows:
-//  1. It acquires a read lock on the Server struct and defers the unlocking of the lock.
-//  2. It creates a backup directory in the default backup directory. The default backup directory is determined by the getDefaultBackUpDir function.
+//  1. It lists the databases and their tables, holding the read lock of the Server struct only for that, so
+//     writes, and the creation and removal of databases, go on while the backup is written.
+//  2. It creates a backup directory in the default backup directory. The default backup directory is determined by the backupBaseDir method.
 //     If there is an error creating the backup directory, the error is returned.
-//  3. It creates a backup file in the backup directory. The backup file is a zip file named "backup.zip".
-//     If there is an error creating the backup file, the error is returned.
-//  4. It creates a new zip writer for the backup file and defers the closing of the zip writer.
-//  5. It iterates over each database in the Databases field of the Server struct.
-//     For each database, it walks the database directory and adds each file to the zip file.
-//     The database directory is determined by the getDefaultServerDir function and the database name.
-//     If there is an error walking the database directory or adding a file to the zip file, the error is returned.
-//  6. If all databases are successfully backed up, the method returns the path to the backup file and nil.
+//  3. It creates a backup file in the backup directory. The backup file is a zip file named after the time the backup
+//     is taken at, such as "backup-20240501T1200.zip", see CreateBackup. If there is an error creating the backup file, the error is returned.
+//  4. It creates a new zip writer for the backup file.
+//  5. For each table, it adds its metadata and a table file with the records it holds in memory, which never change
+//     once published, so every table is backed up as of a single write. Writers of a table only wait while its
+//     records are encoded. The other files of each database directory are copied as they are.
+//     If there is an error adding a file to the zip file, the partial backup is removed and the error is returned.
+//  6. If all databases are successfully backed up, the older backups are pruned by the retention set with
+//     SetBackupRetention, and the method returns the path to the backup file and nil.
 func (s *Server) BackupDatabases() (string, error) {
-	s.RLock()
-	defer s.RUnlock()
+	result, err := s.createBackup(context.Background(), BackupOptions{}, nil)
+	if err != nil {
+		return "", err
+	}
+	return result.Path, nil
+}
 
-	backupDir := filepath.Join(getDefaultBackUpDir(), "backups")
+// backupDatabases does the work of BackupDatabases, writing the backup with the given name, if any, and reporting the
+// files written to the backup to progress. It never holds the server lock while the archive is written: the records
+// of every table are taken from the version it holds in memory, see Table.backupFiles, and the other files of the
+// database directories, such as data keys, are copied as they are.
+func (s *Server) backupDatabases(ctx context.Context, name string, progress ProgressFunc) (*BackupResult, error) {
+	backupDir := s.backupsDir()
 	if err := os.MkdirAll(backupDir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create backup directory: %v", err)
+		return nil, fmt.Errorf("failed to create backup directory: %v", err)
 	}
+	// Writes committed from here on may or may not be in the backup, RestoreToTime replays them from the commit log
+	started := time.Now().UTC()
 
-	backupPath := filepath.Join(backupDir, "backup.zip")
-	backupFile, err := os.Create(backupPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to create backup file: %v", err)
+	s.RLock()
+	databases := make(map[string]*Database, len(s.Databases))
+	for dbName, db := range s.Databases {
+		databases[dbName] = db
 	}
-	defer func(backupFile *os.File) {
-		err := backupFile.Close()
-		if err != nil {
-			fmt.Printf("failed to close backup file: %v\n", err)
-		}
-	}(backupFile)
+	s.RUnlock()
 
-	zipWriter := zip.NewWriter(backupFile)
-	defer func(zipWriter *zip.Writer) {
-		err := zipWriter.Close()
-		if err != nil {
-			fmt.Printf("failed to close zip writer: %v\n", err)
+	// The files are listed first, so the progress knows how many there are. The files of the tables are left to
+	// their snapshots: a copy of a table file could be torn by a write made while it is read
+	type databaseFile struct {
+		dbName, path string
+		table        *Table
+	}
+	var files []databaseFile
+	for dbName, db := range databases {
+		dbDir := filepath.Join(s.databasesDir(), dbName)
+		snapshotted := make(map[string]bool)
+		db.RLock()
+		for _, table := range db.Tables {
+			if table.virtual || table.temporary {
+				continue
+			}
+			files = append(files, databaseFile{dbName: dbName, path: table.FilePath, table: table})
+			snapshotted[filepath.Base(table.FilePath)] = true
+			snapshotted[strings.TrimSuffix(filepath.Base(table.FilePath), ".dat")+".meta"] = true
+			snapshotted[filepath.Base(segmentDir(table.FilePath))] = true
+			snapshotted[filepath.Base(pendingLogPath(table.FilePath))] = true
 		}
-	}(zipWriter)
+		db.RUnlock()
 
-	for dbName := range s.Databases {
-		dbDir := filepath.Join(getDefaultServerDir(), dbName)
 		err := filepath.Walk(dbDir, func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				// The database was dropped, or a file removed, while it was listed
+				return nil
+			}
 			if err != nil {
 				return err
 			}
-			if !info.Mode().IsRegular() {
+			if path != dbDir && filepath.Dir(path) == dbDir && snapshotted[info.Name()] {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
 				return nil
 			}
-
-			relativePath, err := filepath.Rel(getDefaultServerDir(), path)
-			if err != nil {
-				return err
+			if info.Mode().IsRegular() && filepath.Ext(path) != ".tmp" {
+				files = append(files, databaseFile{dbName: dbName, path: path})
 			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to backup database %s: %v", dbName, err)
+		}
+	}
 
-			zipFile, err := zipWriter.Create(relativePath)
-			if err != nil {
-				return err
-			}
+	// The backup is written to a temporary file, renamed once complete, so it is never listed or restored half written
+	backupFile, backupPath, err := createBackupFile(backupDir, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create backup file: %v", err)
+	}
+	tempPath := backupFile.Name()
+	defer os.Remove(tempPath)
+	defer backupFile.Close()
 
-			file, err := os.Open(path)
-			if err != nil {
-				return err
+	zipWriter := zip.NewWriter(backupFile)
+	manifest := &backupManifest{}
+	result := &BackupResult{Path: backupPath, Name: name}
+	progress.report(0, int64(len(files)))
+	for i, file := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var written int64
+		var added int
+		if file.table != nil {
+			written, added, err = addTableToArchive(ctx, zipWriter, manifest, s.databasesDir(), file.table)
+		} else {
+			written, err = addToArchive(zipWriter, manifest, s.databasesDir(), file.path)
+			if err == nil {
+				added = 1
+			} else if os.IsNotExist(err) {
+				// Removed since it was listed
+				err = nil
 			}
-			defer func(file *os.File) {
-				err := file.Close()
-				if err != nil {
-					fmt.Printf("failed to close file: %v\n", err)
-				}
-			}(file)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to backup database %s: %v", file.dbName, err)
+		}
+		result.Files += added
+		result.Bytes += written
+		progress.report(int64(i+1), int64(len(files)))
+	}
 
-			_, err = io.Copy(zipFile, file)
-			if err != nil {
-				return err
-			}
-			return nil
-		})
+	if err := manifest.write(zipWriter); err != nil {
+		return nil, fmt.Errorf("failed to write backup file: %v", err)
+	}
+	if err := zipWriter.SetComment(backupComment(started, time.Now().UTC())); err != nil {
+		return nil, fmt.Errorf("failed to write backup file: %v", err)
+	}
+	if err := zipWriter.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write backup file: %v", err)
+	}
+	if err := backupFile.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write backup file: %v", err)
+	}
+	if err := os.Rename(tempPath, backupPath); err != nil {
+		return nil, fmt.Errorf("failed to write backup file: %v", err)
+	}
+	return result, nil
+}
 
+// addTableToArchive adds the metadata file and the records of the table, as a table file holding every record, to
+// the backup archive of the server directory dir and to its manifest, and returns their size and number. A table
+// dropped since it was listed adds nothing.
+func addTableToArchive(ctx context.Context, zipWriter *zip.Writer, manifest *backupManifest, dir string, table *Table) (int64, int, error) {
+	meta, records, err := table.backupFiles(ctx)
+	if err != nil || records == nil {
+		return 0, 0, err
+	}
+	relativePath, err := filepath.Rel(dir, table.FilePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	var written int64
+	added := 0
+	for _, file := range []struct {
+		path    string
+		content []byte
+	}{
+		{strings.TrimSuffix(relativePath, ".dat") + ".meta", meta},
+		{relativePath, records},
+	} {
+		if file.content == nil {
+			continue
+		}
+		n, err := manifest.add(zipWriter, archivePath(file.path), bytes.NewReader(file.content))
 		if err != nil {
-			return "", fmt.Errorf("failed to backup database %s: %v", dbName, err)
+			return 0, 0, err
 		}
+		written += n
+		added++
 	}
+	return written, added, nil
+}
 
-	return backupPath, nil
+// createBackupFile creates the temporary file a backup with the given name is written to in dir, and returns it with
+// the path the backup is renamed to once written, whose counter is above those of the backups of the current minute,
+// so it sorts after them even if some were deleted.
+func createBackupFile(dir, name string) (*os.File, string, error) {
+	now := time.Now()
+	minute := now.UTC().Truncate(time.Minute)
+	first := 1
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, entry := range entries {
+		backup, ok := parseBackupFileName(strings.TrimSuffix(entry.Name(), ".tmp"))
+		if ok && backup.Created.Equal(minute) && backup.seq >= first {
+			first = backup.seq + 1
+		}
+	}
+	for n := first; ; n++ {
+		path := filepath.Join(dir, backupFileName(now, name, n))
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		file, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		return file, path, err
+	}
+}
+
+// addToArchive adds the file of the server directory dir at path to the backup archive and to its manifest, and
+// returns its size.
+func addToArchive(zipWriter *zip.Writer, manifest *backupManifest, dir, path string) (int64, error) {
+	relativePath, err := filepath.Rel(dir, path)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func(file *os.File) {
+		err := file.Close()
+		if err != nil {
+			fmt.Printf("failed to close file: %v\n", err)
+		}
+	}(file)
+
+	return manifest.add(zipWriter, archivePath(relativePath), file)
+}
+
+// RunBackups backs up the databases, and those of every tenant to the backup directory of the tenant, with
+// BackupDatabases every interval until ctx is done, logging the result of every run. It returns ctx.Err(), or
+// ErrClosed once the server is closed.
+func (s *Server) RunBackups(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.stopped:
+			return ErrClosed
+		case <-ticker.C:
+			for _, server := range append([]*Server{s}, s.tenantServers()...) {
+				backupPath, err := server.BackupDatabases()
+				if err != nil {
+					log.Printf("Failed to back up databases%s: %v", server.tenantSuffix(), err)
+					continue
+				}
+				log.Printf("Databases%s backed up to %s", server.tenantSuffix(), backupPath)
+			}
+		}
+	}
 }
 
 // RestoreDatabases is a method of the Server struct that restores databases from the latest backup file.
 // It acquires a lock on the Server struct and defers the unlocking of the lock.
-// It opens the latest backup file in the default backup directory. The default backup directory is determined by the getDefaultBackUpDir if
+// It opens the latest backup file in the default backup directory. The default backup directory is determined by the backupBaseDir method if
 // the backup Path is empty, if there's not, the route will be checked.
 // If there is an error opening the backup file, the error is returned.
 // It gets the file stat of the backup file. If there is an error getting the file stat, the error is returned.
 // It creates a new zip reader for the backup file. If there is an error creating the zip reader, the error is returned.
+// Before writing anything, it reads every file of the zip file and checks it against the manifest of the backup, and
+// checks that its path stays inside the server directory. If a file is damaged, missing or altered, an error wrapping
+// ErrBackupCorrupt is returned, and an invalid path error for a path that escapes the directory.
 // It iterates over each file in the zip file.
 // For each file, it creates the file path by joining the default server directory and the file name.
-// The default server directory is determined by the getDefaultServerDir function.
+// The default server directory is determined by the databasesDir method.
 // If the file is a directory, it creates the directory with read, write, and execute permissions for the user only.
 // If the file is a regular file, it creates the file with the same permissions as in the zip file.
 // It opens the file for writing. If there is an error opening the file, the error is returned.
@@ -238,20 +529,30 @@ func (s *Server) BackupDatabases() (string, error) {
 // After all files are successfully restored, it loads the databases using the LoadDatabases method of the Server struct.
 // If there is an error loading the databases, the error is returned.
 // If all databases are successfully loaded, the method returns nil.
+//
+// RestoreDatabases overwrites live files without asking; use PreviewRestore and Restore to review the changes first.
 func (s *Server) RestoreDatabases(backupPath ...string) error {
+	if err := s.writable(); err != nil {
+		return err
+	}
 	s.Lock()
 	defer s.Unlock()
 
-	var path string
+	path := ""
 	if len(backupPath) > 0 {
 		path = backupPath[0]
-	} else {
-		path = filepath.Join(getDefaultBackUpDir(), "backups", "backup.zip")
 	}
+	_, err := s.restoreDatabases(s.resolveBackupPath(path), nil)
+	return err
+}
 
+// restoreDatabases checks the backup at path, extracts it into the server directory, reporting the files extracted
+// to progress, and reloads the databases. It reports whether the backup had a manifest its files were checked
+// against. The caller must hold the server write lock.
+func (s *Server) restoreDatabases(path string, progress ProgressFunc) (bool, error) {
 	backupFile, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("failed to open backup file: %v", err)
+		return false, fmt.Errorf("failed to open backup file: %v", err)
 	}
 	defer func(backupFile *os.File) {
 		err := backupFile.Close()
@@ -262,16 +563,62 @@ func (s *Server) RestoreDatabases(backupPath ...string) error {
 
 	stat, err := backupFile.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to get backup file stat: %v", err)
+		return false, fmt.Errorf("failed to get backup file stat: %v", err)
 	}
 
 	zipReader, err := zip.NewReader(backupFile, stat.Size())
 	if err != nil {
-		return fmt.Errorf("failed to create zip reader: %v", err)
+		return false, fmt.Errorf("failed to create zip reader: %v", err)
+	}
+
+	// Nothing is changed unless the whole archive is intact and every file stays inside the server directory
+	verified, err := checkArchive(zipReader, s.databasesDir())
+	if err != nil {
+		return false, err
 	}
+	// Every table is loaded from its file again afterwards, including the ones the backup does not hold
+	if err := s.flushPendingWrites(); err != nil {
+		return false, err
+	}
+	if err := removeRestoredSegments(zipReader, s.databasesDir()); err != nil {
+		return false, err
+	}
+	if err := extractArchive(zipReader, s.databasesDir(), progress); err != nil {
+		return false, err
+	}
+	return verified, s.LoadDatabases()
+}
 
+// removeRestoredSegments removes the segments of the tables whose files the backup archive replaces in dir, which
+// would otherwise be applied to the restored files. The archive brings the segments the tables had at the backup.
+func removeRestoredSegments(zipReader *zip.Reader, dir string) error {
 	for _, file := range zipReader.File {
-		filePath := filepath.Join(getDefaultServerDir(), file.Name)
+		name := strings.ReplaceAll(file.Name, `\`, "/")
+		if filepath.Ext(name) != ".dat" {
+			continue
+		}
+		if database, table := splitTablePath(name); ValidFilename(database) && ValidFilename(table) {
+			if err := os.RemoveAll(filepath.Join(dir, database, table+segmentsSuffix)); err != nil {
+				return fmt.Errorf("failed to remove the segments of table %s: %v", table, err)
+			}
+		}
+	}
+	return nil
+}
+
+// extractArchive writes every file of the backup archive into dir, overwriting the files already there, and reports
+// the files written to progress.
+func extractArchive(zipReader *zip.Reader, dir string, progress ProgressFunc) error {
+	total := int64(len(zipReader.File))
+	for i, file := range zipReader.File {
+		progress.report(int64(i), total)
+		if isManifest(file.Name) {
+			continue
+		}
+		filePath, err := restorePath(dir, file.Name)
+		if err != nil {
+			return err
+		}
 
 		if file.FileInfo().IsDir() {
 			err := os.MkdirAll(filePath, 0755)
@@ -281,7 +628,7 @@ func (s *Server) RestoreDatabases(backupPath ...string) error {
 			continue
 		}
 
-		err := os.MkdirAll(filepath.Dir(filePath), 0755)
+		err = os.MkdirAll(filepath.Dir(filePath), 0755)
 		if err != nil {
 			return err
 		}
@@ -311,7 +658,8 @@ func (s *Server) RestoreDatabases(backupPath ...string) error {
 		}
 	}
 
-	return s.LoadDatabases()
+	progress.report(total, total)
+	return nil
 }
 
 // ServeHTTP implements the http.Handler interface for the server.
@@ -364,3 +712,181 @@ func (s *Server) GetMetrics() map[string]string {
 	}
 	return metrics
 }
+
+// MetricsSnapshots returns a consistent snapshot of the metrics of every table, keyed like GetMetrics. With delta set,
+// each snapshot holds the counts since the previous delta snapshot of the table rather than since it was opened or
+// its metrics reset, see Metrics.Delta.
+func (s *Server) MetricsSnapshots(delta bool) map[string]MetricsSnapshot {
+	s.RLock()
+	defer s.RUnlock()
+
+	snapshots := make(map[string]MetricsSnapshot)
+	for dbName, db := range s.Databases {
+		db.RLock()
+		for tableName, table := range db.Tables {
+			if delta {
+				snapshots[dbName+"_"+tableName] = table.metrics.Delta()
+			} else {
+				snapshots[dbName+"_"+tableName] = table.metrics.Snapshot()
+			}
+		}
+		db.RUnlock()
+	}
+	return snapshots
+}
+
+// TableMetrics are the metrics of a table of the server, as returned by Server.TableMetrics.
+type TableMetrics struct {
+	Database      string          // The name of the database of the table.
+	Table         string          // The name of the table.
+	Records       int             // The number of records, also known while the table is evicted by the cache policy.
+	Resident      bool            // Whether the records are in memory.
+	CachedRecords int             // The number of records in the lookup cache.
+	FileSize      int64           // The size in bytes of the data file and its segments, 0 for tables only held in memory.
+	Unflushed     int             // The number of writes not yet in the data file, in write-behind mode.
+	LegacyReads   int             // The number of times data of the table in the legacy CTR format was read.
+	Segments      int             // The number of segment files next to the data file, in segmented mode.
+	Indexes       IndexUsage      // The number of indexes, how many the index budget spilled to disk and the memory of the others.
+	Metrics       MetricsSnapshot // The counters accumulated since the table was opened or its metrics reset.
+}
+
+// TableMetrics returns the metrics of every table of the server, sorted by database and table. Unlike
+// MetricsSnapshots it also counts the records of each table, without reading evicted tables back into memory, and
+// the size of its file, and does not start a new delta interval, so it can be polled by any number of scrapers.
+func (s *Server) TableMetrics() []TableMetrics {
+	s.RLock()
+	var metrics []TableMetrics
+	var files []string
+	for dbName, db := range s.Databases {
+		if dbName == SystemDatabase {
+			continue
+		}
+		db.RLock()
+		for tableName, table := range db.Tables {
+			caching := table.CacheState()
+			metrics = append(metrics, TableMetrics{
+				Database:      dbName,
+				Table:         tableName,
+				Records:       int(table.recordCount.Load()),
+				Resident:      caching.Resident,
+				CachedRecords: caching.CachedRecords,
+				Unflushed:     table.UnflushedWrites(),
+				LegacyReads:   table.LegacyCiphertextReads(),
+				Segments:      table.Segments(),
+				Indexes:       table.IndexUsage(),
+				Metrics:       table.metrics.Snapshot(),
+			})
+			file := ""
+			if !table.virtual && !table.temporary {
+				file = table.FilePath
+			}
+			files = append(files, file)
+		}
+		db.RUnlock()
+	}
+	s.RUnlock()
+
+	// The files are read once the locks are released, so slow storage does not hold up the writes.
+	for i, file := range files {
+		if file == "" {
+			continue
+		}
+		if size, err := filesSize(file); err == nil {
+			metrics[i].FileSize = size
+		}
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].Database != metrics[j].Database {
+			return metrics[i].Database < metrics[j].Database
+		}
+		return metrics[i].Table < metrics[j].Table
+	})
+	return metrics
+}
+
+// ResetMetrics sets the metrics of every table back to zero, see Metrics.Reset.
+func (s *Server) ResetMetrics() {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, db := range s.Databases {
+		db.RLock()
+		for _, table := range db.Tables {
+			table.metrics.Reset()
+		}
+		db.RUnlock()
+	}
+}
+
+// Flush waits for the writes in progress on every table of the server and of its tenants, writes the changes left
+// pending by write-behind and flushes the table files to stable storage. Servers shutting down call it once they stop accepting requests, so the writes acknowledged to clients
+// survive a crash or power loss of the host right after. Every table is flushed even if some fail.
+//
+// Returns:
+// - An error joining the errors of the tables that failed to flush, or nil if every table was flushed.
+func (s *Server) Flush() error {
+	var errs []error
+	for _, tenant := range s.tenantServers() {
+		if err := tenant.Flush(); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %s: %w", tenant.tenant, err))
+		}
+	}
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, db := range s.Databases {
+		db.RLock()
+		if err := db.syncTables(); err != nil {
+			errs = append(errs, err)
+		}
+		db.RUnlock()
+	}
+	return errors.Join(errs...)
+}
+
+// IndexRecommendations returns the index recommendations of every table that has any, keyed like GetMetrics. Since
+// that key is ambiguous when names contain underscores, each recommendation also names its database and table.
+func (s *Server) IndexRecommendations() map[string][]IndexRecommendation {
+	s.RLock()
+	defer s.RUnlock()
+
+	recommendations := make(map[string][]IndexRecommendation)
+	for dbName, db := range s.Databases {
+		db.RLock()
+		for tableName, table := range db.Tables {
+			if tableRecommendations := table.IndexRecommendations(); len(tableRecommendations) > 0 {
+				for i := range tableRecommendations {
+					tableRecommendations[i].Database, tableRecommendations[i].Table = dbName, tableName
+				}
+				recommendations[dbName+"_"+tableName] = tableRecommendations
+			}
+		}
+		db.RUnlock()
+	}
+	return recommendations
+}
+
+// CorruptRecords checks the record checksums of every table and returns the primary keys of the corrupted
+// records, keyed like GetMetrics. Tables without corrupted records are omitted.
+// It returns an error if a table file cannot be read at all.
+func (s *Server) CorruptRecords() (map[string][]string, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	corrupted := make(map[string][]string)
+	for dbName, db := range s.Databases {
+		db.RLock()
+		for tableName, table := range db.Tables {
+			keys, err := table.CorruptRecords()
+			if err != nil {
+				db.RUnlock()
+				return nil, fmt.Errorf("failed to verify table %s in database %s: %v", tableName, dbName, err)
+			}
+			if len(keys) > 0 {
+				corrupted[dbName+"_"+tableName] = keys
+			}
+		}
+		db.RUnlock()
+	}
+	return corrupted, nil
+}
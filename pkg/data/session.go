@@ -0,0 +1,190 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// ErrSessionClosed is returned when a temporary table is created in a session that has been closed.
+var ErrSessionClosed = errors.New("session has been closed")
+
+// ErrTempTableDropped is returned by writes to a temporary table that has been dropped, explicitly or by closing
+// its session.
+var ErrTempTableDropped = errors.New("temporary table has been dropped")
+
+// sessionIDs numbers the sessions, so that the tables of different sessions never share a name.
+var sessionIDs atomic.Int64
+
+// Session stages the intermediate results of a multi-step operation on a database in temporary tables. Temporary
+// tables only live in memory and only the session sees them: they are never written to disk, listed, backed up
+// or shipped to the commit log. They are dropped when the session is closed:
+//
+//	session := db.NewSession()
+//	defer session.Close()
+//	staged, err := session.CreateTempTable("active_users", "id")
+//	...
+//	results, err := data.JoinTables(staged, orders, "id", "user_id", data.InnerJoin)
+//
+// Statements, queries and transactions run through the session see its temporary tables as well as the tables of
+// the database; a temporary table hides a table of the database with the same name.
+type Session struct {
+	sync.Mutex                   // Mutex to ensure the session is thread safe
+	db         *Database         // Database the session works on
+	id         int64             // Number of the session, which the paths of its tables include
+	tables     map[string]*Table // Temporary tables of the session
+	closed     bool              // Whether the session has been closed
+}
+
+// NewSession starts a session on the database. The caller must Close it to drop its temporary tables.
+func (db *Database) NewSession() *Session {
+	return &Session{
+		db:     db,
+		id:     sessionIDs.Add(1),
+		tables: make(map[string]*Table),
+	}
+}
+
+// CreateTempTable creates a temporary table in the session with the default options.
+func (s *Session) CreateTempTable(tableName, primaryKey string) (*Table, error) {
+	return s.CreateTempTableWithOptions(tableName, primaryKey, TableOptions{})
+}
+
+// CreateTempTableWithOptions is a method of the Session struct that creates a temporary table holding its records
+// in memory until the session is closed. The table is used like any other table: records are written with its
+// methods, or through transactions of the session, and it can be queried and joined with the tables of the database.
+// The table uses the generators of the database, so AutoID and generated timestamps work as in regular tables.
+//
+// Parameters:
+// - tableName: The name of the table. It must not be the name of another temporary table of the session.
+// - primaryKey: The field name to be used as the primary key of the table.
+// - options: The optional settings of the table. Options about storage, such as the pipeline, have no effect.
+//
+// Returns:
+// - A pointer to the new Table.
+// - An error, if the names or options are invalid, the name is taken or the session is closed. If the operation is
+// successful, the error is nil.
+func (s *Session) CreateTempTableWithOptions(tableName, primaryKey string, options TableOptions) (*Table, error) {
+	if !ValidFilename(tableName) {
+		return nil, fmt.Errorf("invalid table name: %s", tableName)
+	}
+	if !ValidFilename(primaryKey) {
+		return nil, fmt.Errorf("invalid primary key: %s", primaryKey)
+	}
+	if err := validateSchema(options); err != nil {
+		return nil, err
+	}
+	// Temporary tables are held in memory anyway, and InMemory would give them a metadata file
+	options.InMemory = false
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil, ErrSessionClosed
+	}
+	if _, exists := s.tables[tableName]; exists {
+		return nil, fmt.Errorf("temporary table %s already exists", tableName)
+	}
+
+	s.db.RLock()
+	generators := s.db.generators
+	s.db.RUnlock()
+	table := &Table{
+		// The path is never opened; it names the table in errors and orders the locks taken by transactions
+		FilePath:   fmt.Sprintf("temporary/%s/%d/%s", s.db.Name, s.id, tableName),
+		PrimaryKey: primaryKey,
+		Records:    make(map[string]*dbdata.Record),
+		Indexes:    make(map[string][]*dbdata.Record),
+		metrics:    NewMetrics(),
+		Options:    options,
+		temporary:  true,
+		generators: generators,
+	}
+	table.Cache = NewRecordCache(table.cacheSize())
+	table.publish(table.Records)
+	s.tables[tableName] = table
+	return table, nil
+}
+
+// TempTable returns the temporary table of the session with the given name, and false if there is none.
+func (s *Session) TempTable(tableName string) (*Table, bool) {
+	s.Lock()
+	defer s.Unlock()
+	table, exists := s.tables[tableName]
+	return table, exists
+}
+
+// DropTempTable drops the temporary table with the given name before the session is closed. Its records are
+// released and later writes to it fail with ErrTempTableDropped.
+func (s *Session) DropTempTable(tableName string) error {
+	s.Lock()
+	table, exists := s.tables[tableName]
+	delete(s.tables, tableName)
+	s.Unlock()
+	if !exists {
+		return fmt.Errorf("temporary table %s not found", tableName)
+	}
+	table.drop()
+	return nil
+}
+
+// Close drops every temporary table of the session. Closing a session twice does nothing.
+func (s *Session) Close() error {
+	s.Lock()
+	tables := s.tables
+	s.tables = make(map[string]*Table)
+	s.closed = true
+	s.Unlock()
+	for _, table := range tables {
+		table.drop()
+	}
+	return nil
+}
+
+// drop empties a temporary table and makes later writes to it fail.
+func (t *Table) drop() {
+	t.Lock()
+	defer t.Unlock()
+	t.dropped = true
+	t.Cache.Clear()
+	t.publish(make(map[string]*dbdata.Record))
+	t.previous = nil
+}
+
+// lookupTable returns the temporary table with the given name or, if there is none, the table of the database.
+func (s *Session) lookupTable(name string) (*Table, error) {
+	if table, exists := s.TempTable(name); exists {
+		return table, nil
+	}
+	return s.db.lookupTable(name)
+}
+
+// Table returns a QueryBuilder for the temporary table or the table of the database with the given name.
+func (s *Session) Table(name string) *QueryBuilder {
+	table, err := s.lookupTable(name)
+	if err != nil {
+		return &QueryBuilder{err: err}
+	}
+	return table.NewQuery()
+}
+
+// Exec runs a statement of the query language like Database.Exec, against the temporary tables of the session and
+// the tables of the database.
+func (s *Session) Exec(statement string) (*Result, error) {
+	return s.ExecCtx(context.Background(), statement)
+}
+
+// ExecCtx runs a statement like Database.ExecCtx, against the temporary tables of the session and the tables of the
+// database.
+func (s *Session) ExecCtx(ctx context.Context, statement string) (*Result, error) {
+	return execStatement(ctx, statement, s.lookupTable)
+}
+
+// BeginTx starts a transaction spanning the temporary tables of the session and the tables of the database, which
+// writes name like Database.BeginTx. Writes to temporary tables are applied by Commit with the others.
+func (s *Session) BeginTx() *MultiTx {
+	return &MultiTx{resolve: s.lookupTable}
+}
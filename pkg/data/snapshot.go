@@ -0,0 +1,126 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// snapshot is an immutable version of the records of a table and of their indexes.
+// Writers never change a published snapshot: they copy its records, apply their changes and publish a new snapshot
+// once the file is written, so readers can use the snapshot they loaded without locking.
+type snapshot struct {
+	records map[string]*dbdata.Record  // Map of primary key values to the records of this version
+	indexes map[string]*indexPartition // Map of field names to the index of the records of this version that have that field
+}
+
+// index returns the records of the snapshot that have the field, paging its index back in if the index budget
+// spilled it to disk, or nil if no record has the field.
+func (s *snapshot) index(field string) []*dbdata.Record {
+	partition, exists := s.indexes[field]
+	if !exists {
+		return nil
+	}
+	return partition.load(s.records)
+}
+
+// indexSize returns the number of records of the snapshot that have the field and whether it is indexed, without
+// paging the index in.
+func (s *snapshot) indexSize(field string) (int, bool) {
+	partition, exists := s.indexes[field]
+	if !exists {
+		return 0, false
+	}
+	return partition.count, true
+}
+
+// publish makes the records the current version of the table: it updates the indexes of the fields of the records
+// that were replaced, see updateIndexes, sets Records and Indexes, and atomically swaps in a new snapshot for readers. The replaced version is kept as the previous one, which
+// change events take their before-images from. The caller must hold the table write lock, or own the table before
+// it is shared, and must not change the records afterwards.
+func (t *Table) publish(records map[string]*dbdata.Record) {
+	indexes := t.updateIndexes(records)
+	t.Records = records
+	t.previous = t.current.Swap(&snapshot{records: records, indexes: indexes})
+	t.recordCount.Store(int64(len(records)))
+}
+
+// loadSnapshot counts an access to the table and returns its current version. It never blocks, even while a writer
+// holds the table write lock, unless the cache policy evicted the table: then it reloads the records from the file
+// first. The returned snapshot stays consistent while later writes are published. The caller must not hold the
+// table lock.
+func (t *Table) loadSnapshot() (*snapshot, error) {
+	t.touch()
+	return t.resident()
+}
+
+// recordsForWrite returns a copy of the map of the current records of the table for a writer to change and publish,
+// reloading them first if the cache policy evicted the table. The records themselves are shared with the published
+// snapshot, so writers must replace the records they change with copies rather than change them. The records are served from memory, so writes never read the
+// file: it is only read when the table is opened, reloaded after an eviction, or by Reload. It returns ctx.Err() if
+// ctx is done. The caller must hold the table write lock.
+func (t *Table) recordsForWrite(ctx context.Context) (*dbdata.Records, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	// Published records are never changed, so the writer gets its own map, in which writes replace the records they
+	// change with changed copies
+	records := &dbdata.Records{Records: maps.Clone(t.Records)}
+	if records.Records == nil {
+		records.Records = make(map[string]*dbdata.Record)
+	}
+	return records, nil
+}
+
+// backupFiles returns the content of the metadata file of the table and of a table file holding the version of its
+// records in memory, which includes the changes write-behind has not written yet, for a backup. The table file is
+// never copied, since a write could change it while it is read. The published snapshot and the settings its file is
+// encoded with are taken under the read lock, which is released before the records are encoded: published records
+// never change, so they are encoded without copying them, and neither writers nor readers of the table wait for it.
+// A table evicted by the cache policy is loaded first. It returns no content for a table that has been dropped.
+func (t *Table) backupFiles(ctx context.Context) (meta, records []byte, err error) {
+	for {
+		if _, err := t.resident(); err != nil {
+			return nil, nil, err
+		}
+		t.RLock()
+		if t.current.Load() != nil {
+			break
+		}
+		// Evicted again before the lock was taken
+		t.RUnlock()
+	}
+	if t.dropped {
+		t.RUnlock()
+		return nil, nil, nil
+	}
+	meta, err = os.ReadFile(strings.TrimSuffix(t.FilePath, ".dat") + ".meta")
+	if err != nil && !os.IsNotExist(err) {
+		t.RUnlock()
+		return nil, nil, fmt.Errorf("failed to read metadata of table %s: %v", t.FilePath, err)
+	}
+	snap, encoder := t.current.Load(), t.encoder()
+	t.RUnlock()
+
+	records, err = encoder.encodeRecords(ctx, &dbdata.Records{Records: snap.records, FormatVersion: RecordsFormatVersion})
+	if err != nil {
+		return nil, nil, err
+	}
+	return meta, records, nil
+}
+
+// encoder returns a detached table holding the settings encodeRecords uses, its options and storage pipeline, so
+// that records can be encoded after the lock is released while SetCompression or a key rotation changes them. The
+// caller must hold the table lock.
+func (t *Table) encoder() *Table {
+	encoder := &Table{FilePath: t.FilePath, Options: t.Options, utils: t.utils, storage: t.storage}
+	encoder.plaintext.Store(t.plaintext.Load())
+	return encoder
+}
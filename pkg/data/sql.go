@@ -0,0 +1,146 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// Result is the outcome of a statement run by Database.Exec.
+type Result struct {
+	Columns  []string // Columns lists the fields of the returned records for SELECT, the primary key first for SELECT *.
+	Records  []Record // Records holds the records returned by SELECT.
+	Affected int      // Affected is the number of records inserted, updated or deleted.
+}
+
+// Exec runs a statement of the query language, see ParseStatement, against the tables of the database.
+// It is equivalent to ExecCtx with a background context.
+func (db *Database) Exec(statement string) (*Result, error) {
+	return db.ExecCtx(context.Background(), statement)
+}
+
+// ExecCtx is a method of the Database struct that parses and runs a statement of the query language.
+// SELECT runs as a query, so equality conditions can use an index. INSERT inserts all its records in one transaction,
+// and UPDATE and DELETE change every matching record while holding the table write lock, so each statement is atomic.
+//
+// Parameters:
+// - ctx: A context.Context that stops the statement with ctx.Err() once it is done.
+// - statement: The statement to run.
+//
+// Returns:
+// - A pointer to a Result holding the selected records or the number of changed records.
+// - An error if the statement is invalid, names an unknown table, or fails. A failed statement changes nothing.
+func (db *Database) ExecCtx(ctx context.Context, statement string) (*Result, error) {
+	return execStatement(ctx, statement, db.lookupTable)
+}
+
+// execStatement parses and runs a statement against the table resolve finds for it.
+func execStatement(ctx context.Context, statement string, resolve func(name string) (*Table, error)) (*Result, error) {
+	stmt, err := ParseStatement(statement)
+	if err != nil {
+		return nil, err
+	}
+	table, err := resolve(stmt.Table)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateConditions(stmt.Conditions); err != nil {
+		return nil, err
+	}
+	matches := func(record *dbdata.Record) bool {
+		return matchConditions(record, stmt.Conditions)
+	}
+
+	switch stmt.Kind {
+	case StatementSelect:
+		return table.execSelect(ctx, stmt)
+	case StatementInsert:
+		tx := table.Begin()
+		for _, record := range stmt.Values {
+			if err := tx.Insert(record); err != nil {
+				return nil, err
+			}
+		}
+		if err := tx.CommitCtx(ctx); err != nil {
+			return nil, err
+		}
+		return &Result{Affected: len(stmt.Values)}, nil
+	case StatementUpdate:
+		defer table.sample("update_where", "", time.Now())
+		unlock, err := table.lockWrite(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+		affected, err := table.updateMatching(ctx, matches, stmt.Updates)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{Affected: affected}, nil
+	case StatementDelete:
+		defer table.sample("delete_where", "", time.Now())
+		unlock, err := table.lockWrite(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+		affected, err := table.deleteMatching(ctx, matches)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{Affected: affected}, nil
+	default:
+		return nil, fmt.Errorf("unsupported statement %s", stmt.Kind)
+	}
+}
+
+// execSelect runs a SELECT statement on the table and keeps the selected fields of the matching records.
+func (t *Table) execSelect(ctx context.Context, stmt *Statement) (*Result, error) {
+	builder := t.NewQuery().WithContext(ctx)
+	for _, condition := range stmt.Conditions {
+		builder.Where(condition.Field, condition.Operator, condition.Value)
+	}
+	if stmt.OrderBy != "" {
+		builder.OrderBy(stmt.OrderBy)
+	}
+	builder.Limit(stmt.Limit).Offset(stmt.Offset)
+
+	records, err := builder.Records()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(stmt.Fields) == 0 {
+		return &Result{Columns: t.columns(records), Records: records}, nil
+	}
+	// Selected fields that a record does not have stay missing rather than becoming NULL
+	projected := make([]Record, len(records))
+	for i, record := range records {
+		projected[i] = make(Record, len(stmt.Fields))
+		for _, field := range stmt.Fields {
+			if value, exists := recordPath(record, field); exists {
+				projected[i][field] = value
+			}
+		}
+	}
+	return &Result{Columns: stmt.Fields, Records: projected}, nil
+}
+
+// columns returns every field of the records, the primary key first and the others sorted by name.
+func (t *Table) columns(records []Record) []string {
+	seen := make(map[string]bool)
+	var others []string
+	for _, record := range records {
+		for field := range record {
+			if field != t.PrimaryKey && !seen[field] {
+				seen[field] = true
+				others = append(others, field)
+			}
+		}
+	}
+	sort.Strings(others)
+	return append([]string{t.PrimaryKey}, others...)
+}
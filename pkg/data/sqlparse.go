@@ -0,0 +1,551 @@
+package data
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// tokenKind identifies the kind of a token of a statement.
+type tokenKind int
+
+const (
+	tokenEnd    tokenKind = iota // End of the statement
+	tokenIdent                   // Identifier or keyword
+	tokenString                  // Quoted string literal
+	tokenNumber                  // Number literal
+	tokenSymbol                  // Punctuation or comparison operator
+)
+
+// token is a lexical unit of a statement.
+type token struct {
+	kind tokenKind
+	text string // Text of the token; string literals are unquoted
+	pos  int    // Byte offset of the token in the statement
+}
+
+// tokenize splits a statement into tokens. Keywords are returned as identifiers and matched case insensitively
+// by the parser.
+func tokenize(statement string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(statement); {
+		c := rune(statement[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '\'' || c == '"':
+			// Strings are single quoted and identifiers may be double quoted; a doubled quote escapes itself
+			var text strings.Builder
+			start := i
+			i++
+			for {
+				if i >= len(statement) {
+					return nil, fmt.Errorf("unterminated quote at position %d", start)
+				}
+				if rune(statement[i]) == c {
+					if i+1 < len(statement) && rune(statement[i+1]) == c {
+						text.WriteByte(statement[i])
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				text.WriteByte(statement[i])
+				i++
+			}
+			kind := tokenString
+			if c == '"' {
+				kind = tokenIdent
+			}
+			tokens = append(tokens, token{kind: kind, text: text.String(), pos: start})
+		case unicode.IsDigit(c) || (c == '-' && i+1 < len(statement) && unicode.IsDigit(rune(statement[i+1]))):
+			start := i
+			i++
+			for i < len(statement) && (unicode.IsDigit(rune(statement[i])) || statement[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: statement[start:i], pos: start})
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(statement) && isIdentRune(rune(statement[i])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: statement[start:i], pos: start})
+		default:
+			start := i
+			if i+1 < len(statement) {
+				switch statement[i : i+2] {
+				case "!=", "<>", "<=", ">=":
+					tokens = append(tokens, token{kind: tokenSymbol, text: statement[i : i+2], pos: start})
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("(),*;=<>+-/%", c) {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+			tokens = append(tokens, token{kind: tokenSymbol, text: string(c), pos: start})
+			i++
+		}
+	}
+	return append(tokens, token{kind: tokenEnd, pos: len(statement)}), nil
+}
+
+// isIdentRune reports whether the rune can appear in an unquoted identifier. Hyphens are allowed because table
+// and field names may contain them, and dots so that values nested in objects can be named by their path, such as
+// address.city.
+func isIdentRune(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '-' || c == '.'
+}
+
+// Statement kinds returned by ParseStatement.
+const (
+	StatementSelect = "SELECT"
+	StatementInsert = "INSERT"
+	StatementUpdate = "UPDATE"
+	StatementDelete = "DELETE"
+)
+
+// Statement is a parsed statement of the query language accepted by Database.Exec.
+type Statement struct {
+	Kind       string      // Kind is one of StatementSelect, StatementInsert, StatementUpdate and StatementDelete.
+	Table      string      // Table is the name of the table the statement reads or writes.
+	Fields     []string    // Fields lists the selected fields, empty for *, or the inserted fields.
+	Values     []Record    // Values holds the inserted records.
+	Updates    Record      // Updates holds the fields set by UPDATE.
+	Conditions []Condition // Conditions holds the WHERE clause; every condition must hold.
+	OrderBy    string      // OrderBy is the field SELECT sorts by.
+	Limit      int         // Limit is the maximum number of records SELECT returns, 0 for no limit.
+	Offset     int         // Offset is the number of records SELECT skips.
+}
+
+// ParseStatement parses a single statement of the query language:
+//
+//	SELECT * | field, ... FROM table [WHERE condition [AND condition]...] [ORDER BY field] [LIMIT n] [OFFSET n]
+//	INSERT INTO table (field, ...) VALUES (value, ...) [, (value, ...)]...
+//	UPDATE table SET field = value [, field = value]... [WHERE ...]
+//	DELETE FROM table [WHERE ...]
+//
+// A condition is field op value, with op one of =, !=, <>, <, <=, > and >=, or field IS [NOT] NULL or field IS MISSING.
+// Values are 'strings', numbers, TRUE, FALSE and NULL. Keywords are case insensitive, identifiers may be double
+// quoted, and a trailing semicolon is optional.
+func ParseStatement(statement string) (*Statement, error) {
+	tokens, err := tokenize(statement)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+
+	var stmt *Statement
+	switch {
+	case p.keyword("SELECT"):
+		stmt, err = p.parseSelect()
+	case p.keyword("INSERT"):
+		stmt, err = p.parseInsert()
+	case p.keyword("UPDATE"):
+		stmt, err = p.parseUpdate()
+	case p.keyword("DELETE"):
+		stmt, err = p.parseDelete()
+	default:
+		return nil, p.errorf("expected SELECT, INSERT, UPDATE or DELETE")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	p.symbol(";")
+	if p.peek().kind != tokenEnd {
+		return nil, p.errorf("unexpected %s", p.describe())
+	}
+	return stmt, nil
+}
+
+// parser consumes the tokens of a statement.
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// peek returns the next token without consuming it.
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+// keyword consumes the next token if it is the given keyword.
+func (p *parser) keyword(word string) bool {
+	tok := p.peek()
+	if tok.kind == tokenIdent && strings.EqualFold(tok.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// symbol consumes the next token if it is the given symbol.
+func (p *parser) symbol(text string) bool {
+	tok := p.peek()
+	if tok.kind == tokenSymbol && tok.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// expectKeyword consumes the given keyword or returns an error.
+func (p *parser) expectKeyword(word string) error {
+	if !p.keyword(word) {
+		return p.errorf("expected %s, found %s", word, p.describe())
+	}
+	return nil
+}
+
+// expectSymbol consumes the given symbol or returns an error.
+func (p *parser) expectSymbol(text string) error {
+	if !p.symbol(text) {
+		return p.errorf("expected '%s', found %s", text, p.describe())
+	}
+	return nil
+}
+
+// ident consumes an identifier.
+func (p *parser) ident(what string) (string, error) {
+	tok := p.peek()
+	if tok.kind != tokenIdent {
+		return "", p.errorf("expected %s, found %s", what, p.describe())
+	}
+	p.pos++
+	return tok.text, nil
+}
+
+// describe returns a description of the next token for error messages.
+func (p *parser) describe() string {
+	tok := p.peek()
+	if tok.kind == tokenEnd {
+		return "end of statement"
+	}
+	return fmt.Sprintf("'%s'", tok.text)
+}
+
+// errorf returns an error located at the next token.
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at position %d: %s", p.peek().pos, fmt.Sprintf(format, args...))
+}
+
+// parseSelect parses the rest of a SELECT statement.
+func (p *parser) parseSelect() (*Statement, error) {
+	stmt := &Statement{Kind: StatementSelect}
+	if !p.symbol("*") {
+		for {
+			field, err := p.ident("field name")
+			if err != nil {
+				return nil, err
+			}
+			stmt.Fields = append(stmt.Fields, field)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	var err error
+	if stmt.Table, err = p.ident("table name"); err != nil {
+		return nil, err
+	}
+	if stmt.Conditions, err = p.parseWhere(); err != nil {
+		return nil, err
+	}
+
+	if p.keyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		if stmt.OrderBy, err = p.ident("field name"); err != nil {
+			return nil, err
+		}
+		if p.keyword("DESC") {
+			return nil, p.errorf("descending order is not supported")
+		}
+		p.keyword("ASC")
+	}
+	if p.keyword("LIMIT") {
+		if stmt.Limit, err = p.count(); err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("OFFSET") {
+		if stmt.Offset, err = p.count(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+// parseInsert parses the rest of an INSERT statement.
+func (p *parser) parseInsert() (*Statement, error) {
+	stmt := &Statement{Kind: StatementInsert}
+	if err := p.expectKeyword("INTO"); err != nil {
+		return nil, err
+	}
+	var err error
+	if stmt.Table, err = p.ident("table name"); err != nil {
+		return nil, err
+	}
+
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	for {
+		field, err := p.ident("field name")
+		if err != nil {
+			return nil, err
+		}
+		stmt.Fields = append(stmt.Fields, field)
+		if !p.symbol(",") {
+			break
+		}
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+
+	if err := p.expectKeyword("VALUES"); err != nil {
+		return nil, err
+	}
+	for {
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		record := make(Record, len(stmt.Fields))
+		for i, field := range stmt.Fields {
+			if i > 0 {
+				if err := p.expectSymbol(","); err != nil {
+					return nil, err
+				}
+			}
+			if record[field], err = p.value(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		stmt.Values = append(stmt.Values, record)
+		if !p.symbol(",") {
+			break
+		}
+	}
+	return stmt, nil
+}
+
+// parseUpdate parses the rest of an UPDATE statement.
+func (p *parser) parseUpdate() (*Statement, error) {
+	stmt := &Statement{Kind: StatementUpdate, Updates: make(Record)}
+	var err error
+	if stmt.Table, err = p.ident("table name"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("SET"); err != nil {
+		return nil, err
+	}
+	for {
+		field, err := p.ident("field name")
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol("="); err != nil {
+			return nil, err
+		}
+		if stmt.Updates[field], err = p.value(); err != nil {
+			return nil, err
+		}
+		if !p.symbol(",") {
+			break
+		}
+	}
+	if stmt.Conditions, err = p.parseWhere(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// parseDelete parses the rest of a DELETE statement.
+func (p *parser) parseDelete() (*Statement, error) {
+	stmt := &Statement{Kind: StatementDelete}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	var err error
+	if stmt.Table, err = p.ident("table name"); err != nil {
+		return nil, err
+	}
+	if stmt.Conditions, err = p.parseWhere(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// ParseConditions parses the conditions of a WHERE clause, without the WHERE keyword, such as
+// "status = 'active' AND created_at >= TIMESTAMP '2024-05-01T00:00:00Z'", for the queries of callers that take them
+// as text, like the filtered exports. The conditions are those of ParseStatement, combined with AND.
+func ParseConditions(where string) ([]Condition, error) {
+	tokens, err := tokenize(where)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	conditions, err := p.parseConditions()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEnd {
+		return nil, p.errorf("unexpected %s", p.describe())
+	}
+	return conditions, nil
+}
+
+// parseWhere parses an optional WHERE clause.
+func (p *parser) parseWhere() ([]Condition, error) {
+	if !p.keyword("WHERE") {
+		return nil, nil
+	}
+	return p.parseConditions()
+}
+
+// parseConditions parses conditions combined with AND.
+func (p *parser) parseConditions() ([]Condition, error) {
+	var conditions []Condition
+	for {
+		parsed, err := p.parseCondition()
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, parsed...)
+		if p.keyword("OR") {
+			return nil, p.errorf("OR is not supported, conditions can only be combined with AND")
+		}
+		if !p.keyword("AND") {
+			return conditions, nil
+		}
+	}
+}
+
+// parseCondition parses a single comparison, or a BETWEEN, which it returns as the two comparisons with its bounds.
+func (p *parser) parseCondition() ([]Condition, error) {
+	field, err := p.ident("field name")
+	if err != nil {
+		return nil, err
+	}
+	condition := Condition{Field: field}
+
+	if p.keyword("BETWEEN") {
+		low, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("AND"); err != nil {
+			return nil, err
+		}
+		high, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		return []Condition{
+			{Field: field, Operator: OpGreaterOrEqual, Value: low},
+			{Field: field, Operator: OpLessOrEqual, Value: high},
+		}, nil
+	}
+
+	if p.keyword("IS") {
+		switch {
+		case p.keyword("NOT"):
+			if err := p.expectKeyword("NULL"); err != nil {
+				return nil, err
+			}
+			condition.Operator = OpIsNotNull
+		case p.keyword("NULL"):
+			condition.Operator = OpIsNull
+		case p.keyword("MISSING"):
+			condition.Operator = OpIsMissing
+		default:
+			return nil, p.errorf("expected NULL, NOT NULL or MISSING, found %s", p.describe())
+		}
+		return []Condition{condition}, nil
+	}
+
+	for _, operator := range []string{OpEqual, OpNotEqual, "<>", OpGreater, OpGreaterOrEqual, OpLess, OpLessOrEqual} {
+		if p.symbol(operator) {
+			condition.Operator = operator
+			break
+		}
+	}
+	switch condition.Operator {
+	case "":
+		return nil, p.errorf("expected a comparison operator, found %s", p.describe())
+	case "<>":
+		condition.Operator = OpNotEqual
+	}
+	if condition.Value, err = p.value(); err != nil {
+		return nil, err
+	}
+	return []Condition{condition}, nil
+}
+
+// value parses a literal. Integers are returned as int64 so they are stored like ints inserted through the API, and
+// TIMESTAMP '...' literals, holding an RFC 3339 timestamp, as time.Time.
+func (p *parser) value() (interface{}, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case tokenString:
+		p.pos++
+		return tok.text, nil
+	case tokenNumber:
+		p.pos++
+		if i, err := strconv.ParseInt(tok.text, 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("syntax error at position %d: invalid number %s", tok.pos, tok.text)
+		}
+		return f, nil
+	case tokenIdent:
+		switch {
+		case p.keyword("TRUE"):
+			return true, nil
+		case p.keyword("FALSE"):
+			return false, nil
+		case p.keyword("NULL"):
+			return nil, nil
+		case p.keyword("TIMESTAMP"):
+			literal := p.peek()
+			if literal.kind != tokenString {
+				return nil, p.errorf("expected a quoted timestamp, found %s", p.describe())
+			}
+			parsed, err := time.Parse(time.RFC3339Nano, literal.text)
+			if err != nil {
+				return nil, fmt.Errorf("syntax error at position %d: invalid timestamp '%s', expected RFC 3339", literal.pos, literal.text)
+			}
+			p.pos++
+			return parsed, nil
+		}
+	}
+	return nil, p.errorf("expected a value, found %s", p.describe())
+}
+
+// count parses a non-negative integer.
+func (p *parser) count() (int, error) {
+	tok := p.peek()
+	if tok.kind == tokenNumber {
+		if n, err := strconv.Atoi(tok.text); err == nil && n >= 0 {
+			p.pos++
+			return n, nil
+		}
+	}
+	return 0, p.errorf("expected a non-negative integer, found %s", p.describe())
+}
@@ -0,0 +1,217 @@
+package data
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/Malpizarr/dbproto/pkg/utils"
+)
+
+// StorageStage is one step of the pipeline that turns marshaled records into the bytes stored in a table file.
+// Encode is applied in pipeline order when writing, Decode in reverse order when reading.
+type StorageStage interface {
+	Name() string                       // Name is the name the stage is registered and configured with.
+	Encode(data []byte) ([]byte, error) // Encode transforms data on its way to the file.
+	Decode(data []byte) ([]byte, error) // Decode reverses Encode on data read from the file.
+}
+
+// StorageStageFactory creates a stage for a table. It receives the table's encryption utilities.
+type StorageStageFactory func(u *utils.Utils) (StorageStage, error)
+
+// DefaultPipeline is the pipeline of tables that do not configure one. It produces the original file format.
+var DefaultPipeline = []string{"encrypt"}
+
+var (
+	storageStagesLock sync.RWMutex
+	storageStages     = map[string]StorageStageFactory{
+		"gzip": func(*utils.Utils) (StorageStage, error) { return gzipStage{}, nil },
+		"encrypt": func(u *utils.Utils) (StorageStage, error) {
+			if u == nil {
+				return nil, errors.New("the encrypt stage requires an AES key")
+			}
+			return encryptStage{utils: u}, nil
+		},
+		"checksum": func(*utils.Utils) (StorageStage, error) { return checksumStage{}, nil },
+	}
+)
+
+// RegisterStorageStage makes a stage available to table pipelines under the given name, replacing any stage with the same name.
+func RegisterStorageStage(name string, factory StorageStageFactory) {
+	storageStagesLock.Lock()
+	defer storageStagesLock.Unlock()
+	storageStages[name] = factory
+}
+
+// newPipeline creates the stages for the given stage names, using DefaultPipeline when names is empty.
+func newPipeline(names []string, u *utils.Utils) ([]StorageStage, error) {
+	if len(names) == 0 {
+		names = DefaultPipeline
+	}
+	storageStagesLock.RLock()
+	defer storageStagesLock.RUnlock()
+
+	pipeline := make([]StorageStage, 0, len(names))
+	for _, name := range names {
+		factory, exists := storageStages[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown storage stage '%s'", name)
+		}
+		stage, err := factory(u)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create storage stage '%s': %v", name, err)
+		}
+		pipeline = append(pipeline, stage)
+	}
+	return pipeline, nil
+}
+
+// encodeStorage runs data through every stage of the table pipeline, in order. Tables in plaintext mode store data as
+// it is, behind the plaintext file header.
+func (t *Table) encodeStorage(data []byte) ([]byte, error) {
+	return t.encodeStorageCtx(context.Background(), data)
+}
+
+// encodeStorageCtx encodes like encodeStorage, tracing each stage as part of the current span of ctx.
+func (t *Table) encodeStorageCtx(ctx context.Context, data []byte) ([]byte, error) {
+	if t.plaintext.Load() {
+		return encodePlaintext(data), nil
+	}
+	if t.storage == nil {
+		return nil, errNoStorageKey
+	}
+	for _, stage := range t.storage {
+		_, span := StartSpan(ctx, "storage.encode")
+		span.SetAttribute("dbproto.storage.stage", stage.Name())
+		var err error
+		data, err = stage.Encode(data)
+		span.SetError(err)
+		span.End()
+		if err != nil {
+			return nil, fmt.Errorf("%s stage failed: %v", stage.Name(), err)
+		}
+	}
+	return data, nil
+}
+
+// decodeStorage reverses encodeStorage, running data through the stages in reverse order.
+func (t *Table) decodeStorage(data []byte) ([]byte, error) {
+	return t.decodeStorageCtx(context.Background(), data)
+}
+
+// decodeStorageCtx decodes like decodeStorage and returns ctx.Err() if ctx is done between stages, tracing each stage
+// as part of the current span of ctx. Data written in plaintext mode is recognized by its header and returned without
+// going through the stages, whatever the mode of the table.
+func (t *Table) decodeStorageCtx(ctx context.Context, data []byte) ([]byte, error) {
+	if isPlaintext(data) {
+		return decodePlaintext(data)
+	}
+	if t.storage == nil {
+		return nil, errNoStorageKey
+	}
+	for i := len(t.storage) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if _, encrypted := t.storage[i].(encryptStage); encrypted && utils.IsLegacyCiphertext(string(data)) {
+			t.noteLegacyCiphertext()
+		}
+		_, span := StartSpan(ctx, "storage.decode")
+		span.SetAttribute("dbproto.storage.stage", t.storage[i].Name())
+		var err error
+		data, err = t.storage[i].Decode(data)
+		span.SetError(err)
+		span.End()
+		if err != nil {
+			return nil, fmt.Errorf("%s stage failed: %v", t.storage[i].Name(), err)
+		}
+	}
+	return data, nil
+}
+
+// noteLegacyCiphertext counts a read of data of the table in the legacy CTR format, which is not authenticated, even
+// one that rejected it, and logs the first one, so that the tables still to be written again as envelopes are known before legacy ciphertext
+// is rejected with utils.SetRejectLegacyCiphertext.
+func (t *Table) noteLegacyCiphertext() {
+	if t.legacyReads.Add(1) == 1 {
+		log.Printf("Table %s holds ciphertext in the legacy CTR format, which has no integrity check; it is stored as an envelope the next time it is written", t.FilePath)
+	}
+}
+
+// LegacyCiphertextReads returns the number of times data of the table in the legacy CTR format was read since the
+// table was opened, whether it was decrypted or rejected. It stays 0 once the file, its segments and its write-behind log are all envelopes.
+func (t *Table) LegacyCiphertextReads() int {
+	return int(t.legacyReads.Load())
+}
+
+// gzipStage compresses data with gzip.
+type gzipStage struct{}
+
+func (gzipStage) Name() string { return "gzip" }
+
+func (gzipStage) Encode(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (gzipStage) Decode(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// encryptStage encrypts data with the table's AES key, producing base64 text.
+type encryptStage struct {
+	utils *utils.Utils
+}
+
+func (encryptStage) Name() string { return "encrypt" }
+
+func (s encryptStage) Encode(data []byte) ([]byte, error) {
+	encrypted, err := s.utils.Encrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(encrypted), nil
+}
+
+func (s encryptStage) Decode(data []byte) ([]byte, error) {
+	return s.utils.Decrypt(string(data))
+}
+
+// checksumStage prefixes data with its SHA-256, and verifies it on the way back.
+type checksumStage struct{}
+
+func (checksumStage) Name() string { return "checksum" }
+
+func (checksumStage) Encode(data []byte) ([]byte, error) {
+	sum := sha256.Sum256(data)
+	return append(sum[:], data...), nil
+}
+
+func (checksumStage) Decode(data []byte) ([]byte, error) {
+	if len(data) < sha256.Size {
+		return nil, errors.New("data is too short to hold a checksum")
+	}
+	sum := sha256.Sum256(data[sha256.Size:])
+	if !bytes.Equal(sum[:], data[:sha256.Size]) {
+		return nil, errors.New("checksum mismatch, the file is corrupted")
+	}
+	return data[sha256.Size:], nil
+}
@@ -0,0 +1,77 @@
+package data_test
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+	"github.com/Malpizarr/dbproto/pkg/utils"
+)
+
+// TestLegacyCiphertextIsReportedAndCanBeRejected checks that a table file still encrypted in the legacy CTR format is
+// read and counted as a legacy read, and that it fails to load once legacy ciphertext is rejected.
+func TestLegacyCiphertextIsReportedAndCanBeRejected(t *testing.T) {
+	key := "0123456789abcdef0123456789abcdef"
+	t.Setenv("AES_KEY", key)
+	t.Setenv("AES_KEY_FILE", "")
+	path := filepath.Join(t.TempDir(), "users.dat")
+
+	table, err := data.OpenTable("id", path, data.TableOptions{})
+	if err != nil {
+		t.Fatalf("Failed to open table: %v", err)
+	}
+	if err := table.Insert(data.Record{"id": "u1", "name": "Ada"}); err != nil {
+		t.Fatalf("Failed to insert record: %v", err)
+	}
+	table.Close()
+
+	// Write the file again as an earlier version did, in CTR mode with the IV prepended
+	stored, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read the table file: %v", err)
+	}
+	u, err := utils.NewUtilsWithKey([]byte(key))
+	if err != nil {
+		t.Fatalf("Failed to create utils: %v", err)
+	}
+	plainText, err := u.Decrypt(string(stored))
+	if err != nil {
+		t.Fatalf("Failed to decrypt the table file: %v", err)
+	}
+	block, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	legacy := make([]byte, aes.BlockSize+len(plainText))
+	if _, err := rand.Read(legacy[:aes.BlockSize]); err != nil {
+		t.Fatalf("Failed to generate IV: %v", err)
+	}
+	cipher.NewCTR(block, legacy[:aes.BlockSize]).XORKeyStream(legacy[aes.BlockSize:], plainText)
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(legacy)), 0644); err != nil {
+		t.Fatalf("Failed to write the legacy file: %v", err)
+	}
+
+	reopened, err := data.OpenTable("id", path, data.TableOptions{})
+	if err != nil {
+		t.Fatalf("Failed to open the legacy table: %v", err)
+	}
+	if record, err := reopened.Select("u1"); err != nil || record["name"] != "Ada" {
+		t.Errorf("Expected u1 to be read from the legacy file, found %v (%v)", record, err)
+	}
+	if reads := reopened.LegacyCiphertextReads(); reads != 1 {
+		t.Errorf("Expected 1 legacy read, found %d", reads)
+	}
+	reopened.Close()
+
+	utils.SetRejectLegacyCiphertext(true)
+	defer utils.SetRejectLegacyCiphertext(false)
+	if _, err := data.OpenTable("id", path, data.TableOptions{}); err == nil || !strings.Contains(err.Error(), utils.ErrLegacyCiphertext.Error()) {
+		t.Errorf("Expected the legacy table to be rejected, found %v", err)
+	}
+}
@@ -2,18 +2,22 @@ package data
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Malpizarr/dbproto/pkg/dbdata"
 	"github.com/Malpizarr/dbproto/pkg/utils"
 
 	"google.golang.org/protobuf/proto"
-	"google.golang.org/protobuf/types/known/structpb"
 )
 
 type Record map[string]interface{}
@@ -26,46 +30,115 @@ type Record map[string]interface{}
 // Indexes is a map where the keys are field names and the values are slices of records that have that field.
 // Records is a map where the keys are primary key values and the values are the corresponding records.
 type Table struct {
-	sync.RWMutex                             // Mutex for read-write locking
-	FilePath     string                      // Path to the file where the table data is stored
-	PrimaryKey   string                      // Field name used as the primary key for the table
-	utils        *utils.Utils                // Utility object used for various helper functions
-	Indexes      map[string][]*dbdata.Record // Map of field names to slices of records that have that field
-	Records      map[string]*dbdata.Record   // Map of primary key values to the corresponding records
-	Cache        map[string]*dbdata.Record   // Cache for recently accessed records
-	metrics      *Metrics                    // Metrics for monitoring
+	sync.RWMutex                                         // Mutex for read-write locking
+	FilePath     string                                  // Path to the file where the table data is stored
+	PrimaryKey   string                                  // Field name used as the primary key for the table
+	utils        *utils.Utils                            // Utility object used for various helper functions
+	Indexes      map[string][]*dbdata.Record             // Map of field names to slices of records that have that field, without the indexes spilled to disk
+	Records      map[string]*dbdata.Record               // Map of primary key values to the corresponding records
+	Cache        *RecordCache                            // Cache of the records recently read by Select
+	metrics      *Metrics                                // Metrics for monitoring
+	commitLog    *CommitLog                              // Commit log that committed mutations are shipped to
+	tenant       string                                  // Tenant of the database of the table, recorded in the commit log and the plugin events
+	requestID    string                                  // ID of the request of the write holding the write lock, recorded in the commit log
+	traceCtx     context.Context                         // Context of the write holding the write lock, whose file writes are traced as part of its request
+	Options      TableOptions                            // Optional settings of the table
+	storage      []StorageStage                          // Pipeline that encodes the marshaled records before they are stored, nil if it needs a key the table was opened without
+	plaintext    atomic.Bool                             // Whether the marshaled records are stored as they are, behind the plaintext file header, instead of through the pipeline
+	legacyReads  atomic.Int64                            // Number of times data of the table in the legacy CTR format was read, see LegacyCiphertextReads
+	virtual      bool                                    // Whether the records are only held in memory, as for the catalog tables
+	temporary    bool                                    // Whether the records are only held in memory but writable, as for the temporary tables of a session and the tables with InMemory set
+	dropped      bool                                    // Whether the table has been dropped, or renamed, after which writes fail
+	readOnly     atomic.Bool                             // Whether writes fail with ErrReadOnly and the file is never opened for writing, see SetReadOnly
+	closed       atomic.Bool                             // Whether the table has been closed, after which reads and writes fail with ErrClosed
+	current      atomic.Pointer[snapshot]                // Version of Records and Indexes that reads use without locking
+	recordCount  atomic.Int64                            // Number of records of the current version, kept while the table is evicted
+	throttle     atomic.Pointer[WriteThrottle]           // Backpressure applied to writes, nil for none
+	telemetry    atomic.Pointer[Telemetry]               // Telemetry the shapes of operations are sampled to, nil for none
+	plugins      atomic.Pointer[[]*Plugin]               // Plugins the lifecycle events of the table are reported to, nil for none
+	computed     atomic.Pointer[[]*computedField]        // Computed fields of the table, declared in its options or registered with ComputeField
+	heat         tableHeat                               // Access frequency of the table and the decisions of the cache policy
+	writeBehind  writeBehindState                        // Writes not yet in the file, in write-behind mode
+	segments     segmentState                            // Segment files and compaction of the table, in segmented mode
+	indexes      indexState                              // Indexes spilled to disk by the index budget
+	hooks        tableHooks                              // Trigger hooks run by the writes of the table
+	generators   Generators                              // Sources of generated primary keys and timestamps
+	previous     *snapshot                               // Version replaced by the last write, holding the before-images of its changes
+	watchers     map[chan ChangeEvent]context.CancelFunc // Channels of the watchers of the table
+	watchLock    sync.Mutex                              // Mutex for the watchers, which subscribe without locking the table
 }
 
 // NewTable is a constructor function for the Table struct.
-// It takes a primary key and a file path as arguments and returns a pointer to a new Table instance.
+// It takes a primary key and a file path as arguments and returns a pointer to a new Table instance
+// that uses the default options.
+//
+// It opens the table with OpenTable. If an error occurs, the function panics, so callers that can handle the error
+// should use OpenTable instead.
+//
+// Parameters:
+// - primaryKey: A string representing the field name to be used as the primary key for the table.
+// - filePath: A string representing the path to the file where the table data is stored.
+//
+// Returns:
+// - A pointer to a new Table instance.
+func NewTable(primaryKey, filePath string) *Table {
+	table, err := OpenTable(primaryKey, filePath, TableOptions{})
+	if err != nil {
+		panic(fmt.Sprintf("failed to open table %s: %v", filePath, err))
+	}
+	return table
+}
+
+// OpenTable creates a Table instance with the given options, which apply before the file is first read. The table is
+// encrypted with the master key; the tables of a database are encrypted with its data key instead. With an empty file
+// path or MemoryPath, or with InMemory set in the options, the table is only held in memory instead, see
+// TableOptions.InMemory.
 //
 // The function first gets the directory from the file path and checks if it exists.
 // If the directory does not exist, it creates it with the appropriate permissions.
-// It then creates a new Table instance, setting the FilePath, PrimaryKey, utils, Records, and Indexes fields.
+// It then creates a new Table instance, setting the FilePath, PrimaryKey, utils, Records, Indexes and storage pipeline.
 // It calls the initializeFileIfNotExists method to ensure that the file where the table data is stored exists.
 // If the file does not exist, it is created and initialized with an empty Records map.
-// If an error occurs during this operation, the function logs the error and exits.
-// It then calls the LoadIndexes method to load the indexes from the file into the Indexes map.
-// If an error occurs during this operation, the function logs the error and exits.
-// Finally, it returns the new Table instance.
+// It then calls the LoadIndexes method to load the records and indexes from the file.
+// If an error occurs during any of these operations, it returns the error.
 //
 // Parameters:
 // - primaryKey: A string representing the field name to be used as the primary key for the table.
 // - filePath: A string representing the path to the file where the table data is stored.
+// - options: The optional settings of the table, such as its storage pipeline.
 //
 // Returns:
 // - A pointer to a new Table instance.
-func NewTable(primaryKey, filePath string) *Table {
+// - If an error occurs, it returns the error and a nil table.
+func OpenTable(primaryKey, filePath string, options TableOptions) (*Table, error) {
+	if filePath == "" || filePath == MemoryPath {
+		options.InMemory = true
+		return newMemoryTable(primaryKey, MemoryPath, options)
+	}
+	if options.InMemory {
+		return newMemoryTable(primaryKey, filePath, options)
+	}
+	utils, err := masterUtils()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create utils: %v", err)
+	}
+	return openTableWith(primaryKey, filePath, options, utils, false)
+}
+
+// openTableWith opens a table like OpenTable, encrypting it with the given utilities, such as the data key of its
+// database, or in plaintext mode if plaintext is set. Without utilities, as for a database in plaintext mode without an
+// AES key, a pipeline that needs them is left out and only files in plaintext can be read.
+func openTableWith(primaryKey, filePath string, options TableOptions, utils *utils.Utils, plaintext bool) (*Table, error) {
 	dir := path.Dir(filePath)
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) && !options.ReadOnly {
 		if err := os.MkdirAll(dir, 0755); err != nil {
-			log.Fatalf("Failed to create directory %s: %v", dir, err)
+			return nil, fmt.Errorf("failed to create directory %s: %v", dir, err)
 		}
 	}
 
-	utils, err := utils.NewUtils()
-	if err != nil {
-		log.Fatalf("Failed to create utils: %v", err)
+	storage, err := newPipeline(options.Pipeline, utils)
+	if err != nil && utils != nil {
+		return nil, err
 	}
 	table := &Table{
 		FilePath:   filePath,
@@ -73,61 +146,239 @@ func NewTable(primaryKey, filePath string) *Table {
 		utils:      utils,
 		Records:    make(map[string]*dbdata.Record),
 		Indexes:    make(map[string][]*dbdata.Record),
-		Cache:      make(map[string]*dbdata.Record),
 		metrics:    NewMetrics(),
+		Options:    options,
+		storage:    storage,
+	}
+	table.Cache = NewRecordCache(table.cacheSize())
+	table.plaintext.Store(plaintext)
+	table.readOnly.Store(options.ReadOnly)
+	table.heat.lastAccess.Store(time.Now().UnixNano()) // Tables start warm rather than idle since the epoch
+	if err := table.compileComputedFields(nil); err != nil {
+		return nil, err
 	}
 	if err := table.initializeFileIfNotExists(); err != nil {
-		log.Fatalf("Failed to initialize file %s: %v", filePath, err)
+		return nil, fmt.Errorf("failed to initialize file %s: %v", filePath, err)
 	}
-	err = table.LoadIndexes()
-	if err != nil {
-		log.Fatalf("Failed to load indexes: %v", err)
+	if err := table.LoadIndexes(); err != nil {
+		return nil, fmt.Errorf("failed to load indexes: %v", err)
 	}
-	return table
+	return table, nil
+}
+
+// newMemoryTable returns an empty table whose records are only held in memory, never encrypted nor written to a file.
+// filePath is never opened; it names the table in errors and orders the locks taken by transactions.
+func newMemoryTable(primaryKey, filePath string, options TableOptions) (*Table, error) {
+	table := &Table{
+		FilePath:   filePath,
+		PrimaryKey: primaryKey,
+		Records:    make(map[string]*dbdata.Record),
+		Indexes:    make(map[string][]*dbdata.Record),
+		metrics:    NewMetrics(),
+		Options:    options,
+		temporary:  true,
+	}
+	table.Cache = NewRecordCache(table.cacheSize())
+	table.readOnly.Store(options.ReadOnly)
+	table.heat.lastAccess.Store(time.Now().UnixNano())
+	if err := table.compileComputedFields(nil); err != nil {
+		return nil, err
+	}
+	table.publish(table.Records)
+	return table, nil
 }
 
-// LoadIndexes loads the indexes from the file
+// LoadIndexes loads the records and indexes from the file. Writes left in the write-behind log by a process that
+// stopped before flushing them are written to the file, unless the table is read-only, and fail the load if they
+// cannot be, so they stay in the log.
 func (t *Table) LoadIndexes() error {
 	records, err := t.readRecordsFromFile()
 	if err != nil {
 		return err
 	}
 
-	if t.Indexes == nil {
-		t.Indexes = make(map[string][]*dbdata.Record)
-	}
-
-	for _, record := range records.GetRecords() {
-		for key, value := range record.Fields {
-			if value != nil && value.GetStringValue() != "" {
-				t.Indexes[key] = append(t.Indexes[key], record)
-			}
+	t.publish(records.Records)
+	if _, err := os.Stat(pendingLogPath(t.FilePath)); err == nil && !t.readOnly.Load() {
+		if err := t.rewriteFile(); err != nil {
+			return fmt.Errorf("failed to write the writes of the write-behind log: %v", err)
 		}
 	}
 	return nil
 }
 
-// ResetAndLoadIndexes resets the indexes and reloads them from the file
-func (t *Table) ResetAndLoadIndexes() error {
+// Reload is a method of the Table struct that reads the records of the table from its file again and rebuilds its
+// indexes. Reads and writes are served from the records held in memory, which the table only reads from the file
+// when it is opened or reloaded after the cache policy evicted it, so Reload is only needed after the file was changed
+// by other means than the table, such as by restoring it from a copy. The lookup cache is emptied.
+//
+// Returns:
+// - An error if the file cannot be read or decoded, in which case the table keeps its records. If the operation is
+// successful, the error is nil.
+func (t *Table) Reload() error {
 	t.Lock()
 	defer t.Unlock()
-
-	t.Indexes = make(map[string][]*dbdata.Record)
+	if err := t.flushPending(); err != nil {
+		return err
+	}
 
 	records, err := t.readRecordsFromFile()
 	if err != nil {
 		return fmt.Errorf("failed to read records from file: %v", err)
 	}
+	t.Cache.Clear()
+	t.publish(records.Records)
+	return nil
+}
+
+// ResetAndLoadIndexes resets the indexes and reloads them from the file, see Reload.
+func (t *Table) ResetAndLoadIndexes() error {
+	return t.Reload()
+}
+
+// updateIndexes returns the indexes of the given records for their snapshot, updated from those of the current
+// snapshot: writes replace the records they change, so the records replaced, inserted or deleted since are told apart
+// by their instance, and only the indexes of the fields they have, before or after the write, are updated, by
+// dropping their previous records and adding the new ones. The other indexes are shared with the current snapshot.
+// Indexes spilled to disk by the index budget are carried over with the keys that changed instead, see
+// carrySpilledIndex. The indexes are built from the records instead, see rebuildIndexes, if there is no current
+// snapshot or more than a quarter of the records were replaced, such as when the file is reloaded. Indexes only holds
+// the indexes in memory. The caller must hold the table write lock.
+func (t *Table) updateIndexes(records map[string]*dbdata.Record) map[string]*indexPartition {
+	previous := t.current.Load()
+	if previous == nil {
+		return t.rebuildIndexes(records)
+	}
+	replaced := replacedKeys(previous.records, records)
+	if len(replaced) > len(records)/4+1 {
+		return t.rebuildIndexes(records)
+	}
+
+	// The fields of the replaced records, with the previous records to drop from their index and the new ones to add
+	removed := make(map[*dbdata.Record]struct{}, len(replaced))
+	added := make(map[string][]*dbdata.Record)
+	for key := range replaced {
+		if old, exists := previous.records[key]; exists {
+			removed[old] = struct{}{}
+			indexedPaths(old, func(path string) {
+				if _, exists := added[path]; !exists {
+					added[path] = nil
+				}
+			})
+		}
+		if record, exists := records[key]; exists {
+			indexedPaths(record, func(path string) {
+				added[path] = append(added[path], record)
+			})
+		}
+	}
+
+	partitions := make(map[string]*indexPartition, len(previous.indexes)+len(added))
+	for field, partition := range previous.indexes {
+		if _, affected := added[field]; !affected {
+			partitions[field] = partition
+		}
+	}
+	for field, additions := range added {
+		partition := previous.indexes[field]
+		var entries []*dbdata.Record
+		if partition != nil {
+			current := partition.entries.Load()
+			if current == nil {
+				if carried := t.carrySpilledIndex(partition, previous.records, records, replaced); carried != nil {
+					partitions[field] = carried
+					continue
+				}
+				// Rebuilt below from the records, which already holds the added ones
+				additions = scanIndex(records, field)
+			} else {
+				entries = make([]*dbdata.Record, 0, len(*current)+len(additions))
+				for _, record := range *current {
+					if _, dropped := removed[record]; !dropped {
+						entries = append(entries, record)
+					}
+				}
+			}
+		}
+		entries = append(entries, additions...)
+		if len(entries) == 0 {
+			continue
+		}
+		next := newIndexPartition(field, entries, &t.indexes)
+		if partition != nil {
+			next.lastUse.Store(partition.lastUse.Load())
+		}
+		partitions[field] = next
+	}
+
+	indexes := make(map[string][]*dbdata.Record, len(partitions))
+	for field, partition := range partitions {
+		if entries := partition.entries.Load(); entries != nil {
+			indexes[field] = *entries
+		}
+	}
+	t.Indexes = indexes
+	t.forgetSpillFiles(partitions)
+	return partitions
+}
+
+// replacedKeys returns the keys of the records inserted, replaced or deleted between two versions of the records of
+// a table, which tells them apart by their instance, unlike changedKeys: unchanged records are shared by both.
+func replacedKeys(previous, current map[string]*dbdata.Record) map[string]struct{} {
+	replaced := make(map[string]struct{})
+	for key, record := range current {
+		if previous[key] != record {
+			replaced[key] = struct{}{}
+		}
+	}
+	for key := range previous {
+		if _, exists := current[key]; !exists {
+			replaced[key] = struct{}{}
+		}
+	}
+	return replaced
+}
 
-	for _, record := range records.GetRecords() {
-		for key, value := range record.Fields {
-			if value != nil && value.GetStringValue() != "" {
-				t.Indexes[key] = append(t.Indexes[key], record)
+// rebuildIndexes builds the indexes of the given records from scratch, so that every indexed record is the same
+// instance that is stored in Records, and returns them for the snapshot of the records.
+// The indexes spilled to disk by the index budget are carried over from the current snapshot instead of being built,
+// see carrySpilledIndexes; Indexes only holds the indexes in memory.
+func (t *Table) rebuildIndexes(records map[string]*dbdata.Record) map[string]*indexPartition {
+	previous := t.current.Load()
+	spilled := t.carrySpilledIndexes(previous, records)
+	indexes := make(map[string][]*dbdata.Record)
+	for _, record := range records {
+		indexedPaths(record, func(path string) {
+			if _, skip := spilled[path]; !skip {
+				indexes[path] = append(indexes[path], record)
 			}
+		})
+	}
+	t.Indexes = indexes
+
+	partitions := make(map[string]*indexPartition, len(indexes)+len(spilled))
+	for field, entries := range indexes {
+		partition := newIndexPartition(field, entries, &t.indexes)
+		if previous != nil && previous.indexes[field] != nil {
+			partition.lastUse.Store(previous.indexes[field].lastUse.Load())
 		}
+		partitions[field] = partition
+	}
+	for field, partition := range spilled {
+		partitions[field] = partition
 	}
+	t.forgetSpillFiles(partitions)
+	return partitions
+}
 
-	return nil
+// indexable reports whether a field value is indexed: non-empty strings and integers are, other values are not.
+func indexable(value *dbdata.Value) bool {
+	switch v := value.GetKind().(type) {
+	case *dbdata.Value_StringValue:
+		return v.StringValue != ""
+	case *dbdata.Value_IntValue:
+		return true
+	}
+	return false
 }
 
 // initializeFileIfNotExists is a method of the Table struct that initializes the file if it doesn't exist.
@@ -155,13 +406,11 @@ func (t *Table) initializeFileIfNotExists() error {
 
 // Insert is a method of the Table struct that inserts a new record into the table.
 // It locks the table for writing, ensuring that no other goroutines can modify the table while the insertion is happening.
-// It first checks if the Indexes map is initialized, and if not, it initializes it.
-// It then reads all existing records from the file where the table data is stored.
+// It first copies the records of the table held in memory, without reading the file.
 // If the primary key of the new record already exists in the table, it returns an error.
 // It then creates a new proto Record from the input record, converting each field value to a proto Value.
-// For each field in the new record, it adds the new record to the index for that field.
-// If the index for a field does not exist, it initializes it before adding the new record.
-// It then adds the new record to the main records map and writes the updated records back to the file.
+// It then adds the new record to the main records map and writes the updated records back to the file,
+// which also updates the indexes of the fields the changed records have.
 // If any error occurs during these operations, it returns the error.
 //
 // Parameters:
@@ -172,127 +421,173 @@ func (t *Table) initializeFileIfNotExists() error {
 // - If an error occurs, it returns the error.
 
 func (t *Table) Insert(record Record) error {
-	t.Lock()
-	defer t.Unlock()
+	return t.InsertCtx(context.Background(), record)
+}
 
-	allRecords, err := t.readRecordsFromFile()
+// InsertCtx inserts a record like Insert. It gives up without changing the table if ctx is done
+// before the record is written.
+func (t *Table) InsertCtx(ctx context.Context, record Record) error {
+	defer t.sample("insert", "", time.Now())
+	unlock, err := t.lockWrite(ctx)
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	primaryKeyValue, ok := record[t.PrimaryKey]
-	if !ok {
-		return fmt.Errorf("primary key '%s' not found in record", t.PrimaryKey)
+	_, err = t.insert(ctx, record)
+	return err
+}
+
+// InsertReturning inserts a record like Insert and returns the record as it was stored,
+// including server-generated fields such as an automatic primary key and timestamps.
+func (t *Table) InsertReturning(record Record) (Record, error) {
+	return t.InsertReturningCtx(context.Background(), record)
+}
+
+// InsertReturningCtx inserts a record like InsertReturning, honoring ctx like InsertCtx.
+func (t *Table) InsertReturningCtx(ctx context.Context, record Record) (Record, error) {
+	defer t.sample("insert", "", time.Now())
+	unlock, err := t.lockWrite(ctx)
+	if err != nil {
+		return nil, err
 	}
+	defer unlock()
 
-	// Validate the primary key value before calling toProtoValue
-	if strValue, ok := primaryKeyValue.(string); ok {
-		if _, err := strconv.ParseInt(strValue, 10, 64); err == nil {
-			primaryKeyValue = "str:" + strValue
-		}
+	stored, err := t.insert(ctx, record)
+	if err != nil {
+		return nil, err
+	}
+	return fromProtoRecord(t.withReadFields(stored))
+}
+
+// insert inserts a record. The caller must hold the table write lock.
+func (t *Table) insert(ctx context.Context, record Record) (*dbdata.Record, error) {
+	allRecords, err := t.recordsForWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	primaryKeyProtoValue, err := toProtoValue(primaryKeyValue)
+	primaryKeyString, protoRecord, err := t.applyInsert(allRecords, record)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	t.Cache.Remove(primaryKeyString)
+
+	t.metrics.IncrementInsertCount()
+	if err := t.writeRecordsToFile(allRecords); err != nil {
+		return nil, err
+	}
+	t.logCommit("insert", primaryKeyString, protoRecord)
+	return protoRecord, nil
+}
+
+// applyInsert converts the record and adds it to records, without writing the file.
+// It returns the primary key under which the record was added and the stored record.
+func (t *Table) applyInsert(records *dbdata.Records, record Record) (string, *dbdata.Record, error) {
+	record, err := t.beforeInsert(record)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := t.checkClientEncrypted(record); err != nil {
+		return "", nil, err
+	}
+	record = t.withGeneratedFields(record, true)
+	if record, err = t.applySchema(t.Options.Schema, record); err != nil {
+		return "", nil, err
+	}
+	if err := checkRules(t.Options.Rules, record); err != nil {
+		return "", nil, err
+	}
+
+	primaryKeyValue, ok := record[t.PrimaryKey]
+	if !ok {
+		return "", nil, fmt.Errorf("primary key '%s' not found in record", t.PrimaryKey)
 	}
-	primaryKeyString := primaryKeyProtoValue.GetStringValue()
 
-	if primaryKeyString == "<nil>" || primaryKeyString == "" {
-		return fmt.Errorf("primary key '%s' is nil or empty", t.PrimaryKey)
+	primaryKeyProtoValue, err := toProtoValue(primaryKeyValue)
+	if err != nil {
+		return "", nil, err
+	}
+	primaryKeyString, err := t.Options.KeyNormalization.encode(primaryKeyProtoValue)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid primary key '%s': %w", t.PrimaryKey, err)
 	}
 
-	protoRecord := &dbdata.Record{Fields: make(map[string]*structpb.Value)}
+	protoRecord := &dbdata.Record{Fields: make(map[string]*dbdata.Value)}
 	for key, value := range record {
-		// Validate each value before calling toProtoValue
-		if strValue, ok := value.(string); ok {
-			if _, err := strconv.ParseInt(strValue, 10, 64); err == nil {
-				value = "str:" + strValue
-			}
-		}
 		protoValue, err := toProtoValue(value)
 		if err != nil {
-			return fmt.Errorf("invalid value type for field '%s': %v", key, err)
+			return "", nil, fmt.Errorf("invalid value type for field '%s': %v", key, err)
 		}
 		protoRecord.Fields[key] = protoValue
 	}
-
-	if _, exists := allRecords.Records[primaryKeyString]; exists {
-		return fmt.Errorf("record with primary key '%s' already exists", primaryKeyString)
+	if err := t.applyComputedFields(protoRecord); err != nil {
+		return "", nil, err
 	}
+	sealRecord(protoRecord)
 
-	allRecords.Records[primaryKeyString] = protoRecord
-	t.Cache[primaryKeyString] = protoRecord
-
-	t.metrics.IncrementInsertCount()
-	return t.writeRecordsToFile(allRecords)
+	if _, exists := records.Records[primaryKeyString]; exists {
+		return "", nil, duplicateKey(primaryKeyString)
+	}
+	records.Records[primaryKeyString] = protoRecord
+	return primaryKeyString, protoRecord, nil
 }
 
 // InsertMany is a method of the Table struct that inserts multiple new records into the table.
-// It divides the records into batches and inserts each batch separately to optimize performance.
-// If an error occurs while inserting a batch, it is added to a slice of errors.
-// After all batches have been processed, it returns the slice of errors.
+// It locks the table for writing and runs every record through the same conversion and checks as Insert, see
+// applyInsert, on a copy of the records held in memory.
+// If any record fails, such as one with a duplicate key, it returns that error and the table is left unchanged;
+// otherwise the file is written once for all the records and every insert is counted and logged.
 //
 // Parameters:
 // - records: A slice of maps representing the records to be inserted. The keys are field names and the values are the field values.
 //
 // Returns:
-// - A slice of errors for records that failed to insert. If all records are inserted successfully, the slice ismpty.
+// - If the operation is successful, it returns nil.
+// - If a record cannot be inserted or the file cannot be written, it returns the error and no record is inserted.
 func (t *Table) InsertMany(records []Record) error {
-	t.Lock()
-	defer t.Unlock()
-
-	allRecords, err := t.readRecordsFromFile()
+	defer t.sample("insert_many", "", time.Now())
+	unlock, err := t.lockWrite(context.Background())
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	for _, record := range records {
-		primaryKeyValue, ok := record[t.PrimaryKey]
-		if !ok {
-			return fmt.Errorf("primary key '%s' not found in record", t.PrimaryKey)
-		}
+	allRecords, err := t.recordsForWrite(context.Background())
+	if err != nil {
+		return err
+	}
 
-		primaryKeyProtoValue, err := toProtoValue(primaryKeyValue)
-		if err != nil {
+	keys := make([]string, len(records))
+	inserted := make([]*dbdata.Record, len(records))
+	for i, record := range records {
+		if keys[i], inserted[i], err = t.applyInsert(allRecords, record); err != nil {
 			return err
 		}
-		primaryKeyString := primaryKeyProtoValue.GetStringValue()
-
-		if primaryKeyString == "<nil>" || primaryKeyString == "" {
-			return fmt.Errorf("primary key '%s' is nil or empty", t.PrimaryKey)
-		}
-
-		protoRecord := &dbdata.Record{Fields: make(map[string]*structpb.Value)}
-		for key, value := range record {
-			protoValue, err := toProtoValue(value)
-			if err != nil {
-				return fmt.Errorf("invalid value type for field '%s': %v", key, err)
-			}
-			protoRecord.Fields[key] = protoValue
-		}
-
-		if _, exists := allRecords.Records[primaryKeyString]; exists {
-			return fmt.Errorf("record with primary key '%s' already exists", primaryKeyString)
-		}
-
-		allRecords.Records[primaryKeyString] = protoRecord
-		t.Cache[primaryKeyString] = protoRecord
+	}
+	for _, key := range keys {
+		t.Cache.Remove(key)
 	}
 
 	if err := t.writeRecordsToFile(allRecords); err != nil {
 		return err
 	}
-
+	for i, key := range keys {
+		t.metrics.IncrementInsertCount()
+		t.logCommit("insert", key, inserted[i])
+	}
 	return nil
 }
 
 //SELECT
 
 // SelectAll is a method of the Table struct that selects all records from the table.
-// It locks the table for reading, ensuring that no other goroutines can modify the table while the selection is happening.
-// It then reads all existing records from the file where the table data is stored.
-// It iterates over the records, appending each one to a slice of records.
+// It reads the current snapshot of the table without locking it, so it neither waits for writers nor delays them,
+// and it sees every record of the last completed write and nothing of the ones still in progress.
+// It iterates over the records of the snapshot, appending each one to a slice of records.
 // If any error occurs during these operations, it returns the error and a nil slice.
 // If the operation is successful, it returns the slice of all records and a nil error.
 //
@@ -301,17 +596,37 @@ func (t *Table) InsertMany(records []Record) error {
 // - If an error occurs, it returns the error and a nil slice.
 // - If the operation is successful, it returns the slice of all records and a nil error.
 func (t *Table) SelectAll() ([]Record, error) {
-	t.RLock()
-	defer t.RUnlock()
+	return t.SelectAllCtx(context.Background())
+}
 
-	allRecordsProto, err := t.readRecordsFromFile()
-	if err != nil {
+// SelectAllCtx returns all records like SelectAll. It stops with ctx.Err() if ctx is done while
+// the records are converted, and enforces the limits set with WithLimits.
+func (t *Table) SelectAllCtx(ctx context.Context) ([]Record, error) {
+	defer t.sample("select_all", "", time.Now())
+	records, err := t.selectAll(ctx)
+	if err := limitResult(ctx, len(records), err); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// selectAll returns all records, honoring ctx like SelectAllCtx but without enforcing limits.
+func (t *Table) selectAll(ctx context.Context) ([]Record, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
+	snap, err := t.readSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
 	var allRecords []Record
-	for _, recordProto := range allRecordsProto.GetRecords() {
-		record, err := fromProtoRecord(recordProto)
+	scanned := 0
+	for _, recordProto := range snap.records {
+		if err := checkScan(ctx, &scanned); err != nil {
+			return nil, err
+		}
+		record, err := fromProtoRecord(t.withReadFields(recordProto))
 		if err != nil {
 			return nil, err
 		}
@@ -322,9 +637,8 @@ func (t *Table) SelectAll() ([]Record, error) {
 }
 
 // SelectWithFilter is a method of the Table struct that selects records from the table based on the given filters.
-// It locks the table for reading, ensuring that no other goroutines can modify the table while the selection is happening.
-// It then reads all existing records from the file where the table data is stored.
-// It iterates over the records, checking each one against the filters.
+// Like SelectAll, it reads the current snapshot of the table without locking it.
+// It iterates over the records of the snapshot, checking each one against the filters.
 // For each record, it iterates over the filters. For each filter, it converts the filter value to a proto Value.
 // If an error occurs during this conversion, it returns the error and a nil slice.
 // It then checks if the field specified by the filter exists in the record and if the value of the field in the record is equal to the filter value.
@@ -340,30 +654,45 @@ func (t *Table) SelectAll() ([]Record, error) {
 // - If an error occurs, it returns the error and a nil slice.
 // - If the operation is successful, it returns the slice of matched records and a nil error.
 func (t *Table) SelectWithFilter(filters map[string]interface{}) ([]Record, error) {
-	t.RLock()
-	defer t.RUnlock()
+	return t.SelectWithFilterCtx(context.Background(), filters)
+}
+
+// SelectWithFilterCtx selects records like SelectWithFilter. It stops with ctx.Err() if ctx is done
+// while the records are scanned, and enforces the limits set with WithLimits.
+func (t *Table) SelectWithFilterCtx(ctx context.Context, filters map[string]interface{}) ([]Record, error) {
+	defer t.sample("select_filter", "", time.Now())
+	records, err := t.selectWithFilter(ctx, filters)
+	if err := limitResult(ctx, len(records), err); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
 
-	allRecords, err := t.readRecordsFromFile()
+// selectWithFilter selects records, honoring ctx like SelectWithFilterCtx but without enforcing limits.
+func (t *Table) selectWithFilter(ctx context.Context, filters map[string]interface{}) ([]Record, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	protoFilters, err := toProtoFilters(filters)
 	if err != nil {
 		return nil, err
 	}
 
+	snap, err := t.readSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
 	var matchedRecords []*dbdata.Record
-
-RecordsLoop:
-	for _, record := range allRecords.GetRecords() {
-		for field, filterValue := range filters {
-			protoValue, err := structpb.NewValue(filterValue)
-			if err != nil {
-				return nil, fmt.Errorf("error converting filter value for field %s: %v", field, err)
-			}
-			value, exists := record.Fields[field]
-			if !exists || !Equal(value, protoValue) {
-				continue RecordsLoop
-			}
+	scanned := 0
+	for _, record := range snap.records {
+		if err := checkScan(ctx, &scanned); err != nil {
+			return nil, err
+		}
+		record = t.withReadFields(record)
+		if matchesProtoFilters(record, protoFilters) {
+			matchedRecords = append(matchedRecords, record)
 		}
-
-		matchedRecords = append(matchedRecords, record)
 	}
 
 	// Convert matchedRecords to []Record
@@ -381,411 +710,1114 @@ RecordsLoop:
 
 // Select is a method of the Table struct that selects a record from the table based on the given key.
 // It locks the table for reading, ensuring that no other goroutines can modify the table while the selection is happening.
-// It then reads all existing records from the file where the table data is stored.
-// It converts the key to a string and checks if a record with that key exists in the table.
+// It serves the record from the lookup cache, or else from the records of the table held in memory, without reading
+// the file. It converts the key to a string and checks if a record with that key exists in the table.
 // If a record with that key does not exist, it returns an error and a nil record.
 // If a record with that key exists, it returns the record and a nil error.
 //
 // Parameters:
-// - key: An interface{} representing the key of the record to be selected. The key is converted to a string before the selection is performed.
+// - key: An interface{} representing the key of the record to be selected. The key is encoded with EncodeKey before the selection is performed.
 //
 // Returns:
 // - A pointer to a dbdata.Record instance representing the record with the given key.
 // - If a record with the given key does not exist, it returns an error and a nil record.
-// - If an error occurs while reading the records from the file, it returns the error and a nil record.
+// - If an error occurs while reloading the records of a table evicted by the cache policy, it returns the error and a nil record.
 // - If the operation is successful, it returns the record with the given key and a nil error.
 func (t *Table) Select(key interface{}) (Record, error) {
-	t.RLock()
-	defer t.RUnlock()
-
-	keyStr := fmt.Sprintf("%v", key)
+	return t.SelectCtx(context.Background(), key)
+}
 
-	if record, exists := t.Cache[keyStr]; exists {
-		t.metrics.IncrementCacheHits()
-		return fromProtoRecord(record)
+// SelectCtx selects a record like Select, observing the writes the consistency of ctx chooses, see WithConsistency.
+// It returns ctx.Err() if ctx is done before the record is looked up.
+func (t *Table) SelectCtx(ctx context.Context, key interface{}) (Record, error) {
+	defer t.sample("select", "", time.Now())
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	snap, err := t.readSnapshot(ctx)
+	if err != nil {
+		return nil, err
 	}
+	t.RLock()
+	defer t.RUnlock()
 
-	records, err := t.readRecordsFromFile()
+	keyStr, err := t.EncodeKey(key)
 	if err != nil {
 		return nil, err
 	}
 
-	record, exists := records.Records[keyStr]
-	if !exists {
-		return nil, fmt.Errorf("record with key %s not found", keyStr)
+	// The cache holds records of the current version, which durable reads do not see while writes are pending
+	if flushed := t.writeBehind.flushed.Load(); flushed != nil && ConsistencyOf(ctx) == ConsistencyDurable {
+		t.metrics.IncrementQueryCount()
+		record, exists := flushed.records[keyStr]
+		if !exists {
+			return nil, recordNotFound(keyStr)
+		}
+		return fromProtoRecord(t.withReadFields(record))
 	}
 
-	t.Cache[keyStr] = record
+	if cached, exists := t.Cache.Get(keyStr); exists {
+		t.metrics.IncrementCacheHits()
+		return fromProtoRecord(t.withReadFields(cached))
+	}
 	t.metrics.IncrementCacheMisses()
 	t.metrics.IncrementQueryCount()
-	return fromProtoRecord(record)
+
+	// Writes published since the snapshot was loaded are seen, so that only records of the current version are cached
+	if current := t.current.Load(); current != nil {
+		snap = current
+	}
+	record, exists := snap.records[keyStr]
+	if !exists {
+		return nil, recordNotFound(keyStr)
+	}
+	t.cacheRecord(keyStr, record)
+	return fromProtoRecord(t.withReadFields(record))
 }
 
 //UPDATE
 
 // Update is a method of the Table struct that updates a record in the table based on the given key.
 // It locks the table for writing, ensuring that no other goroutines can modify the table while the update is happening.
-// It first reads all existing records from the file where the table data is stored.
+// It first copies the records of the table held in memory, without reading the file.
 // If the primary key of the record to be updated does not exist in the table, it returns an error.
 // It then iterates over the fields in the updates map, updating each field in the existing record.
-// For each field, it checks if the field exists in the existing record.
-// If the field exists, it removes the existing record from the index for that field.
-// It then converts the new field value to a proto Value and updates the field in the existing record.
+// For each field, it converts the new field value to a proto Value and updates the field in the existing record.
 // If an error occurs during this conversion, it returns the error.
-// It then adds the updated record to the index for the field.
-// If the index for the field does not exist, it initializes it before adding the updated record.
-// It then writes the updated records back to the file.
+// It then writes the updated records back to the file, which also updates the indexes of the fields the changed records have.
 // If any error occurs during these operations, it returns the error.
 //
 // Parameters:
-// - key: An interface{} representing the key of the record to be updated. The key is converted to a string before the update is performed.
+// - key: An interface{} representing the key of the record to be updated. The key is encoded with EncodeKey before the update is performed.
 // - updates: A map representing the fields to be updated in the record. The keys are field names and the values are the new field values.
 //
 // Returns:
 // - If the operation is successful, it returns nil.
 // - If an error occurs, it returns the error.
 func (t *Table) Update(key interface{}, updates Record) error {
-	t.Lock()
-	defer t.Unlock()
+	return t.UpdateCtx(context.Background(), key, updates)
+}
 
-	keyStr := fmt.Sprintf("%v", key)
-	allRecords, err := t.readRecordsFromFile()
+// UpdateCtx updates a record like Update. It gives up without changing the table if ctx is done
+// before the record is written.
+func (t *Table) UpdateCtx(ctx context.Context, key interface{}, updates Record) error {
+	defer t.sample("update", "", time.Now())
+	unlock, err := t.lockWrite(ctx)
 	if err != nil {
 		return err
 	}
-	existingRecord, exists := allRecords.Records[keyStr]
-	if !exists {
-		return fmt.Errorf("record with key %s not found", keyStr)
-	}
+	defer unlock()
 
-	for field, newValue := range updates {
-		oldVal := existingRecord.Fields[field]
-		if oldVal != nil {
-			newIdxMap := make([]*dbdata.Record, 0)
-			for _, r := range t.Indexes[field] {
-				if r.Fields[field] != oldVal {
-					newIdxMap = append(newIdxMap, r)
-				}
-			}
-			t.Indexes[field] = newIdxMap
-		}
-		newVal, err := structpb.NewValue(newValue)
-		if err != nil {
-			return fmt.Errorf("error converting newValue for field %s: %v", field, err)
-		}
-		existingRecord.Fields[field] = newVal
-		t.Indexes[field] = append(t.Indexes[field], existingRecord)
-	}
-
-	t.Cache[keyStr] = existingRecord
-
-	t.metrics.IncrementUpdateCount()
-	return t.writeRecordsToFile(allRecords)
+	_, err = t.update(ctx, key, updates)
+	return err
 }
 
-// UpdateMany is a method of the Table struct that updates multiple records in the table based on the given keys and updates.
-// It locks the table for writing, ensuring that no other goroutines can modify the table while the updates are happening.
-// It first reads all existing records from the file where the table data is stored.
-// For each key, if the primary key of the record to be updated does not exist in the table, it returns an error for that key but continues with the rest.
-// It then iterates over the fields in the updates map, updating each field in the existing record.
-// For each field, it checks if the field exists in the existing record.
-// If the field exists, it removes the existing record from the index for that field.
-// It then converts the new field value to a proto Value and updates the field in the existing record.
-// If an error occurs during this conversion, it returns an error for that record but continues with the rest.
-// It then adds the updated record to the index for the field.
-// If the index for the field does not exist, it initializes it before adding the updated record.
-// It then writes the updated records back to the file.
-// If any error occurs during these operations, it returns an error for that record but continues with the rest.
-//
-// Parameters:
-// - updates: A map where the keys are the primary key values and the values are the updates to be applied to the records. Each value is a map representing the fields to be updated.
-//
-// Returns:
-// - A slice of errors for records that failed to update. If all records are updated successfully, the slice is empty.
-func (t *Table) UpdateMany(updates map[string]Record) []error {
-	t.Lock()
-	defer t.Unlock()
+// UpdateReturning updates a record like Update and returns the complete record after the update,
+// including server-generated fields such as the update timestamp.
+func (t *Table) UpdateReturning(key interface{}, updates Record) (Record, error) {
+	return t.UpdateReturningCtx(context.Background(), key, updates)
+}
 
-	allRecords, err := t.readRecordsFromFile()
+// UpdateReturningCtx updates a record like UpdateReturning, honoring ctx like UpdateCtx.
+func (t *Table) UpdateReturningCtx(ctx context.Context, key interface{}, updates Record) (Record, error) {
+	defer t.sample("update", "", time.Now())
+	unlock, err := t.lockWrite(ctx)
 	if err != nil {
-		return []error{fmt.Errorf("failed to read records from file: %w", err)}
+		return nil, err
 	}
+	defer unlock()
 
-	var errors []error
+	stored, err := t.update(ctx, key, updates)
+	if err != nil {
+		return nil, err
+	}
+	return fromProtoRecord(t.withReadFields(stored))
+}
 
-	for keyStr, updateFields := range updates {
+// update updates a record. The caller must hold the table write lock.
+func (t *Table) update(ctx context.Context, key interface{}, updates Record) (*dbdata.Record, error) {
+	allRecords, err := t.recordsForWrite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	keyStr, existingRecord, err := t.applyUpdate(allRecords, key, updates)
+	if err != nil {
+		return nil, err
+	}
+	t.Cache.Remove(keyStr)
+
+	t.metrics.IncrementUpdateCount()
+	if err := t.writeRecordsToFile(allRecords); err != nil {
+		return nil, err
+	}
+	t.logCommit("update", keyStr, existingRecord)
+	return existingRecord, nil
+}
+
+// applyUpdate applies the updates to the record with the given key in records, without writing the file.
+// It returns the key of the record and the updated record.
+func (t *Table) applyUpdate(records *dbdata.Records, key interface{}, updates Record) (string, *dbdata.Record, error) {
+	return t.applyChange(records, key, updates, false)
+}
+
+// applyChange applies the updates to the record with the given key in records like applyUpdate. If replace is set,
+// the fields of the record missing from the updates are removed, except the primary key and the creation timestamp.
+// The record is never changed in place, as it may be published: a changed copy replaces it in records, and only if
+// the change succeeds.
+func (t *Table) applyChange(records *dbdata.Records, key interface{}, updates Record, replace bool) (string, *dbdata.Record, error) {
+	keyStr, err := t.EncodeKey(key)
+	if err != nil {
+		return "", nil, err
+	}
+	existingRecord, exists := records.Records[keyStr]
+	if !exists {
+		return "", nil, recordNotFound(keyStr)
+	}
+
+	updates, err = t.beforeUpdate(keyStr, existingRecord, updates)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := t.checkClientEncrypted(updates); err != nil {
+		return "", nil, err
+	}
+	updates = t.withGeneratedFields(updates, false)
+	if updates, err = t.applySchema(t.Options.Schema, updates); err != nil {
+		return "", nil, err
+	}
+	if err := checkRules(t.Options.Rules, updates); err != nil {
+		return "", nil, err
+	}
+
+	newValues := make(map[string]*dbdata.Value, len(updates))
+	for field, newValue := range updates {
+		newVal, err := toProtoValue(newValue)
+		if err != nil {
+			return "", nil, fmt.Errorf("error converting newValue for field %s: %v", field, err)
+		}
+		newValues[field] = newVal
+	}
+	record := proto.Clone(existingRecord).(*dbdata.Record)
+	if replace {
+		for field := range record.Fields {
+			if _, kept := newValues[field]; !kept && field != t.PrimaryKey && !(t.Options.Timestamps && field == CreatedAtField) {
+				delete(record.Fields, field)
+			}
+		}
+	}
+	for field, newVal := range newValues {
+		record.Fields[field] = newVal
+	}
+	if err := t.applyComputedFields(record); err != nil {
+		return "", nil, err
+	}
+	sealRecord(record)
+	records.Records[keyStr] = record
+	return keyStr, record, nil
+}
+
+// ReplaceCtx stores the record under the given key, replacing the record the key has or inserting it if it has
+// none. Unlike UpdateCtx, the fields of the existing record missing from the new one are removed; the primary key and
+// the creation timestamp of the table are kept. The primary key of the record, if set, must be the given key.
+//
+// Parameters:
+// - ctx: The context of the write. The table is left unchanged if it is done before the record is written.
+// - key: The primary key value of the record to replace.
+// - record: The new fields of the record.
+//
+// Returns:
+// - The complete record as stored, including server-generated fields.
+// - Whether the record was inserted because the key had none.
+// - An error if the record could not be stored.
+func (t *Table) ReplaceCtx(ctx context.Context, key interface{}, record Record) (Record, bool, error) {
+	defer t.sample("update", "", time.Now())
+	unlock, err := t.lockWrite(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer unlock()
+
+	keyStr, err := t.EncodeKey(key)
+	if err != nil {
+		return nil, false, err
+	}
+	replacement := make(Record, len(record)+1)
+	for field, value := range record {
+		replacement[field] = value
+	}
+	if value, exists := replacement[t.PrimaryKey]; exists {
+		if encoded, err := t.EncodeKey(value); err != nil || encoded != keyStr {
+			return nil, false, fmt.Errorf("primary key field %s does not match the key %s", t.PrimaryKey, keyStr)
+		}
+	} else {
+		replacement[t.PrimaryKey] = key
+	}
+
+	allRecords, err := t.recordsForWrite(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	var stored *dbdata.Record
+	_, exists := allRecords.Records[keyStr]
+	if !exists {
+		if stored, err = t.insert(ctx, replacement); err != nil {
+			return nil, false, err
+		}
+	} else {
+		if _, stored, err = t.applyChange(allRecords, key, replacement, true); err != nil {
+			return nil, false, err
+		}
+		t.Cache.Remove(keyStr)
+		t.metrics.IncrementUpdateCount()
+		if err := t.writeRecordsToFile(allRecords); err != nil {
+			return nil, false, err
+		}
+		t.logCommit("update", keyStr, stored)
+	}
+	result, err := fromProtoRecord(t.withReadFields(stored))
+	return result, !exists, err
+}
+
+// UpdateMany is a method of the Table struct that updates multiple records in the table based on the given keys and updates.
+// It locks the table for writing, ensuring that no other goroutines can modify the table while the updates are happening.
+// It first copies the records of the table held in memory, without reading the file.
+// For each key, if the primary key of the record to be updated does not exist in the table, it returns an error for that key but continues with the rest.
+// It then iterates over the fields in the updates map, updating each field in the existing record.
+// For each field, it converts the new field value to a proto Value and updates the field in the existing record.
+// If an error occurs during this conversion, it returns an error for that record but continues with the rest.
+// It then writes the updated records back to the file, which also updates the indexes of the fields the changed records have.
+// If any error occurs during these operations, it returns an error for that record but continues with the rest.
+//
+// Parameters:
+// - updates: A map where the keys are the primary key values and the values are the updates to be applied to the records. Each value is a map representing the fields to be updated.
+//
+// Returns:
+// - A slice of errors for records that failed to update. If all records are updated successfully, the slice is empty.
+func (t *Table) UpdateMany(updates map[string]Record) []error {
+	defer t.sample("update_many", "", time.Now())
+	unlock, err := t.lockWrite(context.Background())
+	if err != nil {
+		return []error{err}
+	}
+	defer unlock()
+
+	allRecords, err := t.recordsForWrite(context.Background())
+	if err != nil {
+		return []error{fmt.Errorf("failed to load records: %w", err)}
+	}
+
+	var errors []error
+	var updated []string
+
+	for key, updateFields := range updates {
+		keyStr, err := t.EncodeKey(key)
+		if err != nil {
+			errors = append(errors, err)
+			continue
+		}
 		existingRecord, exists := allRecords.Records[keyStr]
 		if !exists {
-			errors = append(errors, fmt.Errorf("record with key %s not found", keyStr))
+			errors = append(errors, recordNotFound(keyStr))
+			continue
+		}
+		updateFields, err := t.beforeUpdate(keyStr, existingRecord, updateFields)
+		if err != nil {
+			errors = append(errors, err)
+			continue
+		}
+		if err := t.checkClientEncrypted(updateFields); err != nil {
+			errors = append(errors, fmt.Errorf("record with key %s: %v", keyStr, err))
+			continue
+		}
+		updateFields = t.withGeneratedFields(updateFields, false)
+		if updateFields, err = t.applySchema(t.Options.Schema, updateFields); err != nil {
+			errors = append(errors, fmt.Errorf("record with key %s: %w", keyStr, err))
+			continue
+		}
+		if err := checkRules(t.Options.Rules, updateFields); err != nil {
+			errors = append(errors, fmt.Errorf("record with key %s: %w", keyStr, err))
 			continue
 		}
 
+		// The updates are applied to a copy, so a record whose fields cannot be computed is left as it is
+		updatedRecord := proto.Clone(existingRecord).(*dbdata.Record)
 		for field, newValue := range updateFields {
-			oldVal := existingRecord.Fields[field]
-			if oldVal != nil {
-				newIdxMap := make([]*dbdata.Record, 0)
-				for _, r := range t.Indexes[field] {
-					if r.Fields[field] != oldVal {
-						newIdxMap = append(newIdxMap, r)
-					}
-				}
-				t.Indexes[field] = newIdxMap
-			}
-			newVal, err := structpb.NewValue(newValue)
+			newVal, err := toProtoValue(newValue)
 			if err != nil {
 				errors = append(errors, fmt.Errorf("error converting newValue for field %s in record with key %s: %v", field, keyStr, err))
 				continue
 			}
-			existingRecord.Fields[field] = newVal
-			t.Indexes[field] = append(t.Indexes[field], existingRecord)
+			updatedRecord.Fields[field] = newVal
 		}
+		if err := t.applyComputedFields(updatedRecord); err != nil {
+			errors = append(errors, fmt.Errorf("record with key %s: %w", keyStr, err))
+			continue
+		}
+		sealRecord(updatedRecord)
+		existingRecord = updatedRecord
+		allRecords.Records[keyStr] = existingRecord
 
-		t.Cache[keyStr] = existingRecord
+		t.Cache.Remove(keyStr)
 		t.metrics.IncrementUpdateCount()
+		updated = append(updated, keyStr)
 	}
 
 	if writeErr := t.writeRecordsToFile(allRecords); writeErr != nil {
 		return append(errors, fmt.Errorf("failed to write records to file: %w", writeErr))
 	}
 
+	for _, keyStr := range updated {
+		t.logCommit("update", keyStr, allRecords.Records[keyStr])
+	}
 	return errors
 }
 
+// UpdateWhere is a method of the Table struct that updates every record matching the given filters in a single locked pass.
+// It locks the table for writing, copies the records held in memory, and applies the updates to each record
+// whose fields are equal to all the filter values, the same way SelectWithFilter matches records.
+// The updated records are written back to the file once, and the number of affected records is returned.
+// If no record matches, the file is not rewritten.
+//
+// Parameters:
+// - filters: A map where the keys are field names and the values are the values the records must have. Empty or nil
+// filters match every record, so every record is updated.
+// - updates: A map representing the fields to be updated in each matching record.
+//
+// Returns:
+// - The number of updated records.
+// - If an error occurs, it returns the error and no record is updated.
+func (t *Table) UpdateWhere(filters map[string]interface{}, updates Record) (int, error) {
+	return t.UpdateWhereCtx(context.Background(), filters, updates)
+}
+
+// UpdateWhereCtx updates records like UpdateWhere. It gives up without changing the table if ctx is done
+// before the records are written.
+func (t *Table) UpdateWhereCtx(ctx context.Context, filters map[string]interface{}, updates Record) (int, error) {
+	defer t.sample("update_where", "", time.Now())
+	unlock, err := t.lockWrite(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	protoFilters, err := toProtoFilters(filters)
+	if err != nil {
+		return 0, err
+	}
+	return t.updateMatching(ctx, func(record *dbdata.Record) bool {
+		return matchesProtoFilters(record, protoFilters)
+	}, updates)
+}
+
+// updateMatching applies the updates to every record for which matches returns true, writing the file once.
+// It returns the number of updated records. The caller must hold the table write lock.
+func (t *Table) updateMatching(ctx context.Context, matches func(*dbdata.Record) bool, updates Record) (int, error) {
+	if err := t.checkClientEncrypted(updates); err != nil {
+		return 0, err
+	}
+	updates = t.withGeneratedFields(updates, false)
+	updates, err := t.applySchema(t.Options.Schema, updates)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkRules(t.Options.Rules, updates); err != nil {
+		return 0, err
+	}
+
+	protoUpdates := make(map[string]*dbdata.Value, len(updates))
+	for field, newValue := range updates {
+		newVal, err := toProtoValue(newValue)
+		if err != nil {
+			return 0, fmt.Errorf("error converting newValue for field %s: %v", field, err)
+		}
+		protoUpdates[field] = newVal
+	}
+
+	allRecords, err := t.recordsForWrite(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var updated []string
+	scanned := 0
+	for keyStr, record := range allRecords.Records {
+		if err := checkScan(ctx, &scanned); err != nil {
+			return 0, err
+		}
+		if matches(record) {
+			updated = append(updated, keyStr)
+		}
+	}
+	if len(updated) == 0 {
+		return 0, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	// Hooks may change the updates of each record, which are then converted again
+	hooked := make(map[string]map[string]*dbdata.Value, len(updated))
+	if len(t.hooks.beforeUpdate) > 0 {
+		for _, keyStr := range updated {
+			recordUpdates, err := t.beforeUpdate(keyStr, allRecords.Records[keyStr], updates)
+			if err != nil {
+				return 0, err
+			}
+			if err := t.checkClientEncrypted(recordUpdates); err != nil {
+				return 0, err
+			}
+			if recordUpdates, err = t.applySchema(t.Options.Schema, recordUpdates); err != nil {
+				return 0, err
+			}
+			if err := checkRules(t.Options.Rules, recordUpdates); err != nil {
+				return 0, fmt.Errorf("record with key %s: %w", keyStr, err)
+			}
+			hooked[keyStr] = make(map[string]*dbdata.Value, len(recordUpdates))
+			for field, newValue := range recordUpdates {
+				newVal, err := toProtoValue(newValue)
+				if err != nil {
+					return 0, fmt.Errorf("error converting newValue for field %s: %v", field, err)
+				}
+				hooked[keyStr][field] = newVal
+			}
+		}
+	}
+
+	for _, keyStr := range updated {
+		record := proto.Clone(allRecords.Records[keyStr]).(*dbdata.Record)
+		recordUpdates, exists := hooked[keyStr]
+		if !exists {
+			recordUpdates = protoUpdates
+		}
+		for field, newVal := range recordUpdates {
+			record.Fields[field] = proto.Clone(newVal).(*dbdata.Value)
+		}
+		if err := t.applyComputedFields(record); err != nil {
+			return 0, fmt.Errorf("record with key %s: %w", keyStr, err)
+		}
+		sealRecord(record)
+		allRecords.Records[keyStr] = record
+	}
+	for _, keyStr := range updated {
+		t.Cache.Remove(keyStr)
+	}
+
+	if err := t.writeRecordsToFile(allRecords); err != nil {
+		return 0, err
+	}
+	for _, keyStr := range updated {
+		t.metrics.IncrementUpdateCount()
+		t.logCommit("update", keyStr, allRecords.Records[keyStr])
+	}
+	return len(updated), nil
+}
+
 //DELETE
 
 // Delete is a method of the Table struct that deletes a record from the table based on the given key.
 // It locks the table for writing, ensuring that no other goroutines can modify the table while the deletion is happening.
-// It first reads all existing records from the file where the table data is stored.
+// It first copies the records of the table held in memory, without reading the file.
 // If the primary key of the record to be deleted does not exist in the table, it returns an error.
 // It then removes the record from the main records map.
-// It also updates the indexes. For each field in the record, it removes the record from the index for that field.
-// If the index for a field becomes empty after the removal of the record, it deletes the index.
-// It then writes the updated records back to the file.
+// It then writes the updated records back to the file, which also updates the indexes of the fields the changed records have.
 // If any error occurs during these operations, it returns the error.
 //
 // Parameters:
-// - key: An interface{} representing the key of the record to be deleted. The key is converted to a string before the deletion is performed.
+// - key: An interface{} representing the key of the record to be deleted. The key is encoded with EncodeKey before the deletion is performed.
 //
 // Returns:
 // - If the operation is successful, it returns nil.
 // - If an error occurs, it returns the error.
 func (t *Table) Delete(key interface{}) error {
-	t.Lock()
-	defer t.Unlock()
-
-	keyStr := fmt.Sprintf("%v", key)
+	return t.DeleteCtx(context.Background(), key)
+}
 
-	allRecords, err := t.readRecordsFromFile()
+// DeleteCtx deletes a record like Delete. It gives up without changing the table if ctx is done
+// before the remaining records are written.
+func (t *Table) DeleteCtx(ctx context.Context, key interface{}) error {
+	defer t.sample("delete", "", time.Now())
+	unlock, err := t.lockWrite(ctx)
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	record, exists := allRecords.Records[keyStr]
-	if !exists {
-		return fmt.Errorf("record with key %s not found", keyStr)
-	}
+	return t.delete(ctx, key)
+}
 
-	delete(allRecords.Records, keyStr)
-	delete(t.Cache, keyStr)
+// delete deletes a record. The caller must hold the table write lock.
+func (t *Table) delete(ctx context.Context, key interface{}) error {
+	allRecords, err := t.recordsForWrite(ctx)
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	for field := range record.Fields {
-		idxSlice := t.Indexes[field]
-		for i, rec := range idxSlice {
-			if recKeyValue, ok := rec.Fields[t.PrimaryKey]; ok && recKeyValue.GetStringValue() == keyStr {
-				t.Indexes[field] = append(idxSlice[:i], idxSlice[i+1:]...)
-				break
-			}
-		}
-		if len(t.Indexes[field]) == 0 {
-			delete(t.Indexes, field)
-		}
+	keyStr, err := t.applyDelete(allRecords, key)
+	if err != nil {
+		return err
 	}
+	t.Cache.Remove(keyStr)
 
 	t.metrics.IncrementDeleteCount()
-	return t.writeRecordsToFile(allRecords)
+	if err := t.writeRecordsToFile(allRecords); err != nil {
+		return err
+	}
+	t.logCommit("delete", keyStr, nil)
+	return nil
+}
+
+// applyDelete removes the record with the given key from records, without writing the file.
+// It returns the key of the removed record.
+func (t *Table) applyDelete(records *dbdata.Records, key interface{}) (string, error) {
+	keyStr, err := t.EncodeKey(key)
+	if err != nil {
+		return "", err
+	}
+	record, exists := records.Records[keyStr]
+	if !exists {
+		return "", recordNotFound(keyStr)
+	}
+	if err := t.beforeDelete(keyStr, record); err != nil {
+		return "", err
+	}
+	delete(records.Records, keyStr)
+	return keyStr, nil
 }
 
 // DeleteMany is a method of the Table struct that deletes multiple records from the table based on the given keys.
 // It locks the table for writing, ensuring that no other goroutines can modify the table while the deletion is happening.
-// It first reads all existing records from the file where the table data is stored.
+// It first copies the records of the table held in memory, without reading the file.
 // For each key, if the primary key of the record to be deleted does not exist in the table, it returns an error for that key but continues with the rest.
 // It then removes the record from the main records map.
-// It also updates the indexes. For each field in the record, it removes the record from the index for that field.
-// If the index for a field becomes empty after the removal of the record, it deletes the index.
-// It then writes the updated records back to the file.
+// It then writes the updated records back to the file, which also updates the indexes of the fields the changed records have.
 // If any error occurs during these operations, it returns the error.
 //
 // Parameters:
-// - keys: A slice of interface{} representing the keys of the records to be deleted. The keys are converted to strings before the deletion is performed.
+// - keys: A slice of interface{} representing the keys of the records to be deleted. The keys are encoded with EncodeKey before the deletion is performed.
 //
 // Returns:
 // - A slice of errors for keys that failed to delete. If all records are deleted successfully, the slice is empty.
 func (t *Table) DeleteMany(keys []interface{}) []error {
-	t.Lock()
-	defer t.Unlock()
+	defer t.sample("delete_many", "", time.Now())
+	unlock, err := t.lockWrite(context.Background())
+	if err != nil {
+		return []error{err}
+	}
+	defer unlock()
 
-	allRecords, err := t.readRecordsFromFile()
+	allRecords, err := t.recordsForWrite(context.Background())
 	if err != nil {
-		return []error{fmt.Errorf("failed to read records from file: %w", err)}
+		return []error{fmt.Errorf("failed to load records: %w", err)}
 	}
 
 	var errors []error
+	var deleted []string
 
 	for _, key := range keys {
-		keyProtoValue, err := toProtoValue(key)
+		keyStr, err := t.EncodeKey(key)
 		if err != nil {
 			errors = append(errors, err)
 			continue
 		}
-		keyStr := keyProtoValue.GetStringValue()
 
 		record, exists := allRecords.Records[keyStr]
 		if !exists {
-			errors = append(errors, fmt.Errorf("record with key %s not found", keyStr))
+			errors = append(errors, recordNotFound(keyStr))
+			continue
+		}
+		if err := t.beforeDelete(keyStr, record); err != nil {
+			errors = append(errors, err)
 			continue
 		}
 
 		delete(allRecords.Records, keyStr)
-		delete(t.Cache, keyStr)
-
-		for field := range record.Fields {
-			idxSlice := t.Indexes[field]
-			for i, rec := range idxSlice {
-				if recKeyValue, ok := rec.Fields[t.PrimaryKey]; ok && recKeyValue.GetStringValue() == keyStr {
-					t.Indexes[field] = append(idxSlice[:i], idxSlice[i+1:]...)
-					break
-				}
-			}
-			if len(t.Indexes[field]) == 0 {
-				delete(t.Indexes, field)
-			}
-		}
+		t.Cache.Remove(keyStr)
 
 		t.metrics.IncrementDeleteCount()
+		deleted = append(deleted, keyStr)
 	}
 
 	if writeErr := t.writeRecordsToFile(allRecords); writeErr != nil {
-		errors = append(errors, fmt.Errorf("failed to write records to file: %w", writeErr))
+		return append(errors, fmt.Errorf("failed to write records to file: %w", writeErr))
 	}
 
+	for _, keyStr := range deleted {
+		t.logCommit("delete", keyStr, nil)
+	}
 	return errors
 }
 
+// DeleteWhere is a method of the Table struct that deletes every record matching the given filters in a single locked pass.
+// It locks the table for writing, copies the records held in memory, and removes each record whose fields
+// are equal to all the filter values, the same way SelectWithFilter matches records.
+// The remaining records are written back to the file once, and the number of deleted records is returned.
+// If no record matches, the file is not rewritten.
+//
+// Parameters:
+// - filters: A map where the keys are field names and the values are the values the records must have. Empty or nil
+// filters match every record, so every record is deleted.
+//
+// Returns:
+// - The number of deleted records.
+// - If an error occurs, it returns the error and no record is deleted.
+func (t *Table) DeleteWhere(filters map[string]interface{}) (int, error) {
+	return t.DeleteWhereCtx(context.Background(), filters)
+}
+
+// DeleteWhereCtx deletes records like DeleteWhere. It gives up without changing the table if ctx is done
+// before the remaining records are written.
+func (t *Table) DeleteWhereCtx(ctx context.Context, filters map[string]interface{}) (int, error) {
+	defer t.sample("delete_where", "", time.Now())
+	unlock, err := t.lockWrite(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	protoFilters, err := toProtoFilters(filters)
+	if err != nil {
+		return 0, err
+	}
+	return t.deleteMatching(ctx, func(record *dbdata.Record) bool {
+		return matchesProtoFilters(record, protoFilters)
+	})
+}
+
+// deleteMatching removes every record for which matches returns true, writing the file once.
+// It returns the number of deleted records. The caller must hold the table write lock.
+func (t *Table) deleteMatching(ctx context.Context, matches func(*dbdata.Record) bool) (int, error) {
+	allRecords, err := t.recordsForWrite(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted []string
+	scanned := 0
+	for keyStr, record := range allRecords.Records {
+		if err := checkScan(ctx, &scanned); err != nil {
+			return 0, err
+		}
+		if matches(record) {
+			deleted = append(deleted, keyStr)
+		}
+	}
+	if len(deleted) == 0 {
+		return 0, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	for _, keyStr := range deleted {
+		if err := t.beforeDelete(keyStr, allRecords.Records[keyStr]); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, keyStr := range deleted {
+		delete(allRecords.Records, keyStr)
+		t.Cache.Remove(keyStr)
+	}
+	if err := t.writeRecordsToFile(allRecords); err != nil {
+		return 0, err
+	}
+	for _, keyStr := range deleted {
+		t.metrics.IncrementDeleteCount()
+		t.logCommit("delete", keyStr, nil)
+	}
+	return len(deleted), nil
+}
+
 //READER AND WRITER
 
 // readRecordsFromFile reads the records from the file
 func (t *Table) readRecordsFromFile() (*dbdata.Records, error) {
-	encryptedData, err := os.ReadFile(t.FilePath)
+	return t.readRecordsFromFileCtx(context.Background())
+}
+
+// readRecordsFromFileCtx reads the records from the file, returning ctx.Err() if ctx is done before they are decoded.
+// With the VerifyChecksums option it fails with a CorruptRecordsError if any record does not match its checksum.
+func (t *Table) readRecordsFromFileCtx(ctx context.Context) (*dbdata.Records, error) {
+	records, err := t.decodeRecordsFile(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if t.Options.VerifyChecksums {
+		if corrupted := corruptedKeys(records.Records); len(corrupted) > 0 {
+			return nil, &CorruptRecordsError{FilePath: t.FilePath, Keys: corrupted}
+		}
+	}
+	return records, nil
+}
+
+// decodeRecordsFile reads and decodes the records from the file without verifying their checksums.
+func (t *Table) decodeRecordsFile(ctx context.Context) (*dbdata.Records, error) {
+	if t.virtual || t.temporary {
+		// Callers change the records they read before writing them, which must not affect the published ones
+		records := proto.Clone(&dbdata.Records{Records: t.Records}).(*dbdata.Records)
+		if records.Records == nil {
+			records.Records = make(map[string]*dbdata.Record)
+		}
+		return records, nil
+	}
+	ctx, span := t.traceOperation(ctx, "table.read")
+	defer span.End()
+	records, err := t.decodeRecordsFileTraced(ctx)
+	span.SetError(err)
+	return records, err
+}
+
+// decodeRecordsFileTraced does the work of decodeRecordsFile, with a span for each step. The records of a segmented
+// table are read from its base file, or its latest full segment, and updated with the segments written after it.
+// The writes of the write-behind log of the table, if any, are applied last.
+func (t *Table) decodeRecordsFileTraced(ctx context.Context) (*dbdata.Records, error) {
+	segments, err := segmentFiles(t.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list segments: %v", err)
+	}
+	path, deltas := t.FilePath, segments
+	if i := lastFullSegment(segments); i >= 0 {
+		path, deltas = segments[i].path, segments[i+1:]
+	}
+	records, err := t.decodeStoredFile(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.applySegments(ctx, records, deltas); err != nil {
+		return nil, err
+	}
+	t.segments.count.Store(int64(len(segments)))
+	if _, err := t.replayPending(ctx, records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// decodeStoredFile reads and decodes the records of the file at path, upgrading them to the current format version.
+// A missing or empty file holds no records.
+func (t *Table) decodeStoredFile(ctx context.Context, path string) (*dbdata.Records, error) {
+	var storedData []byte
+	_, readSpan := StartSpan(ctx, "file.read")
+	err := t.retryPolicy().DoCtx(ctx, func() error {
+		var readErr error
+		storedData, readErr = os.ReadFile(path)
+		return readErr
+	})
+	readSpan.SetAttribute("dbproto.file.bytes", strconv.Itoa(len(storedData)))
+	if !os.IsNotExist(err) {
+		readSpan.SetError(err)
+	}
+	readSpan.End()
 	if err != nil {
 		if os.IsNotExist(err) {
 			return &dbdata.Records{Records: make(map[string]*dbdata.Record)}, nil
 		}
+		if ctxErr := ctx.Err(); ctxErr != nil && errors.Is(err, ctxErr) {
+			return nil, err
+		}
 		return nil, fmt.Errorf("failed to read file: %v", err)
 	}
 
-	if len(encryptedData) == 0 {
+	if len(storedData) == 0 {
 		return &dbdata.Records{Records: make(map[string]*dbdata.Record)}, nil
 	}
 
-	decryptedData, err := t.utils.Decrypt(string(encryptedData))
+	records, err := t.decodeRecords(ctx, storedData)
 	if err != nil {
-		return nil, fmt.Errorf("decryption failed: %v", err)
-	}
-
-	var records dbdata.Records
-	if err := proto.Unmarshal(decryptedData, &records); err != nil {
-		return nil, fmt.Errorf("proto unmarshal failed: %v", err)
+		return nil, err
 	}
 
 	if records.Records == nil {
 		records.Records = make(map[string]*dbdata.Record)
 	}
+	if records.FormatVersion < RecordsFormatVersion {
+		upgradeRecords(records)
+	}
 
-	return &records, nil
+	return records, nil
 }
 
-// writeRecordsToFile writes the records to the file
+// writeRecordsToFile writes the records to the file and publishes them. Tables in write-behind mode append the records
+// that changed to their write-behind log, publish them right away and leave the file to the next flush, see
+// WriteBehind, and segmented tables only write the records that changed, see Segmentation.
 func (t *Table) writeRecordsToFile(records *dbdata.Records) error {
-	data, err := proto.Marshal(records)
+	if t.virtual {
+		return ErrCatalogReadOnly
+	}
+	if t.closed.Load() {
+		return ErrClosed
+	}
+	if t.readOnly.Load() {
+		return ErrReadOnly
+	}
+	// Records written before checksums existed get one now, on a copy as they may be published; changed records were
+	// sealed when they were changed
+	for key, record := range records.Records {
+		if len(record.Checksum) == 0 {
+			sealed := proto.Clone(record).(*dbdata.Record)
+			sealRecord(sealed)
+			records.Records[key] = sealed
+		}
+	}
+
+	records.FormatVersion = RecordsFormatVersion
+	if t.temporary {
+		if t.dropped && t.Options.InMemory {
+			return ErrTableDropped
+		} else if t.dropped {
+			return ErrTempTableDropped
+		}
+		t.publish(records.Records)
+		return nil
+	}
+	if t.dropped {
+		return ErrTableDropped
+	}
+	if err := t.discardStaleLog(); err != nil {
+		return err
+	}
+	segmented := t.Options.Segmentation != nil
+	var changed map[string]struct{}
+	if segmented || t.Options.WriteBehind != nil {
+		changed = changedKeys(t.Records, records.Records)
+	}
+	if t.Options.WriteBehind != nil {
+		if err := t.logPending(records.Records, changed); err != nil {
+			return err
+		}
+		t.deferBefore()
+		t.publish(records.Records)
+		if segmented {
+			t.trackChanges(changed)
+		}
+		t.deferWrite()
+		return nil
+	}
+	var err error
+	if segmented {
+		err = t.storeChanges(records.Records, changed)
+	} else {
+		err = t.storeRecords(records)
+	}
 	if err != nil {
-		return fmt.Errorf("error marshaling records: %v", err)
+		return err
 	}
-	encryptedData, err := t.utils.Encrypt(data)
+	t.publish(records.Records)
+	return nil
+}
+
+// storeRecords marshals and encodes the records and replaces the content of the file with them.
+func (t *Table) storeRecords(records *dbdata.Records) error {
+	return t.storeRecordsAt(t.FilePath, records)
+}
+
+// storeRecordsAt marshals and encodes the records and replaces the content of the file at path with them.
+func (t *Table) storeRecordsAt(path string, records *dbdata.Records) error {
+	ctx := t.traceCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, span := t.traceOperation(ctx, "table.write")
+	defer span.End()
+	span.SetAttribute("dbproto.records", strconv.Itoa(len(records.Records)))
+
+	encodedData, err := t.encodeRecords(ctx, records)
 	if err != nil {
-		return fmt.Errorf("error encrypting data: %v", err)
+		span.SetError(err)
+		return err
 	}
 
-	// Use batch writing with buffer
-	file, err := os.OpenFile(t.FilePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	// Use batch writing with buffer, retrying the whole write after transient errors
+	_, writeSpan := StartSpan(ctx, "file.write")
+	writeSpan.SetAttribute("dbproto.file.bytes", strconv.Itoa(len(encodedData)))
+	err = t.retryPolicy().Do(func() error {
+		return writeFileBuffered(path, encodedData)
+	})
+	writeSpan.SetError(err)
+	writeSpan.End()
 	if err != nil {
-		return fmt.Errorf("error opening file '%s': %v", t.FilePath, err)
+		span.SetError(err)
+		return err
 	}
+	return nil
+}
+
+// writeFileBuffered replaces the file at filePath with data. The data is written to a temporary file next to it,
+// which is flushed to stable storage and closed before it is renamed over the file, so a crash or a failed write
+// leaves the previous content in place rather than a truncated file. Temporary files end in .tmp, which loading and
+// backups skip.
+func writeFileBuffered(filePath string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file for '%s': %w", filePath, err)
+	}
+	defer os.Remove(file.Name())
 	defer file.Close()
 
 	writer := bufio.NewWriter(file)
-	_, err = writer.Write([]byte(encryptedData))
-	if err != nil {
-		return fmt.Errorf("error writing to file '%s': %v", t.FilePath, err)
+	if _, err := writer.Write(data); err != nil {
+		return fmt.Errorf("error writing to file '%s': %w", filePath, err)
 	}
 	if err := writer.Flush(); err != nil {
-		return fmt.Errorf("error flushing writer: %v", err)
+		return fmt.Errorf("error flushing writer: %w", err)
+	}
+	if err := file.Chmod(0644); err != nil {
+		return fmt.Errorf("error writing to file '%s': %w", filePath, err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("error syncing file '%s': %w", filePath, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error closing file '%s': %w", filePath, err)
+	}
+	if err := os.Rename(file.Name(), filePath); err != nil {
+		return fmt.Errorf("error replacing file '%s': %w", filePath, err)
+	}
+	return nil
+}
+
+// sync waits for the writes in progress on the table, writes the changes write-behind left pending to the file and
+// flushes it and its segments to stable storage, so the writes that returned survive a power loss. Tables only held
+// in memory have nothing to flush, and neither do read-only tables, whose files are never opened for writing.
+func (t *Table) sync() error {
+	if t.virtual || t.temporary || t.readOnly.Load() {
+		return nil
 	}
+	t.Lock()
+	defer t.Unlock()
+	return t.syncFiles()
+}
 
-	t.Records = records.Records
+// syncFiles writes the changes write-behind left pending and flushes the file and the segments of the table to
+// stable storage, see sync. The caller must hold the table write lock.
+func (t *Table) syncFiles() error {
+	if err := t.flushPending(); err != nil {
+		return err
+	}
+	if err := syncFile(t.FilePath); err != nil {
+		return err
+	}
+	segments, err := segmentFiles(t.FilePath)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if err := syncFile(segment.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// syncFile flushes the file at filePath to stable storage, if it exists.
+func syncFile(filePath string) error {
+	file, err := os.OpenFile(filePath, os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error opening file '%s': %w", filePath, err)
+	}
+	defer file.Close()
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("error syncing file '%s': %w", filePath, err)
+	}
 	return nil
 }
 
 //Utils
 
-// Equal checks if two structpb.Value are equal
-func Equal(value1, value2 *structpb.Value) bool {
+// Equal checks if two dbdata.Value are equal. Integers and floating point numbers are equal if they have the same
+// numeric value, and timestamps if they are the same instant, whatever their UTC offset. Objects are equal if they
+// have the same fields with equal values, and lists if they hold equal values in the same order.
+func Equal(value1, value2 *dbdata.Value) bool {
 	if value1.GetKind() == nil || value2.GetKind() == nil {
 		return false
 	}
 
-	switch value1.GetKind().(type) {
-	case *structpb.Value_NumberValue:
+	switch v1 := value1.GetKind().(type) {
+	case *dbdata.Value_IntValue:
+		switch v2 := value2.GetKind().(type) {
+		case *dbdata.Value_IntValue:
+			return v1.IntValue == v2.IntValue
+		case *dbdata.Value_NumberValue:
+			return float64(v1.IntValue) == v2.NumberValue
+		}
+		return false
+	case *dbdata.Value_NumberValue:
+		if v2, ok := value2.GetKind().(*dbdata.Value_IntValue); ok {
+			return v1.NumberValue == float64(v2.IntValue)
+		}
 		return value1.GetNumberValue() == value2.GetNumberValue()
-	case *structpb.Value_StringValue:
+	case *dbdata.Value_StringValue:
 		return value1.GetStringValue() == value2.GetStringValue()
-	case *structpb.Value_BoolValue:
+	case *dbdata.Value_BoolValue:
 		return value1.GetBoolValue() == value2.GetBoolValue()
-	case *structpb.Value_StructValue:
-		return false
-	case *structpb.Value_ListValue:
-
-		return false
+	case *dbdata.Value_BytesValue:
+		_, ok := value2.GetKind().(*dbdata.Value_BytesValue)
+		return ok && bytes.Equal(v1.BytesValue, value2.GetBytesValue())
+	case *dbdata.Value_TimestampValue:
+		v2, ok := value2.GetKind().(*dbdata.Value_TimestampValue)
+		return ok && v1.TimestampValue.AsTime().Equal(v2.TimestampValue.AsTime())
+	case *dbdata.Value_NullValue:
+		return isNullValue(value2)
+	case *dbdata.Value_StructValue:
+		v2, ok := value2.GetKind().(*dbdata.Value_StructValue)
+		return ok && equalStructs(v1.StructValue, v2.StructValue)
+	case *dbdata.Value_ListValue:
+		v2, ok := value2.GetKind().(*dbdata.Value_ListValue)
+		return ok && equalLists(v1.ListValue, v2.ListValue)
 	default:
 		return false
 	}
 }
 
+// isNullValue reports whether the value is a stored NULL, as opposed to a missing field.
+func isNullValue(value *dbdata.Value) bool {
+	_, ok := value.GetKind().(*dbdata.Value_NullValue)
+	return ok
+}
+
+// toProtoFilters converts filter values to protobuf values so they can be compared with record fields.
+func toProtoFilters(filters map[string]interface{}) (map[string]*dbdata.Value, error) {
+	protoFilters := make(map[string]*dbdata.Value, len(filters))
+	for field, filterValue := range filters {
+		protoValue, err := toProtoValue(filterValue)
+		if err != nil {
+			return nil, fmt.Errorf("error converting filter value for field %s: %v", field, err)
+		}
+		protoFilters[field] = protoValue
+	}
+	return protoFilters, nil
+}
+
+// matchesProtoFilters checks if a record has every filtered field with a value equal to the filter value.
+func matchesProtoFilters(record *dbdata.Record, protoFilters map[string]*dbdata.Value) bool {
+	for field, protoValue := range protoFilters {
+		value, exists := fieldValue(record, field)
+		if !exists || !Equal(value, protoValue) {
+			return false
+		}
+	}
+	return true
+}
+
 // toProtoValue converts a given value to a protobuf value.
-// It supports conversion for int, int32, int64, float32, float64 and other types that can be directly converted to a protobuf value.
-// For int, int32 and int64, it converts the value to a string and then to a protobuf string value.
-// For float32 and float64, it converts the value to a protobuf number value.
-// For other types, it directly converts the value to a protobuf value.
+// Integers are stored as protobuf integer values and float32 and float64 values as protobuf number values.
+// Byte slices are stored as protobuf bytes values and time.Time values as protobuf timestamp values.
+// For nil, it returns a protobuf null value, which is stored and kept distinct from a missing field.
+// For other types, it converts the value like structpb.NewValue does.
 // It returns the converted protobuf value and an error if the conversion fails.
-func toProtoValue(value interface{}) (*structpb.Value, error) {
-	switch v := value.(type) {
-	case int:
-		return structpb.NewStringValue("num:" + strconv.FormatInt(int64(v), 10)), nil
-	case int32:
-		return structpb.NewStringValue("num:" + strconv.FormatInt(int64(v), 10)), nil
-	case int64:
-		return structpb.NewStringValue("num:" + strconv.FormatInt(v, 10)), nil
-	case float32:
-		return structpb.NewNumberValue(float64(v)), nil
-	case float64:
-		return structpb.NewNumberValue(v), nil
-	case string:
-		return structpb.NewStringValue(v), nil
-	case bool:
-		return structpb.NewBoolValue(v), nil
-	default:
-		return structpb.NewValue(value)
-	}
+func toProtoValue(value interface{}) (*dbdata.Value, error) {
+	return dbdata.NewValue(value)
 }
 
 // fromProtoRecord converts a protobuf record to a map record.
@@ -804,32 +1836,53 @@ func fromProtoRecord(protoRecord *dbdata.Record) (Record, error) {
 	return record, nil
 }
 
+// RecordToProto converts a record to a protobuf record, converting each value like the tables do when they store it,
+// for clients exchanging records as protobuf messages. The checksum of the returned record is not set.
+func RecordToProto(record Record) (*dbdata.Record, error) {
+	protoRecord := &dbdata.Record{Fields: make(map[string]*dbdata.Value, len(record))}
+	for key, value := range record {
+		protoValue, err := toProtoValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value type for field '%s': %v", key, err)
+		}
+		protoRecord.Fields[key] = protoValue
+	}
+	return protoRecord, nil
+}
+
+// RecordFromProto converts a protobuf record to a record, with its values converted like ValueFromProto does.
+func RecordFromProto(protoRecord *dbdata.Record) (Record, error) {
+	return fromProtoRecord(protoRecord)
+}
+
+// ValueFromProto converts a protobuf value to the Go value the tables return for it, such as int64 for integers and
+// time.Time for timestamps.
+func ValueFromProto(protoValue *dbdata.Value) (interface{}, error) {
+	return fromProtoValue(protoValue)
+}
+
 // fromProtoValue converts a protobuf value to a Go value.
-// It supports conversion for protobuf string value and protobuf number value.
-// For protobuf string value, it attempts to parse the string as an int and returns the int value if the parsing is successful.
-// If the parsing fails, it returns the string value.
-// For protobuf number value, it returns the number value.
+// Protobuf string values are returned as strings, integer values as int64 and number values as float64.
+// Protobuf bytes values are returned as []byte and timestamp values as time.Time in their stored UTC offset.
+// For protobuf null value, it returns nil.
 // For other types, it directly returns the value as interface{}.
 // It returns the converted Go value and an error if the conversion fails.
-func fromProtoValue(protoValue *structpb.Value) (interface{}, error) {
+func fromProtoValue(protoValue *dbdata.Value) (interface{}, error) {
 	switch v := protoValue.GetKind().(type) {
-	case *structpb.Value_StringValue:
-		// Check for the special prefix
-		if len(v.StringValue) > 4 && v.StringValue[:4] == "num:" {
-			intValue, err := strconv.ParseInt(v.StringValue[4:], 10, 64)
-			if err != nil {
-				return nil, err
-			}
-			return intValue, nil
-		}
-		if len(v.StringValue) > 4 && v.StringValue[:4] == "str:" {
-			return v.StringValue[4:], nil
-		}
+	case *dbdata.Value_StringValue:
 		return v.StringValue, nil
-	case *structpb.Value_NumberValue:
+	case *dbdata.Value_IntValue:
+		return v.IntValue, nil
+	case *dbdata.Value_NumberValue:
 		return v.NumberValue, nil
-	case *structpb.Value_BoolValue:
+	case *dbdata.Value_BoolValue:
 		return v.BoolValue, nil
+	case *dbdata.Value_BytesValue:
+		return v.BytesValue, nil
+	case *dbdata.Value_TimestampValue:
+		return v.TimestampValue.AsTime(), nil
+	case *dbdata.Value_NullValue:
+		return nil, nil
 	default:
 		return protoValue.AsInterface(), nil
 	}
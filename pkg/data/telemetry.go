@@ -0,0 +1,166 @@
+package data
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	telemetryBatch         = 512              // telemetryBatch is the number of samples exported together.
+	telemetryFlushInterval = 10 * time.Second // telemetryFlushInterval is how often samples are exported when fewer than a batch are waiting.
+)
+
+// OperationSample is the anonymized shape of an operation on a table. It never holds record contents, keys, field
+// names or table names, so it can be exported to external telemetry systems without leaking data.
+type OperationSample struct {
+	Operation  string        // Operation is the kind of operation, such as "insert", "select" or "query".
+	SizeBucket string        // SizeBucket is the order of magnitude of the number of records of the table, such as "<1k".
+	Latency    time.Duration // Latency is how long the operation took, including waiting for the table.
+	Plan       string        // Plan is how a query found its records, "index" or "full scan", empty for other operations.
+	Time       time.Time     // Time is when the operation started.
+}
+
+// TelemetryExporter sends batches of operation samples to a telemetry system.
+type TelemetryExporter interface {
+	Export(samples []OperationSample) error
+}
+
+// Telemetry samples the operations of the tables it is set on and exports their shapes in batches from a background
+// goroutine, so that operators can plan capacity without logging record contents. Operations never wait for the
+// exporter: samples that arrive while a full batch is waiting to be exported are dropped.
+type Telemetry struct {
+	exporter TelemetryExporter
+	rate     float64
+	samples  chan OperationSample
+	done     chan struct{}
+	stop     sync.Once
+	dropped  atomic.Int64
+}
+
+// NewTelemetry starts sampling the given fraction of operations, between 0 and 1, and exporting them to exporter.
+// Close must be called to export the last samples and stop the background goroutine.
+func NewTelemetry(exporter TelemetryExporter, sampleRate float64) *Telemetry {
+	t := &Telemetry{
+		exporter: exporter,
+		rate:     sampleRate,
+		samples:  make(chan OperationSample, telemetryBatch),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Record adds an operation sample, unless it is left out by the sample rate or the exporter has fallen behind.
+func (t *Telemetry) Record(sample OperationSample) {
+	if t.rate < 1 && rand.Float64() >= t.rate {
+		return
+	}
+	select {
+	case t.samples <- sample:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of sampled operations that were dropped because the exporter fell behind.
+func (t *Telemetry) Dropped() int64 {
+	return t.dropped.Load()
+}
+
+// Close exports the samples still waiting and stops the telemetry. Samples recorded afterwards are dropped.
+func (t *Telemetry) Close() {
+	t.stop.Do(func() {
+		t.samples <- OperationSample{} // The zero sample tells run to export and stop
+		<-t.done
+	})
+}
+
+// run exports the samples in batches, when a batch is full or every telemetryFlushInterval, until Close.
+func (t *Telemetry) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(telemetryFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]OperationSample, 0, telemetryBatch)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(batch); err != nil {
+			log.Printf("Failed to export %d telemetry samples: %v", len(batch), err)
+		}
+		batch = make([]OperationSample, 0, telemetryBatch)
+	}
+	for {
+		select {
+		case sample := <-t.samples:
+			if sample.Operation == "" {
+				export()
+				return
+			}
+			batch = append(batch, sample)
+			if len(batch) == telemetryBatch {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		}
+	}
+}
+
+// SetTelemetry makes the table record the shapes of its operations to the given telemetry. Passing nil disables it.
+func (t *Table) SetTelemetry(telemetry *Telemetry) {
+	t.telemetry.Store(telemetry)
+}
+
+// sample records the shape of an operation of the table that started at start, if telemetry is set, and reports
+// reads to the plugins of the table. The plan is only given for queries.
+func (t *Table) sample(operation, plan string, start time.Time) {
+	t.reportQuery(operation, plan, start)
+	telemetry := t.telemetry.Load()
+	if telemetry == nil {
+		return
+	}
+	size := 0
+	if snap := t.current.Load(); snap != nil { // An evicted table is not loaded just to be measured
+		size = len(snap.records)
+	}
+	telemetry.Record(OperationSample{
+		Operation:  operation,
+		SizeBucket: sizeBucket(size),
+		Latency:    time.Since(start),
+		Plan:       plan,
+		Time:       start,
+	})
+}
+
+// sizeBucket returns the order of magnitude of a number of records, which hides the exact size of a table.
+func sizeBucket(records int) string {
+	switch {
+	case records < 10:
+		return "<10"
+	case records < 100:
+		return "<100"
+	case records < 1000:
+		return "<1k"
+	case records < 10000:
+		return "<10k"
+	case records < 100000:
+		return "<100k"
+	case records < 1000000:
+		return "<1M"
+	default:
+		return ">=1M"
+	}
+}
+
+// planKind names how an execution plan finds its records, for telemetry.
+func planKind(plan ExecutionPlan) string {
+	if plan.IndexToUse != "" {
+		return "index"
+	}
+	return "full scan"
+}
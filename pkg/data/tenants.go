@@ -0,0 +1,220 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// tenantsDir is the directory next to the databases directory of the root server, and inside its backup directory,
+// holding a directory per tenant. The directory of a tenant holds its databases, quarantine and migrations
+// directories, or its backups and exports.
+const tenantsDir = "tenants"
+
+// ErrTenantNotFound is returned for a tenant that does not exist.
+var ErrTenantNotFound = errors.New("tenant not found")
+
+// dataDir returns the directory holding the databases, quarantine and migrations directories of the server.
+func (s *Server) dataDir() string {
+	dir := filepath.Dir(getDefaultServerDir())
+	if s.tenant != "" {
+		dir = filepath.Join(dir, tenantsDir, s.tenant)
+	}
+	return dir
+}
+
+// databasesDir returns the directory holding the databases of the server.
+func (s *Server) databasesDir() string {
+	return filepath.Join(s.dataDir(), "databases")
+}
+
+// backupBaseDir returns the directory the backups and exports of the server are written to.
+func (s *Server) backupBaseDir() string {
+	dir := getDefaultBackUpDir()
+	if s.tenant != "" {
+		dir = filepath.Join(dir, tenantsDir, s.tenant)
+	}
+	return dir
+}
+
+// TenantName returns the tenant whose databases the server holds, or an empty string for the root server.
+func (s *Server) TenantName() string {
+	return s.tenant
+}
+
+// CreateTenant is a method of the Server struct that creates a tenant, with a server of its own holding its
+// databases in a directory of their own, which Tenant returns. Tenants share the settings of the root server, such
+// as its commit log and limits, but not its databases, users, roles or jobs: the databases of a tenant are only
+// reachable through its server. Only the root server has tenants.
+//
+// Parameters:
+// - name: The name of the tenant, which must be a valid file name.
+//
+// Returns:
+// - ErrInvalidName if the name is invalid, ErrNameTaken if the tenant exists, or an error if the server is the server
+// of a tenant or the directory of the tenant cannot be created. If the operation is successful, the error is nil.
+func (s *Server) CreateTenant(name string) error {
+	if s.root != nil {
+		return fmt.Errorf("tenant %s cannot have tenants of its own", s.tenant)
+	}
+	if !ValidFilename(name) {
+		return fmt.Errorf("%w: invalid tenant name: %s", ErrInvalidName, name)
+	}
+	if err := s.writable(); err != nil {
+		return err
+	}
+	s.tenantsLock.Lock()
+	defer s.tenantsLock.Unlock()
+	if _, exists := s.tenants[name]; exists {
+		return fmt.Errorf("%w: tenant %s already exists", ErrNameTaken, name)
+	}
+	tenant := s.newTenant(name)
+	if _, err := os.Stat(tenant.dataDir()); err == nil {
+		return fmt.Errorf("%w: directory of tenant %s already exists", ErrNameTaken, name)
+	}
+	if err := tenant.Initialize(); err != nil {
+		return fmt.Errorf("failed to create tenant %s: %v", name, err)
+	}
+	s.addTenant(tenant)
+	return nil
+}
+
+// Tenant returns the server of a tenant, whose methods work on the databases of the tenant like the methods of the
+// root server work on its own. An empty name, or the name of the tenant of the server, returns the server itself.
+//
+// Parameters:
+// - name: The name of the tenant.
+//
+// Returns:
+// - A pointer to the Server of the tenant.
+// - ErrTenantNotFound if the tenant does not exist, or is asked for on the server of another tenant.
+func (s *Server) Tenant(name string) (*Server, error) {
+	if name == "" || name == s.tenant {
+		return s, nil
+	}
+	s.tenantsLock.Lock()
+	defer s.tenantsLock.Unlock()
+	tenant, exists := s.tenants[name]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrTenantNotFound, name)
+	}
+	return tenant, nil
+}
+
+// ListTenants returns the names of the tenants, sorted. Only the root server has tenants.
+func (s *Server) ListTenants() []string {
+	s.tenantsLock.Lock()
+	defer s.tenantsLock.Unlock()
+	names := make([]string, 0, len(s.tenants))
+	for name := range s.tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadTenants loads every tenant of the tenants directory, see Initialize.
+func (s *Server) loadTenants() error {
+	entries, err := os.ReadDir(filepath.Join(s.dataDir(), tenantsDir))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to read tenants directory: %v", err)
+	}
+	s.tenantsLock.Lock()
+	defer s.tenantsLock.Unlock()
+	for _, entry := range entries {
+		if !entry.IsDir() || !ValidFilename(entry.Name()) {
+			continue
+		}
+		if _, loaded := s.tenants[entry.Name()]; loaded {
+			continue
+		}
+		tenant := s.newTenant(entry.Name())
+		if err := tenant.Initialize(); err != nil {
+			return fmt.Errorf("tenant %s: %v", entry.Name(), err)
+		}
+		s.addTenant(tenant)
+	}
+	return nil
+}
+
+// newTenant returns the server of a tenant with the settings of the server, which it applies to every database of
+// the tenant. The caller must hold the tenants lock.
+func (s *Server) newTenant(name string) *Server {
+	tenant := NewServer()
+	tenant.tenant = name
+	tenant.root = s
+
+	s.RLock()
+	defer s.RUnlock()
+	tenant.commitLog = s.commitLog
+	tenant.limits = s.limits
+	if s.roleLimits != nil {
+		tenant.roleLimits = make(map[string]Limits, len(s.roleLimits))
+		for role, limits := range s.roleLimits {
+			tenant.roleLimits[role] = limits
+		}
+	}
+	tenant.throttle = s.throttle
+	tenant.generators = s.generators
+	tenant.telemetry = s.telemetry
+	tenant.plugins = s.plugins
+	tenant.plaintext = s.plaintext
+	tenant.backupRetention = s.backupRetention
+	tenant.destination = s.destination
+	tenant.readOnly.Store(s.readOnly.Load())
+	return tenant
+}
+
+// addTenant adds the server of a tenant to the tenants of the server. The caller must hold the tenants lock.
+func (s *Server) addTenant(tenant *Server) {
+	if s.tenants == nil {
+		s.tenants = make(map[string]*Server)
+	}
+	s.tenants[tenant.tenant] = tenant
+}
+
+// tenantServers returns the servers of the tenants, sorted by name. It must not be called while holding the server
+// lock, as newTenant takes the server lock while holding the tenants lock.
+func (s *Server) tenantServers() []*Server {
+	s.tenantsLock.Lock()
+	defer s.tenantsLock.Unlock()
+	servers := make([]*Server, 0, len(s.tenants))
+	for _, tenant := range s.tenants {
+		servers = append(servers, tenant)
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].tenant < servers[j].tenant })
+	return servers
+}
+
+// forEachTenant calls fn with the server of every tenant, so the settings of the root server reach the databases of
+// its tenants. The setters defer it before taking the server lock, so it runs once they release it: a tenant being
+// loaded meanwhile either copies the new setting or is passed to fn.
+func (s *Server) forEachTenant(fn func(tenant *Server)) {
+	s.tenantsLock.Lock()
+	defer s.tenantsLock.Unlock()
+	for _, tenant := range s.tenants {
+		fn(tenant)
+	}
+}
+
+// tenantSuffix returns " of tenant <name>" for the server of a tenant, to be appended to its log messages, and an
+// empty string for the root server.
+func (s *Server) tenantSuffix() string {
+	if s.tenant == "" {
+		return ""
+	}
+	return " of tenant " + s.tenant
+}
+
+// credentialServer returns the server holding the API keys of the server: the root server for the server of a
+// tenant, whose keys are found by their ID alone, without knowing the tenant first.
+func (s *Server) credentialServer() *Server {
+	if s.root != nil {
+		return s.root
+	}
+	return s
+}
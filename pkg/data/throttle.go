@@ -0,0 +1,127 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// WriteThrottle applies backpressure to the writes of a table. Writes are flushed to the table file one at a time
+// while holding the table write lock, so a burst of writes queues up behind the lock, each holding its records in
+// memory. Past DelayAfter pending writes, new writes are delayed, and past RejectAfter they fail with a
+// BackpressureError so clients can back off instead of piling up. A zero field disables its threshold.
+type WriteThrottle struct {
+	DelayAfter  int           `json:"delayAfter,omitempty"`  // DelayAfter is the number of pending writes after which new writes are delayed.
+	RejectAfter int           `json:"rejectAfter,omitempty"` // RejectAfter is the number of pending writes after which new writes are rejected.
+	MaxDelay    time.Duration `json:"maxDelay,omitempty"`    // MaxDelay is the delay of a write admitted with RejectAfter writes pending.
+}
+
+// delay returns how long a write is delayed when pending writes, including it, are waiting for the table.
+// The delay grows linearly from nothing at DelayAfter to MaxDelay at RejectAfter.
+func (w WriteThrottle) delay(pending int) time.Duration {
+	if w.DelayAfter <= 0 || w.MaxDelay <= 0 || pending <= w.DelayAfter {
+		return 0
+	}
+	if w.RejectAfter <= w.DelayAfter {
+		return w.MaxDelay
+	}
+	delay := w.MaxDelay * time.Duration(pending-w.DelayAfter) / time.Duration(w.RejectAfter-w.DelayAfter)
+	if delay > w.MaxDelay {
+		return w.MaxDelay
+	}
+	return delay
+}
+
+// retryAfter returns how long a rejected client should wait before retrying: MaxDelay, or a second without one.
+func (w WriteThrottle) retryAfter() time.Duration {
+	if w.MaxDelay > 0 {
+		return w.MaxDelay
+	}
+	return time.Second
+}
+
+// BackpressureError is returned by a write rejected because too many writes are already pending on its table.
+// The write changed nothing and can be retried after RetryAfter.
+type BackpressureError struct {
+	Table      string        // Table is the file path of the table.
+	Pending    int           // Pending is the number of writes that were pending on the table.
+	Limit      int           // Limit is the RejectAfter threshold of the table.
+	RetryAfter time.Duration // RetryAfter is how long the client should wait before retrying.
+}
+
+func (e *BackpressureError) Error() string {
+	return fmt.Sprintf("too many pending writes: %d writes are waiting for table %s (limit %d), retry after %v", e.Pending, e.Table, e.Limit, e.RetryAfter)
+}
+
+// SetWriteThrottle sets the backpressure applied to the writes of the table. It takes effect for writes that
+// start afterwards and does not wait for pending writes.
+func (t *Table) SetWriteThrottle(throttle WriteThrottle) {
+	t.throttle.Store(&throttle)
+}
+
+// PendingWrites returns the number of writes that are waiting for the table or being written, the backlog that the
+// write throttle applies to.
+func (t *Table) PendingWrites() int {
+	t.metrics.RLock()
+	defer t.metrics.RUnlock()
+	return t.metrics.PendingWrites
+}
+
+// admitWrite counts a write as pending on the table, delaying it or rejecting it with a BackpressureError when
+// the backlog is over the thresholds of the write throttle. It returns ctx.Err() if ctx is done while the write
+// is delayed. A write admitted without an error must be ended with metrics.finishWrite.
+func (t *Table) admitWrite(ctx context.Context) error {
+	t.touch()
+	var throttle WriteThrottle
+	if current := t.throttle.Load(); current != nil {
+		throttle = *current
+	}
+
+	pending, admitted := t.metrics.startWrite(throttle.RejectAfter)
+	if !admitted {
+		return &BackpressureError{Table: t.FilePath, Pending: pending, Limit: throttle.RejectAfter, RetryAfter: throttle.retryAfter()}
+	}
+	if delay := throttle.delay(pending); delay > 0 {
+		t.metrics.IncrementDelayedWrites()
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			t.metrics.finishWrite()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// lockWrite admits a write to the table with admitWrite and takes the table write lock, reloading the table if the
+// cache policy evicted it, in a table.lock span of the request of ctx. The file writes of the write are traced as part
+// of the request too. It returns the function that releases the lock and ends the write, or ErrReadOnly right away if
+// the table is read-only.
+func (t *Table) lockWrite(ctx context.Context) (func(), error) {
+	if t.readOnly.Load() {
+		return nil, ErrReadOnly
+	}
+	_, span := t.traceOperation(ctx, "table.lock")
+	defer span.End()
+	if err := t.admitWrite(ctx); err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	t.Lock()
+	if err := t.reload(); err != nil {
+		t.Unlock()
+		t.metrics.finishWrite()
+		span.SetError(err)
+		return nil, err
+	}
+	t.requestID = RequestID(ctx)
+	t.traceCtx = ctx
+	return func() {
+		t.requestID = ""
+		t.traceCtx = nil
+		t.Unlock()
+		t.metrics.finishWrite()
+	}, nil
+}
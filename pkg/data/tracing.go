@@ -0,0 +1,262 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	mathrand "math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of spans, as numbered by OTLP.
+const (
+	SpanKindInternal = 1 // SpanKindInternal is an operation within the server, such as reading a table file.
+	SpanKindServer   = 2 // SpanKindServer is a request served by the server.
+)
+
+// Span is a timed operation of a traced request, such as the request itself, reading and decrypting a table file or
+// planning a query. Spans never hold record contents or keys. The methods of Span do nothing on a nil span, which
+// StartSpan returns for requests that are not traced, so operations can be instrumented without checking.
+type Span struct {
+	TraceID    [16]byte          // TraceID is the ID of the trace, shared by every span of a request.
+	SpanID     [8]byte           // SpanID is the ID of the span.
+	ParentID   [8]byte           // ParentID is the ID of the span this one is part of, zero for the root span.
+	Name       string            // Name is the operation, such as "table.read" or "query.plan".
+	Kind       int               // Kind is SpanKindServer or SpanKindInternal.
+	StartTime  time.Time         // StartTime is when the operation started.
+	EndTime    time.Time         // EndTime is when the operation ended.
+	Attributes map[string]string // Attributes describe the operation, such as the table it ran on.
+	Error      string            // Error is the error the operation failed with, empty if it succeeded.
+
+	tracer *Tracer
+	lock   sync.Mutex
+	ended  bool
+}
+
+// SetAttribute sets an attribute of the span, unless it has ended.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.ended {
+		s.Attributes[key] = value
+	}
+}
+
+// SetError marks the span as failed with err, unless err is nil or the span has ended.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.ended {
+		s.Error = err.Error()
+	}
+}
+
+// End ends the span and hands it to its tracer for export. Only the first call has an effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.lock.Unlock()
+	s.tracer.record(s)
+}
+
+// TraceIDString returns the trace ID in hex, as shown by tracing backends, or an empty string for a nil span.
+func (s *Span) TraceIDString() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.TraceID[:])
+}
+
+// spanKey is the context key of the current span, see StartSpan.
+type spanKey struct{}
+
+// SpanFromContext returns the current span of ctx, or nil if the request of ctx is not traced.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// StartSpan starts a span of the operation as part of the current span of ctx, and returns a copy of ctx in which it
+// is the current span. If ctx has no span, the request is not traced, and StartSpan returns ctx and a nil span.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := parent.tracer.newSpan(name, SpanKindInternal)
+	span.TraceID, span.ParentID = parent.TraceID, parent.SpanID
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SpanExporter sends batches of ended spans to a tracing system.
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+}
+
+// Tracer samples requests and exports the spans of the sampled ones in batches from a background goroutine, like
+// Telemetry exports operation samples. Requests never wait for the exporter: spans that end while a full batch is
+// waiting to be exported are dropped.
+type Tracer struct {
+	exporter SpanExporter
+	rate     float64
+	spans    chan *Span
+	done     chan struct{}
+	stop     sync.Once
+	dropped  atomic.Int64
+}
+
+// NewTracer starts tracing the given fraction of requests, between 0 and 1, and exporting their spans to exporter.
+// Requests continuing a trace of their caller follow its sampling decision instead. Close must be called to export
+// the last spans and stop the background goroutine.
+func NewTracer(exporter SpanExporter, sampleRate float64) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		rate:     sampleRate,
+		spans:    make(chan *Span, telemetryBatch),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// StartTrace starts the root span of a request, and returns a copy of ctx in which it is the current span. The
+// request continues the trace of the W3C traceparent header value of its caller if it is valid, and is traced if
+// the caller traced it; otherwise it starts a new trace, traced at the sample rate. Requests that are not traced get
+// ctx and a nil span.
+func (t *Tracer) StartTrace(ctx context.Context, name string, traceparent string) (context.Context, *Span) {
+	traceID, parentID, sampled, ok := parseTraceparent(traceparent)
+	if !ok {
+		sampled = t.rate >= 1 || (t.rate > 0 && mathrand.Float64() < t.rate)
+	}
+	if !sampled {
+		return ctx, nil
+	}
+	span := t.newSpan(name, SpanKindServer)
+	if ok {
+		span.TraceID, span.ParentID = traceID, parentID
+	} else {
+		rand.Read(span.TraceID[:])
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Dropped returns the number of spans that were dropped because the exporter fell behind.
+func (t *Tracer) Dropped() int64 {
+	return t.dropped.Load()
+}
+
+// Close exports the spans still waiting and stops the tracer. Spans ending afterwards are dropped.
+func (t *Tracer) Close() {
+	t.stop.Do(func() {
+		t.spans <- nil // nil tells run to export and stop
+		<-t.done
+	})
+}
+
+// newSpan returns a started span of the tracer with a new span ID.
+func (t *Tracer) newSpan(name string, kind int) *Span {
+	span := &Span{Name: name, Kind: kind, StartTime: time.Now(), Attributes: make(map[string]string), tracer: t}
+	rand.Read(span.SpanID[:])
+	return span
+}
+
+// record queues an ended span for export, unless the exporter has fallen behind.
+func (t *Tracer) record(span *Span) {
+	select {
+	case t.spans <- span:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// run exports the spans in batches, when a batch is full or every telemetryFlushInterval, until Close.
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(telemetryFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, telemetryBatch)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.ExportSpans(batch); err != nil {
+			log.Printf("Failed to export %d spans: %v", len(batch), err)
+		}
+		batch = make([]*Span, 0, telemetryBatch)
+	}
+	for {
+		select {
+		case span := <-t.spans:
+			if span == nil {
+				export()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) == telemetryBatch {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		}
+	}
+}
+
+// parseTraceparent parses a W3C traceparent header value, version-traceid-parentid-flags, such as
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01. It reports false if the value is not a valid one.
+func parseTraceparent(value string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return traceID, parentID, false, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return traceID, parentID, false, false
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return traceID, parentID, false, false
+	}
+	if traceID == [16]byte{} || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// traceOperation starts a span of an operation of the table, with the names of its database and table, and its tenant
+// if it has one, as attributes.
+func (t *Table) traceOperation(ctx context.Context, name string) (context.Context, *Span) {
+	ctx, span := StartSpan(ctx, name)
+	if span != nil {
+		dbName, tableName := t.tableNames()
+		span.SetAttribute("db.namespace", dbName)
+		span.SetAttribute("db.collection.name", tableName)
+		if t.tenant != "" {
+			span.SetAttribute("dbproto.tenant", t.tenant)
+		}
+	}
+	return ctx, span
+}
@@ -1,19 +1,52 @@
 package data
 
 import (
+	"context"
+	"fmt"
 	"sync"
 
 	"github.com/Malpizarr/dbproto/pkg/dbdata"
-	"google.golang.org/protobuf/proto"
 )
 
-// This srtuct holds the transaction data for managing the transaction
+// This srtuct holds the transaction data for managing the transaction.
+// Instead of copying the table when it starts, a transaction keeps an undo log with the before-image of every key
+// written through it, so starting one costs nothing and a rollback only restores the keys the transaction wrote.
+// Writes made directly on the table rather than through the transaction are not rolled back.
 type Transaction struct {
-	sync.Mutex                                // Mutex to ensure the transaction is thread safe
-	OriginalRecords map[string]*dbdata.Record // Map to hold the original records
+	sync.Mutex                                // Mutex held from Start until Commit or Rollback
+	OriginalRecords map[string]*dbdata.Record // Undo log: each written key's record before its first write, nil if the key did not exist
 	Table           *Table                    // Table to which the transaction belongs
 }
 
+// undoLog maps the keys written by a transaction to their records before the first write, or to nil for keys
+// that did not exist.
+type undoLog map[string]*dbdata.Record
+
+// remember records the before-image of key unless an earlier write already did. The record is kept as it is, since
+// writes replace the records they change rather than changing them.
+func (u undoLog) remember(key string, before *dbdata.Record) {
+	if _, exists := u[key]; !exists {
+		u[key] = before
+	}
+}
+
+// restore returns a copy of records in which every key of the undo log is back to its before-image.
+// records itself is left unchanged, as it may be the published snapshot of the table.
+func (u undoLog) restore(records map[string]*dbdata.Record) map[string]*dbdata.Record {
+	restored := make(map[string]*dbdata.Record, len(records))
+	for key, record := range records {
+		restored[key] = record
+	}
+	for key, before := range u {
+		if before == nil {
+			delete(restored, key)
+		} else {
+			restored[key] = before
+		}
+	}
+	return restored
+}
+
 // Creates a new transaction with the table
 func NewTransaction(table *Table) *Transaction {
 	return &Transaction{
@@ -22,41 +55,163 @@ func NewTransaction(table *Table) *Transaction {
 	}
 }
 
-// Start begins the transaction by locking the table and duplicating the records for potential rollback
+// Start begins the transaction with an empty undo log. It blocks until any other transaction started on the same
+// Transaction value ends.
 func (t *Transaction) Start() error {
 	t.Lock() // Thi is the lock for the transaction to prevent other transactions from happening
+	t.OriginalRecords = make(map[string]*dbdata.Record)
+	return nil
+}
 
-	// Read the records from the file
-	records, err := t.Table.readRecordsFromFile()
+// Insert inserts a record into the table as part of the transaction, so that Rollback deletes it again.
+func (t *Transaction) Insert(record Record) error {
+	unlock, err := t.Table.lockWrite(context.Background())
 	if err != nil {
-		t.Unlock()
 		return err
 	}
-	// This is the loop to clone the records and store them in the original records
-	for key, record := range records.Records {
-		t.OriginalRecords[key] = proto.Clone(record).(*dbdata.Record)
+	defer unlock()
+	return t.insert(record)
+}
+
+// Update updates a record of the table as part of the transaction, so that Rollback restores its fields.
+func (t *Transaction) Update(key interface{}, updates Record) error {
+	unlock, err := t.Table.lockWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return t.update(key, updates)
+}
+
+// Delete deletes a record from the table as part of the transaction, so that Rollback stores it again.
+func (t *Transaction) Delete(key interface{}) error {
+	unlock, err := t.Table.lockWrite(context.Background())
+	if err != nil {
+		return err
 	}
+	defer unlock()
+	return t.delete(key)
+}
+
+// insert inserts a record and records that its key did not exist. The caller must hold the table write lock.
+func (t *Transaction) insert(record Record) error {
+	stored, err := t.Table.insert(context.Background(), record)
+	if err != nil {
+		return err
+	}
+	undoLog(t.OriginalRecords).remember(t.Table.recordKey(stored), nil)
 	return nil
 }
 
-// Commit ends the transaction by unlocking it, indicating successful completion of all operations
+// update updates a record and records its previous state. The caller must hold the table write lock, under which
+// Records holds the records stored in the file.
+func (t *Transaction) update(key interface{}, updates Record) error {
+	keyStr, err := t.Table.EncodeKey(key)
+	if err != nil {
+		return err
+	}
+	before := t.Table.Records[keyStr]
+	if _, err := t.Table.update(context.Background(), key, updates); err != nil {
+		return err
+	}
+	undoLog(t.OriginalRecords).remember(keyStr, before)
+	return nil
+}
+
+// delete deletes a record and records its previous state. The caller must hold the table write lock.
+func (t *Transaction) delete(key interface{}) error {
+	keyStr, err := t.Table.EncodeKey(key)
+	if err != nil {
+		return err
+	}
+	before := t.Table.Records[keyStr]
+	if err := t.Table.delete(context.Background(), key); err != nil {
+		return err
+	}
+	undoLog(t.OriginalRecords).remember(keyStr, before)
+	return nil
+}
+
+// restore writes the before-images of the undo log back to the file and empties the log. The restored keys are
+// shipped to the commit log, so that followers undo the transaction as well. The caller must hold the table write lock.
+func (t *Transaction) restore() error {
+	if len(t.OriginalRecords) == 0 {
+		return nil
+	}
+	records, err := t.Table.recordsForWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	current := records.Records
+	records.Records = undoLog(t.OriginalRecords).restore(current)
+	for key := range t.OriginalRecords {
+		t.Table.Cache.Remove(key)
+	}
+	if err := t.Table.writeRecordsToFile(records); err != nil {
+		return err
+	}
+
+	for key, before := range t.OriginalRecords {
+		_, existed := current[key]
+		switch {
+		case before == nil && existed:
+			t.Table.logCommit("delete", key, nil)
+		case before != nil && existed:
+			t.Table.logCommit("update", key, before)
+		case before != nil:
+			t.Table.logCommit("insert", key, before)
+		}
+	}
+	t.OriginalRecords = make(map[string]*dbdata.Record)
+	return nil
+}
+
+// Commit ends the transaction by unlocking it, keeping every write made through it
 func (t *Transaction) Commit() error {
+	t.OriginalRecords = make(map[string]*dbdata.Record)
 	t.Unlock()
 	return nil
 }
 
-// Rollback ends the transaction by unlocking it and writing the original records back to the file
+// Rollback ends the transaction by unlocking it and restoring the records written through it. The restore is a write
+// of the table like any other, so it takes the table write lock with lockWrite; the transaction ends even if the lock
+// cannot be taken, such as on a read-only table, and the error is returned.
 func (t *Transaction) Rollback() error {
-	t.Table.Lock()
-	defer t.Table.Unlock()
 	defer t.Unlock()
+	unlock, err := t.Table.lockWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return t.restore()
+}
+
+// run performs op as a transaction on the table: op is executed while the table write lock is held for the whole
+// duration, and the keys it wrote are restored from the undo log if it fails.
+// Holding the lock throughout means a rollback can never overwrite writes made by other goroutines.
+func (t *Transaction) run(op func() error) error {
+	t.Lock()
+	defer t.Unlock()
+	unlock, err := t.Table.lockWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-	return t.Table.writeRecordsToFile(&dbdata.Records{Records: t.OriginalRecords})
+	t.OriginalRecords = make(map[string]*dbdata.Record)
+	if err := op(); err != nil {
+		if rollbackErr := t.restore(); rollbackErr != nil {
+			return fmt.Errorf("%v (rollback failed: %v)", err, rollbackErr)
+		}
+		return err
+	}
+	return nil
 }
 
 // InsertWithTransaction is a method of the Table struct that performs an insert operation within a transaction context.
 // It first creates a new transaction for the table.
-// It then starts the transaction by locking the table and duplicating the records for potential rollback.
+// It then locks the table for writing, keeping the lock until the transaction ends, and records the before-image of the key it writes.
 // If an error occurs while starting the transaction, it returns the error.
 // It then tries to insert the record into the table.
 // If an error occurs while inserting the record, it rolls back the transaction and returns the error.
@@ -69,75 +224,54 @@ func (t *Transaction) Rollback() error {
 // - If the operation is successful, it returns nil.
 // - If an error occurs, it returns the error.
 func (t *Table) InsertWithTransaction(record Record) error {
-	transaction := NewTransaction(t)
-	if err := transaction.Start(); err != nil {
-		return err // Start returns an error if the transaction cannot be started
-	}
-
 	// Tries to insert the record into the table and if it fails it rolls back the transaction
-	if err := t.Insert(record); err != nil {
-		transaction.Rollback()
-		return err
-	}
-	// Commit the transaction if the insert succeeds
-	return transaction.Commit()
+	tx := NewTransaction(t)
+	return tx.run(func() error {
+		return tx.insert(record)
+	})
 }
 
 // UpdateWithTransaction is a method of the Table struct that performs an update operation within a transaction context.
 // It first creates a new transaction for the table.
-// It then starts the transaction by locking the table and duplicating the records for potential rollback.
+// It then locks the table for writing, keeping the lock until the transaction ends, and records the before-image of the key it writes.
 // If an error occurs while starting the transaction, it returns the error.
 // It then tries to update the record in the table with the given key and updates.
 // If an error occurs while updating the record, it rolls back the transaction and returns the error.
 // If the update operation is successful, it commits the transaction and returns nil.
 //
 // Parameters:
-// - key: An interface{} representing the key of the record to be updated. The key is converted to a string before the update is performed.
+// - key: An interface{} representing the key of the record to be updated. The key is encoded with EncodeKey before the update is performed.
 // - updates: A Record representing the fields to be updated in the record. The keys are field names and the values are the new field values.
 //
 // Returns:
 // - If the operation is successful, it returns nil.
 // - If an error occurs, it returns the error.
 func (t *Table) UpdateWithTransaction(key interface{}, updates Record) error {
-	transaction := NewTransaction(t)
-	if err := transaction.Start(); err != nil {
-		return err // Start returns an error if the transaction cannot be started
-	}
-
 	// Tries to update the record in the table and if it fails it rolls back the transaction
-	if err := t.Update(key, updates); err != nil {
-		transaction.Rollback()
-		return err
-	}
-	// Commit the transaction if the update succeeds
-	return transaction.Commit()
+	tx := NewTransaction(t)
+	return tx.run(func() error {
+		return tx.update(key, updates)
+	})
 }
 
 // DeleteWithTransaction is a method of the Table struct that performs a delete operation within a transaction context.
 // It first creates a new transaction for the table.
-// It then starts the transaction by locking the table and duplicating the records for potential rollback.
+// It then locks the table for writing, keeping the lock until the transaction ends, and records the before-image of the key it writes.
 // If an error occurs while starting the transaction, it returns the error.
 // It then tries to delete the record from the table with the given key.
 // If an error occurs while deleting the record, it rolls back the transaction and returns the error.
 // If the delete operation is successful, it commits the transaction and returns nil.
 //
 // Parameters:
-// - key: An interface{} representing the key of the record to be deleted. The key is converted to a string before the deletion is performed.
+// - key: An interface{} representing the key of the record to be deleted. The key is encoded with EncodeKey before the deletion is performed.
 //
 // Returns:
 // - If the operation is successful, it returns nil.
 // - If an error occurs, it returns the error.
 func (t *Table) DeleteWithTransaction(key interface{}) error {
-	transaction := NewTransaction(t)
-	if err := transaction.Start(); err != nil {
-		return err // Start returns an error if the transaction cannot be started
-	}
 	// Tries to delete the record from the table and if it fails it rolls back the transaction
-	if err := t.Delete(key); err != nil {
-		transaction.Rollback()
-		return err
-	}
-
-	// Commit the transaction if the delete operation succeeds
-	return transaction.Commit()
+	tx := NewTransaction(t)
+	return tx.run(func() error {
+		return tx.delete(key)
+	})
 }
@@ -0,0 +1,370 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// ErrTxDone is returned when an operation is added to, or a commit is attempted on, a Tx that has already been
+// committed or rolled back.
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// txOp is a write buffered in a transaction until it is committed.
+type txOp struct {
+	table     *Table      // Table the write applies to
+	operation string      // "insert", "update" or "delete"
+	key       interface{} // Key of the record to update or delete
+	record    Record      // Record to insert, or the fields to update
+}
+
+// txBuffer holds the writes of a transaction and whether it has ended.
+type txBuffer struct {
+	sync.Mutex        // Mutex to ensure the transaction is thread safe
+	ops        []txOp // Writes buffered in the order they were added
+	done       bool   // Whether the transaction has been committed or rolled back
+}
+
+// add buffers the operation unless the transaction has ended.
+func (b *txBuffer) add(op txOp) error {
+	b.Lock()
+	defer b.Unlock()
+	if b.done {
+		return ErrTxDone
+	}
+	b.ops = append(b.ops, op)
+	return nil
+}
+
+// commit ends the transaction and applies its writes with commitOps.
+func (b *txBuffer) commit(ctx context.Context) error {
+	b.Lock()
+	defer b.Unlock()
+	if b.done {
+		return ErrTxDone
+	}
+	b.done = true
+	return commitOps(ctx, b.ops)
+}
+
+// rollback ends the transaction and discards its writes.
+func (b *txBuffer) rollback() error {
+	b.Lock()
+	defer b.Unlock()
+	if b.done {
+		return ErrTxDone
+	}
+	b.done = true
+	b.ops = nil
+	return nil
+}
+
+// Tx is a transaction grouping several writes to a table. Writes are buffered until Commit, which applies all of
+// them atomically: either every write is stored or, if any of them fails, none is.
+type Tx struct {
+	buffer txBuffer // Writes of the transaction
+	table  *Table   // Table to which the transaction belongs
+}
+
+// Begin is a method of the Table struct that starts a new transaction on the table.
+// The transaction does not hold any lock until it is committed, so the table stays available to other goroutines
+// while the writes are being added.
+//
+// Returns:
+// - A pointer to a Tx to which writes can be added with Insert, Update and Delete, and which is ended with Commit or Rollback.
+func (t *Table) Begin() *Tx {
+	return &Tx{table: t}
+}
+
+// Insert adds the insertion of the record to the transaction. The record is copied, so it can be reused by the caller.
+// Errors such as a duplicate primary key are reported by Commit.
+func (tx *Tx) Insert(record Record) error {
+	return tx.buffer.add(txOp{table: tx.table, operation: "insert", record: copyRecord(record)})
+}
+
+// Update adds the update of the record with the given key to the transaction. The updates are copied, so they can be
+// reused by the caller. Errors such as a missing record are reported by Commit.
+func (tx *Tx) Update(key interface{}, updates Record) error {
+	return tx.buffer.add(txOp{table: tx.table, operation: "update", key: key, record: copyRecord(updates)})
+}
+
+// Delete adds the deletion of the record with the given key to the transaction. Errors such as a missing record are
+// reported by Commit.
+func (tx *Tx) Delete(key interface{}) error {
+	return tx.buffer.add(txOp{table: tx.table, operation: "delete", key: key})
+}
+
+// Commit applies the buffered writes of the transaction, in the order they were added.
+// It is equivalent to CommitCtx with a background context.
+func (tx *Tx) Commit() error {
+	return tx.CommitCtx(context.Background())
+}
+
+// CommitCtx is a method of the Tx struct that applies the buffered writes of the transaction atomically.
+// It locks the table for writing, copies the records held in memory and applies every write to them in the
+// order the writes were added, so later writes see the effect of earlier ones.
+// If any write fails, or the context is done before the records are written, nothing is stored and the error of the
+// failing write is returned.
+// Otherwise the records are written back to the file once and every write is added to the commit log.
+// The transaction ends whether or not the commit succeeds.
+//
+// Parameters:
+// - ctx: A context.Context that can cancel the commit before the records are written.
+//
+// Returns:
+// - If the writes are committed, it returns nil.
+// - If the transaction has already ended, it returns ErrTxDone.
+// - If an error occurs, it returns the error and the table is left unchanged.
+func (tx *Tx) CommitCtx(ctx context.Context) error {
+	return tx.buffer.commit(ctx)
+}
+
+// Rollback ends the transaction and discards its buffered writes. Nothing has been written to the table, so there
+// is nothing to restore.
+//
+// Returns:
+// - If the transaction is rolled back, it returns nil.
+// - If the transaction has already ended, it returns ErrTxDone.
+func (tx *Tx) Rollback() error {
+	return tx.buffer.rollback()
+}
+
+// MultiTx is a transaction grouping writes to several tables, of one database or of the whole server.
+// Like Tx, its writes are buffered until Commit, which stores all of them or none.
+type MultiTx struct {
+	buffer  txBuffer                          // Writes of the transaction
+	resolve func(name string) (*Table, error) // Finds the table a write names
+}
+
+// BeginTx is a method of the Database struct that starts a transaction spanning the tables of the database.
+// Writes name their table as passed to CreateTable, and the named tables must exist when the writes are added.
+//
+// Returns:
+// - A pointer to a MultiTx to which writes can be added with Insert, Update and Delete, and which is ended with Commit or Rollback.
+func (db *Database) BeginTx() *MultiTx {
+	return &MultiTx{resolve: db.lookupTable}
+}
+
+// BeginTx is a method of the Server struct that starts a transaction spanning the tables of every database.
+// Writes name their table as "database.table", and the named tables must exist when the writes are added.
+//
+// Returns:
+// - A pointer to a MultiTx to which writes can be added with Insert, Update and Delete, and which is ended with Commit or Rollback.
+func (s *Server) BeginTx() *MultiTx {
+	return &MultiTx{resolve: s.lookupTable}
+}
+
+// lookupTable returns the table of the database with the given name.
+func (db *Database) lookupTable(name string) (*Table, error) {
+	if db.closed.Load() {
+		return nil, ErrClosed
+	}
+	db.RLock()
+	defer db.RUnlock()
+	table, exists := db.Tables[name]
+	if !exists {
+		return nil, fmt.Errorf("table %s not found in database %s", name, db.Name)
+	}
+	return table, nil
+}
+
+// lookupTable returns the table named "database.table".
+func (s *Server) lookupTable(name string) (*Table, error) {
+	dbName, tableName, ok := strings.Cut(name, ".")
+	if !ok {
+		return nil, fmt.Errorf("table name %s is not of the form database.table", name)
+	}
+	s.RLock()
+	db, exists := s.Databases[dbName]
+	s.RUnlock()
+	if !exists || dbName == SystemDatabase {
+		return nil, fmt.Errorf("database %s not found", dbName)
+	}
+	return db.lookupTable(tableName)
+}
+
+// Insert adds the insertion of the record into the named table to the transaction. The record is copied, so it can
+// be reused by the caller. It returns an error if the table does not exist; other errors are reported by Commit.
+func (tx *MultiTx) Insert(table string, record Record) error {
+	return tx.add(table, txOp{operation: "insert", record: copyRecord(record)})
+}
+
+// Update adds the update of the record with the given key in the named table to the transaction. The updates are
+// copied, so they can be reused by the caller. It returns an error if the table does not exist; other errors are
+// reported by Commit.
+func (tx *MultiTx) Update(table string, key interface{}, updates Record) error {
+	return tx.add(table, txOp{operation: "update", key: key, record: copyRecord(updates)})
+}
+
+// Delete adds the deletion of the record with the given key from the named table to the transaction. It returns an
+// error if the table does not exist; other errors are reported by Commit.
+func (tx *MultiTx) Delete(table string, key interface{}) error {
+	return tx.add(table, txOp{operation: "delete", key: key})
+}
+
+// add resolves the table of the operation and buffers it.
+func (tx *MultiTx) add(name string, op txOp) error {
+	table, err := tx.resolve(name)
+	if err != nil {
+		return err
+	}
+	op.table = table
+	return tx.buffer.add(op)
+}
+
+// Commit applies the buffered writes of the transaction, in the order they were added.
+// It is equivalent to CommitCtx with a background context.
+func (tx *MultiTx) Commit() error {
+	return tx.CommitCtx(context.Background())
+}
+
+// CommitCtx is a method of the MultiTx struct that applies the buffered writes of the transaction atomically.
+// It locks every written table for writing, in file path order so that concurrent transactions cannot deadlock,
+// and applies every write to the records of its table in the order the writes were added.
+// If any write fails, or the context is done before the records are written, nothing is stored.
+// Otherwise each table is written back to its file once; if writing a table fails, the tables already written are
+// restored to their previous records.
+// The transaction ends whether or not the commit succeeds.
+//
+// Parameters:
+// - ctx: A context.Context that can cancel the commit before the records are written.
+//
+// Returns:
+// - If the writes are committed, it returns nil.
+// - If the transaction has already ended, it returns ErrTxDone.
+// - If an error occurs, it returns the error and every table is left unchanged.
+func (tx *MultiTx) CommitCtx(ctx context.Context) error {
+	return tx.buffer.commit(ctx)
+}
+
+// Rollback ends the transaction and discards its buffered writes. Nothing has been written to the tables, so there
+// is nothing to restore.
+//
+// Returns:
+// - If the transaction is rolled back, it returns nil.
+// - If the transaction has already ended, it returns ErrTxDone.
+func (tx *MultiTx) Rollback() error {
+	return tx.buffer.rollback()
+}
+
+// commitOps applies the operations atomically to their tables, which it locks for writing in file path order.
+// Every operation is applied to records read from the table files before anything is written, so a failing
+// operation leaves every table unchanged. When several tables are written, an undo log records the before-image
+// of every key written in each, so that a failed write can be undone in the tables written before it.
+func commitOps(ctx context.Context, ops []txOp) error {
+	if len(ops) == 0 {
+		return nil
+	}
+
+	tables := make([]*Table, len(ops))
+	for i, op := range ops {
+		tables[i] = op.table
+	}
+	tables = lockOrder(tables)
+	defer func(start time.Time) {
+		for _, table := range tables {
+			table.sample("commit", "", start)
+		}
+	}(time.Now())
+	unlock, err := writeLockTables(ctx, tables...)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	records := make(map[*Table]*dbdata.Records, len(tables))
+	undo := make(map[*Table]undoLog, len(tables))
+	for _, table := range tables {
+		allRecords, err := table.recordsForWrite(ctx)
+		if err != nil {
+			return err
+		}
+		records[table] = allRecords
+		undo[table] = make(undoLog)
+	}
+
+	// The state of every written record before and after its write, for the commit log and the watchers
+	keys := make([]string, len(ops))
+	befores := make([]*dbdata.Record, len(ops))
+	logged := make([]*dbdata.Record, len(ops))
+	for i, op := range ops {
+		var record *dbdata.Record
+		var err error
+		if op.operation != "insert" {
+			key, _ := op.table.EncodeKey(op.key) // invalid keys fail in applyUpdate and applyDelete
+			if before, exists := records[op.table].Records[key]; exists {
+				befores[i] = before
+				if len(tables) > 1 {
+					undo[op.table].remember(key, before)
+				}
+			}
+		}
+		switch op.operation {
+		case "insert":
+			keys[i], record, err = op.table.applyInsert(records[op.table], op.record)
+		case "update":
+			keys[i], record, err = op.table.applyUpdate(records[op.table], op.key, op.record)
+		case "delete":
+			keys[i], err = op.table.applyDelete(records[op.table], op.key)
+		}
+		if err != nil {
+			return fmt.Errorf("operation %d (%s): %w", i+1, op.operation, err)
+		}
+		if len(tables) > 1 && op.operation == "insert" {
+			undo[op.table].remember(keys[i], nil)
+		}
+		logged[i] = record
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	for i, table := range tables {
+		if err := table.writeRecordsToFile(records[table]); err != nil {
+			// Undo the tables already written, and the failed one in case it was partially updated
+			for _, written := range tables[:i+1] {
+				if len(undo[written]) == 0 {
+					continue
+				}
+				written.Cache.Clear()
+				original := &dbdata.Records{Records: undo[written].restore(records[written].Records)}
+				if rollbackErr := written.writeRecordsToFile(original); rollbackErr != nil {
+					return fmt.Errorf("%v (rollback failed: %v)", err, rollbackErr)
+				}
+			}
+			return err
+		}
+	}
+
+	for i, op := range ops {
+		table := op.table
+		table.Cache.Remove(keys[i])
+		switch op.operation {
+		case "insert":
+			table.metrics.IncrementInsertCount()
+		case "update":
+			table.metrics.IncrementUpdateCount()
+		case "delete":
+			table.metrics.IncrementDeleteCount()
+		}
+		table.logChange(op.operation, keys[i], befores[i], logged[i])
+	}
+	return nil
+}
+
+// copyRecord returns a shallow copy of the record.
+func copyRecord(record Record) Record {
+	if record == nil {
+		return nil
+	}
+	copied := make(Record, len(record))
+	for field, value := range record {
+		copied[field] = value
+	}
+	return copied
+}
@@ -0,0 +1,590 @@
+package data
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	usersTable = "users" // usersTable is the table of SystemDatabase holding the users, keyed by their name.
+	rolesTable = "roles" // rolesTable is the table of SystemDatabase holding the roles, keyed by their name.
+)
+
+// AdminRole is the built-in role granting every permission on every database. It always exists, so the first user
+// can be created with it, and cannot be changed or deleted.
+const AdminRole = "admin"
+
+// passwordIterations is the number of PBKDF2-HMAC-SHA256 iterations password hashes are computed with.
+const passwordIterations = 600000
+
+// ErrInvalidCredentials is returned by AuthenticateUser for an unknown user or a wrong password.
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// ErrUserNotFound is returned for a user that does not exist.
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrRoleNotFound is returned for a role that does not exist.
+var ErrRoleNotFound = errors.New("role not found")
+
+// Permission is what a grant allows on a database or table. Each permission includes the ones before it.
+type Permission string
+
+const (
+	PermissionRead  Permission = "read"  // PermissionRead allows reading records, describing tables and joining them.
+	PermissionWrite Permission = "write" // PermissionWrite allows inserting, updating and deleting records as well.
+	PermissionAdmin Permission = "admin" // PermissionAdmin allows creating tables and managing them, such as their retention, as well.
+)
+
+// rank returns the position of the permission in read, write, admin, or 0 if it is unknown.
+func (p Permission) rank() int {
+	switch p {
+	case PermissionRead:
+		return 1
+	case PermissionWrite:
+		return 2
+	case PermissionAdmin:
+		return 3
+	}
+	return 0
+}
+
+// Includes reports whether the permission allows what other allows.
+func (p Permission) Includes(other Permission) bool {
+	return p.rank() > 0 && p.rank() >= other.rank()
+}
+
+// Grant gives a permission on a database, or on one of its tables. It is written database[.table]:permission, with
+// * for every database or every table, such as shop:read, shop.orders:write or *:admin.
+type Grant struct {
+	Database   string     `json:"database"`        // Database is the database the grant applies to, * for every database.
+	Table      string     `json:"table,omitempty"` // Table is the table the grant applies to, empty or * for every table of the database.
+	Permission Permission `json:"permission"`      // Permission is what the grant allows.
+}
+
+// ParseGrant parses a grant written database[.table]:permission.
+func ParseGrant(value string) (Grant, error) {
+	target, permission, ok := strings.Cut(value, ":")
+	database, table, _ := strings.Cut(target, ".")
+	grant := Grant{Database: database, Table: table, Permission: Permission(permission)}
+	if !ok || database == "" || grant.Permission.rank() == 0 {
+		return Grant{}, fmt.Errorf("invalid grant %q, expected database[.table]:permission with permission read, write or admin", value)
+	}
+	if grant.Table == "*" {
+		grant.Table = ""
+	}
+	return grant, nil
+}
+
+// String returns the grant written database[.table]:permission.
+func (g Grant) String() string {
+	if g.Table == "" {
+		return g.Database + ":" + string(g.Permission)
+	}
+	return g.Database + "." + g.Table + ":" + string(g.Permission)
+}
+
+// allows reports whether the grant gives the permission on the table of the database. An empty table asks for a
+// permission on the whole database, which only grants on every table of the database give.
+func (g Grant) allows(database, table string, permission Permission) bool {
+	if g.Database != "*" && g.Database != database {
+		return false
+	}
+	if g.Table != "" && g.Table != table {
+		return false
+	}
+	return g.Permission.Includes(permission)
+}
+
+// Role is a named set of grants given to users.
+type Role struct {
+	Name   string  `json:"name"`   // Name identifies the role.
+	Grants []Grant `json:"grants"` // Grants are the permissions of the role.
+}
+
+// User is an account that logs in to the HTTP API with a password.
+type User struct {
+	Username  string    `json:"username"`  // Username identifies the user.
+	Roles     []string  `json:"roles"`     // Roles are the names of the roles of the user.
+	CreatedAt time.Time `json:"createdAt"` // CreatedAt is when the user was created.
+}
+
+// users returns the table of the users, see systemTable.
+func (s *Server) users(create bool) (*Table, error) {
+	return s.systemTable(usersTable, "username", create)
+}
+
+// roles returns the table of the roles, see systemTable.
+func (s *Server) roles(create bool) (*Table, error) {
+	return s.systemTable(rolesTable, "name", create)
+}
+
+// hashPassword returns the PBKDF2-HMAC-SHA256 hash of the password with a random salt, written
+// pbkdf2-sha256$iterations$salt$hash with the salt and hash base64 encoded.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate a salt: %v", err)
+	}
+	hash := pbkdf2SHA256([]byte(password), salt, passwordIterations, sha256.Size)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+// checkPassword reports whether the password matches a hash returned by hashPassword.
+func checkPassword(password, encoded string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hash, pbkdf2SHA256([]byte(password), salt, iterations, len(hash))) == 1
+}
+
+// pbkdf2SHA256 derives a key of keyLen bytes from the password with PBKDF2 (RFC 8018) and HMAC-SHA256.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := make([]byte, 0, keyLen+sha256.Size)
+	block := make([]byte, 4)
+	for i := uint32(1); len(key) < keyLen; i++ {
+		binary.BigEndian.PutUint32(block, i)
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// userFromRecord returns the user of a record of the user table.
+func userFromRecord(record Record) *User {
+	user := &User{Roles: []string{}}
+	user.Username, _ = record["username"].(string)
+	user.CreatedAt, _ = record["createdAt"].(time.Time)
+	roles, _ := record["roles"].([]interface{})
+	for _, role := range roles {
+		if name, ok := role.(string); ok {
+			user.Roles = append(user.Roles, name)
+		}
+	}
+	return user
+}
+
+// roleFromRecord returns the role of a record of the role table.
+func roleFromRecord(record Record) (*Role, error) {
+	role := &Role{Grants: []Grant{}}
+	role.Name, _ = record["name"].(string)
+	grants, _ := record["grants"].([]interface{})
+	for _, value := range grants {
+		text, _ := value.(string)
+		grant, err := ParseGrant(text)
+		if err != nil {
+			return nil, fmt.Errorf("role %s: %v", role.Name, err)
+		}
+		role.Grants = append(role.Grants, grant)
+	}
+	return role, nil
+}
+
+// CreateUser is a method of the Server struct that creates a user of the HTTP API. Only a salted PBKDF2 hash of the
+// password is stored, in the users table of SystemDatabase.
+//
+// Parameters:
+// - username: The name the user logs in with.
+// - password: The password the user logs in with.
+// - roles: The names of the roles of the user, AdminRole or roles created by SetRole.
+//
+// Returns:
+// - An error, if the user exists, a role does not exist, or the user cannot be stored. If the operation is successful,
+// the error is nil.
+func (s *Server) CreateUser(username, password string, roles []string) error {
+	if username == "" || password == "" {
+		return fmt.Errorf("a user requires a username and a password")
+	}
+	if err := s.checkRoles(roles); err != nil {
+		return err
+	}
+	table, err := s.users(true)
+	if err != nil {
+		return err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	names := make([]interface{}, len(roles))
+	for i, role := range roles {
+		names[i] = role
+	}
+	record := Record{
+		"username":     username,
+		"passwordHash": hash,
+		"roles":        names,
+		"createdAt":    time.Now().UTC().Truncate(time.Microsecond),
+	}
+	if err := table.Insert(record); err != nil {
+		return fmt.Errorf("failed to store user %s: %v", username, err)
+	}
+	return nil
+}
+
+// SetUserPassword is a method of the Server struct that replaces the password of a user. Tokens issued before stay
+// valid until they expire.
+//
+// Parameters:
+// - username: The name of the user.
+// - password: The new password.
+//
+// Returns:
+// - ErrUserNotFound if there is no such user, or an error if the password cannot be stored. If the operation is
+// successful, the error is nil.
+func (s *Server) SetUserPassword(username, password string) error {
+	if password == "" {
+		return fmt.Errorf("a user requires a password")
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return s.updateUser(username, Record{"passwordHash": hash})
+}
+
+// SetUserRoles is a method of the Server struct that replaces the roles of a user. It applies to the next request of
+// the user, even with a token issued before.
+//
+// Parameters:
+// - username: The name of the user.
+// - roles: The names of the new roles of the user.
+//
+// Returns:
+// - ErrUserNotFound if there is no such user, or an error if a role does not exist or the roles cannot be stored. If
+// the operation is successful, the error is nil.
+func (s *Server) SetUserRoles(username string, roles []string) error {
+	if err := s.checkRoles(roles); err != nil {
+		return err
+	}
+	names := make([]interface{}, len(roles))
+	for i, role := range roles {
+		names[i] = role
+	}
+	return s.updateUser(username, Record{"roles": names})
+}
+
+// updateUser updates the record of a user.
+func (s *Server) updateUser(username string, updates Record) error {
+	table, err := s.users(false)
+	if err != nil {
+		return err
+	}
+	if table == nil {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	if record, err := systemRecord(table, username); err != nil {
+		return fmt.Errorf("failed to read the users: %v", err)
+	} else if record == nil {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	if err := table.Update(username, updates); err != nil {
+		return fmt.Errorf("failed to update user %s: %v", username, err)
+	}
+	return nil
+}
+
+// DeleteUser is a method of the Server struct that deletes a user. Its tokens are rejected from then on.
+//
+// Parameters:
+// - username: The name of the user.
+//
+// Returns:
+// - ErrUserNotFound if there is no such user, or an error if it cannot be deleted. If the operation is successful, the
+// error is nil.
+func (s *Server) DeleteUser(username string) error {
+	table, err := s.users(false)
+	if err != nil {
+		return err
+	}
+	if table == nil {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	if record, err := systemRecord(table, username); err != nil {
+		return fmt.Errorf("failed to read the users: %v", err)
+	} else if record == nil {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	if err := table.Delete(username); err != nil {
+		return fmt.Errorf("failed to delete user %s: %v", username, err)
+	}
+	return nil
+}
+
+// ListUsers is a method of the Server struct that lists the users by name, without their passwords.
+func (s *Server) ListUsers() ([]User, error) {
+	table, err := s.users(false)
+	if err != nil {
+		return nil, err
+	}
+	users := []User{}
+	if table == nil {
+		return users, nil
+	}
+	records, err := table.SelectAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the users: %v", err)
+	}
+	for _, record := range records {
+		users = append(users, *userFromRecord(record))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+// User is a method of the Server struct that returns the user with the given name, or ErrUserNotFound.
+func (s *Server) User(username string) (*User, error) {
+	table, err := s.users(false)
+	if err != nil {
+		return nil, err
+	}
+	if table == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	record, err := systemRecord(table, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the users: %v", err)
+	} else if record == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	return userFromRecord(record), nil
+}
+
+// AuthenticateUser is a method of the Server struct that checks the password of a user logging in.
+//
+// Parameters:
+// - username: The name of the user.
+// - password: The password sent by the user.
+//
+// Returns:
+// - A pointer to the User.
+// - ErrInvalidCredentials if there is no such user or the password is wrong, or an error if the users cannot be read.
+// If the password is right, the error is nil.
+func (s *Server) AuthenticateUser(username, password string) (*User, error) {
+	table, err := s.users(false)
+	if err != nil {
+		return nil, err
+	}
+	var record Record
+	if table != nil {
+		if record, err = systemRecord(table, username); err != nil {
+			return nil, fmt.Errorf("failed to read the users: %v", err)
+		}
+	}
+	hash, _ := record["passwordHash"].(string)
+	if record == nil {
+		// Unknown users take as long as wrong passwords, so the time of a failure does not tell whether a user exists
+		unknownUserOnce.Do(func() { unknownUserHash, _ = hashPassword("") })
+		hash = unknownUserHash
+	}
+	if !checkPassword(password, hash) || record == nil {
+		return nil, ErrInvalidCredentials
+	}
+	return userFromRecord(record), nil
+}
+
+var (
+	unknownUserOnce sync.Once
+	unknownUserHash string // unknownUserHash is checked against the password of logins with an unknown username.
+)
+
+// SetRole is a method of the Server struct that creates a role, or replaces the grants of an existing one. It applies
+// to the next request of its users.
+//
+// Parameters:
+// - role: The name and the grants of the role. AdminRole cannot be changed.
+//
+// Returns:
+// - An error, if the role is AdminRole or cannot be stored. If the operation is successful, the error is nil.
+func (s *Server) SetRole(role Role) error {
+	if role.Name == "" {
+		return fmt.Errorf("a role requires a name")
+	}
+	if role.Name == AdminRole {
+		return fmt.Errorf("the %s role is built in and cannot be changed", AdminRole)
+	}
+	grants := make([]interface{}, len(role.Grants))
+	for i, grant := range role.Grants {
+		if _, err := ParseGrant(grant.String()); err != nil {
+			return err
+		}
+		grants[i] = grant.String()
+	}
+	table, err := s.roles(true)
+	if err != nil {
+		return err
+	}
+	existing, err := systemRecord(table, role.Name)
+	if err != nil {
+		return fmt.Errorf("failed to read the roles: %v", err)
+	}
+	if existing != nil {
+		err = table.Update(role.Name, Record{"grants": grants})
+	} else {
+		err = table.Insert(Record{"name": role.Name, "grants": grants})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store role %s: %v", role.Name, err)
+	}
+	return nil
+}
+
+// DeleteRole is a method of the Server struct that deletes a role. Its users keep its name among their roles, which
+// grants nothing until a role of that name is created again.
+//
+// Parameters:
+// - name: The name of the role.
+//
+// Returns:
+// - ErrRoleNotFound if there is no such role, or an error if it cannot be deleted. If the operation is successful,
+// the error is nil.
+func (s *Server) DeleteRole(name string) error {
+	if name == AdminRole {
+		return fmt.Errorf("the %s role is built in and cannot be deleted", AdminRole)
+	}
+	table, err := s.roles(false)
+	if err != nil {
+		return err
+	}
+	if table == nil {
+		return fmt.Errorf("%w: %s", ErrRoleNotFound, name)
+	}
+	if record, err := systemRecord(table, name); err != nil {
+		return fmt.Errorf("failed to read the roles: %v", err)
+	} else if record == nil {
+		return fmt.Errorf("%w: %s", ErrRoleNotFound, name)
+	}
+	if err := table.Delete(name); err != nil {
+		return fmt.Errorf("failed to delete role %s: %v", name, err)
+	}
+	return nil
+}
+
+// ListRoles is a method of the Server struct that lists the roles by name, starting with AdminRole.
+func (s *Server) ListRoles() ([]Role, error) {
+	roles := []Role{adminRole()}
+	table, err := s.roles(false)
+	if err != nil || table == nil {
+		return roles, err
+	}
+	records, err := table.SelectAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the roles: %v", err)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		first, _ := records[i]["name"].(string)
+		second, _ := records[j]["name"].(string)
+		return first < second
+	})
+	for _, record := range records {
+		role, err := roleFromRecord(record)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, *role)
+	}
+	return roles, nil
+}
+
+// adminRole returns the built-in AdminRole.
+func adminRole() Role {
+	return Role{Name: AdminRole, Grants: []Grant{{Database: "*", Permission: PermissionAdmin}}}
+}
+
+// role returns the role with the given name, or nil if there is none.
+func (s *Server) role(name string) (*Role, error) {
+	if name == AdminRole {
+		role := adminRole()
+		return &role, nil
+	}
+	table, err := s.roles(false)
+	if err != nil || table == nil {
+		return nil, err
+	}
+	record, err := systemRecord(table, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the roles: %v", err)
+	} else if record == nil {
+		return nil, nil
+	}
+	return roleFromRecord(record)
+}
+
+// checkRoles returns ErrRoleNotFound if a role does not exist.
+func (s *Server) checkRoles(roles []string) error {
+	for _, name := range roles {
+		role, err := s.role(name)
+		if err != nil {
+			return err
+		}
+		if role == nil {
+			return fmt.Errorf("%w: %s", ErrRoleNotFound, name)
+		}
+	}
+	return nil
+}
+
+// Authorize is a method of the Server struct that checks whether the roles of a user grant a permission.
+//
+// Parameters:
+// - user: The user, as returned by AuthenticateUser or User.
+// - database: The database the permission is needed on, or * for a permission on every database, such as creating one.
+// - table: The table the permission is needed on, or empty for a permission on the whole database.
+// - permission: The permission needed.
+//
+// Returns:
+// - Whether the permission is granted.
+// - An error, if the roles cannot be read. If the operation is successful, the error is nil.
+func (s *Server) Authorize(user *User, database, table string, permission Permission) (bool, error) {
+	for _, name := range user.Roles {
+		role, err := s.role(name)
+		if err != nil {
+			return false, err
+		}
+		if role == nil {
+			continue
+		}
+		for _, grant := range role.Grants {
+			if grant.allows(database, table, permission) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
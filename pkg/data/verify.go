@@ -0,0 +1,196 @@
+package data
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TableVerification is the result of opening and checking a table restored from a backup.
+type TableVerification struct {
+	Database       string   `json:"database"`                 // Database is the database of the table.
+	Table          string   `json:"table"`                    // Table is the name of the table.
+	Records        int      `json:"records"`                  // Records is the number of records read from the table file.
+	Indexes        int      `json:"indexes"`                  // Indexes is the number of indexes built from the records.
+	CorruptRecords []string `json:"corruptRecords,omitempty"` // CorruptRecords are the keys of the records that do not match their checksum.
+	Error          string   `json:"error,omitempty"`          // Error describes why the table could not be opened or failed its checks, empty if it passed.
+}
+
+// BackupVerification reports whether a backup can be restored: every table it holds was opened from a temporary
+// copy, which decrypts and decodes its file and builds its indexes, and passed the integrity checks.
+type BackupVerification struct {
+	Archive  string              `json:"archive"`  // Archive is the path of the backup file.
+	Started  time.Time           `json:"started"`  // Started is when the verification started.
+	Duration time.Duration       `json:"duration"` // Duration is how long the verification took.
+	Tables   []TableVerification `json:"tables"`   // Tables holds the result of every table, sorted by database and table.
+	OK       bool                `json:"ok"`       // OK is whether every table passed.
+}
+
+// Failed returns the tables that could not be opened or failed their checks.
+func (v *BackupVerification) Failed() []TableVerification {
+	var failed []TableVerification
+	for _, table := range v.Tables {
+		if table.Error != "" {
+			failed = append(failed, table)
+		}
+	}
+	return failed
+}
+
+// VerifyBackup restores a backup into a temporary directory and opens every table of it, checking that the backup
+// could be restored, without touching the live data. The temporary directory is removed afterwards.
+//
+// Parameters:
+// - backupPath: Optional path of the backup file, or file name or name of a backup. If it is omitted, the newest backup is used.
+//
+// Returns:
+// - A BackupVerification with the result of every table. Tables that fail are reported in it rather than as an error.
+// - An error, if the backup cannot be read or extracted. If the operation is successful, the error is nil.
+func (s *Server) VerifyBackup(backupPath ...string) (*BackupVerification, error) {
+	path := ""
+	if len(backupPath) > 0 {
+		path = backupPath[0]
+	}
+	verification, err := verifyBackup(s.resolveBackupPath(path))
+	if err != nil {
+		return nil, err
+	}
+	s.lastVerification.Store(verification)
+	return verification, nil
+}
+
+// LastBackupVerification returns the result of the last backup verification of the server, or nil if no backup has
+// been verified since it started.
+func (s *Server) LastBackupVerification() *BackupVerification {
+	return s.lastVerification.Load()
+}
+
+// RunBackupVerification verifies the backup at backupPath, or the newest backup if it is empty, every interval
+// until ctx is done, logging the result of every run. It returns ctx.Err(), or ErrClosed once the server is closed.
+func (s *Server) RunBackupVerification(ctx context.Context, interval time.Duration, backupPath string) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.stopped:
+			return ErrClosed
+		case <-ticker.C:
+			verification, err := s.VerifyBackup(backupPath)
+			if err != nil {
+				log.Printf("Failed to verify backup: %v", err)
+				continue
+			}
+			for _, table := range verification.Failed() {
+				log.Printf("Backup %s: table %s.%s failed verification: %s", verification.Archive, table.Database, table.Table, table.Error)
+			}
+			if verification.OK {
+				log.Printf("Backup %s verified: %d tables in %v", verification.Archive, len(verification.Tables), verification.Duration)
+			}
+		}
+	}
+}
+
+// verifyBackup extracts the backup at path into a temporary directory and verifies every table in it.
+func verifyBackup(path string) (*BackupVerification, error) {
+	verification := &BackupVerification{Archive: path, Started: time.Now().UTC()}
+
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup file: %v", err)
+	}
+	defer archive.Close()
+
+	dir, err := os.MkdirTemp("", "dbproto-verify-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := checkArchive(&archive.Reader, dir); err != nil {
+		return nil, err
+	}
+	if err := extractArchive(&archive.Reader, dir, nil); err != nil {
+		return nil, fmt.Errorf("failed to extract backup: %v", err)
+	}
+
+	_, tables, err := liveContents(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	verification.OK = true
+	for _, name := range names {
+		database, table, _ := strings.Cut(name, "/")
+		result := verifyTable(filepath.Join(dir, database), database, table)
+		if result.Error != "" {
+			verification.OK = false
+		}
+		verification.Tables = append(verification.Tables, result)
+	}
+	verification.Duration = time.Since(verification.Started)
+	return verification, nil
+}
+
+// verifyTable opens a table restored into dbDir like LoadTables does and runs the integrity checks on it.
+func verifyTable(dbDir, database, table string) TableVerification {
+	result := TableVerification{Database: database, Table: table}
+	meta, err := readTableMeta(filepath.Join(dbDir, table+".meta"))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if meta.InMemory {
+		// A table held in memory has no data file to verify, only its metadata
+		return result
+	}
+	tablePath := filepath.Join(dbDir, table+".dat")
+	if _, err := os.Stat(tablePath); err != nil {
+		result.Error = fmt.Sprintf("missing data file: %v", err)
+		return result
+	}
+
+	keyed := NewDatabase(database)
+	if err := keyed.loadDataKey(dbDir); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	keys, err := keyed.keyUtils()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	opened, err := openTableWith(meta.PrimaryKey, tablePath, meta.TableOptions, keys, false)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	snap := opened.current.Load()
+	result.Records = len(snap.records)
+	result.Indexes = len(snap.indexes)
+
+	if result.CorruptRecords, err = opened.CorruptRecords(); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if len(result.CorruptRecords) > 0 {
+		result.Error = fmt.Sprintf("%d records do not match their checksum", len(result.CorruptRecords))
+		return result
+	}
+	if err := opened.CheckInvariants(); err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
@@ -0,0 +1,111 @@
+package data
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// watchBuffer is the number of change events a watcher may fall behind before it is dropped.
+const watchBuffer = 256
+
+// ChangeEvent is a committed change to a record of a table, as sent to the watchers of the table.
+type ChangeEvent struct {
+	Operation string    // Operation is "insert", "update" or "delete".
+	Key       string    // Key is the primary key of the changed record.
+	Before    Record    // Before is the record before the change, nil for inserts.
+	After     Record    // After is the record after the change, nil for deletes.
+	Time      time.Time // Time is when the change was committed.
+	RequestID string    // RequestID is the ID of the HTTP request that made the change, if any, see WithRequestID.
+}
+
+// Watch subscribes to the changes of the table and returns the channel they are sent to, in the order they were
+// committed. Every insert, update and delete is sent once its write is durable, including writes made through
+// transactions and the compensating changes of a rollback.
+//
+// Parameters:
+// - ctx: The context of the subscription. The channel is closed once ctx is done.
+//
+// Returns:
+// - The channel of change events. Events are buffered, but a watcher that falls too far behind is dropped and its
+// channel closed, so that slow receivers never delay writers. A receiver that sees the channel closed while ctx is
+// still live has missed changes, and should read the table again and watch it anew.
+func (t *Table) Watch(ctx context.Context) <-chan ChangeEvent {
+	ctx, cancel := context.WithCancel(ctx)
+	events := make(chan ChangeEvent, watchBuffer)
+
+	t.watchLock.Lock()
+	if t.watchers == nil {
+		t.watchers = make(map[chan ChangeEvent]context.CancelFunc)
+	}
+	t.watchers[events] = cancel
+	t.watchLock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		t.unwatch(events)
+	}()
+	return events
+}
+
+// unwatch removes a watcher from the table and closes its channel, unless it has already been dropped.
+func (t *Table) unwatch(events chan ChangeEvent) {
+	t.watchLock.Lock()
+	defer t.watchLock.Unlock()
+	if cancel, exists := t.watchers[events]; exists {
+		delete(t.watchers, events)
+		close(events)
+		cancel()
+	}
+}
+
+// closeWatchers removes every watcher from the table and closes their channels.
+func (t *Table) closeWatchers() {
+	t.watchLock.Lock()
+	defer t.watchLock.Unlock()
+	for events, cancel := range t.watchers {
+		delete(t.watchers, events)
+		close(events)
+		cancel()
+	}
+}
+
+// notifyWatchers sends a committed change of the table to its watchers, dropping those whose buffer is full.
+// Each watcher gets its own copy of the records. The caller must hold the table write lock, so that events are sent
+// in commit order.
+func (t *Table) notifyWatchers(operation, key string, before, after *dbdata.Record) {
+	t.watchLock.Lock()
+	defer t.watchLock.Unlock()
+	if len(t.watchers) == 0 {
+		return
+	}
+
+	committed := time.Now().UTC()
+	for events, cancel := range t.watchers {
+		event := ChangeEvent{Operation: operation, Key: key, Time: committed, RequestID: t.requestID}
+		var err error
+		if before != nil {
+			if event.Before, err = fromProtoRecord(before); err != nil {
+				log.Printf("Failed to convert record %s for the watchers%s: %v", key, t.requestSuffix(), err)
+				return
+			}
+		}
+		if after != nil {
+			if event.After, err = fromProtoRecord(after); err != nil {
+				log.Printf("Failed to convert record %s for the watchers%s: %v", key, t.requestSuffix(), err)
+				return
+			}
+		}
+
+		select {
+		case events <- event:
+		default:
+			delete(t.watchers, events)
+			close(events)
+			cancel()
+			log.Printf("Dropped a watcher of table %s that fell %d changes behind", t.FilePath, watchBuffer)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package data
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// DefaultWriteBehindInterval is how long the changes of a table in write-behind mode stay unflushed when its
+// WriteBehind sets no interval.
+const DefaultWriteBehindInterval = time.Second
+
+// WriteBehind configures the write-behind mode of a table. By default every write replaces the table file before it
+// returns; in write-behind mode writes are applied in memory, shipped to the commit log and returned right away, and
+// the file is written once for all the writes made since the previous flush: IntervalMs after the first of them, or
+// as soon as Commits of them are pending. Before a write returns, the records it changed are appended to the
+// write-behind log of the table, next to its file, and flushed to stable storage, which costs far less than writing
+// the file. Reads see every write at once, and the writes not yet flushed survive the process dying: opening the table
+// replays them from the log and writes them to the file.
+type WriteBehind struct {
+	IntervalMs int `json:"IntervalMs,omitempty"` // IntervalMs is how many milliseconds changes stay unflushed at most, DefaultWriteBehindInterval if 0.
+	Commits    int `json:"Commits,omitempty"`    // Commits is the number of pending writes that are flushed at once, no limit if 0.
+}
+
+// interval returns how long changes stay unflushed at most.
+func (w *WriteBehind) interval() time.Duration {
+	if w.IntervalMs > 0 {
+		return time.Duration(w.IntervalMs) * time.Millisecond
+	}
+	return DefaultWriteBehindInterval
+}
+
+// validateWriteBehind checks that a write-behind mode can be applied.
+func validateWriteBehind(policy *WriteBehind) error {
+	if policy == nil {
+		return nil
+	}
+	if policy.IntervalMs < 0 {
+		return fmt.Errorf("invalid write-behind interval of %d ms, expected a positive number", policy.IntervalMs)
+	}
+	if policy.Commits < 0 {
+		return fmt.Errorf("invalid write-behind commit count %d, expected a positive number", policy.Commits)
+	}
+	return nil
+}
+
+// pendingLogSuffix replaces the .dat extension of a table file for the write-behind log of the table, which holds
+// the writes made since the file was last written.
+const pendingLogSuffix = ".pending"
+
+// pendingFrameHeader is the size of the header of a frame of the write-behind log: the size of the encoded changes
+// of the write, then their CRC-32, both big-endian.
+const pendingFrameHeader = 8
+
+// writeBehindState tracks the writes of a table in write-behind mode that are not in its file yet.
+type writeBehindState struct {
+	pending atomic.Int64             // Writes published since the file was last written
+	timer   *time.Timer              // Timer of the next flush, nil if none is scheduled
+	flushed atomic.Pointer[snapshot] // Version of the records in the file while writes are pending, nil if none are
+	log     *os.File                 // Write-behind log the pending writes are appended to, nil until the first
+	logSize int64                    // Size of the complete frames of the log
+	stale   bool                     // Whether the log holds writes already in the file, as removing it failed
+}
+
+// pendingLogPath returns the path of the write-behind log of the table file at filePath.
+func pendingLogPath(filePath string) string {
+	return strings.TrimSuffix(filePath, ".dat") + pendingLogSuffix
+}
+
+// SetWriteBehind is a method of the Table struct that switches the table to write-behind mode, which is stored in its
+// metadata, or back to writing the file on every write. Changes still pending are flushed first, so switching the
+// mode off leaves every write that returned in the file.
+//
+// Parameters:
+// - policy: When the pending changes are flushed, or nil to write the file on every write.
+//
+// Returns:
+// - An error, if the policy is invalid, the pending changes cannot be flushed or the metadata cannot be written. If
+// the operation is successful, the error is nil.
+func (t *Table) SetWriteBehind(policy *WriteBehind) error {
+	if err := validateWriteBehind(policy); err != nil {
+		return err
+	}
+	unlock, err := t.lockWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := t.flushPending(); err != nil {
+		return err
+	}
+	return t.saveOptions(func(options *TableOptions) {
+		options.WriteBehind = policy
+	})
+}
+
+// Flush is a method of the Table struct that writes the changes left pending by write-behind to the file and
+// flushes it to stable storage, after waiting for the writes in progress. Tables that are not in write-behind mode
+// only have their file flushed. Every write that returned before Flush survives a crash once it returns.
+//
+// Returns:
+// - ErrClosed if the table has been closed, or an error if the file cannot be written or flushed. If the operation is
+// successful, the error is nil.
+func (t *Table) Flush() error {
+	if t.closed.Load() {
+		return ErrClosed
+	}
+	return t.sync()
+}
+
+// UnflushedWrites returns the number of writes applied in memory but not yet written to the file, which is only
+// non-zero in write-behind mode.
+func (t *Table) UnflushedWrites() int {
+	return int(t.writeBehind.pending.Load())
+}
+
+// logPending appends the records of the given keys, with a tombstone for each deleted one, to the write-behind log of
+// the table as one frame, encoded like the file, and flushes it to stable storage, so a write that write-behind leaves
+// pending survives a crash: reading the file replays the log, see replayPending. A frame that cannot be written is cut
+// off again, so the write fails without leaving a torn frame before the next ones. The caller must hold the table
+// write lock.
+func (t *Table) logPending(records map[string]*dbdata.Record, keys map[string]struct{}) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := t.discardStaleLog(); err != nil {
+		return err
+	}
+	ctx := t.traceCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	payload, err := t.encodeRecords(ctx, changesOf(records, keys))
+	if err != nil {
+		return err
+	}
+	if t.writeBehind.log == nil {
+		file, err := os.OpenFile(pendingLogPath(t.FilePath), os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open write-behind log: %v", err)
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("failed to open write-behind log: %v", err)
+		}
+		t.writeBehind.log, t.writeBehind.logSize = file, info.Size()
+	}
+
+	frame := make([]byte, pendingFrameHeader, pendingFrameHeader+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(payload))
+	frame = append(frame, payload...)
+	file := t.writeBehind.log
+	if _, err = file.WriteAt(frame, t.writeBehind.logSize); err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		if truncErr := file.Truncate(t.writeBehind.logSize); truncErr != nil {
+			log.Printf("Failed to cut a failed write off the write-behind log of table %s: %v", t.FilePath, truncErr)
+		}
+		return fmt.Errorf("failed to write write-behind log: %v", err)
+	}
+	t.writeBehind.logSize += int64(len(frame))
+	return nil
+}
+
+// replayPending applies the writes of the write-behind log of the table to the records read from its file and
+// segments, in the order they were made, and returns how many it applied. A last frame cut short, or failing its
+// checksum, is a write interrupted by a crash before it returned, and ends the log.
+func (t *Table) replayPending(ctx context.Context, records *dbdata.Records) (int, error) {
+	content, err := os.ReadFile(pendingLogPath(t.FilePath))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to read write-behind log: %v", err)
+	}
+	count := 0
+	for len(content) >= pendingFrameHeader {
+		size := uint64(binary.BigEndian.Uint32(content))
+		if uint64(len(content)-pendingFrameHeader) < size {
+			break
+		}
+		payload := content[pendingFrameHeader : pendingFrameHeader+int(size)]
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(content[4:]) {
+			break
+		}
+		changes, err := t.decodeRecords(ctx, payload)
+		if err != nil {
+			return count, fmt.Errorf("write-behind log: %w", err)
+		}
+		if changes.FormatVersion < RecordsFormatVersion {
+			upgradeRecords(changes)
+		}
+		applyChanges(records, changes)
+		content = content[pendingFrameHeader+int(size):]
+		count++
+	}
+	return count, nil
+}
+
+// discardPendingLog closes and removes the write-behind log once the writes it holds are in the file or discarded.
+// A log that cannot be removed is marked stale, and removed before the next write is made. The caller must hold the
+// table write lock.
+func (t *Table) discardPendingLog() {
+	if t.readOnly.Load() {
+		return
+	}
+	if t.writeBehind.log != nil {
+		t.writeBehind.log.Close()
+		t.writeBehind.log, t.writeBehind.logSize = nil, 0
+	}
+	if err := os.Remove(pendingLogPath(t.FilePath)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove the write-behind log of table %s, retrying on the next write: %v", t.FilePath, err)
+		t.writeBehind.stale = true
+		return
+	}
+	t.writeBehind.stale = false
+}
+
+// discardStaleLog removes the write-behind log left stale by discardPendingLog, so its writes are never replayed onto
+// newer records. The caller must hold the table write lock.
+func (t *Table) discardStaleLog() error {
+	if !t.writeBehind.stale {
+		return nil
+	}
+	if err := os.Remove(pendingLogPath(t.FilePath)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale write-behind log: %v", err)
+	}
+	t.writeBehind.stale = false
+	return nil
+}
+
+// deferBefore keeps the current version of the records as the one in the file, for durable reads, before the first
+// write that write-behind leaves pending replaces it. The caller must hold the table write lock.
+func (t *Table) deferBefore() {
+	if t.writeBehind.flushed.Load() == nil {
+		t.writeBehind.flushed.Store(t.current.Load())
+	}
+}
+
+// deferWrite counts a write published without writing the file, and flushes the pending writes if they reached the
+// commit count of the write-behind mode, or schedules their flush otherwise. A flush that fails is retried after
+// the interval. The caller must hold the table write lock.
+func (t *Table) deferWrite() {
+	policy := t.Options.WriteBehind
+	pending := t.writeBehind.pending.Add(1)
+	if policy.Commits > 0 && pending >= int64(policy.Commits) {
+		err := t.flushPending()
+		if err == nil {
+			return
+		}
+		log.Printf("Failed to flush table %s, retrying in %v: %v", t.FilePath, policy.interval(), err)
+	}
+	if t.writeBehind.timer == nil {
+		t.writeBehind.timer = time.AfterFunc(policy.interval(), t.flushBehind)
+	}
+}
+
+// flushBehind flushes the pending writes once the interval of the write-behind mode has passed.
+func (t *Table) flushBehind() {
+	t.Lock()
+	defer t.Unlock()
+	t.writeBehind.timer = nil
+	if err := t.flushPending(); err != nil {
+		interval := DefaultWriteBehindInterval
+		if t.Options.WriteBehind != nil {
+			interval = t.Options.WriteBehind.interval()
+		}
+		log.Printf("Failed to flush table %s, retrying in %v: %v", t.FilePath, interval, err)
+		t.writeBehind.timer = time.AfterFunc(interval, t.flushBehind)
+	}
+}
+
+// flushPending writes the current records to the file if write-behind left writes pending, or only the records they
+// changed to a segment for a segmented table, and cancels the scheduled flush. The pending writes of a dropped table
+// are discarded. The caller must hold the table write lock.
+func (t *Table) flushPending() error {
+	if t.writeBehind.pending.Load() == 0 {
+		return nil
+	}
+	if t.dropped {
+		t.settlePending()
+		return nil
+	}
+	if t.Options.Segmentation == nil {
+		return t.rewriteFile()
+	}
+	if err := t.storeChanges(t.Records, t.segments.unwritten); err != nil {
+		return err
+	}
+	t.settlePending()
+	return nil
+}
+
+// rewriteFile writes the current records to the file, replacing the segments of the table, which leaves no write
+// pending, and cancels the scheduled flush. The caller must hold the table write lock.
+func (t *Table) rewriteFile() error {
+	if err := t.checkpoint(t.Records); err != nil {
+		return err
+	}
+	t.settlePending()
+	return nil
+}
+
+// settlePending forgets the writes left pending by write-behind, removing them from the write-behind log, and cancels
+// the scheduled flush, once they are in the file or discarded. The caller must hold the table write lock.
+func (t *Table) settlePending() {
+	t.discardPendingLog()
+	t.writeBehind.pending.Store(0)
+	t.writeBehind.flushed.Store(nil)
+	t.segments.unwritten = nil
+	if t.writeBehind.timer != nil {
+		t.writeBehind.timer.Stop()
+		t.writeBehind.timer = nil
+	}
+}
+
+// flushPendingWrites writes the changes left pending by write-behind on every table of the server to their files,
+// before the files are read or replaced as a whole. The caller must hold the server lock.
+func (s *Server) flushPendingWrites() error {
+	for dbName, db := range s.Databases {
+		db.RLock()
+		for tableName, table := range db.Tables {
+			table.Lock()
+			err := table.flushPending()
+			table.Unlock()
+			if err != nil {
+				db.RUnlock()
+				return fmt.Errorf("failed to flush table %s.%s: %w", dbName, tableName, err)
+			}
+		}
+		db.RUnlock()
+	}
+	return nil
+}
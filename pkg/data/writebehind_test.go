@@ -0,0 +1,78 @@
+package data_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+)
+
+// TestWriteBehindLogSurvivesCrash checks that the writes of a table in write-behind mode that were never flushed,
+// as when the process dies, are replayed from its write-behind log when the table is opened again, ignoring a write
+// the crash cut short, and that the replayed writes are then in the file.
+func TestWriteBehindLogSurvivesCrash(t *testing.T) {
+	if os.Getenv("AES_KEY") == "" && os.Getenv("AES_KEY_FILE") == "" {
+		t.Setenv("AES_KEY", "0123456789abcdef0123456789abcdef")
+	}
+	path := filepath.Join(t.TempDir(), "events.dat")
+	options := data.TableOptions{WriteBehind: &data.WriteBehind{IntervalMs: 3600 * 1000}}
+
+	crashed, err := data.OpenTable("id", path, options)
+	if err != nil {
+		t.Fatalf("Failed to open table: %v", err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if err := crashed.Insert(data.Record{"id": id, "n": 1}); err != nil {
+			t.Fatalf("Failed to insert %s: %v", id, err)
+		}
+	}
+	if err := crashed.Update("b", data.Record{"n": 2}); err != nil {
+		t.Fatalf("Failed to update b: %v", err)
+	}
+	if err := crashed.Delete("c"); err != nil {
+		t.Fatalf("Failed to delete c: %v", err)
+	}
+	if crashed.UnflushedWrites() == 0 {
+		t.Fatal("Expected the writes to be left unflushed")
+	}
+
+	// The crash interrupted the next write halfway through its frame
+	logPath := filepath.Join(filepath.Dir(path), "events.pending")
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open the write-behind log: %v", err)
+	}
+	file.Write([]byte{0, 0, 1, 0, 42})
+	file.Close()
+
+	check := func(table *data.Table) {
+		t.Helper()
+		records, err := table.SelectAll()
+		if err != nil {
+			t.Fatalf("Failed to select records: %v", err)
+		}
+		if len(records) != 2 {
+			t.Fatalf("Expected records a and b, found %v", records)
+		}
+		b, err := table.Select("b")
+		if err != nil || b["n"] != int64(2) {
+			t.Errorf("Expected b to have n = 2, found %v (%v)", b, err)
+		}
+	}
+	reopened, err := data.OpenTable("id", path, options)
+	if err != nil {
+		t.Fatalf("Failed to reopen table: %v", err)
+	}
+	check(reopened)
+	if _, err := os.Stat(logPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the write-behind log to be removed once replayed, found %v", err)
+	}
+
+	// The replayed writes were written to the file
+	again, err := data.OpenTable("id", path, data.TableOptions{})
+	if err != nil {
+		t.Fatalf("Failed to open table again: %v", err)
+	}
+	check(again)
+}
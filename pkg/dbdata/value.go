@@ -0,0 +1,200 @@
+package dbdata
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// NewValue converts a Go value to a Value like structpb.NewValue does, except that integers are stored as
+// int64, byte slices as bytes and time.Time values as timestamps rather than as numbers and strings. Unsigned
+// integers above the range of int64 are stored as numbers.
+func NewValue(v interface{}) (*Value, error) {
+	switch v := v.(type) {
+	case nil:
+		return NewNullValue(), nil
+	case bool:
+		return NewBoolValue(v), nil
+	case int:
+		return NewIntValue(int64(v)), nil
+	case int8:
+		return NewIntValue(int64(v)), nil
+	case int16:
+		return NewIntValue(int64(v)), nil
+	case int32:
+		return NewIntValue(int64(v)), nil
+	case int64:
+		return NewIntValue(v), nil
+	case uint:
+		return newUintValue(uint64(v)), nil
+	case uint8:
+		return NewIntValue(int64(v)), nil
+	case uint16:
+		return NewIntValue(int64(v)), nil
+	case uint32:
+		return NewIntValue(int64(v)), nil
+	case uint64:
+		return newUintValue(v), nil
+	case float32:
+		return NewNumberValue(float64(v)), nil
+	case float64:
+		return NewNumberValue(v), nil
+	case string:
+		return NewStringValue(v), nil
+	case []byte:
+		return NewBytesValue(v), nil
+	case time.Time:
+		return NewTimestampValue(v), nil
+	case map[string]interface{}:
+		s, err := structpb.NewStruct(nestedValue(v).(map[string]interface{}))
+		if err != nil {
+			return nil, err
+		}
+		return NewStructValue(s), nil
+	case []interface{}:
+		l, err := structpb.NewList(nestedValue(v).([]interface{}))
+		if err != nil {
+			return nil, err
+		}
+		return NewListValue(l), nil
+	default:
+		return nil, fmt.Errorf("invalid type: %T", v)
+	}
+}
+
+// nestedValue returns a copy of a value nested in a struct or list with the times it holds converted to RFC 3339
+// strings, which structpb cannot store otherwise.
+func nestedValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			converted[key] = nestedValue(value)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, value := range v {
+			converted[i] = nestedValue(value)
+		}
+		return converted
+	default:
+		return v
+	}
+}
+
+// newUintValue stores an unsigned integer as an int64 if it fits and as a number otherwise.
+func newUintValue(v uint64) *Value {
+	if v > math.MaxInt64 {
+		return NewNumberValue(float64(v))
+	}
+	return NewIntValue(int64(v))
+}
+
+// NewNullValue constructs a new null Value.
+func NewNullValue() *Value {
+	return &Value{Kind: &Value_NullValue{NullValue: structpb.NullValue_NULL_VALUE}}
+}
+
+// NewBoolValue constructs a new boolean Value.
+func NewBoolValue(v bool) *Value {
+	return &Value{Kind: &Value_BoolValue{BoolValue: v}}
+}
+
+// NewIntValue constructs a new integer Value.
+func NewIntValue(v int64) *Value {
+	return &Value{Kind: &Value_IntValue{IntValue: v}}
+}
+
+// NewNumberValue constructs a new floating point number Value.
+func NewNumberValue(v float64) *Value {
+	return &Value{Kind: &Value_NumberValue{NumberValue: v}}
+}
+
+// NewStringValue constructs a new string Value.
+func NewStringValue(v string) *Value {
+	return &Value{Kind: &Value_StringValue{StringValue: v}}
+}
+
+// NewBytesValue constructs a new bytes Value.
+func NewBytesValue(v []byte) *Value {
+	return &Value{Kind: &Value_BytesValue{BytesValue: v}}
+}
+
+// NewTimestampValue constructs a new timestamp Value, keeping the UTC offset of v.
+func NewTimestampValue(v time.Time) *Value {
+	_, offset := v.Zone()
+	return &Value{Kind: &Value_TimestampValue{TimestampValue: &Timestamp{
+		Seconds:   v.Unix(),
+		Nanos:     int32(v.Nanosecond()),
+		UtcOffset: int32(offset),
+	}}}
+}
+
+// AsTime converts x to a time.Time in a fixed zone with the stored UTC offset, or in UTC if the offset is zero.
+func (x *Timestamp) AsTime() time.Time {
+	t := time.Unix(x.GetSeconds(), int64(x.GetNanos()))
+	if x.GetUtcOffset() == 0 {
+		return t.UTC()
+	}
+	return t.In(time.FixedZone("", int(x.GetUtcOffset())))
+}
+
+// NewStructValue constructs a new struct Value.
+func NewStructValue(v *structpb.Struct) *Value {
+	return &Value{Kind: &Value_StructValue{StructValue: v}}
+}
+
+// NewListValue constructs a new list Value.
+func NewListValue(v *structpb.ListValue) *Value {
+	return &Value{Kind: &Value_ListValue{ListValue: v}}
+}
+
+// AsInterface converts x to a Go value: nil, bool, int64, float64, string, []byte, time.Time,
+// map[string]interface{} or []interface{}. Nested structs and lists hold the values structpb.Value.AsInterface
+// returns.
+func (x *Value) AsInterface() interface{} {
+	switch v := x.GetKind().(type) {
+	case *Value_BoolValue:
+		return v.BoolValue
+	case *Value_IntValue:
+		return v.IntValue
+	case *Value_NumberValue:
+		return v.NumberValue
+	case *Value_StringValue:
+		return v.StringValue
+	case *Value_BytesValue:
+		return v.BytesValue
+	case *Value_TimestampValue:
+		return v.TimestampValue.AsTime()
+	case *Value_StructValue:
+		return v.StructValue.AsMap()
+	case *Value_ListValue:
+		return v.ListValue.AsSlice()
+	default:
+		return nil
+	}
+}
+
+// NewValueFromStructpb converts a value nested in a struct or list to a Value. Nested numbers stay numbers, as
+// structpb stores integers as numbers too.
+func NewValueFromStructpb(v *structpb.Value) *Value {
+	switch v := v.GetKind().(type) {
+	case *structpb.Value_BoolValue:
+		return NewBoolValue(v.BoolValue)
+	case *structpb.Value_NumberValue:
+		return NewNumberValue(v.NumberValue)
+	case *structpb.Value_StringValue:
+		return NewStringValue(v.StringValue)
+	case *structpb.Value_StructValue:
+		return NewStructValue(v.StructValue)
+	case *structpb.Value_ListValue:
+		return NewListValue(v.ListValue)
+	default:
+		return NewNullValue()
+	}
+}
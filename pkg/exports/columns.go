@@ -0,0 +1,97 @@
+package exports
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// Column types of the typed exports, Parquet and SQL. They are the field types of table schemas, and columnJSON for
+// the objects and lists of tables without one.
+const (
+	columnString    = "string"
+	columnInt       = "int"
+	columnFloat     = "float"
+	columnBool      = "bool"
+	columnTimestamp = "timestamp"
+	columnBytes     = "bytes"
+	columnJSON      = "json"
+)
+
+// typedColumn is a column of a typed export: a top-level field of the records and its type.
+type typedColumn struct {
+	name    string
+	colType string
+}
+
+// typedColumns returns the columns of the records, sorted by name: the fields declared in the schema, with their
+// declared type, and the fields of the records, with the type inferred from their values.
+func typedColumns(records []*dbdata.Record, schema map[string]string) []typedColumn {
+	kinds := make(map[string]map[string]bool)
+	for field := range schema {
+		kinds[field] = make(map[string]bool)
+	}
+	for _, rec := range records {
+		for field, val := range rec.GetFields() {
+			if kinds[field] == nil {
+				kinds[field] = make(map[string]bool)
+			}
+			if kind := valueColumnType(val); kind != "" {
+				kinds[field][kind] = true
+			}
+		}
+	}
+
+	columns := make([]typedColumn, 0, len(kinds))
+	for field, seen := range kinds {
+		colType, declared := schema[field]
+		if !declared {
+			colType = inferColumnType(seen)
+		}
+		columns = append(columns, typedColumn{name: field, colType: colType})
+	}
+	sort.Slice(columns, func(i, j int) bool { return columns[i].name < columns[j].name })
+	return columns
+}
+
+// valueColumnType returns the column type of a value on its own, or "" for NULL.
+func valueColumnType(val *dbdata.Value) string {
+	switch val.GetKind().(type) {
+	case *dbdata.Value_IntValue:
+		return columnInt
+	case *dbdata.Value_NumberValue:
+		return columnFloat
+	case *dbdata.Value_BoolValue:
+		return columnBool
+	case *dbdata.Value_TimestampValue:
+		return columnTimestamp
+	case *dbdata.Value_BytesValue:
+		return columnBytes
+	case *dbdata.Value_StructValue, *dbdata.Value_ListValue:
+		return columnJSON
+	case *dbdata.Value_NullValue, nil:
+		return ""
+	default:
+		return columnString
+	}
+}
+
+// inferColumnType returns the type of a column holding values of the given types: their type if they all have the
+// same, float for integers mixed with floating point numbers, and string otherwise, or for a column of NULLs.
+func inferColumnType(kinds map[string]bool) string {
+	if len(kinds) == 1 {
+		for kind := range kinds {
+			return kind
+		}
+	}
+	if len(kinds) == 2 && kinds[columnInt] && kinds[columnFloat] {
+		return columnFloat
+	}
+	return columnString
+}
+
+// columnTypeError reports a value that does not have the type declared for its column.
+func columnTypeError(column typedColumn, val *dbdata.Value) error {
+	return fmt.Errorf("field '%s' is declared as %s but holds %v", column.name, column.colType, val.AsInterface())
+}
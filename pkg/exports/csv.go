@@ -1,45 +1,91 @@
 package exports
 
 import (
+	"encoding/base64"
 	"encoding/csv"
 	"fmt"
+	"io"
 	"os"
 	"sort"
+	"strconv"
+	"time"
 
 	"github.com/Malpizarr/dbproto/pkg/dbdata"
-	"google.golang.org/protobuf/types/known/structpb"
 )
 
-func formatProtoValueCSV(val *structpb.Value) string {
+func formatProtoValueCSV(val *dbdata.Value) string {
 	if val == nil {
 		return ""
 	}
 	switch x := val.Kind.(type) {
-	case *structpb.Value_StringValue:
+	case *dbdata.Value_StringValue:
 		return x.StringValue
-	case *structpb.Value_NumberValue:
+	case *dbdata.Value_IntValue:
+		return strconv.FormatInt(x.IntValue, 10)
+	case *dbdata.Value_NumberValue:
 		return fmt.Sprintf("%g", x.NumberValue)
-	case *structpb.Value_BoolValue:
+	case *dbdata.Value_BoolValue:
 		return fmt.Sprintf("%t", x.BoolValue)
+	case *dbdata.Value_BytesValue:
+		return base64.StdEncoding.EncodeToString(x.BytesValue)
+	case *dbdata.Value_TimestampValue:
+		return x.TimestampValue.AsTime().Format(time.RFC3339Nano)
+	case *dbdata.Value_NullValue:
+		return ""
+	case *dbdata.Value_StructValue, *dbdata.Value_ListValue:
+		return formatCollection(val)
 	default:
 		return fmt.Sprintf("%v", val)
 	}
 }
 
-// ExportRecordsToCSV exports a slice of records to a CSV file.
+// ExportRecordsToCSV exports a slice of records to a CSV file. Values nested in objects and lists get a column per
+// path, such as "address.city" or "tags.0".
 func ExportRecordsToCSV(records []*dbdata.Record, filename string) error {
 	file, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
+	return WriteRecordsCSV(file, records)
+}
+
+// WriteRecordsCSV writes records as CSV to w, under a header row of the columns of every record, sorted, like
+// ExportRecordsToCSV does. Rows are written to w as they are formatted, so the output is never held in memory.
+func WriteRecordsCSV(w io.Writer, records []*dbdata.Record) error {
+	return ExportCSV(w, SliceIterator(records))
+}
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+// ExportCSV streams the records of the iterator to w as CSV, like WriteRecordsCSV, writing each row as it is
+// formatted. The header needs the columns of every record before the first row: a ResettableIterator is read twice,
+// first for the columns, and any other iterator gives the columns of its first record, so that a later record with
+// another column fails the export.
+func ExportCSV(w io.Writer, iter RecordIterator) error {
+	writer := csv.NewWriter(w)
 
+	// Nested values get a column per path, see flattenFields. Records are flattened again when their row is written,
+	// rather than kept flattened, so only the column names stay in memory
 	keySet := make(map[string]bool)
-	for _, rec := range records {
-		for key := range rec.Fields {
+	var first *dbdata.Record
+	if resettable, ok := iter.(ResettableIterator); ok {
+		err := forEachRecord(iter, func(rec *dbdata.Record) error {
+			for key := range flattenFields(rec.GetFields()) {
+				keySet[key] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := resettable.Reset(); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if first, err = iter.Next(); err != nil && err != io.EOF {
+			return err
+		}
+		for key := range flattenFields(first.GetFields()) {
 			keySet[key] = true
 		}
 	}
@@ -54,19 +100,32 @@ func ExportRecordsToCSV(records []*dbdata.Record, filename string) error {
 		return err
 	}
 
-	for _, rec := range records {
+	writeRow := func(rec *dbdata.Record) error {
+		fields := flattenFields(rec.GetFields())
+		for key := range fields {
+			if !keySet[key] {
+				return fmt.Errorf("field '%s' is not a column of the CSV header, which was taken from the first record", key)
+			}
+		}
 		row := make([]string, len(headers))
 		for i, header := range headers {
-			if val, ok := rec.Fields[header]; ok && val != nil {
+			if val, ok := fields[header]; ok && val != nil {
 				row[i] = formatProtoValueCSV(val)
 			} else {
 				row[i] = ""
 			}
 		}
-		if err := writer.Write(row); err != nil {
+		return writer.Write(row)
+	}
+	if first != nil {
+		if err := writeRow(first); err != nil {
 			return err
 		}
 	}
+	if err := forEachRecord(iter, writeRow); err != nil {
+		return err
+	}
 
-	return nil
+	writer.Flush()
+	return writer.Error()
 }
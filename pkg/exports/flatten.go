@@ -0,0 +1,53 @@
+package exports
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// flattenFields returns the fields of a record with the values nested in objects and lists spread over fields named
+// by their path, such as "address.city" or "tags.0", so that each column or element holds a single value. Empty
+// objects and lists are kept as they are. A nested value whose path is also the name of a field of the record is
+// left out in favor of that field.
+func flattenFields(fields map[string]*dbdata.Value) map[string]*dbdata.Value {
+	flat := make(map[string]*dbdata.Value, len(fields))
+	for name, value := range fields {
+		flattenValue(fields, flat, name, value, false)
+	}
+	return flat
+}
+
+// flattenValue adds the value stored at path to flat, or the values nested in it if it is a non-empty object or list.
+func flattenValue(fields, flat map[string]*dbdata.Value, path string, value *dbdata.Value, nested bool) {
+	if _, shadowed := fields[path]; shadowed && nested {
+		return
+	}
+	switch v := value.GetKind().(type) {
+	case *dbdata.Value_StructValue:
+		if len(v.StructValue.GetFields()) > 0 {
+			for name, element := range v.StructValue.GetFields() {
+				flattenValue(fields, flat, path+"."+name, dbdata.NewValueFromStructpb(element), true)
+			}
+			return
+		}
+	case *dbdata.Value_ListValue:
+		if len(v.ListValue.GetValues()) > 0 {
+			for i, element := range v.ListValue.GetValues() {
+				flattenValue(fields, flat, path+"."+strconv.Itoa(i), dbdata.NewValueFromStructpb(element), true)
+			}
+			return
+		}
+	}
+	flat[path] = value
+}
+
+// formatCollection formats an object or list as JSON, which is how the empty ones flattenFields keeps are written.
+func formatCollection(val *dbdata.Value) string {
+	data, err := json.Marshal(val.AsInterface())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
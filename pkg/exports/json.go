@@ -0,0 +1,55 @@
+package exports
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// ExportRecordsToJSON exports a slice of records to a JSON file holding an array of objects.
+// Nested values, such as the records embedded by a denormalized export, are written as nested objects.
+func ExportRecordsToJSON(records []*dbdata.Record, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return ExportJSON(file, SliceIterator(records))
+}
+
+// ExportJSON streams the records of the iterator to w as an indented JSON array of objects, like
+// ExportRecordsToJSON, encoding and writing each record in turn.
+func ExportJSON(w io.Writer, iter RecordIterator) error {
+	out := bufio.NewWriter(w)
+	count := 0
+	err := forEachRecord(iter, func(rec *dbdata.Record) error {
+		object := make(map[string]interface{}, len(rec.Fields))
+		for key, val := range rec.Fields {
+			object[key] = val.AsInterface()
+		}
+		encoded, err := json.MarshalIndent(object, "  ", "  ")
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			out.WriteString("[\n  ")
+		} else {
+			out.WriteString(",\n  ")
+		}
+		count++
+		_, err = out.Write(encoded)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		out.WriteString("[]\n")
+	} else {
+		out.WriteString("\n]\n")
+	}
+	return out.Flush()
+}
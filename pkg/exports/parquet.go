@@ -0,0 +1,424 @@
+package exports
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// parquetRowGroupRows is the number of records written in each row group of a Parquet export. Readers such as
+// Spark split their work by row group, and a writer holds one in memory.
+const parquetRowGroupRows = 100000
+
+// Parquet physical types, converted types and encodings, see parquet.thrift.
+const (
+	parquetBooleanType   = 0
+	parquetInt64Type     = 2
+	parquetDoubleType    = 5
+	parquetByteArrayType = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMicros = 10
+	parquetJSONConverted   = 19
+
+	parquetPlainEncoding = 0
+	parquetRLEEncoding   = 3
+	parquetGzipCodec     = 2
+	parquetOptional      = 1
+	parquetDataPage      = 0
+)
+
+// parquetRowGroup is a row group written to a Parquet file, for the footer of the file.
+type parquetRowGroup struct {
+	rows   int64
+	chunks []parquetChunk
+}
+
+// parquetChunk locates a column chunk written in a row group, for the footer of the file.
+type parquetChunk struct {
+	offset       int64
+	values       int64
+	uncompressed int64
+	compressed   int64
+}
+
+// ExportRecordsToParquet exports a slice of records to a Parquet file, with a column per top-level field, for
+// analytics tools such as DuckDB, Spark or Athena to query directly. The fields declared in the schema, which uses the
+// field types of table schemas, get its types; the type of the other fields is inferred from their values. See
+// WriteRecordsParquet.
+func ExportRecordsToParquet(records []*dbdata.Record, filename string, schema map[string]string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := WriteRecordsParquet(file, records, schema); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// WriteRecordsParquet writes records to w as a Parquet file. Every column is optional, so missing fields and NULL
+// are null. A field whose values are all integers is an INT64 column, integers mixed with floating point numbers a
+// DOUBLE, and booleans, timestamps and bytes get a column of their own type; timestamps are stored in UTC with
+// microsecond precision. Objects and lists are written as JSON strings, and fields whose values have several types
+// as strings formatted like in CSV exports. Pages are compressed with gzip.
+//
+// It returns an error if a value does not have the type the schema declares for its field.
+func WriteRecordsParquet(w io.Writer, records []*dbdata.Record, schema map[string]string) error {
+	columns := typedColumns(records, schema)
+	out := &countingWriter{w: w}
+	if _, err := out.Write([]byte("PAR1")); err != nil {
+		return err
+	}
+
+	var rowGroups []parquetRowGroup
+	for start := 0; start < len(records); start += parquetRowGroupRows {
+		end := start + parquetRowGroupRows
+		if end > len(records) {
+			end = len(records)
+		}
+		chunks := make([]parquetChunk, len(columns))
+		for i, column := range columns {
+			page, err := encodeParquetPage(column, records[start:end])
+			if err != nil {
+				return err
+			}
+			chunks[i] = parquetChunk{offset: out.n, values: int64(end - start)}
+			header, err := writeParquetPage(out, page, end-start)
+			if err != nil {
+				return err
+			}
+			chunks[i].uncompressed = int64(header) + int64(len(page))
+			chunks[i].compressed = out.n - chunks[i].offset
+		}
+		rowGroups = append(rowGroups, parquetRowGroup{rows: int64(end - start), chunks: chunks})
+	}
+
+	footer := parquetFooter(columns, rowGroups, int64(len(records)))
+	if _, err := out.Write(footer); err != nil {
+		return err
+	}
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:4], uint32(len(footer)))
+	copy(trailer[4:], "PAR1")
+	_, err := out.Write(trailer[:])
+	return err
+}
+
+// encodeParquetPage encodes the values of a column in a data page: the definition levels, which tell the values
+// from the nulls, then the PLAIN encoding of the values.
+func encodeParquetPage(column typedColumn, records []*dbdata.Record) ([]byte, error) {
+	defined := make([]bool, len(records))
+	var values bytes.Buffer
+	var bits []bool
+	for i, rec := range records {
+		val, ok := rec.GetFields()[column.name]
+		if !ok || valueColumnType(val) == "" {
+			continue
+		}
+		defined[i] = true
+		switch column.colType {
+		case columnInt:
+			x, ok := val.GetKind().(*dbdata.Value_IntValue)
+			if !ok {
+				return nil, columnTypeError(column, val)
+			}
+			binary.Write(&values, binary.LittleEndian, x.IntValue)
+		case columnFloat:
+			var f float64
+			switch x := val.GetKind().(type) {
+			case *dbdata.Value_NumberValue:
+				f = x.NumberValue
+			case *dbdata.Value_IntValue:
+				f = float64(x.IntValue)
+			default:
+				return nil, columnTypeError(column, val)
+			}
+			binary.Write(&values, binary.LittleEndian, math.Float64bits(f))
+		case columnBool:
+			x, ok := val.GetKind().(*dbdata.Value_BoolValue)
+			if !ok {
+				return nil, columnTypeError(column, val)
+			}
+			bits = append(bits, x.BoolValue)
+		case columnTimestamp:
+			x, ok := val.GetKind().(*dbdata.Value_TimestampValue)
+			if !ok {
+				return nil, columnTypeError(column, val)
+			}
+			binary.Write(&values, binary.LittleEndian, x.TimestampValue.AsTime().UnixMicro())
+		case columnBytes:
+			x, ok := val.GetKind().(*dbdata.Value_BytesValue)
+			if !ok {
+				return nil, columnTypeError(column, val)
+			}
+			writeParquetByteArray(&values, x.BytesValue)
+		case columnJSON:
+			writeParquetByteArray(&values, []byte(formatCollection(val)))
+		default:
+			writeParquetByteArray(&values, []byte(formatProtoValueCSV(val)))
+		}
+	}
+	if column.colType == columnBool {
+		values.Write(packBits(bits))
+	}
+
+	levels := encodeDefinitionLevels(defined)
+	page := make([]byte, 0, 4+len(levels)+values.Len())
+	page = binary.LittleEndian.AppendUint32(page, uint32(len(levels)))
+	page = append(page, levels...)
+	return append(page, values.Bytes()...), nil
+}
+
+// writeParquetByteArray writes a BYTE_ARRAY value in the PLAIN encoding: its length, then its bytes.
+func writeParquetByteArray(values *bytes.Buffer, data []byte) {
+	binary.Write(values, binary.LittleEndian, uint32(len(data)))
+	values.Write(data)
+}
+
+// encodeDefinitionLevels encodes the definition levels of an optional column, 1 for a value and 0 for a null, as a
+// single bit-packed run of the RLE/bit-packing hybrid encoding.
+func encodeDefinitionLevels(defined []bool) []byte {
+	packed := packBits(defined)
+	levels := binary.AppendUvarint(nil, uint64(len(packed))<<1|1)
+	return append(levels, packed...)
+}
+
+// packBits packs booleans in bytes, least significant bit first, padded to a multiple of 8.
+func packBits(bits []bool) []byte {
+	packed := make([]byte, (len(bits)+7)/8)
+	for i, bit := range bits {
+		if bit {
+			packed[i/8] |= 1 << (i % 8)
+		}
+	}
+	return packed
+}
+
+// writeParquetPage compresses a data page of numValues values and nulls and writes it with its header. It returns
+// the size of the header.
+func writeParquetPage(w io.Writer, page []byte, numValues int) (int, error) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(page); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+
+	var header thriftWriter
+	header.begin() // PageHeader
+	header.i32(1, parquetDataPage)
+	header.i32(2, int32(len(page)))
+	header.i32(3, int32(compressed.Len()))
+	header.structField(5) // DataPageHeader
+	header.i32(1, int32(numValues))
+	header.i32(2, parquetPlainEncoding)
+	header.i32(3, parquetRLEEncoding)
+	header.i32(4, parquetRLEEncoding)
+	header.end()
+	header.end()
+	if _, err := w.Write(header.buf); err != nil {
+		return 0, err
+	}
+	_, err := w.Write(compressed.Bytes())
+	return len(header.buf), err
+}
+
+// parquetFooter encodes the FileMetaData of a Parquet file: its schema, a root holding the columns, and the row
+// groups with the location of their column chunks.
+func parquetFooter(columns []typedColumn, rowGroups []parquetRowGroup, numRows int64) []byte {
+	var meta thriftWriter
+	meta.begin() // FileMetaData
+	meta.i32(1, 1)
+	meta.list(2, thriftStruct, len(columns)+1)
+	meta.begin()
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(columns)))
+	meta.end()
+	for _, column := range columns {
+		meta.begin() // SchemaElement
+		meta.i32(1, column.physicalType())
+		meta.i32(3, parquetOptional)
+		meta.binary(4, column.name)
+		switch column.colType {
+		case columnString:
+			meta.i32(6, parquetUTF8)
+			meta.structField(10) // LogicalType
+			meta.structField(1)  // StringType
+			meta.end()
+			meta.end()
+		case columnJSON:
+			meta.i32(6, parquetJSONConverted)
+			meta.structField(10)
+			meta.structField(12) // JsonType
+			meta.end()
+			meta.end()
+		case columnTimestamp:
+			meta.i32(6, parquetTimestampMicros)
+			meta.structField(10)
+			meta.structField(8) // TimestampType
+			meta.boolean(1, true)
+			meta.structField(2) // TimeUnit
+			meta.structField(2) // MicroSeconds
+			meta.end()
+			meta.end()
+			meta.end()
+			meta.end()
+		}
+		meta.end()
+	}
+	meta.i64(3, numRows)
+	meta.list(4, thriftStruct, len(rowGroups))
+	for _, rowGroup := range rowGroups {
+		meta.begin() // RowGroup
+		meta.list(1, thriftStruct, len(rowGroup.chunks))
+		var size int64
+		for i, chunk := range rowGroup.chunks {
+			size += chunk.uncompressed
+			meta.begin() // ColumnChunk
+			meta.i64(2, chunk.offset)
+			meta.structField(3) // ColumnMetaData
+			meta.i32(1, columns[i].physicalType())
+			meta.list(2, thriftI32, 2)
+			meta.listI32(parquetPlainEncoding)
+			meta.listI32(parquetRLEEncoding)
+			meta.list(3, thriftBinary, 1)
+			meta.listBinary(columns[i].name)
+			meta.i32(4, parquetGzipCodec)
+			meta.i64(5, chunk.values)
+			meta.i64(6, chunk.uncompressed)
+			meta.i64(7, chunk.compressed)
+			meta.i64(9, chunk.offset)
+			meta.end()
+			meta.end()
+		}
+		meta.i64(2, size)
+		meta.i64(3, rowGroup.rows)
+		meta.end()
+	}
+	meta.binary(6, "dbproto")
+	meta.end()
+	return meta.buf
+}
+
+// physicalType returns the Parquet type the values of the column are stored as.
+func (c typedColumn) physicalType() int32 {
+	switch c.colType {
+	case columnInt, columnTimestamp:
+		return parquetInt64Type
+	case columnFloat:
+		return parquetDoubleType
+	case columnBool:
+		return parquetBooleanType
+	default:
+		return parquetByteArrayType
+	}
+}
+
+// countingWriter counts the bytes written to w, which gives the offsets of the column chunks.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Thrift compact protocol types.
+const (
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes the structures of the Parquet metadata in the Thrift compact protocol.
+type thriftWriter struct {
+	buf  []byte
+	last []int16 // last holds the id of the last field written in each struct being written
+}
+
+// begin starts a struct, at the top level or as an element of a list; end finishes it.
+func (t *thriftWriter) begin() {
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftWriter) end() {
+	t.buf = append(t.buf, 0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+// field writes the header of a field, with the difference from the id of the previous field when it fits.
+func (t *thriftWriter) field(id int16, fieldType byte) {
+	last := &t.last[len(t.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf = append(t.buf, byte(delta)<<4|fieldType)
+	} else {
+		t.buf = append(t.buf, fieldType)
+		t.buf = binary.AppendVarint(t.buf, int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.buf = binary.AppendVarint(t.buf, int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.buf = binary.AppendVarint(t.buf, v)
+}
+
+func (t *thriftWriter) boolean(id int16, v bool) {
+	if v {
+		t.field(id, thriftTrue)
+	} else {
+		t.field(id, thriftFalse)
+	}
+}
+
+func (t *thriftWriter) binary(id int16, v string) {
+	t.field(id, thriftBinary)
+	t.listBinary(v)
+}
+
+// structField starts a struct field, finished by end.
+func (t *thriftWriter) structField(id int16) {
+	t.field(id, thriftStruct)
+	t.begin()
+}
+
+// list writes the header of a list field of size elements, which follow.
+func (t *thriftWriter) list(id int16, elementType byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.buf = append(t.buf, byte(size)<<4|elementType)
+	} else {
+		t.buf = append(t.buf, 0xf0|elementType)
+		t.buf = binary.AppendUvarint(t.buf, uint64(size))
+	}
+}
+
+func (t *thriftWriter) listI32(v int32) {
+	t.buf = binary.AppendVarint(t.buf, int64(v))
+}
+
+func (t *thriftWriter) listBinary(v string) {
+	t.buf = binary.AppendUvarint(t.buf, uint64(len(v)))
+	t.buf = append(t.buf, v...)
+}
@@ -0,0 +1,244 @@
+package exports
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// SQL dialects of the statements written by WriteRecordsSQL.
+const (
+	SQLite   = "sqlite"
+	MySQL    = "mysql"
+	Postgres = "postgres"
+)
+
+// sqlInsertRows is the number of rows inserted by each INSERT statement of a SQL export.
+const sqlInsertRows = 500
+
+// SQLOptions describes the table created by a SQL export.
+type SQLOptions struct {
+	Dialect    string            // Dialect is SQLite, MySQL or Postgres, SQLite if empty.
+	Table      string            // Table is the name of the created table.
+	PrimaryKey string            // PrimaryKey is the field declared as the primary key of the table, if any.
+	Schema     map[string]string // Schema declares the types of fields, like table schemas; the others are inferred.
+}
+
+// ExportRecordsToSQL exports a slice of records to a SQL file creating a table and inserting them, to migrate them
+// into a relational database. See WriteRecordsSQL.
+func ExportRecordsToSQL(records []*dbdata.Record, filename string, options SQLOptions) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := WriteRecordsSQL(file, records, options); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// WriteRecordsSQL writes to w a CREATE TABLE statement with a column per top-level field, the primary key first,
+// and INSERT statements of the records, in a transaction, in the dialect of the options. The columns of the fields
+// declared in the schema have their types and the type of the others is inferred from their values, as in Parquet
+// exports: integers mixed with floating point numbers make a floating point column, objects and lists are written as
+// JSON, and fields whose values have several types as text formatted like in CSV exports. Timestamps are written in
+// UTC, except in SQLite where they are RFC 3339 text with their offset. Missing fields, NULL and floating point
+// numbers that are not finite are NULL.
+//
+// It returns an error if the dialect is unknown, the table has no name, or a value does not have the type the schema
+// declares for its field.
+func WriteRecordsSQL(w io.Writer, records []*dbdata.Record, options SQLOptions) error {
+	dialect := options.Dialect
+	if dialect == "" {
+		dialect = SQLite
+	}
+	if dialect != SQLite && dialect != MySQL && dialect != Postgres {
+		return fmt.Errorf("unsupported SQL dialect %q, expected sqlite, mysql or postgres", options.Dialect)
+	}
+	if options.Table == "" {
+		return fmt.Errorf("a table name is required")
+	}
+
+	// The primary key comes first, and is a text column if no record tells its type
+	columns := typedColumns(records, options.Schema)
+	primary := -1
+	for i, column := range columns {
+		if column.name == options.PrimaryKey {
+			primary = i
+		}
+	}
+	if primary >= 0 {
+		column := columns[primary]
+		copy(columns[1:primary+1], columns[:primary])
+		columns[0] = column
+	} else if options.PrimaryKey != "" {
+		columns = append([]typedColumn{{name: options.PrimaryKey, colType: columnString}}, columns...)
+	}
+	if len(columns) == 0 {
+		return fmt.Errorf("table %s has no fields to create columns for", options.Table)
+	}
+
+	out := bufio.NewWriter(w)
+	table := quoteSQLIdentifier(dialect, options.Table)
+	fmt.Fprintf(out, "-- Generated by dbproto\nBEGIN;\n\nCREATE TABLE %s (\n", table)
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = quoteSQLIdentifier(dialect, column.name)
+		primary := column.name == options.PrimaryKey
+		fmt.Fprintf(out, "  %s %s", names[i], sqlColumnType(dialect, column.colType, primary))
+		if primary {
+			fmt.Fprintf(out, " NOT NULL PRIMARY KEY")
+		}
+		if i < len(columns)-1 {
+			out.WriteString(",")
+		}
+		out.WriteString("\n")
+	}
+	out.WriteString(");\n")
+
+	for i, rec := range records {
+		if i%sqlInsertRows == 0 {
+			fmt.Fprintf(out, "\nINSERT INTO %s (%s) VALUES\n  (", table, strings.Join(names, ", "))
+		} else {
+			out.WriteString(",\n  (")
+		}
+		for j, column := range columns {
+			literal, err := sqlLiteral(dialect, column, rec.GetFields()[column.name])
+			if err != nil {
+				return err
+			}
+			if j > 0 {
+				out.WriteString(", ")
+			}
+			out.WriteString(literal)
+		}
+		out.WriteString(")")
+		if i%sqlInsertRows == sqlInsertRows-1 || i == len(records)-1 {
+			out.WriteString(";\n")
+		}
+	}
+	out.WriteString("\nCOMMIT;\n")
+	return out.Flush()
+}
+
+// sqlColumnType returns the type of a column in the dialect. MySQL cannot index TEXT, so its string primary keys
+// are VARCHAR.
+func sqlColumnType(dialect, colType string, primary bool) string {
+	types := map[string][3]string{ // SQLite, MySQL, Postgres
+		columnInt:       {"INTEGER", "BIGINT", "BIGINT"},
+		columnFloat:     {"REAL", "DOUBLE", "DOUBLE PRECISION"},
+		columnBool:      {"INTEGER", "BOOLEAN", "BOOLEAN"},
+		columnTimestamp: {"TEXT", "DATETIME(6)", "TIMESTAMP WITH TIME ZONE"},
+		columnBytes:     {"BLOB", "LONGBLOB", "BYTEA"},
+		columnJSON:      {"TEXT", "JSON", "JSONB"},
+		columnString:    {"TEXT", "LONGTEXT", "TEXT"},
+	}
+	if colType == columnString && primary {
+		return map[string]string{SQLite: "TEXT", MySQL: "VARCHAR(255)", Postgres: "TEXT"}[dialect]
+	}
+	names, ok := types[colType]
+	if !ok {
+		names = types[columnString]
+	}
+	switch dialect {
+	case MySQL:
+		return names[1]
+	case Postgres:
+		return names[2]
+	default:
+		return names[0]
+	}
+}
+
+// sqlLiteral returns the literal of a value in a column of the dialect, NULL for missing values.
+func sqlLiteral(dialect string, column typedColumn, val *dbdata.Value) (string, error) {
+	if valueColumnType(val) == "" {
+		return "NULL", nil
+	}
+	switch column.colType {
+	case columnInt:
+		x, ok := val.GetKind().(*dbdata.Value_IntValue)
+		if !ok {
+			return "", columnTypeError(column, val)
+		}
+		return strconv.FormatInt(x.IntValue, 10), nil
+	case columnFloat:
+		var f float64
+		switch x := val.GetKind().(type) {
+		case *dbdata.Value_NumberValue:
+			f = x.NumberValue
+		case *dbdata.Value_IntValue:
+			f = float64(x.IntValue)
+		default:
+			return "", columnTypeError(column, val)
+		}
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return "NULL", nil
+		}
+		return strconv.FormatFloat(f, 'g', -1, 64), nil
+	case columnBool:
+		x, ok := val.GetKind().(*dbdata.Value_BoolValue)
+		if !ok {
+			return "", columnTypeError(column, val)
+		}
+		if dialect == SQLite {
+			if x.BoolValue {
+				return "1", nil
+			}
+			return "0", nil
+		}
+		return strings.ToUpper(strconv.FormatBool(x.BoolValue)), nil
+	case columnTimestamp:
+		x, ok := val.GetKind().(*dbdata.Value_TimestampValue)
+		if !ok {
+			return "", columnTypeError(column, val)
+		}
+		t := x.TimestampValue.AsTime()
+		switch dialect {
+		case MySQL:
+			return quoteSQLString(dialect, t.UTC().Format("2006-01-02 15:04:05.000000")), nil
+		case Postgres:
+			return quoteSQLString(dialect, t.UTC().Format(time.RFC3339Nano)), nil
+		default:
+			return quoteSQLString(dialect, t.Format(time.RFC3339Nano)), nil
+		}
+	case columnBytes:
+		x, ok := val.GetKind().(*dbdata.Value_BytesValue)
+		if !ok {
+			return "", columnTypeError(column, val)
+		}
+		if dialect == Postgres {
+			return `'\x` + hex.EncodeToString(x.BytesValue) + `'`, nil
+		}
+		return "X'" + hex.EncodeToString(x.BytesValue) + "'", nil
+	case columnJSON:
+		return quoteSQLString(dialect, formatCollection(val)), nil
+	default:
+		return quoteSQLString(dialect, formatProtoValueCSV(val)), nil
+	}
+}
+
+// quoteSQLIdentifier quotes the name of a table or column, with backquotes in MySQL and double quotes otherwise.
+func quoteSQLIdentifier(dialect, name string) string {
+	if dialect == MySQL {
+		return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// quoteSQLString quotes a string literal. MySQL also reads backslashes as escapes, so they are doubled there.
+func quoteSQLString(dialect, s string) string {
+	if dialect == MySQL {
+		s = strings.ReplaceAll(s, `\`, `\\`)
+	}
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,69 @@
+package exports
+
+import (
+	"io"
+
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+)
+
+// RecordIterator yields the records of a streaming export one at a time. Next returns io.EOF after the last record.
+type RecordIterator interface {
+	Next() (*dbdata.Record, error)
+}
+
+// ResettableIterator is a RecordIterator that can start over from its first record. ExportCSV reads it twice, once
+// for the columns of its header and once for its rows, so that neither the records nor the rows are held in memory.
+type ResettableIterator interface {
+	RecordIterator
+	Reset() error
+}
+
+// SliceIterator returns a ResettableIterator over a slice of records.
+func SliceIterator(records []*dbdata.Record) ResettableIterator {
+	return &sliceIterator{records: records}
+}
+
+type sliceIterator struct {
+	records []*dbdata.Record
+	next    int
+}
+
+func (it *sliceIterator) Next() (*dbdata.Record, error) {
+	if it.next >= len(it.records) {
+		return nil, io.EOF
+	}
+	it.next++
+	return it.records[it.next-1], nil
+}
+
+func (it *sliceIterator) Reset() error {
+	it.next = 0
+	return nil
+}
+
+// CollectRecords reads every record of the iterator, for the exports that need them all before writing, such as
+// WriteRecordsParquet and WriteRecordsSQL.
+func CollectRecords(iter RecordIterator) ([]*dbdata.Record, error) {
+	var records []*dbdata.Record
+	err := forEachRecord(iter, func(rec *dbdata.Record) error {
+		records = append(records, rec)
+		return nil
+	})
+	return records, err
+}
+
+// forEachRecord calls fn with every record of the iterator, until it or the iterator fails.
+func forEachRecord(iter RecordIterator, fn func(rec *dbdata.Record) error) error {
+	for {
+		rec, err := iter.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
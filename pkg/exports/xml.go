@@ -1,12 +1,15 @@
 package exports
 
 import (
+	"encoding/base64"
 	"encoding/xml"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/Malpizarr/dbproto/pkg/dbdata"
-	"google.golang.org/protobuf/types/known/structpb"
 )
 
 type RecordXML struct {
@@ -16,53 +19,71 @@ type RecordXML struct {
 
 type FieldXML struct {
 	Key   string `xml:"Key,attr"`
+	Null  bool   `xml:"Null,attr,omitempty"` // Null marks a NULL value, as opposed to an empty string
 	Value string `xml:"Value"`
 }
 
-func formatProtoValueXML(val *structpb.Value) string {
+func formatProtoValueXML(val *dbdata.Value) string {
 	if val == nil {
 		return ""
 	}
 
 	switch x := val.Kind.(type) {
-	case *structpb.Value_StringValue:
+	case *dbdata.Value_StringValue:
 		return x.StringValue
-	case *structpb.Value_NumberValue:
+	case *dbdata.Value_IntValue:
+		return strconv.FormatInt(x.IntValue, 10)
+	case *dbdata.Value_NumberValue:
 		if float64(int(x.NumberValue)) == x.NumberValue {
 			return fmt.Sprintf("%d", int(x.NumberValue))
 		}
 		return fmt.Sprintf("%.3f", x.NumberValue)
-	case *structpb.Value_BoolValue:
+	case *dbdata.Value_BoolValue:
 		return fmt.Sprintf("%t", x.BoolValue)
+	case *dbdata.Value_BytesValue:
+		return base64.StdEncoding.EncodeToString(x.BytesValue)
+	case *dbdata.Value_TimestampValue:
+		return x.TimestampValue.AsTime().Format(time.RFC3339Nano)
+	case *dbdata.Value_NullValue:
+		return ""
+	case *dbdata.Value_StructValue, *dbdata.Value_ListValue:
+		return formatCollection(val)
 	default:
 		return fmt.Sprintf("%v", val)
 	}
 }
 
-// ExportRecordsToXML exports a slice of records to an XML file.
+// ExportRecordsToXML exports a slice of records to an XML file. Values nested in objects and lists get a Field per
+// path, such as "address.city" or "tags.0".
 func ExportRecordsToXML(records []*dbdata.Record, filename string) error {
 	file, err := os.Create(filename)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
+	return ExportXML(file, SliceIterator(records))
+}
 
-	encoder := xml.NewEncoder(file)
+// ExportXML streams the records of the iterator to w as XML Record elements, like ExportRecordsToXML, encoding and
+// writing each record in turn.
+func ExportXML(w io.Writer, iter RecordIterator) error {
+	if _, err := io.WriteString(w, "<!-- Generated by dbproto CLI -->\n"); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
 	encoder.Indent("", "  ")
-	_, _ = file.WriteString("<!-- Generated by dbproto CLI -->\n")
-
-	xmlRecords := make([]RecordXML, 0, len(records))
-	for _, rec := range records {
-		fields := make([]FieldXML, 0, len(rec.Fields))
-		for key, protoVal := range rec.Fields {
+	err := forEachRecord(iter, func(rec *dbdata.Record) error {
+		flat := flattenFields(rec.Fields)
+		fields := make([]FieldXML, 0, len(flat))
+		for key, protoVal := range flat {
 			formattedValue := formatProtoValueXML(protoVal)
-			fields = append(fields, FieldXML{Key: key, Value: formattedValue})
+			_, isNull := protoVal.GetKind().(*dbdata.Value_NullValue)
+			fields = append(fields, FieldXML{Key: key, Null: isNull, Value: formattedValue})
 		}
-		xmlRecords = append(xmlRecords, RecordXML{Fields: fields})
-	}
-
-	if err := encoder.Encode(xmlRecords); err != nil {
+		return encoder.Encode(RecordXML{Fields: fields})
+	})
+	if err != nil {
 		return err
 	}
-	return nil
+	return encoder.Close()
 }
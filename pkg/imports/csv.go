@@ -0,0 +1,185 @@
+package imports
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+)
+
+// CSVOptions describes how the rows of a CSV file become records.
+type CSVOptions struct {
+	Comma     rune              // Comma is the field delimiter, ',' if zero.
+	Fields    map[string]string // Fields maps columns of the header to fields; a column mapped to "" is skipped and the others keep their name.
+	BatchSize int               // BatchSize is the number of rows inserted together, DefaultBatchSize if zero.
+	MaxErrors int               // MaxErrors stops the import after that many rows failed, 0 for no limit.
+	NoInfer   bool              // NoInfer keeps every value as a string, except the fields declared by the table schema.
+}
+
+// numberPattern matches decimal numbers written without a plus sign or leading zeros, which converting them would
+// lose, so that identifiers such as zip codes stay strings.
+var numberPattern = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// ImportCSV inserts a record into the table for every row of a CSV file read from r. The header row names the fields
+// of the records, through the Fields mapping of the options, and empty cells are left out of the records, as CSV
+// exports write missing fields.
+// Values are converted to the types the table schema declares for their fields. The type of the others is inferred:
+// decimal numbers become integers, or floating point numbers if they have a fraction or an exponent, true and false
+// become booleans, and anything else stays a string. Timestamps and bytes are only converted for the fields the
+// schema declares, from RFC 3339 and base64 like CSV exports write them.
+// Rows are inserted in batches with InsertMany. A batch that fails is inserted again row by row, so that the rows the
+// table rejects, for a duplicate key or a schema violation for instance, are reported without failing the others.
+//
+// Parameters:
+// - table: The table the records are inserted into.
+// - r: The CSV file, with a header row.
+// - options: The delimiter, the mapping of columns to fields, the size of the batches and the number of failed rows
+// after which the import stops.
+//
+// Returns:
+// - The number of records inserted and the rows that were not, with their line and why.
+// - An error if the file cannot be read or its header is invalid, in which case the rows of the batches written
+// before it stay inserted.
+func ImportCSV(table *data.Table, r io.Reader, options CSVOptions) (Result, error) {
+	reader := csv.NewReader(r)
+	if options.Comma != 0 {
+		reader.Comma = options.Comma
+	}
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return Result{}, errors.New("the file has no header row")
+	}
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to read the header row: %w", err)
+	}
+	fields, err := headerFields(header, options.Fields)
+	if err != nil {
+		return Result{}, err
+	}
+	reader.FieldsPerRecord = len(header)
+
+	inserter := newBatchInserter(table, options.BatchSize, options.MaxErrors)
+	for !inserter.result.Stopped {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil && !errors.Is(err, csv.ErrFieldCount) {
+			inserter.flush()
+			return inserter.result, err
+		}
+		line, _ := reader.FieldPos(0)
+		if err != nil {
+			inserter.reject(RowError{Line: line}, fmt.Errorf("expected %d values, got %d", len(header), len(row)))
+			continue
+		}
+
+		record := make(data.Record, len(fields))
+		for i, value := range row {
+			if fields[i] == "" || value == "" {
+				continue
+			}
+			record[fields[i]] = csvValue(value, table.Options.Schema[fields[i]], options.NoInfer)
+		}
+		inserter.add(RowError{Line: line}, record)
+	}
+	inserter.flush()
+	return inserter.result, nil
+}
+
+// headerFields returns the field of every column of the header, empty for the columns that are skipped.
+func headerFields(header []string, mapping map[string]string) ([]string, error) {
+	fields := make([]string, len(header))
+	columns := make(map[string]bool, len(header))
+	seen := make(map[string]string, len(header))
+	for i, column := range header {
+		if i == 0 {
+			column = strings.TrimPrefix(column, "\ufeff") // spreadsheets start UTF-8 files with a byte order mark
+		}
+		column = strings.TrimSpace(column)
+		columns[column] = true
+		field, mapped := mapping[column]
+		if !mapped {
+			field = column
+		}
+		if field == "" {
+			if !mapped {
+				return nil, fmt.Errorf("column %d of the header has no name", i+1)
+			}
+			continue
+		}
+		if previous, duplicate := seen[field]; duplicate {
+			return nil, fmt.Errorf("columns %q and %q are both imported as field '%s'", previous, column, field)
+		}
+		seen[field] = column
+		fields[i] = field
+	}
+	for column := range mapping {
+		if !columns[column] {
+			return nil, fmt.Errorf("column %q is not in the header", column)
+		}
+	}
+	return fields, nil
+}
+
+// csvValue converts a cell to the type the schema declares for its field, or to the type inferred from it if the
+// field is not declared. Cells that do not parse as their declared type are kept as strings, for the table schema to
+// reject them with the field they belong to; timestamps and bytes are converted by the schema itself.
+func csvValue(value, fieldType string, noInfer bool) interface{} {
+	switch fieldType {
+	case data.FieldString, data.FieldTimestamp, data.FieldBytes:
+		return value
+	case data.FieldInt:
+		if i, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err == nil {
+			return i
+		}
+		return value
+	case data.FieldFloat:
+		if f, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+			return f
+		}
+		return value
+	case data.FieldBool:
+		if b, ok := parseBool(value); ok {
+			return b
+		}
+		return value
+	}
+	if noInfer {
+		return value
+	}
+	if b, ok := parseBool(value); ok {
+		return b
+	}
+	if numberPattern.MatchString(value) {
+		// Integers beyond int64 stay strings rather than losing digits as floating point numbers
+		if !strings.ContainsAny(value, ".eE") {
+			if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+				return i
+			}
+			return value
+		}
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return value
+}
+
+// parseBool parses true and false, in any case.
+func parseBool(value string) (bool, bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true":
+		return true, true
+	case "false":
+		return false, true
+	}
+	return false, false
+}
@@ -0,0 +1,95 @@
+// Package imports inserts the records of CSV, JSON and NDJSON files into tables, reading the files as a stream and
+// inserting their records in batches.
+package imports
+
+import (
+	"fmt"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+)
+
+// DefaultBatchSize is the number of records inserted together when the options of an import do not set one.
+const DefaultBatchSize = 1000
+
+// RowError is why a row of an import was not inserted.
+type RowError struct {
+	Line   int   // Line is the line of the file the row starts on, the header being line 1 in CSV files, 0 if unknown.
+	Record int   // Record is the position of the record in a JSON array, from 1, whose line is not tracked.
+	Err    error // Err is why the row was rejected.
+}
+
+func (e RowError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("record %d: %v", e.Record, e.Err)
+	}
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e RowError) Unwrap() error {
+	return e.Err
+}
+
+// Result is the outcome of an import.
+type Result struct {
+	Inserted int        // Inserted is the number of records inserted.
+	Errors   []RowError // Errors lists the rows that were not inserted, in the order of the file.
+	Stopped  bool       // Stopped reports that the import gave up after MaxErrors failed rows.
+}
+
+// batchInserter inserts the records of an import in batches, reporting the rows that fail.
+type batchInserter struct {
+	table     *data.Table
+	size      int
+	maxErrors int
+	records   []data.Record
+	rows      []RowError
+	result    Result
+}
+
+func newBatchInserter(table *data.Table, size, maxErrors int) *batchInserter {
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	return &batchInserter{table: table, size: size, maxErrors: maxErrors}
+}
+
+// add queues the record of the row at the position of row, and inserts the batch once it is full.
+func (b *batchInserter) add(row RowError, record data.Record) {
+	b.records = append(b.records, record)
+	b.rows = append(b.rows, row)
+	if len(b.records) >= b.size {
+		b.flush()
+	}
+}
+
+// reject reports the row at the position of row as not inserted, and stops the import once MaxErrors rows failed.
+func (b *batchInserter) reject(row RowError, err error) {
+	row.Err = err
+	b.result.Errors = append(b.result.Errors, row)
+	if b.maxErrors > 0 && len(b.result.Errors) >= b.maxErrors {
+		b.result.Stopped = true
+	}
+}
+
+// flush inserts the queued records. InsertMany writes nothing when a record fails, so the records of a failed batch
+// are inserted one at a time to tell which ones the table rejects.
+func (b *batchInserter) flush() {
+	if len(b.records) == 0 {
+		return
+	}
+	if err := b.table.InsertMany(b.records); err == nil {
+		b.result.Inserted += len(b.records)
+	} else {
+		for i, record := range b.records {
+			if b.result.Stopped {
+				break
+			}
+			if err := b.table.Insert(record); err != nil {
+				b.reject(b.rows[i], err)
+				continue
+			}
+			b.result.Inserted++
+		}
+	}
+	b.records, b.rows = b.records[:0], b.rows[:0]
+}
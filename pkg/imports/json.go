@@ -0,0 +1,194 @@
+package imports
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Malpizarr/dbproto/pkg/data"
+)
+
+// JSONOptions describes how the records of a JSON or NDJSON file are inserted.
+type JSONOptions struct {
+	BatchSize int // BatchSize is the number of records inserted together, DefaultBatchSize if zero.
+	MaxErrors int // MaxErrors stops the import after that many records failed, 0 for no limit.
+}
+
+// ImportJSON inserts the objects of a JSON array read from r into the table, such as a JSON export. The array is
+// decoded one object at a time, so files larger than memory can be imported: only the records of the current batch
+// are held. Fields keep their JSON types: integers become integers, other numbers floating point numbers, and objects
+// and lists nested values; strings are converted to timestamps and bytes for the fields the table schema declares so.
+// Records are inserted in batches with InsertMany, and rejected records are reported like in ImportCSV.
+//
+// Parameters:
+// - table: The table the records are inserted into.
+// - r: The JSON file, an array of objects.
+// - options: The size of the batches and the number of rejected records after which the import stops.
+//
+// Returns:
+// - The number of records inserted and the elements of the array that were not, with their position and why.
+// - An error if the file cannot be read or is not a JSON array, in which case the records of the batches written
+// before it stay inserted.
+func ImportJSON(table *data.Table, r io.Reader, options JSONOptions) (Result, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	token, err := decoder.Token()
+	if err == io.EOF {
+		return Result{}, errors.New("the file is empty")
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return Result{}, errors.New("the file is not a JSON array")
+	}
+
+	inserter := newBatchInserter(table, options.BatchSize, options.MaxErrors)
+	for n := 1; !inserter.result.Stopped && decoder.More(); n++ {
+		// A syntax error leaves the decoder in the middle of the array, so it ends the import
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			inserter.flush()
+			return inserter.result, fmt.Errorf("record %d: %w", n, err)
+		}
+		record, err := jsonRecord(value)
+		if err != nil {
+			inserter.reject(RowError{Record: n}, err)
+			continue
+		}
+		inserter.add(RowError{Record: n}, record)
+	}
+	inserter.flush()
+	if inserter.result.Stopped {
+		return inserter.result, nil
+	}
+	if _, err := decoder.Token(); err != nil {
+		return inserter.result, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return inserter.result, errors.New("unexpected data after the JSON array")
+	}
+	return inserter.result, nil
+}
+
+// ImportNDJSON inserts the objects of a newline delimited JSON file read from r into the table, one object per line,
+// such as the logs or exports of other systems. Lines are read one at a time, so files larger than memory can be
+// imported, and blank lines are skipped. Values are converted like in ImportJSON. A line that is not a valid JSON
+// object is reported with the records the table rejects, and the import goes on with the next line.
+//
+// Parameters:
+// - table: The table the records are inserted into.
+// - r: The NDJSON file.
+// - options: The size of the batches and the number of rejected lines after which the import stops.
+//
+// Returns:
+// - The number of records inserted and the lines that were not, with their number and why.
+// - An error if the file cannot be read, in which case the records of the batches written before it stay inserted.
+func ImportNDJSON(table *data.Table, r io.Reader, options JSONOptions) (Result, error) {
+	reader := bufio.NewReader(r)
+	inserter := newBatchInserter(table, options.BatchSize, options.MaxErrors)
+	for line := 1; !inserter.result.Stopped; line++ {
+		content, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			inserter.flush()
+			return inserter.result, err
+		}
+		if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 {
+			record, decodeErr := decodeNDJSONLine(trimmed)
+			if decodeErr != nil {
+				inserter.reject(RowError{Line: line}, decodeErr)
+			} else {
+				inserter.add(RowError{Line: line}, record)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	inserter.flush()
+	return inserter.result, nil
+}
+
+// decodeNDJSONLine decodes the record of a line of an NDJSON file, which must hold a single object.
+func decodeNDJSONLine(line []byte) (data.Record, error) {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("the line holds more than one JSON value")
+	}
+	return jsonRecord(value)
+}
+
+// jsonRecord returns the record of a decoded JSON object, with its numbers converted.
+func jsonRecord(value interface{}) (data.Record, error) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a JSON object, got %s", jsonKind(value))
+	}
+	converted, err := jsonValue(object)
+	if err != nil {
+		return nil, err
+	}
+	return data.Record(converted.(map[string]interface{})), nil
+}
+
+// jsonValue converts the numbers of a value decoded with UseNumber, at any depth, to int64 when they are integers
+// that fit and to float64 otherwise.
+func jsonValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("number %s is out of range", v)
+		}
+		return f, nil
+	case map[string]interface{}:
+		for key, nested := range v {
+			converted, err := jsonValue(nested)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = converted
+		}
+		return v, nil
+	case []interface{}:
+		for i, nested := range v {
+			converted, err := jsonValue(nested)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = converted
+		}
+		return v, nil
+	default:
+		return v, nil
+	}
+}
+
+// jsonKind names the JSON type of a decoded value for errors.
+func jsonKind(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "a boolean"
+	case json.Number:
+		return "a number"
+	case string:
+		return "a string"
+	case []interface{}:
+		return "an array"
+	default:
+		return "an object"
+	}
+}
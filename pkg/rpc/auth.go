@@ -0,0 +1,193 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Malpizarr/dbproto/pkg/api"
+	"github.com/Malpizarr/dbproto/pkg/data"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// roleMetadata is the metadata key naming the role whose limits apply to reads, like api.RoleHeader.
+var roleMetadata = strings.ToLower(api.RoleHeader)
+
+// apiKeyMetadata is the metadata key carrying the API key, for clients that cannot send it as a bearer token in the
+// authorization metadata, like api.APIKeyHeader.
+var apiKeyMetadata = strings.ToLower(api.APIKeyHeader)
+
+// tenantMetadata is the metadata key naming the tenant a call is made to, like api.TenantHeader.
+var tenantMetadata = strings.ToLower(api.TenantHeader)
+
+// consistencyMetadata is the metadata key choosing which writes the reads of a call observe, like
+// api.ConsistencyHeader.
+var consistencyMetadata = strings.ToLower(api.ConsistencyHeader)
+
+// apiKeyContextKey and userContextKey are the context keys of the API key and the user authenticating a call,
+// userServerContextKey the one of the server holding the user, and serverContextKey the one of the server of the
+// tenant the call is made to.
+type (
+	apiKeyContextKey     struct{}
+	userContextKey       struct{}
+	userServerContextKey struct{}
+	serverContextKey     struct{}
+)
+
+// authenticator authenticates the calls of a gRPC server as its Config requires, the way api.RequireJWT and
+// api.RequireAPIKey authenticate HTTP requests. The permissions are checked by the methods, with authorize, once they
+// know the tables the call reads or writes.
+type authenticator struct {
+	server *data.Server
+	config Config
+}
+
+// unary authenticates a unary call before passing it to handler.
+func (a *authenticator) unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// stream authenticates a streaming call before passing it to handler.
+func (a *authenticator) stream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+}
+
+// authenticate returns the context of the call carrying the API key or the user it is authenticated with, and the
+// server of the tenant it is made to, failing with UNAUTHENTICATED if it needs credentials it does not have, and with
+// UNAVAILABLE until the server is ready. Users of the root server naming a tenant in tenantMetadata fail with
+// PERMISSION_DENIED unless they have the admin permission on every database of the root server, like in
+// api.RequireJWT.
+func (a *authenticator) authenticate(ctx context.Context) (context.Context, error) {
+	if a.config.Readiness != nil && !a.config.Readiness.Ready() {
+		return nil, status.Error(codes.Unavailable, "server is not ready")
+	}
+	token := callToken(ctx)
+	switch {
+	case a.config.Tokens != nil && token != "" && !data.IsAPIKey(token):
+		tenantName, username, err := a.config.Tokens.VerifyTenant(token)
+		if errors.Is(err, api.ErrInvalidToken) {
+			return nil, status.Error(codes.Unauthenticated, "invalid or expired token")
+		} else if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		tenant, err := a.server.Tenant(tenantName)
+		if errors.Is(err, data.ErrTenantNotFound) {
+			return nil, status.Error(codes.Unauthenticated, "invalid or expired token")
+		} else if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		user, err := tenant.User(username)
+		if errors.Is(err, data.ErrUserNotFound) {
+			return nil, status.Error(codes.Unauthenticated, "invalid or expired token")
+		} else if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if tenantName == "" && metadataValue(ctx, tenantMetadata) != "" {
+			// Calls are served by the tenant they name, whose databases the roles of the root server do not describe,
+			// so only users who may manage tenants, with the admin permission on every database, may name one
+			allowed, err := tenant.Authorize(user, "*", "", data.PermissionAdmin)
+			if err != nil {
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+			if !allowed {
+				return nil, status.Error(codes.PermissionDenied, fmt.Sprintf("user %s lacks %s permission on * to access a tenant", user.Username, data.PermissionAdmin))
+			}
+		}
+		ctx = context.WithValue(context.WithValue(ctx, userContextKey{}, user), userServerContextKey{}, tenant)
+		return a.tenant(ctx, tenantName)
+	case a.config.Tokens != nil || a.config.RequireAPIKey:
+		if token == "" {
+			return nil, status.Error(codes.Unauthenticated, "API key or token required")
+		}
+		key, err := a.server.AuthenticateAPIKey(token)
+		if errors.Is(err, data.ErrInvalidAPIKey) {
+			return nil, status.Error(codes.Unauthenticated, "invalid API key")
+		} else if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return a.tenant(context.WithValue(ctx, apiKeyContextKey{}, key), key.Tenant)
+	}
+	return a.tenant(ctx, "")
+}
+
+// tenant returns the context of the call carrying the server of the tenant it is made to, see api.TenantServer, with
+// bound the tenant its credentials are bound to. Calls naming another tenant in tenantMetadata fail with
+// PERMISSION_DENIED, and calls to unknown tenants with NOT_FOUND.
+func (a *authenticator) tenant(ctx context.Context, bound string) (context.Context, error) {
+	server, err := api.TenantServer(a.server, bound, metadataValue(ctx, tenantMetadata))
+	if errors.Is(err, api.ErrTenantMismatch) {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return context.WithValue(ctx, serverContextKey{}, server), nil
+}
+
+// authenticatedStream is a server stream whose context carries the credentials of the call.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// authorize checks that the credentials of the call grant the permission on the table of the database, or on the
+// database if table is empty, failing with PERMISSION_DENIED if they do not. Users are checked against the roles of
+// the server holding them. Read-only API keys are only allowed to read, and calls without credentials are allowed
+// everything, like the HTTP routes without authentication.
+func authorize(ctx context.Context, database, table string, permission data.Permission) error {
+	if key, _ := ctx.Value(apiKeyContextKey{}).(*data.APIKey); key != nil && !key.CanWrite() && permission != data.PermissionRead {
+		return status.Error(codes.PermissionDenied, "the API key is read-only")
+	}
+	user, _ := ctx.Value(userContextKey{}).(*data.User)
+	if user == nil {
+		return nil
+	}
+	server, _ := ctx.Value(userServerContextKey{}).(*data.Server)
+	allowed, err := server.Authorize(user, database, table, permission)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if !allowed {
+		target := database
+		if table != "" {
+			target += "." + table
+		}
+		return status.Error(codes.PermissionDenied, fmt.Sprintf("user %s lacks %s permission on %s", user.Username, permission, target))
+	}
+	return nil
+}
+
+// callToken returns the bearer token of the authorization metadata of the call, or else its apiKeyMetadata.
+func callToken(ctx context.Context) string {
+	if auth := metadataValue(ctx, "authorization"); auth != "" {
+		scheme, credentials, _ := strings.Cut(auth, " ")
+		if strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(credentials)
+		}
+	}
+	return metadataValue(ctx, apiKeyMetadata)
+}
+
+// metadataValue returns the first value of the metadata key of the call, or an empty string if it has none.
+func metadataValue(ctx context.Context, key string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
@@ -0,0 +1,337 @@
+// Package rpc serves the databases of a dbproto server over gRPC, with the service defined in rpc.proto. Records and
+// values are sent as the dbdata messages the tables are stored with.
+package rpc
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Malpizarr/dbproto/pkg/api"
+	"github.com/Malpizarr/dbproto/pkg/data"
+	"github.com/Malpizarr/dbproto/pkg/dbdata"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Config configures the authentication of the gRPC server, the way the flags of dbproto serve configure the HTTP
+// server.
+type Config struct {
+	Tokens        *api.Tokens    // Tokens, if set, verifies the tokens of users, whose roles are checked on every call. API keys are accepted too.
+	RequireAPIKey bool           // RequireAPIKey rejects calls without a valid API key, unless Tokens is set.
+	Readiness     *api.Readiness // Readiness, if set, makes calls fail with UNAVAILABLE until the server is ready.
+}
+
+// Service implements the Database service on the databases of a server.
+type Service struct {
+	UnimplementedDatabaseServer
+	server *data.Server
+}
+
+// NewService returns the Database service of the server, without authentication. Use NewServer to serve it with the
+// authentication of Config.
+func NewService(server *data.Server) *Service {
+	return &Service{server: server}
+}
+
+// NewServer returns a gRPC server serving the Database service of the server, which authenticates every call as
+// configured and passes opts on to grpc.NewServer.
+func NewServer(server *data.Server, config Config, opts ...grpc.ServerOption) *grpc.Server {
+	auth := &authenticator{server: server, config: config}
+	opts = append(opts, grpc.UnaryInterceptor(auth.unary), grpc.StreamInterceptor(auth.stream))
+	grpcServer := grpc.NewServer(opts...)
+	RegisterDatabaseServer(grpcServer, NewService(server))
+	return grpcServer
+}
+
+// CreateDatabase creates a database, like POST /createDatabase. It needs the admin permission on every database.
+func (s *Service) CreateDatabase(ctx context.Context, req *CreateDatabaseRequest) (*CreateDatabaseResponse, error) {
+	if err := authorize(ctx, "*", "", data.PermissionAdmin); err != nil {
+		return nil, err
+	}
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "database name is required")
+	}
+	if err := s.serverOf(ctx).CreateDatabase(req.GetName()); err != nil {
+		return nil, errorStatus(err, codes.Internal)
+	}
+	return &CreateDatabaseResponse{}, nil
+}
+
+// CreateTable creates a table, like POST /createTable. It needs the admin permission on the database.
+func (s *Service) CreateTable(ctx context.Context, req *CreateTableRequest) (*CreateTableResponse, error) {
+	if err := authorize(ctx, req.GetDatabase(), "", data.PermissionAdmin); err != nil {
+		return nil, err
+	}
+	db, err := s.serverOf(ctx).Database(req.GetDatabase())
+	if err != nil {
+		return nil, errorStatus(err, codes.Internal)
+	}
+	options := data.TableOptions{
+		AutoID:     req.GetAutoId(),
+		Timestamps: req.GetTimestamps(),
+		Schema:     req.GetSchema(),
+	}
+	if err := db.CreateTableWithOptions(req.GetTable(), req.GetPrimaryKey(), options); err != nil {
+		return nil, errorStatus(err, codes.InvalidArgument)
+	}
+	return &CreateTableResponse{}, nil
+}
+
+// Insert inserts a record and returns it as stored, like POST /databases/{db}/tables/{table}/records. It needs the
+// write permission on the table.
+func (s *Service) Insert(ctx context.Context, req *InsertRequest) (*InsertResponse, error) {
+	table, err := s.table(ctx, req.GetDatabase(), req.GetTable(), data.PermissionWrite)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetRecord() == nil {
+		return nil, status.Error(codes.InvalidArgument, "record is required")
+	}
+	record, err := data.RecordFromProto(req.GetRecord())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	stored, err := table.InsertReturningCtx(ctx, record)
+	if err != nil {
+		return nil, errorStatus(err, codes.Internal)
+	}
+	protoRecord, err := data.RecordToProto(stored)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &InsertResponse{Record: protoRecord}, nil
+}
+
+// Select returns the record with the given primary key, like GET /databases/{db}/tables/{table}/records/{key}. It
+// needs the read permission on the table.
+func (s *Service) Select(ctx context.Context, req *SelectRequest) (*SelectResponse, error) {
+	table, err := s.table(ctx, req.GetDatabase(), req.GetTable(), data.PermissionRead)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetKey() == nil {
+		return nil, status.Error(codes.InvalidArgument, "key is required")
+	}
+	key, err := data.ValueFromProto(req.GetKey())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if ctx, err = consistentContext(ctx); err != nil {
+		return nil, err
+	}
+	record, err := table.SelectCtx(ctx, key)
+	if err != nil {
+		return nil, errorStatus(err, codes.Internal)
+	}
+	protoRecord, err := data.RecordToProto(record)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &SelectResponse{Record: protoRecord}, nil
+}
+
+// Query returns a page of the records matching a query, like POST /databases/{db}/tables/{table}/query. It needs the
+// read permission on the table.
+func (s *Service) Query(ctx context.Context, req *QueryRequest) (*QueryResponse, error) {
+	table, err := s.table(ctx, req.GetDatabase(), req.GetTable(), data.PermissionRead)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetLimit() < 0 || req.GetOffset() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "limit and offset must not be negative")
+	}
+	query := data.Query{
+		Filters: make(map[string]interface{}, len(req.GetFilters())),
+		SortBy:  req.GetSortBy(),
+		Limit:   int(req.GetLimit()),
+		Offset:  int(req.GetOffset()),
+		Cursor:  req.GetCursor(),
+		Fields:  req.GetFields(),
+	}
+	for field, protoValue := range req.GetFilters() {
+		if query.Filters[field], err = data.ValueFromProto(protoValue); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid filter value for field %s: %v", field, err)
+		}
+	}
+	for _, condition := range req.GetConditions() {
+		var value interface{}
+		if condition.GetValue() != nil {
+			if value, err = data.ValueFromProto(condition.GetValue()); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid condition value for field %s: %v", condition.GetField(), err)
+			}
+		}
+		query.Conditions = append(query.Conditions, data.Condition{Field: condition.GetField(), Operator: condition.GetOperator(), Value: value})
+	}
+
+	if ctx, err = consistentContext(ctx); err != nil {
+		return nil, err
+	}
+	ctx, cancel := s.limitedContext(ctx)
+	defer cancel()
+	result, err := table.QueryPageCtx(ctx, query)
+	if err != nil {
+		return nil, errorStatus(err, codes.InvalidArgument)
+	}
+	records, err := protoRecords(result.Records)
+	if err != nil {
+		return nil, err
+	}
+	return &QueryResponse{Records: records, NextCursor: result.NextCursor, Total: int64(result.Total)}, nil
+}
+
+// Join joins two tables of a database, like POST /joinTables without intoTable. It needs the read permission on both
+// tables.
+func (s *Service) Join(ctx context.Context, req *JoinRequest) (*JoinResponse, error) {
+	t1, err := s.table(ctx, req.GetDatabase(), req.GetTable1(), data.PermissionRead)
+	if err != nil {
+		return nil, err
+	}
+	t2, err := s.table(ctx, req.GetDatabase(), req.GetTable2(), data.PermissionRead)
+	if err != nil {
+		return nil, err
+	}
+
+	if ctx, err = consistentContext(ctx); err != nil {
+		return nil, err
+	}
+	ctx, cancel := s.limitedContext(ctx)
+	defer cancel()
+	results, err := data.JoinTablesCtx(ctx, t1, t2, req.GetKey1(), req.GetKey2(), data.JoinType(req.GetJoinType()))
+	if err != nil {
+		return nil, errorStatus(err, codes.Internal)
+	}
+	records := make([]data.Record, len(results))
+	for i, result := range results {
+		records[i] = result
+	}
+	protoResults, err := protoRecords(records)
+	if err != nil {
+		return nil, err
+	}
+	return &JoinResponse{Records: protoResults}, nil
+}
+
+// Watch streams the changes of a table until the client cancels the call, like Table.Watch. It needs the read
+// permission on the table. The stream ends with RESOURCE_EXHAUSTED if the client falls too far behind.
+func (s *Service) Watch(req *WatchRequest, stream Database_WatchServer) error {
+	table, err := s.table(stream.Context(), req.GetDatabase(), req.GetTable(), data.PermissionRead)
+	if err != nil {
+		return err
+	}
+	events := table.Watch(stream.Context())
+	for event := range events {
+		protoEvent := &ChangeEvent{
+			Operation: event.Operation,
+			Key:       event.Key,
+			Time:      dbdata.NewTimestampValue(event.Time).GetTimestampValue(),
+			RequestId: event.RequestID,
+		}
+		if event.Before != nil {
+			if protoEvent.Before, err = data.RecordToProto(event.Before); err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+		}
+		if event.After != nil {
+			if protoEvent.After, err = data.RecordToProto(event.After); err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+		}
+		if err := stream.Send(protoEvent); err != nil {
+			return err
+		}
+	}
+	if err := stream.Context().Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.ResourceExhausted, "watcher fell too far behind and missed changes, read the table and watch it again")
+}
+
+// table returns the table of the database after checking the caller has the permission on it, failing with NOT_FOUND
+// if either does not exist. Writes to the catalog fail with PERMISSION_DENIED.
+func (s *Service) table(ctx context.Context, dbName, tableName string, permission data.Permission) (*data.Table, error) {
+	if err := authorize(ctx, dbName, tableName, permission); err != nil {
+		return nil, err
+	}
+	if permission != data.PermissionRead && dbName == data.CatalogDatabase {
+		return nil, status.Error(codes.PermissionDenied, data.ErrCatalogReadOnly.Error())
+	}
+	db, err := s.serverOf(ctx).Database(dbName)
+	if err != nil {
+		return nil, errorStatus(err, codes.Internal)
+	}
+	db.RLock()
+	table, exists := db.Tables[tableName]
+	db.RUnlock()
+	if !exists {
+		return nil, status.Error(codes.NotFound, data.ErrTableNotFound.Error())
+	}
+	return table, nil
+}
+
+// consistentContext returns the context of the call carrying the consistency of reads its consistencyMetadata names,
+// failing with INVALID_ARGUMENT if it names none of them.
+func consistentContext(ctx context.Context) (context.Context, error) {
+	name := metadataValue(ctx, consistencyMetadata)
+	if name == "" {
+		return ctx, nil
+	}
+	consistency, err := data.ParseConsistency(name)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return data.WithConsistency(ctx, consistency), nil
+}
+
+// limitedContext returns the context of a read carrying the limits of the role in the roleMetadata of the call.
+func (s *Service) limitedContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return data.WithLimits(ctx, s.serverOf(ctx).LimitsFor(metadataValue(ctx, roleMetadata)))
+}
+
+// serverOf returns the server of the tenant the call is made to, or the server of the service for calls that went
+// through no authenticator.
+func (s *Service) serverOf(ctx context.Context) *data.Server {
+	if server, ok := ctx.Value(serverContextKey{}).(*data.Server); ok {
+		return server
+	}
+	return s.server
+}
+
+// protoRecords converts records to protobuf records, failing with INTERNAL if a value cannot be converted.
+func protoRecords(records []data.Record) ([]*dbdata.Record, error) {
+	protoRecords := make([]*dbdata.Record, len(records))
+	for i, record := range records {
+		protoRecord, err := data.RecordToProto(record)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		protoRecords[i] = protoRecord
+	}
+	return protoRecords, nil
+}
+
+// errorStatus returns the status of a failed call, with the code matching the status the HTTP routes answer the error
+// with, and fallback for errors they have no specific status for.
+func errorStatus(err error, fallback codes.Code) error {
+	var validationErr *data.ValidationError
+	var limitErr *data.LimitExceededError
+	var backpressureErr *data.BackpressureError
+	code := fallback
+	switch {
+	case errors.Is(err, data.ErrDatabaseNotFound), errors.Is(err, data.ErrTableNotFound), errors.Is(err, data.ErrRecordNotFound):
+		code = codes.NotFound
+	case errors.Is(err, data.ErrDuplicateKey), errors.Is(err, data.ErrNameTaken):
+		code = codes.AlreadyExists
+	case errors.As(err, &validationErr), errors.Is(err, data.ErrSchemaViolation), errors.Is(err, data.ErrInvalidKey), errors.Is(err, data.ErrInvalidName):
+		code = codes.InvalidArgument
+	case errors.Is(err, data.ErrCatalogReadOnly), errors.Is(err, data.ErrReadOnly):
+		code = codes.PermissionDenied
+	case errors.As(err, &limitErr):
+		code = codes.ResourceExhausted
+	case errors.As(err, &backpressureErr):
+		code = codes.Unavailable
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(code, err.Error())
+}
@@ -0,0 +1,66 @@
+// Package service runs a long-lived process, such as the dbproto HTTP server, under an OS service manager.
+// It reports readiness and shutdown to systemd through the sd_notify protocol, runs as a Windows service
+// when started by the Service Control Manager, and falls back to plain console mode otherwise.
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// RunFunc is the body of a service. It must call ready once it accepts work and return after ctx is
+// cancelled, having released its resources.
+type RunFunc func(ctx context.Context, ready func()) error
+
+// Run runs fn as the service with the given name until fn returns or the service is asked to stop.
+// Under the Windows Service Control Manager stop and shutdown requests cancel the context.
+// Everywhere else SIGINT and SIGTERM do, and systemd is told about readiness and shutdown when
+// NOTIFY_SOCKET is set.
+func Run(name string, fn RunFunc) error {
+	if managed, err := runManaged(name, fn); managed {
+		return err
+	}
+	return runConsole(fn)
+}
+
+// runConsole runs fn until it returns or the process receives SIGINT or SIGTERM.
+func runConsole(fn RunFunc) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ready := func() {
+		if err := Notify("READY=1"); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to notify service manager: %v\n", err)
+		}
+	}
+	err := fn(ctx, ready)
+	if notifyErr := Notify("STOPPING=1"); notifyErr != nil {
+		fmt.Fprintf(os.Stderr, "failed to notify service manager: %v\n", notifyErr)
+	}
+	return err
+}
+
+// Notify sends a state string such as "READY=1" or "STOPPING=1" to systemd using the sd_notify protocol.
+// It does nothing when the process was not started by systemd with Type=notify.
+func Notify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:] // abstract socket namespace
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
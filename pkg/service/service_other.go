@@ -0,0 +1,8 @@
+//go:build !windows
+
+package service
+
+// runManaged reports false: outside Windows, service managers such as systemd run the process directly.
+func runManaged(name string, fn RunFunc) (bool, error) {
+	return false, nil
+}
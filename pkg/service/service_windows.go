@@ -0,0 +1,62 @@
+//go:build windows
+
+package service
+
+import (
+	"context"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// runManaged runs fn through the Service Control Manager if the process was started as a Windows service.
+// It reports whether it did so.
+func runManaged(name string, fn RunFunc) (bool, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false, nil
+	}
+	handler := &windowsHandler{fn: fn}
+	if err := svc.Run(name, handler); err != nil {
+		return true, err
+	}
+	return true, handler.err
+}
+
+// windowsHandler adapts a RunFunc to the svc.Handler interface.
+type windowsHandler struct {
+	fn  RunFunc
+	err error
+}
+
+// Execute reports the service as running once fn is ready and cancels fn on stop or shutdown requests.
+func (h *windowsHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.fn(ctx, func() { status <- svc.Status{State: svc.Running, Accepts: accepted} })
+	}()
+
+	for {
+		select {
+		case h.err = <-done:
+			status <- svc.Status{State: svc.StopPending}
+			if h.err != nil {
+				return true, 1
+			}
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// AWSKMSKeyProvider decrypts the master key with AWS KMS. The master key is stored encrypted by a KMS key, as the
+// ciphertext blob returned by `aws kms encrypt`, so only principals allowed to decrypt with the KMS key can read it.
+// The request is signed with Signature Version 4 using the given credentials.
+type AWSKMSKeyProvider struct {
+	Region          string       // Region is the AWS region of the KMS key, such as us-east-1.
+	CiphertextBlob  string       // CiphertextBlob is the base64 encoded master key encrypted by the KMS key.
+	KeyID           string       // KeyID is the KMS key the blob was encrypted with, which KMS checks if set.
+	Endpoint        string       // Endpoint overrides the KMS endpoint of the region, for VPC endpoints.
+	AccessKeyID     string       // AccessKeyID is the AWS access key signing the request.
+	SecretAccessKey string       // SecretAccessKey is the secret of the access key.
+	SessionToken    string       // SessionToken is the token of temporary credentials, if any.
+	Client          *http.Client // Client sends the request, http.DefaultClient if nil.
+	cache           cachedKey
+}
+
+// AWSKMSKeyProviderFromEnv returns the AWSKMSKeyProvider configured by the environment: AES_KEY_KMS_CIPHERTEXT, or
+// the file named by AES_KEY_KMS_CIPHERTEXT_FILE, holds the ciphertext blob, AES_KEY_KMS_KEY_ID the optional key and
+// AES_KEY_KMS_ENDPOINT the optional endpoint. The region and credentials are read from the standard AWS_REGION (or
+// AWS_DEFAULT_REGION), AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN variables.
+func AWSKMSKeyProviderFromEnv() (*AWSKMSKeyProvider, error) {
+	blob, err := readKey("AES_KEY_KMS_CIPHERTEXT", "AES_KEY_KMS_CIPHERTEXT_FILE")
+	if err != nil {
+		return nil, err
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	provider := &AWSKMSKeyProvider{
+		Region:          region,
+		CiphertextBlob:  blob,
+		KeyID:           os.Getenv("AES_KEY_KMS_KEY_ID"),
+		Endpoint:        os.Getenv("AES_KEY_KMS_ENDPOINT"),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if provider.CiphertextBlob == "" {
+		return nil, errors.New("the aws-kms key provider requires AES_KEY_KMS_CIPHERTEXT or AES_KEY_KMS_CIPHERTEXT_FILE")
+	}
+	if provider.Region == "" {
+		return nil, errors.New("the aws-kms key provider requires AWS_REGION")
+	}
+	if provider.AccessKeyID == "" || provider.SecretAccessKey == "" {
+		return nil, errors.New("the aws-kms key provider requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return provider, nil
+}
+
+func (*AWSKMSKeyProvider) Name() string { return "aws-kms" }
+
+// Key decrypts the ciphertext blob with KMS the first time it is called and returns the same key afterwards.
+func (p *AWSKMSKeyProvider) Key(ctx context.Context) ([]byte, error) {
+	return p.cache.get(ctx, p.decrypt)
+}
+
+// decrypt calls the Decrypt action of KMS on the ciphertext blob.
+func (p *AWSKMSKeyProvider) decrypt(ctx context.Context) ([]byte, error) {
+	request := map[string]string{"CiphertextBlob": p.CiphertextBlob}
+	if p.KeyID != "" {
+		request["KeyId"] = p.KeyID
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://kms.%s.amazonaws.com/", p.Region)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+	SignAWSRequest(req, AWSPayloadHash(body), "kms", p.Region, p.AccessKeyID, p.SecretAccessKey, p.SessionToken, time.Now())
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach AWS KMS: %v", err)
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the AWS KMS response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("AWS KMS returned %s: %s", resp.Status, strings.TrimSpace(string(content)))
+	}
+	var response struct {
+		Plaintext string `json:"Plaintext"`
+	}
+	if err := json.Unmarshal(content, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse the AWS KMS response: %v", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(response.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the key returned by AWS KMS: %v", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UnsignedPayload is the payload hash of requests whose body is streamed without being hashed, which S3 accepts.
+const UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// AWSPayloadHash returns the hex encoded SHA-256 of a request body, as SignAWSRequest takes it.
+func AWSPayloadHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// SignAWSRequest signs the request with AWS Signature Version 4 for the service and region, as made at now, setting
+// its X-Amz-Date, X-Amz-Security-Token and Authorization headers. The host of the request and every header set on it
+// before are signed; the host is not added to the headers, which net/http sends from the URL. The path is signed as
+// escaped in the URL, and the query parameters sorted by name and then value and escaped with AWSURIEncode, so
+// requests built with AWSCanonicalQuery are sent as they are signed.
+//
+// Parameters:
+// - req: The request to sign.
+// - payloadHash: The hex encoded SHA-256 of the body, see AWSPayloadHash, or UnsignedPayload.
+// - service: The signing name of the service, such as s3 or kms.
+// - region: The region the request is sent to, such as us-east-1.
+// - accessKeyID, secretAccessKey: The access key signing the request and its secret.
+// - sessionToken: The token of temporary credentials, none if empty.
+// - now: When the request is made.
+func SignAWSRequest(req *http.Request, payloadHash, service, region, accessKeyID, secretAccessKey, sessionToken string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		if !strings.EqualFold(name, "Host") {
+			headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		AWSCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	for _, part := range []string{region, service, "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKeyID, scope, signedHeaders, signature))
+}
+
+// AWSCanonicalQuery returns the canonical query string of Signature Version 4: the parameters sorted by name and then
+// value, both escaped with AWSURIEncode.
+func AWSCanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return AWSURIEncode(names[i], true) < AWSURIEncode(names[j], true) })
+	var pairs []string
+	for _, name := range names {
+		values := make([]string, len(query[name]))
+		for i, value := range query[name] {
+			values[i] = AWSURIEncode(value, true)
+		}
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, AWSURIEncode(name, true)+"="+value)
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// AWSURIEncode percent-encodes every byte of s but the unreserved characters, and slashes unless encodeSlash is set,
+// as Signature Version 4 expects.
+func AWSURIEncode(s string, encodeSlash bool) string {
+	var escaped strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of the data with the key.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
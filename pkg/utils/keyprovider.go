@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyProvider supplies the master AES key, so that it can be kept in a key management service instead of the
+// environment or a file on disk.
+type KeyProvider interface {
+	Name() string                            // Name is the name the provider is selected with in KeyProviderVariable.
+	Key(ctx context.Context) ([]byte, error) // Key returns the master key, or an error if it is not available yet.
+}
+
+// KeyProviderVariable is the environment variable naming the provider NewUtils gets the master key from: "env", the
+// default, "file", "aws-kms" or "vault". Each provider is configured with its own environment variables, see
+// EnvKeyProvider, FileKeyProvider, AWSKMSKeyProvider and VaultKeyProvider.
+const KeyProviderVariable = "DBPROTO_KEY_PROVIDER"
+
+// keyProviderTimeout bounds the time NewUtils waits for a remote provider.
+const keyProviderTimeout = 10 * time.Second
+
+var keyProvider struct {
+	sync.Mutex
+	provider KeyProvider // Provider set by SetKeyProvider or built from the environment for a remote service, nil for the default
+}
+
+// SetKeyProvider makes NewUtils get the master key from the given provider instead of the one named by
+// KeyProviderVariable. A nil provider restores the provider of the environment.
+func SetKeyProvider(provider KeyProvider) {
+	keyProvider.Lock()
+	defer keyProvider.Unlock()
+	keyProvider.provider = provider
+}
+
+// configuredKeyProvider returns the provider NewUtils gets the master key from. The environment and file providers are
+// built again on every call, so that a key set later is picked up, while a remote provider is built once and keeps
+// the key it fetched.
+func configuredKeyProvider() (KeyProvider, error) {
+	keyProvider.Lock()
+	defer keyProvider.Unlock()
+	if keyProvider.provider != nil {
+		return keyProvider.provider, nil
+	}
+
+	var err error
+	switch name := os.Getenv(KeyProviderVariable); name {
+	case "", "env":
+		if os.Getenv("AES_KEY") == "" && os.Getenv("AES_KEY_FILE") != "" {
+			return FileKeyProvider{Path: os.Getenv("AES_KEY_FILE")}, nil
+		}
+		return EnvKeyProvider{Variable: "AES_KEY"}, nil
+	case "file":
+		return FileKeyProvider{Path: os.Getenv("AES_KEY_FILE")}, nil
+	case "aws-kms":
+		keyProvider.provider, err = AWSKMSKeyProviderFromEnv()
+	case "vault":
+		keyProvider.provider, err = VaultKeyProviderFromEnv()
+	default:
+		return nil, fmt.Errorf("unknown key provider %q in %s, expected env, file, aws-kms or vault", name, KeyProviderVariable)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return keyProvider.provider, nil
+}
+
+// EnvKeyProvider reads the master key from an environment variable, AES_KEY by default. It is the default provider;
+// if AES_KEY is unset and AES_KEY_FILE is set, the FileKeyProvider of that file is used instead.
+type EnvKeyProvider struct {
+	Variable string // Variable is the environment variable holding the key, AES_KEY if empty.
+}
+
+func (EnvKeyProvider) Name() string { return "env" }
+
+func (p EnvKeyProvider) Key(ctx context.Context) ([]byte, error) {
+	variable := p.Variable
+	if variable == "" {
+		variable = "AES_KEY"
+	}
+	return []byte(os.Getenv(variable)), nil
+}
+
+// FileKeyProvider reads the master key from a file, such as a mounted secret, named by AES_KEY_FILE when built from
+// the environment. A trailing line break is ignored.
+type FileKeyProvider struct {
+	Path string // Path is the file holding the key.
+}
+
+func (FileKeyProvider) Name() string { return "file" }
+
+func (p FileKeyProvider) Key(ctx context.Context) ([]byte, error) {
+	if p.Path == "" {
+		return nil, errors.New("no AES key file is set")
+	}
+	content, err := os.ReadFile(p.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read AES key file: %v", err)
+	}
+	return []byte(strings.TrimRight(string(content), "\r\n")), nil
+}
+
+// cachedKey holds the key a remote provider fetched, so that the service is called once per process.
+type cachedKey struct {
+	sync.Mutex
+	key []byte
+}
+
+// get returns the cached key, fetching it first if it has not been fetched yet. Failed fetches are not cached.
+func (c *cachedKey) get(ctx context.Context, fetch func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.key != nil {
+		return c.key, nil
+	}
+	key, err := fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.key = key
+	return key, nil
+}
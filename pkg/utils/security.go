@@ -1,69 +1,288 @@
 package utils
 
 import (
+	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
 )
 
 // Utils is a utility structure that holds the AES key.
 type Utils struct {
-	aesKey []byte
+	aesKey       []byte
+	previousKeys [][]byte // Keys that still decrypt, but no longer encrypt, data during a key rotation
 }
 
 // NewUtils creates a new Utils instance with the AES key from the environment variable.
-// The AES key must be exactly 32 bytes (256 bits) long.
+// If AES_KEY is unset, the key is read from the file named by AES_KEY_FILE, such as a mounted secret.
+// The key is fetched from AWS KMS or HashiCorp Vault instead if DBPROTO_KEY_PROVIDER names them, or from
+// the provider set with SetKeyProvider.
+// During a key rotation, data encrypted with the key in AES_PREVIOUS_KEY, or the file named by
+// AES_PREVIOUS_KEY_FILE, is decrypted as well. The AES keys must be exactly 32 bytes (256 bits) long.
 func NewUtils() (*Utils, error) {
-	key := os.Getenv("AES_KEY")
+	provider, err := configuredKeyProvider()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), keyProviderTimeout)
+	defer cancel()
+	key, err := provider.Key(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the AES key from the %s key provider: %v", provider.Name(), err)
+	}
 	if len(key) != 32 {
 		return nil, errors.New("AES key must be exactly 32 bytes (256 bits) long")
 	}
-	return &Utils{
+	u := &Utils{
 		aesKey: []byte(key),
-	}, nil
+	}
+
+	previous, err := readKey("AES_PREVIOUS_KEY", "AES_PREVIOUS_KEY_FILE")
+	if err != nil {
+		return nil, err
+	}
+	if previous != "" {
+		if len(previous) != 32 {
+			return nil, errors.New("previous AES key must be exactly 32 bytes (256 bits) long")
+		}
+		u.previousKeys = [][]byte{[]byte(previous)}
+	}
+	return u, nil
+}
+
+// readKey reads a key or secret from the environment variable, or from the file named by fileVariable if it is unset.
+func readKey(variable, fileVariable string) (string, error) {
+	key := os.Getenv(variable)
+	if key == "" {
+		if keyFile := os.Getenv(fileVariable); keyFile != "" {
+			content, err := os.ReadFile(keyFile)
+			if err != nil {
+				return "", fmt.Errorf("failed to read %s: %v", fileVariable, err)
+			}
+			key = strings.TrimRight(string(content), "\r\n")
+		}
+	}
+	return key, nil
+}
+
+// Rotate returns a Utils instance that encrypts with the new key and decrypts data encrypted with the new key,
+// the key of u or any key u still decrypts with. Data in the legacy CTR format is decrypted with the new key only.
+// The new key must be exactly 32 bytes (256 bits) long and differ from the key of u.
+func (u *Utils) Rotate(newKey []byte) (*Utils, error) {
+	if bytes.Equal(newKey, u.aesKey) {
+		return nil, errors.New("the new AES key is the current key")
+	}
+	return u.WithKeys(newKey)
+}
+
+// WithKeys returns a Utils instance that encrypts with the key and decrypts data encrypted with the key, any of the
+// previous keys, the key of u or any key u still decrypts with, tried in that order. Data in the legacy CTR format is
+// decrypted with the key only. Every key must be exactly 32 bytes (256 bits) long.
+func (u *Utils) WithKeys(key []byte, previous ...[]byte) (*Utils, error) {
+	keys := append(append([][]byte{key}, previous...), u.aesKey)
+	keys = append(keys, u.previousKeys...)
+	derived := &Utils{}
+	for _, candidate := range keys {
+		if len(candidate) != 32 {
+			return nil, errors.New("AES key must be exactly 32 bytes (256 bits) long")
+		}
+		if derived.aesKey == nil {
+			derived.aesKey = append([]byte(nil), candidate...)
+		} else if !derived.decryptsWith(candidate) {
+			derived.previousKeys = append(derived.previousKeys, candidate)
+		}
+	}
+	return derived, nil
+}
+
+// decryptsWith reports whether the key is the key of u or one of its previous keys.
+func (u *Utils) decryptsWith(key []byte) bool {
+	if bytes.Equal(key, u.aesKey) {
+		return true
+	}
+	for _, previous := range u.previousKeys {
+		if bytes.Equal(key, previous) {
+			return true
+		}
+	}
+	return false
 }
 
-// Encrypt encrypts the given data using AES encryption in CTR mode.
-// A random Initialization Vector (IV) is generated for each encryption operation.
-// The IV is prepended to the ciphertext and base64 encoded.
+// GenerateKey returns a random AES key, 32 bytes (256 bits) long.
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// WrapKey encrypts a key with the key of u, so that it can be stored next to the data it encrypts.
+func (u *Utils) WrapKey(key []byte) (string, error) {
+	return u.Encrypt(key)
+}
+
+// UnwrapKey decrypts a key encrypted by WrapKey with the key of u or a previous key.
+func (u *Utils) UnwrapKey(wrapped string) ([]byte, error) {
+	envelope, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(string(envelope), envelopeMagic) {
+		return nil, errors.New("wrapped key is not an envelope")
+	}
+	key, err := u.Decrypt(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, errors.New("wrapped key is not 32 bytes (256 bits) long")
+	}
+	return key, nil
+}
+
+// envelopeMagic starts every envelope produced by Encrypt, telling it apart from the legacy CTR format, which
+// starts with a random IV instead. A legacy IV starts with the same bytes with a probability of 2^-32.
+const envelopeMagic = "dbpE"
+
+// EnvelopeVersion is the version byte that follows envelopeMagic in the envelopes produced by Encrypt: AES-GCM
+// with a random 12 byte nonce, which authenticates the ciphertext and the envelope header.
+const EnvelopeVersion byte = 1
+
+// ErrAuthenticationFailed is returned by Decrypt for envelopes that were modified or encrypted with another key.
+var ErrAuthenticationFailed = errors.New("ciphertext failed authentication, it is corrupted or was encrypted with another key")
+
+// Encrypt encrypts the given data using AES in GCM mode, which detects any change to the ciphertext.
+// The envelope holds envelopeMagic, the EnvelopeVersion byte, a random nonce and the sealed data, and is base64 encoded.
 func (u *Utils) Encrypt(data []byte) (string, error) {
-	block, err := aes.NewCipher(u.aesKey)
+	gcm, err := newGCM(u.aesKey)
 	if err != nil {
 		return "", err
 	}
 
-	// Create a byte slice to hold the IV and the ciphertext.
-	cipherText := make([]byte, aes.BlockSize+len(data))
+	// Create a byte slice holding the header and the nonce, which the sealed data is appended to.
+	header := append([]byte(envelopeMagic), EnvelopeVersion)
+	envelope := make([]byte, len(header)+gcm.NonceSize(), len(header)+gcm.NonceSize()+len(data)+gcm.Overhead())
+	copy(envelope, header)
 
-	// Generate a random IV.
-	iv := cipherText[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	// Generate a random nonce.
+	nonce := envelope[len(header):]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return "", err
 	}
 
-	// Create a new CTR stream cipher using the block cipher and the IV.
-	stream := cipher.NewCTR(block, iv)
+	// Encrypt and authenticate the data, and authenticate the header with it.
+	envelope = gcm.Seal(envelope, nonce, data, header)
+
+	// Encode the envelope to base64.
+	return base64.StdEncoding.EncodeToString(envelope), nil
+}
 
-	// Encrypt the data using the CTR stream cipher.
-	stream.XORKeyStream(cipherText[aes.BlockSize:], data)
+// ErrLegacyCiphertext is returned by Decrypt for data in the legacy CTR format while legacy ciphertext is rejected,
+// see SetRejectLegacyCiphertext.
+var ErrLegacyCiphertext = errors.New("ciphertext is in the legacy CTR format, which has no integrity check, and legacy ciphertext is rejected")
 
-	// Encode the ciphertext to base64.
-	return base64.StdEncoding.EncodeToString(cipherText), nil
+// RejectLegacyCiphertextVariable is the environment variable that makes Decrypt reject data in the legacy CTR format
+// when set to true, like SetRejectLegacyCiphertext.
+const RejectLegacyCiphertextVariable = "DBPROTO_REJECT_LEGACY_CIPHERTEXT"
+
+// rejectLegacy is set by SetRejectLegacyCiphertext.
+var rejectLegacy atomic.Bool
+
+// SetRejectLegacyCiphertext makes Decrypt fail with ErrLegacyCiphertext for data in the legacy CTR format, which is
+// not authenticated, instead of decrypting it, once every file has been written again as an envelope. Legacy
+// ciphertext is also rejected while RejectLegacyCiphertextVariable is set to true.
+func SetRejectLegacyCiphertext(reject bool) {
+	rejectLegacy.Store(reject)
 }
 
-// Decrypt decrypts the given base64 encoded data using AES encryption in CTR mode.
-// The IV is extracted from the ciphertext and used to initialize the cipher.
+// rejectsLegacyCiphertext reports whether Decrypt rejects data in the legacy CTR format.
+func rejectsLegacyCiphertext() bool {
+	if rejectLegacy.Load() {
+		return true
+	}
+	reject, _ := strconv.ParseBool(os.Getenv(RejectLegacyCiphertextVariable))
+	return reject
+}
+
+// IsLegacyCiphertext reports whether the base64 encoded data is in the legacy CTR format rather than an envelope
+// produced by Encrypt, decoding only the start of the data. Data that is not base64 is neither.
+func IsLegacyCiphertext(data string) bool {
+	// Eight base64 characters decode to six bytes, enough to hold envelopeMagic.
+	start := data
+	if len(start) > 8 {
+		start = start[:8]
+	}
+	decoded, err := base64.StdEncoding.DecodeString(start)
+	return err == nil && !strings.HasPrefix(string(decoded), envelopeMagic)
+}
+
+// Decrypt decrypts the given base64 encoded data produced by Encrypt with the key or, during a key rotation, a
+// previous key. Data in the legacy format, AES in CTR mode
+// with the IV prepended, is still decrypted, without any integrity check, so that files written before envelopes
+// existed stay readable until they are written again, unless legacy ciphertext is rejected with
+// SetRejectLegacyCiphertext or RejectLegacyCiphertextVariable. IsLegacyCiphertext tells which format data is in.
 func (u *Utils) Decrypt(data string) ([]byte, error) {
 	// Decode the base64 encoded data.
 	cipherText, err := base64.StdEncoding.DecodeString(data)
 	if err != nil {
 		return nil, err
 	}
+	if !strings.HasPrefix(string(cipherText), envelopeMagic) {
+		if rejectsLegacyCiphertext() {
+			return nil, ErrLegacyCiphertext
+		}
+		return u.decryptCTR(cipherText)
+	}
+
+	if len(cipherText) <= len(envelopeMagic) {
+		return nil, errors.New("cipherText too short")
+	}
+	header := cipherText[:len(envelopeMagic)+1]
+	if version := header[len(envelopeMagic)]; version != EnvelopeVersion {
+		return nil, fmt.Errorf("unsupported envelope version %d", version)
+	}
+
+	// Open the sealed data with the current key first, then with the previous keys during a key rotation.
+	for _, key := range append([][]byte{u.aesKey}, u.previousKeys...) {
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(cipherText) < len(header)+gcm.NonceSize()+gcm.Overhead() {
+			return nil, errors.New("cipherText too short")
+		}
+
+		// Extract the nonce following the header, and open the sealed data after it.
+		nonce := cipherText[len(header) : len(header)+gcm.NonceSize()]
+		if plainText, err := gcm.Open(nil, nonce, cipherText[len(header)+gcm.NonceSize():], header); err == nil {
+			return plainText, nil
+		}
+	}
+	return nil, ErrAuthenticationFailed
+}
+
+// newGCM returns the AES-GCM cipher of the key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
 
+// decryptCTR decrypts data in the legacy format, AES in CTR mode with the IV prepended to the ciphertext.
+func (u *Utils) decryptCTR(cipherText []byte) ([]byte, error) {
 	// Ensure the ciphertext is at least as long as the AES block size.
 	if len(cipherText) < aes.BlockSize {
 		return nil, errors.New("cipherText too short")
@@ -88,3 +307,67 @@ func (u *Utils) Decrypt(data string) ([]byte, error) {
 
 	return plainText, nil
 }
+
+// CiphertextPrefix marks field values that were encrypted by a client before being sent to the server.
+const CiphertextPrefix = "enc:"
+
+// NewUtilsWithKey creates a new Utils instance with the given AES key instead of the environment variable.
+// The AES key must be exactly 32 bytes (256 bits) long.
+func NewUtilsWithKey(key []byte) (*Utils, error) {
+	if len(key) != 32 {
+		return nil, errors.New("AES key must be exactly 32 bytes (256 bits) long")
+	}
+	return &Utils{
+		aesKey: append([]byte(nil), key...),
+	}, nil
+}
+
+// EncryptValue serializes a field value as JSON and encrypts it, returning an opaque string marked with CiphertextPrefix.
+func (u *Utils) EncryptValue(value interface{}) (string, error) {
+	plainText, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	cipherText, err := u.Encrypt(plainText)
+	if err != nil {
+		return "", err
+	}
+	return CiphertextPrefix + cipherText, nil
+}
+
+// DecryptValue reverses EncryptValue. Values that are not strings marked with CiphertextPrefix are returned unchanged;
+// marked values encrypted in the legacy CTR format before envelopes existed are decrypted like Decrypt does.
+func (u *Utils) DecryptValue(value interface{}) (interface{}, error) {
+	s, ok := value.(string)
+	if !ok || !strings.HasPrefix(s, CiphertextPrefix) {
+		return value, nil
+	}
+	plainText, err := u.Decrypt(strings.TrimPrefix(s, CiphertextPrefix))
+	if err != nil {
+		return nil, err
+	}
+	var decrypted interface{}
+	if err := json.Unmarshal(plainText, &decrypted); err != nil {
+		return nil, err
+	}
+	return decrypted, nil
+}
+
+// minEnvelopeSize is the size of an envelope of empty data: envelopeMagic, the version byte, the nonce and the
+// authentication tag of AES-GCM.
+const minEnvelopeSize = len(envelopeMagic) + 1 + 12 + 16
+
+// IsCiphertext reports whether the value is a string produced by EncryptValue: CiphertextPrefix followed by a base64
+// envelope of the current version, at least long enough to hold its nonce and authentication tag. Plaintext that only
+// starts with CiphertextPrefix is not ciphertext, and neither are values of the legacy CTR format.
+func IsCiphertext(value interface{}) bool {
+	s, ok := value.(string)
+	if !ok || !strings.HasPrefix(s, CiphertextPrefix) {
+		return false
+	}
+	envelope, err := base64.StdEncoding.DecodeString(s[len(CiphertextPrefix):])
+	if err != nil || len(envelope) < minEnvelopeSize || !strings.HasPrefix(string(envelope), envelopeMagic) {
+		return false
+	}
+	return envelope[len(envelopeMagic)] == EnvelopeVersion
+}
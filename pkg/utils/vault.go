@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// VaultKeyProvider reads the master key from a secret of HashiCorp Vault, stored in either version of the key/value
+// secrets engine.
+type VaultKeyProvider struct {
+	Address   string       // Address is the address of the Vault server, such as https://vault.example.com:8200.
+	Token     string       // Token authenticates the request.
+	Namespace string       // Namespace is the Vault Enterprise namespace of the secret, if any.
+	Path      string       // Path is the API path of the secret, such as secret/data/dbproto for version 2.
+	Field     string       // Field is the field of the secret holding the key, aes_key if empty.
+	Client    *http.Client // Client sends the request, http.DefaultClient if nil.
+	cache     cachedKey
+}
+
+// VaultKeyProviderFromEnv returns the VaultKeyProvider configured by the environment: the standard VAULT_ADDR,
+// VAULT_TOKEN (or the file named by VAULT_TOKEN_FILE) and VAULT_NAMESPACE variables, AES_KEY_VAULT_PATH for the
+// path of the secret and AES_KEY_VAULT_FIELD for its field.
+func VaultKeyProviderFromEnv() (*VaultKeyProvider, error) {
+	token, err := readKey("VAULT_TOKEN", "VAULT_TOKEN_FILE")
+	if err != nil {
+		return nil, err
+	}
+	provider := &VaultKeyProvider{
+		Address:   os.Getenv("VAULT_ADDR"),
+		Token:     token,
+		Namespace: os.Getenv("VAULT_NAMESPACE"),
+		Path:      os.Getenv("AES_KEY_VAULT_PATH"),
+		Field:     os.Getenv("AES_KEY_VAULT_FIELD"),
+	}
+	if provider.Address == "" || provider.Path == "" {
+		return nil, errors.New("the vault key provider requires VAULT_ADDR and AES_KEY_VAULT_PATH")
+	}
+	if provider.Token == "" {
+		return nil, errors.New("the vault key provider requires VAULT_TOKEN or VAULT_TOKEN_FILE")
+	}
+	return provider, nil
+}
+
+func (*VaultKeyProvider) Name() string { return "vault" }
+
+// Key reads the secret from Vault the first time it is called and returns the same key afterwards.
+func (p *VaultKeyProvider) Key(ctx context.Context) ([]byte, error) {
+	return p.cache.get(ctx, p.read)
+}
+
+// read reads the field of the secret from Vault.
+func (p *VaultKeyProvider) read(ctx context.Context) ([]byte, error) {
+	url := strings.TrimSuffix(p.Address, "/") + "/v1/" + strings.TrimPrefix(p.Path, "/")
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", p.Token)
+	if p.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.Namespace)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach Vault: %v", err)
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the Vault response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Vault returned %s: %s", resp.Status, strings.TrimSpace(string(content)))
+	}
+
+	// Version 2 of the key/value engine nests the fields of the secret under data.data, version 1 under data
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(content, &secret); err != nil {
+		return nil, fmt.Errorf("failed to parse the Vault response: %v", err)
+	}
+	fields := secret.Data
+	if nested, ok := fields["data"].(map[string]interface{}); ok {
+		fields = nested
+	}
+	field := p.Field
+	if field == "" {
+		field = "aes_key"
+	}
+	key, ok := fields[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("the Vault secret %s has no string field %s", p.Path, field)
+	}
+	return []byte(key), nil
+}